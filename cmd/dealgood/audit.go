@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// Outcomes of a request for a single target recorded by a ReplayAudit.
+const (
+	auditSent      = "sent"      // the request was sent and a response received
+	auditFailed    = "failed"    // the request was sent but no response was received
+	auditCached    = "cached"    // the request was served by the target's emulated cache
+	auditSkipped   = "skipped"   // the target's guard held the request back
+	auditDropped   = "dropped"   // the target's queue was full
+	auditAbandoned = "abandoned" // the request was still queued when dealgood stopped
+)
+
+// A ReplayAudit records what happened to each request read from the source for every target,
+// so that it can be shown that all targets saw the same workload rather than assuming it.
+// Requests are identified by the order in which they were read from the source.
+type ReplayAudit struct {
+	experiment string
+	targets    []string
+
+	mu       sync.Mutex
+	pending  map[uint64]*auditEntry
+	out      *bufio.Writer // optional writer of a record for each request
+	file     *os.File
+	complete map[string]int64 // number of requests sent to each target and answered
+	audited  int64            // number of requests whose outcome is known for every target
+	diverged int64            // number of audited requests not answered by every target
+
+	outcomeCounter  *prometheus.CounterVec
+	completeGauge   *prometheus.GaugeVec
+	divergedCounter *prometheus.CounterVec
+}
+
+// An auditEntry is the record of a single request written by a ReplayAudit.
+type auditEntry struct {
+	ID       uint64            `json:"id"`
+	Time     time.Time         `json:"time"`
+	Method   string            `json:"method"`
+	URI      string            `json:"uri"`
+	Outcomes map[string]string `json:"outcomes"` // outcome for each target
+}
+
+// NewReplayAudit creates an audit of the requests sent to targets. If fname is not empty a
+// record of the outcome for each target is written to it as a JSON object per request.
+func NewReplayAudit(experiment string, targets []*Target, fname string) (*ReplayAudit, error) {
+	a := &ReplayAudit{
+		experiment: experiment,
+		pending:    make(map[uint64]*auditEntry),
+		complete:   make(map[string]int64, len(targets)),
+	}
+	for _, t := range targets {
+		a.targets = append(a.targets, t.Name)
+	}
+
+	var err error
+	a.outcomeCounter, err = newCounterMetric(
+		"audit_outcomes_total",
+		"The number of requests read from the source by what happened to them for each target.",
+		[]string{"experiment", "target", "outcome"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	a.completeGauge, err = newGaugeMetric(
+		"audit_completeness_ratio",
+		"The share of requests read from the source that were sent to a target and answered.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	a.divergedCounter, err = newCounterMetric(
+		"audit_diverged_requests_total",
+		"The number of requests read from the source that were not sent to and answered by every target.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	if fname != "" {
+		a.file, err = os.Create(fname)
+		if err != nil {
+			return nil, fmt.Errorf("create audit file: %w", err)
+		}
+		a.out = bufio.NewWriter(a.file)
+	}
+
+	return a, nil
+}
+
+// Begin starts the audit of a request read from the source.
+func (a *ReplayAudit) Begin(id uint64, r *request.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[id] = &auditEntry{
+		ID:       id,
+		Time:     time.Now().UTC(),
+		Method:   r.Method,
+		URI:      r.URI,
+		Outcomes: make(map[string]string, len(a.targets)),
+	}
+}
+
+// Outcome records what happened to a request for a target.
+func (a *ReplayAudit) Outcome(id uint64, target string, outcome string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.pending[id]
+	if !ok {
+		return
+	}
+	e.Outcomes[target] = outcome
+	if len(e.Outcomes) == len(a.targets) {
+		a.finish(e)
+	}
+}
+
+// Result records the outcome of a request for a target from its timings, nil if it was served
+// by the target's emulated cache.
+func (a *ReplayAudit) Result(id uint64, target string, rt *RequestTiming) {
+	switch {
+	case rt == nil:
+		a.Outcome(id, target, auditCached)
+	case rt.StatusCode == 0:
+		a.Outcome(id, target, auditFailed)
+	default:
+		a.Outcome(id, target, auditSent)
+	}
+}
+
+// finish completes the audit of a request once its outcome for every target is known. The
+// caller must hold a.mu.
+func (a *ReplayAudit) finish(e *auditEntry) {
+	delete(a.pending, e.ID)
+	a.audited++
+
+	diverged := false
+	for _, target := range a.targets {
+		outcome := e.Outcomes[target]
+		if outcome == auditSent {
+			a.complete[target]++
+		} else {
+			diverged = true
+		}
+		a.outcomeCounter.WithLabelValues(a.experiment, target, outcome).Add(1)
+		a.completeGauge.WithLabelValues(a.experiment, target).Set(float64(a.complete[target]) / float64(a.audited))
+	}
+	if diverged {
+		a.diverged++
+		a.divergedCounter.WithLabelValues(a.experiment).Add(1)
+	}
+
+	if a.out != nil {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		a.out.Write(data)
+		a.out.WriteByte('\n')
+	}
+}
+
+// Close completes the audit of requests that were still waiting to be sent to some targets,
+// which are recorded as abandoned, and closes the audit file.
+func (a *ReplayAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := make([]uint64, 0, len(a.pending))
+	for id := range a.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		e := a.pending[id]
+		for _, target := range a.targets {
+			if _, ok := e.Outcomes[target]; !ok {
+				e.Outcomes[target] = auditAbandoned
+			}
+		}
+		a.finish(e)
+	}
+
+	if a.file == nil {
+		return nil
+	}
+	if err := a.out.Flush(); err != nil {
+		a.file.Close()
+		return fmt.Errorf("write audit file: %w", err)
+	}
+	return a.file.Close()
+}
+
+// Report prints the share of requests each target was sent and answered.
+func (a *ReplayAudit) Report(w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.audited == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Replay audit: %d requests, %d not answered by every target\n", a.audited, a.diverged)
+	for _, target := range a.targets {
+		fmt.Fprintf(w, "  %s: %.2f%% complete\n", target, 100*float64(a.complete[target])/float64(a.audited))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A StartBarrier holds back the start of the measured window until every target has answered
+// a probe, the request source has delivered its first request and, when metrics are scraped,
+// Prometheus has scraped dealgood since the workers started. Requests sent and metrics
+// recorded while the experiment is still warming up would otherwise be mixed into its results.
+// The boundaries of the measured window are exported as metrics so results can be read for
+// exactly that period.
+type StartBarrier struct {
+	experiment string
+	scrapes    *ScrapeNotifier // nil when metrics are not scraped, in which case scrapes are not waited for
+	timeout    time.Duration   // maximum time to wait for a scrape, after which the window starts anyway
+
+	mu      sync.Mutex
+	scraped <-chan struct{} // closed by the first scrape after the barrier is armed, nil until then
+
+	stageGauge *prometheus.GaugeVec
+	startGauge *prometheus.GaugeVec
+	endGauge   *prometheus.GaugeVec
+}
+
+func NewStartBarrier(experiment string, scrapes *ScrapeNotifier, timeout time.Duration) (*StartBarrier, error) {
+	b := &StartBarrier{
+		experiment: experiment,
+		scrapes:    scrapes,
+		timeout:    timeout,
+	}
+
+	var err error
+	b.stageGauge, err = newGaugeMetric(
+		"start_barrier_wait_seconds",
+		"The time spent waiting at each stage of the start barrier: targets, stream and scrape.",
+		[]string{"experiment", "stage"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	b.startGauge, err = newGaugeMetric(
+		"window_start_timestamp_seconds",
+		"The unix time the measured window of the experiment started, once the start barrier was passed.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	b.endGauge, err = newGaugeMetric(
+		"window_end_timestamp_seconds",
+		"The unix time the measured window of the experiment ended.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return b, nil
+}
+
+// ArmScrape starts waiting for a scrape. Only scrapes made after this call, which include the
+// metrics registered by the loader, release the barrier.
+func (b *StartBarrier) ArmScrape() {
+	if b.scrapes == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.scraped == nil {
+		b.scraped = b.scrapes.Next()
+	}
+}
+
+// Stage records the time spent waiting at a stage of the barrier.
+func (b *StartBarrier) Stage(stage string, d time.Duration) {
+	b.stageGauge.WithLabelValues(b.experiment, stage).Set(d.Seconds())
+}
+
+// WaitScrape waits until metrics have been scraped since the barrier was armed. If no scrape is
+// made within the barrier's timeout it returns false and the window should start anyway. It
+// returns immediately if metrics are not scraped.
+func (b *StartBarrier) WaitScrape(ctx context.Context) (bool, error) {
+	if b.scrapes == nil {
+		return true, nil
+	}
+	b.ArmScrape()
+	b.mu.Lock()
+	scraped := b.scraped
+	b.mu.Unlock()
+
+	start := time.Now()
+	defer func() { b.Stage("scrape", time.Since(start)) }()
+
+	t := time.NewTimer(b.timeout)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-t.C:
+		return false, nil
+	case <-scraped:
+		return true, nil
+	}
+}
+
+// Started records the start of the measured window.
+func (b *StartBarrier) Started(t time.Time) {
+	b.startGauge.WithLabelValues(b.experiment).Set(float64(t.UnixNano()) / 1e9)
+}
+
+// Ended records the end of the measured window.
+func (b *StartBarrier) Ended(t time.Time) {
+	b.endGauge.WithLabelValues(b.experiment).Set(float64(t.UnixNano()) / 1e9)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+)
+
+// Modes requested by the first byte a client sends to a baseline server.
+const (
+	baselineModePing     = 'P' // echo each byte sent by the client
+	baselineModeDownload = 'D' // send data until the client closes the connection
+)
+
+// baselinePings is the number of round trips timed to measure the RTT to a target.
+const baselinePings = 20
+
+// A NetworkBaseline measures the round trip time and throughput between dealgood and a
+// baseline server running alongside each target before the measured window starts. Targets
+// that differ only in the network path to them would otherwise be indistinguishable from
+// targets that differ in performance.
+type NetworkBaseline struct {
+	experiment string
+	port       int           // port of the baseline server on each target's host
+	duration   time.Duration // time spent measuring the throughput to each target
+
+	rttGauge        *prometheus.GaugeVec
+	throughputGauge *prometheus.GaugeVec
+}
+
+func NewNetworkBaseline(experiment string, port int, duration time.Duration) (*NetworkBaseline, error) {
+	b := &NetworkBaseline{
+		experiment: experiment,
+		port:       port,
+		duration:   duration,
+	}
+
+	var err error
+	b.rttGauge, err = newGaugeMetric(
+		"network_baseline_rtt_seconds",
+		"The median round trip time between dealgood and the host of a target, measured before the measured window started.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	b.throughputGauge, err = newGaugeMetric(
+		"network_baseline_throughput_bytes_per_second",
+		"The throughput of a single tcp connection from the host of a target to dealgood, measured before the measured window started.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return b, nil
+}
+
+// Run measures the network path to each target in turn, so that the measurements do not
+// compete for dealgood's bandwidth. Remote targets are skipped since nothing runs alongside
+// them. Targets that cannot be measured are reported but do not stop the experiment.
+func (b *NetworkBaseline) Run(ctx context.Context, targets []*Target, quiet bool) {
+	for _, target := range targets {
+		if target.Guard != nil {
+			continue
+		}
+		host, _, err := net.SplitHostPort(target.RawHostPort)
+		if err != nil {
+			host = target.RawHostPort
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(b.port))
+
+		rtt, err := baselineRTT(ctx, addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "network baseline: target %s: rtt: %v\n", target.Name, err)
+			continue
+		}
+		b.rttGauge.WithLabelValues(b.experiment, target.Name).Set(rtt.Seconds())
+
+		throughput, err := baselineThroughput(ctx, addr, b.duration)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "network baseline: target %s: throughput: %v\n", target.Name, err)
+			continue
+		}
+		b.throughputGauge.WithLabelValues(b.experiment, target.Name).Set(throughput)
+
+		if !quiet {
+			fmt.Printf("network baseline of %s: rtt %s, throughput %.1f Mbit/s\n", target.Name, rtt, throughput*8/1e6)
+		}
+	}
+}
+
+// baselineRTT returns the median time taken to echo a single byte over a connection to the
+// baseline server at addr.
+func baselineRTT(ctx context.Context, addr string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	conn, err := dialBaseline(ctx, addr, baselineModePing)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	samples := make([]time.Duration, 0, baselinePings)
+	buf := []byte{0}
+	for i := 0; i < baselinePings; i++ {
+		start := time.Now()
+		if _, err := conn.Write(buf); err != nil {
+			return 0, fmt.Errorf("write: %w", err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return 0, fmt.Errorf("read: %w", err)
+		}
+		samples = append(samples, time.Since(start))
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[len(samples)/2], nil
+}
+
+// baselineThroughput returns the rate in bytes per second at which the baseline server at
+// addr sends data over a single connection, measured for the given duration.
+func baselineThroughput(ctx context.Context, addr string, d time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, d+10*time.Second)
+	defer cancel()
+
+	conn, err := dialBaseline(ctx, addr, baselineModeDownload)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// skip the first part of the transfer while tcp slow start ramps up
+	buf := make([]byte, 64*1024)
+	warmup := time.Now().Add(d / 5)
+	for time.Now().Before(warmup) {
+		if _, err := conn.Read(buf); err != nil {
+			return 0, fmt.Errorf("read: %w", err)
+		}
+	}
+
+	var total int64
+	start := time.Now()
+	end := start.Add(d)
+	for time.Now().Before(end) {
+		n, err := conn.Read(buf)
+		total += int64(n)
+		if err != nil {
+			return 0, fmt.Errorf("read: %w", err)
+		}
+	}
+	return float64(total) / time.Since(start).Seconds(), nil
+}
+
+func dialBaseline(ctx context.Context, addr string, mode byte) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte{mode}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write mode: %w", err)
+	}
+	return conn, nil
+}
+
+var baselineServerCommand = &cli.Command{
+	Name:  "baseline-server",
+	Usage: "Serve the network baseline measured by dealgood, run alongside a target",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "listen-addr",
+			Usage:   "Address to listen on for network baseline connections.",
+			Value:   ":5201",
+			EnvVars: []string{"DEALGOOD_BASELINE_LISTEN_ADDR"},
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		return ServeBaseline(cc.Context, cc.String("listen-addr"))
+	},
+}
+
+// ServeBaseline accepts connections from dealgood on addr, echoing bytes or sending data
+// depending on the mode requested by each.
+func ServeBaseline(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	fmt.Printf("serving network baseline on %s\n", addr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+		go serveBaselineConn(conn)
+	}
+}
+
+func serveBaselineConn(conn net.Conn) {
+	defer conn.Close()
+	// no measurement takes longer than this, so a stalled client is not served forever
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	r := bufio.NewReader(conn)
+	mode, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	switch mode {
+	case baselineModePing:
+		buf := make([]byte, 1)
+		for {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	case baselineModeDownload:
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Body strategies control how much of each response body is read.
+const (
+	bodyFull    = "full"    // read the whole body, counting the bytes received
+	bodyDiscard = "discard" // close the body without reading it, timing only the response headers
+	bodyHash    = "hash"    // read the whole body and hash it so bodies can be compared across targets
+	bodyPartial = "partial" // read at most a fixed number of bytes of the body
+)
+
+// A BodyStrategy reads response bodies according to the experiment's configuration.
+type BodyStrategy struct {
+	Mode  string
+	Limit int64 // maximum number of bytes to read in partial mode
+}
+
+func NewBodyStrategy(mode string, limit int64) (*BodyStrategy, error) {
+	switch mode {
+	case "", bodyFull:
+		return &BodyStrategy{Mode: bodyFull}, nil
+	case bodyDiscard, bodyHash:
+		return &BodyStrategy{Mode: mode}, nil
+	case bodyPartial:
+		if limit <= 0 {
+			return nil, fmt.Errorf("partial body strategy requires a positive read limit")
+		}
+		return &BodyStrategy{Mode: mode, Limit: limit}, nil
+	default:
+		return nil, fmt.Errorf("unsupported body strategy: %s", mode)
+	}
+}
+
+// Complete reports whether the strategy reads whole bodies, so the number of bytes read
+// can be checked against the response's Content-Length.
+func (s *BodyStrategy) Complete() bool {
+	return s.Mode == bodyFull || s.Mode == bodyHash
+}
+
+// Read consumes the body according to the strategy, returning the number of bytes read and,
+// in hash mode, the hex encoded sha256 hash of the body.
+func (s *BodyStrategy) Read(body io.Reader) (int64, string, error) {
+	switch s.Mode {
+	case bodyDiscard:
+		return 0, "", nil
+	case bodyPartial:
+		n, err := discardBody(io.LimitReader(body, s.Limit))
+		return n, "", err
+	case bodyHash:
+		h := sha256.New()
+		n, err := discardBody(&hashReader{r: body, h: h})
+		if err != nil {
+			return n, "", err
+		}
+		return n, hex.EncodeToString(h.Sum(nil)), nil
+	default:
+		n, err := discardBody(body)
+		return n, "", err
+	}
+}
+
+// hashReader writes everything read from r to h.
+type hashReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
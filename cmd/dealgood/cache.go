@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ResponseCache emulates a shared HTTP cache, such as a CDN, in front of a target. Fresh
+// responses are served from the cache without a request being sent to the target. Stale
+// responses, and a fraction of fresh ones, are revalidated with a conditional request.
+// Only the metadata needed to make caching decisions is retained, not response bodies.
+type ResponseCache struct {
+	conditionalRate float64 // fraction of fresh cache hits that are revalidated with the target
+	maxEntries      int
+
+	resultCounter *prometheus.CounterVec
+	experiment    string
+	target        string
+
+	mu      sync.Mutex // guards following fields
+	rng     *rand.Rand
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	expires      time.Time
+	etag         string
+	lastModified string
+}
+
+// Cache lookup results, used to label metrics
+const (
+	cacheHit         = "hit"         // a fresh response was served from the cache
+	cacheMiss        = "miss"        // no usable response was cached
+	cacheRevalidate  = "revalidate"  // a conditional request was sent to the target
+	cacheNotModified = "notmodified" // the target confirmed the cached response was still valid
+	cacheUncacheable = "uncacheable" // the request or response may not be cached
+)
+
+func NewResponseCache(experiment string, target string, conditionalRate float64, maxEntries int) (*ResponseCache, error) {
+	c := &ResponseCache{
+		conditionalRate: conditionalRate,
+		maxEntries:      maxEntries,
+		experiment:      experiment,
+		target:          target,
+		rng:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		entries:         make(map[string]*cacheEntry),
+	}
+
+	var err error
+	c.resultCounter, err = newCounterMetric(
+		"cache_results_total",
+		"The number of requests handled by the emulated cache in front of each target, by result.",
+		[]string{"experiment", "target", "result"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return c, nil
+}
+
+// Lookup reports whether the request can be served from the cache. When it cannot, any
+// validators that should be sent in a conditional request are added to the request.
+func (c *ResponseCache) Lookup(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		c.count(cacheUncacheable)
+		return false
+	}
+
+	key := cacheKey(req)
+	var e cacheEntry
+	c.mu.Lock()
+	pe, ok := c.entries[key]
+	if ok {
+		e = *pe
+	}
+	conditional := c.rng.Float64() < c.conditionalRate
+	c.mu.Unlock()
+
+	if !ok {
+		c.count(cacheMiss)
+		return false
+	}
+
+	if time.Now().Before(e.expires) && !conditional {
+		c.count(cacheHit)
+		return true
+	}
+
+	if e.etag == "" && e.lastModified == "" {
+		c.count(cacheMiss)
+		return false
+	}
+
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		req.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	c.count(cacheRevalidate)
+	return false
+}
+
+// Store records the response in the cache if it may be cached.
+func (c *ResponseCache) Store(req *http.Request, resp *http.Response) {
+	key := cacheKey(req)
+
+	if resp.StatusCode == http.StatusNotModified {
+		c.count(cacheNotModified)
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.expires = time.Now().Add(freshness(resp.Header))
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK || !cacheable(resp.Header) {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return
+	}
+
+	e := &cacheEntry{
+		expires:      time.Now().Add(freshness(resp.Header)),
+		etag:         resp.Header.Get("Etag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = e
+}
+
+func (c *ResponseCache) count(result string) {
+	c.resultCounter.WithLabelValues(c.experiment, c.target, result).Add(1)
+}
+
+// cacheKey returns the key for a request, including the request headers that
+// gateways vary their responses by.
+func cacheKey(req *http.Request) string {
+	return req.Method + " " + req.Host + req.URL.RequestURI() + "|" + req.Header.Get("Accept") + "|" + req.Header.Get("Range")
+}
+
+// cacheable reports whether a response with the given headers may be stored by a shared cache
+func cacheable(h http.Header) bool {
+	for _, d := range cacheControl(h) {
+		switch d {
+		case "no-store", "private":
+			return false
+		}
+	}
+	return h.Get("Etag") != "" || h.Get("Last-Modified") != "" || freshness(h) > 0
+}
+
+// freshness returns how long a response with the given headers remains fresh
+func freshness(h http.Header) time.Duration {
+	maxAge, sMaxAge := -1, -1
+	for _, d := range cacheControl(h) {
+		switch {
+		case d == "no-cache":
+			return 0
+		case strings.HasPrefix(d, "s-maxage="):
+			if secs, err := strconv.Atoi(strings.TrimPrefix(d, "s-maxage=")); err == nil {
+				sMaxAge = secs
+			}
+		case strings.HasPrefix(d, "max-age="):
+			if secs, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil {
+				maxAge = secs
+			}
+		}
+	}
+	// s-maxage takes precedence for shared caches
+	if sMaxAge >= 0 {
+		return time.Duration(sMaxAge) * time.Second
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second
+	}
+	return 0
+}
+
+func cacheControl(h http.Header) []string {
+	var directives []string
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if d != "" {
+				directives = append(directives, d)
+			}
+		}
+	}
+	return directives
+}
@@ -5,11 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"text/tabwriter"
 	"time"
 )
 
-func nogui(ctx context.Context, source RequestSource, exp *Experiment, printHeader bool, printTimings bool, printFailures bool, interactive bool) error {
+func nogui(ctx context.Context, source RequestSource, exp *Experiment, printHeader bool, printTimings bool, printFailures bool, interactive bool, har *HARRecorder, harPath string, barrier *StartBarrier, shutdown *Shutdown) error {
 	timings := make(chan *RequestTiming, 10000)
 	defer func() {
 		close(timings)
@@ -39,17 +40,179 @@ func nogui(ctx context.Context, source RequestSource, exp *Experiment, printHead
 		go printCollectedTimings(ctx, coll, exp, interactive)
 	}
 
+	for _, t := range exp.Targets {
+		if !isExternal(t) {
+			continue
+		}
+		t.Guard, err = NewTargetGuard(GuardConfig{
+			MaxRate:        flags.externalMaxRate,
+			ErrorThreshold: flags.breakerThreshold,
+			MinRequests:    flags.breakerMinRequests,
+			Window:         flags.breakerWindow,
+			Cooldown:       flags.breakerCooldown,
+			ExperimentName: exp.Name,
+			TargetName:     t.Name,
+		})
+		if err != nil {
+			return fmt.Errorf("new target guard: %w", err)
+		}
+		if printHeader {
+			fmt.Printf("Target %s is outside the experiment network, limiting to %d requests per second\n", t.Name, flags.externalMaxRate)
+		}
+	}
+
+	if flags.cacheEmulation {
+		for _, t := range exp.Targets {
+			t.Cache, err = NewResponseCache(exp.Name, t.Name, flags.cacheConditionalRate, flags.cacheMaxEntries)
+			if err != nil {
+				return fmt.Errorf("new response cache: %w", err)
+			}
+		}
+	}
+
 	l, err := NewLoader(exp.Name, exp.Targets, source, timings, exp.Rate, exp.Concurrency, exp.Duration)
 	if err != nil {
 		return fmt.Errorf("new loader: %w", err)
 	}
 	l.PrintFailures = printFailures
+	l.Barrier = barrier
+	l.Shutdown = shutdown
+	l.HAR = har
+	l.CookieMode = flags.cookieJar
+	l.MaxCookieJars = flags.maxCookieJars
+	l.Body, err = NewBodyStrategy(flags.bodyStrategy, flags.bodyReadLimit)
+	if err != nil {
+		return fmt.Errorf("body strategy: %w", err)
+	}
+	if flags.acceptEncoding != "" {
+		l.Encodings, err = NewEncodingMatrix(flags.acceptEncoding)
+		if err != nil {
+			return fmt.Errorf("accept encoding: %w", err)
+		}
+		l.EncodingSizes, err = NewEncodingRecorder(exp.Name, l.Encodings.Values())
+		if err != nil {
+			return fmt.Errorf("new encoding recorder: %w", err)
+		}
+	}
+	if flags.slowestRequests > 0 {
+		l.Slowest, err = NewSlowestRecorder(flags.slowestRequests, flags.slowestWindow)
+		if err != nil {
+			return fmt.Errorf("new slowest recorder: %w", err)
+		}
+		slowestCtx, stopSlowest := context.WithCancel(ctx)
+		slowestDone := make(chan struct{})
+		go func() {
+			l.Slowest.Run(slowestCtx)
+			close(slowestDone)
+		}()
+		defer func() {
+			stopSlowest()
+			<-slowestDone
+			l.Slowest.Report(os.Stdout)
+		}()
+	}
+	if flags.workloadPaths > 0 {
+		l.Workload, err = NewWorkloadProfile(exp.Name, flags.workloadPaths, l.Body.Mode != bodyDiscard)
+		if err != nil {
+			return fmt.Errorf("new workload profile: %w", err)
+		}
+		workloadCtx, stopWorkload := context.WithCancel(ctx)
+		workloadDone := make(chan struct{})
+		go func() {
+			l.Workload.Run(workloadCtx, 15*time.Second)
+			close(workloadDone)
+		}()
+		defer func() {
+			stopWorkload()
+			<-workloadDone
+			l.Workload.Report(os.Stdout)
+		}()
+	}
+	if flags.search {
+		l.Search, err = NewCapacitySearch(exp.Name, SearchConfig{
+			StartRate:     flags.searchStartRate,
+			MaxRate:       float64(exp.Rate),
+			Step:          flags.searchStep,
+			MaxP99:        flags.searchMaxP99,
+			MaxErrorRatio: flags.searchMaxErrorRatio,
+			Precision:     flags.searchPrecision,
+		}, exp.Targets, !printHeader)
+		if err != nil {
+			return fmt.Errorf("new capacity search: %w", err)
+		}
+		defer l.Search.Report(os.Stdout)
+	}
+	if flags.spikeMultiplier > 0 {
+		if l.Search != nil {
+			return fmt.Errorf("spikes cannot be combined with a capacity search")
+		}
+		l.Spikes, err = NewSpikeScenario(exp.Name, SpikeConfig{
+			Multiplier: flags.spikeMultiplier,
+			Duration:   flags.spikeDuration,
+			Interval:   flags.spikeInterval,
+			Tolerance:  flags.spikeTolerance,
+		}, exp.Targets, !printHeader)
+		if err != nil {
+			return fmt.Errorf("new spike scenario: %w", err)
+		}
+		defer l.Spikes.Report(os.Stdout)
+	}
+	l.TargetQueue = flags.targetQueueSize
+	l.Burst = flags.rateBurst
+	l.Jitter = flags.rateJitter
+
+	if (flags.compareHeaders != "" || l.Body.Mode == bodyHash) && len(exp.Targets) > 1 {
+		l.Headers, err = NewHeaderComparer(exp.Name, strings.Split(flags.compareHeaders, ","), len(exp.Targets), flags.headerDiffLogRate)
+		if err != nil {
+			return fmt.Errorf("new header comparer: %w", err)
+		}
+	}
+
+	if flags.serverTimingMetrics > 0 {
+		l.ServerTiming, err = NewServerTimingRecorder(exp.Name, flags.serverTimingMetrics)
+		if err != nil {
+			return fmt.Errorf("new server timing recorder: %w", err)
+		}
+	}
+
+	if flags.clickhouseURL != "" {
+		l.Records, err = NewClickHouseSink(ctx, flags.clickhouseURL, flags.clickhouseUser, flags.clickhousePassword, flags.clickhouseDatabase, flags.clickhouseTable, flags.clickhouseBatchSize, flags.clickhouseFlushInterval)
+		if err != nil {
+			return fmt.Errorf("new clickhouse sink: %w", err)
+		}
+		go l.Records.Run(ctx)
+		defer l.Records.Close()
+	}
+
+	if flags.audit || flags.auditFile != "" {
+		l.Audit, err = NewReplayAudit(exp.Name, exp.Targets, flags.auditFile)
+		if err != nil {
+			return fmt.Errorf("new replay audit: %w", err)
+		}
+		defer func() {
+			if err := l.Audit.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "replay audit: %v\n", err)
+			}
+			l.Audit.Report(os.Stdout)
+		}()
+	}
 
 	if err := l.Send(ctx); err != nil {
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 			fmt.Fprintf(os.Stderr, "loader stopped: %v", err)
 		}
 	}
+	if shutdown != nil && shutdown.Stopped() {
+		// the final metrics, including the drained requests, are lost unless scraped before exiting
+		shutdown.ArmScrape()
+		shutdown.WaitScrape()
+	}
+
+	if har != nil {
+		if err := har.WriteFile(harPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write har file: %v\n", err)
+		}
+	}
 
 	latest := coll.Latest()
 	printSampleTimings(ctx, latest, exp)
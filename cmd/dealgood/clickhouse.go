@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// clickhouseSchema creates the table per-request records are inserted into. It is formatted with
+// the qualified name of the table.
+const clickhouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	time DateTime64(3, 'UTC'),
+	experiment LowCardinality(String),
+	target LowCardinality(String),
+	method LowCardinality(String),
+	uri String,
+	format LowCardinality(String),
+	status UInt16,
+	error_class LowCardinality(String),
+	dropped UInt8,
+	body_bytes Int64,
+	connect_ms Float64,
+	ttfb_ms Float64,
+	total_ms Float64
+) ENGINE = MergeTree
+PARTITION BY toDate(time)
+ORDER BY (experiment, target, time)`
+
+var clickhouseIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// A ClickHouseRecord is a single request sent to a target, as stored in ClickHouse.
+type ClickHouseRecord struct {
+	Time       string  `json:"time"` // formatted as expected by DateTime64(3)
+	Experiment string  `json:"experiment"`
+	Target     string  `json:"target"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Format     string  `json:"format"`
+	Status     int     `json:"status"`
+	ErrorClass string  `json:"error_class"`
+	Dropped    uint8   `json:"dropped"`
+	BodyBytes  int64   `json:"body_bytes"`
+	ConnectMS  float64 `json:"connect_ms"`
+	TTFBMS     float64 `json:"ttfb_ms"`
+	TotalMS    float64 `json:"total_ms"`
+}
+
+// A ClickHouseSink streams a record of every request sent to targets into a ClickHouse table
+// using the HTTP interface. Records are inserted in batches. When ClickHouse cannot keep up the
+// buffer fills and further records are dropped rather than slowing the workers.
+type ClickHouseSink struct {
+	url           string
+	user          string
+	password      string
+	table         string // qualified table name
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+
+	records chan *ClickHouseRecord
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	writtenCounter *prometheus.CounterVec
+	droppedCounter *prometheus.CounterVec
+	errorCounter   *prometheus.CounterVec
+}
+
+// NewClickHouseSink returns a sink that inserts records into table in database on the ClickHouse
+// server at addr, which is the url of its HTTP interface. The table is created if it does not
+// exist.
+func NewClickHouseSink(ctx context.Context, addr, user, password, database, table string, batchSize int, flushInterval time.Duration) (*ClickHouseSink, error) {
+	if !clickhouseIdentifier.MatchString(database) {
+		return nil, fmt.Errorf("invalid database name: %q", database)
+	}
+	if !clickhouseIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %q", table)
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("batch size must be positive")
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive")
+	}
+
+	s := &ClickHouseSink{
+		url:           addr,
+		user:          user,
+		password:      password,
+		table:         database + "." + table,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: 60 * time.Second},
+		records:       make(chan *ClickHouseRecord, 4*batchSize),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	var err error
+	s.writtenCounter, err = newCounterMetric("clickhouse_records_written_total", "The number of request records inserted into clickhouse.", []string{})
+	if err != nil {
+		return nil, err
+	}
+	s.droppedCounter, err = newCounterMetric("clickhouse_records_dropped_total", "The number of request records dropped because the clickhouse buffer was full or an insert failed.", []string{})
+	if err != nil {
+		return nil, err
+	}
+	s.errorCounter, err = newCounterMetric("clickhouse_insert_errors_total", "The number of failed clickhouse inserts.", []string{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.exec(ctx, fmt.Sprintf(clickhouseSchema, s.table), nil); err != nil {
+		return nil, fmt.Errorf("create table: %w", err)
+	}
+	return s, nil
+}
+
+// Record queues a record of a request and its timings for insertion.
+func (s *ClickHouseSink) Record(start time.Time, r *request.Request, t *RequestTiming) {
+	rec := &ClickHouseRecord{
+		Time:       start.UTC().Format("2006-01-02 15:04:05.000"),
+		Experiment: t.ExperimentName,
+		Target:     t.TargetName,
+		Method:     r.Method,
+		URI:        r.URI,
+		Format:     t.Format,
+		Status:     t.StatusCode,
+		ErrorClass: t.ErrorClass,
+		BodyBytes:  t.BodyBytes,
+		ConnectMS:  float64(t.ConnectTime) / float64(time.Millisecond),
+		TTFBMS:     float64(t.TTFB) / float64(time.Millisecond),
+		TotalMS:    float64(t.TotalTime) / float64(time.Millisecond),
+	}
+	if t.Dropped {
+		rec.Dropped = 1
+	}
+
+	select {
+	case s.records <- rec:
+	default:
+		s.droppedCounter.WithLabelValues().Add(1)
+	}
+}
+
+// Run inserts batches of records until the context is canceled or the sink is closed.
+func (s *ClickHouseSink) Run(ctx context.Context) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*ClickHouseRecord, 0, s.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			s.drain(batch)
+			return
+		case <-s.done:
+			s.drain(batch)
+			return
+		case rec := <-s.records:
+			batch = append(batch, rec)
+			if len(batch) >= s.batchSize {
+				s.insert(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.insert(ctx, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// Close stops the sink after inserting any records that are still buffered.
+func (s *ClickHouseSink) Close() error {
+	s.once.Do(func() { close(s.done) })
+	<-s.stopped
+	return nil
+}
+
+// drain inserts the batch along with everything remaining in the buffer.
+func (s *ClickHouseSink) drain(batch []*ClickHouseRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for {
+		select {
+		case rec := <-s.records:
+			batch = append(batch, rec)
+			if len(batch) >= s.batchSize {
+				s.insert(ctx, batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				s.insert(ctx, batch)
+			}
+			return
+		}
+	}
+}
+
+func (s *ClickHouseSink) insert(ctx context.Context, batch []*ClickHouseRecord) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range batch {
+		if err := enc.Encode(rec); err != nil {
+			continue
+		}
+	}
+
+	if err := s.exec(ctx, "INSERT INTO "+s.table+" FORMAT JSONEachRow", &buf); err != nil {
+		fmt.Fprintf(os.Stderr, "clickhouse insert: %v\n", err)
+		s.errorCounter.WithLabelValues().Add(1)
+		s.droppedCounter.WithLabelValues().Add(float64(len(batch)))
+		return
+	}
+	s.writtenCounter.WithLabelValues().Add(float64(len(batch)))
+}
+
+// exec runs a statement using the HTTP interface. The statement is sent in the query string so
+// that data for inserts can be streamed in the body.
+func (s *ClickHouseSink) exec(ctx context.Context, query string, data io.Reader) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return fmt.Errorf("parse url: %w", err)
+	}
+	q := u.Query()
+	q.Set("query", query)
+	u.RawQuery = q.Encode()
+
+	if data == nil {
+		data = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), data)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
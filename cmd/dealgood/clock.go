@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch, 1900, and the unix epoch.
+const ntpEpochOffset = 2208988800
+
+// dateResolution is the resolution of the HTTP Date header, which limits how precisely the
+// clock of a server can be compared with ours.
+const dateResolution = time.Second
+
+// A ClockCheck measures the offset of dealgood's clock from an NTP server and from the clocks
+// of the targets and metrics stack. Time to first byte is measured locally, but stream lag is
+// computed from timestamps made by skyfish and metrics are timestamped by the stack that
+// stores them, so a skewed clock silently corrupts both.
+type ClockCheck struct {
+	experiment string
+	ntpServer  string        // address of the NTP server, empty to skip the NTP check
+	maxSkew    time.Duration // offset above which a warning is printed
+
+	offsetGauge *prometheus.GaugeVec
+	skewedGauge *prometheus.GaugeVec
+}
+
+func NewClockCheck(experiment string, ntpServer string, maxSkew time.Duration) (*ClockCheck, error) {
+	c := &ClockCheck{
+		experiment: experiment,
+		ntpServer:  ntpServer,
+		maxSkew:    maxSkew,
+	}
+
+	var err error
+	c.offsetGauge, err = newGaugeMetric(
+		"clock_offset_seconds",
+		"The offset of a peer's clock from dealgood's when dealgood started. Offsets from targets and the pushgateway are read from the HTTP Date header so are only accurate to a second.",
+		[]string{"experiment", "peer"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	c.skewedGauge, err = newGaugeMetric(
+		"clock_skewed",
+		"Indicates whether the clock offset from a peer exceeded the maximum allowed skew when dealgood started.",
+		[]string{"experiment", "peer"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return c, nil
+}
+
+// Run measures the clock offset from the NTP server, each target and, if not empty, the
+// pushgateway at pushURL, recording each and warning about those that exceed the maximum skew.
+// Peers that cannot be reached are reported but do not stop the experiment.
+func (c *ClockCheck) Run(ctx context.Context, targets []*Target, pushURL string, quiet bool) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var g errgroup.Group
+	if c.ntpServer != "" {
+		g.Go(func() error {
+			// an unreachable server never answers, so give up on it sooner
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			offset, err := ntpOffset(ctx, c.ntpServer)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "clock check: ntp server %s: %v\n", c.ntpServer, err)
+				return nil
+			}
+			c.record("ntp", offset, 0, quiet)
+			return nil
+		})
+	}
+	for _, target := range targets {
+		target := target // copied for capture by the closure
+		g.Go(func() error {
+			offset, err := targetOffset(ctx, target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "clock check: target %s: %v\n", target.Name, err)
+				return nil
+			}
+			c.record(target.Name, offset, dateResolution, quiet)
+			return nil
+		})
+	}
+	if pushURL != "" {
+		g.Go(func() error {
+			offset, err := urlOffset(ctx, http.DefaultClient, pushURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "clock check: pushgateway: %v\n", err)
+				return nil
+			}
+			c.record("pushgateway", offset, dateResolution, quiet)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+// record records the offset from a peer, warning if it exceeds the maximum skew by more than
+// the resolution of the measurement.
+func (c *ClockCheck) record(peer string, offset time.Duration, resolution time.Duration, quiet bool) {
+	c.offsetGauge.WithLabelValues(c.experiment, peer).Set(offset.Seconds())
+	abs := offset
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs > c.maxSkew+resolution {
+		c.skewedGauge.WithLabelValues(c.experiment, peer).Set(1)
+		fmt.Fprintf(os.Stderr, "warning: clock of %s is offset by %s from dealgood's, more than the %s allowed; ttfb and stream lag may be wrong\n", peer, offset, c.maxSkew)
+		return
+	}
+	c.skewedGauge.WithLabelValues(c.experiment, peer).Set(0)
+	if !quiet {
+		fmt.Printf("clock of %s is offset by %s\n", peer, offset)
+	}
+}
+
+// ntpOffset returns the offset of an NTP server's clock from the local clock using a single
+// SNTP exchange. server may omit the port, which defaults to 123.
+func ntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // leap indicator 0, version 4, client mode
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+	if n < 48 {
+		return 0, fmt.Errorf("short response of %d bytes", n)
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("server sent a kiss of death")
+	}
+
+	t2 := ntpTime(resp[32:40]) // time the server received the request
+	t3 := ntpTime(resp[40:48]) // time the server sent the response
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// ntpTime decodes a 64 bit NTP timestamp.
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := (int64(frac) * 1e9) >> 32
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
+
+// targetOffset returns the offset of a target's clock from the local clock, read from the
+// Date header of a response to a probe.
+func targetOffset(ctx context.Context, target *Target) (time.Duration, error) {
+	hc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         target.HostName,
+			},
+			DisableKeepAlives: true,
+			DialContext:       target.DialContext,
+		},
+		Timeout: 5 * time.Second,
+	}
+	req, err := newRequest(ctx, target, &request.Request{Method: "GET", URI: "/"})
+	if err != nil {
+		return 0, fmt.Errorf("new request: %w", err)
+	}
+	return dateOffset(hc, req)
+}
+
+// urlOffset returns the offset of a server's clock from the local clock, read from the Date
+// header of a response to a HEAD request.
+func urlOffset(ctx context.Context, hc *http.Client, u string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return 0, fmt.Errorf("new request: %w", err)
+	}
+	return dateOffset(hc, req)
+}
+
+// dateOffset sends a request and compares the response's Date header with the local time
+// midway between sending the request and receiving the response.
+func dateOffset(hc *http.Client, req *http.Request) (time.Duration, error) {
+	start := time.Now()
+	resp, err := hc.Do(req)
+	end := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("request: %w", err)
+	}
+	resp.Body.Close()
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return 0, fmt.Errorf("no date header in response")
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return 0, fmt.Errorf("parse date header: %w", err)
+	}
+	// the date is truncated to the second so compare with the middle of that second
+	mid := start.Add(end.Sub(start) / 2)
+	return t.Add(dateResolution / 2).Sub(mid), nil
+}
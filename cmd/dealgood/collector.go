@@ -20,6 +20,9 @@ type RequestTiming struct {
 	TimeoutError   bool
 	Dropped        bool
 	StatusCode     int
+	ErrorClass     string // the class of error encountered, empty if the request succeeded
+	Format         string // the format requested, see requestFormat
+	BodyBytes      int64  // number of bytes of the response body that were read
 	ConnectTime    time.Duration
 	TTFB           time.Duration
 	TotalTime      time.Duration
@@ -36,6 +39,11 @@ type Collector struct {
 	connectErrorCounter *prometheus.CounterVec
 	timeoutErrorCounter *prometheus.CounterVec
 	responsesCounter    *prometheus.CounterVec
+	formatTTFBHist      *prometheus.HistogramVec
+	formatTotalHist     *prometheus.HistogramVec
+	formatResponses     *prometheus.CounterVec
+	errorsCounter       *prometheus.CounterVec
+	bodyBytesCounter    *prometheus.CounterVec
 
 	mu      sync.Mutex // guards access to samples
 	samples map[string]MetricSample
@@ -122,6 +130,51 @@ func NewCollector(timings chan *RequestTiming, sampleInterval time.Duration) (*C
 		return nil, fmt.Errorf("new counter: %w", err)
 	}
 
+	coll.formatTTFBHist, err = newHistogramMetric(
+		"format_ttfb_seconds",
+		"The time till the first byte is received for successful gateway requests, by requested response format.",
+		[]string{"experiment", "target", "format"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.formatTotalHist, err = newHistogramMetric(
+		"format_request_time_seconds",
+		"The total time taken for successful gateway requests, by requested response format.",
+		[]string{"experiment", "target", "format"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	coll.formatResponses, err = newCounterMetric(
+		"format_responses_total",
+		"The total number of responses received, by requested response format.",
+		[]string{"experiment", "target", "format", "code"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.errorsCounter, err = newCounterMetric(
+		"errors_total",
+		"The total number of failed requests, by class of error.",
+		[]string{"experiment", "target", "class"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	coll.bodyBytesCounter, err = newCounterMetric(
+		"response_body_bytes_total",
+		"The total number of response body bytes read from the target.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
 	return coll, nil
 }
 
@@ -150,6 +203,9 @@ func (c *Collector) Run(ctx context.Context) {
 			}
 			st.TotalRequests++
 			c.requestsCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
+			if res.ErrorClass != "" {
+				c.errorsCounter.WithLabelValues(res.ExperimentName, res.TargetName, res.ErrorClass).Add(1)
+			}
 			if res.ConnectError {
 				st.TotalConnectErrors++
 				c.connectErrorCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(1)
@@ -163,6 +219,8 @@ func (c *Collector) Run(ctx context.Context) {
 				st.ConnectTime.Add(res.ConnectTime.Seconds())
 				c.connectHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.ConnectTime.Seconds())
 				c.responsesCounter.WithLabelValues(res.ExperimentName, res.TargetName, strconv.Itoa(res.StatusCode)).Add(1)
+				c.formatResponses.WithLabelValues(res.ExperimentName, res.TargetName, res.Format, strconv.Itoa(res.StatusCode)).Add(1)
+				c.bodyBytesCounter.WithLabelValues(res.ExperimentName, res.TargetName).Add(float64(res.BodyBytes))
 
 				switch res.StatusCode / 100 {
 				case 2:
@@ -171,6 +229,8 @@ func (c *Collector) Run(ctx context.Context) {
 					st.TotalTime.Add(res.TotalTime.Seconds())
 					c.ttfbHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.TTFB.Seconds())
 					c.totalHist.WithLabelValues(res.ExperimentName, res.TargetName).Observe(res.TotalTime.Seconds())
+					c.formatTTFBHist.WithLabelValues(res.ExperimentName, res.TargetName, res.Format).Observe(res.TTFB.Seconds())
+					c.formatTotalHist.WithLabelValues(res.ExperimentName, res.TargetName, res.Format).Observe(res.TotalTime.Seconds())
 				case 3:
 					st.TotalHttp3XX++
 				case 4:
@@ -181,6 +241,7 @@ func (c *Collector) Run(ctx context.Context) {
 			}
 
 			stats[res.TargetName] = st
+			releaseTiming(res)
 
 		case <-sampleTicker.C:
 			samples := map[string]MetricSample{}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"sync"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// A CookieJars provides the cookie jar that should be used for a request, allowing
+// session based gateways to be exercised as though requests came from real clients.
+type CookieJars interface {
+	Jar(r *request.Request) http.CookieJar
+}
+
+// NewCookieJars returns the cookie jar behaviour for a single worker. Mode may be one of:
+//
+//	none   - requests are stateless and no cookies are retained
+//	worker - each worker keeps a single cookie jar for all requests it sends
+//	client - a cookie jar is kept for each original client, identified by remote address and user agent
+func NewCookieJars(mode string, maxClients int) (CookieJars, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "worker":
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, fmt.Errorf("new cookie jar: %w", err)
+		}
+		return &singleJar{jar: jar}, nil
+	case "client":
+		return &clientJars{
+			max:  maxClients,
+			jars: make(map[string]http.CookieJar),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cookie jar mode: %s", mode)
+	}
+}
+
+type singleJar struct {
+	jar http.CookieJar
+}
+
+func (s *singleJar) Jar(*request.Request) http.CookieJar {
+	return s.jar
+}
+
+// clientJars keeps a cookie jar per original client. When the maximum number of clients
+// is reached an arbitrary jar is discarded, simulating a client that has gone away.
+type clientJars struct {
+	max int
+
+	mu   sync.Mutex // guards jars
+	jars map[string]http.CookieJar
+}
+
+func (c *clientJars) Jar(r *request.Request) http.CookieJar {
+	key := r.RemoteAddr + "|" + r.UserAgent
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jar, ok := c.jars[key]
+	if ok {
+		return jar
+	}
+
+	if c.max > 0 && len(c.jars) >= c.max {
+		for k := range c.jars {
+			delete(c.jars, k)
+			break
+		}
+	}
+
+	// cookiejar.New only fails when given invalid options
+	jar, _ = cookiejar.New(nil)
+	c.jars[key] = jar
+	return jar
+}
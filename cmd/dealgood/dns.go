@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsResolver is used for all name lookups made by dealgood. It may be replaced
+// to use a custom DNS server.
+var dnsResolver = net.DefaultResolver
+
+// useResolver configures dealgood to send all DNS queries to the server at addr.
+func useResolver(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid resolver address %q: %w", addr, err)
+	}
+
+	dnsResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return nil
+}
+
+// overrideTarget is the override address that refers to the target's own address
+const overrideTarget = "target"
+
+// A HostOverride maps a hostname to a fixed address, like an entry in a hosts file.
+type HostOverride struct {
+	Pattern string // hostname to match, a leading "*." matches any subdomain
+	Addr    string // IP address to connect to, or "target" to use the target's own address
+}
+
+func (o HostOverride) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(o.Pattern, "*.") {
+		return strings.HasSuffix(host, o.Pattern[1:])
+	}
+	return host == o.Pattern
+}
+
+// parseHostOverrides parses a JSON object mapping target names to objects that map hostname
+// patterns to addresses. Overrides listed under the name "*" apply to every target. For example:
+//
+//	{"*": {"*.ipfs.localhost": "target"}, "kubo": {"gateway.example.com": "10.0.0.5"}}
+func parseHostOverrides(v string) (map[string][]HostOverride, error) {
+	var raw map[string]map[string]string
+	if err := json.Unmarshal([]byte(v), &raw); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	overrides := make(map[string][]HostOverride, len(raw))
+	for target, hosts := range raw {
+		for pattern, addr := range hosts {
+			if addr != overrideTarget && net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("override for %s must be an ip address or %q: %q", pattern, overrideTarget, addr)
+			}
+			overrides[target] = append(overrides[target], HostOverride{
+				Pattern: strings.ToLower(pattern),
+				Addr:    addr,
+			})
+		}
+	}
+	return overrides, nil
+}
+
+// DialContext connects to the address on behalf of the target, applying any host overrides
+// and using the configured resolver. It is suitable for use in an http.Transport.
+func (t *Target) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range t.HostOverrides {
+		if !o.Match(host) {
+			continue
+		}
+		if o.Addr == overrideTarget {
+			host, _, err = net.SplitHostPort(t.HostPort())
+			if err != nil {
+				host = t.HostPort()
+			}
+		} else {
+			host = o.Addr
+		}
+		break
+	}
+
+	d := &net.Dialer{
+		Timeout:  30 * time.Second,
+		Resolver: dnsResolver,
+	}
+	return d.DialContext(ctx, network, net.JoinHostPort(host, port))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An EncodingMatrix chooses the Accept-Encoding header sent with each request from a weighted
+// set of values, so that the mix of compressed and uncompressed responses requested from
+// targets can be controlled. The same value is sent to every target for a given request.
+type EncodingMatrix struct {
+	values  []string
+	weights []int // cumulative weights of values
+	rng     *rand.Rand
+}
+
+// NewEncodingMatrix parses a JSON object mapping Accept-Encoding values to their relative
+// weights, for example {"gzip":50,"br, gzip":30,"identity":20}.
+func NewEncodingMatrix(spec string) (*EncodingMatrix, error) {
+	var weights map[string]int
+	if err := json.Unmarshal([]byte(spec), &weights); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if len(weights) == 0 {
+		return nil, fmt.Errorf("at least one value must be given")
+	}
+
+	m := &EncodingMatrix{
+		rng: rand.New(rand.NewSource(rand.Int63())),
+	}
+	for v := range weights {
+		m.values = append(m.values, v)
+	}
+	sort.Strings(m.values)
+
+	total := 0
+	for _, v := range m.values {
+		if strings.TrimSpace(v) == "" {
+			return nil, fmt.Errorf("values must not be empty, use identity to request uncompressed responses")
+		}
+		if weights[v] <= 0 {
+			return nil, fmt.Errorf("weight of %q must be a positive number", v)
+		}
+		total += weights[v]
+		m.weights = append(m.weights, total)
+	}
+	return m, nil
+}
+
+// Values returns the Accept-Encoding values the matrix chooses from.
+func (m *EncodingMatrix) Values() []string {
+	return m.values
+}
+
+// Choose returns an Accept-Encoding value, picked according to the weights. It is not safe for
+// concurrent use.
+func (m *EncodingMatrix) Choose() string {
+	n := m.rng.Intn(m.weights[len(m.weights)-1])
+	i := sort.SearchInts(m.weights, n+1)
+	return m.values[i]
+}
+
+// Apply sets the request's Accept-Encoding header to a value chosen from the matrix, replacing
+// any sent by the original client.
+func (m *EncodingMatrix) Apply(header map[string]string) map[string]string {
+	h := make(map[string]string, len(header)+1)
+	for k, v := range header {
+		if http.CanonicalHeaderKey(k) == "Accept-Encoding" {
+			continue
+		}
+		h[k] = v
+	}
+	h["Accept-Encoding"] = m.Choose()
+	return h
+}
+
+// An EncodingRecorder counts the bytes of responses from each target by content encoding,
+// both as received and, for encodings dealgood can decode, after decompression, so that the
+// effect of a gateway's compression on transfer size can be compared across targets.
+type EncodingRecorder struct {
+	experiment string
+	accepted   map[string]bool // values sent in Accept-Encoding, used to bound label cardinality
+
+	responsesCounter    *prometheus.CounterVec
+	wireBytesCounter    *prometheus.CounterVec
+	decodedBytesCounter *prometheus.CounterVec
+}
+
+func NewEncodingRecorder(experiment string, accepted []string) (*EncodingRecorder, error) {
+	r := &EncodingRecorder{
+		experiment: experiment,
+		accepted:   make(map[string]bool, len(accepted)),
+	}
+	for _, v := range accepted {
+		r.accepted[v] = true
+	}
+
+	var err error
+	r.responsesCounter, err = newCounterMetric(
+		"encoded_responses_total",
+		"The number of responses received from each target by the Accept-Encoding requested and the Content-Encoding returned.",
+		[]string{"experiment", "target", "accept", "encoding"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	r.wireBytesCounter, err = newCounterMetric(
+		"response_wire_bytes_total",
+		"The number of response body bytes received from each target before decompression, by Content-Encoding.",
+		[]string{"experiment", "target", "encoding"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	r.decodedBytesCounter, err = newCounterMetric(
+		"response_decoded_bytes_total",
+		"The number of response body bytes received from each target after decompression, by Content-Encoding. Only recorded for identity, gzip and deflate responses.",
+		[]string{"experiment", "target", "encoding"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return r, nil
+}
+
+// Record records the sizes of a response body. decoded is negative if the body could not be
+// decompressed.
+func (r *EncodingRecorder) Record(target string, accept string, encoding string, wire int64, decoded int64) {
+	if !r.accepted[accept] {
+		accept = "other"
+	}
+	r.responsesCounter.WithLabelValues(r.experiment, target, accept, encoding).Add(1)
+	r.wireBytesCounter.WithLabelValues(r.experiment, target, encoding).Add(float64(wire))
+	if decoded >= 0 {
+		r.decodedBytesCounter.WithLabelValues(r.experiment, target, encoding).Add(float64(decoded))
+	}
+}
+
+// contentEncoding returns the normalized Content-Encoding of a response, "other" for
+// encodings that are not commonly used by gateways.
+func contentEncoding(h http.Header) string {
+	enc := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	switch enc {
+	case "", "identity":
+		return "identity"
+	case "gzip", "x-gzip":
+		return "gzip"
+	case "deflate", "br", "zstd":
+		return enc
+	default:
+		return "other"
+	}
+}
+
+// decodedSizer counts the decompressed size of a response body that is written to it as it is
+// read, without holding the body in memory.
+type decodedSizer struct {
+	pw   *io.PipeWriter
+	done chan int64
+}
+
+// newDecodedSizer returns a sizer for bodies with the given normalized content encoding, or nil
+// if dealgood cannot decode it.
+func newDecodedSizer(encoding string) *decodedSizer {
+	var open func(io.Reader) (io.Reader, error)
+	switch encoding {
+	case "gzip":
+		open = func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }
+	case "deflate":
+		// the http deflate encoding is zlib framed
+		open = func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }
+	default:
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	s := &decodedSizer{pw: pw, done: make(chan int64, 1)}
+	go func() {
+		// closing the reader on error makes further writes fail rather than block
+		dr, err := open(pr)
+		if err != nil {
+			pr.CloseWithError(err)
+			s.done <- -1
+			return
+		}
+		n, err := io.Copy(io.Discard, dr)
+		if err != nil {
+			pr.CloseWithError(err)
+			s.done <- -1
+			return
+		}
+		io.Copy(io.Discard, pr)
+		s.done <- n
+	}()
+	return s
+}
+
+// Write implements io.Writer. Errors from the decoder are ignored so that a corrupt body
+// does not interrupt reading the response.
+func (s *decodedSizer) Write(p []byte) (int, error) {
+	s.pw.Write(p)
+	return len(p), nil
+}
+
+// Size returns the decompressed size of everything written, or -1 if it could not be decoded.
+func (s *decodedSizer) Size() int64 {
+	s.pw.Close()
+	return <-s.done
+}
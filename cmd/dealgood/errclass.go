@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// Error classes form a stable taxonomy of the ways a request can fail. They are used to
+// label metrics so that a rise in errors can be attributed to a cause.
+const (
+	errClassInvalidRequest = "invalid_request" // the request could not be constructed for the target
+	errClassDNS            = "dns"             // the target's hostname could not be resolved
+	errClassConnect        = "connect"         // a connection could not be established or was reset
+	errClassTLS            = "tls"             // the tls handshake or certificate verification failed
+	errClassTimeout        = "timeout"         // the request timed out before the response was complete
+	errClassClient         = "4xx"             // the target responded with a client error status
+	errClassServer         = "5xx"             // the target responded with a server error status
+	errClassBodyMismatch   = "body_mismatch"   // the body length differed from the declared Content-Length
+	errClassTruncated      = "truncated"       // the connection failed while the body was being read
+)
+
+// classifyError returns the error class for an error returned while sending a request.
+func classifyError(err error) string {
+	if os.IsTimeout(err) {
+		return errClassTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errClassDNS
+	}
+
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) || strings.Contains(err.Error(), "tls:") {
+		return errClassTLS
+	}
+
+	return errClassConnect
+}
+
+// classifyBodyError returns the error class for an error returned while reading a response body.
+func classifyBodyError(err error) string {
+	if os.IsTimeout(err) {
+		return errClassTimeout
+	}
+	return errClassTruncated
+}
+
+// classifyResponse returns the error class for a complete response, or an empty string if
+// the response is not an error.
+func classifyResponse(method string, statusCode int, contentLength int64, size int64) string {
+	switch statusCode / 100 {
+	case 4:
+		return errClassClient
+	case 5:
+		return errClassServer
+	}
+	if method != "HEAD" && contentLength >= 0 && size != contentLength {
+		return errClassBodyMismatch
+	}
+	return ""
+}
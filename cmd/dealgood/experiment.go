@@ -2,10 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"strings"
 	"sync"
-
-	"github.com/plprobelab/thunderdome/pkg/request"
 )
 
 type ExperimentJSON struct {
@@ -20,6 +21,18 @@ type TargetJSON struct {
 	Name    string `json:"name"`           // short name of the target to be used in reports
 	BaseURL string `json:"base_url"`       // base URL of the target (without a path)
 	Host    string `json:"host,omitempty"` // An optional hostname to be sent as a Host header in requests
+
+	// Headers are added to every request sent to the target, replacing any header with the same
+	// name in the original request. A Host header overrides the hostname sent in requests.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SubdomainGateway is the domain served by the target as a subdomain gateway. When set, path
+	// requests are rewritten into subdomain form, for example /ipfs/<cid> becomes <cid>.ipfs.<domain>
+	SubdomainGateway string `json:"subdomain_gateway,omitempty"`
+
+	// MaxInFlight limits the number of requests in flight to the target, below the experiment's
+	// concurrency. Requests wait in a queue while the target is at its limit.
+	MaxInFlight int `json:"max_in_flight,omitempty"`
 }
 
 type Experiment struct {
@@ -31,12 +44,21 @@ type Experiment struct {
 }
 
 type Target struct {
-	Name        string                // short name of the target to be used in reports and metrics
-	BaseURL     string                // base URL of the target (without a path)
-	HostName    string                // the name of the host to be sent in the Host header of requests (may be different to the target's own host name)
-	URLScheme   string                // http or https
-	RawHostPort string                // hostname and port of target as derived from the URL
-	Requests    chan *request.Request // channel used to receive requests to be issued to the target
+	Name             string              // short name of the target to be used in reports and metrics
+	BaseURL          string              // base URL of the target (without a path)
+	HostName         string              // the name of the host to be sent in the Host header of requests (may be different to the target's own host name)
+	URLScheme        string              // http or https
+	RawHostPort      string              // hostname and port of target as derived from the URL
+	Requests         chan *targetRequest // channel used to receive requests to be issued to the target
+	MaxInFlight      int                 // maximum number of requests in flight to the target, zero to use the experiment's concurrency
+	Queue            *TargetQueue        // queue of requests waiting for the target, used when MaxInFlight is set
+	Guard            *TargetGuard        // optional guard limiting load on targets outside the experiment network
+	Search           *TargetSearch       // optional capacity search limiting the target to the rate being tried
+	Headers          http.Header         // headers added to every request sent to the target
+	HostOverride     bool                // whether HostName replaces the Host header of every request
+	Cache            *ResponseCache      // optional cache emulated in front of the target
+	HostOverrides    []HostOverride      // fixed addresses for hostnames, used when connecting to the target or following redirects
+	SubdomainGateway string              // domain of the target's subdomain gateway, empty when requests should use paths
 
 	mu               sync.Mutex // guards accesses to hostPort which may change over time
 	resolvedHostPort string
@@ -103,14 +125,26 @@ func newExperiment(expjson *ExperimentJSON) (*Experiment, error) {
 		}
 		seenNames[tj.Name] = true
 
+		// use the default port for the scheme rather than the gateway default if none is specified
+		hostport := u.Host
+		if u.Port() == "" {
+			switch u.Scheme {
+			case "https":
+				hostport = net.JoinHostPort(u.Hostname(), "443")
+			case "http":
+				hostport = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+
 		t := &Target{
 			Name:             tj.Name,
 			BaseURL:          tj.BaseURL,
 			HostName:         u.Hostname(),
 			URLScheme:        u.Scheme,
-			RawHostPort:      u.Host,
-			resolvedHostPort: u.Host,
-			Requests:         make(chan *request.Request),
+			RawHostPort:      hostport,
+			resolvedHostPort: hostport,
+			Requests:         make(chan *targetRequest),
+			MaxInFlight:      tj.MaxInFlight,
 		}
 
 		// allow host to be overridden
@@ -118,6 +152,27 @@ func newExperiment(expjson *ExperimentJSON) (*Experiment, error) {
 			t.HostName = tj.Host
 		}
 
+		if len(tj.Headers) > 0 {
+			t.Headers = make(http.Header, len(tj.Headers))
+			for k, v := range tj.Headers {
+				if http.CanonicalHeaderKey(k) == "Host" {
+					t.HostName = v
+					t.HostOverride = true
+					continue
+				}
+				t.Headers.Set(k, v)
+			}
+		}
+
+		if tj.SubdomainGateway != "" {
+			t.SubdomainGateway = strings.ToLower(strings.Trim(tj.SubdomainGateway, "."))
+			// subdomains, including those in redirects, always resolve to the target
+			t.HostOverrides = append(t.HostOverrides,
+				HostOverride{Pattern: "*.ipfs." + t.SubdomainGateway, Addr: overrideTarget},
+				HostOverride{Pattern: "*.ipns." + t.SubdomainGateway, Addr: overrideTarget},
+			)
+		}
+
 		exp.Targets = append(exp.Targets, t)
 
 	}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A MetricsSink sends samples of dealgood's metrics to an observability backend other than Prometheus.
+type MetricsSink interface {
+	Send(ts time.Time, samples []exportSample) error
+	Close() error
+}
+
+// exportSample is the value of a single metric series at the time it was gathered.
+type exportSample struct {
+	Name    string
+	Labels  []*dto.LabelPair // sorted by name
+	Value   float64          // current value, cumulative for counters
+	Delta   float64          // change in value since the previous export, only set for counters
+	Counter bool
+}
+
+// NewMetricsSink returns a sink for the named backend. Kind may be one of:
+//
+//	influx   - InfluxDB line protocol written over http to addr, which should be the full write url
+//	graphite - Graphite plaintext protocol with tags sent over tcp to addr
+//	statsd   - StatsD sent over udp to addr, labels are appended to the metric name
+//	datadog  - DogStatsD sent over udp to addr, labels are sent as tags
+func NewMetricsSink(kind string, addr string, token string) (MetricsSink, error) {
+	switch kind {
+	case "influx":
+		return &influxSink{url: addr, token: token, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "graphite":
+		return &graphiteSink{addr: addr}, nil
+	case "statsd", "datadog":
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+		return &statsdSink{conn: conn, tags: kind == "datadog"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported metrics exporter: %s", kind)
+	}
+}
+
+// A MetricsExporter periodically gathers metrics from the Prometheus registry and sends them to a sink.
+type MetricsExporter struct {
+	sink     MetricsSink
+	gatherer prom.Gatherer
+	interval time.Duration
+	prev     map[string]float64 // previous values of counters, keyed by series
+}
+
+func NewMetricsExporter(sink MetricsSink, interval time.Duration) *MetricsExporter {
+	return &MetricsExporter{
+		sink:     sink,
+		gatherer: prom.DefaultGatherer,
+		interval: interval,
+		prev:     make(map[string]float64),
+	}
+}
+
+// Run exports metrics periodically until the context is canceled.
+func (e *MetricsExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.export(); err != nil {
+				fmt.Fprintf(os.Stderr, "export metrics: %v\n", err)
+			}
+		}
+	}
+}
+
+// Close makes a final export of metrics and closes the sink.
+func (e *MetricsExporter) Close() error {
+	if err := e.export(); err != nil {
+		e.sink.Close()
+		return err
+	}
+	return e.sink.Close()
+}
+
+func (e *MetricsExporter) export() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gather: %w", err)
+	}
+
+	var samples []exportSample
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			labels := m.GetLabel()
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, e.counter(mf.GetName(), labels, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				samples = append(samples, exportSample{Name: mf.GetName(), Labels: labels, Value: m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, exportSample{Name: mf.GetName(), Labels: labels, Value: m.GetUntyped().GetValue()})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				samples = append(samples,
+					e.counter(mf.GetName()+"_count", labels, float64(h.GetSampleCount())),
+					e.counter(mf.GetName()+"_sum", labels, h.GetSampleSum()),
+				)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				samples = append(samples,
+					e.counter(mf.GetName()+"_count", labels, float64(s.GetSampleCount())),
+					e.counter(mf.GetName()+"_sum", labels, s.GetSampleSum()),
+				)
+			}
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+	return e.sink.Send(time.Now(), samples)
+}
+
+func (e *MetricsExporter) counter(name string, labels []*dto.LabelPair, value float64) exportSample {
+	key := seriesKey(name, labels)
+	delta := value - e.prev[key]
+	if delta < 0 {
+		// counter was reset
+		delta = value
+	}
+	e.prev[key] = value
+	return exportSample{Name: name, Labels: labels, Value: value, Delta: delta, Counter: true}
+}
+
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteByte(0)
+		b.WriteString(l.GetName())
+		b.WriteByte('=')
+		b.WriteString(l.GetValue())
+	}
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "0"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type influxSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func (s *influxSink) Send(ts time.Time, samples []exportSample) error {
+	var buf bytes.Buffer
+	for _, smp := range samples {
+		buf.WriteString(influxEscaper.Replace(smp.Name))
+		for _, l := range smp.Labels {
+			if l.GetValue() == "" {
+				continue
+			}
+			buf.WriteByte(',')
+			buf.WriteString(influxEscaper.Replace(l.GetName()))
+			buf.WriteByte('=')
+			buf.WriteString(influxEscaper.Replace(l.GetValue()))
+		}
+		buf.WriteString(" value=")
+		buf.WriteString(formatValue(smp.Value))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+		buf.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &buf)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("write: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *influxSink) Close() error { return nil }
+
+type graphiteSink struct {
+	addr string
+}
+
+var graphiteEscaper = strings.NewReplacer(";", "_", "~", "_", " ", "_", "=", "_")
+
+func (s *graphiteSink) Send(ts time.Time, samples []exportSample) error {
+	var buf bytes.Buffer
+	for _, smp := range samples {
+		buf.WriteString(graphiteEscaper.Replace(smp.Name))
+		for _, l := range smp.Labels {
+			if l.GetValue() == "" {
+				continue
+			}
+			buf.WriteByte(';')
+			buf.WriteString(graphiteEscaper.Replace(l.GetName()))
+			buf.WriteByte('=')
+			buf.WriteString(graphiteEscaper.Replace(l.GetValue()))
+		}
+		fmt.Fprintf(&buf, " %s %d\n", formatValue(smp.Value), ts.Unix())
+	}
+
+	// connect for each send so that a restarted carbon server does not leave a broken connection
+	conn, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", s.addr, err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
+
+func (s *graphiteSink) Close() error { return nil }
+
+// maxStatsdPacket is the maximum size of a udp packet sent to a statsd server, chosen to avoid fragmentation
+const maxStatsdPacket = 1432
+
+type statsdSink struct {
+	conn net.Conn
+	tags bool // send labels as DogStatsD tags rather than appending them to the metric name
+}
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", " ", "_")
+
+func (s *statsdSink) Send(_ time.Time, samples []exportSample) error {
+	var packet bytes.Buffer
+	var line bytes.Buffer
+	for _, smp := range samples {
+		line.Reset()
+		line.WriteString(statsdEscaper.Replace(smp.Name))
+		if !s.tags {
+			for _, l := range smp.Labels {
+				if l.GetValue() != "" {
+					line.WriteByte('.')
+					line.WriteString(strings.ReplaceAll(statsdEscaper.Replace(l.GetValue()), ".", "_"))
+				}
+			}
+		}
+		line.WriteByte(':')
+		if smp.Counter {
+			if smp.Delta == 0 {
+				continue
+			}
+			line.WriteString(formatValue(smp.Delta))
+			line.WriteString("|c")
+		} else {
+			line.WriteString(formatValue(smp.Value))
+			line.WriteString("|g")
+		}
+		if s.tags && len(smp.Labels) > 0 {
+			line.WriteString("|#")
+			for i, l := range smp.Labels {
+				if i > 0 {
+					line.WriteByte(',')
+				}
+				line.WriteString(statsdEscaper.Replace(l.GetName()))
+				line.WriteByte(':')
+				line.WriteString(statsdEscaper.Replace(l.GetValue()))
+			}
+		}
+
+		if packet.Len() > 0 && packet.Len()+1+line.Len() > maxStatsdPacket {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line.Bytes())
+	}
+
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// Response formats used to label metrics
+const (
+	formatCAR   = "car"   // a CAR file was requested using ?format=car or an Accept header
+	formatRaw   = "raw"   // a raw block was requested using ?format=raw or an Accept header
+	formatRange = "range" // a byte range of the default response was requested
+	formatFull  = "full"  // the complete default response was requested
+)
+
+// requestFormat classifies the response format requested by a request.
+func requestFormat(r *request.Request) string {
+	if _, query, found := strings.Cut(r.URI, "?"); found {
+		if q, err := url.ParseQuery(query); err == nil {
+			switch q.Get("format") {
+			case "car":
+				return formatCAR
+			case "raw":
+				return formatRaw
+			}
+		}
+	}
+
+	var accept, rng string
+	for k, v := range r.Header {
+		switch {
+		case strings.EqualFold(k, "Accept"):
+			accept = v
+		case strings.EqualFold(k, "Range"):
+			rng = v
+		}
+	}
+
+	switch {
+	case strings.Contains(accept, "application/vnd.ipld.car"):
+		return formatCAR
+	case strings.Contains(accept, "application/vnd.ipld.raw"):
+		return formatRaw
+	case rng != "":
+		return formatRange
+	default:
+		return formatFull
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A TargetGuard protects a target outside of the experiment's network from excessive load. It
+// enforces a hard cap on the request rate, independent of the experiment's configured rate,
+// and stops sending requests for a cooldown period when the target responds with an elevated
+// rate of 429 or 5xx responses.
+type TargetGuard struct {
+	limiter *TokenBucket // nil means no rate cap
+	breaker *CircuitBreaker
+
+	throttledCounter prometheus.Counter
+	openGauge        prometheus.Gauge
+	tripsCounter     prometheus.Counter
+}
+
+type GuardConfig struct {
+	MaxRate        int           // maximum requests per second, zero for no limit
+	ErrorThreshold float64       // fraction of 429 or 5xx responses that opens the circuit, zero to disable
+	MinRequests    int           // minimum number of responses in a window before the circuit may open
+	Window         time.Duration // period over which the error rate is measured
+	Cooldown       time.Duration // time the circuit remains open before requests are sent again
+	ExperimentName string
+	TargetName     string
+}
+
+func NewTargetGuard(cfg GuardConfig) (*TargetGuard, error) {
+	g := &TargetGuard{}
+	if cfg.MaxRate > 0 {
+		g.limiter = NewTokenBucket(float64(cfg.MaxRate), cfg.MaxRate)
+	}
+	if cfg.ErrorThreshold > 0 {
+		g.breaker = NewCircuitBreaker(cfg.ErrorThreshold, cfg.MinRequests, cfg.Window, cfg.Cooldown)
+	}
+
+	throttled, err := newCounterMetric(
+		"guard_throttled_total",
+		"The number of requests not sent to an external target because of the safety rate cap or an open circuit breaker.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	g.throttledCounter = throttled.WithLabelValues(cfg.ExperimentName, cfg.TargetName)
+
+	open, err := newGaugeMetric(
+		"guard_circuit_open",
+		"Indicates whether the circuit breaker for an external target is open and requests are not being sent.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	g.openGauge = open.WithLabelValues(cfg.ExperimentName, cfg.TargetName)
+
+	trips, err := newCounterMetric(
+		"guard_circuit_trips_total",
+		"The number of times the circuit breaker for an external target has opened.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	g.tripsCounter = trips.WithLabelValues(cfg.ExperimentName, cfg.TargetName)
+
+	return g, nil
+}
+
+// Allow reports whether a request may be sent to the target now.
+func (g *TargetGuard) Allow() bool {
+	if g.breaker != nil {
+		if g.breaker.Open() {
+			g.openGauge.Set(1)
+			g.throttledCounter.Add(1)
+			return false
+		}
+		g.openGauge.Set(0)
+	}
+	if g.limiter != nil && !g.limiter.Take() {
+		g.throttledCounter.Add(1)
+		return false
+	}
+	return true
+}
+
+// Observe records the outcome of a request sent to the target.
+func (g *TargetGuard) Observe(statusCode int, failed bool) {
+	if g.breaker == nil {
+		return
+	}
+	if g.breaker.Record(failed || statusCode == 429 || statusCode/100 == 5) {
+		g.tripsCounter.Add(1)
+		g.openGauge.Set(1)
+	}
+}
+
+// A TokenBucket is a rate limiter that allows up to burst events at once and refills
+// at a steady rate.
+type TokenBucket struct {
+	rate  float64          // tokens added per second
+	burst float64          // maximum number of tokens
+	now   func() time.Time // source of the current time, replaced in tests
+
+	mu     sync.Mutex // guards following fields
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+		last:   time.Now(),
+	}
+}
+
+// Take removes a token from the bucket, reporting whether one was available.
+func (b *TokenBucket) Take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes a token from the bucket, returning how long the caller must wait before the
+// token is available. Unlike Take the bucket may go into debt, so a caller that waits for
+// the returned duration before each event is paced at exactly the bucket's rate.
+func (b *TokenBucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// A CircuitBreaker opens when the fraction of failed requests within a window exceeds
+// a threshold and closes again after a cooldown period.
+type CircuitBreaker struct {
+	threshold   float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+	now         func() time.Time // source of the current time, replaced in tests
+
+	mu          sync.Mutex // guards following fields
+	windowStart time.Time
+	total       int
+	failed      int
+	openUntil   time.Time
+}
+
+func NewCircuitBreaker(threshold float64, minRequests int, window time.Duration, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:   threshold,
+		minRequests: minRequests,
+		window:      window,
+		cooldown:    cooldown,
+		now:         time.Now,
+		windowStart: time.Now(),
+	}
+}
+
+// Open reports whether the circuit is open and requests should not be sent.
+func (c *CircuitBreaker) Open() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now().Before(c.openUntil)
+}
+
+// Record records the outcome of a request and reports whether it caused the circuit to open.
+func (c *CircuitBreaker) Record(failed bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Before(c.openUntil) {
+		// responses to requests sent before the circuit opened are ignored
+		return false
+	}
+	if now.Sub(c.windowStart) > c.window {
+		c.windowStart = now
+		c.total = 0
+		c.failed = 0
+	}
+
+	c.total++
+	if failed {
+		c.failed++
+	}
+
+	if c.total >= c.minRequests && float64(c.failed)/float64(c.total) >= c.threshold {
+		c.openUntil = now.Add(c.cooldown)
+		c.windowStart = c.openUntil
+		c.total = 0
+		c.failed = 0
+		return true
+	}
+	return false
+}
+
+// isExternal reports whether the target's resolved address is outside of a private network.
+func isExternal(t *Target) bool {
+	host, _, err := net.SplitHostPort(t.HostPort())
+	if err != nil {
+		host = t.HostPort()
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// unresolved names are assumed to be external
+		return true
+	}
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
+}
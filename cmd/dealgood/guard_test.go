@@ -0,0 +1,211 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when advanced.
+type testClock struct {
+	t time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time          { return c.t }
+func (c *testClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// useClock makes the bucket read the time from the clock, as though it had been created at the
+// clock's current time.
+func (b *TokenBucket) useClock(c *testClock) {
+	b.now = c.Now
+	b.last = c.Now()
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	clock := newTestClock()
+	b := NewTokenBucket(4, 2)
+	b.useClock(clock)
+
+	steps := []struct {
+		advance time.Duration
+		want    bool
+	}{
+		// the bucket starts full
+		{advance: 0, want: true},
+		{advance: 0, want: true},
+		{advance: 0, want: false},
+		// a token is added every 250ms
+		{advance: 100 * time.Millisecond, want: false},
+		{advance: 150 * time.Millisecond, want: true},
+		{advance: 0, want: false},
+		// an idle bucket only fills up to its burst
+		{advance: 10 * time.Second, want: true},
+		{advance: 0, want: true},
+		{advance: 0, want: false},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		if got := b.Take(); got != s.want {
+			t.Errorf("step %d: got %v, wanted %v", i, got, s.want)
+		}
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	clock := newTestClock()
+	b := NewTokenBucket(8, 1)
+	b.useClock(clock)
+	b.tokens = 0
+
+	steps := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		// the bucket goes into debt, so each reservation waits one interval longer
+		{advance: 0, want: 125 * time.Millisecond},
+		{advance: 0, want: 250 * time.Millisecond},
+		{advance: 0, want: 375 * time.Millisecond},
+		// waiting for a reservation pays off the debt it was made with
+		{advance: 375 * time.Millisecond, want: 125 * time.Millisecond},
+		{advance: 125 * time.Millisecond, want: 125 * time.Millisecond},
+		// a late caller is released at once, but only up to the burst
+		{advance: 5 * time.Second, want: 0},
+		{advance: 0, want: 125 * time.Millisecond},
+	}
+	for i, s := range steps {
+		clock.Advance(s.advance)
+		if got := b.Reserve(); got != s.want {
+			t.Errorf("step %d: got %v, wanted %v", i, got, s.want)
+		}
+	}
+}
+
+func TestNewTokenBucketBurst(t *testing.T) {
+	testCases := []struct {
+		burst int
+		want  float64
+	}{
+		{burst: -1, want: 1},
+		{burst: 0, want: 1},
+		{burst: 1, want: 1},
+		{burst: 20, want: 20},
+	}
+	for _, tc := range testCases {
+		b := NewTokenBucket(10, tc.burst)
+		if b.burst != tc.want {
+			t.Errorf("burst %d: got a burst of %v, wanted %v", tc.burst, b.burst, tc.want)
+		}
+		if b.tokens != tc.want {
+			t.Errorf("burst %d: got %v initial tokens, wanted %v", tc.burst, b.tokens, tc.want)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		advance  time.Duration
+		failed   bool
+		wantTrip bool
+		wantOpen bool
+	}
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens at threshold once minimum requests are seen",
+			steps: []step{
+				{failed: true},
+				{failed: true},
+				{failed: false},
+				{failed: true, wantTrip: true, wantOpen: true},
+			},
+		},
+		{
+			name: "stays closed below threshold",
+			steps: []step{
+				{failed: true},
+				{failed: false},
+				{failed: false},
+				{failed: false},
+				{failed: false},
+			},
+		},
+		{
+			name: "ignores responses while open and closes after cooldown",
+			steps: []step{
+				{failed: true},
+				{failed: true},
+				{failed: true},
+				{failed: true, wantTrip: true, wantOpen: true},
+				{advance: 29 * time.Second, failed: true, wantOpen: true},
+				// the failures before the circuit opened are forgotten
+				{advance: time.Second, failed: false},
+				{failed: true},
+				{failed: false},
+				{failed: true, wantTrip: true, wantOpen: true},
+			},
+		},
+		{
+			name: "forgets failures from an earlier window",
+			steps: []step{
+				{failed: true},
+				{failed: true},
+				{failed: true},
+				{advance: 11 * time.Second, failed: true},
+				{failed: false},
+				{failed: false},
+				{failed: false},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newTestClock()
+			c := NewCircuitBreaker(0.5, 4, 10*time.Second, 30*time.Second)
+			c.now = clock.Now
+			c.windowStart = clock.Now()
+
+			for i, s := range tc.steps {
+				clock.Advance(s.advance)
+				if got := c.Record(s.failed); got != s.wantTrip {
+					t.Errorf("step %d: got trip %v, wanted %v", i, got, s.wantTrip)
+				}
+				if got := c.Open(); got != s.wantOpen {
+					t.Errorf("step %d: got open %v, wanted %v", i, got, s.wantOpen)
+				}
+			}
+		})
+	}
+}
+
+func TestIsExternal(t *testing.T) {
+	testCases := []struct {
+		hostport string
+		want     bool
+	}{
+		{hostport: "localhost:8080", want: false},
+		{hostport: "127.0.0.1:8080", want: false},
+		{hostport: "10.1.2.3:8080", want: false},
+		{hostport: "172.16.0.1:80", want: false},
+		{hostport: "192.168.1.1:80", want: false},
+		{hostport: "169.254.169.254:80", want: false},
+		{hostport: "[::1]:8080", want: false},
+		{hostport: "[fd00::1]:8080", want: false},
+		{hostport: "10.1.2.3", want: false},
+		{hostport: "8.8.8.8:443", want: true},
+		{hostport: "[2001:4860:4860::8888]:443", want: true},
+		{hostport: "gateway.example.com:443", want: true},
+	}
+	for _, tc := range testCases {
+		tgt := &Target{}
+		tgt.SetHostPort(tc.hostport)
+		if got := isExternal(tgt); got != tc.want {
+			t.Errorf("%s: got %v, wanted %v", tc.hostport, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// HAR is the root of an HTTP Archive document. Only the subset of the HAR 1.2
+// format needed to describe replayed requests is supported.
+// See http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"` // total time of the request in milliseconds
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"` // name of the target the request was sent to
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// HARTimings are expressed in milliseconds, -1 indicates the timing does not apply
+type HARTimings struct {
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HARRecorder records a sample of the requests sent to targets so they can be
+// exported as a HAR file.
+type HARRecorder struct {
+	sampleRate float64 // fraction of requests to record
+	maxEntries int     // maximum number of entries to retain, zero means no limit
+
+	mu      sync.Mutex // guards following fields
+	rng     *rand.Rand
+	entries []HAREntry
+}
+
+func NewHARRecorder(sampleRate float64, maxEntries int) *HARRecorder {
+	return &HARRecorder{
+		sampleRate: sampleRate,
+		maxEntries: maxEntries,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Record adds the request and its response to the recorded sample if it is selected.
+func (h *HARRecorder) Record(targetName string, req *http.Request, resp *http.Response, start time.Time, connectTime, ttfb, totalTime time.Duration, size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.maxEntries > 0 && len(h.entries) >= h.maxEntries {
+		return
+	}
+	if h.rng.Float64() >= h.sampleRate {
+		return
+	}
+
+	entry := HAREntry{
+		StartedDateTime: start,
+		Time:            ms(totalTime),
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQueryString(req.URL.Query()),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: HARResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(resp.Header),
+			Content: HARContent{
+				Size:     size,
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    int(size),
+		},
+		Timings: HARTimings{
+			Connect: ms(connectTime),
+			Send:    0,
+			Wait:    ms(ttfb - connectTime),
+			Receive: ms(totalTime - ttfb),
+		},
+		Comment: targetName,
+	}
+	if req.Host != "" {
+		entry.Request.Headers = append(entry.Request.Headers, HARNameValue{Name: "Host", Value: req.Host})
+	}
+	if connectTime == 0 {
+		entry.Timings.Connect = -1
+	}
+
+	h.entries = append(h.entries, entry)
+}
+
+// WriteFile writes the recorded requests to the named file in HAR format.
+func (h *HARRecorder) WriteFile(fname string) error {
+	h.mu.Lock()
+	entries := make([]HAREntry, len(h.entries))
+	copy(entries, h.entries)
+	h.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+
+	doc := HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{
+				Name:    appName,
+				Version: "0.1",
+			},
+			Entries: entries,
+		},
+	}
+
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return nil
+}
+
+// NewHARRequestSource reads the entries of a HAR file and returns a RandomRequestSource
+// that will serve the requests at random.
+func NewHARRequestSource(fname string, filter filter.RequestFilter, metrics *RequestSourceMetrics) (*RandomRequestSource, error) {
+	reqs, err := readHARRequests(fname)
+	if err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("no requests found in %s", fname)
+	}
+
+	return NewRandomRequestSource(filter, metrics, reqs), nil
+}
+
+func readHARRequests(fname string) ([]*request.Request, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	var doc HAR
+	if err := json.NewDecoder(f).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	var reqs []*request.Request
+	for _, e := range doc.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			continue
+		}
+
+		req := &request.Request{
+			Method:    e.Request.Method,
+			URI:       u.RequestURI(),
+			Header:    map[string]string{},
+			Status:    e.Response.Status,
+			Timestamp: e.StartedDateTime,
+		}
+
+		for _, h := range e.Request.Headers {
+			// pseudo headers are recorded by browsers for http/2 requests
+			if strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			switch http.CanonicalHeaderKey(h.Name) {
+			case "User-Agent":
+				req.UserAgent = h.Value
+			case "Referer":
+				req.Referer = h.Value
+			case "Cookie", "Content-Length", "Connection":
+				continue
+			}
+			req.Header[http.CanonicalHeaderKey(h.Name)] = h.Value
+		}
+
+		if e.Request.PostData != nil && e.Request.PostData.Text != "" {
+			req.Body = []byte(e.Request.PostData.Text)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	return reqs, nil
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	nvs := make([]HARNameValue, 0, len(h))
+	for k, vs := range h {
+		for _, v := range vs {
+			nvs = append(nvs, HARNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(nvs, func(i, j int) bool { return nvs[i].Name < nvs[j].Name })
+	return nvs
+}
+
+func harQueryString(q url.Values) []HARNameValue {
+	nvs := make([]HARNameValue, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			nvs = append(nvs, HARNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(nvs, func(i, j int) bool { return nvs[i].Name < nvs[j].Name })
+	return nvs
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
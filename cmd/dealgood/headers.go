@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// headerCompareExpiry is the time after which an incomplete comparison is discarded. Comparisons
+// are normally completed or discarded as soon as every target has responded or been skipped, so
+// this only bounds the entries of requests that were lost, such as when the loader stops.
+const headerCompareExpiry = 2 * time.Minute
+
+// HeaderComparer captures selected response headers from each target and compares
+// them once every target has responded to the same request.
+type HeaderComparer struct {
+	experimentName string
+	headers        []string // canonical names of headers to capture
+	targets        int      // number of targets each request is sent to
+	logRate        float64  // fraction of mismatches to log
+
+	comparedCounter       *prometheus.CounterVec
+	headerMismatchCounter *prometheus.CounterVec
+	statusMismatchCounter *prometheus.CounterVec
+	bodyMismatchCounter   *prometheus.CounterVec
+
+	mu        sync.Mutex // guards following fields
+	rng       *rand.Rand
+	pending   map[*request.Request]*headerCapture
+	lastSweep time.Time
+}
+
+type headerCapture struct {
+	created   time.Time
+	responses []capturedResponse
+	skipped   int // number of targets that did not respond to the request
+}
+
+type capturedResponse struct {
+	target   string
+	status   int
+	headers  map[string]string
+	bodyHash string // empty unless bodies are being hashed
+}
+
+func NewHeaderComparer(experimentName string, headers []string, targets int, logRate float64) (*HeaderComparer, error) {
+	h := &HeaderComparer{
+		experimentName: experimentName,
+		targets:        targets,
+		logRate:        logRate,
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		pending:        make(map[*request.Request]*headerCapture),
+		lastSweep:      time.Now(),
+	}
+	for _, name := range headers {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		h.headers = append(h.headers, http.CanonicalHeaderKey(name))
+	}
+
+	var err error
+	h.comparedCounter, err = newCounterMetric(
+		"response_headers_compared_total",
+		"The number of requests whose response headers were compared across all targets.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	h.headerMismatchCounter, err = newCounterMetric(
+		"response_header_mismatch_total",
+		"The number of compared requests where the value of a response header differed between targets.",
+		[]string{"experiment", "header"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	h.statusMismatchCounter, err = newCounterMetric(
+		"response_status_mismatch_total",
+		"The number of compared requests where the response status code differed between targets.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	h.bodyMismatchCounter, err = newCounterMetric(
+		"response_body_mismatch_total",
+		"The number of compared requests where the hash of the response body differed between targets.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return h, nil
+}
+
+// Record captures the response from a target for a request. When all targets have
+// responded their headers, and the hashes of their bodies if known, are compared.
+func (h *HeaderComparer) Record(r *request.Request, targetName string, resp *http.Response, bodyHash string) {
+	cr := capturedResponse{
+		target:   targetName,
+		status:   resp.StatusCode,
+		headers:  make(map[string]string, len(h.headers)),
+		bodyHash: bodyHash,
+	}
+	for _, name := range h.headers {
+		cr.headers[name] = strings.Join(resp.Header.Values(name), ", ")
+	}
+
+	h.add(r, &cr)
+}
+
+// Skip records that a request was not sent to a target, or that the target failed to respond.
+// The responses of the other targets are then not compared.
+func (h *HeaderComparer) Skip(r *request.Request) {
+	h.add(r, nil)
+}
+
+// add accounts for the response of one target to a request, or for a skipped target when cr is
+// nil, and compares the responses once every target has been accounted for.
+func (h *HeaderComparer) add(r *request.Request, cr *capturedResponse) {
+	h.mu.Lock()
+	now := time.Now()
+	if now.Sub(h.lastSweep) > headerCompareExpiry {
+		for k, c := range h.pending {
+			if now.Sub(c.created) > headerCompareExpiry {
+				delete(h.pending, k)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	c, ok := h.pending[r]
+	if !ok {
+		c = &headerCapture{created: now}
+		h.pending[r] = c
+	}
+	if cr != nil {
+		c.responses = append(c.responses, *cr)
+	} else {
+		c.skipped++
+	}
+	if len(c.responses)+c.skipped < h.targets {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.pending, r)
+	if c.skipped > 0 {
+		h.mu.Unlock()
+		return
+	}
+	logMismatch := h.rng.Float64() < h.logRate
+	h.mu.Unlock()
+
+	h.compare(r, c.responses, logMismatch)
+}
+
+func (h *HeaderComparer) compare(r *request.Request, responses []capturedResponse, logMismatch bool) {
+	h.comparedCounter.WithLabelValues(h.experimentName).Add(1)
+
+	// Header differences are expected when the status differs so only the status is reported
+	for _, cr := range responses[1:] {
+		if cr.status != responses[0].status {
+			h.statusMismatchCounter.WithLabelValues(h.experimentName).Add(1)
+			if logMismatch {
+				h.logDiff(r, "status", responses, func(cr capturedResponse) string { return fmt.Sprint(cr.status) })
+			}
+			return
+		}
+	}
+
+	if responses[0].bodyHash != "" {
+		for _, cr := range responses[1:] {
+			if cr.bodyHash != responses[0].bodyHash {
+				h.bodyMismatchCounter.WithLabelValues(h.experimentName).Add(1)
+				if logMismatch {
+					h.logDiff(r, "body", responses, func(cr capturedResponse) string { return cr.bodyHash })
+				}
+				break
+			}
+		}
+	}
+
+	for _, name := range h.headers {
+		for _, cr := range responses[1:] {
+			if cr.headers[name] != responses[0].headers[name] {
+				h.headerMismatchCounter.WithLabelValues(h.experimentName, name).Add(1)
+				if logMismatch {
+					name := name // copied for capture by the closure
+					h.logDiff(r, name, responses, func(cr capturedResponse) string { return cr.headers[name] })
+				}
+				break
+			}
+		}
+	}
+}
+
+func (h *HeaderComparer) logDiff(r *request.Request, what string, responses []capturedResponse, value func(capturedResponse) string) {
+	sort.Slice(responses, func(i, j int) bool { return responses[i].target < responses[j].target })
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s mismatch for %s %s:", what, r.Method, r.URI)
+	for _, cr := range responses {
+		fmt.Fprintf(&b, " %s=%q", cr.target, value(cr))
+	}
+	fmt.Fprintln(os.Stderr, b.String())
+}
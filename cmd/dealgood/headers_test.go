@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+func TestHeaderComparerSkip(t *testing.T) {
+	h, err := NewHeaderComparer("headers-skip", []string{"Content-Type"}, 3, 0)
+	if err != nil {
+		t.Fatalf("new header comparer: %v", err)
+	}
+	compared := func() float64 {
+		return testutil.ToFloat64(h.comparedCounter.WithLabelValues("headers-skip"))
+	}
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}}}
+
+	testCases := []struct {
+		name         string
+		skipped      int
+		wantCompared float64
+	}{
+		{name: "all responded", skipped: 0, wantCompared: 1},
+		{name: "one skipped", skipped: 1, wantCompared: 0},
+		{name: "all skipped", skipped: 3, wantCompared: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := compared()
+			r := &request.Request{Method: "GET", URI: "/ipfs/x"}
+			for i := 0; i < 3-tc.skipped; i++ {
+				h.Record(r, "target", resp, "")
+			}
+			for i := 0; i < tc.skipped; i++ {
+				h.Skip(r)
+			}
+			if got := compared() - before; got != tc.wantCompared {
+				t.Errorf("got %v comparisons, wanted %v", got, tc.wantCompared)
+			}
+			if len(h.pending) != 0 {
+				t.Errorf("got %d pending comparisons, wanted none", len(h.pending))
+			}
+		})
+	}
+}
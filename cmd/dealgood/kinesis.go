@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+const (
+	// kinesisShardRefreshInterval is how often the stream is checked for new shards created by resharding
+	kinesisShardRefreshInterval = time.Minute
+
+	// kinesisCheckpointInterval is how often the position in each shard is saved
+	kinesisCheckpointInterval = 10 * time.Second
+
+	// kinesisPollInterval is the time to wait between reads from a shard. Kinesis allows five
+	// reads per second per shard, shared between all consumers of the stream.
+	kinesisPollInterval = time.Second
+
+	// kinesisMaxRetryDelay caps the delay between attempts to get a new iterator for a shard,
+	// which starts at kinesisPollInterval and doubles after each failure
+	kinesisMaxRetryDelay = 30 * time.Second
+
+	// kinesisShardEnd is the checkpoint recorded for a shard that has been closed and fully read
+	kinesisShardEnd = "SHARD_END"
+)
+
+type KinesisConfig struct {
+	AWSConfig       *aws.Config
+	Stream          string
+	CheckpointTable string // dynamodb table used to record the position in each shard, empty to start from the latest record
+}
+
+// KinesisRequestSource reads requests published by skyfish to a Kinesis data stream. Each
+// shard is read by its own goroutine and the position reached in each shard is periodically
+// checkpointed to a DynamoDB table so a restarted dealgood resumes where it left off.
+// Child shards created by resharding are only read once their parents have been fully read.
+type KinesisRequestSource struct {
+	cfg     KinesisConfig
+	ch      chan request.Request
+	done    chan struct{}
+	filter  filter.RequestFilter
+	metrics *RequestSourceMetrics
+
+	recordCounter prometheus.Counter
+	shardsGauge   prometheus.Gauge
+	behindGauge   *prometheus.GaugeVec
+
+	mu       sync.Mutex // guards following fields
+	svc      *kinesis.Kinesis
+	db       *dynamodb.DynamoDB
+	shards   map[string]bool // shards that are being read or have been fully read
+	finished map[string]bool // shards that have been fully read
+	err      error
+}
+
+func NewKinesisRequestSource(cfg *KinesisConfig, filter filter.RequestFilter, metrics *RequestSourceMetrics, rps int) (*KinesisRequestSource, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config must not be nil")
+	}
+	if cfg.Stream == "" {
+		return nil, fmt.Errorf("stream name must not be empty")
+	}
+	s := &KinesisRequestSource{
+		cfg:      *cfg,
+		ch:       make(chan request.Request, rps*60*30), // buffer at least 30 minutes of requests
+		done:     make(chan struct{}),
+		filter:   filter,
+		metrics:  metrics,
+		shards:   make(map[string]bool),
+		finished: make(map[string]bool),
+	}
+
+	recordCounter, err := newCounterMetric(
+		"kinesis_records_received_total",
+		"The number of records received from the kinesis stream.",
+		[]string{"stream"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.recordCounter = recordCounter.WithLabelValues(cfg.Stream)
+
+	shardsGauge, err := newGaugeMetric(
+		"kinesis_shards_active",
+		"The number of kinesis shards currently being read.",
+		[]string{"stream"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	s.shardsGauge = shardsGauge.WithLabelValues(cfg.Stream)
+
+	s.behindGauge, err = newGaugeMetric(
+		"kinesis_millis_behind_latest",
+		"The number of milliseconds the most recent read from each kinesis shard was behind the tip of the stream.",
+		[]string{"stream", "shard"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *KinesisRequestSource) Name() string {
+	return "kinesis"
+}
+
+func (s *KinesisRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *KinesisRequestSource) Start() error {
+	sess, err := session.NewSession(s.cfg.AWSConfig)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	s.mu.Lock()
+	s.svc = kinesis.New(sess)
+	if s.cfg.CheckpointTable != "" {
+		s.db = dynamodb.New(sess)
+	}
+	s.mu.Unlock()
+
+	// fail early if the stream cannot be read
+	if err := s.refreshShards(); err != nil {
+		return err
+	}
+	log.Printf("reading from kinesis stream %s", s.cfg.Stream)
+	s.metrics.connected.Set(1)
+
+	go func() {
+		ticker := time.NewTicker(kinesisShardRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				s.metrics.connected.Set(0)
+				return
+			case <-ticker.C:
+				if err := s.refreshShards(); err != nil {
+					s.metrics.errors.Add(1)
+					log.Printf("failed to refresh kinesis shards: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// refreshShards lists the shards in the stream and starts reading any shard that is not
+// already being read and whose parents have been fully read.
+func (s *KinesisRequestSource) refreshShards() error {
+	var shards []*kinesis.Shard
+	in := &kinesis.ListShardsInput{StreamName: aws.String(s.cfg.Stream)}
+	for {
+		out, err := s.svc.ListShards(in)
+		if err != nil {
+			return fmt.Errorf("list shards: %w", err)
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == nil {
+			break
+		}
+		// the stream name must not be given with a next token
+		in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+
+	listed := make(map[string]bool, len(shards))
+	for _, sh := range shards {
+		listed[aws.StringValue(sh.ShardId)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sh := range shards {
+		id := aws.StringValue(sh.ShardId)
+		if s.shards[id] {
+			continue
+		}
+		if !s.parentsFinished(listed, sh.ParentShardId, sh.AdjacentParentShardId) {
+			continue
+		}
+		s.shards[id] = true
+		s.shardsGauge.Add(1)
+		go s.readShard(id, sh.ParentShardId != nil)
+	}
+	return nil
+}
+
+// parentsFinished reports whether the parent shards have been fully read. Parents that are
+// no longer listed have passed the stream's retention period and are treated as finished.
+// It must be called with the mutex held.
+func (s *KinesisRequestSource) parentsFinished(listed map[string]bool, parents ...*string) bool {
+	for _, p := range parents {
+		if p == nil {
+			continue
+		}
+		id := aws.StringValue(p)
+		if listed[id] && !s.finished[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *KinesisRequestSource) readShard(shardID string, isChild bool) {
+	defer s.shardsGauge.Sub(1)
+
+	checkpoint, err := s.loadCheckpoint(shardID)
+	if err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to load checkpoint for shard %s, starting from latest record: %v", shardID, err)
+	}
+	if checkpoint == kinesisShardEnd {
+		s.finishShard(shardID)
+		return
+	}
+
+	lastSeq := checkpoint
+	iter, err := s.shardIterator(shardID, lastSeq, isChild)
+	if err != nil {
+		s.setErr(err)
+		return
+	}
+
+	lastCheckpoint := time.Now()
+	saved := lastSeq
+	for {
+		select {
+		case <-s.done:
+			s.saveCheckpoint(shardID, lastSeq, saved)
+			return
+		default:
+		}
+
+		out, err := s.svc.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iter,
+			Limit:         aws.Int64(10000),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				case kinesis.ErrCodeProvisionedThroughputExceededException:
+					time.Sleep(kinesisPollInterval)
+					continue
+				case kinesis.ErrCodeExpiredIteratorException:
+					next, ok := s.refreshIterator(shardID, lastSeq, isChild)
+					if !ok {
+						s.saveCheckpoint(shardID, lastSeq, saved)
+						return
+					}
+					iter = next
+					continue
+				}
+			}
+			s.metrics.errors.Add(1)
+			log.Printf("failed to read kinesis shard %s: %v", shardID, err)
+			time.Sleep(kinesisPollInterval)
+			continue
+		}
+
+		if out.MillisBehindLatest != nil {
+			s.behindGauge.WithLabelValues(s.cfg.Stream, shardID).Set(float64(*out.MillisBehindLatest))
+		}
+		s.recordCounter.Add(float64(len(out.Records)))
+		for _, rec := range out.Records {
+			if !s.processRecord(rec.Data) {
+				s.saveCheckpoint(shardID, lastSeq, saved)
+				return
+			}
+			lastSeq = aws.StringValue(rec.SequenceNumber)
+		}
+
+		if out.NextShardIterator == nil {
+			// the shard has been closed by resharding and all its records have been read
+			s.saveCheckpoint(shardID, kinesisShardEnd, saved)
+			s.behindGauge.DeleteLabelValues(s.cfg.Stream, shardID)
+			s.finishShard(shardID)
+			return
+		}
+		iter = out.NextShardIterator
+
+		if time.Since(lastCheckpoint) > kinesisCheckpointInterval {
+			s.saveCheckpoint(shardID, lastSeq, saved)
+			saved = lastSeq
+			lastCheckpoint = time.Now()
+		}
+
+		time.Sleep(kinesisPollInterval)
+	}
+}
+
+// refreshIterator replaces an expired iterator for a shard, retrying with backoff until it
+// succeeds. It returns false if the source is stopped first.
+func (s *KinesisRequestSource) refreshIterator(shardID string, lastSeq string, isChild bool) (*string, bool) {
+	retryDelay := kinesisPollInterval
+	for {
+		iter, err := s.shardIterator(shardID, lastSeq, isChild)
+		if err == nil {
+			return iter, true
+		}
+		s.metrics.errors.Add(1)
+		log.Printf("failed to refresh iterator for kinesis shard %s, retrying in %s: %v", shardID, retryDelay, err)
+		select {
+		case <-s.done:
+			return nil, false
+		case <-time.After(retryDelay):
+		}
+		retryDelay *= 2
+		if retryDelay > kinesisMaxRetryDelay {
+			retryDelay = kinesisMaxRetryDelay
+		}
+	}
+}
+
+// shardIterator returns an iterator positioned after the last sequence number read. Without
+// a sequence number, child shards are read from the start so no records are missed after
+// resharding and all other shards are read from the latest record.
+func (s *KinesisRequestSource) shardIterator(shardID string, lastSeq string, isChild bool) (*string, error) {
+	in := &kinesis.GetShardIteratorInput{
+		StreamName: aws.String(s.cfg.Stream),
+		ShardId:    aws.String(shardID),
+	}
+	switch {
+	case lastSeq != "":
+		in.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		in.StartingSequenceNumber = aws.String(lastSeq)
+	case isChild:
+		in.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+	default:
+		in.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeLatest)
+	}
+
+	out, err := s.svc.GetShardIterator(in)
+	if err != nil {
+		return nil, fmt.Errorf("get shard iterator: %w", err)
+	}
+	return out.ShardIterator, nil
+}
+
+// processRecord sends the requests contained in a record to the loader. It returns false
+// if the source has been stopped.
+func (s *KinesisRequestSource) processRecord(data []byte) bool {
+	payload, err := kinesisRecordPayload(data)
+	if err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to decode record: %v", err)
+		return true
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(payload))
+	for scanner.Scan() {
+		s.metrics.requestsIncoming.Add(1)
+		var req request.Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to unmarshal request: %v", err)
+			continue
+		}
+
+		if s.filter != nil && !s.filter(&req) {
+			s.metrics.requestsFiltered.Add(1)
+			continue
+		}
+
+		select {
+		case <-s.done:
+			return false
+		case s.ch <- req:
+		default:
+			s.metrics.requestsDropped.Add(1)
+		}
+	}
+	return true
+}
+
+// kinesisRecordPayload returns the requests contained in a record published by skyfish.
+// Records start with a line holding a JSON object of message attributes, equivalent to
+// the attributes of an sns message, followed by the message payload.
+func kinesisRecordPayload(data []byte) (string, error) {
+	header, payload, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return "", fmt.Errorf("record has no attribute header")
+	}
+	attrs := make(map[string]string)
+	if err := json.Unmarshal(header, &attrs); err != nil {
+		return "", fmt.Errorf("unmarshal attributes: %w", err)
+	}
+	return decodeMessagePayload(string(payload), attrs)
+}
+
+func (s *KinesisRequestSource) loadCheckpoint(shardID string) (string, error) {
+	if s.db == nil {
+		return "", nil
+	}
+	out, err := s.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.cfg.CheckpointTable),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			"shard_id": {S: aws.String(shardID)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("get item: %w", err)
+	}
+	if att, ok := out.Item["checkpoint"]; ok && att.S != nil {
+		return *att.S, nil
+	}
+	return "", nil
+}
+
+// saveCheckpoint records the position reached in a shard unless it is unchanged since the
+// previous checkpoint.
+func (s *KinesisRequestSource) saveCheckpoint(shardID string, checkpoint string, previous string) {
+	if s.db == nil || checkpoint == "" || checkpoint == previous {
+		return
+	}
+	_, err := s.db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.cfg.CheckpointTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"shard_id":   {S: aws.String(shardID)},
+			"checkpoint": {S: aws.String(checkpoint)},
+			"updated":    {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to save checkpoint for shard %s: %v", shardID, err)
+	}
+}
+
+func (s *KinesisRequestSource) finishShard(shardID string) {
+	s.mu.Lock()
+	s.finished[shardID] = true
+	s.mu.Unlock()
+
+	// start reading any children without waiting for the next refresh
+	select {
+	case <-s.done:
+	default:
+		if err := s.refreshShards(); err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to refresh kinesis shards: %v", err)
+		}
+	}
+}
+
+func (s *KinesisRequestSource) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *KinesisRequestSource) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+func (s *KinesisRequestSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
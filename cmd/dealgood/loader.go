@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -22,6 +23,25 @@ type Loader struct {
 	Concurrency    int                 // number of workers per target
 	Duration       int
 	PrintFailures  bool
+	HAR            *HARRecorder          // optional recorder of sampled requests
+	Headers        *HeaderComparer       // optional comparer of response headers
+	ServerTiming   *ServerTimingRecorder // optional recorder of Server-Timing response headers
+	Body           *BodyStrategy         // how response bodies are read, nil means bodies are read in full
+	Records        *ClickHouseSink       // optional sink of per-request records
+	Encodings      *EncodingMatrix       // optional matrix of Accept-Encoding values to send
+	EncodingSizes  *EncodingRecorder     // optional recorder of response sizes by content encoding
+	Slowest        *SlowestRecorder      // optional recorder of the slowest requests
+	Workload       *WorkloadProfile      // optional profile of the requests replayed
+	Audit          *ReplayAudit          // optional audit of the outcome of each request for every target
+	Barrier        *StartBarrier         // optional barrier that delays the measured window until everything is ready
+	Shutdown       *Shutdown             // optional staged shutdown that drains requests in flight when dealgood is stopped
+	Search         *CapacitySearch       // optional search for the highest rate each target sustains, started with the measured window
+	Spikes         *SpikeScenario        // optional periodic traffic spikes, scheduled from the start of the measured window
+	CookieMode     string                // cookie jar behaviour, see NewCookieJars
+	MaxCookieJars  int                   // maximum number of client cookie jars to retain per target
+	Burst          int                   // number of requests that may be sent at once to catch up with the rate, zero to choose automatically
+	Jitter         float64               // maximum random offset applied to each request's send time, as a fraction of the request interval
+	TargetQueue    int                   // number of requests that may wait for a target at its in-flight limit, zero to use the concurrency
 
 	streamLagGauge        *prometheus.GaugeVec
 	streamIntervalGauge   *prometheus.GaugeVec
@@ -110,17 +130,75 @@ func NewLoader(experimentName string, targets []*Target, source RequestSource, t
 	return l, nil
 }
 
+// queueSize returns the number of requests that may wait to be sent to a target that has reached
+// its in-flight limit before further requests are dropped.
+func (l *Loader) queueSize() int {
+	if l.TargetQueue > 0 {
+		return l.TargetQueue
+	}
+	return l.Concurrency
+}
+
 // Send sends requests to each target until the duration has passed or the context is canceled.
 func (l *Loader) Send(ctx context.Context) error {
-	var cancel func()
-	if l.Duration > 0 {
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(l.Duration)*time.Second)
-		defer cancel()
+	// the duration is counted from the start of the measured window, which is delayed by the
+	// start barrier
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	startWindow := func() {
+		if l.Search != nil {
+			go l.Search.Run(ctx)
+		}
+		if l.Spikes != nil {
+			l.Spikes.Start(time.Now())
+		}
+		if l.Duration > 0 {
+			t := time.AfterFunc(time.Duration(l.Duration)*time.Second, cancel)
+			go func() {
+				<-ctx.Done()
+				t.Stop()
+			}()
+		}
+	}
+	if l.Barrier == nil {
+		startWindow()
 	}
 
 	workers := make([]*Worker, 0, len(l.Targets)*l.Concurrency)
 	for _, target := range l.Targets {
-		for j := 0; j < l.Concurrency; j++ {
+		// client cookie jars are shared by all of a target's workers
+		var targetJars CookieJars
+		if l.CookieMode == "client" {
+			var err error
+			targetJars, err = NewCookieJars(l.CookieMode, l.MaxCookieJars)
+			if err != nil {
+				return fmt.Errorf("cookie jars: %w", err)
+			}
+		}
+
+		workerCount := l.Concurrency
+		if target.MaxInFlight > 0 && target.MaxInFlight < workerCount {
+			// each worker sends one request at a time, so the number of workers caps the requests
+			// in flight and the rest wait in the target's queue
+			workerCount = target.MaxInFlight
+			queue, err := NewTargetQueue(l.ExperimentName, target.Name)
+			if err != nil {
+				return fmt.Errorf("target queue: %w", err)
+			}
+			target.Queue = queue
+			target.Requests = make(chan *targetRequest, l.queueSize())
+		}
+
+		for j := 0; j < workerCount; j++ {
+			jars := targetJars
+			if jars == nil {
+				var err error
+				jars, err = NewCookieJars(l.CookieMode, l.MaxCookieJars)
+				if err != nil {
+					return fmt.Errorf("cookie jars: %w", err)
+				}
+			}
+
 			tr := &http.Transport{
 				TLSClientConfig: &tls.Config{
 					InsecureSkipVerify: true,
@@ -129,6 +207,7 @@ func (l *Loader) Send(ctx context.Context) error {
 				MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
 				DisableCompression:  true,
 				DisableKeepAlives:   true,
+				DialContext:         target.DialContext,
 			}
 			http2.ConfigureTransport(tr)
 
@@ -140,6 +219,17 @@ func (l *Loader) Send(ctx context.Context) error {
 					Timeout:   30 * time.Second,
 				},
 				PrintFailures: l.PrintFailures,
+				HAR:           l.HAR,
+				Headers:       l.Headers,
+				Cookies:       jars,
+				ServerTiming:  l.ServerTiming,
+				Body:          l.Body,
+				Records:       l.Records,
+				Encodings:     l.EncodingSizes,
+				Slowest:       l.Slowest,
+				Workload:      l.Workload,
+				Audit:         l.Audit,
+				Spikes:        l.Spikes,
 			})
 		}
 	}
@@ -150,72 +240,171 @@ func (l *Loader) Send(ctx context.Context) error {
 		go w.Run(ctx, &wg, l.Timings)
 	}
 
+	if l.Barrier != nil {
+		l.Barrier.ArmScrape()
+	}
 	if err := l.Source.Start(); err != nil {
 		return fmt.Errorf("start source: %w", err)
 	}
+	sourceStart := time.Now()
+	started := l.Barrier == nil
 
-	requestInterval := time.Duration(float64(time.Second) / float64(l.Rate))
+	// a nil channel is never ready, so the loop only stops for a shutdown if there is one
+	var stopping <-chan struct{}
+	if l.Shutdown != nil {
+		l.Shutdown.Sending()
+		stopping = l.Shutdown.Stopping()
+	}
 
-	tick := time.NewTicker(requestInterval)
-	defer tick.Stop()
+	pacer := NewPacer(float64(l.Rate), l.Burst, l.Jitter)
+	pacerRate := float64(l.Rate)
 
+	l.targetsGauge.WithLabelValues(l.ExperimentName).Set(float64(len(l.Targets)))
+	l.rateGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Rate))
+	l.concurrencyGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Concurrency))
+
+	var seq uint64 // number of requests read from the source
 loop:
 	for {
+		if l.Spikes != nil {
+			if rate := l.Spikes.Rate(float64(l.Rate)); rate != pacerRate {
+				pacer = NewPacer(rate, l.Burst, l.Jitter)
+				pacerRate = rate
+			}
+		}
+		if err := pacer.Wait(ctx); err != nil {
+			break loop
+		}
+
+		var req request.Request
+		var ok bool
+
+		// Do we have a request available
 		select {
 		case <-ctx.Done():
 			break loop
-		case <-tick.C:
-			l.targetsGauge.WithLabelValues(l.ExperimentName).Set(float64(len(l.Targets)))
-			l.rateGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Rate))
-			l.concurrencyGauge.WithLabelValues(l.ExperimentName).Set(float64(l.Concurrency))
-
-			var req request.Request
-			var ok bool
+		case <-stopping:
+			break loop
+		case req, ok = <-l.Source.Chan():
+		default:
+			// No request ready so report that
+			l.streamWaitCounter.WithLabelValues(l.ExperimentName).Add(1)
 
-			// Do we have a request available
+			// Now wait for the request
 			select {
 			case <-ctx.Done():
 				break loop
+			case <-stopping:
+				break loop
 			case req, ok = <-l.Source.Chan():
-			default:
-				// No request ready so report that
-				l.streamWaitCounter.WithLabelValues(l.ExperimentName).Add(1)
-
-				// Now wait for the request
-				select {
-				case <-ctx.Done():
-					break loop
-				case req, ok = <-l.Source.Chan():
-				}
 			}
-			if !ok {
-				// Channel was closed so source is terminated
+		}
+		if !ok {
+			// Channel was closed so source is terminated
+			break loop
+		}
+
+		if !started {
+			// the first request shows the source is connected to the stream
+			l.Barrier.Stage("stream", time.Since(sourceStart))
+			scraped, err := l.Barrier.WaitScrape(ctx)
+			if err != nil {
 				break loop
 			}
-			// Report that we got a request
-			l.streamRequestsCounter.WithLabelValues(l.ExperimentName).Add(1)
-
-			// report how far behind the stream we are
-			l.streamLagGauge.WithLabelValues(l.ExperimentName).Set(time.Since(req.Timestamp).Seconds())
-
-			for _, be := range l.Targets {
-				select {
-				case be.Requests <- &req:
-				default:
-					l.Timings <- &RequestTiming{
-						ExperimentName: l.ExperimentName,
-						TargetName:     be.Name,
-						Dropped:        true,
-					}
+			if !scraped {
+				fmt.Fprintf(os.Stderr, "metrics were not scraped within the start barrier timeout, starting the measured window anyway\n")
+			}
+			windowStart := time.Now()
+			l.Barrier.Started(windowStart)
+			fmt.Printf("Measured window started at %s\n", windowStart.UTC().Format(time.RFC3339Nano))
+			startWindow()
+			started = true
+			// restart pacing so time spent at the barrier is not made up with a burst
+			pacer = NewPacer(float64(l.Rate), l.Burst, l.Jitter)
+			pacerRate = float64(l.Rate)
+		}
+		// Report that we got a request
+		l.streamRequestsCounter.WithLabelValues(l.ExperimentName).Add(1)
+
+		// report how far behind the stream we are
+		l.streamLagGauge.WithLabelValues(l.ExperimentName).Set(time.Since(req.Timestamp).Seconds())
+
+		if l.Encodings != nil {
+			req.Header = l.Encodings.Apply(req.Header)
+		}
+		if l.Workload != nil {
+			l.Workload.Request(&req)
+		}
+		seq++
+		if l.Audit != nil {
+			l.Audit.Begin(seq, &req)
+		}
+
+		for _, be := range l.Targets {
+			if be.Guard != nil && !be.Guard.Allow() {
+				if l.Audit != nil {
+					l.Audit.Outcome(seq, be.Name, auditSkipped)
+				}
+				if l.Headers != nil {
+					l.Headers.Skip(&req)
+				}
+				continue
+			}
+			if be.Search != nil && !be.Search.Allow() {
+				if l.Audit != nil {
+					l.Audit.Outcome(seq, be.Name, auditSkipped)
+				}
+				if l.Headers != nil {
+					l.Headers.Skip(&req)
+				}
+				continue
+			}
+			treq := &targetRequest{Request: &req, id: seq}
+			if be.Queue != nil {
+				treq.queued = time.Now()
+			}
+			select {
+			case be.Requests <- treq:
+				if be.Queue != nil {
+					depth := len(be.Requests)
+					be.Queue.Queued(depth, depth > 0)
+				}
+			default:
+				if l.Audit != nil {
+					l.Audit.Outcome(seq, be.Name, auditDropped)
+				}
+				if l.Headers != nil {
+					l.Headers.Skip(&req)
 				}
+				l.Timings <- acquireTiming(RequestTiming{
+					ExperimentName: l.ExperimentName,
+					TargetName:     be.Name,
+					Dropped:        true,
+				})
 			}
 		}
 	}
 
+	// when stopped, no further requests are consumed from the source while those already sent
+	// to targets are drained
+	draining := l.Shutdown != nil && l.Shutdown.Stopped()
+	if draining {
+		stopStart := time.Now()
+		l.Source.Stop()
+		l.Shutdown.Stage("source", time.Since(stopStart))
+	}
 	for _, be := range l.Targets {
 		close(be.Requests)
 	}
+	if draining && !l.Shutdown.Drain(&wg) {
+		cancel()
+	}
 	wg.Wait()
+	if l.Barrier != nil && started {
+		windowEnd := time.Now()
+		l.Barrier.Ended(windowEnd)
+		fmt.Printf("Measured window ended at %s\n", windowEnd.UTC().Format(time.RFC3339Nano))
+	}
 
 	if err := l.Source.Err(); err != nil {
 		return fmt.Errorf("source: %w", err)
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/nats"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+const (
+	// natsFetchBatch is the maximum number of messages requested from the consumer at a time
+	natsFetchBatch = 256
+
+	// natsFetchExpiry is how long a request for messages waits for them to be published
+	natsFetchExpiry = 5 * time.Second
+
+	// natsAckWait is how long the server waits for a message to be acknowledged before
+	// delivering it again
+	natsAckWait = 30 * time.Second
+
+	// natsReconnectInterval is the time to wait before reconnecting to a server that went away
+	natsReconnectInterval = 5 * time.Second
+)
+
+type NATSConfig struct {
+	URL               string
+	Stream            string
+	Consumer          string        // name of the durable consumer, created if it does not exist
+	StartSequence     uint64        // stream sequence a new consumer starts from, 0 for none
+	StartTime         time.Time     // time a new consumer starts from, zero for none
+	InactiveThreshold time.Duration // time after which the server deletes the consumer once it is no longer read
+}
+
+// NATSRequestSource reads requests published by skyfish to a NATS JetStream stream through a
+// durable pull consumer. The server keeps the consumer's position in the stream, so a restarted
+// dealgood resumes where it left off, and a new consumer may start from a sequence number or
+// time to replay requests already in the stream.
+type NATSRequestSource struct {
+	cfg     NATSConfig
+	ch      chan request.Request
+	ctx     context.Context
+	cancel  context.CancelFunc
+	filter  filter.RequestFilter
+	metrics *RequestSourceMetrics
+
+	messageCounter prometheus.Counter
+	pendingGauge   prometheus.Gauge
+
+	mu   sync.Mutex // guards following fields
+	conn *nats.Conn
+	js   *nats.JetStream
+}
+
+func NewNATSRequestSource(cfg *NATSConfig, filter filter.RequestFilter, metrics *RequestSourceMetrics, rps int) (*NATSRequestSource, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config must not be nil")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("server url must not be empty")
+	}
+	if cfg.Stream == "" {
+		return nil, fmt.Errorf("stream name must not be empty")
+	}
+	if cfg.Consumer == "" {
+		return nil, fmt.Errorf("consumer name must not be empty")
+	}
+	if cfg.StartSequence > 0 && !cfg.StartTime.IsZero() {
+		return nil, fmt.Errorf("only one of start sequence or start time may be given")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &NATSRequestSource{
+		cfg:     *cfg,
+		ch:      make(chan request.Request, rps*60*30), // buffer at least 30 minutes of requests
+		ctx:     ctx,
+		cancel:  cancel,
+		filter:  filter,
+		metrics: metrics,
+	}
+
+	messageCounter, err := newCounterMetric(
+		"nats_messages_received_total",
+		"The number of messages received from the nats stream.",
+		[]string{"stream"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.messageCounter = messageCounter.WithLabelValues(cfg.Stream)
+
+	pendingGauge, err := newGaugeMetric(
+		"nats_messages_pending",
+		"The number of messages in the nats stream not yet delivered to dealgood's consumer.",
+		[]string{"stream"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	s.pendingGauge = pendingGauge.WithLabelValues(cfg.Stream)
+
+	return s, nil
+}
+
+func (s *NATSRequestSource) Name() string {
+	return "nats"
+}
+
+func (s *NATSRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *NATSRequestSource) Start() error {
+	// fail early if the stream cannot be read
+	if err := s.connect(); err != nil {
+		return err
+	}
+	log.Printf("reading from nats stream %s with consumer %s", s.cfg.Stream, s.cfg.Consumer)
+	go s.run()
+	return nil
+}
+
+// connect connects to the server and creates the consumer if it does not exist.
+func (s *NATSRequestSource) connect() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+
+	conn, err := nats.Dial(ctx, s.cfg.URL, appName)
+	if err != nil {
+		return err
+	}
+	js := nats.NewJetStream(conn, 10*time.Second)
+	if err := s.ensureConsumer(ctx, js); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.js = js
+	s.mu.Unlock()
+	s.metrics.connected.Set(1)
+	return nil
+}
+
+func (s *NATSRequestSource) ensureConsumer(ctx context.Context, js *nats.JetStream) error {
+	info, err := js.ConsumerInfo(ctx, s.cfg.Stream, s.cfg.Consumer)
+	if err == nil {
+		if s.cfg.StartSequence > 0 || !s.cfg.StartTime.IsZero() {
+			log.Printf("consumer %s already exists, resuming from stream sequence %d rather than the requested start", s.cfg.Consumer, info.Delivered.StreamSeq)
+		}
+		return nil
+	}
+	if !errors.Is(err, nats.ErrNotFound) {
+		return fmt.Errorf("consumer info: %w", err)
+	}
+
+	cc := nats.ConsumerConfig{
+		Durable:           s.cfg.Consumer,
+		DeliverPolicy:     nats.DeliverNew,
+		AckPolicy:         nats.AckPolicyAll,
+		AckWait:           natsAckWait,
+		MaxAckPending:     natsFetchBatch * 4,
+		InactiveThreshold: s.cfg.InactiveThreshold,
+	}
+	switch {
+	case s.cfg.StartSequence > 0:
+		cc.DeliverPolicy = nats.DeliverByStartSeq
+		cc.OptStartSeq = s.cfg.StartSequence
+	case !s.cfg.StartTime.IsZero():
+		cc.DeliverPolicy = nats.DeliverByStartTime
+		start := s.cfg.StartTime.UTC()
+		cc.OptStartTime = &start
+	}
+	if _, err := js.AddConsumer(ctx, s.cfg.Stream, cc); err != nil {
+		return fmt.Errorf("add consumer: %w", err)
+	}
+	log.Printf("created nats consumer %s, delivering %s", s.cfg.Consumer, cc.DeliverPolicy)
+	return nil
+}
+
+func (s *NATSRequestSource) run() {
+	defer s.metrics.connected.Set(0)
+	for {
+		s.mu.Lock()
+		conn, js := s.conn, s.js
+		s.mu.Unlock()
+
+		msgs, err := js.Fetch(s.ctx, s.cfg.Stream, s.cfg.Consumer, natsFetchBatch, natsFetchExpiry)
+		if s.ctx.Err() != nil {
+			conn.Close()
+			return
+		}
+		if !s.processMessages(msgs) {
+			conn.Close()
+			return
+		}
+		if err == nil {
+			continue
+		}
+
+		s.metrics.errors.Add(1)
+		log.Printf("failed to read nats stream %s: %v", s.cfg.Stream, err)
+		if errors.Is(err, nats.ErrNotFound) {
+			// the consumer was deleted, recreate it on the same connection
+			if err := s.ensureConsumer(s.ctx, js); err != nil {
+				log.Printf("failed to recreate nats consumer: %v", err)
+				time.Sleep(natsReconnectInterval)
+			}
+			continue
+		}
+		if conn.Err() == nil {
+			time.Sleep(natsReconnectInterval)
+			continue
+		}
+
+		s.metrics.connected.Set(0)
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(natsReconnectInterval):
+			}
+			if err := s.connect(); err != nil {
+				s.metrics.errors.Add(1)
+				log.Printf("failed to reconnect to nats: %v", err)
+				continue
+			}
+			log.Printf("reconnected to nats stream %s", s.cfg.Stream)
+			break
+		}
+	}
+}
+
+// processMessages sends the requests contained in the messages to the loader, then
+// acknowledges them. It returns false if the source has been stopped.
+func (s *NATSRequestSource) processMessages(msgs []*nats.Msg) bool {
+	if len(msgs) == 0 {
+		return true
+	}
+	s.messageCounter.Add(float64(len(msgs)))
+	for _, msg := range msgs {
+		if !s.processMessage(msg) {
+			return false
+		}
+	}
+
+	// the consumer acknowledges every earlier message along with the last
+	last := msgs[len(msgs)-1]
+	if err := last.Ack(); err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to acknowledge nats messages: %v", err)
+	}
+	if md, err := last.Metadata(); err == nil {
+		s.pendingGauge.Set(float64(md.Pending))
+	}
+	return true
+}
+
+func (s *NATSRequestSource) processMessage(msg *nats.Msg) bool {
+	// header names are canonicalized when read but skyfish's attributes are lower case
+	attrs := make(map[string]string, len(msg.Header))
+	for k, v := range msg.Header {
+		if len(v) > 0 {
+			attrs[strings.ToLower(k)] = v[0]
+		}
+	}
+	payload, err := decodeMessagePayload(string(msg.Data), attrs)
+	if err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to decode message: %v", err)
+		return true
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(payload))
+	for scanner.Scan() {
+		s.metrics.requestsIncoming.Add(1)
+		var req request.Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to unmarshal request: %v", err)
+			continue
+		}
+
+		if s.filter != nil && !s.filter(&req) {
+			s.metrics.requestsFiltered.Add(1)
+			continue
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return false
+		case s.ch <- req:
+		default:
+			s.metrics.requestsDropped.Add(1)
+		}
+	}
+	return true
+}
+
+func (s *NATSRequestSource) Stop() {
+	s.cancel()
+}
+
+// Err always returns nil since failures to read the stream are retried until the source is stopped.
+func (s *NATSRequestSource) Err() error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// A Pacer schedules events at a steady rate. Each event is scheduled relative to the
+// previous one rather than to when the caller was last woken, so imprecise timers and
+// slow callers do not cause the rate to drift. When the caller falls behind, up to
+// burst events are released immediately to catch up.
+type Pacer struct {
+	bucket   *TokenBucket
+	interval time.Duration
+	jitter   float64 // maximum random offset applied to each event, as a fraction of the interval
+	rng      *rand.Rand
+	timer    *time.Timer
+}
+
+// NewPacer returns a pacer for the given rate in events per second. A burst less than one
+// is chosen automatically to allow catching up on 10ms of events.
+func NewPacer(rate float64, burst int, jitter float64) *Pacer {
+	if burst < 1 {
+		burst = int(rate / 100)
+	}
+	b := NewTokenBucket(rate, burst)
+	// start with an empty bucket so the first events are paced rather than sent as a burst
+	b.tokens = 0
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	return &Pacer{
+		bucket:   b,
+		interval: time.Duration(float64(time.Second) / rate),
+		jitter:   jitter,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		timer:    timer,
+	}
+}
+
+// Wait blocks until the next event is due or the context is canceled. It is not safe for concurrent use.
+func (p *Pacer) Wait(ctx context.Context) error {
+	d := p.bucket.Reserve()
+	if p.jitter > 0 {
+		// the offset is symmetric so the mean rate is unaffected
+		d += time.Duration((p.rng.Float64()*2 - 1) * p.jitter * float64(p.interval))
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	p.timer.Reset(d)
+	select {
+	case <-ctx.Done():
+		if !p.timer.Stop() {
+			<-p.timer.C
+		}
+		return ctx.Err()
+	case <-p.timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewPacerBurst(t *testing.T) {
+	testCases := []struct {
+		rate  float64
+		burst int
+		want  float64
+	}{
+		// the default burst covers 10ms of events, but is at least one
+		{rate: 1, burst: 0, want: 1},
+		{rate: 150, burst: 0, want: 1},
+		{rate: 250, burst: 0, want: 2},
+		{rate: 1000, burst: 0, want: 10},
+		{rate: 1000, burst: 3, want: 3},
+	}
+	for _, tc := range testCases {
+		p := NewPacer(tc.rate, tc.burst, 0)
+		if p.bucket.burst != tc.want {
+			t.Errorf("rate %v, burst %d: got a burst of %v, wanted %v", tc.rate, tc.burst, p.bucket.burst, tc.want)
+		}
+	}
+}
+
+func TestPacerCatchUp(t *testing.T) {
+	clock := newTestClock()
+	p := NewPacer(1600, 0, 0)
+	p.bucket.useClock(clock)
+
+	// a new pacer has no tokens, so its first event is paced rather than sent at once
+	if d := p.bucket.Reserve(); d <= 0 {
+		t.Fatalf("got a first wait of %v, wanted a positive wait", d)
+	}
+
+	// after falling a second behind, only the burst is released to catch up
+	clock.Advance(time.Second)
+	released := 0
+	for p.bucket.Reserve() <= 0 {
+		released++
+	}
+	if released != 16 {
+		t.Errorf("got %d events released at once, wanted 16", released)
+	}
+}
+
+func TestPacerRebuiltAtNewRate(t *testing.T) {
+	// the loader builds a new pacer when a spike changes the rate, so the new rate must take
+	// effect at once without releasing a burst
+	clock := newTestClock()
+	p := NewPacer(4, 0, 0)
+	p.bucket.useClock(clock)
+	for i := 0; i < 4; i++ {
+		p.bucket.Reserve()
+	}
+
+	p = NewPacer(8, 0, 0)
+	p.bucket.useClock(clock)
+	for i, want := range []time.Duration{125 * time.Millisecond, 250 * time.Millisecond} {
+		if got := p.bucket.Reserve(); got != want {
+			t.Errorf("reservation %d: got %v, wanted %v", i, got, want)
+		}
+	}
+}
+
+func TestPacerWaitCanceled(t *testing.T) {
+	p := NewPacer(0.001, 0, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Wait(ctx); err != context.Canceled {
+		t.Errorf("got %v, wanted %v", err, context.Canceled)
+	}
+}
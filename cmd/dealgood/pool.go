@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// bodyBufferSize is the size of the buffers used to read response bodies. It is larger
+// than the buffer used by io.Copy so large responses, such as CAR files, need fewer reads.
+const bodyBufferSize = 64 << 10
+
+var bodyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bodyBufferSize)
+		return &buf
+	},
+}
+
+// discardBody reads r until EOF using a pooled buffer and returns the number of bytes read.
+func discardBody(r io.Reader) (int64, error) {
+	bufp := bodyBufferPool.Get().(*[]byte)
+	defer bodyBufferPool.Put(bufp)
+	buf := *bufp
+
+	var n int64
+	for {
+		nr, err := r.Read(buf)
+		n += int64(nr)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+var timingPool = sync.Pool{
+	New: func() any {
+		return new(RequestTiming)
+	},
+}
+
+// acquireTiming returns a RequestTiming from the pool. Ownership passes to the
+// collector once the timing is sent on the timings channel.
+func acquireTiming(v RequestTiming) *RequestTiming {
+	rt := timingPool.Get().(*RequestTiming)
+	*rt = v
+	return rt
+}
+
+// releaseTiming returns a RequestTiming to the pool once it has been collected.
+func releaseTiming(rt *RequestTiming) {
+	*rt = RequestTiming{}
+	timingPool.Put(rt)
+}
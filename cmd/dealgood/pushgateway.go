@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// A MetricsPusher pushes metrics to a Prometheus Pushgateway whenever the scrape endpoint
+// has not been scraped recently, so that metrics survive network partitions between
+// Prometheus and dealgood. Since counters and histograms are cumulative the gateway only
+// needs to hold the most recent values; a final push is made when dealgood exits so the
+// values are retained when the task is replaced.
+type MetricsPusher struct {
+	pusher     *push.Pusher
+	interval   time.Duration // how often to check whether metrics need to be pushed
+	staleAfter time.Duration // time since the last scrape after which metrics are pushed
+	scrapes    *ScrapeNotifier
+
+	pushing prom.Gauge
+	pushes  *prom.CounterVec
+}
+
+func NewMetricsPusher(url string, experiment string, scrapes *ScrapeNotifier, interval time.Duration, staleAfter time.Duration) (*MetricsPusher, error) {
+	instance, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("hostname: %w", err)
+	}
+
+	p := &MetricsPusher{
+		pusher: push.New(url, appName).
+			Gatherer(prom.DefaultGatherer).
+			Grouping("experiment", experiment).
+			Grouping("instance", instance),
+		interval:   interval,
+		staleAfter: staleAfter,
+		scrapes:    scrapes,
+	}
+
+	pushing, err := newGaugeMetric(
+		"pushgateway_active",
+		"Indicates whether metrics are being pushed to the pushgateway because the scrape endpoint has not been scraped recently.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	p.pushing = pushing.WithLabelValues(experiment)
+
+	p.pushes, err = newCounterMetric(
+		"pushgateway_pushes_total",
+		"The number of attempts to push metrics to the pushgateway, by result.",
+		[]string{"experiment", "result"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.pushes = p.pushes.MustCurryWith(prom.Labels{"experiment": experiment})
+
+	return p, nil
+}
+
+// Run pushes metrics periodically while the scrape endpoint is not being scraped, until the context is canceled.
+func (p *MetricsPusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.scrapes.Since() < p.staleAfter {
+				p.pushing.Set(0)
+				continue
+			}
+			p.pushing.Set(1)
+			if err := p.push(ctx); err != nil {
+				fmt.Fprintf(os.Stderr, "push metrics: %v\n", err)
+			}
+		}
+	}
+}
+
+// Close makes a final push of metrics so they are retained after dealgood exits.
+func (p *MetricsPusher) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return p.push(ctx)
+}
+
+func (p *MetricsPusher) push(ctx context.Context) error {
+	if err := p.pusher.PushContext(ctx); err != nil {
+		p.pushes.WithLabelValues("failed").Add(1)
+		return err
+	}
+	p.pushes.WithLabelValues("ok").Add(1)
+	return nil
+}
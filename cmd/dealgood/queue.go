@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A targetRequest is a request waiting to be sent to a target.
+type targetRequest struct {
+	*request.Request
+	id     uint64    // position of the request in the order it was read from the source
+	queued time.Time // when the request was queued for a target with an in-flight limit, zero otherwise
+}
+
+// A TargetQueue holds requests for a target whose number of in-flight requests is limited,
+// emulating the connection cap of a load balancer in front of it. Requests that arrive while
+// the target is at its limit wait in the queue, rather than being sent concurrently, and are
+// only dropped once the queue is full. The time spent waiting is not included in the request's
+// timings but is recorded separately.
+type TargetQueue struct {
+	experiment string
+	target     string
+
+	depthGauge    *prometheus.GaugeVec
+	waitHist      *prometheus.HistogramVec
+	queuedCounter *prometheus.CounterVec
+}
+
+func NewTargetQueue(experiment string, target string) (*TargetQueue, error) {
+	q := &TargetQueue{
+		experiment: experiment,
+		target:     target,
+	}
+
+	var err error
+	q.depthGauge, err = newGaugeMetric(
+		"target_queue_depth",
+		"The number of requests waiting to be sent to a target because it has reached its limit of in-flight requests.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	q.waitHist, err = newHistogramMetric(
+		"target_queue_wait_seconds",
+		"The time requests waited to be sent to a target because it had reached its limit of in-flight requests.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	q.queuedCounter, err = newCounterMetric(
+		"target_queued_requests_total",
+		"The number of requests that had to wait to be sent to a target because it had reached its limit of in-flight requests.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return q, nil
+}
+
+// Queued records the number of requests waiting after one is added to the queue. busy reports
+// whether the request had to wait because every worker was sending a request.
+func (q *TargetQueue) Queued(depth int, busy bool) {
+	q.depthGauge.WithLabelValues(q.experiment, q.target).Set(float64(depth))
+	if busy {
+		q.queuedCounter.WithLabelValues(q.experiment, q.target).Add(1)
+	}
+}
+
+// Dequeued records the time a request waited and the number of requests still waiting once it
+// is taken from the queue.
+func (q *TargetQueue) Dequeued(r *targetRequest, depth int) {
+	q.depthGauge.WithLabelValues(q.experiment, q.target).Set(float64(depth))
+	q.waitHist.WithLabelValues(q.experiment, q.target).Observe(time.Since(r.queued).Seconds())
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+const (
+	// redisReadCount is the maximum number of entries read from the stream at a time
+	redisReadCount = 256
+
+	// redisBlockTime is how long a read waits for entries to be added to the stream
+	redisBlockTime = 5 * time.Second
+
+	// redisRetryInterval is the time to wait before reading again after a failed read
+	redisRetryInterval = 5 * time.Second
+
+	// redisPayloadField is the field of a stream entry holding the batch of requests, every other
+	// field is a message attribute
+	redisPayloadField = "payload"
+
+	// redisStartNew is the position of a new consumer group that reads entries added after it
+	// is created
+	redisStartNew = "$"
+)
+
+type RedisConfig struct {
+	URL      string
+	Stream   string
+	Group    string // name of the consumer group, created if it does not exist
+	Consumer string // name of this reader within the group, defaults to the hostname
+	Start    string // entry id a new group starts after, "$" for new entries or "0" for every entry
+}
+
+// RedisRequestSource reads requests added by skyfish to a Redis stream through a consumer group.
+// The server keeps the group's position in the stream, so a restarted dealgood resumes where it
+// left off, first reading any entries it was delivered but had not acknowledged.
+type RedisRequestSource struct {
+	cfg     RedisConfig
+	ch      chan request.Request
+	ctx     context.Context
+	cancel  context.CancelFunc
+	filter  filter.RequestFilter
+	metrics *RequestSourceMetrics
+
+	entryCounter prometheus.Counter
+
+	client *redis.Client
+}
+
+func NewRedisRequestSource(cfg *RedisConfig, filter filter.RequestFilter, metrics *RequestSourceMetrics, rps int) (*RedisRequestSource, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("config must not be nil")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("server url must not be empty")
+	}
+	if cfg.Stream == "" {
+		return nil, fmt.Errorf("stream name must not be empty")
+	}
+	if cfg.Group == "" {
+		return nil, fmt.Errorf("consumer group name must not be empty")
+	}
+	if cfg.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("hostname: %w", err)
+		}
+		cfg.Consumer = hostname
+	}
+	if cfg.Start == "" {
+		cfg.Start = redisStartNew
+	}
+	opts, err := redis.ParseURL(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse server url: %w", err)
+	}
+	opts.ClientName = appName
+	opts.ContextTimeoutEnabled = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &RedisRequestSource{
+		cfg:     *cfg,
+		ch:      make(chan request.Request, rps*60*30), // buffer at least 30 minutes of requests
+		ctx:     ctx,
+		cancel:  cancel,
+		filter:  filter,
+		metrics: metrics,
+		client:  redis.NewClient(opts),
+	}
+
+	entryCounter, err := newCounterMetric(
+		"redis_entries_received_total",
+		"The number of entries received from the redis stream.",
+		[]string{"stream"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.entryCounter = entryCounter.WithLabelValues(cfg.Stream)
+
+	return s, nil
+}
+
+func (s *RedisRequestSource) Name() string {
+	return "redis"
+}
+
+func (s *RedisRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *RedisRequestSource) Start() error {
+	// fail early if the stream cannot be read
+	ctx, cancel := context.WithTimeout(s.ctx, 30*time.Second)
+	defer cancel()
+	if err := s.ensureGroup(ctx); err != nil {
+		s.client.Close()
+		return err
+	}
+	s.metrics.connected.Set(1)
+	log.Printf("reading from redis stream %s with consumer group %s", s.cfg.Stream, s.cfg.Group)
+	go s.run()
+	return nil
+}
+
+// ensureGroup creates the consumer group, and the stream, if they do not exist.
+func (s *RedisRequestSource) ensureGroup(ctx context.Context) error {
+	err := s.client.XGroupCreateMkStream(ctx, s.cfg.Stream, s.cfg.Group, s.cfg.Start).Err()
+	if err != nil {
+		if redisErrorCode(err) == "BUSYGROUP" {
+			// the group already exists and keeps its position
+			return nil
+		}
+		return fmt.Errorf("create consumer group: %w", err)
+	}
+	log.Printf("created redis consumer group %s starting at %s", s.cfg.Group, s.cfg.Start)
+	return nil
+}
+
+func (s *RedisRequestSource) run() {
+	defer s.client.Close()
+	defer s.metrics.connected.Set(0)
+
+	// entries delivered to this consumer but not acknowledged before a restart are read first
+	next := "0"
+	for {
+		ctx, cancel := context.WithTimeout(s.ctx, redisBlockTime+10*time.Second)
+		streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.cfg.Group,
+			Consumer: s.cfg.Consumer,
+			Streams:  []string{s.cfg.Stream, next},
+			Count:    redisReadCount,
+			Block:    redisBlockTime,
+		}).Result()
+		cancel()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err == nil || errors.Is(err, redis.Nil) {
+			// a nil reply means the read timed out without any entries
+			var entries []redis.XMessage
+			for _, st := range streams {
+				entries = append(entries, st.Messages...)
+			}
+			s.metrics.connected.Set(1)
+			if !s.processEntries(entries) {
+				return
+			}
+			if next != ">" && len(entries) == 0 {
+				next = ">"
+			}
+			continue
+		}
+
+		s.metrics.errors.Add(1)
+		log.Printf("failed to read redis stream %s: %v", s.cfg.Stream, err)
+		if redisErrorCode(err) == "NOGROUP" {
+			// the stream or group was deleted, recreate it
+			if err := s.ensureGroup(s.ctx); err != nil {
+				log.Printf("failed to recreate redis consumer group: %v", err)
+			} else {
+				continue
+			}
+		} else {
+			// the connection may have been lost, so read any unacknowledged entries again
+			// once the client has reconnected
+			s.metrics.connected.Set(0)
+			next = "0"
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(redisRetryInterval):
+		}
+	}
+}
+
+// redisErrorCode returns the first word of an error reply from the server, which it uses to
+// classify the error, or an empty string for any other error.
+func redisErrorCode(err error) string {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return ""
+	}
+	code, _, _ := strings.Cut(rerr.Error(), " ")
+	return code
+}
+
+// processEntries sends the requests contained in the entries to the loader, then acknowledges
+// them. It returns false if the source has been stopped.
+func (s *RedisRequestSource) processEntries(entries []redis.XMessage) bool {
+	if len(entries) == 0 {
+		return true
+	}
+	s.entryCounter.Add(float64(len(entries)))
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !s.processEntry(e) {
+			return false
+		}
+		ids = append(ids, e.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, 10*time.Second)
+	defer cancel()
+	if err := s.client.XAck(ctx, s.cfg.Stream, s.cfg.Group, ids...).Err(); err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to acknowledge redis entries: %v", err)
+	}
+	return true
+}
+
+func (s *RedisRequestSource) processEntry(e redis.XMessage) bool {
+	payload, ok := e.Values[redisPayloadField].(string)
+	if !ok {
+		// deleted from the stream before it was read
+		return true
+	}
+	attrs := make(map[string]string, len(e.Values))
+	for k, v := range e.Values {
+		if v, ok := v.(string); ok && k != redisPayloadField {
+			attrs[k] = v
+		}
+	}
+	payload, err := decodeMessagePayload(payload, attrs)
+	if err != nil {
+		s.metrics.errors.Add(1)
+		log.Printf("failed to decode message: %v", err)
+		return true
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(payload))
+	for scanner.Scan() {
+		s.metrics.requestsIncoming.Add(1)
+		var req request.Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to unmarshal request: %v", err)
+			continue
+		}
+
+		if s.filter != nil && !s.filter(&req) {
+			s.metrics.requestsFiltered.Add(1)
+			continue
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return false
+		case s.ch <- req:
+		default:
+			s.metrics.requestsDropped.Add(1)
+		}
+	}
+	return true
+}
+
+func (s *RedisRequestSource) Stop() {
+	s.cancel()
+}
+
+// Err always returns nil since failures to read the stream are retried until the source is stopped.
+func (s *RedisRequestSource) Err() error {
+	return nil
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -352,10 +356,23 @@ func permutePaths(paths []string) []*request.Request {
 		{},
 		{"Accept": "application/vnd.ipld.car"},
 		{"Accept": "application/vnd.ipld.raw"},
+		{"Range": "bytes=0-1023"},
+		{"Range": "bytes=1024-65535"},
+	}
+	queryVariants := []string{
+		"?format=car",
+		"?format=raw",
 	}
 
-	reqs := make([]*request.Request, 0, len(paths)*len(headerVariants))
+	reqs := make([]*request.Request, 0, len(paths)*(len(headerVariants)+len(queryVariants)))
 	for _, p := range paths {
+		for _, q := range queryVariants {
+			reqs = append(reqs, &request.Request{
+				Method: "GET",
+				URI:    p + q,
+				Header: map[string]string{},
+			})
+		}
 		for _, h := range headerVariants {
 			req := &request.Request{
 				Method: "GET",
@@ -477,8 +494,19 @@ func (l *LokiRequestSource) Err() error {
 type SQSConfig struct {
 	AWSConfig *aws.Config
 	Queue     string
+	Receivers int // number of concurrent receivers polling the queue
 }
 
+const (
+	// sqsWaitTime is the long polling wait time, the maximum permitted by SQS
+	sqsWaitTime = 20
+
+	// sqsRetryDelay is the delay before receiving again after a failed receive, doubled for
+	// each consecutive failure up to sqsMaxRetryDelay
+	sqsRetryDelay    = 100 * time.Millisecond
+	sqsMaxRetryDelay = 30 * time.Second
+)
+
 type SQSRequestSource struct {
 	cfg     SQSConfig
 	ch      chan request.Request
@@ -486,6 +514,10 @@ type SQSRequestSource struct {
 	filter  filter.RequestFilter
 	metrics *RequestSourceMetrics
 
+	receiveHist    prometheus.Observer
+	emptyCounter   prometheus.Counter
+	messageCounter prometheus.Counter
+
 	mu       sync.Mutex
 	svc      *sqs.SQS
 	queueURL string
@@ -503,6 +535,39 @@ func NewSQSRequestSource(cfg *SQSConfig, filter filter.RequestFilter, metrics *R
 		filter:  filter,
 		metrics: metrics,
 	}
+	if s.cfg.Receivers < 1 {
+		s.cfg.Receivers = 1
+	}
+
+	receiveHist, err := newHistogramMetric(
+		"sqs_receive_seconds",
+		"The time taken for each call to receive messages from the sqs queue, including time spent long polling.",
+		[]string{"queue"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+	s.receiveHist = receiveHist.WithLabelValues(cfg.Queue)
+
+	emptyCounter, err := newCounterMetric(
+		"sqs_empty_receives_total",
+		"The number of calls to receive messages from the sqs queue that returned no messages.",
+		[]string{"queue"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.emptyCounter = emptyCounter.WithLabelValues(cfg.Queue)
+
+	messageCounter, err := newCounterMetric(
+		"sqs_messages_received_total",
+		"The number of messages received from the sqs queue.",
+		[]string{"queue"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.messageCounter = messageCounter.WithLabelValues(cfg.Queue)
 
 	return s, nil
 }
@@ -532,88 +597,131 @@ func (s *SQSRequestSource) Start() error {
 		return fmt.Errorf("get queue url: %w", err)
 	}
 	s.queueURL = *urlResult.QueueUrl
-	log.Printf("found queue url %s", s.queueURL)
+	log.Printf("found queue url %s, starting %d receivers", s.queueURL, s.cfg.Receivers)
 	s.metrics.connected.Set(1)
-	defer s.metrics.connected.Set(0)
+
+	var wg sync.WaitGroup
+	wg.Add(s.cfg.Receivers)
+	for i := 0; i < s.cfg.Receivers; i++ {
+		go func() {
+			defer wg.Done()
+			s.receive(s.svc, s.queueURL)
+		}()
+	}
 	go func() {
-		for {
+		wg.Wait()
+		s.metrics.connected.Set(0)
+	}()
+
+	return nil
+}
+
+// receive repeatedly long polls the queue for batches of messages until the source is stopped.
+func (s *SQSRequestSource) receive(svc *sqs.SQS, queueURL string) {
+	retryDelay := sqsRetryDelay
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		start := time.Now()
+		msgResult, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			AttributeNames: []*string{
+				aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			},
+			MessageAttributeNames: []*string{
+				aws.String(sqs.QueueAttributeNameAll),
+			},
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			VisibilityTimeout:   aws.Int64(5),
+			WaitTimeSeconds:     aws.Int64(sqsWaitTime),
+		})
+		s.receiveHist.Observe(time.Since(start).Seconds())
+		if err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to receive message, retrying in %s: %v", retryDelay, err)
 			select {
 			case <-s.done:
 				return
-			default:
+			case <-time.After(retryDelay):
 			}
+			retryDelay *= 2
+			if retryDelay > sqsMaxRetryDelay {
+				retryDelay = sqsMaxRetryDelay
+			}
+			continue
+		}
+		retryDelay = sqsRetryDelay
 
-			msgResult, err := s.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
-				AttributeNames: []*string{
-					aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
-				},
-				MessageAttributeNames: []*string{
-					aws.String(sqs.QueueAttributeNameAll),
-				},
-				QueueUrl:            aws.String(s.queueURL),
-				MaxNumberOfMessages: aws.Int64(10),
-				VisibilityTimeout:   aws.Int64(5),
-				WaitTimeSeconds:     aws.Int64(10),
+		if len(msgResult.Messages) == 0 {
+			s.emptyCounter.Add(1)
+			continue
+		}
+		s.messageCounter.Add(float64(len(msgResult.Messages)))
+
+		// delete the batch before processing, requests are only ever sent once
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(msgResult.Messages))
+		for i, msg := range msgResult.Messages {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: msg.ReceiptHandle,
 			})
+		}
+		delResult, err := svc.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			s.metrics.errors.Add(1)
+			log.Printf("failed to delete messages: %v", err)
+		} else if len(delResult.Failed) > 0 {
+			s.metrics.errors.Add(float64(len(delResult.Failed)))
+			log.Printf("failed to delete %d messages", len(delResult.Failed))
+		}
+
+		for _, msg := range msgResult.Messages {
+			if msg.Body == nil {
+				s.metrics.errors.Add(1)
+				log.Printf("message body was nil: %s", *msg.MessageId)
+				continue
+			}
+
+			payload, err := sqsMessagePayload(msg)
 			if err != nil {
 				s.metrics.errors.Add(1)
-				log.Printf("failed to receive message: %v", err)
+				log.Printf("failed to decode message: %v", err)
 				continue
 			}
 
-			for _, msg := range msgResult.Messages {
-				if msg.Body == nil {
+			scanner := bufio.NewScanner(strings.NewReader(payload))
+			for scanner.Scan() {
+				s.metrics.requestsIncoming.Add(1)
+				data := scanner.Bytes()
+				var req request.Request
+				if err := json.Unmarshal(data, &req); err != nil {
 					s.metrics.errors.Add(1)
-					log.Printf("message body was nil: %s", *msg.MessageId)
+					log.Printf("failed to unmarshal request: %v", err)
 					continue
 				}
-				_, err = s.svc.DeleteMessage(&sqs.DeleteMessageInput{
-					QueueUrl:      aws.String(s.queueURL),
-					ReceiptHandle: msg.ReceiptHandle,
-				})
-				if err != nil {
-					s.metrics.errors.Add(1)
-					log.Printf("failed to delete message: %v", err)
-				}
 
-				var smsg SNSMessage
-				if err := json.Unmarshal([]byte(*msg.Body), &smsg); err != nil {
-					s.metrics.errors.Add(1)
-					log.Printf("failed to unmarshal message: %v", err)
+				if s.filter != nil && !s.filter(&req) {
+					s.metrics.requestsFiltered.Add(1)
 					continue
 				}
 
-				scanner := bufio.NewScanner(strings.NewReader(smsg.Message))
-				for scanner.Scan() {
-					s.metrics.requestsIncoming.Add(1)
-					data := scanner.Bytes()
-					var req request.Request
-					if err := json.Unmarshal(data, &req); err != nil {
-						s.metrics.errors.Add(1)
-						log.Printf("failed to unmarshal request: %v", err)
-						continue
-					}
-
-					if s.filter != nil && !s.filter(&req) {
-						s.metrics.requestsFiltered.Add(1)
-						continue
-					}
-
-					select {
-					case <-s.done:
-						return
-					case s.ch <- req:
-					default:
-						s.metrics.requestsDropped.Add(1)
-					}
+				select {
+				case <-s.done:
+					return
+				case s.ch <- req:
+				default:
+					s.metrics.requestsDropped.Add(1)
 				}
-
 			}
-
 		}
-	}()
-
-	return nil
+	}
 }
 
 func (s *SQSRequestSource) Stop() {
@@ -636,8 +744,86 @@ func (s *SQSRequestSource) Err() error {
 }
 
 type SNSMessage struct {
-	Type      string `json:"Type"`
-	MessageId string `json:"MessageId"`
-	TopicArn  string `json:"TopicArn"`
-	Message   string `json:"Message"`
+	Type              string                         `json:"Type"`
+	MessageId         string                         `json:"MessageId"`
+	TopicArn          string                         `json:"TopicArn"`
+	Message           string                         `json:"Message"`
+	MessageAttributes map[string]SNSMessageAttribute `json:"MessageAttributes"`
+}
+
+type SNSMessageAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// contentEncodingAttribute is the message attribute set by skyfish when it compresses a message
+const contentEncodingAttribute = "content-encoding"
+
+// schemaVersionAttribute is the message attribute set by skyfish to identify the format of
+// the message payload. Messages without the attribute are from older publishers and contain
+// one or more newline separated requests, which is compatible with version 1.
+const schemaVersionAttribute = "schema-version"
+
+// maxSchemaVersion is the newest message schema version that dealgood can read
+const maxSchemaVersion = 1
+
+// sqsMessagePayload returns the newline separated requests contained in a message received
+// from sqs. Messages may be delivered either wrapped in an sns notification or, when raw
+// message delivery is enabled on the subscription, as the original message with its attributes
+// converted to sqs message attributes. Compressed messages are decompressed.
+func sqsMessagePayload(msg *sqs.Message) (string, error) {
+	payload := *msg.Body
+	attrs := make(map[string]string)
+	for name, attr := range msg.MessageAttributes {
+		if attr.StringValue != nil {
+			attrs[name] = *attr.StringValue
+		}
+	}
+
+	var smsg SNSMessage
+	if err := json.Unmarshal([]byte(payload), &smsg); err == nil && smsg.Type == "Notification" {
+		payload = smsg.Message
+		for name, attr := range smsg.MessageAttributes {
+			attrs[name] = attr.Value
+		}
+	}
+
+	return decodeMessagePayload(payload, attrs)
+}
+
+// decodeMessagePayload checks the schema version of a message published by skyfish and
+// decompresses its payload if necessary, returning the newline separated requests.
+func decodeMessagePayload(payload string, attrs map[string]string) (string, error) {
+	if v, ok := attrs[schemaVersionAttribute]; ok {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid schema version: %q", v)
+		}
+		if version < 1 || version > maxSchemaVersion {
+			return "", fmt.Errorf("unsupported schema version: %d", version)
+		}
+	}
+
+	encoding := attrs[contentEncodingAttribute]
+	switch encoding {
+	case "":
+		return payload, nil
+	case "gzip":
+		compressed, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return "", fmt.Errorf("base64 decode: %w", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return "", fmt.Errorf("gzip: %w", err)
+		}
+		defer zr.Close()
+		var buf strings.Builder
+		if _, err := io.Copy(&buf, zr); err != nil {
+			return "", fmt.Errorf("gzip: %w", err)
+		}
+		return buf.String(), nil
+	default:
+		return "", fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
 }
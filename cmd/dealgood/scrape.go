@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A ScrapeNotifier records when Prometheus scrapes dealgood's metrics. The start barrier and
+// the shutdown wait for a scrape that includes the metrics recorded so far, and the metrics
+// pusher pushes once scrapes stop arriving.
+type ScrapeNotifier struct {
+	now func() time.Time // source of the current time, replaced in tests
+
+	mu      sync.Mutex      // guards following fields
+	last    time.Time       // when the last scrape finished, or the notifier was created
+	waiters []chan struct{} // closed once a scrape that started after they were added finishes
+}
+
+func NewScrapeNotifier() *ScrapeNotifier {
+	n := &ScrapeNotifier{now: time.Now}
+	n.last = n.now()
+	return n
+}
+
+// Handler wraps the metrics handler to record when metrics are scraped.
+func (n *ScrapeNotifier) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only waiters added before the scrape started are sure to see its metrics
+		n.mu.Lock()
+		waiters := n.waiters
+		n.waiters = nil
+		n.mu.Unlock()
+
+		h.ServeHTTP(w, r)
+
+		n.mu.Lock()
+		n.last = n.now()
+		n.mu.Unlock()
+		for _, ch := range waiters {
+			close(ch)
+		}
+	})
+}
+
+// Next returns a channel that is closed when a scrape that starts after the call has finished,
+// so that it holds every metric recorded before the call.
+func (n *ScrapeNotifier) Next() <-chan struct{} {
+	ch := make(chan struct{})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.waiters = append(n.waiters, ch)
+	return ch
+}
+
+// Since returns the time since the last scrape finished, or since the notifier was created if
+// there has been no scrape.
+func (n *ScrapeNotifier) Since() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.now().Sub(n.last)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestScrapeNotifierNext(t *testing.T) {
+	n := NewScrapeNotifier()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocking := n.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	h := n.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	scrape := func(h http.Handler) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	}
+
+	before := n.Next()
+	done := make(chan struct{})
+	go func() {
+		scrape(blocking)
+		close(done)
+	}()
+	<-started
+
+	// a scrape already in progress may have gathered the metrics before the call
+	during := n.Next()
+	close(release)
+	<-done
+	if !closed(before) {
+		t.Errorf("got channel open after a scrape that started after it, wanted closed")
+	}
+	if closed(during) {
+		t.Errorf("got channel closed by a scrape already in progress, wanted open")
+	}
+
+	scrape(h)
+	if !closed(during) {
+		t.Errorf("got channel open after a scrape that started after it, wanted closed")
+	}
+
+	// each channel is closed by a single scrape and later ones are unaffected
+	after := n.Next()
+	if closed(after) {
+		t.Errorf("got channel closed before any scrape, wanted open")
+	}
+	scrape(h)
+	if !closed(after) {
+		t.Errorf("got channel open after a scrape, wanted closed")
+	}
+}
+
+func TestScrapeNotifierSince(t *testing.T) {
+	clock := newTestClock()
+	n := NewScrapeNotifier()
+	n.now = clock.Now
+	n.last = clock.Now()
+	h := n.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	clock.Advance(10 * time.Second)
+	if got := n.Since(); got != 10*time.Second {
+		t.Errorf("got %s since creation, wanted %s", got, 10*time.Second)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	clock.Advance(3 * time.Second)
+	if got := n.Since(); got != 3*time.Second {
+		t.Errorf("got %s since the last scrape, wanted %s", got, 3*time.Second)
+	}
+}
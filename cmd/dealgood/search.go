@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SearchConfig configures a search for the highest request rate each target can sustain.
+type SearchConfig struct {
+	StartRate     float64       // rate of the first step
+	MaxRate       float64       // highest rate tried, the experiment's rate since no target can be sent more
+	Step          time.Duration // time spent at each rate
+	MaxP99        time.Duration // highest 99th percentile time to first byte within the SLO
+	MaxErrorRatio float64       // highest share of failed requests within the SLO
+	Precision     float64       // the search ends when the failing rate is within this fraction of the sustained rate
+}
+
+// searchWarmup is the share of each step whose responses are ignored, so requests queued at the
+// previous rate do not count against the new one.
+const searchWarmup = 0.2
+
+// searchMinAnswered is the share of the requests sent in a step that must be answered within it.
+// A target answering fewer is falling behind even if the responses it sends are fast.
+const searchMinAnswered = 0.9
+
+// A CapacitySearch finds the highest request rate each target can sustain within an SLO. Each
+// target is sent requests at its own rate, which doubles every step until the SLO is broken and
+// is then narrowed by bisection between the highest rate that met it and the lowest that did
+// not. Once the search for a target ends it is held at the highest rate that met the SLO.
+type CapacitySearch struct {
+	experiment string
+	cfg        SearchConfig
+	targets    []*TargetSearch
+	quiet      bool
+
+	rateGauge     *prometheus.GaugeVec
+	capacityGauge *prometheus.GaugeVec
+}
+
+// A TargetSearch limits the requests sent to one target to the rate being tried and measures
+// the target's responses at that rate.
+type TargetSearch struct {
+	name string
+
+	mu       sync.Mutex // guards the fields below
+	bucket   *TokenBucket
+	rate     float64   // rate being tried
+	lo, hi   float64   // highest rate that met the SLO and lowest that did not, zero if none yet
+	measure  time.Time // when responses start to count towards the step
+	sent     int       // requests allowed since measure
+	answered int       // responses received since measure
+	failed   int       // failed responses received since measure
+	ttfb     *TimeMetric
+	done     bool
+	reason   string // why the search ended
+}
+
+func NewCapacitySearch(experiment string, cfg SearchConfig, targets []*Target, quiet bool) (*CapacitySearch, error) {
+	if cfg.StartRate <= 0 {
+		return nil, fmt.Errorf("search start rate must be greater than zero")
+	}
+	if cfg.StartRate > cfg.MaxRate {
+		cfg.StartRate = cfg.MaxRate
+	}
+	s := &CapacitySearch{
+		experiment: experiment,
+		cfg:        cfg,
+		quiet:      quiet,
+	}
+
+	var err error
+	s.rateGauge, err = newGaugeMetric(
+		"search_rate_requests_per_second",
+		"The request rate currently being sent to a target by the capacity search.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	s.capacityGauge, err = newGaugeMetric(
+		"search_capacity_requests_per_second",
+		"The highest request rate a target has sustained within the SLO during the capacity search.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	for _, target := range targets {
+		ts := &TargetSearch{name: target.Name}
+		ts.start(cfg.StartRate, cfg.Step)
+		target.Search = ts
+		s.targets = append(s.targets, ts)
+		s.rateGauge.WithLabelValues(experiment, target.Name).Set(cfg.StartRate)
+	}
+	return s, nil
+}
+
+// Run evaluates each target at the end of every step until all searches have ended or the
+// context is canceled. It should be started with the measured window, which restarts the
+// first step.
+func (s *CapacitySearch) Run(ctx context.Context) {
+	for _, ts := range s.targets {
+		ts.mu.Lock()
+		ts.start(ts.rate, s.cfg.Step)
+		ts.mu.Unlock()
+	}
+
+	ticker := time.NewTicker(s.cfg.Step)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		running := 0
+		for _, ts := range s.targets {
+			rate, lo, ok := ts.evaluate(s.cfg)
+			if lo > 0 {
+				s.capacityGauge.WithLabelValues(s.experiment, ts.name).Set(lo)
+			}
+			s.rateGauge.WithLabelValues(s.experiment, ts.name).Set(rate)
+			if !ok {
+				running++
+			}
+			if !s.quiet {
+				fmt.Printf("capacity search: %s: %s\n", ts.name, ts.status())
+			}
+		}
+		if running == 0 {
+			return
+		}
+	}
+}
+
+// Report writes the capacity found for each target.
+func (s *CapacitySearch) Report(w io.Writer) {
+	fmt.Fprintf(w, "Capacity within p99 ttfb %s and %.2f%% errors:\n", s.cfg.MaxP99, s.cfg.MaxErrorRatio*100)
+	for _, ts := range s.targets {
+		fmt.Fprintf(w, "  %s: %s\n", ts.name, ts.status())
+	}
+}
+
+// start begins a step at the given rate, counting responses once its warmup has passed.
+func (ts *TargetSearch) start(rate float64, step time.Duration) {
+	ts.rate = rate
+	ts.bucket = NewTokenBucket(rate, int(math.Ceil(rate/100)))
+	ts.measure = time.Now().Add(time.Duration(float64(step) * searchWarmup))
+	ts.sent, ts.answered, ts.failed = 0, 0, 0
+	ts.ttfb = NewTimeMetric()
+}
+
+// Allow reports whether a request may be sent to the target at the rate being tried.
+func (ts *TargetSearch) Allow() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.bucket.Take() {
+		return false
+	}
+	if ts.measuring() {
+		ts.sent++
+	}
+	return true
+}
+
+// Observe records the outcome of a request sent to the target.
+func (ts *TargetSearch) Observe(res *RequestTiming) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.measuring() {
+		return
+	}
+	ts.answered++
+	if res.ConnectError || res.TimeoutError || res.Dropped || res.StatusCode >= 500 || res.StatusCode == 429 {
+		ts.failed++
+		return
+	}
+	ts.ttfb.Add(res.TTFB.Seconds())
+}
+
+func (ts *TargetSearch) measuring() bool {
+	return !time.Now().Before(ts.measure)
+}
+
+// evaluate judges the step that has just ended against the SLO and starts the next one,
+// returning the rate now being sent, the highest rate that met the SLO and whether the
+// search has ended.
+func (ts *TargetSearch) evaluate(cfg SearchConfig) (float64, float64, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.done {
+		return ts.rate, ts.lo, true
+	}
+	if ts.sent == 0 {
+		// nothing was sent, most likely because the measured window has not started, so the
+		// step says nothing about the target and is repeated
+		ts.start(ts.rate, cfg.Step)
+		return ts.rate, ts.lo, false
+	}
+	elapsed := time.Since(ts.measure).Seconds()
+
+	met := ts.answered > 0 &&
+		float64(ts.answered) >= searchMinAnswered*float64(ts.sent) &&
+		float64(ts.failed) <= cfg.MaxErrorRatio*float64(ts.answered) &&
+		(ts.ttfb.Count == 0 || ts.ttfb.Digest.Quantile(0.99) <= cfg.MaxP99.Seconds())
+
+	if met {
+		// fewer requests than the rate allows means the request source could not keep up, so
+		// higher rates cannot be tried
+		if float64(ts.sent) < 0.8*ts.rate*elapsed {
+			ts.lo = ts.rate
+			return ts.finish("limited by the request source", cfg.Step), ts.lo, true
+		}
+		ts.lo = ts.rate
+	} else {
+		ts.hi = ts.rate
+	}
+
+	var next float64
+	switch {
+	case ts.hi == 0 && ts.lo >= cfg.MaxRate:
+		return ts.finish("limited by the experiment rate", cfg.Step), ts.lo, true
+	case ts.hi == 0:
+		next = math.Min(ts.lo*2, cfg.MaxRate)
+	case ts.lo == 0:
+		if ts.hi <= 1 {
+			return ts.finish("no rate met the SLO", cfg.Step), ts.lo, true
+		}
+		next = ts.hi / 2
+	case ts.hi-ts.lo <= cfg.Precision*ts.lo:
+		return ts.finish("", cfg.Step), ts.lo, true
+	default:
+		next = (ts.lo + ts.hi) / 2
+	}
+
+	ts.start(next, cfg.Step)
+	return next, ts.lo, false
+}
+
+// finish ends the search, holding the target at the highest rate that met the SLO.
+func (ts *TargetSearch) finish(reason string, step time.Duration) float64 {
+	ts.done = true
+	ts.reason = reason
+	rate := ts.lo
+	if rate == 0 {
+		rate = 1
+	}
+	ts.start(rate, step)
+	return rate
+}
+
+func (ts *TargetSearch) status() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	switch {
+	case ts.done && ts.lo == 0:
+		return ts.reason
+	case ts.done && ts.reason != "":
+		return fmt.Sprintf("at least %.1f rps, %s", ts.lo, ts.reason)
+	case ts.done:
+		return fmt.Sprintf("%.1f rps, failed at %.1f rps", ts.lo, ts.hi)
+	default:
+		return fmt.Sprintf("trying %.1f rps, sustained %.1f rps", ts.rate, ts.lo)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+var contentSeederCommand = &cli.Command{
+	Name:  "content-seeder",
+	Usage: "Add freshly generated content to an IPFS node and hand out each CID once, run alongside the node",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "ipfs-api",
+			Usage:   "URL of the RPC API of the IPFS node content is added to.",
+			Value:   "http://127.0.0.1:5001",
+			EnvVars: []string{"DEALGOOD_SEEDER_IPFS_API"},
+		},
+		&cli.StringFlag{
+			Name:    "listen-addr",
+			Usage:   "Address to serve the CIDs of seeded content on.",
+			Value:   ":8090",
+			EnvVars: []string{"DEALGOOD_SEEDER_LISTEN_ADDR"},
+		},
+		&cli.IntFlag{
+			Name:    "content-size",
+			Usage:   "Size in bytes of each item of content.",
+			Value:   256 * 1024,
+			EnvVars: []string{"DEALGOOD_SEEDER_CONTENT_SIZE"},
+		},
+		&cli.IntFlag{
+			Name:    "workers",
+			Usage:   "Number of items of content added and announced concurrently.",
+			Value:   16,
+			EnvVars: []string{"DEALGOOD_SEEDER_WORKERS"},
+		},
+		&cli.IntFlag{
+			Name:    "buffer",
+			Usage:   "Number of seeded CIDs held ready to be handed out. Seeding pauses while the buffer is full so content is as fresh as possible.",
+			Value:   10000,
+			EnvVars: []string{"DEALGOOD_SEEDER_BUFFER"},
+		},
+		&cli.IntFlag{
+			Name:    "count",
+			Usage:   "Number of items of content to seed as a fixed corpus served at /corpus. Zero seeds content continuously, handing out each CID once at /cids.",
+			EnvVars: []string{"DEALGOOD_SEEDER_COUNT"},
+		},
+		&cli.BoolFlag{
+			Name:    "provide",
+			Usage:   "Announce each CID to the DHT before handing it out, so that it can be found by nodes that are not connected to the seeder.",
+			Value:   true,
+			EnvVars: []string{"DEALGOOD_SEEDER_PROVIDE"},
+		},
+	},
+	Action: func(cc *cli.Context) error {
+		s := NewContentSeeder(cc.String("ipfs-api"), cc.Int("content-size"), cc.Int("buffer"), cc.Int("count"), cc.Bool("provide"))
+		return s.Serve(cc.Context, cc.String("listen-addr"), cc.Int("workers"))
+	},
+}
+
+// A ContentSeeder adds randomly generated content to an IPFS node, optionally announces it to
+// the DHT, and hands out the CID of each item once. Content is never requested twice, so a
+// target retrieving it cannot have it cached or stored locally and must find and fetch it from
+// the network. Given a count, it instead seeds a fixed corpus of content that may be requested
+// any number of times, making the node a controlled source of content for targets.
+type ContentSeeder struct {
+	api     string
+	size    int
+	count   int
+	provide bool
+	client  *http.Client
+	fresh   chan string // seeded CIDs not yet handed out
+
+	mu        sync.Mutex // guards corpus
+	corpus    []string
+	remaining atomic.Int64 // items of the corpus not yet claimed by a worker
+
+	added    atomic.Int64
+	provided atomic.Int64
+	failed   atomic.Int64
+	served   atomic.Int64
+}
+
+func NewContentSeeder(api string, size int, buffer int, count int, provide bool) *ContentSeeder {
+	s := &ContentSeeder{
+		api:     api,
+		size:    size,
+		count:   count,
+		provide: provide,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		fresh:   make(chan string, buffer),
+	}
+	s.remaining.Store(int64(count))
+	return s
+}
+
+// Serve seeds content with the given number of workers and serves the CIDs of seeded content
+// on addr until the context is canceled. GET /cids?count=n returns up to n CIDs as a JSON
+// array, removing them from the buffer. When seeding a corpus, GET /corpus returns every CID
+// of the corpus once all have been seeded. GET /peering returns the node's identity in the
+// form of an entry of kubo's Peering.Peers configuration.
+func (s *ContentSeeder) Serve(ctx context.Context, addr string, workers int) error {
+	for i := 0; i < workers; i++ {
+		if s.count > 0 {
+			go s.corpusLoop(ctx)
+		} else {
+			go s.seedLoop(ctx)
+		}
+	}
+	go s.logStats(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cids", s.handleCIDs)
+	mux.HandleFunc("/corpus", s.handleCorpus)
+	mux.HandleFunc("/peering", s.handlePeering)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("serving seeded CIDs on %s, adding content to %s", addr, s.api)
+	if err := srv.ListenAndServe(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("serve: %w", err)
+	}
+	return nil
+}
+
+func (s *ContentSeeder) handleCIDs(w http.ResponseWriter, r *http.Request) {
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 1 {
+		count = 1
+	}
+	if count > cap(s.fresh) {
+		// no more than are buffered can be returned
+		count = cap(s.fresh)
+	}
+	cids := make([]string, 0, count)
+loop:
+	for len(cids) < count {
+		select {
+		case c := <-s.fresh:
+			cids = append(cids, c)
+		default:
+			break loop
+		}
+	}
+	s.served.Add(int64(len(cids)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cids)
+}
+
+func (s *ContentSeeder) handleCorpus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		http.Error(w, "not seeding a corpus", http.StatusNotFound)
+		return
+	}
+	if len(s.corpus) < s.count {
+		http.Error(w, fmt.Sprintf("seeded %d of %d", len(s.corpus), s.count), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.corpus)
+}
+
+// peeringPeer is an entry of kubo's Peering.Peers configuration.
+type peeringPeer struct {
+	ID    string
+	Addrs []string
+}
+
+func (s *ContentSeeder) handlePeering(w http.ResponseWriter, r *http.Request) {
+	var id struct {
+		ID        string
+		Addresses []string
+	}
+	if err := s.call(r.Context(), "id", url.Values{}, "", nil, &id); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	p := peeringPeer{ID: id.ID, Addrs: []string{}}
+	for _, a := range id.Addresses {
+		// peering addresses must not include the peer id
+		a, _, _ = strings.Cut(a, "/p2p/")
+		if strings.HasPrefix(a, "/ip4/127.") || strings.HasPrefix(a, "/ip6/::1/") {
+			continue
+		}
+		p.Addrs = append(p.Addrs, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// corpusLoop seeds items of the corpus until every item has been claimed by a worker.
+func (s *ContentSeeder) corpusLoop(ctx context.Context) {
+	for ctx.Err() == nil && s.remaining.Add(-1) >= 0 {
+		for ctx.Err() == nil {
+			c, err := s.seed(ctx)
+			if err != nil {
+				s.failed.Add(1)
+				log.Printf("seed content: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+			s.mu.Lock()
+			s.corpus = append(s.corpus, c)
+			if len(s.corpus) == s.count {
+				log.Printf("seeded corpus of %d items", s.count)
+			}
+			s.mu.Unlock()
+			break
+		}
+	}
+}
+
+func (s *ContentSeeder) seedLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		c, err := s.seed(ctx)
+		if err != nil {
+			s.failed.Add(1)
+			log.Printf("seed content: %v", err)
+			// the node may still be starting
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case s.fresh <- c:
+		}
+	}
+}
+
+// seed adds an item of random content to the node and returns its CID once it has been
+// announced.
+func (s *ContentSeeder) seed(ctx context.Context) (string, error) {
+	data := make([]byte, s.size)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("generate content: %w", err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "content")
+	if err != nil {
+		return "", fmt.Errorf("create form file: %w", err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	var added struct {
+		Hash string
+	}
+	params := url.Values{"cid-version": {"1"}, "raw-leaves": {"true"}, "pin": {"true"}, "quieter": {"true"}}
+	if err := s.call(ctx, "add", params, mw.FormDataContentType(), &body, &added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("add: no cid returned")
+	}
+	s.added.Add(1)
+
+	if s.provide {
+		if err := s.call(ctx, "routing/provide", url.Values{"arg": {added.Hash}}, "", nil, nil); err != nil {
+			return "", err
+		}
+		s.provided.Add(1)
+	}
+	return added.Hash, nil
+}
+
+// call invokes a command of the node's RPC API, decoding the first JSON value of the response
+// into out if it is not nil and reading the rest so that streamed commands run to completion.
+func (s *ContentSeeder) call(ctx context.Context, cmd string, params url.Values, contentType string, body io.Reader, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.api+"/api/v0/"+cmd+"?"+params.Encode(), body)
+	if err != nil {
+		return fmt.Errorf("%s: new request: %w", cmd, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cmd, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: unexpected status %s: %s", cmd, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("%s: decode response: %w", cmd, err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("%s: read response: %w", cmd, err)
+	}
+	return nil
+}
+
+func (s *ContentSeeder) logStats(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Printf("seeded %d, provided %d, failed %d, served %d, ready %d", s.added.Load(), s.provided.Load(), s.failed.Load(), s.served.Load(), len(s.fresh))
+			if s.count > 0 && s.added.Load() >= int64(s.count) {
+				// the corpus is complete, nothing more will be seeded
+				return
+			}
+		}
+	}
+}
+
+// SeederRequestSource requests the content of a content seeder, each CID once, so that every
+// request is for content the targets have not seen before.
+type SeederRequestSource struct {
+	url     string
+	rps     int
+	client  *http.Client
+	ch      chan request.Request
+	done    chan struct{}
+	filter  filter.RequestFilter
+	metrics *RequestSourceMetrics
+}
+
+func NewSeederRequestSource(seederURL string, filter filter.RequestFilter, metrics *RequestSourceMetrics, rps int) (*SeederRequestSource, error) {
+	if seederURL == "" {
+		return nil, fmt.Errorf("seeder url must be given as the source parameter")
+	}
+	if rps < 1 {
+		rps = 1
+	}
+	return &SeederRequestSource{
+		url:     seederURL,
+		rps:     rps,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		ch:      make(chan request.Request, rps*10),
+		done:    make(chan struct{}),
+		filter:  filter,
+		metrics: metrics,
+	}, nil
+}
+
+func (s *SeederRequestSource) Name() string {
+	return "seeder"
+}
+
+func (s *SeederRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *SeederRequestSource) Start() error {
+	go func() {
+		s.metrics.connected.Set(1)
+		defer s.metrics.connected.Set(0)
+		defer close(s.ch)
+
+		for {
+			cids, err := s.fetch()
+			if err != nil {
+				s.metrics.errors.Add(1)
+				log.Printf("seeder source: %v", err)
+			}
+			if len(cids) == 0 {
+				// the seeder is starting or has fallen behind
+				select {
+				case <-s.done:
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			for _, c := range cids {
+				s.metrics.requestsIncoming.Add(1)
+				req := request.Request{
+					Method:    http.MethodGet,
+					URI:       "/ipfs/" + c,
+					Header:    map[string]string{},
+					Timestamp: time.Now(),
+				}
+				if s.filter != nil && !s.filter(&req) {
+					s.metrics.requestsFiltered.Add(1)
+					continue
+				}
+				select {
+				case <-s.done:
+					return
+				case s.ch <- req:
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// fetch takes up to a second's worth of CIDs from the seeder.
+func (s *SeederRequestSource) fetch() ([]string, error) {
+	resp, err := s.client.Get(s.url + "/cids?count=" + strconv.Itoa(s.rps))
+	if err != nil {
+		return nil, fmt.Errorf("get cids: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get cids: unexpected status %s", resp.Status)
+	}
+	var cids []string
+	if err := json.NewDecoder(resp.Body).Decode(&cids); err != nil {
+		return nil, fmt.Errorf("decode cids: %w", err)
+	}
+	return cids, nil
+}
+
+func (s *SeederRequestSource) Stop() {
+	close(s.done)
+}
+
+func (s *SeederRequestSource) Err() error {
+	return nil
+}
+
+// corpusWait is the longest time to wait for the content providers to finish seeding their
+// corpora.
+const corpusWait = 30 * time.Minute
+
+// NewCorpusRequestSource returns a request source that requests content chosen at random from
+// the corpora of the content seeders at the given comma separated urls. It waits until every
+// seeder has finished seeding its corpus.
+func NewCorpusRequestSource(seederURLs string, filter filter.RequestFilter, metrics *RequestSourceMetrics) (*RandomRequestSource, error) {
+	if seederURLs == "" {
+		return nil, fmt.Errorf("content seeder urls must be given as the source parameter")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	deadline := time.Now().Add(corpusWait)
+
+	var reqs []*request.Request
+	for _, u := range strings.Split(seederURLs, ",") {
+		var cids []string
+		for {
+			var err error
+			cids, err = fetchCorpus(client, u)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("corpus of %s: %w", u, err)
+			}
+			log.Printf("waiting for corpus of %s: %v", u, err)
+			time.Sleep(5 * time.Second)
+		}
+		for _, c := range cids {
+			reqs = append(reqs, &request.Request{
+				Method: http.MethodGet,
+				URI:    "/ipfs/" + c,
+				Header: map[string]string{},
+			})
+		}
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("no content in corpora")
+	}
+
+	src := NewRandomRequestSource(filter, metrics, reqs)
+	src.name = "corpus"
+	return src, nil
+}
+
+func fetchCorpus(client *http.Client, seederURL string) ([]string, error) {
+	resp, err := client.Get(seederURL + "/corpus")
+	if err != nil {
+		return nil, fmt.Errorf("get corpus: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("get corpus: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var cids []string
+	if err := json.NewDecoder(resp.Body).Decode(&cids); err != nil {
+		return nil, fmt.Errorf("decode corpus: %w", err)
+	}
+	return cids, nil
+}
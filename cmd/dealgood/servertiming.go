@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServerTimingRecorder exports the components of Server-Timing headers returned by
+// targets as metrics, allowing latency to be broken down into the phases reported
+// by the gateway such as blockstore access, routing and transfer.
+type ServerTimingRecorder struct {
+	experiment string
+	maxNames   int // maximum number of distinct metric names to record, to bound label cardinality
+
+	hist *prometheus.HistogramVec
+
+	mu    sync.Mutex // guards names
+	names map[string]bool
+}
+
+func NewServerTimingRecorder(experiment string, maxNames int) (*ServerTimingRecorder, error) {
+	s := &ServerTimingRecorder{
+		experiment: experiment,
+		maxNames:   maxNames,
+		names:      make(map[string]bool),
+	}
+
+	var err error
+	s.hist, err = newHistogramMetric(
+		"server_timing_seconds",
+		"The duration of each component reported by targets in Server-Timing response headers.",
+		[]string{"experiment", "target", "metric"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram: %w", err)
+	}
+
+	return s, nil
+}
+
+// Record records any Server-Timing metrics that include a duration in the response headers.
+func (s *ServerTimingRecorder) Record(target string, h http.Header) {
+	for _, v := range h.Values("Server-Timing") {
+		for _, m := range parseServerTiming(v) {
+			if !s.allow(m.Name) {
+				continue
+			}
+			s.hist.WithLabelValues(s.experiment, target, m.Name).Observe(m.Duration / 1000)
+		}
+	}
+}
+
+func (s *ServerTimingRecorder) allow(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.names[name] {
+		return true
+	}
+	if len(s.names) >= s.maxNames {
+		return false
+	}
+	s.names[name] = true
+	return true
+}
+
+type serverTimingMetric struct {
+	Name     string
+	Duration float64 // milliseconds
+}
+
+// parseServerTiming parses the value of a Server-Timing header, returning only metrics that
+// have a duration. See https://www.w3.org/TR/server-timing/
+func parseServerTiming(v string) []serverTimingMetric {
+	var metrics []serverTimingMetric
+	for _, entry := range strings.Split(v, ",") {
+		params := strings.Split(entry, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" || !validMetricName(name) {
+			continue
+		}
+		for _, p := range params[1:] {
+			k, val, found := strings.Cut(strings.TrimSpace(p), "=")
+			if !found || !strings.EqualFold(strings.TrimSpace(k), "dur") {
+				continue
+			}
+			dur, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(val), `"`), 64)
+			if err != nil || dur < 0 {
+				break
+			}
+			metrics = append(metrics, serverTimingMetric{Name: name, Duration: dur})
+			break
+		}
+	}
+	return metrics
+}
+
+// validMetricName reports whether name is a safe label value, consisting only of
+// letters, digits, hyphens, underscores and dots.
+func validMetricName(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A Shutdown stops dealgood in stages when it is sent SIGTERM, as ECS does when its task is
+// stopped. The request source is stopped first so no further requests are consumed, then
+// requests already sent to targets are given time to finish and finally Prometheus is given
+// time to scrape the final metrics. Exiting straight away would lose the requests in flight and
+// every metric recorded since the previous scrape. A second signal, or the drain and scrape
+// timeouts passing, cuts the shutdown short.
+type Shutdown struct {
+	experiment    string
+	scrapes       *ScrapeNotifier // nil when metrics are not scraped, in which case scrapes are not waited for
+	drainTimeout  time.Duration   // maximum time to wait for requests in flight to finish
+	scrapeTimeout time.Duration   // maximum time to wait for a final scrape of the metrics
+
+	stopping chan struct{} // closed when the shutdown starts
+
+	mu      sync.Mutex
+	stopped bool            // whether the shutdown has started
+	sending bool            // whether the loader is sending requests and will drain them once stopping
+	scraped <-chan struct{} // closed by the first scrape after the shutdown is armed, nil until then
+
+	stageGauge *prometheus.GaugeVec
+}
+
+func NewShutdown(experiment string, scrapes *ScrapeNotifier, drainTimeout, scrapeTimeout time.Duration) (*Shutdown, error) {
+	s := &Shutdown{
+		experiment:    experiment,
+		scrapes:       scrapes,
+		drainTimeout:  drainTimeout,
+		scrapeTimeout: scrapeTimeout,
+		stopping:      make(chan struct{}),
+	}
+
+	var err error
+	s.stageGauge, err = newGaugeMetric(
+		"shutdown_stage_seconds",
+		"The time spent at each stage of the shutdown: source, drain and scrape.",
+		[]string{"experiment", "stage"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return s, nil
+}
+
+// Notify starts the shutdown when the process is sent SIGTERM or interrupted. cancel is called
+// if the loader is not yet sending requests, since there is nothing to drain, or when a second
+// signal is received.
+func (s *Shutdown) Notify(ctx context.Context, cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigs:
+				if s.Stop() {
+					fmt.Fprintf(os.Stderr, "received %s, shutting down\n", sig)
+					continue
+				}
+				fmt.Fprintf(os.Stderr, "received %s during shutdown, exiting\n", sig)
+				cancel()
+				return
+			}
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.stopping:
+			s.mu.Lock()
+			sending := s.sending
+			s.mu.Unlock()
+			if !sending {
+				cancel()
+			}
+		}
+	}()
+}
+
+// Stop starts the shutdown. It returns false if the shutdown had already started.
+func (s *Shutdown) Stop() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.stopped = true
+	close(s.stopping)
+	return true
+}
+
+// Stopping returns a channel that is closed when the shutdown starts.
+func (s *Shutdown) Stopping() <-chan struct{} {
+	return s.stopping
+}
+
+// Stopped reports whether the shutdown has started.
+func (s *Shutdown) Stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// Sending records that the loader is sending requests and will drain them when the shutdown
+// starts.
+func (s *Shutdown) Sending() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending = true
+}
+
+// Drain waits for wg, which counts the workers sending requests to targets, for up to the drain
+// timeout. It returns false if the timeout passed first, in which case the caller should abort
+// the requests still in flight.
+func (s *Shutdown) Drain(wg *sync.WaitGroup) bool {
+	start := time.Now()
+	defer func() { s.Stage("drain", time.Since(start)) }()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(s.drainTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		fmt.Fprintf(os.Stderr, "requests in flight did not finish within the drain timeout of %s, abandoning them\n", s.drainTimeout)
+		return false
+	}
+}
+
+// ArmScrape starts waiting for a scrape. Only scrapes made after this call, which include every
+// request that was drained, end the wait.
+func (s *Shutdown) ArmScrape() {
+	if s.scrapes == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.scraped == nil {
+		s.scraped = s.scrapes.Next()
+	}
+}
+
+// WaitScrape waits until metrics have been scraped since the scrape was armed, for up to the
+// final scrape timeout. It returns immediately if metrics are not scraped.
+func (s *Shutdown) WaitScrape() {
+	if s.scrapes == nil {
+		return
+	}
+	s.ArmScrape()
+	s.mu.Lock()
+	scraped := s.scraped
+	s.mu.Unlock()
+
+	start := time.Now()
+	defer func() { s.Stage("scrape", time.Since(start)) }()
+
+	t := time.NewTimer(s.scrapeTimeout)
+	defer t.Stop()
+	select {
+	case <-scraped:
+	case <-t.C:
+		fmt.Fprintf(os.Stderr, "metrics were not scraped within the final scrape timeout of %s\n", s.scrapeTimeout)
+	}
+}
+
+// Stage records the time spent at a stage of the shutdown.
+func (s *Shutdown) Stage(stage string, d time.Duration) {
+	s.stageGauge.WithLabelValues(s.experiment, stage).Set(d.Seconds())
+	fmt.Fprintf(os.Stderr, "shutdown stage %s took %s\n", stage, d.Round(time.Millisecond))
+}
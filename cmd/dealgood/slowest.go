@@ -0,0 +1,178 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// A SlowestRecorder keeps the slowest requests sent to each target in consecutive windows, so
+// that a regression seen in latency graphs can be traced to the content that was slow. At the
+// end of each window the slowest requests are written to the log, where ironbar picks them up,
+// and merged into the slowest of the whole run which are printed when dealgood stops.
+type SlowestRecorder struct {
+	k      int           // number of requests kept for each target
+	window time.Duration // length of each window
+	out    io.Writer     // where the slowest requests of each window are written
+
+	mu          sync.Mutex
+	windowStart time.Time
+	current     map[string]*slowHeap         // slowest requests of the current window, keyed by target
+	overall     map[string][]api.SlowRequest // slowest requests since the recorder started, keyed by target
+}
+
+func NewSlowestRecorder(k int, window time.Duration) (*SlowestRecorder, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("number of slowest requests must be a positive number")
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be a positive duration")
+	}
+	now := time.Now().UTC()
+	return &SlowestRecorder{
+		k:           k,
+		window:      window,
+		out:         os.Stdout,
+		windowStart: now,
+		current:     make(map[string]*slowHeap),
+		overall:     make(map[string][]api.SlowRequest),
+	}, nil
+}
+
+// Record considers a request for the slowest of its target's current window. Dropped requests
+// are never sent so are ignored.
+func (s *SlowestRecorder) Record(sent time.Time, r *request.Request, rt *RequestTiming) {
+	if rt.Dropped {
+		return
+	}
+	total := rt.TotalTime.Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.current[rt.TargetName]
+	if !ok {
+		h = &slowHeap{}
+		s.current[rt.TargetName] = h
+	}
+	if h.Len() == s.k && (*h)[0].TotalSeconds >= total {
+		return
+	}
+	sr := api.SlowRequest{
+		Time:           sent.UTC(),
+		Method:         r.Method,
+		URI:            r.URI,
+		StatusCode:     rt.StatusCode,
+		ErrorClass:     rt.ErrorClass,
+		ConnectSeconds: rt.ConnectTime.Seconds(),
+		TTFBSeconds:    rt.TTFB.Seconds(),
+		TotalSeconds:   total,
+	}
+	if h.Len() == s.k {
+		(*h)[0] = sr
+		heap.Fix(h, 0)
+		return
+	}
+	heap.Push(h, sr)
+}
+
+// Run closes a window each time the window length passes until the context is canceled, when
+// the final, partial, window is closed.
+func (s *SlowestRecorder) Run(ctx context.Context) {
+	t := time.NewTicker(s.window)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.closeWindow()
+			return
+		case <-t.C:
+			s.closeWindow()
+		}
+	}
+}
+
+// closeWindow writes the slowest requests of each target in the current window to the log and
+// starts a new window.
+func (s *SlowestRecorder) closeWindow() {
+	s.mu.Lock()
+	end := time.Now().UTC()
+	windows := make([]api.SlowestRequests, 0, len(s.current))
+	for target, h := range s.current {
+		reqs := h.sorted()
+		s.overall[target] = api.MergeSlowRequests(s.overall[target], reqs, s.k)
+		windows = append(windows, api.SlowestRequests{
+			Target:      target,
+			WindowStart: s.windowStart,
+			WindowEnd:   end,
+			Requests:    reqs,
+		})
+	}
+	s.current = make(map[string]*slowHeap, len(s.current))
+	s.windowStart = end
+	s.mu.Unlock()
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Target < windows[j].Target })
+	for _, w := range windows {
+		data, err := json.Marshal(w)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintln(s.out, api.SlowestRequestsLogPrefix+string(data))
+	}
+}
+
+// Report prints the slowest requests sent to each target since the recorder started.
+func (s *SlowestRecorder) Report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]string, 0, len(s.overall))
+	for target := range s.overall {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		fmt.Fprintf(w, "Slowest requests to %s:\n", target)
+		for _, r := range s.overall[target] {
+			outcome := fmt.Sprint(r.StatusCode)
+			if r.ErrorClass != "" {
+				outcome += " " + r.ErrorClass
+			}
+			fmt.Fprintf(w, "  %8.3fs (connect %.3fs, ttfb %.3fs) %s %s %s\n", r.TotalSeconds, r.ConnectSeconds, r.TTFBSeconds, outcome, r.Method, r.URI)
+		}
+	}
+}
+
+// slowHeap is a min-heap of requests ordered by total time, so the fastest of the slowest
+// requests kept is the one replaced.
+type slowHeap []api.SlowRequest
+
+func (h slowHeap) Len() int           { return len(h) }
+func (h slowHeap) Less(i, j int) bool { return h[i].TotalSeconds < h[j].TotalSeconds }
+func (h slowHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *slowHeap) Push(x any) { *h = append(*h, x.(api.SlowRequest)) }
+
+func (h *slowHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// sorted returns the requests in the heap, slowest first.
+func (h slowHeap) sorted() []api.SlowRequest {
+	out := append([]api.SlowRequest(nil), h...)
+	sort.Slice(out, func(i, j int) bool { return out[i].TotalSeconds > out[j].TotalSeconds })
+	return out
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SpikeConfig configures periodic traffic spikes and the scoring of each target's recovery.
+type SpikeConfig struct {
+	Multiplier float64       // request rate during a spike as a multiple of the experiment's rate
+	Duration   time.Duration // length of each spike
+	Interval   time.Duration // time between the starts of successive spikes, the first starts one interval into the measured window
+	Tolerance  float64       // a target has recovered once its p99 is within this fraction of its p99 before the spike
+}
+
+// spikeBucket is the period responses are grouped by after a spike when judging whether a
+// target has recovered. Recovery times are measured in whole buckets.
+const spikeBucket = 10 * time.Second
+
+// spikeMaxBaseline is the longest period before a spike whose p99 recovery is judged against.
+const spikeMaxBaseline = 2 * time.Minute
+
+// spikeMinResponses is the fewest responses a baseline or bucket needs for its p99 to be used.
+const spikeMinResponses = 10
+
+// spikeMaxErrorRatio is the highest share of failed responses in a bucket for the target to
+// count as recovered, so that a target answering quickly with errors is not mistaken for one
+// that has recovered.
+const spikeMaxErrorRatio = 0.01
+
+// A SpikeScenario multiplies the request rate for a short period at regular intervals and
+// scores how quickly each target's latency recovers afterwards. The p99 time to first byte of
+// each target is measured for a baseline period before each spike. Once the spike ends,
+// responses are grouped into buckets and the target has recovered at the start of the first
+// bucket whose p99 is within the tolerance of its baseline.
+type SpikeScenario struct {
+	experiment string
+	cfg        SpikeConfig
+	quiet      bool
+	baseline   time.Duration // length of the period before each spike that the baseline is measured over
+
+	mu      sync.Mutex // guards the fields below
+	start   time.Time  // start of the measured window, zero until it has started
+	active  bool       // whether a spike is in progress
+	targets map[string]*targetSpikes
+	names   []string
+
+	activeGauge        *prometheus.GaugeVec
+	spikesCounter      *prometheus.CounterVec
+	recoveryCounter    *prometheus.CounterVec
+	unrecoveredCounter *prometheus.CounterVec
+	maxRecoveryGauge   *prometheus.GaugeVec
+}
+
+// targetSpikes tracks the recovery of one target from the current spike.
+type targetSpikes struct {
+	spike        int // number of the latest spike, zero before the first
+	baselineFor  int // number of the spike the baseline was measured before
+	baseline     *TimeMetric
+	threshold    float64 // p99 in seconds the target must return within
+	pending      bool    // whether the target has yet to recover from the latest spike
+	bucket       int     // index of the bucket being filled, counted from the end of the spike
+	bucketTTFB   *TimeMetric
+	bucketFailed int
+	recoveries   []time.Duration
+	maxRecovery  time.Duration
+	unrecovered  int // spikes the target had not recovered from when the next baseline started
+	unscored     int // spikes without enough responses before them to measure a baseline
+}
+
+func NewSpikeScenario(experiment string, cfg SpikeConfig, targets []*Target, quiet bool) (*SpikeScenario, error) {
+	if cfg.Multiplier <= 1 {
+		return nil, fmt.Errorf("spike multiplier must be greater than one")
+	}
+	if cfg.Duration <= 0 {
+		return nil, fmt.Errorf("spike duration must be greater than zero")
+	}
+	quietPeriod := cfg.Interval - cfg.Duration
+	if quietPeriod < 4*spikeBucket {
+		return nil, fmt.Errorf("spike interval must be at least %s longer than the spike duration", 4*spikeBucket)
+	}
+
+	s := &SpikeScenario{
+		experiment: experiment,
+		cfg:        cfg,
+		quiet:      quiet,
+		baseline:   quietPeriod / 2,
+		targets:    make(map[string]*targetSpikes),
+	}
+	if s.baseline > spikeMaxBaseline {
+		s.baseline = spikeMaxBaseline
+	}
+	for _, target := range targets {
+		s.targets[target.Name] = &targetSpikes{baseline: NewTimeMetric()}
+		s.names = append(s.names, target.Name)
+	}
+
+	var err error
+	s.activeGauge, err = newGaugeMetric(
+		"spike_active",
+		"Whether a traffic spike is being sent to targets, 1 during a spike and 0 otherwise.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	s.spikesCounter, err = newCounterMetric(
+		"spikes_total",
+		"The number of traffic spikes a target's recovery was scored for.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	s.recoveryCounter, err = newCounterMetric(
+		"spike_recovery_seconds_total",
+		"The total time taken by a target to recover from the traffic spikes it recovered from.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	s.unrecoveredCounter, err = newCounterMetric(
+		"spike_unrecovered_total",
+		"The number of traffic spikes a target had not recovered from before the baseline of the next spike started.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	s.maxRecoveryGauge, err = newGaugeMetric(
+		"spike_recovery_max_seconds",
+		"The longest time taken by a target to recover from a traffic spike.",
+		[]string{"experiment", "target"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	for _, name := range s.names {
+		// start the counters at zero so the first spike is counted by increase queries
+		s.spikesCounter.WithLabelValues(experiment, name).Add(0)
+		s.recoveryCounter.WithLabelValues(experiment, name).Add(0)
+		s.unrecoveredCounter.WithLabelValues(experiment, name).Add(0)
+	}
+	s.activeGauge.WithLabelValues(experiment).Set(0)
+
+	return s, nil
+}
+
+// Start begins the schedule of spikes, the first of which starts one interval later.
+func (s *SpikeScenario) Start(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = t
+}
+
+// phase returns the number of the latest spike at t, zero before the first, and the time
+// since it started. It reports false if the schedule has not started.
+func (s *SpikeScenario) phase(t time.Time) (int, time.Duration, bool) {
+	if s.start.IsZero() {
+		return 0, 0, false
+	}
+	d := t.Sub(s.start)
+	k := int(d / s.cfg.Interval)
+	return k, d - time.Duration(k)*s.cfg.Interval, true
+}
+
+// Rate returns the rate requests should be sent at now, given the experiment's rate.
+func (s *SpikeScenario) Rate(base float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, off, ok := s.phase(time.Now())
+	active := ok && k >= 1 && off < s.cfg.Duration
+	if active != s.active {
+		s.active = active
+		v := 0.0
+		if active {
+			v = 1
+		}
+		s.activeGauge.WithLabelValues(s.experiment).Set(v)
+		if !s.quiet && active {
+			fmt.Printf("spike %d: sending %.1f rps for %s\n", k, base*s.cfg.Multiplier, s.cfg.Duration)
+		}
+	}
+	if active {
+		return base * s.cfg.Multiplier
+	}
+	return base
+}
+
+// Observe records the response to a request sent to a target.
+func (s *SpikeScenario) Observe(target string, res *RequestTiming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.targets[target]
+	if !ok {
+		return
+	}
+	k, off, ok := s.phase(time.Now())
+	if !ok {
+		return
+	}
+	failed := res.ConnectError || res.TimeoutError || res.Dropped || res.StatusCode >= 500 || res.StatusCode == 429
+
+	if off >= s.cfg.Interval-s.baseline {
+		// the baseline of the next spike has started
+		s.closeSpike(target, ts)
+		if ts.baselineFor != k+1 {
+			ts.baselineFor = k + 1
+			ts.baseline = NewTimeMetric()
+		}
+		if !failed {
+			ts.baseline.Add(res.TTFB.Seconds())
+		}
+		return
+	}
+	if k == 0 {
+		return
+	}
+	if ts.spike != k {
+		s.closeSpike(target, ts)
+		s.beginSpike(ts, k)
+	}
+	if off < s.cfg.Duration || !ts.pending {
+		// responses during the spike say nothing about recovery
+		return
+	}
+
+	if i := int((off - s.cfg.Duration) / spikeBucket); i != ts.bucket {
+		s.judgeBucket(target, ts)
+		if !ts.pending {
+			return
+		}
+		ts.bucket = i
+		ts.bucketTTFB = NewTimeMetric()
+		ts.bucketFailed = 0
+	}
+	if failed {
+		ts.bucketFailed++
+		return
+	}
+	ts.bucketTTFB.Add(res.TTFB.Seconds())
+}
+
+// beginSpike starts scoring the target's recovery from spike k against the baseline measured
+// before it.
+func (s *SpikeScenario) beginSpike(ts *targetSpikes, k int) {
+	ts.spike = k
+	ts.bucket = 0
+	ts.bucketTTFB = NewTimeMetric()
+	ts.bucketFailed = 0
+	if ts.baselineFor != k || ts.baseline.Count < spikeMinResponses {
+		ts.pending = false
+		ts.unscored++
+		return
+	}
+	ts.threshold = ts.baseline.Digest.Quantile(0.99) * (1 + s.cfg.Tolerance)
+	ts.pending = true
+}
+
+// judgeBucket records the target as recovered if the bucket being filled has enough responses
+// and its p99 is within the threshold.
+func (s *SpikeScenario) judgeBucket(target string, ts *targetSpikes) {
+	n := ts.bucketTTFB.Count + ts.bucketFailed
+	if n < spikeMinResponses || float64(ts.bucketFailed) > spikeMaxErrorRatio*float64(n) {
+		return
+	}
+	if ts.bucketTTFB.Digest.Quantile(0.99) > ts.threshold {
+		return
+	}
+
+	recovery := time.Duration(ts.bucket) * spikeBucket
+	ts.pending = false
+	ts.recoveries = append(ts.recoveries, recovery)
+	if recovery > ts.maxRecovery {
+		ts.maxRecovery = recovery
+	}
+	s.spikesCounter.WithLabelValues(s.experiment, target).Add(1)
+	s.recoveryCounter.WithLabelValues(s.experiment, target).Add(recovery.Seconds())
+	s.maxRecoveryGauge.WithLabelValues(s.experiment, target).Set(ts.maxRecovery.Seconds())
+	if !s.quiet {
+		fmt.Printf("spike %d: %s recovered in %s\n", ts.spike, target, recovery)
+	}
+}
+
+// closeSpike ends the scoring of the target's latest spike, which it has not recovered from
+// unless the bucket being filled shows it has.
+func (s *SpikeScenario) closeSpike(target string, ts *targetSpikes) {
+	if !ts.pending {
+		return
+	}
+	s.judgeBucket(target, ts)
+	if !ts.pending {
+		return
+	}
+	ts.pending = false
+	ts.unrecovered++
+	s.spikesCounter.WithLabelValues(s.experiment, target).Add(1)
+	s.unrecoveredCounter.WithLabelValues(s.experiment, target).Add(1)
+	if !s.quiet {
+		fmt.Printf("spike %d: %s did not recover\n", ts.spike, target)
+	}
+}
+
+// Report writes the recovery of each target from the spikes it was scored for.
+func (s *SpikeScenario) Report(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(w, "Spike recovery to within %.0f%% of the p99 time to first byte before each spike:\n", s.cfg.Tolerance*100)
+	for _, name := range s.names {
+		ts := s.targets[name]
+		var total time.Duration
+		for _, r := range ts.recoveries {
+			total += r
+		}
+		mean := "-"
+		if len(ts.recoveries) > 0 {
+			mean = (total / time.Duration(len(ts.recoveries))).String()
+		}
+		fmt.Fprintf(w, "  %s: recovered from %d spikes, mean %s, max %s, %d not recovered, %d not scored\n",
+			name, len(ts.recoveries), mean, ts.maxRecovery, ts.unrecovered, ts.unscored)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// spoolSegmentSize is the size at which a new spool segment file is started. Segments are
+// deleted once they have been fully read so disk space is reclaimed as the spool drains.
+const spoolSegmentSize = 16 << 20
+
+// SpoolingRequestSource wraps a request source with a bounded disk-backed buffer. Requests
+// are read from the wrapped source as soon as they are available and held on disk until the
+// loader is ready for them, so bursts in a live stream are absorbed rather than dropped.
+// Requests are only dropped once the spool reaches its maximum size.
+type SpoolingRequestSource struct {
+	src      RequestSource
+	dir      string
+	maxBytes int64
+
+	ch   chan request.Request
+	done chan struct{}
+
+	spooledGauge   prometheus.Gauge
+	droppedCounter prometheus.Counter
+
+	mu       sync.Mutex // guards following fields
+	cond     *sync.Cond // signalled when requests are spooled or the source ends
+	segments []*spoolSegment
+	size     int64 // bytes held in the spool that have not been read
+	ended    bool  // the wrapped source has closed its channel
+	stopped  bool
+	nextID   int
+	err      error
+}
+
+type spoolSegment struct {
+	path    string
+	w       *os.File
+	written int64
+	rf      *os.File // opened for reading once the segment becomes the head of the spool
+	read    int64
+}
+
+var _ RequestSource = (*SpoolingRequestSource)(nil)
+
+func NewSpoolingRequestSource(src RequestSource, dir string, maxBytes int64) (*SpoolingRequestSource, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create spool directory: %w", err)
+	}
+
+	s := &SpoolingRequestSource{
+		src:      src,
+		dir:      dir,
+		maxBytes: maxBytes,
+		ch:       make(chan request.Request),
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	spooled, err := newGaugeMetric(
+		"spool_bytes",
+		"The number of bytes of requests held in the disk-backed spool waiting to be sent to targets.",
+		[]string{"source"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+	s.spooledGauge = spooled.WithLabelValues(src.Name())
+
+	dropped, err := newCounterMetric(
+		"spool_dropped_total",
+		"The number of requests dropped because the disk-backed spool was full.",
+		[]string{"source"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	s.droppedCounter = dropped.WithLabelValues(src.Name())
+
+	return s, nil
+}
+
+func (s *SpoolingRequestSource) Name() string {
+	return s.src.Name()
+}
+
+func (s *SpoolingRequestSource) Chan() <-chan request.Request {
+	return s.ch
+}
+
+func (s *SpoolingRequestSource) Start() error {
+	if err := s.src.Start(); err != nil {
+		return err
+	}
+
+	go s.fill()
+	go s.drain()
+	return nil
+}
+
+func (s *SpoolingRequestSource) Stop() {
+	s.src.Stop()
+
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.done)
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+}
+
+func (s *SpoolingRequestSource) Err() error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.src.Err()
+}
+
+// fill reads requests from the wrapped source and appends them to the spool.
+func (s *SpoolingRequestSource) fill() {
+	defer func() {
+		s.mu.Lock()
+		s.ended = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+
+	for req := range s.src.Chan() {
+		data, err := json.Marshal(req)
+		if err != nil {
+			log.Printf("failed to marshal request for spool: %v", err)
+			continue
+		}
+		data = append(data, '\n')
+
+		if err := s.append(data); err != nil {
+			s.setErr(err)
+			return
+		}
+	}
+}
+
+func (s *SpoolingRequestSource) append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+	if s.size+int64(len(data)) > s.maxBytes {
+		s.droppedCounter.Add(1)
+		return nil
+	}
+
+	var seg *spoolSegment
+	if n := len(s.segments); n > 0 && s.segments[n-1].written < spoolSegmentSize {
+		seg = s.segments[n-1]
+	} else {
+		path := filepath.Join(s.dir, fmt.Sprintf("spool-%06d.jsonl", s.nextID))
+		s.nextID++
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("create spool segment: %w", err)
+		}
+		seg = &spoolSegment{path: path, w: f}
+		s.segments = append(s.segments, seg)
+	}
+
+	if _, err := seg.w.Write(data); err != nil {
+		return fmt.Errorf("write spool segment: %w", err)
+	}
+	seg.written += int64(len(data))
+	s.size += int64(len(data))
+	s.spooledGauge.Set(float64(s.size))
+	s.cond.Broadcast()
+	return nil
+}
+
+// drain reads requests from the spool and sends them to the loader.
+func (s *SpoolingRequestSource) drain() {
+	defer close(s.ch)
+
+	var lines [][]byte
+	for {
+		if len(lines) == 0 {
+			var err error
+			lines, err = s.next()
+			if err != nil {
+				s.setErr(err)
+				return
+			}
+			if lines == nil {
+				// spool is empty and the source has ended, or the spool was stopped
+				return
+			}
+		}
+
+		var req request.Request
+		if err := json.Unmarshal(lines[0], &req); err != nil {
+			log.Printf("failed to unmarshal spooled request: %v", err)
+			lines = lines[1:]
+			continue
+		}
+
+		select {
+		case <-s.done:
+			return
+		case s.ch <- req:
+		}
+		lines = lines[1:]
+	}
+}
+
+// next blocks until there are unread requests in the spool and returns a batch of them. It
+// returns nil when the spool is empty and no more requests will be added.
+func (s *SpoolingRequestSource) next() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.stopped {
+			s.removeSegments()
+			return nil, nil
+		}
+		if len(s.segments) > 0 {
+			head := s.segments[0]
+			if head.read < head.written {
+				return s.readSegment(head)
+			}
+			if len(s.segments) > 1 || head.written >= spoolSegmentSize {
+				// fully read and no more will be written to it
+				s.closeSegment(head)
+				s.segments = s.segments[1:]
+				continue
+			}
+		}
+		if s.ended {
+			s.removeSegments()
+			return nil, nil
+		}
+		s.cond.Wait()
+	}
+}
+
+// readSegment reads the complete lines written to the segment that have not yet been read.
+// It must be called with the mutex held.
+func (s *SpoolingRequestSource) readSegment(seg *spoolSegment) ([][]byte, error) {
+	if seg.rf == nil {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("open spool segment: %w", err)
+		}
+		seg.rf = f
+	}
+
+	// limit the batch so the lock is not held for long
+	n := seg.written - seg.read
+	if n > 1<<20 {
+		n = 1 << 20
+	}
+	br := bufio.NewReader(io.NewSectionReader(seg.rf, seg.read, n))
+
+	var lines [][]byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// a partial line at the end of the batch is read again in the next batch
+			break
+		}
+		lines = append(lines, line)
+		seg.read += int64(len(line))
+		s.size -= int64(len(line))
+	}
+	if len(lines) == 0 {
+		// a single line larger than the batch size
+		line, err := io.ReadAll(io.NewSectionReader(seg.rf, seg.read, seg.written-seg.read))
+		if err != nil {
+			return nil, fmt.Errorf("read spool segment: %w", err)
+		}
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		lines = append(lines, line)
+		seg.read += int64(len(line))
+		s.size -= int64(len(line))
+	}
+	s.spooledGauge.Set(float64(s.size))
+	return lines, nil
+}
+
+func (s *SpoolingRequestSource) closeSegment(seg *spoolSegment) {
+	seg.w.Close()
+	if seg.rf != nil {
+		seg.rf.Close()
+	}
+	if err := os.Remove(seg.path); err != nil {
+		log.Printf("failed to remove spool segment: %v", err)
+	}
+}
+
+func (s *SpoolingRequestSource) removeSegments() {
+	for _, seg := range s.segments {
+		s.closeSegment(seg)
+	}
+	s.segments = nil
+	s.size = 0
+	s.spooledGauge.Set(0)
+}
+
+func (s *SpoolingRequestSource) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.ended = true
+	s.cond.Broadcast()
+}
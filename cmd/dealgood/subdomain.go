@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// subdomainRequest rewrites a path gateway request uri into the hostname and path used to make
+// the equivalent request to a subdomain gateway serving the given domain. For example
+// /ipfs/QmHash/file.txt becomes bafyhash.ipfs.localhost and /file.txt. It reports false if
+// the uri cannot be rewritten, such as when it does not refer to content.
+func subdomainRequest(uri string, domain string) (string, string, bool) {
+	path, query, hasQuery := strings.Cut(uri, "?")
+
+	var ns string
+	switch {
+	case strings.HasPrefix(path, "/ipfs/"):
+		ns = "ipfs"
+	case strings.HasPrefix(path, "/ipns/"):
+		ns = "ipns"
+	default:
+		return "", "", false
+	}
+
+	root, rest, _ := strings.Cut(path[len(ns)+2:], "/")
+	if root == "" {
+		return "", "", false
+	}
+
+	var label string
+	switch ns {
+	case "ipfs":
+		c, err := cid.Decode(root)
+		if err != nil {
+			return "", "", false
+		}
+		// subdomains must be case insensitive so use a base32 encoded CIDv1
+		label = cid.NewCidV1(c.Type(), c.Hash()).String()
+	case "ipns":
+		if c, err := cid.Decode(root); err == nil {
+			// libp2p keys are represented as base36 in subdomains but base32 is also accepted
+			label = cid.NewCidV1(cid.Libp2pKey, c.Hash()).String()
+		} else {
+			// DNSLink names are inlined into a single DNS label
+			label = strings.ReplaceAll(strings.ReplaceAll(root, "-", "--"), ".", "-")
+		}
+	}
+	if len(label) > 63 {
+		// too long for a DNS label
+		return "", "", false
+	}
+
+	newPath := "/" + rest
+	if hasQuery {
+		newPath += "?" + query
+	}
+	return label + "." + ns + "." + domain, newPath, true
+}
@@ -30,6 +30,17 @@ type Worker struct {
 	ExperimentName string
 	Client         *http.Client
 	PrintFailures  bool
+	HAR            *HARRecorder          // optional recorder of sampled requests
+	Headers        *HeaderComparer       // optional comparer of response headers
+	Cookies        CookieJars            // optional cookie jars, nil means requests are stateless
+	ServerTiming   *ServerTimingRecorder // optional recorder of Server-Timing response headers
+	Body           *BodyStrategy         // how response bodies are read, nil means bodies are read in full
+	Records        *ClickHouseSink       // optional sink of per-request records
+	Encodings      *EncodingRecorder     // optional recorder of response sizes by content encoding
+	Slowest        *SlowestRecorder      // optional recorder of the slowest requests
+	Workload       *WorkloadProfile      // optional profile of the requests replayed
+	Audit          *ReplayAudit          // optional audit of the outcome of each request
+	Spikes         *SpikeScenario        // optional traffic spikes whose recovery is scored
 }
 
 func (w *Worker) Run(ctx context.Context, wg *sync.WaitGroup, results chan *RequestTiming) {
@@ -39,11 +50,41 @@ func (w *Worker) Run(ctx context.Context, wg *sync.WaitGroup, results chan *Requ
 		select {
 		case <-ctx.Done():
 			return
-		case req, ok := <-w.Target.Requests:
+		case treq, ok := <-w.Target.Requests:
 			if !ok {
 				return
 			}
+			if w.Target.Queue != nil {
+				w.Target.Queue.Dequeued(treq, len(w.Target.Requests))
+			}
+			req := treq.Request
+			sent := time.Now()
 			result := w.timeRequest(ctx, req)
+			if w.Audit != nil {
+				w.Audit.Result(treq.id, w.Target.Name, result)
+			}
+			if result == nil {
+				// request was served by the emulated cache
+				continue
+			}
+			if w.Records != nil {
+				w.Records.Record(sent, req, result)
+			}
+			if w.Slowest != nil {
+				w.Slowest.Record(sent, req, result)
+			}
+			if w.Workload != nil {
+				w.Workload.Response(req, result)
+			}
+			if w.Target.Guard != nil {
+				w.Target.Guard.Observe(result.StatusCode, result.ConnectError || result.TimeoutError)
+			}
+			if w.Target.Search != nil {
+				w.Target.Search.Observe(result)
+			}
+			if w.Spikes != nil {
+				w.Spikes.Observe(w.Target.Name, result)
+			}
 
 			// Check context again since it might have been canceled while we were
 			// waiting for request
@@ -58,16 +99,40 @@ func (w *Worker) Run(ctx context.Context, wg *sync.WaitGroup, results chan *Requ
 	}
 }
 
+// timeRequest sends the request to the worker's target and returns its timings, or nil
+// if the request was served by the target's emulated cache.
 func (w *Worker) timeRequest(ctx context.Context, r *request.Request) *RequestTiming {
 	req, err := newRequest(ctx, w.Target, r)
 	if err != nil {
+		if w.Headers != nil {
+			w.Headers.Skip(r)
+		}
 		if w.PrintFailures {
 			fmt.Fprintf(os.Stderr, "%s %s => error %v\n", r.Method, w.Target.BaseURL+r.URI, err)
 		}
-		return &RequestTiming{
+		return acquireTiming(RequestTiming{
 			ExperimentName: w.ExperimentName,
 			TargetName:     w.Target.Name,
 			ConnectError:   true,
+			ErrorClass:     errClassInvalidRequest,
+		})
+	}
+
+	if w.Target.Cache != nil && w.Target.Cache.Lookup(req) {
+		if w.Headers != nil {
+			w.Headers.Skip(r)
+		}
+		return nil
+	}
+
+	var jar http.CookieJar
+	var cookieURL *url.URL
+	if w.Cookies != nil {
+		jar = w.Cookies.Jar(r)
+		// cookies are scoped to the host the request is addressed to rather than the target's address
+		cookieURL = &url.URL{Scheme: req.URL.Scheme, Host: req.Host, Path: req.URL.Path}
+		for _, c := range jar.Cookies(cookieURL) {
+			req.AddCookie(c)
 		}
 	}
 
@@ -98,60 +163,132 @@ func (w *Worker) timeRequest(ctx context.Context, r *request.Request) *RequestTi
 
 	resp, err := w.Client.Do(req)
 	if err != nil {
+		if w.Headers != nil {
+			w.Headers.Skip(r)
+		}
 		if w.PrintFailures {
 			fmt.Fprintf(os.Stderr, "%s %s => error %v\n", req.Method, req.URL, err)
 		}
 		if os.IsTimeout(err) {
-			return &RequestTiming{
+			return acquireTiming(RequestTiming{
 				ExperimentName: w.ExperimentName,
 				TargetName:     w.Target.Name,
 				TimeoutError:   true,
-			}
+				ErrorClass:     errClassTimeout,
+			})
 		}
 		if err := resolveTarget(w.Target, !w.PrintFailures); err != nil {
 			fmt.Fprintf(os.Stderr, "resolve %s => error %v\n", w.Target.RawHostPort, err)
 		}
 
-		return &RequestTiming{
+		return acquireTiming(RequestTiming{
 			ExperimentName: w.ExperimentName,
 			TargetName:     w.Target.Name,
 			ConnectError:   true,
-		}
+			ErrorClass:     classifyError(err),
+		})
 	}
 	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
+	body := w.Body
+	if body == nil {
+		body = &BodyStrategy{Mode: bodyFull}
+	}
+	var respBody io.Reader = resp.Body
+	var encoding string
+	var sizer *decodedSizer
+	if w.Encodings != nil {
+		encoding = contentEncoding(resp.Header)
+		if body.Complete() {
+			// the decompressed size is only known when the whole body is read
+			sizer = newDecodedSizer(encoding)
+		}
+		if sizer != nil {
+			respBody = io.TeeReader(resp.Body, sizer)
+		}
+	}
+	size, bodyHash, err := body.Read(respBody)
+	if w.Encodings != nil {
+		decoded := int64(-1)
+		switch {
+		case sizer != nil:
+			decoded = sizer.Size()
+		case encoding == "identity" && body.Complete():
+			decoded = size
+		}
+		w.Encodings.Record(w.Target.Name, r.Header["Accept-Encoding"], encoding, size, decoded)
+	}
+	contentLength := resp.ContentLength
+	if !body.Complete() {
+		// the body length can only be checked when it has been fully read
+		contentLength = -1
+	}
+	errClass := classifyResponse(req.Method, resp.StatusCode, contentLength, size)
+	if err != nil {
+		errClass = classifyBodyError(err)
+	}
+	if w.Target.Cache != nil {
+		w.Target.Cache.Store(req, resp)
+	}
+	if jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			jar.SetCookies(cookieURL, cookies)
+		}
+	}
 
 	end = time.Now()
 	totalTime = end.Sub(start)
 
+	if w.HAR != nil {
+		w.HAR.Record(w.Target.Name, req, resp, start, connectTime, ttfb, totalTime, size)
+	}
+	if w.Headers != nil {
+		w.Headers.Record(r, w.Target.Name, resp, bodyHash)
+	}
+	if w.ServerTiming != nil {
+		w.ServerTiming.Record(w.Target.Name, resp.Header)
+	}
+
 	if w.PrintFailures {
 		if resp.StatusCode/100 != 2 {
 			fmt.Fprintf(os.Stderr, "%s %s => %s\n", req.Method, req.URL, resp.Status)
 		}
 	}
 
-	return &RequestTiming{
+	return acquireTiming(RequestTiming{
 		ExperimentName: w.ExperimentName,
 		TargetName:     w.Target.Name,
 		StatusCode:     resp.StatusCode,
+		ErrorClass:     errClass,
+		Format:         requestFormat(r),
+		BodyBytes:      size,
 		ConnectTime:    connectTime,
 		TTFB:           ttfb,
 		TotalTime:      totalTime,
-	}
+	})
 }
 
 func newRequest(ctx context.Context, t *Target, r *request.Request) (*http.Request, error) {
+	uri := r.URI
+	var subdomainHost string
+	if t.SubdomainGateway != "" {
+		if host, rewritten, ok := subdomainRequest(r.URI, t.SubdomainGateway); ok {
+			subdomainHost, uri = host, rewritten
+		}
+	}
+
+	path, query, _ := strings.Cut(uri, "?")
 	req := &http.Request{
 		Method: r.Method,
 		URL: &url.URL{
-			Scheme: t.URLScheme,
-			Host:   t.HostPort(),
-			Path:   r.URI,
+			Scheme:   t.URLScheme,
+			Host:     t.HostPort(),
+			Path:     path,
+			RawQuery: query,
 		},
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     make(http.Header),
+		Header:     make(http.Header, len(r.Header)+len(t.Headers)+1),
 	}
 
 	if r.Body != nil {
@@ -162,12 +299,20 @@ func newRequest(ctx context.Context, t *Target, r *request.Request) (*http.Reque
 		req.Header.Set(k, v)
 	}
 
+	for k, vs := range t.Headers {
+		req.Header[k] = vs
+	}
+
 	host := req.Header.Get("Host")
 	// The live request log uses a hostname of backend to refer to the orginal host
-	if host == "backend" || host == "" {
+	if host == "backend" || host == "" || t.HostOverride {
 		host = t.HostName
 		req.Header.Set("Host", t.HostName)
 	}
+	if subdomainHost != "" {
+		host = subdomainHost
+		req.Header.Set("Host", host)
+	}
 	req.Host = host
 
 	return req, nil
@@ -207,6 +352,7 @@ func targetsReady(ctx context.Context, targets []*Target, quiet bool, interactiv
 					MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
 					DisableCompression:  true,
 					DisableKeepAlives:   true,
+					DialContext:         target.DialContext,
 				}
 				http2.ConfigureTransport(tr)
 
@@ -274,7 +420,7 @@ func resolve(name string) (string, error) {
 
 	if port != "" {
 		// Lookup A record
-		ips, err := net.LookupIP(host)
+		ips, err := dnsResolver.LookupIP(context.Background(), "ip", host)
 		if err != nil {
 			var de *net.DNSError
 			if errors.As(err, &de) {
@@ -294,7 +440,7 @@ func resolve(name string) (string, error) {
 	}
 
 	// No A record so lookup SRV
-	_, recs, err := net.DefaultResolver.LookupSRV(context.Background(), "", "", host)
+	_, recs, err := dnsResolver.LookupSRV(context.Background(), "", "", host)
 	if err != nil {
 		return name, fmt.Errorf("lookup srv: %w", err)
 	}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// workloadTopN are the numbers of most requested paths whose share of all requests is reported.
+var workloadTopN = []int{1, 10, 100, 1000}
+
+// workloadSizeQuantiles are the quantiles of response size reported, weighted by request.
+var workloadSizeQuantiles = []float64{0.5, 0.9, 0.99}
+
+// A WorkloadProfile describes the composition of the requests replayed during a run: how many
+// distinct paths were requested, how concentrated requests were on the most popular paths and
+// how large the responses were. Differences in results between runs can then be attributed to
+// differences in workload rather than to changes in the targets.
+type WorkloadProfile struct {
+	experiment string
+	maxPaths   int  // maximum number of distinct paths tracked
+	sizes      bool // whether response sizes are recorded, false when bodies are not read
+
+	mu        sync.Mutex
+	paths     map[string]*pathStats
+	requests  int64 // number of requests replayed
+	untracked int64 // number of requests for paths that were not tracked once maxPaths was reached
+
+	requestsGauge    *prometheus.GaugeVec
+	uniquePathsGauge *prometheus.GaugeVec
+	topShareGauge    *prometheus.GaugeVec
+	sizeGauge        *prometheus.GaugeVec
+	untrackedGauge   *prometheus.GaugeVec
+}
+
+type pathStats struct {
+	count int64
+	size  int64 // size of the first successful response body read for the path, -1 if none yet
+}
+
+func NewWorkloadProfile(experiment string, maxPaths int, sizes bool) (*WorkloadProfile, error) {
+	if maxPaths <= 0 {
+		return nil, fmt.Errorf("maximum number of paths must be a positive number")
+	}
+	p := &WorkloadProfile{
+		experiment: experiment,
+		maxPaths:   maxPaths,
+		sizes:      sizes,
+		paths:      make(map[string]*pathStats),
+	}
+
+	var err error
+	p.requestsGauge, err = newGaugeMetric(
+		"workload_requests",
+		"The number of requests replayed since dealgood started, counted once however many targets they were sent to.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	p.uniquePathsGauge, err = newGaugeMetric(
+		"workload_unique_paths",
+		"The number of distinct paths requested since dealgood started. A lower bound once the number of tracked paths reaches its limit.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	p.topShareGauge, err = newGaugeMetric(
+		"workload_top_share",
+		"The share of requests made for the n most requested paths since dealgood started.",
+		[]string{"experiment", "n"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	p.sizeGauge, err = newGaugeMetric(
+		"workload_response_size_bytes",
+		"Quantiles of the size of response bodies read, weighted by the number of requests for each path.",
+		[]string{"experiment", "quantile"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	p.untrackedGauge, err = newGaugeMetric(
+		"workload_untracked_requests",
+		"The number of requests for paths that were not tracked because the limit on tracked paths was reached.",
+		[]string{"experiment"},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	return p, nil
+}
+
+// Request counts a request replayed to the targets.
+func (p *WorkloadProfile) Request(r *request.Request) {
+	path := requestPath(r.URI)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	ps, ok := p.paths[path]
+	if !ok {
+		if len(p.paths) >= p.maxPaths {
+			p.untracked++
+			return
+		}
+		ps = &pathStats{size: -1}
+		p.paths[path] = ps
+	}
+	ps.count++
+}
+
+// Response records the size of a response body the first time a path is successfully read
+// from any target.
+func (p *WorkloadProfile) Response(r *request.Request, rt *RequestTiming) {
+	if !p.sizes || rt.Dropped || rt.ErrorClass != "" || rt.StatusCode < 200 || rt.StatusCode > 299 {
+		return
+	}
+	path := requestPath(r.URI)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ps, ok := p.paths[path]; ok && ps.size < 0 {
+		ps.size = rt.BodyBytes
+	}
+}
+
+// Run updates the workload metrics each interval until the context is canceled.
+func (p *WorkloadProfile) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.update()
+			return
+		case <-t.C:
+			p.update()
+		}
+	}
+}
+
+func (p *WorkloadProfile) update() {
+	s := p.Summary()
+	p.requestsGauge.WithLabelValues(p.experiment).Set(float64(s.Requests))
+	p.uniquePathsGauge.WithLabelValues(p.experiment).Set(float64(s.UniquePaths))
+	p.untrackedGauge.WithLabelValues(p.experiment).Set(float64(s.Untracked))
+	for i, n := range workloadTopN {
+		p.topShareGauge.WithLabelValues(p.experiment, fmt.Sprint(n)).Set(s.TopShare[i])
+	}
+	for i, q := range workloadSizeQuantiles {
+		if s.Sizes[i] < 0 {
+			continue
+		}
+		p.sizeGauge.WithLabelValues(p.experiment, fmt.Sprint(q)).Set(float64(s.Sizes[i]))
+	}
+}
+
+// A WorkloadSummary is a snapshot of a WorkloadProfile. TopShare and Sizes are indexed like
+// workloadTopN and workloadSizeQuantiles. Sizes are -1 if no response has been read.
+type WorkloadSummary struct {
+	Requests    int64
+	UniquePaths int
+	Untracked   int64
+	TopShare    []float64
+	Sizes       []int64
+}
+
+// Summary computes the composition of the requests replayed so far.
+func (p *WorkloadProfile) Summary() *WorkloadSummary {
+	p.mu.Lock()
+	stats := make([]pathStats, 0, len(p.paths))
+	for _, ps := range p.paths {
+		stats = append(stats, *ps)
+	}
+	s := &WorkloadSummary{
+		Requests:    p.requests,
+		UniquePaths: len(p.paths),
+		Untracked:   p.untracked,
+		TopShare:    make([]float64, len(workloadTopN)),
+		Sizes:       make([]int64, len(workloadSizeQuantiles)),
+	}
+	p.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].count > stats[j].count })
+	if s.Requests > 0 {
+		var cum int64
+		next := 0
+		for i, ps := range stats {
+			cum += ps.count
+			for next < len(workloadTopN) && workloadTopN[next] == i+1 {
+				s.TopShare[next] = float64(cum) / float64(s.Requests)
+				next++
+			}
+		}
+		for ; next < len(workloadTopN); next++ {
+			s.TopShare[next] = float64(cum) / float64(s.Requests)
+		}
+	}
+
+	// quantiles of size weighted by the number of requests for each path
+	sort.Slice(stats, func(i, j int) bool { return stats[i].size < stats[j].size })
+	var sized int64
+	for _, ps := range stats {
+		if ps.size >= 0 {
+			sized += ps.count
+		}
+	}
+	for i := range s.Sizes {
+		s.Sizes[i] = -1
+	}
+	if sized > 0 {
+		var cum int64
+		next := 0
+		for _, ps := range stats {
+			if ps.size < 0 {
+				continue
+			}
+			cum += ps.count
+			for next < len(workloadSizeQuantiles) && float64(cum) >= workloadSizeQuantiles[next]*float64(sized) {
+				s.Sizes[next] = ps.size
+				next++
+			}
+		}
+	}
+
+	return s
+}
+
+// Report prints the composition of the requests replayed since dealgood started.
+func (p *WorkloadProfile) Report(w io.Writer) {
+	s := p.Summary()
+	fmt.Fprintf(w, "Workload: %d requests for %d distinct paths\n", s.Requests, s.UniquePaths)
+	if s.Untracked > 0 {
+		fmt.Fprintf(w, "  %d requests were for paths beyond the %d tracked\n", s.Untracked, p.maxPaths)
+	}
+	for i, n := range workloadTopN {
+		fmt.Fprintf(w, "  top %d paths: %.1f%% of requests\n", n, s.TopShare[i]*100)
+	}
+	for i, q := range workloadSizeQuantiles {
+		if s.Sizes[i] < 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  response size p%g: %d bytes\n", q*100, s.Sizes[i])
+	}
+}
+
+// requestPath returns the path of a request URI without its query string, so requests for the
+// same content with different parameters are counted together.
+func requestPath(uri string) string {
+	path, _, _ := strings.Cut(uri, "?")
+	return path
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/pkg/prom"
+	"github.com/plprobelab/thunderdome/pkg/run"
+)
+
+const appName = "egress"
+
+var app = &cli.App{
+	Name:   appName,
+	Usage:  "A forward proxy that counts the requests a target sends to shared upstreams and other destinations",
+	Action: Run,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "listen-addr",
+			Usage:       "Network address to accept proxied requests on.",
+			Value:       ":3128",
+			Destination: &flags.listenAddr,
+			EnvVars:     []string{"EGRESS_LISTEN_ADDR"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "upstream",
+			Usage:       "A shared upstream to count requests to, as name:host. A leading *. in the host matches any subdomain. A name may be given with several hosts. Requests to other hosts are counted as other. May be repeated.",
+			Destination: &flags.upstreams,
+			EnvVars:     []string{"EGRESS_UPSTREAMS"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "allow",
+			Usage:       "Only permit connections to this host. A leading *. matches any subdomain. May be repeated. If not given, all hosts not denied are permitted.",
+			Destination: &flags.allow,
+			EnvVars:     []string{"EGRESS_ALLOW"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "deny",
+			Usage:       "Refuse connections to this host, even if allowed. A leading *. matches any subdomain. May be repeated.",
+			Destination: &flags.deny,
+			EnvVars:     []string{"EGRESS_DENY"},
+		},
+		&cli.IntFlag{
+			Name:        "max-destinations",
+			Usage:       "Maximum number of destination hosts counted individually. Further hosts are counted as untracked.",
+			Value:       500,
+			Destination: &flags.maxDestinations,
+			EnvVars:     []string{"EGRESS_MAX_DESTINATIONS"},
+		},
+		&cli.StringFlag{
+			Name:        "prometheus-addr",
+			Usage:       "Network address to start a prometheus metric exporter server on (example: :9092)",
+			Value:       ":9092",
+			Destination: &flags.prometheusAddr,
+			EnvVars:     []string{"EGRESS_PROMETHEUS_ADDR"},
+		},
+	},
+}
+
+var flags struct {
+	listenAddr     string
+	prometheusAddr string
+	upstreams      cli.StringSlice
+	allow          cli.StringSlice
+	deny           cli.StringSlice
+
+	maxDestinations int
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.LUTC | log.Lshortfile)
+	ctx := context.Background()
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func Run(cc *cli.Context) error {
+	ctx := cc.Context
+
+	upstreams, err := ParseUpstreams(flags.upstreams.Value())
+	if err != nil {
+		return fmt.Errorf("upstreams: %w", err)
+	}
+	if names := upstreams.Names(); len(names) > 0 {
+		log.Printf("counting requests to upstreams: %s", strings.Join(names, ", "))
+	}
+
+	rules, err := NewRules(flags.allow.Value(), flags.deny.Value())
+	if err != nil {
+		return fmt.Errorf("rules: %w", err)
+	}
+	if !rules.Empty() {
+		log.Printf("applying %d allow and %d deny rules", len(flags.allow.Value()), len(flags.deny.Value()))
+	}
+
+	rg := new(run.Group)
+
+	proxy, err := NewProxy(flags.listenAddr, upstreams, rules, flags.maxDestinations)
+	if err != nil {
+		return fmt.Errorf("new proxy: %w", err)
+	}
+	rg.Add(proxy)
+
+	if flags.prometheusAddr != "" {
+		ps, err := prom.NewPrometheusServer(flags.prometheusAddr, "/metrics", appName)
+		if err != nil {
+			return fmt.Errorf("start prometheus: %w", err)
+		}
+		rg.Add(Restartable{ps})
+	}
+
+	return rg.RunAndWait(ctx)
+}
+
+type Restartable struct {
+	run.Runnable
+}
+
+func (r Restartable) Run(ctx context.Context) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := r.Runnable.Run(ctx); err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+		}
+	}
+}
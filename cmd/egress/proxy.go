@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/pkg/prom"
+)
+
+// hopHeaders are removed from requests and responses forwarded by the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// untrackedDestination is the name given to destinations beyond the limit on tracked destinations.
+const untrackedDestination = "untracked"
+
+// A Proxy is a forward HTTP proxy that counts the requests and bytes a target sends to each
+// shared upstream and destination host, refusing destinations its rules do not permit. Plain
+// HTTP requests are forwarded and counted individually. HTTPS requests are tunnelled with
+// CONNECT so only the tunnel and the bytes passing through it can be counted.
+type Proxy struct {
+	addr            string
+	upstreams       *UpstreamMatcher
+	rules           *Rules
+	maxDestinations int // maximum number of destination hosts given their own metric series
+	transport       *http.Transport
+	dialer          *net.Dialer
+
+	mu           sync.Mutex
+	destinations map[string]bool // destination hosts with their own metric series
+
+	requestsCounter     *prom.CounterVec
+	tunnelsCounter      *prom.CounterVec
+	bytesCounter        *prom.CounterVec
+	errorsCounter       *prom.CounterVec
+	destRequestsCounter *prom.CounterVec
+	destBytesCounter    *prom.CounterVec
+	deniedCounter       *prom.CounterVec
+}
+
+func NewProxy(addr string, upstreams *UpstreamMatcher, rules *Rules, maxDestinations int) (*Proxy, error) {
+	if maxDestinations < 0 {
+		return nil, fmt.Errorf("maximum number of destinations must not be negative")
+	}
+	p := &Proxy{
+		addr:            addr,
+		upstreams:       upstreams,
+		rules:           rules,
+		maxDestinations: maxDestinations,
+		destinations:    make(map[string]bool),
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	p.transport = &http.Transport{
+		DialContext:           p.dialer.DialContext,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	var err error
+	p.requestsCounter, err = prom.NewPrometheusCounterVec(appName, "upstream_requests_total", "The number of plain HTTP requests and HTTPS tunnels opened to each upstream.", nil, "upstream")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.tunnelsCounter, err = prom.NewPrometheusCounterVec(appName, "upstream_tunnels_total", "The number of HTTPS tunnels opened to each upstream, which may each carry many requests.", nil, "upstream")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.bytesCounter, err = prom.NewPrometheusCounterVec(appName, "upstream_bytes_total", "The number of bytes sent to and received from each upstream.", nil, "upstream", "direction")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.errorsCounter, err = prom.NewPrometheusCounterVec(appName, "upstream_errors_total", "The number of requests and tunnels to each upstream that failed to connect or complete.", nil, "upstream")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	p.destRequestsCounter, err = prom.NewPrometheusCounterVec(appName, "destination_requests_total", "The number of plain HTTP requests and HTTPS tunnels opened to each destination host.", nil, "destination")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.destBytesCounter, err = prom.NewPrometheusCounterVec(appName, "destination_bytes_total", "The number of bytes sent to and received from each destination host.", nil, "destination", "direction")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+	p.deniedCounter, err = prom.NewPrometheusCounterVec(appName, "denied_requests_total", "The number of requests and tunnels refused because the rules do not permit their destination host.", nil, "destination")
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	// start every upstream at zero so increases are reported from the first request
+	for _, name := range append(upstreams.Names(), otherUpstream) {
+		p.requestsCounter.WithLabelValues(name)
+		p.errorsCounter.WithLabelValues(name)
+	}
+
+	return p, nil
+}
+
+func (p *Proxy) Run(ctx context.Context) error {
+	server := &http.Server{Addr: p.addr, Handler: p}
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			slog.Error("failed to shut down proxy server", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "egress proxy only accepts absolute request URIs", http.StatusBadRequest)
+		return
+	}
+	p.forward(w, r)
+}
+
+// forward sends a plain HTTP request to its destination and copies the response back.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	upstream, dest, ok := p.admit(w, r.URL.Host)
+	if !ok {
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	if r.ContentLength > 0 {
+		p.countBytes(upstream, dest, "sent", r.ContentLength)
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.errorsCounter.WithLabelValues(upstream).Add(1)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	n, err := io.Copy(w, resp.Body)
+	p.countBytes(upstream, dest, "received", n)
+	if err != nil {
+		p.errorsCounter.WithLabelValues(upstream).Add(1)
+	}
+}
+
+// tunnel connects to the destination of a CONNECT request and copies bytes in both directions
+// until either side closes its connection.
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, dest, ok := p.admit(w, r.Host)
+	if !ok {
+		return
+	}
+	p.tunnelsCounter.WithLabelValues(upstream).Add(1)
+
+	dst, err := p.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.errorsCounter.WithLabelValues(upstream).Add(1)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	src, buf, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	if _, err := src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// the client may already have sent bytes that were buffered while reading the request
+		n, _ := io.Copy(dst, io.MultiReader(io.LimitReader(buf, int64(buf.Reader.Buffered())), src))
+		p.countBytes(upstream, dest, "sent", n)
+		closeWrite(dst)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(src, dst)
+		p.countBytes(upstream, dest, "received", n)
+		closeWrite(src)
+	}()
+	wg.Wait()
+}
+
+// admit checks that the rules permit a connection to hostport, refusing the request if not,
+// and counts it against its upstream and destination.
+func (p *Proxy) admit(w http.ResponseWriter, hostport string) (string, string, bool) {
+	dest := p.destination(hostport)
+	if !p.rules.Permit(hostport) {
+		p.deniedCounter.WithLabelValues(dest).Add(1)
+		http.Error(w, fmt.Sprintf("egress to %s is not permitted", hostName(hostport)), http.StatusForbidden)
+		return "", "", false
+	}
+	upstream := p.upstreams.Match(hostport)
+	p.requestsCounter.WithLabelValues(upstream).Add(1)
+	p.destRequestsCounter.WithLabelValues(dest).Add(1)
+	return upstream, dest, true
+}
+
+// destination returns the name hostport is counted under, which is its host name unless the
+// limit on tracked destinations has been reached.
+func (p *Proxy) destination(hostport string) string {
+	host := hostName(hostport)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.destinations[host] {
+		return host
+	}
+	if len(p.destinations) >= p.maxDestinations {
+		return untrackedDestination
+	}
+	p.destinations[host] = true
+	return host
+}
+
+func (p *Proxy) countBytes(upstream, dest, direction string, n int64) {
+	p.bytesCounter.WithLabelValues(upstream, direction).Add(float64(n))
+	p.destBytesCounter.WithLabelValues(dest, direction).Add(float64(n))
+}
+
+// closeWrite signals the end of writes on a connection so the peer sees the other side close.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range splitTokens(v) {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// splitTokens splits a comma separated header value.
+func splitTokens(v string) []string {
+	var tokens []string
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rules decide which destinations a target may connect to through the proxy. A destination
+// matching a deny rule is always refused. When there are allow rules, a destination must also
+// match one of them.
+type Rules struct {
+	allow []string
+	deny  []string
+}
+
+// NewRules creates rules from lists of hosts. A host with a leading *. matches any subdomain.
+func NewRules(allow, deny []string) (*Rules, error) {
+	r := &Rules{}
+	for _, list := range []struct {
+		hosts []string
+		out   *[]string
+	}{
+		{hosts: allow, out: &r.allow},
+		{hosts: deny, out: &r.deny},
+	} {
+		for _, h := range list.hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if h == "" {
+				continue
+			}
+			if strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+				return nil, fmt.Errorf("invalid host %q, expected a host name with an optional leading *.", h)
+			}
+			*list.out = append(*list.out, h)
+		}
+	}
+	return r, nil
+}
+
+// Permit reports whether a connection to hostport is allowed.
+func (r *Rules) Permit(hostport string) bool {
+	host := hostName(hostport)
+	for _, p := range r.deny {
+		if matchHost(p, host) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, p := range r.allow {
+		if matchHost(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the rules permit every destination.
+func (r *Rules) Empty() bool {
+	return len(r.allow) == 0 && len(r.deny) == 0
+}
+
+// matchHost reports whether host matches pattern, which may have a leading *. to match any
+// subdomain.
+func matchHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
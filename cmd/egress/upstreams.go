@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// otherUpstream is the name given to destinations that do not match any upstream.
+const otherUpstream = "other"
+
+// An UpstreamMatcher names the shared upstream a destination host belongs to.
+type UpstreamMatcher struct {
+	exact    map[string]string // upstream name for each exact host name
+	suffixes []upstreamSuffix  // upstream name for hosts ending with a suffix, longest first
+}
+
+type upstreamSuffix struct {
+	suffix string // includes the leading dot
+	name   string
+}
+
+// ParseUpstreams parses upstream definitions of the form name:host. A host with a leading *.
+// matches any subdomain. A name may be given more than once to match several hosts.
+func ParseUpstreams(defs []string) (*UpstreamMatcher, error) {
+	m := &UpstreamMatcher{exact: make(map[string]string)}
+	for _, def := range defs {
+		if strings.TrimSpace(def) == "" {
+			// an empty environment variable yields a single empty definition
+			continue
+		}
+		name, host, ok := strings.Cut(def, ":")
+		name = strings.TrimSpace(name)
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || name == "" || host == "" {
+			return nil, fmt.Errorf("invalid upstream %q, expected name:host", def)
+		}
+		if name == otherUpstream {
+			return nil, fmt.Errorf("upstream name %q is reserved for unmatched destinations", otherUpstream)
+		}
+		if strings.HasPrefix(host, "*.") {
+			m.suffixes = append(m.suffixes, upstreamSuffix{suffix: host[1:], name: name})
+			continue
+		}
+		m.exact[host] = name
+	}
+	sort.SliceStable(m.suffixes, func(i, j int) bool { return len(m.suffixes[i].suffix) > len(m.suffixes[j].suffix) })
+	return m, nil
+}
+
+// Match returns the name of the upstream that hostport belongs to, or "other" if there is none.
+func (m *UpstreamMatcher) Match(hostport string) string {
+	host := hostName(hostport)
+	if name, ok := m.exact[host]; ok {
+		return name
+	}
+	for _, s := range m.suffixes {
+		if strings.HasSuffix(host, s.suffix) {
+			return s.name
+		}
+	}
+	return otherUpstream
+}
+
+// Names returns the names of all upstreams, sorted.
+func (m *UpstreamMatcher) Names() []string {
+	seen := make(map[string]bool)
+	for _, name := range m.exact {
+		seen[name] = true
+	}
+	for _, s := range m.suffixes {
+		seen[s.name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hostName returns the lower case host name of hostport without its port or trailing dot.
+func hostName(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
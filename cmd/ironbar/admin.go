@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// ConfigureAdminRoutes adds the admin api, which requires the admin token as a bearer token.
+// The admin api is not available if no admin token is configured.
+func (s *Server) ConfigureAdminRoutes(r *mux.Router) {
+	if s.adminToken == "" {
+		return
+	}
+	ar := r.PathPrefix("/admin").Subrouter()
+	ar.Use(s.requireAdmin)
+	ar.Path("/maintenance").Methods("GET").HandlerFunc(s.GetMaintenanceHandler)
+	ar.Path("/maintenance").Methods("PUT").HandlerFunc(s.SetMaintenanceHandler)
+	ar.Path("/freezes").Methods("GET").HandlerFunc(s.ListFreezeWindowsHandler)
+	ar.Path("/freezes").Methods("POST").HandlerFunc(s.AddFreezeWindowHandler)
+	ar.Path("/freezes/{id}").Methods("DELETE").HandlerFunc(s.DeleteFreezeWindowHandler)
+	ar.Path("/jobs").Methods("GET").HandlerFunc(s.ListJobsHandler)
+	ar.Path("/jobs/{id}").Methods("DELETE").HandlerFunc(s.CancelJobHandler)
+	ar.Path("/pins").Methods("GET").HandlerFunc(s.ListPinsHandler)
+	ar.Path("/pins/{name}").Methods("PUT").HandlerFunc(s.PinExperimentHandler)
+	ar.Path("/pins/{name}").Methods("DELETE").HandlerFunc(s.UnpinExperimentHandler)
+	ar.Path("/reload").Methods("POST").HandlerFunc(s.ReloadConfigHandler)
+}
+
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			s.WriteError(w, http.StatusUnauthorized, api.ErrorCodeUnauthorized, errors.New("admin token required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoadAdminState reads the persisted maintenance mode, freeze windows and pins.
+func (s *Server) LoadAdminState(ctx context.Context) error {
+	st, err := s.db.GetAdminState(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.admin = st
+	s.mu.Unlock()
+	if st.Maintenance.Enabled {
+		slog.Warn("ironbar is in maintenance mode", "reason", st.Maintenance.Reason)
+	}
+	return nil
+}
+
+// ErrUnavailable is returned when an experiment cannot be accepted because ironbar is in
+// maintenance mode or the experiment would overlap a freeze window.
+type ErrUnavailable struct {
+	Reason string
+}
+
+func (e *ErrUnavailable) Error() string {
+	return e.Reason
+}
+
+// checkAvailable returns an ErrUnavailable if an experiment running from start to end may
+// not be accepted. Callers must hold s.mu.
+func (s *Server) checkAvailable(start, end time.Time) error {
+	if s.admin == nil {
+		return nil
+	}
+	if m := s.admin.Maintenance; m.Enabled {
+		reason := "ironbar is in maintenance mode, new experiments are not being accepted"
+		if m.Reason != "" {
+			reason += ": " + m.Reason
+		}
+		return &ErrUnavailable{Reason: reason}
+	}
+	for _, fw := range s.admin.FreezeWindows {
+		if start.Before(fw.End) && end.After(fw.Start) {
+			reason := fmt.Sprintf("experiment would overlap freeze window %s from %s to %s", fw.ID, fw.Start.Format(time.RFC3339), fw.End.Format(time.RFC3339))
+			if fw.Reason != "" {
+				reason += ": " + fw.Reason
+			}
+			return &ErrUnavailable{Reason: reason}
+		}
+	}
+	return nil
+}
+
+func (s *Server) Unavailable(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Info("experiment rejected", "error", err)
+	s.WriteError(w, http.StatusServiceUnavailable, api.ErrorCodeUnavailable, err)
+}
+
+// drainBy shortens every running experiment that is due to end after deadline so that it
+// ends at deadline instead. Callers must hold s.mu.
+func (s *Server) drainBy(ctx context.Context, deadline time.Time) error {
+	for name, mr := range s.managed {
+		if !mr.Deleted.IsZero() || !mr.End.After(deadline) {
+			continue
+		}
+		slog.Info("draining experiment", "experiment", name, "end", deadline)
+		if err := s.db.RecordExperimentEnd(ctx, name, deadline.UnixNano()); err != nil {
+			return fmt.Errorf("record end of experiment %s: %w", name, err)
+		}
+		mr.End = deadline
+	}
+	return nil
+}
+
+// pruneFreezeWindows removes freeze windows that have ended. Callers must hold s.mu.
+func (s *Server) pruneFreezeWindows(now time.Time) {
+	st := *s.admin
+	st.FreezeWindows = nil
+	for _, fw := range s.admin.FreezeWindows {
+		if fw.End.After(now) {
+			st.FreezeWindows = append(st.FreezeWindows, fw)
+		}
+	}
+	s.admin = &st
+}
+
+func (s *Server) GetMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	out := s.admin.Maintenance
+	s.mu.Unlock()
+	s.WriteAsJSON(w, http.StatusOK, &out)
+}
+
+func (s *Server) SetMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	in := new(api.MaintenanceStatus)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+
+	if !in.Enabled {
+		in.Reason = ""
+		in.DrainBy = time.Time{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if in.Enabled {
+		in.Since = s.admin.Maintenance.Since
+		if !s.admin.Maintenance.Enabled {
+			in.Since = time.Now().UTC()
+		}
+	} else {
+		in.Since = time.Time{}
+	}
+
+	if !in.DrainBy.IsZero() {
+		if err := s.drainBy(ctx, in.DrainBy); err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to drain experiments: %w", err))
+			return
+		}
+	}
+
+	st := *s.admin
+	st.Maintenance = *in
+	if err := s.db.PutAdminState(ctx, &st); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to record maintenance mode: %w", err))
+		return
+	}
+	s.admin = &st
+
+	slog.Info("maintenance mode changed", "enabled", in.Enabled, "reason", in.Reason, "drain_by", in.DrainBy)
+	s.WriteAsJSON(w, http.StatusOK, in)
+}
+
+func (s *Server) ListFreezeWindowsHandler(w http.ResponseWriter, r *http.Request) {
+	out := &api.ListFreezeWindowsOutput{
+		Items: []api.FreezeWindow{},
+	}
+	s.mu.Lock()
+	out.Items = append(out.Items, s.admin.FreezeWindows...)
+	s.mu.Unlock()
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) AddFreezeWindowHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	in := new(api.FreezeWindow)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+
+	now := time.Now().UTC()
+	if in.Start.IsZero() || in.End.IsZero() || !in.End.After(in.Start) {
+		s.BadRequest(w, r, fmt.Errorf("freeze window must have a start and an end after the start"))
+		return
+	}
+	if !in.End.After(now) {
+		s.BadRequest(w, r, fmt.Errorf("freeze window has already ended"))
+		return
+	}
+	in.ID = newEventID()[:8]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pruneFreezeWindows(now)
+
+	if in.Drain {
+		deadline := in.Start
+		if deadline.Before(now) {
+			deadline = now
+		}
+		if err := s.drainBy(ctx, deadline); err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to drain experiments: %w", err))
+			return
+		}
+	}
+
+	st := *s.admin
+	st.FreezeWindows = append(append([]api.FreezeWindow{}, s.admin.FreezeWindows...), *in)
+	sort.Slice(st.FreezeWindows, func(i, j int) bool { return st.FreezeWindows[i].Start.Before(st.FreezeWindows[j].Start) })
+	if err := s.db.PutAdminState(ctx, &st); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to record freeze window: %w", err))
+		return
+	}
+	s.admin = &st
+
+	slog.Info("freeze window added", "id", in.ID, "start", in.Start, "end", in.End, "reason", in.Reason)
+	s.WriteAsJSON(w, http.StatusOK, in)
+}
+
+func (s *Server) DeleteFreezeWindowHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := mux.Vars(r)["id"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := *s.admin
+	st.FreezeWindows = nil
+	found := false
+	for _, fw := range s.admin.FreezeWindows {
+		if fw.ID == id {
+			found = true
+			continue
+		}
+		st.FreezeWindows = append(st.FreezeWindows, fw)
+	}
+	if !found {
+		s.NotFoundHandler(w, r)
+		return
+	}
+
+	if err := s.db.PutAdminState(ctx, &st); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to remove freeze window: %w", err))
+		return
+	}
+	s.admin = &st
+
+	slog.Info("freeze window removed", "id", id)
+	s.WriteAsJSON(w, http.StatusOK, &api.ListFreezeWindowsOutput{Items: append([]api.FreezeWindow{}, st.FreezeWindows...)})
+}
+
+func (s *Server) ReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := s.Reload()
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to reload configuration, the previous configuration is still in use: %w", err))
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+var errUnsupportedResource = errors.New("unsupported resource type")
+
+// AdoptResourcesHandler registers existing resources under an experiment so that they are
+// monitored and removed once the experiment ends. It is used to recover resources whose
+// experiment record has been lost. Resources are added to the experiment's existing
+// resources if it is already managed.
+func (s *Server) AdoptResourcesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	name := vars["name"]
+	if len(name) == 0 {
+		s.NotFoundHandler(w, r)
+		return
+	}
+
+	in := new(api.AdoptResourcesInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+
+	if len(in.ARNs) == 0 && len(in.Tags) == 0 {
+		s.BadRequest(w, r, fmt.Errorf("at least one arn or tag must be supplied"))
+		return
+	}
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to create aws session: %w", err))
+		return
+	}
+
+	arns := in.ARNs
+	if len(in.Tags) > 0 {
+		tagged, err := findTaggedResources(ctx, sess, in.Tags)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to find tagged resources: %w", err))
+			return
+		}
+		arns = append(arns, tagged...)
+	}
+
+	out := &api.AdoptResourcesOutput{
+		URL:         "/experiments/" + name,
+		Adopted:     []api.Resource{},
+		Unsupported: []string{},
+	}
+	for _, a := range arns {
+		res, err := resolveResource(ctx, sess, a)
+		if err != nil {
+			if errors.Is(err, errUnsupportedResource) {
+				out.Unsupported = append(out.Unsupported, a)
+				continue
+			}
+			s.BadRequest(w, r, fmt.Errorf("resolve %s: %w", a, err))
+			return
+		}
+		out.Adopted = append(out.Adopted, res)
+	}
+
+	if len(out.Adopted) == 0 {
+		s.BadRequest(w, r, fmt.Errorf("no resources that can be managed were found"))
+		return
+	}
+
+	end := in.End
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var definition string
+	mr, ok := s.managed[name]
+	if ok && mr.Deleted.IsZero() {
+		er, err := s.db.GetExperiment(ctx, name)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to get experiment: %w", err))
+			return
+		}
+		definition = er.Definition
+		if !in.End.IsZero() {
+			mr.End = in.End
+		}
+	} else {
+		mr = &ManagedResources{
+			Name:  name,
+			Start: time.Now().UTC(),
+			End:   end,
+
+			ShutdownTimeouts: shutdownTimeouts(""),
+		}
+	}
+
+	resources := mergeResources(mr.Resources, out.Adopted)
+	resJSON, err := json.Marshal(resources)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to marshal resources: %w", err))
+		return
+	}
+
+	usageJSON, err := json.Marshal(mr.Usage)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to marshal usage: %w", err))
+		return
+	}
+
+	var failuresJSON []byte
+	if len(mr.Failures) > 0 {
+		failuresJSON, err = json.Marshal(mr.Failures)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal failures: %w", err))
+			return
+		}
+	}
+
+	var matchesJSON []byte
+	if len(mr.LogMatches) > 0 {
+		matchesJSON, err = json.Marshal(mr.LogMatches)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal log matches: %w", err))
+			return
+		}
+	}
+
+	var anomaliesJSON []byte
+	if len(mr.Anomalies) > 0 {
+		anomaliesJSON, err = json.Marshal(mr.Anomalies)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal anomalies: %w", err))
+			return
+		}
+	}
+
+	var restartsJSON []byte
+	if len(mr.Restarts) > 0 {
+		restartsJSON, err = json.Marshal(mr.Restarts)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal restarts: %w", err))
+			return
+		}
+	}
+
+	var changesJSON []byte
+	if len(mr.Changes) > 0 {
+		changesJSON, err = json.Marshal(mr.Changes)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal config changes: %w", err))
+			return
+		}
+	}
+
+	var slowestJSON []byte
+	if len(mr.Slowest) > 0 {
+		slowestJSON, err = json.Marshal(slowestRecord{Latest: mr.Slowest, Overall: mr.SlowestOverall})
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal slowest requests: %w", err))
+			return
+		}
+	}
+
+	var placementsJSON []byte
+	if len(mr.Placements) > 0 {
+		placementsJSON, err = json.Marshal(mr.Placements)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to marshal placements: %w", err))
+			return
+		}
+	}
+
+	rec := &ExperimentRecord{
+		Name:       name,
+		Start:      mr.Start.UnixNano(),
+		End:        mr.End.UnixNano(),
+		Definition: definition,
+		Resources:  string(resJSON),
+		Usage:      string(usageJSON),
+		Failures:   string(failuresJSON),
+		LogMatches: string(matchesJSON),
+		Anomalies:  string(anomaliesJSON),
+		Restarts:   string(restartsJSON),
+		Changes:    string(changesJSON),
+		Slowest:    string(slowestJSON),
+		Placements: string(placementsJSON),
+	}
+	if err := s.db.RecordExperimentStart(ctx, rec); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to record adopted resources: %w", err))
+		return
+	}
+
+	mr.Resources = resources
+	s.managed[name] = mr
+	slog.Info("adopted resources", "experiment", name, "adopted", len(out.Adopted), "unsupported", len(out.Unsupported))
+
+	out.Message = fmt.Sprintf("Adopted %d resources", len(out.Adopted))
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+// findTaggedResources returns the arns of all resources that have every one of the tags.
+func findTaggedResources(ctx context.Context, sess *session.Session, tags map[string]string) ([]string, error) {
+	in := &resourcegroupstaggingapi.GetResourcesInput{}
+	for k, v := range tags {
+		in.TagFilters = append(in.TagFilters, &resourcegroupstaggingapi.TagFilter{
+			Key:    aws.String(k),
+			Values: []*string{aws.String(v)},
+		})
+	}
+
+	var arns []string
+	err := resourcegroupstaggingapi.New(sess).GetResourcesPagesWithContext(ctx, in, func(out *resourcegroupstaggingapi.GetResourcesOutput, last bool) bool {
+		for _, m := range out.ResourceTagMappingList {
+			if m.ResourceARN != nil {
+				arns = append(arns, *m.ResourceARN)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get resources: %w", err)
+	}
+	return arns, nil
+}
+
+// resolveResource converts an arn into a resource that ironbar can manage, looking up any
+// additional keys needed to remove it. It returns errUnsupportedResource for arns of
+// resources that ironbar does not know how to remove.
+func resolveResource(ctx context.Context, sess *session.Session, s string) (api.Resource, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return api.Resource{}, fmt.Errorf("parse arn: %w", err)
+	}
+
+	switch a.Service {
+	case "ecs":
+		parts := strings.Split(a.Resource, "/")
+		switch {
+		case parts[0] == "task" && len(parts) == 3:
+			clusterArn := arn.ARN{
+				Partition: a.Partition,
+				Service:   a.Service,
+				Region:    a.Region,
+				AccountID: a.AccountID,
+				Resource:  "cluster/" + parts[1],
+			}
+			return api.Resource{
+				Type: api.ResourceTypeEcsTask,
+				Keys: map[string]string{
+					api.ResourceKeyEcsClusterArn: clusterArn.String(),
+					api.ResourceKeyArn:           s,
+				},
+			}, nil
+		case parts[0] == "task":
+			return api.Resource{}, fmt.Errorf("task arn does not include the cluster name, use the long arn format")
+		case parts[0] == "task-definition" && len(parts) == 2:
+			return api.Resource{
+				Type: api.ResourceTypeEcsTaskDefinition,
+				Keys: map[string]string{
+					api.ResourceKeyArn: s,
+				},
+			}, nil
+		}
+
+	case "sns":
+		// subscription arns have the form arn:aws:sns:region:account:topic:subscription-id
+		if strings.Count(a.Resource, ":") == 1 {
+			return api.Resource{
+				Type: api.ResourceTypeEcsSnsSubscription,
+				Keys: map[string]string{
+					api.ResourceKeyArn: s,
+				},
+			}, nil
+		}
+
+	case "sqs":
+		out, err := sqs.New(sess).GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+			QueueName:              aws.String(a.Resource),
+			QueueOwnerAWSAccountId: aws.String(a.AccountID),
+		})
+		if err != nil {
+			return api.Resource{}, fmt.Errorf("get queue url: %w", err)
+		}
+		return api.Resource{
+			Type: api.ResourceTypeSqsQueue,
+			Keys: map[string]string{
+				api.ResourceKeyArn:      s,
+				api.ResourceKeyQueueURL: aws.StringValue(out.QueueUrl),
+			},
+		}, nil
+
+	case "dynamodb":
+		parts := strings.Split(a.Resource, "/")
+		if parts[0] == "table" && len(parts) == 2 {
+			return api.Resource{
+				Type: api.ResourceTypeDynamoDBTable,
+				Keys: map[string]string{
+					api.ResourceKeyTableName: parts[1],
+				},
+			}, nil
+		}
+
+	case "ec2":
+		parts := strings.Split(a.Resource, "/")
+		if parts[0] == "instance" && len(parts) == 2 {
+			return api.Resource{
+				Type: api.ResourceTypeEc2Instance,
+				Keys: map[string]string{
+					api.ResourceKeyEc2InstanceID: parts[1],
+				},
+			}, nil
+		}
+		if parts[0] == "placement-group" && len(parts) == 2 {
+			return api.Resource{
+				Type: api.ResourceTypeEc2PlacementGroup,
+				Keys: map[string]string{
+					api.ResourceKeyGroupName: parts[1],
+				},
+			}, nil
+		}
+	}
+
+	return api.Resource{}, errUnsupportedResource
+}
+
+// mergeResources appends the adopted resources to the existing ones, skipping any that are
+// already present.
+func mergeResources(existing, adopted []api.Resource) []api.Resource {
+	seen := make(map[string]bool)
+	merged := make([]api.Resource, 0, len(existing)+len(adopted))
+	for _, rs := range [][]api.Resource{existing, adopted} {
+		for _, res := range rs {
+			id := resourceID(res)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			merged = append(merged, res)
+		}
+	}
+	return merged
+}
+
+// resourceID returns a string that uniquely identifies a resource by its type and keys.
+func resourceID(res api.Resource) string {
+	keys := make([]string, 0, len(res.Keys))
+	for k, v := range res.Keys {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return res.Type + ":" + strings.Join(keys, ",")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// defaultAnalysisTimeout is how long an analysis may run for if its resource does not say.
+const defaultAnalysisTimeout = 30 * time.Minute
+
+// analysisPollInterval is how often a running analysis task is checked.
+const analysisPollInterval = 15 * time.Second
+
+// hasAnalyses reports whether any analyses were registered with the experiment.
+func hasAnalyses(mr *ManagedResources) bool {
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeAnalysis {
+			return true
+		}
+	}
+	return false
+}
+
+// RunAnalyses runs the analyses registered with a completed experiment in parallel, records
+// their outcomes and returns them together with the experiment's conformance reports. It may take as long as the longest analysis timeout so
+// should be called in its own goroutine.
+func (s *Server) RunAnalyses(ctx context.Context, mr ManagedResources) []api.Analysis {
+	logger := slog.With("experiment", mr.Name)
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		logger.Error("failed to create aws session", err)
+		return nil
+	}
+
+	var resources []api.Resource
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeAnalysis {
+			resources = append(resources, res)
+		}
+	}
+
+	analyses := make([]api.Analysis, len(resources))
+	var wg sync.WaitGroup
+	for i := range resources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			analyses[i] = s.runAnalysis(ctx, sess, logger, mr, resources[i])
+		}(i)
+	}
+	wg.Wait()
+
+	merged, err := s.db.MergeAnalyses(ctx, mr.Name, analyses)
+	if err != nil {
+		logger.Error("failed to record analyses", err)
+		return analyses
+	}
+	return merged
+}
+
+// runAnalysis registers an analysis task definition, runs it to completion and reads its output
+// from the task's log stream. The task definition is deregistered afterwards.
+func (s *Server) runAnalysis(ctx context.Context, sess *session.Session, logger *slog.Logger, mr ManagedResources, res api.Resource) api.Analysis {
+	an := api.Analysis{
+		Name:   res.Keys[api.ResourceKeyComponent],
+		Start:  time.Now().UTC(),
+		Status: api.AnalysisStatusFailed,
+	}
+	logger = logger.With("analysis", an.Name)
+	fail := func(err error) api.Analysis {
+		logger.Error("analysis failed", err)
+		an.End = time.Now().UTC()
+		an.Reason = err.Error()
+		return an
+	}
+
+	tdIn := new(ecs.RegisterTaskDefinitionInput)
+	if err := json.Unmarshal([]byte(res.Keys[api.ResourceKeyTaskDefinitionInput]), tdIn); err != nil {
+		return fail(fmt.Errorf("decode task definition input: %w", err))
+	}
+	if len(tdIn.ContainerDefinitions) != 1 {
+		return fail(fmt.Errorf("analysis task definition must have exactly one container"))
+	}
+	container := tdIn.ContainerDefinitions[0]
+
+	runIn := new(ecs.RunTaskInput)
+	if err := json.Unmarshal([]byte(res.Keys[api.ResourceKeyRunTaskInput]), runIn); err != nil {
+		return fail(fmt.Errorf("decode run task input: %w", err))
+	}
+
+	timeout := defaultAnalysisTimeout
+	if v := res.Keys[api.ResourceKeyTimeout]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fail(fmt.Errorf("invalid timeout: %w", err))
+		}
+		timeout = d
+	}
+
+	tdArn, err := registerEcsTaskDefinition(ctx, sess, tdIn)
+	if err != nil {
+		return fail(err)
+	}
+	defer func() {
+		if err := deregisterEcsTaskDefinition(ctx, sess, tdArn); err != nil {
+			logger.Error("failed to deregister analysis task definition", err, "arn", tdArn)
+		}
+	}()
+
+	env := map[string]string{
+		"THUNDERDOME_EXPERIMENT_START": mr.Start.Format(time.RFC3339),
+		"THUNDERDOME_EXPERIMENT_END":   mr.End.Format(time.RFC3339),
+	}
+	if s.results != nil {
+		env["THUNDERDOME_PROMETHEUS_QUERY_URL"] = s.results.URL
+	}
+	override := &ecs.ContainerOverride{Name: container.Name}
+	for k, v := range env {
+		override.Environment = append(override.Environment, &ecs.KeyValuePair{Name: aws.String(k), Value: aws.String(v)})
+	}
+	runIn.TaskDefinition = aws.String(tdArn)
+	runIn.Overrides = &ecs.TaskOverride{ContainerOverrides: []*ecs.ContainerOverride{override}}
+
+	clusterArn := aws.StringValue(runIn.Cluster)
+	an.TaskArn, err = runEcsTask(ctx, sess, runIn)
+	if err != nil {
+		return fail(err)
+	}
+	logger.Info("started analysis", "arn", an.TaskArn, "timeout", timeout)
+
+	task, err := waitForTaskStopped(ctx, sess, clusterArn, an.TaskArn, timeout)
+	if err != nil {
+		return fail(err)
+	}
+	if task == nil {
+		logger.Warn("analysis timed out, stopping it", "arn", an.TaskArn)
+		if err := stopEcsTask(ctx, sess, clusterArn, an.TaskArn); err != nil {
+			logger.Error("failed to stop analysis task", err, "arn", an.TaskArn)
+		}
+		an.End = time.Now().UTC()
+		an.Status = api.AnalysisStatusTimedOut
+		an.Reason = fmt.Sprintf("analysis did not complete within %s", timeout)
+		return an
+	}
+
+	for _, c := range task.Containers {
+		if aws.StringValue(c.Name) != aws.StringValue(container.Name) {
+			continue
+		}
+		if c.ExitCode == nil {
+			return fail(fmt.Errorf("analysis did not run: %s", aws.StringValue(task.StoppedReason)))
+		}
+		if code := aws.Int64Value(c.ExitCode); code != 0 {
+			return fail(fmt.Errorf("analysis exited with code %d", code))
+		}
+	}
+
+	if container.LogConfiguration == nil || aws.StringValue(container.LogConfiguration.LogDriver) != "awslogs" {
+		return fail(fmt.Errorf("analysis container must log to cloudwatch to return output"))
+	}
+	opts := container.LogConfiguration.Options
+	stream := path.Join(aws.StringValue(opts["awslogs-stream-prefix"]), aws.StringValue(container.Name), path.Base(an.TaskArn))
+	lines, err := readLogEvents(ctx, sess, aws.StringValue(opts["awslogs-group"]), stream)
+	if err != nil {
+		return fail(fmt.Errorf("read analysis output: %w", err))
+	}
+	an.Output = lastJSONLine(lines)
+	if an.Output == nil {
+		return fail(fmt.Errorf("analysis wrote no json output"))
+	}
+
+	an.End = time.Now().UTC()
+	an.Status = api.AnalysisStatusSucceeded
+	logger.Info("analysis succeeded", "arn", an.TaskArn)
+	return an
+}
+
+// waitForTaskStopped polls a task until it has stopped and returns it, or returns nil if the
+// task is still running after timeout.
+func waitForTaskStopped(ctx context.Context, sess *session.Session, clusterArn, taskArn string, timeout time.Duration) (*ecs.Task, error) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(analysisPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, nil
+		case <-ticker.C:
+		}
+
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			slog.Error("failed to describe analysis task", err, "arn", taskArn)
+			continue
+		}
+		if task == nil {
+			return nil, fmt.Errorf("analysis task not found")
+		}
+		if aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped {
+			return task, nil
+		}
+	}
+}
+
+// lastJSONLine returns the last line that holds a JSON object or array, or nil if there is none.
+func lastJSONLine(lines []string) json.RawMessage {
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := bytes.TrimSpace([]byte(lines[i]))
+		if len(line) == 0 || (line[0] != '{' && line[0] != '[') {
+			continue
+		}
+		if json.Valid(line) {
+			return json.RawMessage(line)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ListAnalysesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	analyses, err := s.db.GetAnalyses(ctx, name)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to read analyses: %w", err))
+		return
+	}
+	if analyses == nil {
+		s.NotFound(w, r, fmt.Errorf("no analyses have been recorded for experiment %s", name))
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, &api.ListAnalysesOutput{Items: analyses})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// maxAnnotationLength is the longest annotation text accepted.
+const maxAnnotationLength = 4096
+
+// A GrafanaClient copies experiment annotations to Grafana's annotations api so they are
+// rendered on dashboards. Annotations are tagged with thunderdome and experiment:<name> so a
+// dashboard can show those of the experiment it is displaying.
+type GrafanaClient struct {
+	URL   string // base url of the grafana instance, for example https://protocollabs.grafana.net
+	Token string // service account token with permission to write annotations
+
+	client *http.Client
+}
+
+func NewGrafanaClient(baseURL, token string) *GrafanaClient {
+	return &GrafanaClient{
+		URL:    strings.TrimSuffix(baseURL, "/"),
+		Token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// AddAnnotation creates a grafana annotation for an experiment annotation.
+func (c *GrafanaClient) AddAnnotation(ctx context.Context, experiment string, a api.Annotation) error {
+	text := a.Text
+	if a.Author != "" {
+		text += " (" + a.Author + ")"
+	}
+	body, err := json.Marshal(map[string]any{
+		"time": a.Time.UnixMilli(),
+		"tags": []string{"thunderdome", "experiment:" + experiment},
+		"text": text,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal annotation: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post annotation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("post annotation: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// DeleteAnnotations removes the grafana annotations of an experiment.
+func (c *GrafanaClient) DeleteAnnotations(ctx context.Context, experiment string) error {
+	q := url.Values{}
+	q.Add("tags", "thunderdome")
+	q.Add("tags", "experiment:"+experiment)
+	q.Set("type", "annotation")
+	q.Set("limit", "1000")
+
+	var found []struct {
+		ID int64 `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/annotations?"+q.Encode(), &found); err != nil {
+		return fmt.Errorf("find annotations: %w", err)
+	}
+	for _, a := range found {
+		if err := c.do(ctx, http.MethodDelete, "/api/annotations/"+strconv.FormatInt(a.ID, 10), nil); err != nil {
+			return fmt.Errorf("delete annotation %d: %w", a.ID, err)
+		}
+	}
+	return nil
+}
+
+// do sends a request without a body to the grafana api and decodes the response into out, if
+// it is not nil.
+func (c *GrafanaClient) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// AddAnnotationHandler attaches an annotation to a running or recently stopped experiment.
+func (s *Server) AddAnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	in := new(api.AddAnnotationInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+	in.Text = strings.TrimSpace(in.Text)
+	if in.Text == "" {
+		s.BadRequest(w, r, fmt.Errorf("annotation text must be supplied"))
+		return
+	}
+	if len(in.Text) > maxAnnotationLength {
+		s.BadRequest(w, r, fmt.Errorf("annotation text must be no longer than %d bytes", maxAnnotationLength))
+		return
+	}
+
+	s.mu.Lock()
+	_, ok := s.managed[name]
+	s.mu.Unlock()
+	if !ok {
+		s.NotFound(w, r, fmt.Errorf("experiment %s is not running or recently stopped", name))
+		return
+	}
+
+	a := api.Annotation{
+		Time:   in.Time.UTC(),
+		Author: in.Author,
+		Text:   in.Text,
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now().UTC()
+	}
+
+	if err := s.addAnnotation(ctx, name, a); err != nil {
+		s.ServerError(w, r, err)
+		return
+	}
+
+	s.WriteAsJSON(w, http.StatusOK, &a)
+}
+
+// addAnnotation records an annotation of an experiment and copies it to grafana.
+func (s *Server) addAnnotation(ctx context.Context, name string, a api.Annotation) error {
+	// annotations are read and rewritten as a whole so concurrent additions must be serialised
+	s.annotationsMu.Lock()
+	defer s.annotationsMu.Unlock()
+
+	annotations, err := s.db.GetAnnotations(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read annotations: %w", err)
+	}
+	annotations = append(annotations, a)
+	if err := s.db.PutAnnotations(ctx, name, annotations); err != nil {
+		return fmt.Errorf("failed to record annotation: %w", err)
+	}
+
+	if s.grafana != nil {
+		if err := s.grafana.AddAnnotation(ctx, name, a); err != nil {
+			slog.Error("failed to add grafana annotation", err, "experiment", name)
+		}
+	}
+	return nil
+}
+
+// ListAnnotationsHandler lists the annotations attached to an experiment, oldest first.
+func (s *Server) ListAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	annotations, err := s.db.GetAnnotations(ctx, name)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to read annotations: %w", err))
+		return
+	}
+	if annotations == nil {
+		s.mu.Lock()
+		_, ok := s.managed[name]
+		s.mu.Unlock()
+		if !ok {
+			s.NotFound(w, r, fmt.Errorf("no annotations have been recorded for experiment %s", name))
+			return
+		}
+		annotations = []api.Annotation{}
+	}
+	s.WriteAsJSON(w, http.StatusOK, &api.ListAnnotationsOutput{Items: annotations})
+}
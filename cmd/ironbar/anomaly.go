@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/prom"
+)
+
+const (
+	// anomalyWarmup is the number of samples of each target used to learn its usual error
+	// ratio and latency before shifts are flagged.
+	anomalyWarmup = 10
+
+	// anomalyAlpha is the weight of each new sample in the moving mean and variance once the
+	// baseline has warmed up, so the baseline follows slow drift while sudden shifts stand out.
+	anomalyAlpha = 0.1
+
+	// anomalyMinWindow is the shortest window that rates and latencies are read over, since
+	// dealgood's metrics are scraped about once a minute.
+	anomalyMinWindow = time.Minute
+
+	// maxAnomalies limits the anomalies kept for an experiment so its record stays small.
+	maxAnomalies = 50
+)
+
+// An anomalyMetric is a measure of each target that is watched for sudden shifts.
+type anomalyMetric struct {
+	name  string
+	query string                     // formatted with the experiment selector and the window
+	floor func(mean float64) float64 // smallest shift flagged, so a target that is flat does not flag noise
+}
+
+var anomalyMetrics = []anomalyMetric{
+	{
+		name:  api.AnomalyMetricErrorRatio,
+		query: "sum by (target) (increase(thunderdome_dealgood_errors_total%[1]s%[2]s)) / sum by (target) (increase(thunderdome_dealgood_requests_total%[1]s%[2]s))",
+		floor: func(float64) float64 { return 0.01 },
+	},
+	{
+		name:  api.AnomalyMetricTTFBP99,
+		query: "histogram_quantile(0.99, sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket%[1]s%[2]s)))",
+		floor: func(mean float64) float64 { return 0.1 * mean },
+	},
+}
+
+// An anomalyBaseline is the exponentially weighted mean and variance of one metric of a target.
+type anomalyBaseline struct {
+	samples  int
+	mean     float64
+	variance float64
+	flagged  bool // the latest sample was anomalous, so a shift that persists is flagged once
+}
+
+// observe compares x with the baseline, returning the deviation of x from the mean and the
+// smallest deviation that is anomalous, then adds x to the baseline. The threshold is zero
+// while the baseline is warming up.
+func (b *anomalyBaseline) observe(x, sigma float64, floor func(float64) float64) (deviation, threshold float64) {
+	deviation = x - b.mean
+	if b.samples >= anomalyWarmup {
+		threshold = math.Max(sigma*math.Sqrt(b.variance), floor(b.mean))
+	}
+
+	// a plain average while warming up, then a moving one
+	alpha := math.Max(anomalyAlpha, 1/float64(b.samples+1))
+	incr := alpha * deviation
+	b.mean += incr
+	b.variance = (1 - alpha) * (b.variance + deviation*incr)
+	b.samples++
+	return deviation, threshold
+}
+
+// An AnomalyDetector watches the error ratio and latency of each target of a running experiment
+// for sudden shifts, learning each target's baseline from the checks of the experiment so far.
+type AnomalyDetector struct {
+	results        *ResultsClient
+	anomalyCounter *prom.CounterVec
+
+	mu        sync.Mutex                  // guards baselines since experiments are checked concurrently
+	baselines map[string]*anomalyBaseline // keyed by experiment, target and metric
+}
+
+func NewAnomalyDetector(results *ResultsClient) (*AnomalyDetector, error) {
+	d := &AnomalyDetector{
+		results:   results,
+		baselines: make(map[string]*anomalyBaseline),
+	}
+
+	var err error
+	d.anomalyCounter, err = prom.NewPrometheusCounterVec(
+		appName,
+		"target_anomalies_total",
+		"The total number of sudden shifts in a target's error ratio or latency flagged while an experiment was running.",
+		map[string]string{},
+		"experiment", "target", "metric",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return d, nil
+}
+
+// Check reads each target's error ratio and p99 time to first byte over the latest window and
+// compares them with the target's baseline, appending those more than sigma standard deviations
+// from it to mr.Anomalies. It returns the anomalies found. A shift is flagged once, when it
+// starts, rather than at every check it lasts. mr should be a copy of the managed experiment
+// since s.mu is not held while the metrics are read.
+func (d *AnomalyDetector) Check(ctx context.Context, logger *slog.Logger, mr *ManagedResources, sigma float64, window time.Duration) []api.Anomaly {
+	if window < anomalyMinWindow {
+		window = anomalyMinWindow
+	}
+	sel := fmt.Sprintf("{experiment=%q}", mr.Name)
+	win := fmt.Sprintf("[%ds]", int64(math.Ceil(window.Seconds())))
+	now := time.Now().UTC()
+
+	var found []api.Anomaly
+	for _, m := range anomalyMetrics {
+		values, err := d.results.queryByTarget(ctx, fmt.Sprintf(m.query, sel, win), now)
+		if err != nil {
+			logger.Error("failed to read metric for anomaly detection", err, "metric", m.name)
+			continue
+		}
+
+		d.mu.Lock()
+		for target, v := range values {
+			key := anomalyKey(mr.Name, target, m.name)
+			b, ok := d.baselines[key]
+			if !ok {
+				b = new(anomalyBaseline)
+				d.baselines[key] = b
+			}
+			mean, stddev := b.mean, math.Sqrt(b.variance)
+			deviation, threshold := b.observe(v, sigma, m.floor)
+			anomalous := threshold > 0 && math.Abs(deviation) > threshold
+			if anomalous && !b.flagged {
+				a := api.Anomaly{
+					Time:   now,
+					Target: target,
+					Metric: m.name,
+					Value:  v,
+					Mean:   mean,
+					StdDev: stddev,
+				}
+				if stddev > 0 {
+					a.Sigma = deviation / stddev
+				}
+				found = append(found, a)
+				d.anomalyCounter.WithLabelValues(mr.Name, target, m.name).Add(1)
+				logger.Warn("target shifted suddenly", "target", target, "metric", m.name, "value", v, "mean", mean, "stddev", stddev)
+			}
+			b.flagged = anomalous
+		}
+		d.mu.Unlock()
+	}
+
+	for _, a := range found {
+		if len(mr.Anomalies) >= maxAnomalies {
+			break
+		}
+		mr.Anomalies = append(mr.Anomalies, a)
+	}
+	return found
+}
+
+// Forget discards the baselines of an experiment once it has completed.
+func (d *AnomalyDetector) Forget(mr *ManagedResources) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefix := mr.Name + "\x00"
+	for key := range d.baselines {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.baselines, key)
+		}
+	}
+}
+
+func anomalyKey(experiment, target, metric string) string {
+	return experiment + "\x00" + target + "\x00" + metric
+}
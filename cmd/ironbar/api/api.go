@@ -1,6 +1,7 @@
 package api
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -10,6 +11,10 @@ const (
 	ResourceTypeEcsSnsSubscription = "sns_subscription"
 	ResourceTypeSqsQueue           = "sqs_queue"
 	ResourceTypeEc2Instance        = "ec2_instance"
+	ResourceTypeEc2PlacementGroup  = "ec2_placement_group"
+	ResourceTypeDynamoDBTable      = "dynamodb_table"
+	ResourceTypeAnalysis           = "analysis"    // an analysis task run by ironbar once the experiment completes
+	ResourceTypeConformance        = "conformance" // a gateway conformance task run by ironbar against a target while the experiment is running
 )
 
 const (
@@ -17,6 +22,79 @@ const (
 	ResourceKeyEcsClusterArn = "ecs_cluster_arn"
 	ResourceKeyQueueURL      = "queue_url"
 	ResourceKeyEc2InstanceID = "ecs_instance_id"
+	ResourceKeyTableName     = "table_name"
+	ResourceKeyGroupName     = "group_name"     // name of an ec2 placement group
+	ResourceKeyDedicated     = "dedicated"      // "true" when an ec2 instance was launched for a single target and is terminated with the experiment
+	ResourceKeyComponent     = "component"      // name of the experiment component that owns an ecs task
+	ResourceKeyRunTaskInput  = "run_task_input" // json encoded ecs RunTaskInput used to retry an ecs task
+	ResourceKeyDebugPort     = "debug_port"     // port on which an ecs task serves pprof profiles under /debug/pprof
+	ResourceKeyAdminPort     = "admin_port"     // port on which a target's ecs task serves its admin api, such as kubo's rpc api
+
+	ResourceKeyTaskDefinitionInput = "task_definition_input" // json encoded ecs RegisterTaskDefinitionInput for an analysis
+	ResourceKeyTimeout             = "timeout"               // maximum time an analysis may run for, as a Go duration
+	ResourceKeyPhase               = "phase"                 // phase of the experiment in which a conformance task is run, one of the ConformancePhase constants
+)
+
+// Phases of an experiment in which ironbar runs conformance tasks.
+const (
+	ConformancePhasePre  = "pre"  // once all of the experiment's tasks are running
+	ConformancePhasePost = "post" // once the experiment is due to end, before it is torn down
+)
+
+// Causes of experiment failures. Spot interruptions, image pull failures and AWS throttling
+// are transient and may be retried, a crash of the target or dealgood is not.
+const (
+	FailureCauseSpotInterruption = "spot_interruption"
+	FailureCauseImagePull        = "image_pull"
+	FailureCauseThrottling       = "aws_throttling"
+	FailureCauseCrash            = "crash"
+	FailureCauseUnknown          = "unknown"
+)
+
+// A Failure records an ecs task belonging to an experiment that stopped before the experiment
+// ended.
+type Failure struct {
+	Time      time.Time `json:"time"`
+	Component string    `json:"component,omitempty"`
+	TaskArn   string    `json:"task_arn"`
+	Cause     string    `json:"cause"`
+	Reason    string    `json:"reason,omitempty"` // the reason given by ecs for stopping the task
+	Retried   bool      `json:"retried"`
+	RetryArn  string    `json:"retry_arn,omitempty"` // the task started in its place if it was retried
+	Dumps     []string  `json:"dumps,omitempty"`     // s3 urls of the last profiles captured from the task before it crashed
+}
+
+// APIVersion is the version of the api described by this package. It is increased when a
+// change means clients and servers built with earlier versions can no longer work together,
+// at which point MinAPIVersion is raised to the oldest version that still can. Additions that
+// older clients and servers can ignore are announced as features instead.
+const (
+	APIVersion    = 1
+	MinAPIVersion = 1
+)
+
+// Features an ironbar may support, reported by its version endpoint so that clients can tell
+// whether it would ignore parts of an experiment's definition.
+const (
+	FeatureKmsKey         = "kms_key"         // encrypts an experiment's queues and tables with the definition's kms_key_arn
+	FeatureNoiseBaseline  = "noise_baseline"  // records noise estimates from definitions with noise_baseline set
+	FeatureSoak           = "soak"            // measures the latency drift of definitions with a soak section
+	FeatureShutdownStages = "shutdown_stages" // shuts experiments down in stages using the definition's shutdown timeouts
+)
+
+// VersionOutput describes the version of a running ironbar and what it supports.
+type VersionOutput struct {
+	Version       string   `json:"version"`         // version of the ironbar binary
+	APIVersion    int      `json:"api_version"`     // version of the api it serves
+	MinAPIVersion int      `json:"min_api_version"` // oldest api version of a client it works with
+	Features      []string `json:"features"`        // one or more of the Feature constants
+}
+
+// Priorities of experiments, in increasing order of urgency.
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityUrgent = "urgent"
 )
 
 type NewExperimentInput struct {
@@ -25,6 +103,39 @@ type NewExperimentInput struct {
 	End        time.Time  `json:"end"`
 	Definition string     `json:"definition"`
 	Resources  []Resource `json:"resources"`
+	Usage      Usage      `json:"usage"`
+}
+
+// Usage describes who submitted an experiment, why, and the resources it uses, which are
+// counted against their quotas.
+type Usage struct {
+	Owner       string            `json:"owner,omitempty"`
+	Team        string            `json:"team,omitempty"`
+	Purpose     string            `json:"purpose,omitempty"` // why the experiment is being run
+	Ticket      string            `json:"ticket,omitempty"`  // issue or pull request the experiment is for
+	Labels      map[string]string `json:"labels,omitempty"`  // for finding related experiments in listings
+	VCPUs       int               `json:"vcpus,omitempty"`
+	CostPerHour float64           `json:"cost_per_hour,omitempty"` // in US dollars
+	Priority    string            `json:"priority,omitempty"`      // one of the Priority constants, normal if empty
+	Preemptible bool              `json:"preemptible,omitempty"`   // may be stopped early to admit an experiment of higher priority
+	Cluster     string            `json:"cluster,omitempty"`       // ecs cluster the targets run in, the default cluster if empty
+}
+
+// CheckQuotaInput asks whether an experiment would be accepted without exceeding any quota.
+// Clusters lists the clusters the experiment could be placed in, in order of preference, of
+// which ironbar chooses the one with the most room.
+type CheckQuotaInput struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Usage    Usage     `json:"usage"`
+	Clusters []string  `json:"clusters,omitempty"`
+}
+
+type CheckQuotaOutput struct {
+	Message  string   `json:"message"`
+	Preempts []string `json:"preempts,omitempty"` // names of running experiments that would be stopped to admit the experiment
+	Cluster  string   `json:"cluster,omitempty"`  // cluster chosen from those offered, empty if none were offered
 }
 
 type Resource struct {
@@ -38,26 +149,129 @@ type NewExperimentOutput struct {
 	StatusURL string `json:"status_url"`
 }
 
+// Statuses of experiments in experiment listings.
+const (
+	ListStatusRunning  = "running"
+	ListStatusStopping = "stopping" // past its end time, its resources are being removed
+	ListStatusStopped  = "stopped"
+)
+
+// ListExperimentsInput filters, sorts and pages the experiments listed by ironbar. It is sent
+// as url query parameters. The zero value lists the running and recently stopped experiments,
+// most recently started first.
+type ListExperimentsInput struct {
+	Status    string            // one of the ListStatus constants, any status if empty
+	Owner     string            // only experiments submitted by this owner
+	Team      string            // only experiments submitted by this team
+	Labels    map[string]string // only experiments with all of these labels
+	MinAge    time.Duration     // only experiments started at least this long ago
+	MaxAge    time.Duration     // only experiments started at most this long ago
+	Sort      string            // one of name, start or end, prefixed with - for descending order. Defaults to -start.
+	Limit     int               // maximum number of experiments returned, ironbar's default if zero
+	PageToken string            // NextPageToken of the previous page
+	All       bool              // include completed experiments from ironbar's history
+}
+
 type ListExperimentsOutput struct {
-	Items []ListExperimentsItem `json:"items"`
+	Items         []ListExperimentsItem `json:"items"`
+	NextPageToken string                `json:"next_page_token,omitempty"` // empty if this is the last page
 }
 
 type ListExperimentsItem struct {
-	Name    string    `json:"name"`
-	Start   time.Time `json:"start"`
-	End     time.Time `json:"end"`
-	Stopped time.Time `json:"stopped"`
+	Name    string            `json:"name"`
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	Stopped time.Time         `json:"stopped"`
+	Status  string            `json:"status"` // one of the ListStatus constants
+	Owner   string            `json:"owner,omitempty"`
+	Team    string            `json:"team,omitempty"`
+	Purpose string            `json:"purpose,omitempty"`
+	Ticket  string            `json:"ticket,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Pinned  bool              `json:"pinned,omitempty"` // exempt from ironbar's retention policy
 }
 
 type ExperimentStatusOutput struct {
-	Start   time.Time `json:"start"`
-	End     time.Time `json:"end"`
-	Stopped time.Time `json:"stopped"`
-	Status  string    `json:"status"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Stopped  time.Time `json:"stopped"`
+	Status   string    `json:"status"`
+	Owner    string    `json:"owner,omitempty"`
+	Team     string    `json:"team,omitempty"`
+	Purpose  string    `json:"purpose,omitempty"`
+	Ticket   string    `json:"ticket,omitempty"`
+	Cluster  string    `json:"cluster,omitempty"` // ecs cluster the targets run in, the default cluster if empty
+	Failures []Failure `json:"failures,omitempty"`
+
+	LogMatches []LogMatches       `json:"log_matches,omitempty"`
+	Anomalies  []Anomaly          `json:"anomalies,omitempty"`
+	Restarts   []TargetRestart    `json:"restarts,omitempty"`
+	Changes    []ConfigChange     `json:"config_changes,omitempty"`
+	Deadlines  []DeadlineExceeded `json:"deadlines_exceeded,omitempty"`
+	Shutdown   []ShutdownStage    `json:"shutdown,omitempty"` // stages of the shutdown that have started, empty until the experiment is due to end
+
+	// Slowest are the slowest requests sent to each target in the most recent window reported
+	// by dealgood and SlowestOverall the slowest since the experiment started.
+	Slowest        []SlowestRequests `json:"slowest_requests,omitempty"`
+	SlowestOverall []SlowestRequests `json:"slowest_requests_overall,omitempty"`
+
+	Placements []TaskPlacement `json:"placements,omitempty"` // empty until all of the experiment's tasks are running
+
+	// Asymmetries are the differences between the placement of the targets found so far. The
+	// network baseline is only compared once the experiment has completed.
+	Asymmetries []Asymmetry `json:"asymmetries,omitempty"`
+}
+
+// A TaskPlacement records where one of an experiment's tasks ran and the image it ran, as
+// described by ironbar once all of the experiment's tasks were running.
+type TaskPlacement struct {
+	Component        string `json:"component"`
+	TaskArn          string `json:"task_arn"`
+	AvailabilityZone string `json:"availability_zone,omitempty"`
+	InstanceID       string `json:"instance_id,omitempty"`   // empty for tasks that do not run on an ec2 instance
+	InstanceType     string `json:"instance_type,omitempty"` // empty for tasks that do not run on an ec2 instance
+	Image            string `json:"image,omitempty"`         // image of the gateway or dealgood container
+	ImageDigest      string `json:"image_digest,omitempty"`  // digest of the image the container ran
+	ImageBase        string `json:"image_base,omitempty"`    // image the image was built from, if recorded in its labels
+}
+
+// Kinds of asymmetry between the targets of an experiment.
+const (
+	AsymmetryAvailabilityZone  = "availability_zone"
+	AsymmetryInstanceType      = "instance_type"
+	AsymmetryHost              = "host"
+	AsymmetryImageBase         = "image_base"
+	AsymmetryNetworkRTT        = "network_rtt"
+	AsymmetryNetworkThroughput = "network_throughput"
+)
+
+// An Asymmetry is a difference in the environment of an experiment's targets that could bias
+// a comparison of their results. Values holds the value of each target that differs, keyed by
+// target name.
+type Asymmetry struct {
+	Kind        string            `json:"kind"`
+	Description string            `json:"description"`
+	Values      map[string]string `json:"values"`
 }
 
 type DeleteExperimentOutput struct{}
 
+// AdoptResourcesInput describes existing resources to be registered under an experiment.
+// Resources may be given by arn, by a tag query or both. Every tag must match for a resource
+// to be selected.
+type AdoptResourcesInput struct {
+	ARNs []string          `json:"arns"`
+	Tags map[string]string `json:"tags"`
+	End  time.Time         `json:"end"` // when the adopted resources should be removed, defaults to now
+}
+
+type AdoptResourcesOutput struct {
+	Message     string     `json:"message"`
+	URL         string     `json:"url"`
+	Adopted     []Resource `json:"adopted"`
+	Unsupported []string   `json:"unsupported"` // arns of resources that ironbar cannot manage
+}
+
 type GetExperimentOutput struct {
 	Name       string    `json:"name"`
 	Start      time.Time `json:"start"`
@@ -65,3 +279,591 @@ type GetExperimentOutput struct {
 	Stopped    time.Time `json:"stopped"`
 	Definition string    `json:"definition"`
 }
+
+// A NoiseEstimate is the difference measured between two targets running the same image in an
+// A/A experiment. It gives the smallest difference between targets in other experiments that
+// can be told apart from noise. Differences in requests and latencies are relative to the mean
+// of the two targets, differences in error ratio are absolute.
+type NoiseEstimate struct {
+	Experiment     string    `json:"experiment"`
+	Time           time.Time `json:"time"`
+	InstanceType   string    `json:"instance_type,omitempty"`
+	DurationSecs   float64   `json:"duration_secs"`
+	RequestsDiff   float64   `json:"requests_diff"`
+	ErrorRatioDiff float64   `json:"error_ratio_diff"`
+	TTFBP50Diff    float64   `json:"ttfb_p50_diff"`
+	TTFBP95Diff    float64   `json:"ttfb_p95_diff"`
+	TTFBP99Diff    float64   `json:"ttfb_p99_diff"`
+}
+
+type ListNoiseEstimatesOutput struct {
+	Items []NoiseEstimate `json:"items"` // most recent first
+}
+
+// WebhookEventExperimentCompleted is sent when all of an experiment's resources have been removed.
+const WebhookEventExperimentCompleted = "experiment.completed"
+
+// WebhookEventDeadlineExceeded is sent when an experiment's resources are not all running
+// within the provision deadline of its start, or not all removed within the teardown deadline
+// of its end.
+const WebhookEventDeadlineExceeded = "experiment.deadline_exceeded"
+
+// WebhookEventAnomalyDetected is sent when a target's error ratio or latency shifts suddenly
+// while an experiment is running, if anomaly notifications are enabled.
+const WebhookEventAnomalyDetected = "experiment.anomaly_detected"
+
+// WebhookEvent is the body of a webhook delivered by ironbar.
+type WebhookEvent struct {
+	ID         string            `json:"id"` // unique for each event, repeated when a delivery is retried
+	Event      string            `json:"event"`
+	Time       time.Time         `json:"time"`
+	Experiment ExperimentSummary `json:"experiment"`
+	Deadline   *DeadlineExceeded `json:"deadline,omitempty"` // set for experiment.deadline_exceeded events
+	Anomaly    *Anomaly          `json:"anomaly,omitempty"`  // set for experiment.anomaly_detected events
+	Pipeline   *Pipeline         `json:"pipeline,omitempty"` // set for pipeline.completed events
+}
+
+const (
+	DeadlineOperationProvision = "provision"
+	DeadlineOperationTeardown  = "teardown"
+)
+
+// A DeadlineExceeded records that an operation on an experiment did not finish by its deadline.
+type DeadlineExceeded struct {
+	Operation string    `json:"operation"`
+	Deadline  time.Time `json:"deadline"`
+	Time      time.Time `json:"time"` // when ironbar noticed
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// ExperimentSummary summarises an experiment and its results.
+type ExperimentSummary struct {
+	Name        string             `json:"name"`
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Stopped     time.Time          `json:"stopped"`
+	Owner       string             `json:"owner,omitempty"`
+	Team        string             `json:"team,omitempty"`
+	Purpose     string             `json:"purpose,omitempty"`
+	Ticket      string             `json:"ticket,omitempty"`
+	Definition  string             `json:"definition"`
+	Targets     []TargetSummary    `json:"targets,omitempty"` // empty if results could not be read
+	Failures    []Failure          `json:"failures,omitempty"`
+	Traffic     *TrafficSummary    `json:"traffic,omitempty"`          // nil if the live traffic could not be read
+	Workload    *WorkloadSummary   `json:"workload,omitempty"`         // nil if dealgood's workload profile could not be read
+	Window      *MeasuredWindow    `json:"measured_window,omitempty"`  // nil if dealgood did not record one
+	Excluded    []ExcludedWindow   `json:"excluded_windows,omitempty"` // periods left out of the targets' results
+	Segments    []Segment          `json:"segments,omitempty"`         // results of each segment of the definition followed by each period between redeploys
+	Analyses    []Analysis         `json:"analyses,omitempty"`
+	Annotations []Annotation       `json:"annotations,omitempty"`
+	LogMatches  []LogMatches       `json:"log_matches,omitempty"`
+	Anomalies   []Anomaly          `json:"anomalies,omitempty"`
+	Restarts    []TargetRestart    `json:"restarts,omitempty"`
+	Changes     []ConfigChange     `json:"config_changes,omitempty"`
+	Deadlines   []DeadlineExceeded `json:"deadlines_exceeded,omitempty"`
+	Slowest     []SlowestRequests  `json:"slowest_requests,omitempty"` // slowest requests to each target over the whole experiment
+	Placements  []TaskPlacement    `json:"placements,omitempty"`
+	Asymmetries []Asymmetry        `json:"asymmetries,omitempty"` // differences between the targets' environments that could bias results
+	Soak        []SoakSummary      `json:"soak,omitempty"`        // stability of each target, only for soak experiments
+	Shutdown    []ShutdownStage    `json:"shutdown,omitempty"`
+}
+
+// Stages of an experiment's shutdown, in the order ironbar runs them.
+const (
+	ShutdownStageSource   = "source"   // the request queue's subscription is removed
+	ShutdownStageDealgood = "dealgood" // dealgood is stopped and drains the requests in flight
+	ShutdownStageTargets  = "targets"  // the targets and the experiment's other tasks and instances are stopped
+	ShutdownStageInfra    = "infra"    // queues, tables, task definitions and placement groups are removed
+)
+
+// A ShutdownStage records a stage of an experiment's shutdown. ironbar moves on to the next
+// stage once the resources of the stage have stopped or its timeout has passed, in which case
+// it keeps trying to stop them.
+type ShutdownStage struct {
+	Stage          string    `json:"stage"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"` // zero until all of the stage's resources have stopped
+	TimeoutSeconds float64   `json:"timeout_seconds,omitempty"`
+	TimedOut       bool      `json:"timed_out,omitempty"`
+}
+
+// Outcomes of an analysis.
+const (
+	AnalysisStatusSucceeded = "succeeded"
+	AnalysisStatusFailed    = "failed"
+	AnalysisStatusTimedOut  = "timed_out"
+)
+
+// An Analysis is the outcome of an analysis container run by ironbar once an experiment has
+// completed. Output is the last line the container wrote that is a JSON object or array.
+type Analysis struct {
+	Name    string          `json:"name"`
+	TaskArn string          `json:"task_arn,omitempty"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Status  string          `json:"status"`
+	Reason  string          `json:"reason,omitempty"` // why the analysis failed
+	Output  json.RawMessage `json:"output,omitempty"`
+}
+
+type ListAnalysesOutput struct {
+	Items []Analysis `json:"items"`
+}
+
+// LogMatches counts the lines written to a component's logs while an experiment was running
+// that matched one of ironbar's log patterns, such as panics or out of memory errors.
+type LogMatches struct {
+	Component string   `json:"component"`
+	Pattern   string   `json:"pattern"`
+	Count     int      `json:"count"`
+	Excerpts  []string `json:"excerpts,omitempty"` // the first few matching lines
+}
+
+// Metrics of a target that ironbar watches for sudden shifts.
+const (
+	AnomalyMetricErrorRatio = "error_ratio"
+	AnomalyMetricTTFBP99    = "ttfb_p99_seconds"
+)
+
+// An Anomaly is a sudden shift in a target's error ratio or latency while an experiment was
+// running, compared with the target's moving mean and standard deviation before the shift.
+type Anomaly struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+	Mean   float64   `json:"mean"`
+	StdDev float64   `json:"stddev"`
+	Sigma  float64   `json:"sigma"` // standard deviations the value was from the mean, negative if below it
+}
+
+// SlowestRequestsLogPrefix starts the lines dealgood writes to its log at the end of each window
+// with the slowest requests sent to a target, JSON encoded as SlowestRequests, so that ironbar
+// can pick them out of the log.
+const SlowestRequestsLogPrefix = "thunderdome:slowest_requests "
+
+// SlowestRequests are the slowest requests sent to a target during a window, slowest first.
+type SlowestRequests struct {
+	Target      string        `json:"target"`
+	WindowStart time.Time     `json:"window_start"`
+	WindowEnd   time.Time     `json:"window_end"`
+	Requests    []SlowRequest `json:"requests"`
+}
+
+// A SlowRequest is a request that was one of the slowest sent to a target, with the breakdown
+// of its timing.
+type SlowRequest struct {
+	Time           time.Time `json:"time"` // when the request was sent
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	StatusCode     int       `json:"status_code,omitempty"` // zero if no response was received
+	ErrorClass     string    `json:"error_class,omitempty"`
+	ConnectSeconds float64   `json:"connect_seconds"`
+	TTFBSeconds    float64   `json:"ttfb_seconds"`
+	TotalSeconds   float64   `json:"total_seconds"`
+}
+
+// MergeSlowRequests returns the k slowest of two lists of requests that are each ordered slowest
+// first.
+func MergeSlowRequests(a, b []SlowRequest, k int) []SlowRequest {
+	out := make([]SlowRequest, 0, k)
+	for len(out) < k && (len(a) > 0 || len(b) > 0) {
+		if len(b) == 0 || (len(a) > 0 && a[0].TotalSeconds >= b[0].TotalSeconds) {
+			out = append(out, a[0])
+			a = a[1:]
+		} else {
+			out = append(out, b[0])
+			b = b[1:]
+		}
+	}
+	return out
+}
+
+// An Annotation is a free-form note attached to an experiment, such as a record of a manual
+// intervention made while it was running.
+type Annotation struct {
+	Time   time.Time `json:"time"`
+	Author string    `json:"author,omitempty"`
+	Text   string    `json:"text"`
+}
+
+type AddAnnotationInput struct {
+	Text   string    `json:"text"`
+	Author string    `json:"author,omitempty"`
+	Time   time.Time `json:"time,omitempty"` // when the annotated event happened, defaults to now
+}
+
+type ListAnnotationsOutput struct {
+	Items []Annotation `json:"items"`
+}
+
+type RestartTargetInput struct {
+	Author  string `json:"author,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Exclude bool   `json:"exclude,omitempty"` // exclude the time the target was restarting from the experiment's results
+	Image   string `json:"image,omitempty"`   // image the target is redeployed with, empty to restart it with the image it was running
+}
+
+type RestartTargetOutput struct {
+	Job        Job        `json:"job"`
+	Annotation Annotation `json:"annotation"`
+}
+
+// QueryInput is a PromQL query of an experiment's metrics. ironbar adds a matcher for the
+// experiment to every selector in the query, so it must not name the experiment itself.
+type QueryInput struct {
+	Query string        // the PromQL expression
+	Time  time.Time     // time of an instant query, defaults to when the experiment stopped or now if it is running
+	Range bool          // run the query for each step between Start and End rather than at Time
+	Start time.Time     // start of a range query, defaults to the start of the experiment
+	End   time.Time     // end of a range query, defaults to when the experiment stopped or now if it is running
+	Step  time.Duration // interval between the points of a range query, defaults to giving about 250 points
+}
+
+type QueryOutput struct {
+	Query      string        `json:"query"`       // the query that was run, scoped to the experiment
+	ResultType string        `json:"result_type"` // one of vector, matrix, scalar or string
+	Series     []QuerySeries `json:"series"`
+}
+
+// A QuerySeries is one of the series returned by a query, ordered by time. A scalar or string
+// result is returned as a single series without labels.
+type QuerySeries struct {
+	Labels  map[string]string `json:"labels,omitempty"`
+	Samples []QuerySample     `json:"samples"`
+}
+
+type QuerySample struct {
+	Time  time.Time `json:"time"`
+	Value string    `json:"value"` // formatted as by Prometheus, so it may be NaN, +Inf or -Inf
+}
+
+// A TargetRestart records a restart of one of an experiment's targets asked for by an operator.
+// The target's task is stopped and run again on the same instance so that dealgood can still
+// reach it.
+type TargetRestart struct {
+	Target     string    `json:"target"`
+	Requested  time.Time `json:"requested"`
+	Author     string    `json:"author,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	OldTaskArn string    `json:"old_task_arn"`
+	NewTaskArn string    `json:"new_task_arn,omitempty"` // empty until the new task has been started
+	Running    time.Time `json:"running"`                // when the new task was seen running, zero until then
+	Excluded   bool      `json:"excluded,omitempty"`     // whether the restart is excluded from the experiment's results
+	Error      string    `json:"error,omitempty"`        // why the restart failed
+
+	// Image is the image the target was redeployed with and OldImage the image it ran before.
+	// TaskDefinitionArn is the task definition registered for the new image. All are empty for
+	// a restart with the same image.
+	Image             string `json:"image,omitempty"`
+	OldImage          string `json:"old_image,omitempty"`
+	TaskDefinitionArn string `json:"task_definition_arn,omitempty"`
+}
+
+// A ConfigChange records a call ironbar made to the admin api of one of an experiment's targets
+// at the start of a segment, to change the target's configuration while it runs.
+type ConfigChange struct {
+	Segment string    `json:"segment"`
+	Target  string    `json:"target"`
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status,omitempty"` // status code of the target's response, zero if there was none
+	Error   string    `json:"error,omitempty"`  // why the call failed
+}
+
+// A Segment is a period of an experiment whose targets' results are reported on their own, such
+// as one of the segments of the experiment definition or the time between redeploys of a target
+// with a new image.
+type Segment struct {
+	Name    string            `json:"name"`
+	Start   time.Time         `json:"start"`
+	End     time.Time         `json:"end"`
+	Images  map[string]string `json:"images,omitempty"`  // image run by each target that was redeployed during the experiment, keyed by target
+	Targets []TargetSummary   `json:"targets,omitempty"` // empty if results could not be read
+}
+
+// An ExcludedWindow is a period left out of an experiment's results, such as while a target
+// was being restarted. It applies to every target so they are still compared over the same time.
+type ExcludedWindow struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// TrafficSummary describes the live request stream while an experiment was running. Live
+// traffic varies with the time of day, so results of experiments run at different times should
+// be compared with the traffic each saw in mind.
+type TrafficSummary struct {
+	RequestRate   float64            `json:"request_rate"`             // mean live requests per second
+	PathClasses   map[string]float64 `json:"path_classes,omitempty"`   // share of requests by path class, such as ipfs or ipns
+	StatusClasses map[string]float64 `json:"status_classes,omitempty"` // share of requests by the status class served by the live gateways
+}
+
+// A MeasuredWindow is the period an experiment's results were measured over, which starts once
+// dealgood's start barrier has been passed rather than when the experiment was deployed. End
+// is zero if dealgood had not finished when the window was read.
+type MeasuredWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end,omitempty"`
+}
+
+// WorkloadSummary describes the requests dealgood replayed to the targets of an experiment, so
+// that differences in results between runs can be attributed to the content requested rather
+// than to changes in the targets.
+type WorkloadSummary struct {
+	Requests    float64            `json:"requests"`                      // requests replayed, counted once however many targets they were sent to
+	UniquePaths float64            `json:"unique_paths"`                  // distinct paths requested, a lower bound if dealgood reached its limit on tracked paths
+	TopShare    map[string]float64 `json:"top_share,omitempty"`           // share of requests for the n most requested paths, keyed by n
+	SizeBytes   map[string]float64 `json:"response_size_bytes,omitempty"` // quantiles of response body size weighted by requests, keyed by quantile
+}
+
+// TargetSummary summarises the requests sent to a single target over the course of an experiment.
+type TargetSummary struct {
+	Target     string  `json:"target"`
+	Requests   float64 `json:"requests"`
+	ErrorRatio float64 `json:"error_ratio"`
+	TTFBP50    float64 `json:"ttfb_p50_seconds"`
+	TTFBP95    float64 `json:"ttfb_p95_seconds"`
+	TTFBP99    float64 `json:"ttfb_p99_seconds"`
+
+	// Shadow is set for a target that received the experiment's requests but is left out of
+	// the comparison of results.
+	Shadow bool `json:"shadow,omitempty"`
+
+	// Completeness is the share of the requests read by dealgood that were sent to the target
+	// and answered, nil unless the experiment was audited.
+	Completeness *float64 `json:"completeness,omitempty"`
+
+	// UpstreamRequests and UpstreamBytes are the plain HTTP requests and HTTPS tunnels the target
+	// opened to each shared upstream and the bytes it received from them, keyed by upstream
+	// name. Nil unless the experiment routed target traffic through the egress proxy.
+	UpstreamRequests map[string]float64 `json:"upstream_requests,omitempty"`
+	UpstreamBytes    map[string]float64 `json:"upstream_bytes,omitempty"`
+
+	// EgressDenied is the number of connections the egress proxy refused because its rules did
+	// not permit their destination, nil if none were refused.
+	EgressDenied *float64 `json:"egress_denied,omitempty"`
+
+	// BaselineRTT and BaselineThroughput are the round trip time and single connection
+	// throughput between dealgood and the target's host, measured before the measured window
+	// started. Nil for remote targets and when no baseline was measured.
+	BaselineRTT        *float64 `json:"baseline_rtt_seconds,omitempty"`
+	BaselineThroughput *float64 `json:"baseline_throughput_bytes_per_second,omitempty"`
+
+	// Capacity is the highest request rate the target sustained within the SLO, nil unless
+	// the experiment ran a capacity search.
+	Capacity *float64 `json:"capacity_requests_per_second,omitempty"`
+
+	// Spikes is the number of traffic spikes the target's recovery was scored for, of which
+	// SpikesUnrecovered were not recovered from before the next spike. SpikeRecoveryMean and
+	// SpikeRecoveryMax are the mean and longest times taken to recover from the others. Nil
+	// unless the experiment sent spikes.
+	Spikes            *float64 `json:"spikes,omitempty"`
+	SpikesUnrecovered *float64 `json:"spikes_unrecovered,omitempty"`
+	SpikeRecoveryMean *float64 `json:"spike_recovery_mean_seconds,omitempty"`
+	SpikeRecoveryMax  *float64 `json:"spike_recovery_max_seconds,omitempty"`
+
+	// ConformanceFailed is the number of gateway conformance tests the target failed when
+	// tested before it was stopped or, if it was only tested once running, then. Nil unless
+	// its conformance tests ran to completion.
+	ConformanceFailed *float64 `json:"conformance_failed,omitempty"`
+}
+
+// A SoakSummary describes the stability of a target over a soak experiment. Growth and drift
+// are the slopes of a linear fit over the measured window, so a target whose memory use or
+// latency creeps up shows a positive value even if it never fails. Pointer fields are nil when
+// the target does not export the metric they are read from.
+type SoakSummary struct {
+	Target string `json:"target"`
+
+	// MemoryMax and MemoryGrowth are the highest memory use of the target's container and its
+	// growth, read from the ecs task metadata.
+	MemoryMax    *float64 `json:"memory_max_bytes,omitempty"`
+	MemoryGrowth *float64 `json:"memory_growth_bytes_per_hour,omitempty"`
+
+	// GoroutinesMax and GoroutineGrowth are read from the go_goroutines metric exported by
+	// targets written in Go.
+	GoroutinesMax   *float64 `json:"goroutines_max,omitempty"`
+	GoroutineGrowth *float64 `json:"goroutine_growth_per_hour,omitempty"`
+
+	// Restarts is the number of times the target's task stopped before the experiment ended.
+	Restarts int `json:"restarts"`
+
+	// TTFBP50Drift and TTFBP99Drift are the slopes of the target's time to first byte
+	// quantiles, each computed over successive intervals of the soak experiment.
+	// TTFBP99First and TTFBP99Last are the 99th percentile in the first and last interval.
+	TTFBP50Drift *float64 `json:"ttfb_p50_drift_seconds_per_hour,omitempty"`
+	TTFBP99Drift *float64 `json:"ttfb_p99_drift_seconds_per_hour,omitempty"`
+	TTFBP99First *float64 `json:"ttfb_p99_first_interval_seconds,omitempty"`
+	TTFBP99Last  *float64 `json:"ttfb_p99_last_interval_seconds,omitempty"`
+}
+
+// MaintenanceStatus describes whether ironbar is in maintenance mode. While in maintenance
+// mode new experiments are rejected. If DrainBy is set, running experiments are stopped by
+// that time.
+type MaintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since,omitempty"`
+	DrainBy time.Time `json:"drain_by,omitempty"`
+}
+
+// A FreezeWindow is a period during which no experiments may run, for example while
+// infrastructure is being upgraded. Experiments that would overlap the window are rejected.
+// If Drain is set, experiments already running when the window is declared are stopped
+// before it starts.
+type FreezeWindow struct {
+	ID     string    `json:"id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Reason string    `json:"reason,omitempty"`
+	Drain  bool      `json:"drain,omitempty"`
+}
+
+type ListFreezeWindowsOutput struct {
+	Items []FreezeWindow `json:"items"`
+}
+
+// A Pin exempts an experiment from ironbar's retention policy so that its records are kept
+// indefinitely. It applies to every run of experiments with the name.
+type Pin struct {
+	Experiment string    `json:"experiment"`
+	Reason     string    `json:"reason,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+type PinExperimentInput struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type ListPinsOutput struct {
+	Items []Pin `json:"items"`
+}
+
+const (
+	JobStatePending   = "pending"
+	JobStateRunning   = "running"
+	JobStateSucceeded = "succeeded"
+	JobStateFailed    = "failed"
+	JobStateCancelled = "cancelled"
+)
+
+const (
+	JobKindCheck     = "check"     // checks a running experiment's tasks for failures and log matches
+	JobKindTeardown  = "teardown"  // removes the resources of an experiment that is due to end
+	JobKindComplete  = "complete"  // runs analyses, sends webhooks and records noise estimates
+	JobKindRetention = "retention" // applies the retention policy to completed experiments
+
+	JobKindConformance = "conformance" // runs gateway conformance tests against an experiment's targets
+	JobKindRestart     = "restart"     // restarts one of an experiment's targets
+	JobKindConfig      = "config"      // calls the admin apis of an experiment's targets as a segment starts
+	JobKindPipeline    = "pipeline"    // deploys the next stage of a pipeline, whose name is the job's experiment
+)
+
+// A Job is a unit of ironbar's background work, usually on a single experiment.
+type Job struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Experiment string    `json:"experiment,omitempty"`
+	State      string    `json:"state"`
+	Attempts   int       `json:"attempts"` // number of times the job has been started, including after restarts
+	Created    time.Time `json:"created"`
+	Started    time.Time `json:"started,omitempty"`
+	Finished   time.Time `json:"finished,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type ListJobsOutput struct {
+	Items []Job `json:"items"`
+}
+
+// ReloadConfigOutput reports a reload of ironbar's configuration.
+type ReloadConfigOutput struct {
+	Reloaded time.Time `json:"reloaded"`
+	Changed  []string  `json:"changed"` // names of the settings that changed, such as quotas or monitor_interval
+}
+
+// Labels that mark an experiment as a stage of a pipeline. ironbar labels the experiments of
+// the stages it deploys, and updates the stage when the experiment is registered and once it
+// completes.
+const (
+	LabelPipeline      = "thunderdome.pipeline"
+	LabelPipelineStage = "thunderdome.pipeline_stage"
+)
+
+// States of a pipeline stage.
+const (
+	StageStatePending   = "pending"   // waiting to be deployed, possibly for the stages it needs
+	StageStateDeploying = "deploying" // ironbar is deploying its experiment
+	StageStateRunning   = "running"   // its experiment has been registered
+	StageStatePassed    = "passed"    // its experiment completed and met every gate
+	StageStateFailed    = "failed"    // its experiment missed a gate or could not be deployed
+	StageStateSkipped   = "skipped"   // a stage it needs did not pass
+)
+
+// Verdicts of a pipeline.
+const (
+	PipelineVerdictPending = "pending" // some stages have not finished
+	PipelineVerdictGo      = "go"      // every stage passed
+	PipelineVerdictNoGo    = "no_go"   // a stage failed or was skipped
+)
+
+// PipelineGates are the criteria the experiment of a stage must meet for the stage to pass.
+// Unset gates are not checked.
+type PipelineGates struct {
+	MaxErrorRatio        *float64 `json:"max_error_ratio,omitempty"`        // highest error ratio of any target
+	MaxFailures          *int     `json:"max_failures,omitempty"`           // most task failures, such as crashes, ironbar may record
+	MaxRestarts          *int     `json:"max_restarts,omitempty"`           // most restarts of any target, only for soak experiments
+	MaxConformanceFailed *float64 `json:"max_conformance_failed,omitempty"` // most gateway conformance tests any target may fail
+
+	// MaxRegression is the highest relative increase of the candidate target's p99 time to
+	// first byte over the baseline target's, for example 0.1 for 10%.
+	Baseline      string   `json:"baseline,omitempty"`
+	Candidate     string   `json:"candidate,omitempty"`
+	MaxRegression *float64 `json:"max_regression,omitempty"`
+}
+
+// A PipelineStage is an experiment run as one step of a pipeline.
+type PipelineStage struct {
+	Name       string        `json:"name"`
+	Experiment string        `json:"experiment"`      // name the stage's experiment is deployed with
+	Needs      []string      `json:"needs,omitempty"` // stages that must pass before this one is deployed
+	Gates      PipelineGates `json:"gates"`
+	Definition string        `json:"definition,omitempty"` // experiment deployed for the stage, with the image of every target built
+
+	State    string          `json:"state"`
+	Started  time.Time       `json:"started,omitempty"`
+	Finished time.Time       `json:"finished,omitempty"`
+	Reasons  []string        `json:"reasons,omitempty"` // why the stage failed or was skipped
+	Targets  []TargetSummary `json:"targets,omitempty"` // results the gates were checked against
+}
+
+// A Pipeline is a sequence of experiments run for a release candidate, such as a smoke test,
+// a comparison with the previous release and a soak, whose outcomes are combined into a
+// go or no-go verdict.
+type Pipeline struct {
+	Name     string          `json:"name"`
+	Owner    string          `json:"owner,omitempty"` // user the experiments of the stages are submitted for
+	Team     string          `json:"team,omitempty"`
+	Created  time.Time       `json:"created"`
+	Finished time.Time       `json:"finished,omitempty"`
+	Verdict  string          `json:"verdict"`
+	Stages   []PipelineStage `json:"stages"`
+}
+
+// NewPipelineInput defines a pipeline, whose stages ironbar deploys one at a time. Stages are
+// listed in the order they are deployed and may only need stages listed before them. The
+// state of each stage is ignored.
+type NewPipelineInput struct {
+	Owner  string          `json:"owner,omitempty"`
+	Team   string          `json:"team,omitempty"`
+	Stages []PipelineStage `json:"stages"`
+}
+
+type FailPipelineStageInput struct {
+	Reason string `json:"reason"`
+}
+
+// WebhookEventPipelineCompleted is sent when every stage of a pipeline has finished.
+const WebhookEventPipelineCompleted = "pipeline.completed"
@@ -0,0 +1,83 @@
+package api
+
+import "errors"
+
+// Error codes identify the cause of a failed request, or of a failed thunderdome command. They
+// are stable, unlike error messages, so automation can decide whether to fix its input, wait
+// or retry.
+const (
+	// The experiment definition or request is invalid. Fix it before trying again.
+	ErrorCodeSpecInvalid = "SPEC_INVALID"
+
+	// The experiment is missing metadata, such as its owner or purpose, that ironbar requires.
+	ErrorCodeMetadataMissing = "METADATA_MISSING"
+
+	// An image used by the experiment does not exist.
+	ErrorCodeImageNotFound = "IMAGE_NOT_FOUND"
+
+	// The experiment, or another named object, is not known to ironbar.
+	ErrorCodeNotFound = "NOT_FOUND"
+
+	// The admin token is missing or wrong.
+	ErrorCodeUnauthorized = "UNAUTHORIZED"
+
+	// The request conflicts with the current state, for example cancelling a finished job.
+	ErrorCodeConflict = "CONFLICT"
+
+	// Starting the experiment would exceed one of the submitter's quotas.
+	ErrorCodeQuotaExceeded = "QUOTA_EXCEEDED"
+
+	// ironbar is in maintenance mode, the experiment would overlap a freeze window or ironbar is
+	// not configured with a service the request needs.
+	ErrorCodeUnavailable = "UNAVAILABLE"
+
+	// One or more preflight checks of the environment failed.
+	ErrorCodePreflightFailed = "PREFLIGHT_FAILED"
+
+	// AWS throttled a request. Retry after a short wait.
+	ErrorCodeAWSThrottled = "AWS_THROTTLED"
+
+	// An AWS request failed for a reason other than throttling.
+	ErrorCodeAWSError = "AWS_ERROR"
+
+	// ironbar failed for an unclassified reason.
+	ErrorCodeInternal = "INTERNAL"
+)
+
+// ErrorResponse is the body of every error response from ironbar.
+type ErrorResponse struct {
+	Code string `json:"code,omitempty"`
+	Err  string `json:"err"`
+}
+
+// IsUserError reports whether an error code means the request, rather than ironbar or AWS,
+// was at fault.
+func IsUserError(code string) bool {
+	switch code {
+	case ErrorCodeSpecInvalid, ErrorCodeMetadataMissing, ErrorCodeImageNotFound, ErrorCodeNotFound, ErrorCodeUnauthorized, ErrorCodeConflict:
+		return true
+	}
+	return false
+}
+
+// A CodedError is an error with one of the error codes.
+type CodedError struct {
+	Code string
+	Err  error
+}
+
+func (e *CodedError) Error() string { return e.Err.Error() }
+func (e *CodedError) Unwrap() error { return e.Err }
+
+// ErrorCode returns the code of err.
+func (e *CodedError) ErrorCode() string { return e.Code }
+
+// ErrorCode returns the code of the first error in err's chain that has one, or the empty
+// string if none do.
+func ErrorCode(err error) string {
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return ""
+}
@@ -1,19 +1,57 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 )
 
+// awsCallTimeout bounds each request made to an AWS api, including each retry of it, so that a
+// request that stalls on the network fails instead of waiting indefinitely.
+const awsCallTimeout = time.Minute
+
+// newAWSSession returns a session for calling AWS apis in a region whose requests time out
+// after awsCallTimeout. Every call must still be made with a context so that it is abandoned
+// when the job or request that made it is cancelled.
+func newAWSSession(region string) (*session.Session, error) {
+	return session.NewSession(&aws.Config{
+		Region:     aws.String(region),
+		HTTPClient: &http.Client{Timeout: awsCallTimeout},
+	})
+}
+
+// awsErrorCode returns the api error code for a failed AWS request, or the empty string if err
+// did not come from AWS.
+func awsErrorCode(err error) string {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return ""
+	}
+	if request.IsErrorThrottle(aerr) {
+		return api.ErrorCodeAWSThrottled
+	}
+	return api.ErrorCodeAWSError
+}
+
 func isTaskActive(ctx context.Context, sess *session.Session, ecsClusterArn, taskArn string) (bool, error) {
 	logger := slog.With("arn", taskArn, "cluster_arn", ecsClusterArn)
 	logger.Debug("checking if task is active")
@@ -25,7 +63,7 @@ func isTaskActive(ctx context.Context, sess *session.Session, ecsClusterArn, tas
 		},
 	}
 
-	out, err := svc.DescribeTasks(in)
+	out, err := svc.DescribeTasksWithContext(ctx, in)
 	if err != nil {
 		return true, fmt.Errorf("describe tasks: %w", err)
 	}
@@ -60,7 +98,7 @@ func isTaskDefinitionActive(ctx context.Context, sess *session.Session, arn stri
 		TaskDefinition: aws.String(arn),
 	}
 
-	out, err := svc.DescribeTaskDefinition(in)
+	out, err := svc.DescribeTaskDefinitionWithContext(ctx, in)
 	if err != nil {
 		return true, fmt.Errorf("describe task definition: %w", err)
 	}
@@ -87,7 +125,7 @@ func isSnsSubscriptionActive(ctx context.Context, sess *session.Session, arn str
 		SubscriptionArn: aws.String(arn),
 	}
 
-	out, err := svc.GetSubscriptionAttributes(in)
+	out, err := svc.GetSubscriptionAttributesWithContext(ctx, in)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == sns.ErrCodeNotFoundException {
@@ -123,7 +161,7 @@ func isSqsQueueActive(ctx context.Context, sess *session.Session, url string) (b
 		},
 	}
 
-	out, err := svc.GetQueueAttributes(in)
+	out, err := svc.GetQueueAttributesWithContext(ctx, in)
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == sqs.ErrCodeQueueDoesNotExist {
@@ -155,19 +193,234 @@ func stopEcsTask(ctx context.Context, sess *session.Session, ecsClusterArn, task
 		Task:    aws.String(taskArn),
 	}
 
-	if _, err := svc.StopTask(in); err != nil {
+	if _, err := svc.StopTaskWithContext(ctx, in); err != nil {
 		return fmt.Errorf("stop task: %w", err)
 	}
 	return nil
 }
 
+// describeEcsTask returns the task or nil if it cannot be found.
+func describeEcsTask(ctx context.Context, sess *session.Session, ecsClusterArn, taskArn string) (*ecs.Task, error) {
+	svc := ecs.New(sess)
+	out, err := svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(ecsClusterArn),
+		Tasks: []*string{
+			aws.String(taskArn),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe tasks: %w", err)
+	}
+	for _, ta := range out.Tasks {
+		if aws.StringValue(ta.TaskArn) == taskArn {
+			return ta, nil
+		}
+	}
+	return nil, nil
+}
+
+// isTaskStopped reports whether a task has stopped, rather than only been asked to stop. A task
+// that ECS no longer knows of has stopped.
+func isTaskStopped(ctx context.Context, sess *session.Session, ecsClusterArn, taskArn string) (bool, error) {
+	task, err := describeEcsTask(ctx, sess, ecsClusterArn, taskArn)
+	if err != nil {
+		return false, err
+	}
+	if task == nil {
+		return true, nil
+	}
+	status := aws.StringValue(task.LastStatus)
+	return status == "STOPPED" || status == "DELETED", nil
+}
+
+// describeEcsTaskDefinition returns the task definition with the given arn.
+func describeEcsTaskDefinition(ctx context.Context, sess *session.Session, arn string) (*ecs.TaskDefinition, error) {
+	svc := ecs.New(sess)
+	out, err := svc.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(arn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe task definition: %w", err)
+	}
+	if out.TaskDefinition == nil {
+		return nil, fmt.Errorf("no task definition found")
+	}
+	return out.TaskDefinition, nil
+}
+
+// taskHostAddress returns the private ip address of the ec2 instance a task is running on.
+func taskHostAddress(ctx context.Context, sess *session.Session, ecsClusterArn, taskArn string) (string, error) {
+	task, err := describeEcsTask(ctx, sess, ecsClusterArn, taskArn)
+	if err != nil {
+		return "", err
+	}
+	if task == nil || task.ContainerInstanceArn == nil {
+		return "", fmt.Errorf("task is not running on a container instance")
+	}
+
+	svc := ecs.New(sess)
+	outci, err := svc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            aws.String(ecsClusterArn),
+		ContainerInstances: []*string{task.ContainerInstanceArn},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describe container instances: %w", err)
+	}
+	if len(outci.ContainerInstances) != 1 || outci.ContainerInstances[0].Ec2InstanceId == nil {
+		return "", fmt.Errorf("container instance not found")
+	}
+
+	ec2svc := ec2.New(sess)
+	outi, err := ec2svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{outci.ContainerInstances[0].Ec2InstanceId},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describe instances: %w", err)
+	}
+	for _, r := range outi.Reservations {
+		for _, inst := range r.Instances {
+			if inst.PrivateIpAddress != nil {
+				return aws.StringValue(inst.PrivateIpAddress), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("private ip address not found")
+}
+
+// definitionKmsKey returns the kms key an experiment definition asks for its resources to be
+// encrypted with, or the empty string if it does not set one or cannot be decoded.
+func definitionKmsKey(definition string) string {
+	var def struct {
+		KmsKeyArn string
+	}
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		return ""
+	}
+	return def.KmsKeyArn
+}
+
+// putS3Object writes content to an object in an s3 bucket, encrypted with the given kms key
+// or with the bucket's default encryption if kmsKey is empty.
+func putS3Object(ctx context.Context, sess *session.Session, bucket, key, kmsKey string, content []byte) error {
+	svc := s3.New(sess)
+	in := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	}
+	if kmsKey != "" {
+		in.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		in.SSEKMSKeyId = aws.String(kmsKey)
+	}
+	_, err := svc.PutObjectWithContext(ctx, in)
+	if err != nil {
+		return fmt.Errorf("put object: %w", err)
+	}
+	return nil
+}
+
+// runEcsTask runs a single task and returns its arn.
+func runEcsTask(ctx context.Context, sess *session.Session, in *ecs.RunTaskInput) (string, error) {
+	svc := ecs.New(sess)
+	out, err := svc.RunTaskWithContext(ctx, in)
+	if err != nil {
+		return "", fmt.Errorf("run task: %w", err)
+	}
+	if len(out.Failures) > 0 {
+		f := out.Failures[0]
+		return "", fmt.Errorf("run task failed: %s: %s", aws.StringValue(f.Reason), aws.StringValue(f.Detail))
+	}
+	if len(out.Tasks) != 1 {
+		return "", fmt.Errorf("run task returned unexpected number of tasks: %d", len(out.Tasks))
+	}
+	return aws.StringValue(out.Tasks[0].TaskArn), nil
+}
+
+// registerEcsTaskDefinition registers a task definition and returns its arn.
+func registerEcsTaskDefinition(ctx context.Context, sess *session.Session, in *ecs.RegisterTaskDefinitionInput) (string, error) {
+	svc := ecs.New(sess)
+	out, err := svc.RegisterTaskDefinitionWithContext(ctx, in)
+	if err != nil {
+		return "", fmt.Errorf("register task definition: %w", err)
+	}
+	if out.TaskDefinition == nil || out.TaskDefinition.TaskDefinitionArn == nil {
+		return "", fmt.Errorf("no task definition arn found")
+	}
+	return aws.StringValue(out.TaskDefinition.TaskDefinitionArn), nil
+}
+
+// readLogEvents returns the messages written to a cloudwatch log stream, oldest first.
+func readLogEvents(ctx context.Context, sess *session.Session, group, stream string) ([]string, error) {
+	svc := cloudwatchlogs.New(sess)
+	in := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		StartFromHead: aws.Bool(true),
+	}
+
+	var messages []string
+	for {
+		out, err := svc.GetLogEventsWithContext(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("get log events: %w", err)
+		}
+		for _, ev := range out.Events {
+			messages = append(messages, aws.StringValue(ev.Message))
+		}
+		// the same token is returned once the end of the stream is reached
+		if len(out.Events) == 0 || aws.StringValue(out.NextForwardToken) == aws.StringValue(in.NextToken) {
+			return messages, nil
+		}
+		in.NextToken = out.NextForwardToken
+	}
+}
+
+// filterLogEvents calls fn with each event written to a cloudwatch log stream at or after
+// start, oldest first, reading at most maxPages pages of events.
+func filterLogEvents(ctx context.Context, sess *session.Session, group, stream string, start int64, maxPages int, fn func(*cloudwatchlogs.FilteredLogEvent)) error {
+	return filterLogEventsMatching(ctx, sess, group, stream, "", start, maxPages, fn)
+}
+
+// filterLogEventsMatching calls fn for the events in a log stream from start that match a
+// cloudwatch filter pattern, or for all events if the pattern is empty.
+func filterLogEventsMatching(ctx context.Context, sess *session.Session, group, stream, pattern string, start int64, maxPages int, fn func(*cloudwatchlogs.FilteredLogEvent)) error {
+	svc := cloudwatchlogs.New(sess)
+	in := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:   aws.String(group),
+		LogStreamNames: []*string{aws.String(stream)},
+		StartTime:      aws.Int64(start),
+	}
+	if pattern != "" {
+		in.FilterPattern = aws.String(pattern)
+	}
+
+	for page := 0; page < maxPages; page++ {
+		out, err := svc.FilterLogEventsWithContext(ctx, in)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+				// the stream is created when the container first writes to it
+				return nil
+			}
+			return fmt.Errorf("filter log events: %w", err)
+		}
+		for _, ev := range out.Events {
+			fn(ev)
+		}
+		if out.NextToken == nil {
+			return nil
+		}
+		in.NextToken = out.NextToken
+	}
+	return nil
+}
+
 func deregisterEcsTaskDefinition(ctx context.Context, sess *session.Session, arn string) error {
 	in := &ecs.DeregisterTaskDefinitionInput{
 		TaskDefinition: aws.String(arn),
 	}
 
 	svc := ecs.New(sess)
-	_, err := svc.DeregisterTaskDefinition(in)
+	_, err := svc.DeregisterTaskDefinitionWithContext(ctx, in)
 	if err != nil {
 		return fmt.Errorf("deregister task definition: %w", err)
 	}
@@ -181,7 +434,7 @@ func unsubscribeSqsQueue(ctx context.Context, sess *session.Session, arn string)
 		SubscriptionArn: aws.String(arn),
 	}
 
-	_, err := snssvc.Unsubscribe(in)
+	_, err := snssvc.UnsubscribeWithContext(ctx, in)
 	if err != nil {
 		return fmt.Errorf("unsubscribe from request topic: %w", err)
 	}
@@ -196,13 +449,58 @@ func deleteSqsQueue(ctx context.Context, sess *session.Session, queueURL string)
 		QueueUrl: aws.String(queueURL),
 	}
 
-	_, err := svc.DeleteQueue(in)
+	_, err := svc.DeleteQueueWithContext(ctx, in)
 	if err != nil {
 		return fmt.Errorf("delete queue: %w", err)
 	}
 	return nil
 }
 
+func isDynamoDBTableActive(ctx context.Context, sess *session.Session, tableName string) (bool, error) {
+	logger := slog.With("table_name", tableName)
+	logger.Debug("checking if table is active")
+
+	svc := dynamodb.New(sess)
+	in := &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}
+
+	out, err := svc.DescribeTableWithContext(ctx, in)
+	if err != nil {
+		if _, ok := err.(*dynamodb.ResourceNotFoundException); ok {
+			return false, nil
+		}
+		return true, fmt.Errorf("describe table: %w", err)
+	}
+
+	if out.Table == nil || out.Table.TableStatus == nil {
+		logger.Debug("no table status found")
+		return false, nil
+	}
+
+	if *out.Table.TableStatus == dynamodb.TableStatusDeleting {
+		logger.Debug("table is being deleted")
+		return false, nil
+	}
+
+	logger.Debug("table found", "status", *out.Table.TableStatus)
+	return true, nil
+}
+
+func deleteDynamoDBTable(ctx context.Context, sess *session.Session, tableName string) error {
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.DeleteTableInput{
+		TableName: aws.String(tableName),
+	}
+
+	_, err := svc.DeleteTableWithContext(ctx, in)
+	if err != nil {
+		return fmt.Errorf("delete table: %w", err)
+	}
+	return nil
+}
+
 func isEc2InstanceActive(ctx context.Context, sess *session.Session, instanceID string) (bool, error) {
 	logger := slog.With("instance_id", instanceID)
 	logger.Debug("checking if ec2 instance is active")
@@ -213,7 +511,7 @@ func isEc2InstanceActive(ctx context.Context, sess *session.Session, instanceID
 			aws.String(instanceID),
 		},
 	}
-	out, err := svc.DescribeInstances(in)
+	out, err := svc.DescribeInstancesWithContext(ctx, in)
 	if err != nil {
 		return true, fmt.Errorf("describe ec2 instances: %w", err)
 	}
@@ -230,3 +528,104 @@ func isEc2InstanceActive(ctx context.Context, sess *session.Session, instanceID
 		return true, nil
 	}
 }
+
+// isEc2InstanceRunning reports whether an ec2 instance is in any state other than shutting
+// down or terminated. Unlike isEc2InstanceActive it ignores instances that have been
+// terminated but are still listed.
+func isEc2InstanceRunning(ctx context.Context, sess *session.Session, instanceID string) (bool, error) {
+	logger := slog.With("instance_id", instanceID)
+	logger.Debug("checking if ec2 instance is running")
+
+	svc := ec2.New(sess)
+	in := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{
+			aws.String(instanceID),
+		},
+	}
+	out, err := svc.DescribeInstancesWithContext(ctx, in)
+	if err != nil {
+		return true, fmt.Errorf("describe ec2 instances: %w", err)
+	}
+
+	for _, r := range out.Reservations {
+		for _, instance := range r.Instances {
+			if instance == nil || instance.State == nil {
+				continue
+			}
+			switch state := aws.StringValue(instance.State.Name); state {
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+				logger.Debug("instance is not running", "state", state)
+			default:
+				logger.Debug("instance is running", "state", state)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func terminateEc2Instance(ctx context.Context, sess *session.Session, instanceID string) error {
+	svc := ec2.New(sess)
+
+	in := &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{
+			aws.String(instanceID),
+		},
+	}
+
+	_, err := svc.TerminateInstancesWithContext(ctx, in)
+	if err != nil {
+		return fmt.Errorf("terminate instances: %w", err)
+	}
+	return nil
+}
+
+func isPlacementGroupActive(ctx context.Context, sess *session.Session, groupName string) (bool, error) {
+	logger := slog.With("group_name", groupName)
+	logger.Debug("checking if placement group is active")
+
+	svc := ec2.New(sess)
+	in := &ec2.DescribePlacementGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String(groupName)},
+			},
+		},
+	}
+	out, err := svc.DescribePlacementGroupsWithContext(ctx, in)
+	if err != nil {
+		return true, fmt.Errorf("describe placement groups: %w", err)
+	}
+
+	for _, pg := range out.PlacementGroups {
+		if aws.StringValue(pg.GroupName) != groupName {
+			continue
+		}
+		switch state := aws.StringValue(pg.State); state {
+		case ec2.PlacementGroupStateDeleting, ec2.PlacementGroupStateDeleted:
+			logger.Debug("placement group is being deleted", "state", state)
+			return false, nil
+		default:
+			logger.Debug("placement group found", "state", state)
+			return true, nil
+		}
+	}
+
+	logger.Debug("no placement group found")
+	return false, nil
+}
+
+func deletePlacementGroup(ctx context.Context, sess *session.Session, groupName string) error {
+	svc := ec2.New(sess)
+
+	in := &ec2.DeletePlacementGroupInput{
+		GroupName: aws.String(groupName),
+	}
+
+	_, err := svc.DeletePlacementGroupWithContext(ctx, in)
+	if err != nil {
+		return fmt.Errorf("delete placement group: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+// Package client is a typed Go client for ironbar's HTTP API, described by the OpenAPI
+// specification in cmd/ironbar/api/openapi.yaml. It allows other tools to submit experiments,
+// query their status and read their definitions without using the thunderdome command.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// ErrNotFound matches, using errors.Is, the error returned when the requested experiment is not
+// known to ironbar.
+var ErrNotFound = errors.New("not found")
+
+// Error is returned when ironbar responds with an error status. Code is one of the error codes
+// defined in the api package, or empty if ironbar did not return one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ironbar returned status %d", e.StatusCode)
+	}
+	return e.Message
+}
+
+// ErrorCode returns the api error code of the response so that api.ErrorCode can classify it.
+func (e *Error) ErrorCode() string { return e.Code }
+
+// Is reports whether a not found response matches ErrNotFound.
+func (e *Error) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Client makes requests to an ironbar server.
+type Client struct {
+	baseURL    string
+	hc         *http.Client
+	adminToken string
+}
+
+// New returns a client for the ironbar server at addr, which may be a host and port or a
+// base url. If hc is nil then http.DefaultClient is used.
+func New(addr string, hc *http.Client) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(addr, "/"),
+		hc:      hc,
+	}
+}
+
+// WithAdminToken returns a copy of the client that authenticates with the admin token, which is
+// required by the admin methods.
+func (c *Client) WithAdminToken(token string) *Client {
+	cc := *c
+	cc.adminToken = token
+	return &cc
+}
+
+// NewExperiment records the start of an experiment and the resources ironbar should remove
+// when it ends.
+func (c *Client) NewExperiment(ctx context.Context, in *api.NewExperimentInput) (*api.NewExperimentOutput, error) {
+	out := new(api.NewExperimentOutput)
+	if err := c.do(ctx, http.MethodPost, "/experiments", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListExperiments lists experiments that are running or were recently stopped.
+func (c *Client) ListExperiments(ctx context.Context, in *api.ListExperimentsInput) (*api.ListExperimentsOutput, error) {
+	path := "/experiments"
+	if in != nil {
+		if q := listExperimentsQuery(in).Encode(); q != "" {
+			path += "?" + q
+		}
+	}
+	out := new(api.ListExperimentsOutput)
+	if err := c.do(ctx, http.MethodGet, path, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func listExperimentsQuery(in *api.ListExperimentsInput) url.Values {
+	q := url.Values{}
+	if in.Status != "" {
+		q.Set("status", in.Status)
+	}
+	if in.Owner != "" {
+		q.Set("owner", in.Owner)
+	}
+	if in.Team != "" {
+		q.Set("team", in.Team)
+	}
+	for k, v := range in.Labels {
+		q.Add("label", k+"="+v)
+	}
+	if in.MinAge > 0 {
+		q.Set("min_age", in.MinAge.String())
+	}
+	if in.MaxAge > 0 {
+		q.Set("max_age", in.MaxAge.String())
+	}
+	if in.Sort != "" {
+		q.Set("sort", in.Sort)
+	}
+	if in.Limit > 0 {
+		q.Set("limit", strconv.Itoa(in.Limit))
+	}
+	if in.PageToken != "" {
+		q.Set("page_token", in.PageToken)
+	}
+	if in.All {
+		q.Set("all", "true")
+	}
+	return q
+}
+
+// GetExperiment returns an experiment including its definition.
+func (c *Client) GetExperiment(ctx context.Context, name string) (*api.GetExperimentOutput, error) {
+	out := new(api.GetExperimentOutput)
+	if err := c.do(ctx, http.MethodGet, "/experiments/"+url.PathEscape(name), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExperimentStatus returns the operational status of an experiment.
+func (c *Client) ExperimentStatus(ctx context.Context, name string) (*api.ExperimentStatusOutput, error) {
+	out := new(api.ExperimentStatusOutput)
+	if err := c.do(ctx, http.MethodGet, "/experiments/"+url.PathEscape(name)+"/status", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CheckQuota reports whether an experiment would be accepted without exceeding any quota. An
+// *Error with status code 403 is returned if a quota would be exceeded.
+func (c *Client) CheckQuota(ctx context.Context, in *api.CheckQuotaInput) (*api.CheckQuotaOutput, error) {
+	out := new(api.CheckQuotaOutput)
+	if err := c.do(ctx, http.MethodPost, "/quotas/check", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListNoiseEstimates lists the noise estimates measured by A/A experiments, most recent first.
+// Version reports the version of ironbar and the api versions and features it supports. An
+// ironbar that predates the version endpoint returns an error matching ErrNotFound.
+func (c *Client) Version(ctx context.Context) (*api.VersionOutput, error) {
+	out := new(api.VersionOutput)
+	if err := c.do(ctx, http.MethodGet, "/version", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) ListNoiseEstimates(ctx context.Context) (*api.ListNoiseEstimatesOutput, error) {
+	out := new(api.ListNoiseEstimatesOutput)
+	if err := c.do(ctx, http.MethodGet, "/noise", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListAnalyses lists the outcomes of the analyses run once an experiment completed. It returns
+// ErrNotFound if none have been recorded.
+func (c *Client) ListAnalyses(ctx context.Context, name string) (*api.ListAnalysesOutput, error) {
+	out := new(api.ListAnalysesOutput)
+	if err := c.do(ctx, http.MethodGet, "/experiments/"+url.PathEscape(name)+"/analyses", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AddAnnotation attaches an annotation to a running or recently stopped experiment.
+func (c *Client) AddAnnotation(ctx context.Context, name string, in *api.AddAnnotationInput) (*api.Annotation, error) {
+	out := new(api.Annotation)
+	if err := c.do(ctx, http.MethodPost, "/experiments/"+url.PathEscape(name)+"/annotations", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListAnnotations lists the annotations attached to an experiment, oldest first. It returns
+// ErrNotFound if the experiment is unknown and has no annotations.
+func (c *Client) ListAnnotations(ctx context.Context, name string) (*api.ListAnnotationsOutput, error) {
+	out := new(api.ListAnnotationsOutput)
+	if err := c.do(ctx, http.MethodGet, "/experiments/"+url.PathEscape(name)+"/annotations", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RestartTarget restarts one of a running experiment's targets in the background. The restart
+// is recorded in the experiment's status once it has finished.
+func (c *Client) RestartTarget(ctx context.Context, name string, target string, in *api.RestartTargetInput) (*api.RestartTargetOutput, error) {
+	out := new(api.RestartTargetOutput)
+	if err := c.do(ctx, http.MethodPost, "/experiments/"+url.PathEscape(name)+"/targets/"+url.PathEscape(target)+"/restart", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Query runs a PromQL query over an experiment's metrics, scoped to the experiment by ironbar.
+// A range query is run when in.Range is set. It returns ErrNotFound if the experiment is unknown.
+func (c *Client) Query(ctx context.Context, name string, in *api.QueryInput) (*api.QueryOutput, error) {
+	q := url.Values{"query": {in.Query}}
+	path := "/experiments/" + url.PathEscape(name) + "/query"
+	if in.Range {
+		path += "_range"
+		if !in.Start.IsZero() {
+			q.Set("start", in.Start.Format(time.RFC3339Nano))
+		}
+		if !in.End.IsZero() {
+			q.Set("end", in.End.Format(time.RFC3339Nano))
+		}
+		if in.Step > 0 {
+			q.Set("step", in.Step.String())
+		}
+	} else if !in.Time.IsZero() {
+		q.Set("time", in.Time.Format(time.RFC3339Nano))
+	}
+	out := new(api.QueryOutput)
+	if err := c.do(ctx, http.MethodGet, path+"?"+q.Encode(), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdoptResources registers existing resources under an experiment.
+func (c *Client) AdoptResources(ctx context.Context, name string, in *api.AdoptResourcesInput) (*api.AdoptResourcesOutput, error) {
+	out := new(api.AdoptResourcesOutput)
+	if err := c.do(ctx, http.MethodPost, "/experiments/"+url.PathEscape(name)+"/adopt", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetMaintenance returns whether ironbar is in maintenance mode.
+func (c *Client) GetMaintenance(ctx context.Context) (*api.MaintenanceStatus, error) {
+	out := new(api.MaintenanceStatus)
+	if err := c.do(ctx, http.MethodGet, "/admin/maintenance", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetMaintenance enables or disables maintenance mode. While enabled, new experiments are
+// rejected with status code 503. Running experiments due to end after DrainBy, if set, are
+// shortened to end at DrainBy.
+func (c *Client) SetMaintenance(ctx context.Context, in *api.MaintenanceStatus) (*api.MaintenanceStatus, error) {
+	out := new(api.MaintenanceStatus)
+	if err := c.do(ctx, http.MethodPut, "/admin/maintenance", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListFreezeWindows lists the freeze windows that have not yet ended.
+func (c *Client) ListFreezeWindows(ctx context.Context) (*api.ListFreezeWindowsOutput, error) {
+	out := new(api.ListFreezeWindowsOutput)
+	if err := c.do(ctx, http.MethodGet, "/admin/freezes", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AddFreezeWindow declares a freeze window, returning it with its assigned ID.
+func (c *Client) AddFreezeWindow(ctx context.Context, in *api.FreezeWindow) (*api.FreezeWindow, error) {
+	out := new(api.FreezeWindow)
+	if err := c.do(ctx, http.MethodPost, "/admin/freezes", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteFreezeWindow removes a freeze window, returning the remaining ones.
+func (c *Client) DeleteFreezeWindow(ctx context.Context, id string) (*api.ListFreezeWindowsOutput, error) {
+	out := new(api.ListFreezeWindowsOutput)
+	if err := c.do(ctx, http.MethodDelete, "/admin/freezes/"+url.PathEscape(id), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListJobs lists ironbar's queued, running and recently finished jobs. If experiment is not
+// empty only its jobs are listed.
+func (c *Client) ListJobs(ctx context.Context, experiment string) (*api.ListJobsOutput, error) {
+	path := "/admin/jobs"
+	if experiment != "" {
+		path += "?" + url.Values{"experiment": {experiment}}.Encode()
+	}
+	out := new(api.ListJobsOutput)
+	if err := c.do(ctx, http.MethodGet, path, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CancelJob cancels a queued or running job.
+func (c *Client) CancelJob(ctx context.Context, id string) (*api.Job, error) {
+	out := new(api.Job)
+	if err := c.do(ctx, http.MethodDelete, "/admin/jobs/"+url.PathEscape(id), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReloadConfig makes ironbar read its configuration files again, reporting which settings
+// changed. The previous configuration is kept if the files are invalid.
+func (c *Client) ReloadConfig(ctx context.Context) (*api.ReloadConfigOutput, error) {
+	out := new(api.ReloadConfigOutput)
+	if err := c.do(ctx, http.MethodPost, "/admin/reload", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListPins lists the experiments that are exempt from the retention policy.
+func (c *Client) ListPins(ctx context.Context) (*api.ListPinsOutput, error) {
+	out := new(api.ListPinsOutput)
+	if err := c.do(ctx, http.MethodGet, "/admin/pins", nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PinExperiment exempts the records of an experiment from the retention policy so they are
+// kept indefinitely.
+func (c *Client) PinExperiment(ctx context.Context, name string, in *api.PinExperimentInput) (*api.Pin, error) {
+	out := new(api.Pin)
+	if err := c.do(ctx, http.MethodPut, "/admin/pins/"+url.PathEscape(name), in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UnpinExperiment removes the pin from an experiment, returning the remaining pins.
+func (c *Client) UnpinExperiment(ctx context.Context, name string) (*api.ListPinsOutput, error) {
+	out := new(api.ListPinsOutput)
+	if err := c.do(ctx, http.MethodDelete, "/admin/pins/"+url.PathEscape(name), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutPipeline defines a pipeline, returning it unchanged if it already exists with the same stages.
+func (c *Client) PutPipeline(ctx context.Context, name string, in *api.NewPipelineInput) (*api.Pipeline, error) {
+	out := new(api.Pipeline)
+	if err := c.do(ctx, http.MethodPut, "/pipelines/"+url.PathEscape(name), in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetPipeline returns a pipeline with the state of each of its stages.
+func (c *Client) GetPipeline(ctx context.Context, name string) (*api.Pipeline, error) {
+	out := new(api.Pipeline)
+	if err := c.do(ctx, http.MethodGet, "/pipelines/"+url.PathEscape(name), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FailPipelineStage fails a stage of a pipeline that has not finished.
+func (c *Client) FailPipelineStage(ctx context.Context, name string, stage string, in *api.FailPipelineStageInput) (*api.Pipeline, error) {
+	out := new(api.Pipeline)
+	if err := c.do(ctx, http.MethodPost, "/pipelines/"+url.PathEscape(name)+"/stages/"+url.PathEscape(stage)+"/fail", in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var errResp api.ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil {
+			apiErr.Code = errResp.Code
+			apiErr.Message = errResp.Err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			apiErr.Code = api.ErrorCodeNotFound
+			if apiErr.Message == "" {
+				apiErr.Message = ErrNotFound.Error()
+			}
+		}
+		return apiErr
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// defaultCluster is the name of the cluster used by experiments that do not name one.
+const defaultCluster = "default"
+
+// A ClusterCapacity limits the experiments ironbar places in an ecs cluster. A zero value for
+// any limit means it is not enforced.
+type ClusterCapacity struct {
+	MaxVCPUs int `json:"max_vcpus"` // maximum number of vCPUs used by running experiments placed in the cluster
+}
+
+// A ClusterConfig holds the capacity of each cluster experiments may be placed in, keyed by
+// the cluster names used in the thunderdome base infra.
+type ClusterConfig map[string]ClusterCapacity
+
+func LoadClusterConfig(fname string) (ClusterConfig, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open clusters file: %w", err)
+	}
+	defer f.Close()
+
+	cc := make(ClusterConfig)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cc); err != nil {
+		return nil, fmt.Errorf("decode clusters file: %w", err)
+	}
+	return cc, nil
+}
+
+// ClusterFullError reports that none of the clusters an experiment could be placed in has room for it.
+type ClusterFullError struct {
+	Clusters []string
+	Adding   int
+}
+
+func (e *ClusterFullError) Error() string {
+	return fmt.Sprintf("no cluster has room for %d more vCPUs, tried %v", e.Adding, e.Clusters)
+}
+
+// Place chooses the cluster an experiment with the given usage runs in from the candidates,
+// which are in order of preference. The cluster with the most vCPUs to spare once the
+// experiment is added is chosen, preferring earlier candidates when equal. Clusters without a
+// configured capacity are unlimited. Experiments with the same name are ignored since the new
+// experiment replaces them.
+func (cc ClusterConfig) Place(name string, candidates []string, u api.Usage, managed map[string]*ManagedResources) (string, error) {
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	used := make(map[string]int)
+	for _, mr := range managed {
+		if mr.Name == name || !mr.Deleted.IsZero() {
+			continue
+		}
+		used[clusterName(mr.Usage.Cluster)] += mr.Usage.VCPUs
+	}
+
+	best, bestSpare := "", -1
+	for _, c := range candidates {
+		capacity, ok := cc[c]
+		if !ok || capacity.MaxVCPUs == 0 {
+			// an unlimited cluster always has the most room
+			return c, nil
+		}
+		spare := capacity.MaxVCPUs - used[c] - u.VCPUs
+		if spare >= 0 && spare > bestSpare {
+			best, bestSpare = c, spare
+		}
+	}
+	if best == "" {
+		return "", &ClusterFullError{Clusters: candidates, Adding: u.VCPUs}
+	}
+	return best, nil
+}
+
+// clusterName returns the name of the cluster recorded in an experiment's usage.
+func clusterName(name string) string {
+	if name == "" {
+		return defaultCluster
+	}
+	return name
+}
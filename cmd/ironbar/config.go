@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// Settings are the parts of ironbar's configuration that can be changed while it runs, by
+// sending it SIGHUP or with POST /admin/reload. They are replaced rather than modified, so a
+// check or teardown that is running keeps the settings it started with.
+type Settings struct {
+	MonitorInterval   time.Duration
+	Settle            time.Duration
+	ProvisionDeadline time.Duration  // how long after its start an experiment's tasks must be running, zero for no deadline
+	TeardownDeadline  time.Duration  // how long after its end an experiment's resources must be removed, zero for no deadline
+	Webhooks          *WebhookSender // optional, nil if no webhooks are configured
+	Quotas            *QuotaConfig   // optional, nil if quotas are not enforced
+	Clusters          ClusterConfig  // optional, nil if cluster capacity is not limited
+	RequiredMetadata  []string       // metadata fields that experiments must supply
+	MaxRetries        int            // maximum number of failed tasks retried per experiment, zero disables retries
+	AnomalySigma      float64        // standard deviations from its baseline a target must shift to be flagged, zero disables detection
+	AnomalyNotify     bool           // send a webhook for each anomaly flagged
+}
+
+// ConfigFile holds settings that override the command line flags of the same name. It is read
+// again when the configuration is reloaded, along with the quotas and clusters files. Settings
+// it leaves out keep the value of their flag.
+type ConfigFile struct {
+	MonitorInterval   *configDuration `json:"monitor_interval"`
+	Settle            *configDuration `json:"settle"`
+	ProvisionDeadline *configDuration `json:"provision_deadline"`
+	TeardownDeadline  *configDuration `json:"teardown_deadline"`
+	MaxRetries        *int            `json:"max_retries"`
+	RequiredMetadata  []string        `json:"required_metadata"`
+	AnomalySigma      *float64        `json:"anomaly_sigma"`
+	AnomalyNotify     *bool           `json:"anomaly_notify"`
+	Webhooks          *struct {
+		URLs    []string `json:"urls"`
+		Secret  string   `json:"secret"`
+		Retries int      `json:"retries"`
+	} `json:"webhooks"`
+}
+
+// configDuration is a duration written in the config file as a Go duration such as "90s".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"90s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return fmt.Errorf("duration must not be negative: %s", s)
+	}
+	*d = configDuration(v)
+	return nil
+}
+
+func LoadConfigFile(fname string) (*ConfigFile, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+
+	cf := new(ConfigFile)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cf); err != nil {
+		return nil, fmt.Errorf("decode config file: %w", err)
+	}
+	return cf, nil
+}
+
+// LoadSettings builds the settings from the command line flags and the config, quotas and
+// clusters files, reading the files again each time it is called.
+func LoadSettings() (*Settings, error) {
+	st := &Settings{
+		MonitorInterval:   time.Duration(options.monitorInterval) * time.Minute,
+		Settle:            time.Duration(options.settle) * time.Minute,
+		ProvisionDeadline: options.provisionDeadline,
+		TeardownDeadline:  options.teardownDeadline,
+		MaxRetries:        options.maxRetries,
+		AnomalySigma:      options.anomalySigma,
+		AnomalyNotify:     options.anomalyNotify,
+	}
+	metadata := options.requiredMetadata.Value()
+	webhookURLs, webhookSecret, webhookRetries := options.webhookURLs.Value(), options.webhookSecret, options.webhookRetries
+
+	if options.configFile != "" {
+		cf, err := LoadConfigFile(options.configFile)
+		if err != nil {
+			return nil, err
+		}
+		if cf.MonitorInterval != nil {
+			st.MonitorInterval = time.Duration(*cf.MonitorInterval)
+		}
+		if cf.Settle != nil {
+			st.Settle = time.Duration(*cf.Settle)
+		}
+		if cf.ProvisionDeadline != nil {
+			st.ProvisionDeadline = time.Duration(*cf.ProvisionDeadline)
+		}
+		if cf.TeardownDeadline != nil {
+			st.TeardownDeadline = time.Duration(*cf.TeardownDeadline)
+		}
+		if cf.MaxRetries != nil {
+			st.MaxRetries = *cf.MaxRetries
+		}
+		if cf.AnomalySigma != nil {
+			st.AnomalySigma = *cf.AnomalySigma
+		}
+		if cf.AnomalyNotify != nil {
+			st.AnomalyNotify = *cf.AnomalyNotify
+		}
+		if cf.RequiredMetadata != nil {
+			metadata = cf.RequiredMetadata
+		}
+		if cf.Webhooks != nil {
+			webhookURLs, webhookSecret, webhookRetries = cf.Webhooks.URLs, cf.Webhooks.Secret, cf.Webhooks.Retries
+		}
+	}
+	if st.MonitorInterval <= 0 {
+		return nil, fmt.Errorf("monitor interval must be positive")
+	}
+	if st.MaxRetries < 0 {
+		return nil, fmt.Errorf("max retries must not be negative")
+	}
+	if st.AnomalySigma < 0 {
+		return nil, fmt.Errorf("anomaly sigma must not be negative")
+	}
+
+	var err error
+	st.RequiredMetadata, err = ParseRequiredMetadata(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("required metadata: %w", err)
+	}
+
+	if len(webhookURLs) > 0 {
+		st.Webhooks = NewWebhookSender(webhookURLs, webhookSecret, webhookRetries)
+	}
+
+	if options.quotasFile != "" {
+		st.Quotas, err = LoadQuotaConfig(options.quotasFile)
+		if err != nil {
+			return nil, fmt.Errorf("load quotas: %w", err)
+		}
+	}
+
+	if options.clustersFile != "" {
+		st.Clusters, err = LoadClusterConfig(options.clustersFile)
+		if err != nil {
+			return nil, fmt.Errorf("load clusters: %w", err)
+		}
+	}
+
+	return st, nil
+}
+
+// changedSettings returns the names of the settings that differ between old and new.
+func changedSettings(old, new *Settings) []string {
+	var changed []string
+	add := func(name string, differ bool) {
+		if differ {
+			changed = append(changed, name)
+		}
+	}
+	add("monitor_interval", old.MonitorInterval != new.MonitorInterval)
+	add("settle", old.Settle != new.Settle)
+	add("provision_deadline", old.ProvisionDeadline != new.ProvisionDeadline)
+	add("teardown_deadline", old.TeardownDeadline != new.TeardownDeadline)
+	add("max_retries", old.MaxRetries != new.MaxRetries)
+	add("anomaly_sigma", old.AnomalySigma != new.AnomalySigma)
+	add("anomaly_notify", old.AnomalyNotify != new.AnomalyNotify)
+	add("required_metadata", !reflect.DeepEqual(old.RequiredMetadata, new.RequiredMetadata))
+	add("webhooks", !sameWebhooks(old.Webhooks, new.Webhooks))
+	add("quotas", !reflect.DeepEqual(old.Quotas, new.Quotas))
+	add("clusters", !reflect.DeepEqual(old.Clusters, new.Clusters))
+	return changed
+}
+
+func sameWebhooks(a, b *WebhookSender) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(a.URLs, b.URLs) && a.Secret == b.Secret && a.MaxRetries == b.MaxRetries
+}
+
+// Reload reads the configuration again and, if it is valid, replaces the server's settings.
+// The previous settings are kept if it is not. Checks and teardowns in progress finish with the
+// settings they started with and the monitor picks up a changed interval straight away.
+func (s *Server) Reload() (*api.ReloadConfigOutput, error) {
+	st, err := s.loadSettings()
+	if err != nil {
+		slog.Error("failed to reload configuration, keeping the previous configuration", err)
+		return nil, err
+	}
+
+	old := s.settings.Swap(st)
+	changed := changedSettings(old, st)
+	slog.Info("reloaded configuration", "changed", changed)
+
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+	return &api.ReloadConfigOutput{Reloaded: time.Now().UTC(), Changed: changed}, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// adminClient makes the admin calls of segments. A target that does not answer in time is
+// recorded as failed rather than holding up the calls to the other targets.
+var adminClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxAdminErrorBody limits how much of an unsuccessful response is kept in a config change.
+const maxAdminErrorBody = 512
+
+// A configRun is the payload of a config job.
+type configRun struct {
+	Segments []string `json:"segments"` // names of the segments whose admin calls are made, in order
+}
+
+// dueSegments returns the names of the segments of a running experiment that have started but
+// whose admin calls have not been made. Segments start with the measured window recorded by
+// dealgood, as they do in the experiment's summary, so none are due until it has started.
+func (s *Server) dueSegments(ctx context.Context, logger *slog.Logger, mr *ManagedResources, now time.Time) []string {
+	pending := false
+	for _, sd := range mr.Segments {
+		if len(sd.AdminCalls) > 0 && !segmentChanged(mr, sd.Name) {
+			pending = true
+		}
+	}
+	if !pending {
+		return nil
+	}
+
+	start := mr.Start
+	if s.results != nil {
+		window, err := s.results.MeasuredWindow(ctx, mr.Name, mr.Start, now)
+		if err != nil {
+			logger.Error("failed to read measured window", err)
+			return nil
+		}
+		if window == nil {
+			return nil
+		}
+		start = window.Start
+	}
+
+	var due []string
+	starts := segmentStarts(mr.Segments, start)
+	for i, sd := range mr.Segments {
+		if starts[i].After(now) {
+			break
+		}
+		if len(sd.AdminCalls) > 0 && !segmentChanged(mr, sd.Name) {
+			due = append(due, sd.Name)
+		}
+	}
+	return due
+}
+
+// segmentChanged reports whether the admin calls of a segment have been made.
+func segmentChanged(mr *ManagedResources, segment string) bool {
+	for _, c := range mr.Changes {
+		if c.Segment == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// configJob makes the admin calls of each segment that has started, changing the configuration
+// of the experiment's targets while they run. Each call is recorded with its outcome and a
+// segment's calls are not made again if some of them fail, since they may not be idempotent.
+// If the job is stopped part way through a segment, the calls it did not make are recorded as
+// failed along with those it did.
+func (s *Server) configJob(ctx context.Context, j api.Job, payload json.RawMessage) error {
+	var run configRun
+	if err := json.Unmarshal(payload, &run); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+
+	s.mu.Lock()
+	m, ok := s.managed[j.Experiment]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok || !mr.Deleted.IsZero() {
+		return nil
+	}
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		return fmt.Errorf("new aws session: %w", err)
+	}
+	logger := slog.With("experiment", mr.Name, "job", j.ID)
+
+	for _, name := range run.Segments {
+		if ctx.Err() != nil {
+			// segments not yet started are left for the next job
+			return ctx.Err()
+		}
+		if segmentChanged(mr, name) {
+			continue
+		}
+		var seg *definedSegment
+		for i := range mr.Segments {
+			if mr.Segments[i].Name == name {
+				seg = &mr.Segments[i]
+			}
+		}
+		if seg == nil {
+			logger.Warn("segment is not defined, skipping its admin calls", "segment", name)
+			continue
+		}
+
+		logger.Info("changing configuration of targets", "segment", name)
+		var changes []api.ConfigChange
+		failed := 0
+		for _, call := range seg.AdminCalls {
+			for _, target := range adminTargets(mr, call.Targets) {
+				if ctx.Err() != nil {
+					// the segment is not started again once some of its calls have been
+					// made, so the calls left are recorded as failed
+					changes = append(changes, interruptedAdminCall(name, target, call))
+					failed++
+					continue
+				}
+				c := s.callAdmin(ctx, sess, mr, target, call)
+				c.Segment = name
+				if c.Error != "" {
+					logger.Warn("admin call failed", "segment", name, "target", target, "path", c.Path, "error", c.Error)
+					failed++
+				}
+				changes = append(changes, c)
+			}
+		}
+		if len(changes) == 0 {
+			// recorded so that the segment is not found due again
+			changes = append(changes, api.ConfigChange{Segment: name, Time: time.Now().UTC(), Error: "no target has an admin port"})
+			failed++
+		}
+
+		// the calls made are recorded even if the job was stopped part way through them,
+		// since nothing else would
+		rctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		recorded := s.recordConfigChanges(rctx, logger, mr.Name, changes)
+		if recorded {
+			a := api.Annotation{
+				Time: time.Now().UTC(),
+				Text: configAnnotation(name, len(changes), failed),
+			}
+			if err := s.addAnnotation(rctx, mr.Name, a); err != nil {
+				logger.Error("failed to annotate config change", err, "segment", name)
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !recorded {
+			return fmt.Errorf("record config changes of segment %s", name)
+		}
+		mr.Changes = append(mr.Changes, changes...)
+	}
+	return nil
+}
+
+// interruptedAdminCall returns the outcome of an admin call that was not made because its job
+// was stopped.
+func interruptedAdminCall(segment, target string, call adminCall) api.ConfigChange {
+	method := call.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	return api.ConfigChange{
+		Segment: segment,
+		Target:  target,
+		Time:    time.Now().UTC(),
+		Method:  method,
+		Path:    call.Path,
+		Error:   "not made, the job was stopped",
+	}
+}
+
+func configAnnotation(segment string, calls, failed int) string {
+	text := fmt.Sprintf("changed configuration of targets for segment %s", segment)
+	if failed > 0 {
+		text += fmt.Sprintf(" (%d of %d admin calls failed)", failed, calls)
+	}
+	return text
+}
+
+// adminTargets returns the names of the targets an admin call is made to: the named targets,
+// or every target deployed with an admin port if none are named.
+func adminTargets(mr *ManagedResources, named []string) []string {
+	if len(named) > 0 {
+		return named
+	}
+	var targets []string
+	for _, res := range mr.Resources {
+		target, ok := strings.CutPrefix(res.Keys[api.ResourceKeyComponent], targetComponentPrefix)
+		if res.Type == api.ResourceTypeEcsTask && ok && res.Keys[api.ResourceKeyAdminPort] != "" {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// callAdmin sends an admin call to the admin api of a target's task and returns its outcome.
+func (s *Server) callAdmin(ctx context.Context, sess *session.Session, mr *ManagedResources, target string, call adminCall) api.ConfigChange {
+	method := call.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	c := api.ConfigChange{
+		Target: target,
+		Time:   time.Now().UTC(),
+		Method: method,
+		Path:   call.Path,
+	}
+
+	_, res, ok := targetTask(mr, target)
+	if !ok {
+		c.Error = "target not found"
+		return c
+	}
+	port, err := strconv.Atoi(res.Keys[api.ResourceKeyAdminPort])
+	if err != nil || port <= 0 {
+		c.Error = "target was deployed without an admin port"
+		return c
+	}
+	host, err := taskHostAddress(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn])
+	if err != nil {
+		c.Error = fmt.Sprintf("find task address: %v", err)
+		return c
+	}
+
+	var body io.Reader
+	if call.Body != "" {
+		body = strings.NewReader(call.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+host+":"+strconv.Itoa(port)+call.Path, body)
+	if err != nil {
+		c.Error = fmt.Sprintf("new request: %v", err)
+		return c
+	}
+	if call.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.Time = time.Now().UTC()
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	defer resp.Body.Close()
+	c.Status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxAdminErrorBody))
+		c.Error = fmt.Sprintf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return c
+}
+
+// recordConfigChanges adds config changes to a managed experiment and records them.
+func (s *Server) recordConfigChanges(ctx context.Context, logger *slog.Logger, name string, changes []api.ConfigChange) bool {
+	s.mu.Lock()
+	cur, ok := s.managed[name]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	cur.Changes = append(cur.Changes, changes...)
+	changesJSON, err := json.Marshal(cur.Changes)
+	s.mu.Unlock()
+	if err != nil {
+		logger.Error("failed to marshal config changes", err)
+		return false
+	}
+
+	if err := s.db.RecordExperimentConfigChanges(ctx, name, string(changesJSON)); err != nil {
+		logger.Error("failed to record config changes", err)
+		s.checkErrorsCounter.Add(1)
+		return false
+	}
+	return true
+}
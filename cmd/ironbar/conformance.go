@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// conformanceRun is the payload of a conformance job.
+type conformanceRun struct {
+	Phase string `json:"phase"`
+}
+
+// conformanceReport is the summary written by a conformance task as its output.
+type conformanceReport struct {
+	Passed      int      `json:"passed"`
+	Failed      int      `json:"failed"`
+	Skipped     int      `json:"skipped"`
+	FailedTests []string `json:"failed_tests,omitempty"`
+}
+
+// hasConformance reports whether any conformance tasks of a phase were registered with the
+// experiment, or of any phase if phase is empty.
+func hasConformance(mr *ManagedResources, phase string) bool {
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeConformance && (phase == "" || res.Keys[api.ResourceKeyPhase] == phase) {
+			return true
+		}
+	}
+	return false
+}
+
+// conformed reports whether the conformance tasks of a phase have been run for the experiment.
+func conformed(mr *ManagedResources, phase string) bool {
+	for _, p := range mr.Conformed {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// conformanceJob runs the conformance tasks of one phase against the experiment's targets in
+// parallel and records their reports with the experiment's analyses. The phase is marked as
+// run whatever the outcome so that a failing conformance task cannot hold up a teardown.
+func (s *Server) conformanceJob(ctx context.Context, j api.Job, payload json.RawMessage) error {
+	var run conformanceRun
+	if err := json.Unmarshal(payload, &run); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+
+	s.mu.Lock()
+	m, ok := s.managed[j.Experiment]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok || !mr.Deleted.IsZero() {
+		return nil
+	}
+
+	defer func() {
+		s.mu.Lock()
+		if cur, ok := s.managed[mr.Name]; ok && !conformed(cur, run.Phase) {
+			cur.Conformed = append(cur.Conformed, run.Phase)
+		}
+		s.mu.Unlock()
+	}()
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		return fmt.Errorf("new aws session: %w", err)
+	}
+	logger := slog.With("experiment", mr.Name, "job", j.ID, "phase", run.Phase)
+
+	var resources []api.Resource
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeConformance && res.Keys[api.ResourceKeyPhase] == run.Phase {
+			resources = append(resources, res)
+		}
+	}
+	logger.Info("running conformance tests", "targets", len(resources))
+
+	reports := make([]api.Analysis, len(resources))
+	var wg sync.WaitGroup
+	for i := range resources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reports[i] = s.runAnalysis(ctx, sess, logger, *mr, resources[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := s.db.MergeAnalyses(ctx, mr.Name, reports); err != nil {
+		return fmt.Errorf("record conformance reports: %w", err)
+	}
+	return ctx.Err()
+}
+
+// addConformanceFailures sets the number of conformance tests each target failed from the
+// reports recorded with the experiment's analyses, preferring those of the post phase.
+func addConformanceFailures(targets []api.TargetSummary, analyses []api.Analysis) {
+	failed := map[string]float64{}
+	phases := map[string]string{}
+	for _, an := range analyses {
+		// conformance reports are named "conformance <target> <phase>"
+		fields := strings.Fields(an.Name)
+		if len(fields) != 3 || fields[0] != "conformance" || an.Status != api.AnalysisStatusSucceeded {
+			continue
+		}
+		target, phase := fields[1], fields[2]
+		if phases[target] == api.ConformancePhasePost {
+			continue
+		}
+		var report conformanceReport
+		if err := json.Unmarshal(an.Output, &report); err != nil {
+			continue
+		}
+		failed[target] = float64(report.Failed)
+		phases[target] = phase
+	}
+	for i := range targets {
+		if v, ok := failed[targets[i].Target]; ok {
+			targets[i].ConformanceFailed = &v
+		}
+	}
+}
@@ -2,14 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 )
 
 type DB struct {
@@ -23,6 +26,14 @@ type ExperimentRecord struct {
 	End        int64
 	Definition string
 	Resources  string
+	Usage      string // json encoded api.Usage
+	Failures   string // json encoded []api.Failure, empty if there have been none
+	LogMatches string // json encoded []api.LogMatches, empty if there have been none
+	Anomalies  string // json encoded []api.Anomaly, empty if there have been none
+	Restarts   string // json encoded []api.TargetRestart, empty if there have been none
+	Changes    string // json encoded []api.ConfigChange, empty if there have been none
+	Slowest    string // json encoded slowestRecord, empty if dealgood has not reported any
+	Placements string // json encoded []api.TaskPlacement, empty until all tasks are running
 }
 
 var ErrNotFound = errors.New("not found")
@@ -30,9 +41,7 @@ var ErrNotFound = errors.New("not found")
 func (d *DB) RecordExperimentStart(ctx context.Context, rec *ExperimentRecord) error {
 	logger := slog.With("experiment", rec.Name)
 	logger.Info("recording experiment start")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(d.AwsRegion),
-	})
+	sess, err := newAWSSession(d.AwsRegion)
 	if err != nil {
 		return fmt.Errorf("new session: %w", err)
 	}
@@ -57,10 +66,34 @@ func (d *DB) RecordExperimentStart(ctx context.Context, rec *ExperimentRecord) e
 			"resources": {
 				S: aws.String(rec.Resources),
 			},
+			"quota_usage": {
+				S: aws.String(rec.Usage),
+			},
 		},
 	}
+	if rec.Failures != "" {
+		din.Item["failures"] = &dynamodb.AttributeValue{S: aws.String(rec.Failures)}
+	}
+	if rec.LogMatches != "" {
+		din.Item["log_matches"] = &dynamodb.AttributeValue{S: aws.String(rec.LogMatches)}
+	}
+	if rec.Anomalies != "" {
+		din.Item["anomalies"] = &dynamodb.AttributeValue{S: aws.String(rec.Anomalies)}
+	}
+	if rec.Restarts != "" {
+		din.Item["restarts"] = &dynamodb.AttributeValue{S: aws.String(rec.Restarts)}
+	}
+	if rec.Changes != "" {
+		din.Item["config_changes"] = &dynamodb.AttributeValue{S: aws.String(rec.Changes)}
+	}
+	if rec.Slowest != "" {
+		din.Item["slowest_requests"] = &dynamodb.AttributeValue{S: aws.String(rec.Slowest)}
+	}
+	if rec.Placements != "" {
+		din.Item["placements"] = &dynamodb.AttributeValue{S: aws.String(rec.Placements)}
+	}
 
-	if _, err := svc.PutItem(din); err != nil {
+	if _, err := svc.PutItemWithContext(ctx, din); err != nil {
 		return fmt.Errorf("write item: %w", err)
 	}
 
@@ -70,9 +103,7 @@ func (d *DB) RecordExperimentStart(ctx context.Context, rec *ExperimentRecord) e
 func (d *DB) RecordExperimentEnd(ctx context.Context, name string, end int64) error {
 	logger := slog.With("experiment", name)
 	logger.Info("recording experiment end")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(d.AwsRegion),
-	})
+	sess, err := newAWSSession(d.AwsRegion)
 	if err != nil {
 		return fmt.Errorf("new session: %w", err)
 	}
@@ -97,7 +128,239 @@ func (d *DB) RecordExperimentEnd(ctx context.Context, name string, end int64) er
 		},
 	}
 
-	if _, err := svc.UpdateItem(in); err != nil {
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+// RecordExperimentFailures records the failures of an experiment's tasks along with its
+// resources, which include any tasks started to retry them.
+func (d *DB) RecordExperimentFailures(ctx context.Context, name string, resources string, failures string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording experiment failures")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET resources = :r, failures = :f`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":r": {
+				S: aws.String(resources),
+			},
+			":f": {
+				S: aws.String(failures),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentRestarts(ctx context.Context, name string, resources string, restarts string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording experiment restarts")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET resources = :r, restarts = :t`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":r": {
+				S: aws.String(resources),
+			},
+			":t": {
+				S: aws.String(restarts),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentConfigChanges(ctx context.Context, name string, changes string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording experiment config changes")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET config_changes = :c`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":c": {
+				S: aws.String(changes),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentLogMatches(ctx context.Context, name string, matches string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording experiment log matches")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET log_matches = :m`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":m": {
+				S: aws.String(matches),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentAnomalies(ctx context.Context, name string, anomalies string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording experiment anomalies")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET anomalies = :a`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":a": {
+				S: aws.String(anomalies),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentSlowest(ctx context.Context, name string, slowest string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording slowest requests")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET slowest_requests = :s`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				S: aws.String(slowest),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("update item: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DB) RecordExperimentPlacements(ctx context.Context, name string, placements string) error {
+	logger := slog.With("experiment", name)
+	logger.Info("recording task placements")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+		UpdateExpression: aws.String(`SET placements = :p`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {
+				S: aws.String(placements),
+			},
+		},
+	}
+
+	if _, err := svc.UpdateItemWithContext(ctx, in); err != nil {
 		return fmt.Errorf("update item: %w", err)
 	}
 
@@ -107,9 +370,7 @@ func (d *DB) RecordExperimentEnd(ctx context.Context, name string, end int64) er
 func (d *DB) RemoveExperiment(ctx context.Context, name string) error {
 	logger := slog.With("experiment", name)
 	logger.Info("removing experiment")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(d.AwsRegion),
-	})
+	sess, err := newAWSSession(d.AwsRegion)
 	if err != nil {
 		return fmt.Errorf("new session: %w", err)
 	}
@@ -125,7 +386,7 @@ func (d *DB) RemoveExperiment(ctx context.Context, name string) error {
 		},
 	}
 
-	if _, err := svc.DeleteItem(in); err != nil {
+	if _, err := svc.DeleteItemWithContext(ctx, in); err != nil {
 		return fmt.Errorf("delete item: %w", err)
 	}
 
@@ -134,9 +395,7 @@ func (d *DB) RemoveExperiment(ctx context.Context, name string) error {
 
 func (d *DB) ListExperiments(ctx context.Context) ([]ExperimentRecord, error) {
 	slog.Debug("listing experiments")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(d.AwsRegion),
-	})
+	sess, err := newAWSSession(d.AwsRegion)
 	if err != nil {
 		return nil, fmt.Errorf("new session: %w", err)
 	}
@@ -150,10 +409,10 @@ func (d *DB) ListExperiments(ctx context.Context) ([]ExperimentRecord, error) {
 			"#end":   aws.String("end"),
 			"#start": aws.String("start"),
 		},
-		ProjectionExpression: aws.String("#name,#start,#end,resources"),
+		ProjectionExpression: aws.String("#name,#start,#end,resources,quota_usage,failures,log_matches,placements"),
 	}
 
-	out, err := svc.Scan(in)
+	out, err := svc.ScanWithContext(ctx, in)
 	if err != nil {
 		return nil, fmt.Errorf("scan items: %w", err)
 	}
@@ -164,6 +423,9 @@ func (d *DB) ListExperiments(ctx context.Context) ([]ExperimentRecord, error) {
 
 		if nameAtt, ok := it["name"]; ok && nameAtt != nil && nameAtt.S != nil && *nameAtt.S != "" {
 			rec.Name = *nameAtt.S
+			if strings.HasPrefix(rec.Name, ironbarItemPrefix) {
+				continue
+			}
 			slog.Debug("reading experiment record", "name", rec.Name)
 		} else {
 			slog.Warn("no name found for item")
@@ -199,6 +461,38 @@ func (d *DB) ListExperiments(ctx context.Context) ([]ExperimentRecord, error) {
 			continue
 		}
 
+		if usageAtt, ok := it["quota_usage"]; ok && usageAtt != nil && usageAtt.S != nil {
+			rec.Usage = *usageAtt.S
+		}
+
+		if failuresAtt, ok := it["failures"]; ok && failuresAtt != nil && failuresAtt.S != nil {
+			rec.Failures = *failuresAtt.S
+		}
+
+		if matchesAtt, ok := it["log_matches"]; ok && matchesAtt != nil && matchesAtt.S != nil {
+			rec.LogMatches = *matchesAtt.S
+		}
+
+		if anomaliesAtt, ok := it["anomalies"]; ok && anomaliesAtt != nil && anomaliesAtt.S != nil {
+			rec.Anomalies = *anomaliesAtt.S
+		}
+
+		if restartsAtt, ok := it["restarts"]; ok && restartsAtt != nil && restartsAtt.S != nil {
+			rec.Restarts = *restartsAtt.S
+		}
+
+		if changesAtt, ok := it["config_changes"]; ok && changesAtt != nil && changesAtt.S != nil {
+			rec.Changes = *changesAtt.S
+		}
+
+		if slowestAtt, ok := it["slowest_requests"]; ok && slowestAtt != nil && slowestAtt.S != nil {
+			rec.Slowest = *slowestAtt.S
+		}
+
+		if placementsAtt, ok := it["placements"]; ok && placementsAtt != nil && placementsAtt.S != nil {
+			rec.Placements = *placementsAtt.S
+		}
+
 		recs = append(recs, rec)
 	}
 
@@ -207,9 +501,7 @@ func (d *DB) ListExperiments(ctx context.Context) ([]ExperimentRecord, error) {
 
 func (d *DB) GetExperiment(ctx context.Context, name string) (*ExperimentRecord, error) {
 	slog.Debug("getting experiment")
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(d.AwsRegion),
-	})
+	sess, err := newAWSSession(d.AwsRegion)
 	if err != nil {
 		return nil, fmt.Errorf("new session: %w", err)
 	}
@@ -232,7 +524,7 @@ func (d *DB) GetExperiment(ctx context.Context, name string) (*ExperimentRecord,
 		ProjectionExpression: aws.String("#name,#start,#end,resources,definition"),
 	}
 
-	out, err := svc.GetItem(in)
+	out, err := svc.GetItemWithContext(ctx, in)
 	if err != nil {
 		if _, ok := err.(*dynamodb.ResourceNotFoundException); ok {
 			return nil, ErrNotFound
@@ -279,3 +571,649 @@ func (d *DB) GetExperiment(ctx context.Context, name string) (*ExperimentRecord,
 
 	return &rec, nil
 }
+
+// ironbarItemPrefix starts the names of items in the experiments table that hold ironbar's
+// own state rather than an experiment. They cannot clash with an experiment name since those
+// may not contain underscores.
+const ironbarItemPrefix = "__ironbar_"
+
+// adminStateItemName is the name of the item in the experiments table that holds ironbar's
+// maintenance mode and freeze windows.
+const adminStateItemName = ironbarItemPrefix + "admin"
+
+// AdminState is ironbar's administrative state, persisted so it survives restarts.
+type AdminState struct {
+	Maintenance   api.MaintenanceStatus `json:"maintenance"`
+	FreezeWindows []api.FreezeWindow    `json:"freeze_windows"`
+	Pins          []api.Pin             `json:"pins,omitempty"`
+}
+
+func (d *DB) GetAdminState(ctx context.Context) (*AdminState, error) {
+	slog.Debug("getting admin state")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.GetItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(adminStateItemName),
+			},
+		},
+	}
+
+	out, err := svc.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get item: %w", err)
+	}
+
+	st := new(AdminState)
+	if out.Item == nil {
+		return st, nil
+	}
+
+	if stateAtt, ok := out.Item["admin_state"]; ok && stateAtt != nil && stateAtt.S != nil {
+		if err := json.Unmarshal([]byte(*stateAtt.S), st); err != nil {
+			return nil, fmt.Errorf("unmarshal admin state: %w", err)
+		}
+	}
+
+	return st, nil
+}
+
+func (d *DB) PutAdminState(ctx context.Context, st *AdminState) error {
+	slog.Info("recording admin state")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	content, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("marshal admin state: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(adminStateItemName),
+			},
+			"admin_state": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// noiseItemName is the name of the item in the experiments table that holds the noise
+// estimates measured by A/A experiments.
+const noiseItemName = ironbarItemPrefix + "noise"
+
+// maxNoiseEstimates is the number of noise estimates kept, older ones are discarded.
+const maxNoiseEstimates = 50
+
+// GetNoiseEstimates returns the recorded noise estimates, most recent first.
+func (d *DB) GetNoiseEstimates(ctx context.Context) ([]api.NoiseEstimate, error) {
+	slog.Debug("getting noise estimates")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.GetItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(noiseItemName),
+			},
+		},
+	}
+
+	out, err := svc.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get item: %w", err)
+	}
+
+	var estimates []api.NoiseEstimate
+	if out.Item == nil {
+		return estimates, nil
+	}
+
+	if att, ok := out.Item["noise_estimates"]; ok && att != nil && att.S != nil {
+		if err := json.Unmarshal([]byte(*att.S), &estimates); err != nil {
+			return nil, fmt.Errorf("unmarshal noise estimates: %w", err)
+		}
+	}
+
+	return estimates, nil
+}
+
+// AddNoiseEstimate records a new noise estimate, discarding the oldest if there are more
+// than maxNoiseEstimates.
+func (d *DB) AddNoiseEstimate(ctx context.Context, ne api.NoiseEstimate) error {
+	slog.Info("recording noise estimate", "experiment", ne.Experiment)
+	estimates, err := d.GetNoiseEstimates(ctx)
+	if err != nil {
+		return err
+	}
+	estimates = append([]api.NoiseEstimate{ne}, estimates...)
+	if len(estimates) > maxNoiseEstimates {
+		estimates = estimates[:maxNoiseEstimates]
+	}
+
+	content, err := json.Marshal(estimates)
+	if err != nil {
+		return fmt.Errorf("marshal noise estimates: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(noiseItemName),
+			},
+			"noise_estimates": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// analysesItemName returns the name of the item in the experiments table that holds the
+// analyses of an experiment. It is kept after the experiment's own record is removed.
+func analysesItemName(experiment string) string {
+	return ironbarItemPrefix + "analyses_" + experiment
+}
+
+// GetAnalyses returns the analyses recorded for an experiment, or nil if there are none.
+func (d *DB) GetAnalyses(ctx context.Context, experiment string) ([]api.Analysis, error) {
+	slog.Debug("getting analyses", "experiment", experiment)
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.GetItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(analysesItemName(experiment)),
+			},
+		},
+	}
+
+	out, err := svc.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get item: %w", err)
+	}
+
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var analyses []api.Analysis
+	if att, ok := out.Item["analyses"]; ok && att != nil && att.S != nil {
+		if err := json.Unmarshal([]byte(*att.S), &analyses); err != nil {
+			return nil, fmt.Errorf("unmarshal analyses: %w", err)
+		}
+	}
+
+	return analyses, nil
+}
+
+// PutAnalyses records the analyses of an experiment, replacing any recorded before.
+func (d *DB) PutAnalyses(ctx context.Context, experiment string, analyses []api.Analysis) error {
+	slog.Info("recording analyses", "experiment", experiment)
+	content, err := json.Marshal(analyses)
+	if err != nil {
+		return fmt.Errorf("marshal analyses: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(analysesItemName(experiment)),
+			},
+			"analyses": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// MergeAnalyses records analyses of an experiment, replacing any recorded before with the same
+// name and keeping the others, and returns all of the experiment's analyses. Analyses that run
+// at different times, such as conformance tests and those run once the experiment completes,
+// are recorded this way.
+func (d *DB) MergeAnalyses(ctx context.Context, experiment string, analyses []api.Analysis) ([]api.Analysis, error) {
+	existing, err := d.GetAnalyses(ctx, experiment)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make([]api.Analysis, 0, len(existing)+len(analyses))
+	replaced := map[string]bool{}
+	for _, an := range analyses {
+		replaced[an.Name] = true
+	}
+	for _, an := range existing {
+		if !replaced[an.Name] {
+			merged = append(merged, an)
+		}
+	}
+	merged = append(merged, analyses...)
+
+	if err := d.PutAnalyses(ctx, experiment, merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// annotationsItemName returns the name of the item in the experiments table that holds the
+// annotations of an experiment. It is kept after the experiment's own record is removed.
+func annotationsItemName(experiment string) string {
+	return ironbarItemPrefix + "annotations_" + experiment
+}
+
+// GetAnnotations returns the annotations recorded for an experiment, oldest first, or nil if
+// there are none.
+func (d *DB) GetAnnotations(ctx context.Context, experiment string) ([]api.Annotation, error) {
+	slog.Debug("getting annotations", "experiment", experiment)
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.GetItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(annotationsItemName(experiment)),
+			},
+		},
+	}
+
+	out, err := svc.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get item: %w", err)
+	}
+
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var annotations []api.Annotation
+	if att, ok := out.Item["annotations"]; ok && att != nil && att.S != nil {
+		if err := json.Unmarshal([]byte(*att.S), &annotations); err != nil {
+			return nil, fmt.Errorf("unmarshal annotations: %w", err)
+		}
+	}
+
+	return annotations, nil
+}
+
+// PutAnnotations records the annotations of an experiment, replacing any recorded before.
+func (d *DB) PutAnnotations(ctx context.Context, experiment string, annotations []api.Annotation) error {
+	slog.Info("recording annotations", "experiment", experiment)
+	content, err := json.Marshal(annotations)
+	if err != nil {
+		return fmt.Errorf("marshal annotations: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(annotationsItemName(experiment)),
+			},
+			"annotations": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// pipelineItemName returns the name of the item in the experiments table that holds a pipeline.
+func pipelineItemName(name string) string {
+	return ironbarItemPrefix + "pipeline_" + name
+}
+
+// GetPipeline returns a pipeline, or nil if there is none with the name.
+func (d *DB) GetPipeline(ctx context.Context, name string) (*api.Pipeline, error) {
+	slog.Debug("getting pipeline", "pipeline", name)
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.GetItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(pipelineItemName(name)),
+			},
+		},
+	}
+
+	out, err := svc.GetItemWithContext(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get item: %w", err)
+	}
+
+	att, ok := out.Item["pipeline"]
+	if !ok || att == nil || att.S == nil {
+		return nil, nil
+	}
+	p := new(api.Pipeline)
+	if err := json.Unmarshal([]byte(*att.S), p); err != nil {
+		return nil, fmt.Errorf("unmarshal pipeline: %w", err)
+	}
+	return p, nil
+}
+
+// PutPipeline records a pipeline, replacing any recorded before with the same name.
+func (d *DB) PutPipeline(ctx context.Context, p *api.Pipeline) error {
+	slog.Info("recording pipeline", "pipeline", p.Name, "verdict", p.Verdict)
+	content, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("marshal pipeline: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(pipelineItemName(p.Name)),
+			},
+			"pipeline": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// historyItemPrefix starts the names of the items in the experiments table that record
+// completed experiments. One is kept for each run of an experiment.
+const historyItemPrefix = ironbarItemPrefix + "history_"
+
+// PutHistory records a completed experiment in the history.
+func (d *DB) PutHistory(ctx context.Context, it api.ListExperimentsItem) error {
+	slog.Info("recording experiment history", "experiment", it.Name)
+	content, err := json.Marshal(it)
+	if err != nil {
+		return fmt.Errorf("marshal history: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(historyItemPrefix + historyKey(it)),
+			},
+			"history": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// ListHistory returns every completed experiment recorded in the history.
+func (d *DB) ListHistory(ctx context.Context) ([]api.ListExperimentsItem, error) {
+	slog.Debug("listing experiment history")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.ScanInput{
+		TableName: aws.String(d.TableName),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(historyItemPrefix)},
+		},
+		FilterExpression:     aws.String("begins_with(#name, :prefix)"),
+		ProjectionExpression: aws.String("#name,history"),
+	}
+
+	var items []api.ListExperimentsItem
+	err = svc.ScanPagesWithContext(ctx, in, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			att, ok := item["history"]
+			if !ok || att == nil || att.S == nil {
+				continue
+			}
+			var it api.ListExperimentsItem
+			if err := json.Unmarshal([]byte(*att.S), &it); err != nil {
+				slog.Error("failed to unmarshal experiment history", err, "name", aws.StringValue(item["name"].S))
+				continue
+			}
+			items = append(items, it)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan items: %w", err)
+	}
+
+	return items, nil
+}
+
+// DeleteHistory removes a completed experiment from the history.
+func (d *DB) DeleteHistory(ctx context.Context, it api.ListExperimentsItem) error {
+	slog.Info("removing experiment history", "experiment", it.Name, "start", it.Start)
+	return d.deleteItem(ctx, historyItemPrefix+historyKey(it))
+}
+
+// DeleteExperimentData removes the analyses and annotations recorded for an experiment.
+func (d *DB) DeleteExperimentData(ctx context.Context, experiment string) error {
+	slog.Info("removing experiment analyses and annotations", "experiment", experiment)
+	if err := d.deleteItem(ctx, analysesItemName(experiment)); err != nil {
+		return fmt.Errorf("analyses: %w", err)
+	}
+	if err := d.deleteItem(ctx, annotationsItemName(experiment)); err != nil {
+		return fmt.Errorf("annotations: %w", err)
+	}
+	return nil
+}
+
+// jobItemPrefix starts the names of the items in the experiments table that hold jobs that
+// have not finished, so they can be resumed after a restart.
+const jobItemPrefix = ironbarItemPrefix + "job_"
+
+// PutJob records the state of a job.
+func (d *DB) PutJob(ctx context.Context, j *storedJob) error {
+	content, err := json.Marshal(j)
+	if err != nil {
+		return fmt.Errorf("marshal job: %w", err)
+	}
+
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.PutItemInput{
+		TableName: aws.String(d.TableName),
+		Item: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(jobItemPrefix + j.ID),
+			},
+			"job": {
+				S: aws.String(string(content)),
+			},
+		},
+	}
+
+	if _, err := svc.PutItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("write item: %w", err)
+	}
+
+	return nil
+}
+
+// ListJobs returns every job that has been recorded and not deleted.
+func (d *DB) ListJobs(ctx context.Context) ([]*storedJob, error) {
+	slog.Debug("listing jobs")
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.ScanInput{
+		TableName: aws.String(d.TableName),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(jobItemPrefix)},
+		},
+		FilterExpression:     aws.String("begins_with(#name, :prefix)"),
+		ProjectionExpression: aws.String("#name,job"),
+	}
+
+	var jobs []*storedJob
+	err = svc.ScanPagesWithContext(ctx, in, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			att, ok := item["job"]
+			if !ok || att == nil || att.S == nil {
+				continue
+			}
+			j := new(storedJob)
+			if err := json.Unmarshal([]byte(*att.S), j); err != nil {
+				slog.Error("failed to unmarshal job", err, "name", aws.StringValue(item["name"].S))
+				continue
+			}
+			jobs = append(jobs, j)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan items: %w", err)
+	}
+
+	return jobs, nil
+}
+
+// DeleteJob removes the record of a job once it has finished.
+func (d *DB) DeleteJob(ctx context.Context, id string) error {
+	return d.deleteItem(ctx, jobItemPrefix+id)
+}
+
+func (d *DB) deleteItem(ctx context.Context, name string) error {
+	sess, err := newAWSSession(d.AwsRegion)
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.TableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {
+				S: aws.String(name),
+			},
+		},
+	}
+
+	if _, err := svc.DeleteItemWithContext(ctx, in); err != nil {
+		return fmt.Errorf("delete item: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// escalateDeadline records that an operation on an experiment missed its deadline and raises
+// it: an error is logged, the deadlines_exceeded_total metric is counted and, if webhooks are
+// configured, an experiment.deadline_exceeded event is sent. Each operation is escalated once
+// per experiment. Callers must hold s.mu.
+func (s *Server) escalateDeadline(ctx context.Context, mr *ManagedResources, operation string, deadline time.Time, detail string) {
+	for _, d := range mr.Deadlines {
+		if d.Operation == operation {
+			return
+		}
+	}
+
+	d := api.DeadlineExceeded{
+		Operation: operation,
+		Deadline:  deadline,
+		Time:      time.Now().UTC(),
+		Detail:    detail,
+	}
+	mr.Deadlines = append(mr.Deadlines, d)
+
+	slog.Error("experiment missed deadline", fmt.Errorf("%s did not finish by %s", operation, deadline.Format(time.RFC3339)), "experiment", mr.Name, "detail", detail)
+	s.deadlinesCounter.WithLabelValues(operation).Add(1)
+
+	if webhooks := s.settings.Load().Webhooks; webhooks != nil {
+		go webhooks.Send(ctx, &api.WebhookEvent{
+			Event:      api.WebhookEventDeadlineExceeded,
+			Time:       d.Time,
+			Experiment: experimentSummary(mr.clone(), ""),
+			Deadline:   &d,
+		})
+	}
+}
+
+// pendingTasks returns the components of the experiment's tasks that are not yet running.
+// Tasks that have failed are ignored since they are reported as failures.
+func pendingTasks(ctx context.Context, sess *session.Session, mr *ManagedResources) ([]string, error) {
+	var pending []string
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		if taskArn == "" || hasFailure(mr.Failures, taskArn) {
+			continue
+		}
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			return nil, fmt.Errorf("describe task %s: %w", taskArn, err)
+		}
+		if task == nil || aws.StringValue(task.LastStatus) != ecs.DesiredStatusRunning {
+			pending = append(pending, res.Keys[api.ResourceKeyComponent])
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// maxDumpSize limits the size of a single profile read from a target.
+const maxDumpSize = 64 << 20
+
+// dumpProfiles are the pprof profiles captured from targets, keyed by the name of the file
+// they are stored in.
+var dumpProfiles = []struct {
+	file string
+	path string
+}{
+	{file: "goroutine.txt", path: "/debug/pprof/goroutine?debug=2"},
+	{file: "heap.pb.gz", path: "/debug/pprof/heap"},
+}
+
+// A DumpCollector periodically captures goroutine and heap profiles from the debug endpoints
+// of running targets so that, when a target crashes, the last profiles taken before the crash
+// can be stored in s3 for postmortem debugging. Only tasks registered with a debug port are
+// profiled.
+type DumpCollector struct {
+	bucket   string        // s3 bucket that dumps of crashed tasks are stored in
+	kmsKey   string        // key dumps are encrypted with unless their experiment sets its own, the bucket's default if empty
+	interval time.Duration // time between captures from each task
+
+	client *http.Client
+
+	mu    sync.Mutex
+	dumps map[string]*taskDump // most recent dump of each task, keyed by task arn
+}
+
+// A taskDump is a set of profiles captured from a task at the same time.
+type taskDump struct {
+	Time     time.Time
+	Profiles map[string][]byte // keyed by file name
+}
+
+func NewDumpCollector(bucket, kmsKey string, interval time.Duration) *DumpCollector {
+	return &DumpCollector{
+		bucket:   bucket,
+		kmsKey:   kmsKey,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		dumps:    make(map[string]*taskDump),
+	}
+}
+
+// Capture takes new profiles from each of the experiment's tasks whose last capture is older
+// than the collector's interval. It may be called concurrently for different experiments.
+func (c *DumpCollector) Capture(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources) {
+	now := time.Now()
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		port, err := strconv.Atoi(res.Keys[api.ResourceKeyDebugPort])
+		if err != nil || port <= 0 {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		c.mu.Lock()
+		d, ok := c.dumps[taskArn]
+		c.mu.Unlock()
+		if ok && now.Sub(d.Time) < c.interval {
+			continue
+		}
+
+		host, err := taskHostAddress(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			logger.Debug("failed to find task address", "arn", taskArn, "error", err)
+			continue
+		}
+
+		d = &taskDump{
+			Time:     now.UTC(),
+			Profiles: make(map[string][]byte, len(dumpProfiles)),
+		}
+		for _, p := range dumpProfiles {
+			content, err := c.fetch(ctx, "http://"+host+":"+strconv.Itoa(port)+p.path)
+			if err != nil {
+				// the task may be overloaded or restarting, keep the previous dump
+				logger.Debug("failed to capture profile", "arn", taskArn, "profile", p.file, "error", err)
+				continue
+			}
+			d.Profiles[p.file] = content
+		}
+		if len(d.Profiles) > 0 {
+			c.mu.Lock()
+			c.dumps[taskArn] = d
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Store writes the most recent dump captured from a task to s3, encrypted with the experiment's
+// kms key if it has one, and returns the urls of the stored profiles. It returns nil if no dump
+// was captured within three intervals of now.
+func (c *DumpCollector) Store(ctx context.Context, sess *session.Session, mr *ManagedResources, component, taskArn string) ([]string, error) {
+	c.mu.Lock()
+	d, ok := c.dumps[taskArn]
+	c.mu.Unlock()
+	if !ok || time.Since(d.Time) > 3*c.interval {
+		return nil, nil
+	}
+
+	kmsKey := c.kmsKey
+	if mr.KmsKeyArn != "" {
+		kmsKey = mr.KmsKeyArn
+	}
+	prefix := path.Join(mr.Name, component, path.Base(taskArn), d.Time.Format("20060102T150405Z"))
+	var urls []string
+	for _, p := range dumpProfiles {
+		content, ok := d.Profiles[p.file]
+		if !ok {
+			continue
+		}
+		key := prefix + "/" + p.file
+		if err := putS3Object(ctx, sess, c.bucket, key, kmsKey, content); err != nil {
+			return urls, fmt.Errorf("store %s: %w", p.file, err)
+		}
+		urls = append(urls, "s3://"+c.bucket+"/"+key)
+	}
+	c.mu.Lock()
+	delete(c.dumps, taskArn)
+	c.mu.Unlock()
+	return urls, nil
+}
+
+// Forget discards the dumps captured from an experiment's tasks once it has completed.
+func (c *DumpCollector) Forget(mr *ManagedResources) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeEcsTask {
+			delete(c.dumps, res.Keys[api.ResourceKeyArn])
+		}
+	}
+}
+
+func (c *DumpCollector) fetch(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(resp.Body, maxDumpSize)); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return buf.Bytes(), nil
+}
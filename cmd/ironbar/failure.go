@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// CheckFailures looks for tasks of a running experiment that have stopped before the
+// experiment was due to end. The cause of each failure is classified and recorded and, if
+// the cause is transient and the experiment has retries remaining, the task is run again. It
+// reports whether any failures were found. mr should be a copy of the managed experiment since
+// s.mu is not held while ecs is called.
+func (s *Server) CheckFailures(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources, now time.Time) bool {
+	changed := false
+	for i, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		if taskArn == "" || hasFailure(mr.Failures, taskArn) {
+			continue
+		}
+
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			logger.Error("failed to describe task", err, "arn", taskArn, "cluster_arn", clusterArn)
+			s.checkErrorsCounter.Add(1)
+			continue
+		}
+		if task == nil || aws.StringValue(task.LastStatus) != ecs.DesiredStatusStopped {
+			continue
+		}
+		if aws.StringValue(task.StopCode) == ecs.TaskStopCodeUserInitiated {
+			// stopped deliberately, for example by thunderdome teardown
+			continue
+		}
+
+		f := api.Failure{
+			Time:      now,
+			Component: res.Keys[api.ResourceKeyComponent],
+			TaskArn:   taskArn,
+		}
+		f.Cause, f.Reason = classifyFailure(task)
+		logger.Warn("task stopped before experiment ended", "component", f.Component, "arn", taskArn, "cause", f.Cause, "reason", f.Reason)
+
+		if f.Cause == api.FailureCauseCrash && s.dumps != nil {
+			f.Dumps, err = s.dumps.Store(ctx, sess, mr, f.Component, taskArn)
+			if err != nil {
+				logger.Error("failed to store dumps of crashed task", err, "component", f.Component, "arn", taskArn)
+				s.checkErrorsCounter.Add(1)
+			}
+		}
+
+		if isTransientFailure(f.Cause) && retriedCount(mr.Failures) < s.settings.Load().MaxRetries {
+			newArn, err := retryTask(ctx, sess, res)
+			if err != nil {
+				logger.Error("failed to retry task", err, "component", f.Component, "arn", taskArn)
+				s.checkErrorsCounter.Add(1)
+			} else {
+				logger.Info("retried task", "component", f.Component, "arn", newArn, "attempt", retriedCount(mr.Failures)+1)
+				f.Retried = true
+				f.RetryArn = newArn
+				mr.Resources[i] = retriedResource(res, newArn)
+			}
+		}
+
+		mr.Failures = append(mr.Failures, f)
+		changed = true
+	}
+
+	return changed
+}
+
+// classifyFailure returns the cause of a stopped task's failure along with the reasons given
+// by ecs for stopping it.
+func classifyFailure(task *ecs.Task) (string, string) {
+	reasons := []string{}
+	if r := aws.StringValue(task.StoppedReason); r != "" {
+		reasons = append(reasons, r)
+	}
+	exited := false
+	for _, c := range task.Containers {
+		if r := aws.StringValue(c.Reason); r != "" {
+			reasons = append(reasons, aws.StringValue(c.Name)+": "+r)
+		}
+		if c.ExitCode != nil && *c.ExitCode != 0 {
+			exited = true
+			reasons = append(reasons, fmt.Sprintf("%s: exit code %d", aws.StringValue(c.Name), *c.ExitCode))
+		}
+	}
+	reason := strings.Join(reasons, "; ")
+	stopCode := aws.StringValue(task.StopCode)
+
+	switch {
+	case stopCode == ecs.TaskStopCodeSpotInterruption,
+		stopCode == ecs.TaskStopCodeTerminationNotice,
+		strings.Contains(reason, "Host EC2") && strings.Contains(reason, "terminated"):
+		return api.FailureCauseSpotInterruption, reason
+	case containsAny(reason, "CannotPullContainerError", "pull image", "PullImage"):
+		return api.FailureCauseImagePull, reason
+	case containsAny(reason, "Throttling", "ThrottlingException", "Rate exceeded", "RequestLimitExceeded"):
+		return api.FailureCauseThrottling, reason
+	case stopCode == ecs.TaskStopCodeEssentialContainerExited, exited, strings.Contains(reason, "OutOfMemoryError"):
+		return api.FailureCauseCrash, reason
+	}
+	return api.FailureCauseUnknown, reason
+}
+
+func isTransientFailure(cause string) bool {
+	switch cause {
+	case api.FailureCauseSpotInterruption, api.FailureCauseImagePull, api.FailureCauseThrottling:
+		return true
+	}
+	return false
+}
+
+// retryTask runs a task again using the input it was originally run with and returns the
+// arn of the new task.
+func retryTask(ctx context.Context, sess *session.Session, res api.Resource) (string, error) {
+	content, ok := res.Keys[api.ResourceKeyRunTaskInput]
+	if !ok {
+		return "", fmt.Errorf("task was registered without its run task input")
+	}
+	in := new(ecs.RunTaskInput)
+	if err := json.Unmarshal([]byte(content), in); err != nil {
+		return "", fmt.Errorf("decode run task input: %w", err)
+	}
+	return runEcsTask(ctx, sess, in)
+}
+
+// retriedResource returns a copy of a task resource that refers to the task started to
+// replace it.
+func retriedResource(res api.Resource, taskArn string) api.Resource {
+	keys := make(map[string]string, len(res.Keys))
+	for k, v := range res.Keys {
+		keys[k] = v
+	}
+	keys[api.ResourceKeyArn] = taskArn
+	return api.Resource{Type: res.Type, Keys: keys}
+}
+
+func hasFailure(failures []api.Failure, taskArn string) bool {
+	for _, f := range failures {
+		if f.TaskArn == taskArn {
+			return true
+		}
+	}
+	return false
+}
+
+func retriedCount(failures []api.Failure) int {
+	n := 0
+	for _, f := range failures {
+		if f.Retried {
+			n++
+		}
+	}
+	return n
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/prom"
+)
+
+const (
+	// jobQueueSize is the number of jobs that may be waiting for a worker.
+	jobQueueSize = 256
+
+	// maxJobAttempts is the number of times a recorded job is started, counting restarts of
+	// ironbar, before it is abandoned.
+	maxJobAttempts = 3
+
+	// finishedJobRetention is how long finished jobs are kept so they can be listed.
+	finishedJobRetention = 24 * time.Hour
+)
+
+var (
+	ErrJobQueueFull = errors.New("job queue is full")
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job has already finished")
+)
+
+// A JobFunc performs a job. It must return promptly once ctx is done.
+type JobFunc func(ctx context.Context, j api.Job, payload json.RawMessage) error
+
+// jobHandler describes how jobs of a kind are performed.
+type jobHandler struct {
+	fn      JobFunc
+	timeout time.Duration
+	persist bool // whether jobs are recorded in the experiments table so they resume after a restart
+}
+
+// storedJob is a job as it is recorded in the experiments table.
+type storedJob struct {
+	api.Job
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type job struct {
+	storedJob
+	cancel    context.CancelFunc // set while the job is running
+	cancelled bool
+}
+
+// jobKey identifies the queued or running job of a kind for an experiment.
+func jobKey(kind, experiment string) string {
+	return kind + "/" + experiment
+}
+
+// A JobEngine runs ironbar's background work on a bounded pool of workers. Each job runs with
+// its own context, which is cancelled if the job exceeds the timeout for its kind or is
+// cancelled through the admin api, so a stuck AWS call delays only the job that made it. At
+// most one job of each kind may be queued or running for an experiment. Jobs of kinds that
+// would otherwise be lost are recorded in the experiments table until they finish and are
+// resumed when ironbar restarts.
+type JobEngine struct {
+	db       *DB
+	workers  int
+	handlers map[string]jobHandler
+	queue    chan *job
+
+	activeGauge prom.Gauge
+	jobsCounter *prom.CounterVec
+
+	mu      sync.Mutex
+	jobs    map[string]*job // keyed by id
+	active  map[string]*job // queued or running jobs, keyed by jobKey
+	backlog []*job          // resumed jobs waiting for room in the queue
+}
+
+func NewJobEngine(db *DB, workers int) (*JobEngine, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("job engine must have at least one worker")
+	}
+	e := &JobEngine{
+		db:       db,
+		workers:  workers,
+		handlers: make(map[string]jobHandler),
+		queue:    make(chan *job, jobQueueSize),
+		jobs:     make(map[string]*job),
+		active:   make(map[string]*job),
+	}
+
+	var err error
+	e.activeGauge, err = prom.NewPrometheusGauge(
+		appName,
+		"active_jobs",
+		"The number of jobs that are queued or running.",
+		map[string]string{},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new gauge: %w", err)
+	}
+
+	e.jobsCounter, err = prom.NewPrometheusCounterVec(
+		appName,
+		"jobs_total",
+		"The total number of jobs that have finished, by kind and final state.",
+		map[string]string{},
+		"kind", "state",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return e, nil
+}
+
+// Register sets the function that performs jobs of a kind and how long they may run for.
+// Register must be called before the engine is run.
+func (e *JobEngine) Register(kind string, timeout time.Duration, persist bool, fn JobFunc) {
+	e.handlers[kind] = jobHandler{fn: fn, timeout: timeout, persist: persist}
+}
+
+// Resume queues the recorded jobs that had not finished when ironbar last stopped. Jobs that
+// have already been started maxJobAttempts times are abandoned since they are likely to be
+// what stopped it. Jobs that do not fit in the queue are held back and queued as workers take
+// jobs from it.
+func (e *JobEngine) Resume(ctx context.Context) error {
+	stored, err := e.db.ListJobs(ctx)
+	if err != nil {
+		return fmt.Errorf("list jobs: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sj := range stored {
+		logger := slog.With("job", sj.ID, "kind", sj.Kind, "experiment", sj.Experiment)
+		if _, ok := e.handlers[sj.Kind]; !ok {
+			logger.Warn("ignoring job of unknown kind")
+			continue
+		}
+		j := &job{storedJob: *sj}
+		if sj.Attempts >= maxJobAttempts {
+			logger.Error("abandoning job", fmt.Errorf("job was started %d times without finishing", sj.Attempts))
+			j.State = api.JobStateFailed
+			j.Error = "abandoned after restarts"
+			j.Finished = time.Now().UTC()
+			e.jobs[j.ID] = j
+			if err := e.db.DeleteJob(ctx, j.ID); err != nil {
+				logger.Error("failed to remove job record", err)
+			}
+			continue
+		}
+		if err := e.enqueue(j); err != nil {
+			e.track(j)
+			e.backlog = append(e.backlog, j)
+			logger.Info("holding back job until the queue has room", "attempts", j.Attempts)
+			continue
+		}
+		logger.Info("resuming job", "attempts", j.Attempts)
+	}
+	return nil
+}
+
+// Run starts the workers and waits until ctx is done. Running jobs are cancelled when ctx is
+// done but remain recorded so they are resumed after a restart.
+func (e *JobEngine) Run(ctx context.Context) {
+	slog.Info("starting job engine", "workers", e.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-e.queue:
+					e.refill()
+					e.run(ctx, j)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Submit queues a job of a kind for an experiment, returning the job that is already queued
+// or running if there is one. Jobs of recorded kinds are written to the experiments table
+// before they are queued.
+func (e *JobEngine) Submit(ctx context.Context, kind, experiment string, payload any) (api.Job, error) {
+	h, ok := e.handlers[kind]
+	if !ok {
+		return api.Job{}, fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	e.mu.Lock()
+	if j, ok := e.active[jobKey(kind, experiment)]; ok {
+		e.mu.Unlock()
+		return j.Job, nil
+	}
+	e.mu.Unlock()
+
+	j := &job{
+		storedJob: storedJob{
+			Job: api.Job{
+				ID:         newEventID(),
+				Kind:       kind,
+				Experiment: experiment,
+				State:      api.JobStatePending,
+				Created:    time.Now().UTC(),
+			},
+		},
+	}
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return api.Job{}, fmt.Errorf("marshal payload: %w", err)
+		}
+		j.Payload = content
+	}
+	if h.persist {
+		if err := e.db.PutJob(ctx, &j.storedJob); err != nil {
+			return api.Job{}, fmt.Errorf("record job: %w", err)
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if existing, ok := e.active[jobKey(kind, experiment)]; ok {
+		// another job was queued while this one was being recorded
+		j.State = api.JobStateCancelled
+		if h.persist {
+			go e.forget(context.Background(), j)
+		}
+		return existing.Job, nil
+	}
+	if err := e.enqueue(j); err != nil {
+		if h.persist {
+			go e.forget(context.Background(), j)
+		}
+		return api.Job{}, err
+	}
+	return j.Job, nil
+}
+
+// enqueue adds a job to the queue. Callers must hold e.mu.
+func (e *JobEngine) enqueue(j *job) error {
+	e.pruneFinished(time.Now())
+	j.State = api.JobStatePending
+	select {
+	case e.queue <- j:
+	default:
+		return ErrJobQueueFull
+	}
+	e.track(j)
+	return nil
+}
+
+// track records a job as queued. Callers must hold e.mu.
+func (e *JobEngine) track(j *job) {
+	e.jobs[j.ID] = j
+	e.active[jobKey(j.Kind, j.Experiment)] = j
+	e.activeGauge.Set(float64(len(e.active)))
+}
+
+// refill moves held back jobs into the queue while it has room. Jobs cancelled while held back
+// are dropped.
+func (e *JobEngine) refill() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(e.backlog) > 0 {
+		j := e.backlog[0]
+		if j.State == api.JobStatePending {
+			select {
+			case e.queue <- j:
+			default:
+				return
+			}
+		}
+		e.backlog[0] = nil
+		e.backlog = e.backlog[1:]
+	}
+}
+
+// Cancel stops a queued or running job.
+func (e *JobEngine) Cancel(id string) (api.Job, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	j, ok := e.jobs[id]
+	if !ok {
+		return api.Job{}, ErrJobNotFound
+	}
+	if e.active[jobKey(j.Kind, j.Experiment)] != j {
+		return j.Job, ErrJobFinished
+	}
+	e.cancelLocked(j)
+	return j.Job, nil
+}
+
+// CancelExperiment stops the queued or running job of a kind for an experiment, if there is one.
+func (e *JobEngine) CancelExperiment(kind, experiment string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if j, ok := e.active[jobKey(kind, experiment)]; ok {
+		e.cancelLocked(j)
+	}
+}
+
+// cancelLocked stops a job. A running job finishes once its function returns, a queued job is
+// finished immediately and skipped by the worker that takes it. Callers must hold e.mu.
+func (e *JobEngine) cancelLocked(j *job) {
+	slog.Info("cancelling job", "job", j.ID, "kind", j.Kind, "experiment", j.Experiment)
+	j.cancelled = true
+	if j.cancel != nil {
+		j.cancel()
+		return
+	}
+	e.finishLocked(j, api.JobStateCancelled, "")
+	if e.handlers[j.Kind].persist {
+		go e.forget(context.Background(), j)
+	}
+}
+
+// List returns the jobs that are queued, running or finished within finishedJobRetention,
+// most recently created first. If experiment is not empty only its jobs are listed.
+func (e *JobEngine) List(experiment string) []api.Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pruneFinished(time.Now())
+	jobs := []api.Job{}
+	for _, j := range e.jobs {
+		if experiment == "" || j.Experiment == experiment {
+			jobs = append(jobs, j.Job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	return jobs
+}
+
+func (e *JobEngine) run(ctx context.Context, j *job) {
+	h := e.handlers[j.Kind]
+
+	e.mu.Lock()
+	if j.State != api.JobStatePending {
+		// cancelled while queued
+		e.mu.Unlock()
+		return
+	}
+	jctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	j.cancel = cancel
+	j.State = api.JobStateRunning
+	j.Started = time.Now().UTC()
+	j.Attempts++
+	sj := j.storedJob
+	e.mu.Unlock()
+
+	logger := slog.With("job", j.ID, "kind", j.Kind, "experiment", j.Experiment)
+	logger.Debug("starting job", "attempt", sj.Attempts)
+	if h.persist {
+		if err := e.db.PutJob(jctx, &sj); err != nil {
+			logger.Error("failed to record job", err)
+		}
+	}
+
+	err := h.fn(jctx, sj.Job, sj.Payload)
+	if ctx.Err() != nil {
+		// ironbar is stopping, leave the job recorded as running so that it is resumed
+		logger.Info("job interrupted by shutdown")
+		return
+	}
+
+	e.mu.Lock()
+	j.cancel = nil
+	switch {
+	case j.cancelled:
+		e.finishLocked(j, api.JobStateCancelled, "")
+	case err != nil:
+		if errors.Is(jctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s: %w", h.timeout, err)
+		}
+		e.finishLocked(j, api.JobStateFailed, err.Error())
+	default:
+		e.finishLocked(j, api.JobStateSucceeded, "")
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		logger.Error("job failed", err)
+	} else {
+		logger.Debug("job finished", "state", j.State)
+	}
+	if h.persist {
+		e.forget(ctx, j)
+	}
+}
+
+// finishLocked records the final state of a job. Callers must hold e.mu.
+func (e *JobEngine) finishLocked(j *job, state string, reason string) {
+	j.State = state
+	j.Error = reason
+	j.Finished = time.Now().UTC()
+	if e.active[jobKey(j.Kind, j.Experiment)] == j {
+		delete(e.active, jobKey(j.Kind, j.Experiment))
+	}
+	e.activeGauge.Set(float64(len(e.active)))
+	e.jobsCounter.WithLabelValues(j.Kind, state).Add(1)
+}
+
+// forget removes the record of a finished job from the experiments table.
+func (e *JobEngine) forget(ctx context.Context, j *job) {
+	if err := e.db.DeleteJob(ctx, j.ID); err != nil {
+		slog.Error("failed to remove job record", err, "job", j.ID)
+	}
+}
+
+// pruneFinished discards jobs that finished more than finishedJobRetention ago. Callers must
+// hold e.mu.
+func (e *JobEngine) pruneFinished(now time.Time) {
+	for id, j := range e.jobs {
+		if !j.Finished.IsZero() && now.Sub(j.Finished) > finishedJobRetention {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// submitJob submits a job, logging any failure to do so. The monitor submits its jobs again
+// on its next check so failures are not returned.
+func (s *Server) submitJob(ctx context.Context, logger *slog.Logger, kind, experiment string, payload any) {
+	if _, err := s.jobs.Submit(ctx, kind, experiment, payload); err != nil {
+		logger.Error("failed to submit job", err, "kind", kind)
+		s.checkErrorsCounter.Add(1)
+	}
+}
+
+// ListJobsHandler lists ironbar's recent jobs, optionally only those of an experiment.
+func (s *Server) ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	out := &api.ListJobsOutput{
+		Items: s.jobs.List(r.URL.Query().Get("experiment")),
+	}
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+// CancelJobHandler cancels a queued or running job. Jobs submitted by the monitor, such as
+// checks and teardowns, are submitted again on its next check.
+func (s *Server) CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := s.jobs.Cancel(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		s.NotFound(w, r, err)
+		return
+	case errors.Is(err, ErrJobFinished):
+		s.WriteError(w, http.StatusConflict, api.ErrorCodeConflict, err)
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, &j)
+}
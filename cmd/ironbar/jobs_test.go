@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+func TestJobEngineRefill(t *testing.T) {
+	e, err := NewJobEngine(nil, 1)
+	if err != nil {
+		t.Fatalf("new job engine: %v", err)
+	}
+	newJob := func(i int) *job {
+		return &job{storedJob: storedJob{Job: api.Job{ID: fmt.Sprint(i), Kind: "k", Experiment: fmt.Sprint("exp", i)}}}
+	}
+
+	e.mu.Lock()
+	for i := 0; i < jobQueueSize; i++ {
+		if err := e.enqueue(newJob(i)); err != nil {
+			t.Fatalf("enqueue job %d: %v", i, err)
+		}
+	}
+	// the jobs that do not fit are held back as Resume does
+	var held []*job
+	for i := jobQueueSize; i < jobQueueSize+3; i++ {
+		j := newJob(i)
+		if err := e.enqueue(j); err != ErrJobQueueFull {
+			t.Fatalf("enqueue job %d: got %v, wanted %v", i, err, ErrJobQueueFull)
+		}
+		e.track(j)
+		e.backlog = append(e.backlog, j)
+		held = append(held, j)
+	}
+	e.cancelLocked(held[1])
+	e.mu.Unlock()
+
+	// each job taken from the queue makes room for one held back job, skipping cancelled ones
+	<-e.queue
+	e.refill()
+	if len(e.backlog) != 1 {
+		t.Fatalf("got %d held back jobs, wanted 1", len(e.backlog))
+	}
+	<-e.queue
+	e.refill()
+	if len(e.backlog) != 0 {
+		t.Fatalf("got %d held back jobs, wanted none", len(e.backlog))
+	}
+	if len(e.queue) != jobQueueSize {
+		t.Errorf("got %d queued jobs, wanted %d", len(e.queue), jobQueueSize)
+	}
+
+	// the held back jobs are the last in the queue
+	for i := 0; i < jobQueueSize-2; i++ {
+		<-e.queue
+	}
+	for _, want := range []*job{held[0], held[2]} {
+		if got := <-e.queue; got != want {
+			t.Errorf("got job %s, wanted %s", got.ID, want.ID)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListExperimentsHandler lists the running and recently stopped experiments, and completed
+// experiments from the history if asked, filtered, sorted and paged by the query parameters.
+func (s *Server) ListExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	in, err := parseListExperimentsQuery(r.URL.Query())
+	if err != nil {
+		s.BadRequest(w, r, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var items []api.ListExperimentsItem
+	seen := map[string]bool{}
+
+	s.mu.Lock()
+	pinned := s.pinnedExperiments()
+	for _, mr := range s.managed {
+		it := listItem(mr, now)
+		seen[historyKey(it)] = true
+		items = append(items, it)
+	}
+	s.mu.Unlock()
+
+	if in.All {
+		history, err := s.db.ListHistory(ctx)
+		if err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to read experiment history: %w", err))
+			return
+		}
+		for _, it := range history {
+			if !seen[historyKey(it)] {
+				items = append(items, it)
+			}
+		}
+	}
+
+	for i := range items {
+		items[i].Pinned = pinned[items[i].Name]
+	}
+
+	out, err := listExperiments(items, in, now)
+	if err != nil {
+		s.BadRequest(w, r, err)
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+// recordHistory keeps a record of a completed experiment in the history so it can still be
+// listed once ironbar has forgotten it.
+func (s *Server) recordHistory(ctx context.Context, mr *ManagedResources) {
+	if err := s.db.PutHistory(ctx, listItem(mr, time.Now().UTC())); err != nil {
+		slog.Error("failed to record experiment history", err, "experiment", mr.Name)
+		s.checkErrorsCounter.Add(1)
+	}
+}
+
+// listItem describes a managed experiment in a listing.
+func listItem(mr *ManagedResources, now time.Time) api.ListExperimentsItem {
+	it := api.ListExperimentsItem{
+		Name:    mr.Name,
+		Start:   mr.Start,
+		End:     mr.End,
+		Stopped: mr.Deleted,
+		Owner:   mr.Usage.Owner,
+		Team:    mr.Usage.Team,
+		Purpose: mr.Usage.Purpose,
+		Ticket:  mr.Usage.Ticket,
+		Labels:  mr.Usage.Labels,
+	}
+	switch {
+	case !mr.Deleted.IsZero():
+		it.Status = api.ListStatusStopped
+	case now.After(mr.End):
+		it.Status = api.ListStatusStopping
+	default:
+		it.Status = api.ListStatusRunning
+	}
+	return it
+}
+
+// historyKey identifies a single run of an experiment, since names may be reused.
+func historyKey(it api.ListExperimentsItem) string {
+	return it.Name + "_" + strconv.FormatInt(it.Start.UnixNano(), 10)
+}
+
+// parseListExperimentsQuery reads the filters, sort order and page of an experiment listing
+// from url query parameters.
+func parseListExperimentsQuery(q url.Values) (*api.ListExperimentsInput, error) {
+	in := &api.ListExperimentsInput{
+		Status:    q.Get("status"),
+		Owner:     q.Get("owner"),
+		Team:      q.Get("team"),
+		Sort:      q.Get("sort"),
+		PageToken: q.Get("page_token"),
+	}
+
+	switch in.Status {
+	case "", api.ListStatusRunning, api.ListStatusStopping, api.ListStatusStopped:
+	default:
+		return nil, fmt.Errorf("unsupported status %q, expected one of running, stopping or stopped", in.Status)
+	}
+
+	for _, l := range q["label"] {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("label must be given as KEY=VALUE: %q", l)
+		}
+		if in.Labels == nil {
+			in.Labels = map[string]string{}
+		}
+		in.Labels[k] = v
+	}
+
+	var err error
+	if v := q.Get("min_age"); v != "" {
+		if in.MinAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("min_age: %w", err)
+		}
+	}
+	if v := q.Get("max_age"); v != "" {
+		if in.MaxAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("max_age: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if in.Limit, err = strconv.Atoi(v); err != nil || in.Limit < 0 {
+			return nil, fmt.Errorf("limit must be a non-negative integer: %q", v)
+		}
+	}
+	if v := q.Get("all"); v != "" {
+		if in.All, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("all: %w", err)
+		}
+	}
+
+	return in, nil
+}
+
+// listExperiments filters, sorts and pages a set of experiments. Pages are offsets into the
+// sorted results, so experiments starting or stopping between requests may shift items across
+// page boundaries.
+func listExperiments(items []api.ListExperimentsItem, in *api.ListExperimentsInput, now time.Time) (*api.ListExperimentsOutput, error) {
+	matched := make([]api.ListExperimentsItem, 0, len(items))
+	for _, it := range items {
+		if listMatches(it, in, now) {
+			matched = append(matched, it)
+		}
+	}
+
+	field, desc := strings.TrimPrefix(in.Sort, "-"), strings.HasPrefix(in.Sort, "-")
+	if in.Sort == "" {
+		field, desc = "start", true
+	}
+	var less func(a, b api.ListExperimentsItem) bool
+	switch field {
+	case "name":
+		less = func(a, b api.ListExperimentsItem) bool { return a.Name < b.Name }
+	case "start":
+		less = func(a, b api.ListExperimentsItem) bool { return a.Start.Before(b.Start) }
+	case "end":
+		less = func(a, b api.ListExperimentsItem) bool { return a.End.Before(b.End) }
+	default:
+		return nil, fmt.Errorf("unsupported sort %q, expected one of name, start or end, optionally prefixed with -", in.Sort)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	limit := in.Limit
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	offset := 0
+	if in.PageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(in.PageToken)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid page token: %q", in.PageToken)
+		}
+	}
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+
+	out := &api.ListExperimentsOutput{
+		Items: []api.ListExperimentsItem{},
+	}
+	end := offset + limit
+	if end < len(matched) {
+		out.NextPageToken = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+	out.Items = append(out.Items, matched[offset:end]...)
+	return out, nil
+}
+
+func listMatches(it api.ListExperimentsItem, in *api.ListExperimentsInput, now time.Time) bool {
+	if in.Status != "" && it.Status != in.Status {
+		return false
+	}
+	if in.Owner != "" && it.Owner != in.Owner {
+		return false
+	}
+	if in.Team != "" && it.Team != in.Team {
+		return false
+	}
+	for k, v := range in.Labels {
+		if lv, ok := it.Labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	age := now.Sub(it.Start)
+	if in.MinAge > 0 && age < in.MinAge {
+		return false
+	}
+	if in.MaxAge > 0 && age > in.MaxAge {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/prom"
+)
+
+const (
+	maxLogExcerpts       = 5   // number of matching lines kept for each component and pattern
+	maxLogExcerptLength  = 500 // matching lines are truncated to this many bytes
+	maxLogPagesPerStream = 10  // limits the events read from a single stream in each check
+)
+
+// A LogPattern is a regular expression matched against each line a target writes to its logs.
+type LogPattern struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+
+	re *regexp.Regexp
+}
+
+// defaultLogPatterns find the problems that are not visible in latency graphs.
+var defaultLogPatterns = []LogPattern{
+	{Name: "panic", Regex: `panic: |goroutine \d+ \[running\]`},
+	{Name: "oom", Regex: `(?i)out of memory|OOMKilled|oom-kill`},
+	{Name: "deadline_exceeded", Regex: `context deadline exceeded`},
+}
+
+// LoadLogPatterns reads a JSON array of log patterns from a file, or returns the default
+// patterns if fname is empty.
+func LoadLogPatterns(fname string) ([]LogPattern, error) {
+	patterns := defaultLogPatterns
+	if fname != "" {
+		content, err := os.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("read file: %w", err)
+		}
+		patterns = nil
+		if err := json.Unmarshal(content, &patterns); err != nil {
+			return nil, fmt.Errorf("unmarshal: %w", err)
+		}
+	}
+
+	out := make([]LogPattern, 0, len(patterns))
+	for _, p := range patterns {
+		if p.Name == "" {
+			return nil, fmt.Errorf("log pattern must have a name")
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("log pattern %s: %w", p.Name, err)
+		}
+		p.re = re
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// A LogWatcher tails the cloudwatch logs of the tasks of running experiments, counting the
+// lines that match each of its patterns and keeping a few excerpts of them.
+type LogWatcher struct {
+	patterns   []LogPattern
+	containers map[string]bool // names of the containers whose logs are watched
+
+	matchesCounter *prom.CounterVec
+
+	mu       sync.Mutex                     // guards taskDefs and cursors since experiments are checked concurrently
+	taskDefs map[string]*ecs.TaskDefinition // task definitions of watched tasks, keyed by arn
+	cursors  map[string]int64               // time in milliseconds to read each log stream from, keyed by stream name
+}
+
+func NewLogWatcher(patterns []LogPattern, containers []string) (*LogWatcher, error) {
+	w := &LogWatcher{
+		patterns:   patterns,
+		containers: make(map[string]bool, len(containers)),
+		taskDefs:   make(map[string]*ecs.TaskDefinition),
+		cursors:    make(map[string]int64),
+	}
+	for _, c := range containers {
+		w.containers[c] = true
+	}
+
+	var err error
+	w.matchesCounter, err = prom.NewPrometheusCounterVec(
+		appName,
+		"target_log_matches_total",
+		"The total number of lines written to the logs of experiment tasks that matched a log pattern.",
+		map[string]string{},
+		"experiment", "component", "pattern",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return w, nil
+}
+
+// Check reads the log lines written by the experiment's tasks since the previous check and
+// records matches in mr.LogMatches. It returns true if any were found. mr should be a copy of
+// the managed experiment since s.mu is not held while the logs are read.
+func (w *LogWatcher) Check(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources) bool {
+	changed := false
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		if taskArn == "" {
+			continue
+		}
+		component := res.Keys[api.ResourceKeyComponent]
+
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			logger.Error("failed to describe task", err, "arn", taskArn, "cluster_arn", clusterArn)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+
+		td, err := w.taskDefinition(ctx, sess, aws.StringValue(task.TaskDefinitionArn))
+		if err != nil {
+			logger.Error("failed to describe task definition", err, "arn", aws.StringValue(task.TaskDefinitionArn))
+			continue
+		}
+
+		for _, c := range td.ContainerDefinitions {
+			if !w.containers[aws.StringValue(c.Name)] {
+				continue
+			}
+			if c.LogConfiguration == nil || aws.StringValue(c.LogConfiguration.LogDriver) != "awslogs" {
+				continue
+			}
+			opts := c.LogConfiguration.Options
+			group := aws.StringValue(opts["awslogs-group"])
+			stream := path.Join(aws.StringValue(opts["awslogs-stream-prefix"]), aws.StringValue(c.Name), path.Base(taskArn))
+
+			w.mu.Lock()
+			start, ok := w.cursors[stream]
+			w.mu.Unlock()
+			if !ok {
+				start = mr.Start.UnixMilli()
+			}
+			err := filterLogEvents(ctx, sess, group, stream, start, maxLogPagesPerStream, func(ev *cloudwatchlogs.FilteredLogEvent) {
+				if ts := aws.Int64Value(ev.Timestamp); ts >= start {
+					start = ts + 1
+				}
+				if w.match(mr, component, aws.StringValue(ev.Message)) {
+					changed = true
+				}
+			})
+			w.mu.Lock()
+			w.cursors[stream] = start
+			w.mu.Unlock()
+			if err != nil {
+				logger.Error("failed to read task logs", err, "component", component, "stream", stream)
+			}
+		}
+	}
+	return changed
+}
+
+// Forget discards the state kept for an experiment's tasks once it has completed.
+func (w *LogWatcher) Forget(mr *ManagedResources) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, res := range mr.Resources {
+		if res.Type == api.ResourceTypeEcsTaskDefinition {
+			delete(w.taskDefs, res.Keys[api.ResourceKeyArn])
+			continue
+		}
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		suffix := "/" + path.Base(res.Keys[api.ResourceKeyArn])
+		for stream := range w.cursors {
+			if strings.HasSuffix(stream, suffix) {
+				delete(w.cursors, stream)
+			}
+		}
+	}
+}
+
+func (w *LogWatcher) taskDefinition(ctx context.Context, sess *session.Session, arn string) (*ecs.TaskDefinition, error) {
+	w.mu.Lock()
+	td, ok := w.taskDefs[arn]
+	w.mu.Unlock()
+	if ok {
+		return td, nil
+	}
+	td, err := describeEcsTaskDefinition(ctx, sess, arn)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.taskDefs[arn] = td
+	w.mu.Unlock()
+	return td, nil
+}
+
+// match records a line in mr.LogMatches for each pattern it matches and reports whether it
+// matched any.
+func (w *LogWatcher) match(mr *ManagedResources, component string, line string) bool {
+	matched := false
+	for _, p := range w.patterns {
+		if !p.re.MatchString(line) {
+			continue
+		}
+		matched = true
+		w.matchesCounter.WithLabelValues(mr.Name, component, p.Name).Add(1)
+
+		var lm *api.LogMatches
+		for i := range mr.LogMatches {
+			if mr.LogMatches[i].Component == component && mr.LogMatches[i].Pattern == p.Name {
+				lm = &mr.LogMatches[i]
+				break
+			}
+		}
+		if lm == nil {
+			mr.LogMatches = append(mr.LogMatches, api.LogMatches{Component: component, Pattern: p.Name})
+			lm = &mr.LogMatches[len(mr.LogMatches)-1]
+		}
+		lm.Count++
+		if len(lm.Excerpts) < maxLogExcerpts {
+			if len(line) > maxLogExcerptLength {
+				line = line[:maxLogExcerptLength]
+			}
+			lm.Excerpts = append(lm.Excerpts, strings.TrimSpace(line))
+		}
+	}
+	return matched
+}
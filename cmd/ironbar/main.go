@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/urfave/cli/v2"
@@ -11,9 +13,13 @@ import (
 
 	"github.com/plprobelab/thunderdome/pkg/prom"
 	"github.com/plprobelab/thunderdome/pkg/run"
+	"github.com/plprobelab/thunderdome/pkg/version"
 )
 
 func main() {
+	// -v is the alias of --verbose, so --version has none
+	cli.VersionFlag = &cli.BoolFlag{Name: "version", Usage: "print the version"}
+
 	ctx := context.Background()
 	if err := app.RunContext(ctx, os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
@@ -30,6 +36,38 @@ var options struct {
 	experimentsTableName string
 	monitorInterval      int
 	settle               int
+	provisionDeadline    time.Duration
+	teardownDeadline     time.Duration
+	rulesURL             string
+	rulesUser            string
+	rulesToken           string
+	rulesNamespace       string
+	rulesInterval        time.Duration
+	webhookURLs          cli.StringSlice
+	webhookSecret        string
+	webhookRetries       int
+	resultsURL           string
+	resultsUser          string
+	resultsToken         string
+	anomalySigma         float64
+	anomalyNotify        bool
+	grafanaURL           string
+	grafanaToken         string
+	watchLogs            bool
+	logPatternsFile      string
+	logContainers        cli.StringSlice
+	dumpsBucket          string
+	dumpInterval         time.Duration
+	quotasFile           string
+	clustersFile         string
+	retention            time.Duration
+	archiveBucket        string
+	kmsKeyArn            string
+	configFile           string
+	requiredMetadata     cli.StringSlice
+	adminToken           string
+	maxRetries           int
+	jobWorkers           int
 }
 
 const (
@@ -41,6 +79,7 @@ var app = &cli.App{
 	Name:        appName,
 	HelpName:    appName,
 	Description: "ironbar is a service for managing experiments",
+	Version:     version.String(),
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:        "addr",
@@ -104,6 +143,228 @@ var app = &cli.App{
 			EnvVars:     []string{envPrefix + "SETTLE"},
 			Destination: &options.settle,
 		},
+		&cli.DurationFlag{
+			Name:        "provision-deadline",
+			Usage:       "How long after an experiment starts its tasks must all be running before the delay is escalated. Zero disables the deadline.",
+			Value:       15 * time.Minute,
+			EnvVars:     []string{envPrefix + "PROVISION_DEADLINE"},
+			Destination: &options.provisionDeadline,
+		},
+		&cli.DurationFlag{
+			Name:        "teardown-deadline",
+			Usage:       "How long after an experiment ends its resources must all be removed before the delay is escalated. Zero disables the deadline.",
+			Value:       10 * time.Minute,
+			EnvVars:     []string{envPrefix + "TEARDOWN_DEADLINE"},
+			Destination: &options.teardownDeadline,
+		},
+		&cli.StringFlag{
+			Name:        "rules-url",
+			Usage:       "Base URL of a Prometheus ruler API, such as Grafana Cloud or Mimir, used to install recording rules for each experiment. Recording rules are not managed if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RULES_URL"},
+			Destination: &options.rulesURL,
+		},
+		&cli.StringFlag{
+			Name:        "rules-user",
+			Usage:       "The user name used to authenticate with the ruler API.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RULES_USER"},
+			Destination: &options.rulesUser,
+		},
+		&cli.StringFlag{
+			Name:        "rules-token",
+			Usage:       "The token used to authenticate with the ruler API.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RULES_TOKEN"},
+			Destination: &options.rulesToken,
+		},
+		&cli.StringFlag{
+			Name:        "rules-namespace",
+			Usage:       "The namespace that experiment recording rules are created in.",
+			Value:       "thunderdome",
+			EnvVars:     []string{envPrefix + "RULES_NAMESPACE"},
+			Destination: &options.rulesNamespace,
+		},
+		&cli.DurationFlag{
+			Name:        "rules-interval",
+			Usage:       "The evaluation interval of experiment recording rules.",
+			Value:       time.Minute,
+			EnvVars:     []string{envPrefix + "RULES_INTERVAL"},
+			Destination: &options.rulesInterval,
+		},
+		&cli.StringSliceFlag{
+			Name:        "webhook-url",
+			Usage:       "URL that a webhook carrying a summary of the experiment's results is posted to when an experiment completes. May be repeated.",
+			EnvVars:     []string{envPrefix + "WEBHOOK_URL"},
+			Destination: &options.webhookURLs,
+		},
+		&cli.StringFlag{
+			Name:        "webhook-secret",
+			Usage:       "Secret used to sign webhooks with HMAC-SHA256. Webhooks are not signed if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "WEBHOOK_SECRET"},
+			Destination: &options.webhookSecret,
+		},
+		&cli.IntFlag{
+			Name:        "webhook-retries",
+			Usage:       "The number of times delivery of a webhook is retried, with exponential backoff, before it is abandoned.",
+			Value:       5,
+			EnvVars:     []string{envPrefix + "WEBHOOK_RETRIES"},
+			Destination: &options.webhookRetries,
+		},
+		&cli.StringFlag{
+			Name:        "results-url",
+			Usage:       "Base URL of the Prometheus query API that experiment metrics are written to, used to include per target results in webhooks and to answer experiment queries. Results are not included if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RESULTS_URL"},
+			Destination: &options.resultsURL,
+		},
+		&cli.StringFlag{
+			Name:        "results-user",
+			Usage:       "The user name used to authenticate with the Prometheus query API.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RESULTS_USER"},
+			Destination: &options.resultsUser,
+		},
+		&cli.StringFlag{
+			Name:        "results-token",
+			Usage:       "The token used to authenticate with the Prometheus query API.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "RESULTS_TOKEN"},
+			Destination: &options.resultsToken,
+		},
+		&cli.Float64Flag{
+			Name:        "anomaly-sigma",
+			Usage:       "Flag a sudden shift in a target's error ratio or p99 time to first byte while an experiment runs when it is more than this many standard deviations from the target's moving baseline. Requires --results-url. Zero disables anomaly detection.",
+			Value:       0,
+			EnvVars:     []string{envPrefix + "ANOMALY_SIGMA"},
+			Destination: &options.anomalySigma,
+		},
+		&cli.BoolFlag{
+			Name:        "anomaly-notify",
+			Usage:       "Send an experiment.anomaly_detected webhook for each anomaly flagged.",
+			Value:       false,
+			EnvVars:     []string{envPrefix + "ANOMALY_NOTIFY"},
+			Destination: &options.anomalyNotify,
+		},
+		&cli.StringFlag{
+			Name:        "grafana-url",
+			Usage:       "Base URL of a Grafana instance that experiment annotations are copied to so they are shown on dashboards. Annotations are not copied if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "GRAFANA_URL"},
+			Destination: &options.grafanaURL,
+		},
+		&cli.StringFlag{
+			Name:        "grafana-token",
+			Usage:       "Service account token used to write annotations to Grafana.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "GRAFANA_TOKEN"},
+			Destination: &options.grafanaToken,
+		},
+		&cli.BoolFlag{
+			Name:        "watch-logs",
+			Usage:       "Tail the logs of running experiments' targets for patterns such as panics and out of memory errors, counting matches and recording excerpts with the experiment.",
+			Value:       false,
+			EnvVars:     []string{envPrefix + "WATCH_LOGS"},
+			Destination: &options.watchLogs,
+		},
+		&cli.StringFlag{
+			Name:        "log-patterns-file",
+			Usage:       "Path to a JSON file of log patterns, each with a name and regex, to watch for instead of the defaults.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "LOG_PATTERNS_FILE"},
+			Destination: &options.logPatternsFile,
+		},
+		&cli.StringSliceFlag{
+			Name:        "log-container",
+			Usage:       "Name of a container whose logs are watched. May be repeated.",
+			Value:       cli.NewStringSlice("gateway"),
+			EnvVars:     []string{envPrefix + "LOG_CONTAINER"},
+			Destination: &options.logContainers,
+		},
+		&cli.StringFlag{
+			Name:        "dumps-bucket",
+			Usage:       "S3 bucket that the last goroutine and heap profiles captured from a target before it crashed are stored in. Profiles are only captured from targets with a debug port and not at all if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "DUMPS_BUCKET"},
+			Destination: &options.dumpsBucket,
+		},
+		&cli.DurationFlag{
+			Name:        "dump-interval",
+			Usage:       "How often profiles are captured from each target with a debug port.",
+			Value:       5 * time.Minute,
+			EnvVars:     []string{envPrefix + "DUMP_INTERVAL"},
+			Destination: &options.dumpInterval,
+		},
+		&cli.StringFlag{
+			Name:        "config-file",
+			Usage:       "Path to a JSON file of settings that override their flags and can be changed without restarting: monitor_interval, settle, provision_deadline, teardown_deadline, max_retries, required_metadata, anomaly_sigma, anomaly_notify and webhooks. The config, quotas and clusters files are read again on SIGHUP or POST /admin/reload.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "CONFIG_FILE"},
+			Destination: &options.configFile,
+		},
+		&cli.StringFlag{
+			Name:        "quotas-file",
+			Usage:       "Path to a JSON file of global, team and per user quotas enforced when experiments are submitted. Quotas are not enforced if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "QUOTAS_FILE"},
+			Destination: &options.quotasFile,
+		},
+		&cli.StringFlag{
+			Name:        "clusters-file",
+			Usage:       "Path to a JSON file giving the maximum vCPUs of experiments placed in each ecs cluster, used to choose a cluster for experiments that let ironbar place them. Clusters are unlimited if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "CLUSTERS_FILE"},
+			Destination: &options.clustersFile,
+		},
+		&cli.DurationFlag{
+			Name:        "retention",
+			Usage:       "How long the history, analyses and annotations of completed experiments are kept before they are removed. Pinned experiments are kept indefinitely. Records are kept indefinitely if zero.",
+			Value:       0,
+			EnvVars:     []string{envPrefix + "RETENTION"},
+			Destination: &options.retention,
+		},
+		&cli.StringFlag{
+			Name:        "archive-bucket",
+			Usage:       "S3 bucket that the records of completed experiments are archived to before they are removed by the retention policy. Records are not archived if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "ARCHIVE_BUCKET"},
+			Destination: &options.archiveBucket,
+		},
+		&cli.StringFlag{
+			Name:        "kms-key-arn",
+			Usage:       "Customer managed KMS key that archived records and crash dumps are encrypted with. Dumps of experiments that set their own key are encrypted with it instead. The buckets' default encryption is used if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "KMS_KEY_ARN"},
+			Destination: &options.kmsKeyArn,
+		},
+		&cli.StringSliceFlag{
+			Name:        "required-metadata",
+			Usage:       "Metadata that every experiment must supply, any of owner, team, purpose and ticket. May be repeated or comma separated. Experiments without it are rejected before any resources are created.",
+			EnvVars:     []string{envPrefix + "REQUIRED_METADATA"},
+			Destination: &options.requiredMetadata,
+		},
+		&cli.StringFlag{
+			Name:        "admin-token",
+			Usage:       "Bearer token required by the admin api, used to manage maintenance mode, freeze windows and pinned experiments. The admin api is disabled if empty.",
+			Value:       "",
+			EnvVars:     []string{envPrefix + "ADMIN_TOKEN"},
+			Destination: &options.adminToken,
+		},
+		&cli.IntFlag{
+			Name:        "max-retries",
+			Usage:       "Maximum number of times tasks of an experiment that fail for a transient reason, such as a spot interruption, are run again. Zero disables retries.",
+			Value:       0,
+			EnvVars:     []string{envPrefix + "MAX_RETRIES"},
+			Destination: &options.maxRetries,
+		},
+		&cli.IntFlag{
+			Name:        "job-workers",
+			Usage:       "Number of jobs, such as checks of running experiments and teardowns of completed ones, that may run at once.",
+			Value:       8,
+			EnvVars:     []string{envPrefix + "JOB_WORKERS"},
+			Destination: &options.jobWorkers,
+		},
 	},
 	Action:          Run,
 	HideHelpCommand: true,
@@ -140,17 +401,77 @@ func Run(cc *cli.Context) error {
 		TableName: options.experimentsTableName,
 	}
 
+	var rules *RulesClient
+	if options.rulesURL != "" {
+		rules = NewRulesClient(options.rulesURL, options.rulesUser, options.rulesToken, options.rulesNamespace, options.rulesInterval)
+	}
+
+	var results *ResultsClient
+	if options.resultsURL != "" {
+		results = NewResultsClient(options.resultsURL, options.resultsUser, options.resultsToken)
+	}
+
+	var grafana *GrafanaClient
+	if options.grafanaURL != "" {
+		grafana = NewGrafanaClient(options.grafanaURL, options.grafanaToken)
+	}
+
+	var logs *LogWatcher
+	if options.watchLogs {
+		patterns, err := LoadLogPatterns(options.logPatternsFile)
+		if err != nil {
+			return fmt.Errorf("load log patterns: %w", err)
+		}
+		logs, err = NewLogWatcher(patterns, options.logContainers.Value())
+		if err != nil {
+			return fmt.Errorf("new log watcher: %w", err)
+		}
+	}
+
+	var dumps *DumpCollector
+	if options.dumpsBucket != "" {
+		dumps = NewDumpCollector(options.dumpsBucket, options.kmsKeyArn, options.dumpInterval)
+	}
+
+	var retention *RetentionPolicy
+	if options.retention > 0 {
+		retention = NewRetentionPolicy(options.retention, options.archiveBucket, options.kmsKeyArn)
+	}
+
 	svr, err := NewServer(
 		ctx,
 		db,
 		options.awsRegion,
-		time.Duration(options.monitorInterval)*time.Minute,
-		time.Duration(options.settle)*time.Minute,
+		LoadSettings,
+		rules,
+		results,
+		grafana,
+		logs,
+		dumps,
+		retention,
+		options.adminToken,
+		options.jobWorkers,
 	)
 	if err != nil {
 		return fmt.Errorf("create server: %w", err)
 	}
 	rg.Add(svr)
 
+	// reload the configuration on SIGHUP without interrupting the monitoring of experiments
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("received SIGHUP, reloading configuration")
+				svr.Reload()
+			}
+		}
+	}()
+
 	return rg.RunAndWait(ctx)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// metadataFields are the fields of an experiment's usage that ironbar can require to be
+// supplied, so that the cost of every experiment can be attributed to someone and a reason.
+var metadataFields = map[string]func(u api.Usage) string{
+	"owner":   func(u api.Usage) string { return u.Owner },
+	"team":    func(u api.Usage) string { return u.Team },
+	"purpose": func(u api.Usage) string { return u.Purpose },
+	"ticket":  func(u api.Usage) string { return u.Ticket },
+}
+
+// ParseRequiredMetadata checks that each of the names is a metadata field that can be required.
+func ParseRequiredMetadata(names []string) ([]string, error) {
+	var fields []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := metadataFields[name]; !ok {
+			return nil, fmt.Errorf("unknown metadata field %q, expected one of owner, team, purpose or ticket", name)
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// checkMetadata returns an error naming the required metadata fields that are missing from an
+// experiment's usage.
+func (s *Server) checkMetadata(u api.Usage) error {
+	var missing []string
+	for _, name := range s.settings.Load().RequiredMetadata {
+		if strings.TrimSpace(metadataFields[name](u)) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return &api.CodedError{
+			Code: api.ErrorCodeMetadataMissing,
+			Err:  fmt.Errorf("experiment is missing required metadata: %s", strings.Join(missing, ", ")),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// noiseDefinition holds the parts of an experiment definition needed to estimate noise.
+type noiseDefinition struct {
+	NoiseBaseline bool
+	Targets       []struct {
+		Name         string
+		InstanceType string
+	}
+}
+
+// RecordNoiseEstimate estimates the run-to-run noise of the environment from the results of a
+// completed A/A experiment. Experiments that are not A/A experiments are ignored.
+func (s *Server) RecordNoiseEstimate(ctx context.Context, mr ManagedResources, definition string) {
+	if definition == "" {
+		return
+	}
+	var def noiseDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		slog.Error("failed to decode experiment definition", err, "experiment", mr.Name)
+		return
+	}
+	if !def.NoiseBaseline {
+		return
+	}
+	logger := slog.With("experiment", mr.Name)
+
+	if len(def.Targets) != 2 {
+		logger.Warn("noise baseline experiment must have exactly two targets", "targets", len(def.Targets))
+		return
+	}
+
+	summaries, err := s.results.TargetSummaries(ctx, mr.Name, mr.Start, mr.End, excludedWindows(&mr, mr.Start, mr.End))
+	if err != nil {
+		logger.Error("failed to read experiment results", err)
+		return
+	}
+	if len(summaries) != 2 {
+		logger.Warn("results were not found for both targets of noise baseline experiment", "targets", len(summaries))
+		return
+	}
+
+	ne := noiseEstimate(summaries[0], summaries[1])
+	ne.Experiment = mr.Name
+	ne.Time = time.Now().UTC()
+	ne.InstanceType = def.Targets[0].InstanceType
+	ne.DurationSecs = mr.End.Sub(mr.Start).Seconds()
+
+	if err := s.db.AddNoiseEstimate(ctx, ne); err != nil {
+		logger.Error("failed to record noise estimate", err)
+		return
+	}
+	logger.Info("recorded noise estimate", "requests_diff", ne.RequestsDiff, "ttfb_p50_diff", ne.TTFBP50Diff, "ttfb_p99_diff", ne.TTFBP99Diff)
+}
+
+// noiseEstimate returns the differences between two targets running the same image.
+func noiseEstimate(a, b api.TargetSummary) api.NoiseEstimate {
+	return api.NoiseEstimate{
+		RequestsDiff:   relativeDiff(a.Requests, b.Requests),
+		ErrorRatioDiff: math.Abs(a.ErrorRatio - b.ErrorRatio),
+		TTFBP50Diff:    relativeDiff(a.TTFBP50, b.TTFBP50),
+		TTFBP95Diff:    relativeDiff(a.TTFBP95, b.TTFBP95),
+		TTFBP99Diff:    relativeDiff(a.TTFBP99, b.TTFBP99),
+	}
+}
+
+// relativeDiff returns the absolute difference between a and b relative to their mean.
+func relativeDiff(a, b float64) float64 {
+	mean := (a + b) / 2
+	if mean == 0 {
+		return 0
+	}
+	return math.Abs(a-b) / mean
+}
+
+func (s *Server) ListNoiseEstimatesHandler(w http.ResponseWriter, r *http.Request) {
+	estimates, err := s.db.GetNoiseEstimates(r.Context())
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to get noise estimates: %w", err))
+		return
+	}
+	out := &api.ListNoiseEstimatesOutput{
+		Items: []api.NoiseEstimate{},
+	}
+	out.Items = append(out.Items, estimates...)
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
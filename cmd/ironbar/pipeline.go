@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// rePipelineName matches the names of pipelines and their stages, which are used in the names
+// of experiments.
+var rePipelineName = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+
+// pipelineJobTimeout is how long a pipeline job may take to deploy the experiment of a stage.
+const pipelineJobTimeout = time.Hour
+
+// A stageDeployer deploys the experiment of a pipeline stage on behalf of the pipeline's owner.
+type stageDeployer func(ctx context.Context, p *api.Pipeline, e *exp.Experiment) error
+
+// infraDeployer deploys the experiments of pipeline stages the way thunderdome deploys them,
+// except that the images of their targets must already have been built.
+func infraDeployer(region string) stageDeployer {
+	return func(ctx context.Context, p *api.Pipeline, e *exp.Experiment) error {
+		return infra.NewProviderFor(region, p.Owner, p.Team).Deploy(ctx, e, false)
+	}
+}
+
+// PutPipelineHandler defines a pipeline and submits the job that deploys its first stage.
+// Defining a pipeline that already exists with the same stages returns it as it is and
+// submits the job again, so a pipeline whose job was lost can be resumed.
+func (s *Server) PutPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	in := new(api.NewPipelineInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+	if err := validatePipeline(name, in.Stages); err != nil {
+		s.BadRequest(w, r, err)
+		return
+	}
+
+	p, err := s.putPipeline(ctx, name, in)
+	switch {
+	case api.ErrorCode(err) == api.ErrorCodeConflict:
+		s.WriteError(w, http.StatusConflict, api.ErrorCodeConflict, err)
+		return
+	case err != nil:
+		s.ServerError(w, r, err)
+		return
+	}
+	if p.Verdict == api.PipelineVerdictPending {
+		s.submitPipelineJob(ctx, p.Name)
+	}
+	s.WriteAsJSON(w, http.StatusOK, p)
+}
+
+// putPipeline records a new pipeline, or returns the existing one if it has the same stages.
+func (s *Server) putPipeline(ctx context.Context, name string, in *api.NewPipelineInput) (*api.Pipeline, error) {
+	s.pipelinesMu.Lock()
+	defer s.pipelinesMu.Unlock()
+
+	existing, err := s.db.GetPipeline(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline: %w", err)
+	}
+	if existing != nil {
+		if !samePipelineStages(existing.Stages, in.Stages) {
+			return nil, &api.CodedError{Code: api.ErrorCodeConflict, Err: fmt.Errorf("pipeline %s already exists with different stages", name)}
+		}
+		return existing, nil
+	}
+
+	p := &api.Pipeline{
+		Name:    name,
+		Owner:   in.Owner,
+		Team:    in.Team,
+		Created: time.Now().UTC(),
+		Verdict: api.PipelineVerdictPending,
+	}
+	for _, st := range in.Stages {
+		p.Stages = append(p.Stages, api.PipelineStage{
+			Name:       st.Name,
+			Experiment: st.Experiment,
+			Needs:      st.Needs,
+			Gates:      st.Gates,
+			Definition: st.Definition,
+			State:      api.StageStatePending,
+		})
+	}
+	if err := s.db.PutPipeline(ctx, p); err != nil {
+		return nil, fmt.Errorf("failed to record pipeline: %w", err)
+	}
+	return p, nil
+}
+
+// GetPipelineHandler returns a pipeline with the state of each of its stages.
+func (s *Server) GetPipelineHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	p, err := s.db.GetPipeline(r.Context(), name)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to read pipeline: %w", err))
+		return
+	}
+	if p == nil {
+		s.NotFound(w, r, fmt.Errorf("pipeline %s not found", name))
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, p)
+}
+
+// FailPipelineStageHandler fails a stage that has not finished, such as one whose experiment
+// is stuck. The stages that need it are skipped.
+func (s *Server) FailPipelineStageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name, stage := mux.Vars(r)["name"], mux.Vars(r)["stage"]
+
+	in := new(api.FailPipelineStageInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+	if in.Reason == "" {
+		s.BadRequest(w, r, fmt.Errorf("reason must be supplied"))
+		return
+	}
+
+	var finished bool
+	p, err := s.updatePipeline(ctx, name, func(p *api.Pipeline) error {
+		st := findStage(p, stage)
+		if st == nil {
+			return &api.CodedError{Code: api.ErrorCodeNotFound, Err: fmt.Errorf("stage %s not found in pipeline %s", stage, name)}
+		}
+		if st.State != api.StageStatePending && st.State != api.StageStateDeploying && st.State != api.StageStateRunning {
+			return &api.CodedError{Code: api.ErrorCodeConflict, Err: fmt.Errorf("stage %s has already finished", stage)}
+		}
+		st.State = api.StageStateFailed
+		st.Finished = time.Now().UTC()
+		st.Reasons = append(st.Reasons, in.Reason)
+		finished = settlePipeline(p)
+		return nil
+	})
+	switch {
+	case api.ErrorCode(err) == api.ErrorCodeNotFound:
+		s.NotFound(w, r, err)
+		return
+	case api.ErrorCode(err) == api.ErrorCodeConflict:
+		s.WriteError(w, http.StatusConflict, api.ErrorCodeConflict, err)
+		return
+	case err != nil:
+		s.ServerError(w, r, err)
+		return
+	}
+	if finished {
+		go s.notifyPipelineCompleted(context.Background(), p)
+	} else {
+		s.submitPipelineJob(ctx, name)
+	}
+	s.WriteAsJSON(w, http.StatusOK, p)
+}
+
+// updatePipeline reads a pipeline, applies fn to it and records it, returning the result.
+func (s *Server) updatePipeline(ctx context.Context, name string, fn func(p *api.Pipeline) error) (*api.Pipeline, error) {
+	// pipelines are read and rewritten as a whole so concurrent updates must be serialised
+	s.pipelinesMu.Lock()
+	defer s.pipelinesMu.Unlock()
+
+	p, err := s.db.GetPipeline(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline: %w", err)
+	}
+	if p == nil {
+		return nil, &api.CodedError{Code: api.ErrorCodeNotFound, Err: fmt.Errorf("pipeline %s not found", name)}
+	}
+	if err := fn(p); err != nil {
+		return nil, err
+	}
+	if err := s.db.PutPipeline(ctx, p); err != nil {
+		return nil, fmt.Errorf("failed to record pipeline: %w", err)
+	}
+	return p, nil
+}
+
+// pipelineStageOf returns the pipeline and stage an experiment was deployed for, if any.
+func pipelineStageOf(mr *ManagedResources) (string, string, bool) {
+	pipeline, stage := mr.Usage.Labels[api.LabelPipeline], mr.Usage.Labels[api.LabelPipelineStage]
+	return pipeline, stage, pipeline != "" && stage != ""
+}
+
+// startPipelineStage marks the stage an experiment was deployed for as running.
+func (s *Server) startPipelineStage(ctx context.Context, mr *ManagedResources) {
+	pipeline, stage, ok := pipelineStageOf(mr)
+	if !ok {
+		return
+	}
+	logger := slog.With("experiment", mr.Name, "pipeline", pipeline, "stage", stage)
+	_, err := s.updatePipeline(ctx, pipeline, func(p *api.Pipeline) error {
+		st := findStage(p, stage)
+		if st == nil || st.Experiment != mr.Name {
+			return fmt.Errorf("experiment does not belong to the pipeline")
+		}
+		if st.State != api.StageStatePending && st.State != api.StageStateDeploying {
+			return fmt.Errorf("stage is %s", st.State)
+		}
+		st.State = api.StageStateRunning
+		st.Started = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to start pipeline stage", err)
+		return
+	}
+	logger.Info("pipeline stage started")
+}
+
+// finishPipelineStage checks the gates of the stage a completed experiment was deployed for
+// against its summary and records whether it passed.
+func (s *Server) finishPipelineStage(ctx context.Context, mr *ManagedResources, summary *api.ExperimentSummary) {
+	pipeline, stage, ok := pipelineStageOf(mr)
+	if !ok {
+		return
+	}
+	logger := slog.With("experiment", mr.Name, "pipeline", pipeline, "stage", stage)
+
+	var finished bool
+	p, err := s.updatePipeline(ctx, pipeline, func(p *api.Pipeline) error {
+		st := findStage(p, stage)
+		if st == nil || st.Experiment != mr.Name {
+			return fmt.Errorf("experiment does not belong to the pipeline")
+		}
+		if st.State != api.StageStateRunning && st.State != api.StageStateDeploying && st.State != api.StageStatePending {
+			return fmt.Errorf("stage is %s", st.State)
+		}
+		if st.Started.IsZero() {
+			st.Started = mr.Start
+		}
+		st.Finished = time.Now().UTC()
+		st.Targets = summary.Targets
+		st.Reasons = checkGates(st.Gates, summary)
+		st.State = api.StageStatePassed
+		if len(st.Reasons) > 0 {
+			st.State = api.StageStateFailed
+		}
+		finished = settlePipeline(p)
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to finish pipeline stage", err)
+		return
+	}
+	logger.Info("pipeline stage finished", "state", findStage(p, stage).State)
+	if finished {
+		s.notifyPipelineCompleted(ctx, p)
+	} else {
+		s.submitPipelineJob(ctx, pipeline)
+	}
+}
+
+// submitPipelineJob submits the job that deploys the next stage of a pipeline.
+func (s *Server) submitPipelineJob(ctx context.Context, name string) {
+	s.submitJob(ctx, slog.With("pipeline", name), api.JobKindPipeline, name, nil)
+}
+
+// pipelineJob deploys the experiment of the next stage of a pipeline whose needs have all
+// passed, unless a stage is already running. Stages are deployed one at a time, so the job is
+// submitted again each time a stage finishes. A stage whose experiment could not be deployed
+// fails and the job moves on to the next.
+func (s *Server) pipelineJob(ctx context.Context, j api.Job, _ json.RawMessage) error {
+	name := j.Experiment
+	logger := slog.With("pipeline", name)
+	for {
+		p, st, err := s.claimPipelineStage(ctx, name)
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			return nil
+		}
+
+		logger.Info("deploying pipeline stage", "stage", st.Name, "experiment", st.Experiment)
+		err = s.deployPipelineStage(ctx, p, st)
+		if err == nil {
+			// the stage starts running once its experiment is registered
+			return nil
+		}
+		logger.Error("failed to deploy pipeline stage", err, "stage", st.Name)
+
+		// the failure is recorded even if the job timed out, since nothing else would
+		fctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		var finished bool
+		p, ferr := s.updatePipeline(fctx, name, func(p *api.Pipeline) error {
+			cur := findStage(p, st.Name)
+			if cur == nil || cur.State != api.StageStateDeploying {
+				return nil
+			}
+			cur.State = api.StageStateFailed
+			cur.Finished = time.Now().UTC()
+			cur.Reasons = append(cur.Reasons, fmt.Sprintf("deploy: %v", err))
+			finished = settlePipeline(p)
+			return nil
+		})
+		cancel()
+		if ferr != nil {
+			return fmt.Errorf("record failed deployment of stage %s: %w", st.Name, ferr)
+		}
+		if finished {
+			s.notifyPipelineCompleted(ctx, p)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// claimPipelineStage marks the next stage of a pipeline that is ready to be deployed as
+// deploying and returns it, or returns a nil stage if none is. A stage left deploying by an
+// earlier job is failed unless its experiment was registered, since a deployment interrupted
+// by a restart of ironbar cannot be picked up again.
+func (s *Server) claimPipelineStage(ctx context.Context, name string) (*api.Pipeline, *api.PipelineStage, error) {
+	p, err := s.db.GetPipeline(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read pipeline: %w", err)
+	}
+	if p == nil {
+		return nil, nil, fmt.Errorf("pipeline %s not found", name)
+	}
+	// s.mu may not be acquired while updating a pipeline
+	registered := map[string]bool{}
+	s.mu.Lock()
+	for _, st := range p.Stages {
+		if st.State == api.StageStateDeploying {
+			_, registered[st.Experiment] = s.managed[st.Experiment]
+		}
+	}
+	s.mu.Unlock()
+
+	var claimed *api.PipelineStage
+	var finished bool
+	p, err = s.updatePipeline(ctx, name, func(p *api.Pipeline) error {
+		claimed = nil
+		if p.Verdict != api.PipelineVerdictPending {
+			return nil
+		}
+		for i := range p.Stages {
+			st := &p.Stages[i]
+			if st.State != api.StageStateDeploying {
+				continue
+			}
+			if registered[st.Experiment] {
+				st.State = api.StageStateRunning
+				if st.Started.IsZero() {
+					st.Started = time.Now().UTC()
+				}
+				continue
+			}
+			st.State = api.StageStateFailed
+			st.Finished = time.Now().UTC()
+			st.Reasons = append(st.Reasons, "deployment was interrupted")
+		}
+		finished = settlePipeline(p)
+		for _, st := range p.Stages {
+			if st.State == api.StageStateRunning {
+				return nil
+			}
+		}
+		if st := nextPipelineStage(p); st != nil {
+			st.State = api.StageStateDeploying
+			c := *st
+			claimed = &c
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if finished {
+		s.notifyPipelineCompleted(ctx, p)
+	}
+	return p, claimed, nil
+}
+
+// deployPipelineStage deploys the experiment of a stage from its definition.
+func (s *Server) deployPipelineStage(ctx context.Context, p *api.Pipeline, st *api.PipelineStage) error {
+	e := new(exp.Experiment)
+	if err := json.Unmarshal([]byte(st.Definition), e); err != nil {
+		return fmt.Errorf("decode experiment definition: %w", err)
+	}
+	return s.deployStage(ctx, p, e)
+}
+
+// nextPipelineStage returns the first pending stage whose needs have all passed, or nil if
+// there is none.
+func nextPipelineStage(p *api.Pipeline) *api.PipelineStage {
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		if st.State != api.StageStatePending {
+			continue
+		}
+		ready := true
+		for _, need := range st.Needs {
+			if dep := findStage(p, need); dep == nil || dep.State != api.StageStatePassed {
+				ready = false
+				break
+			}
+		}
+		if ready {
+			return st
+		}
+	}
+	return nil
+}
+
+// checkGates returns the reasons an experiment's results miss the gates of its stage, or nil if
+// it meets them all.
+func checkGates(g api.PipelineGates, summary *api.ExperimentSummary) []string {
+	var reasons []string
+	if g.MaxFailures != nil && len(summary.Failures) > *g.MaxFailures {
+		reasons = append(reasons, fmt.Sprintf("%d task failures, more than the %d allowed", len(summary.Failures), *g.MaxFailures))
+	}
+
+	needsResults := g.MaxErrorRatio != nil || g.MaxConformanceFailed != nil || g.MaxRegression != nil
+	if needsResults && len(summary.Targets) == 0 {
+		return append(reasons, "the experiment's results could not be read")
+	}
+	byName := map[string]api.TargetSummary{}
+	for _, t := range summary.Targets {
+		byName[t.Target] = t
+		if t.Shadow {
+			// shadow targets run unstable builds that are not held to the gates
+			continue
+		}
+		if g.MaxErrorRatio != nil && t.ErrorRatio > *g.MaxErrorRatio {
+			reasons = append(reasons, fmt.Sprintf("target %s error ratio %.4f is above %.4f", t.Target, t.ErrorRatio, *g.MaxErrorRatio))
+		}
+		if g.MaxConformanceFailed != nil {
+			switch {
+			case t.ConformanceFailed == nil:
+				reasons = append(reasons, fmt.Sprintf("target %s has no conformance report", t.Target))
+			case *t.ConformanceFailed > *g.MaxConformanceFailed:
+				reasons = append(reasons, fmt.Sprintf("target %s failed %.0f conformance tests, more than the %.0f allowed", t.Target, *t.ConformanceFailed, *g.MaxConformanceFailed))
+			}
+		}
+	}
+
+	if g.MaxRegression != nil {
+		baseline, bok := byName[g.Baseline]
+		candidate, cok := byName[g.Candidate]
+		switch {
+		case !bok || !cok:
+			reasons = append(reasons, fmt.Sprintf("no results for baseline %s or candidate %s", g.Baseline, g.Candidate))
+		case baseline.TTFBP99 <= 0:
+			reasons = append(reasons, fmt.Sprintf("baseline %s has no p99 time to first byte", g.Baseline))
+		default:
+			diff := (candidate.TTFBP99 - baseline.TTFBP99) / baseline.TTFBP99
+			if diff > *g.MaxRegression {
+				reasons = append(reasons, fmt.Sprintf("candidate %s p99 time to first byte is %+.1f%% from baseline %s, above %.1f%%", g.Candidate, diff*100, g.Baseline, *g.MaxRegression*100))
+			}
+		}
+	}
+
+	if g.MaxRestarts != nil {
+		if len(summary.Soak) == 0 {
+			reasons = append(reasons, "the experiment has no soak results")
+		}
+		for _, ss := range summary.Soak {
+			if ss.Restarts > *g.MaxRestarts {
+				reasons = append(reasons, fmt.Sprintf("target %s restarted %d times, more than the %d allowed", ss.Target, ss.Restarts, *g.MaxRestarts))
+			}
+		}
+	}
+	return reasons
+}
+
+// settlePipeline skips the stages that need a stage that did not pass and, once every stage
+// has finished, sets the pipeline's verdict. It reports whether the pipeline finished.
+func settlePipeline(p *api.Pipeline) bool {
+	// stages only need stages listed before them so one pass skips every dependent
+	for i := range p.Stages {
+		st := &p.Stages[i]
+		if st.State != api.StageStatePending {
+			continue
+		}
+		for _, need := range st.Needs {
+			if dep := findStage(p, need); dep != nil && (dep.State == api.StageStateFailed || dep.State == api.StageStateSkipped) {
+				st.State = api.StageStateSkipped
+				st.Finished = time.Now().UTC()
+				st.Reasons = append(st.Reasons, fmt.Sprintf("needs stage %s, which %s", need, dep.State))
+				break
+			}
+		}
+	}
+
+	if p.Verdict != api.PipelineVerdictPending {
+		return false
+	}
+	verdict := api.PipelineVerdictGo
+	for _, st := range p.Stages {
+		switch st.State {
+		case api.StageStatePending, api.StageStateDeploying, api.StageStateRunning:
+			return false
+		case api.StageStateFailed, api.StageStateSkipped:
+			verdict = api.PipelineVerdictNoGo
+		}
+	}
+	p.Verdict = verdict
+	p.Finished = time.Now().UTC()
+	return true
+}
+
+func (s *Server) notifyPipelineCompleted(ctx context.Context, p *api.Pipeline) {
+	slog.Info("pipeline completed", "pipeline", p.Name, "verdict", p.Verdict)
+	webhooks := s.settings.Load().Webhooks
+	if webhooks == nil {
+		return
+	}
+	webhooks.Send(ctx, &api.WebhookEvent{
+		Event:    api.WebhookEventPipelineCompleted,
+		Time:     time.Now().UTC(),
+		Pipeline: p,
+	})
+}
+
+func findStage(p *api.Pipeline, name string) *api.PipelineStage {
+	for i := range p.Stages {
+		if p.Stages[i].Name == name {
+			return &p.Stages[i]
+		}
+	}
+	return nil
+}
+
+// validatePipeline checks that a pipeline has uniquely named stages that only need stages
+// listed before them, each with an experiment ironbar can deploy.
+func validatePipeline(name string, stages []api.PipelineStage) error {
+	if !rePipelineName.MatchString(name) {
+		return fmt.Errorf("pipeline name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", name)
+	}
+	if len(stages) == 0 {
+		return fmt.Errorf("pipeline must have at least one stage")
+	}
+	seen := map[string]bool{}
+	experiments := map[string]bool{}
+	for _, st := range stages {
+		if !rePipelineName.MatchString(st.Name) {
+			return fmt.Errorf("stage name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", st.Name)
+		}
+		if seen[st.Name] {
+			return fmt.Errorf("stage name must be unique, %q has already been used", st.Name)
+		}
+		if st.Experiment == "" || experiments[st.Experiment] {
+			return fmt.Errorf("stage %s must have an experiment name not used by another stage", st.Name)
+		}
+		for _, need := range st.Needs {
+			if !seen[need] {
+				return fmt.Errorf("stage %s needs %s, which must be listed before it", st.Name, need)
+			}
+		}
+		if err := validateStageDefinition(name, st); err != nil {
+			return fmt.Errorf("stage %s: %w", st.Name, err)
+		}
+		seen[st.Name] = true
+		experiments[st.Experiment] = true
+	}
+	return nil
+}
+
+// validateStageDefinition checks that the experiment of a stage is named and labelled for it
+// and that the image of every target has been built, since ironbar cannot build images.
+func validateStageDefinition(pipeline string, st api.PipelineStage) error {
+	if st.Definition == "" {
+		return fmt.Errorf("definition must be supplied")
+	}
+	e := new(exp.Experiment)
+	if err := json.Unmarshal([]byte(st.Definition), e); err != nil {
+		return fmt.Errorf("decode definition: %w", err)
+	}
+	if e.Name != st.Experiment {
+		return fmt.Errorf("definition is of experiment %q rather than %q", e.Name, st.Experiment)
+	}
+	if e.Labels[api.LabelPipeline] != pipeline || e.Labels[api.LabelPipelineStage] != st.Name {
+		return fmt.Errorf("definition must be labelled with %s=%s and %s=%s", api.LabelPipeline, pipeline, api.LabelPipelineStage, st.Name)
+	}
+	for _, t := range e.Targets {
+		if !t.IsRemote() && t.Image == "" {
+			return fmt.Errorf("image of target %s must be built", t.Name)
+		}
+	}
+	return nil
+}
+
+// samePipelineStages reports whether two pipelines define the same stages, ignoring their
+// state and experiment definitions, which differ if images are rebuilt.
+func samePipelineStages(a, b []api.PipelineStage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Experiment != b[i].Experiment ||
+			!reflect.DeepEqual(a[i].Needs, b[i].Needs) || !reflect.DeepEqual(a[i].Gates, b[i].Gates) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+func TestValidateStageDefinition(t *testing.T) {
+	labels := map[string]string{api.LabelPipeline: "rc", api.LabelPipelineStage: "smoke"}
+	definition := func(e *exp.Experiment) string {
+		def, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("marshal experiment: %v", err)
+		}
+		return string(def)
+	}
+
+	testCases := []struct {
+		name       string
+		definition string
+		wantErr    bool
+	}{
+		{
+			name: "built images and remote targets",
+			definition: definition(&exp.Experiment{
+				Name:   "rc-smoke",
+				Labels: labels,
+				Targets: []*exp.TargetSpec{
+					{Name: "kubo", Image: "ecr/kubo:abc", ImageSpec: &exp.ImageSpec{BaseImage: "ipfs/kubo"}},
+					{Name: "remote", URL: "https://gateway.example.com"},
+				},
+			}),
+		},
+		{
+			name:    "missing definition",
+			wantErr: true,
+		},
+		{
+			name:       "not json",
+			definition: "{",
+			wantErr:    true,
+		},
+		{
+			name: "experiment of another stage",
+			definition: definition(&exp.Experiment{
+				Name:   "rc-soak",
+				Labels: labels,
+			}),
+			wantErr: true,
+		},
+		{
+			name: "missing labels",
+			definition: definition(&exp.Experiment{
+				Name: "rc-smoke",
+			}),
+			wantErr: true,
+		},
+		{
+			name: "image not built",
+			definition: definition(&exp.Experiment{
+				Name:   "rc-smoke",
+				Labels: labels,
+				Targets: []*exp.TargetSpec{
+					{Name: "kubo", ImageSpec: &exp.ImageSpec{BaseImage: "ipfs/kubo"}},
+				},
+			}),
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st := api.PipelineStage{Name: "smoke", Experiment: "rc-smoke", Definition: tc.definition}
+			err := validateStageDefinition("rc", st)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("got error %v, wanted error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNextPipelineStage(t *testing.T) {
+	testCases := []struct {
+		name   string
+		states []string
+		want   string
+	}{
+		{name: "first stage", states: []string{api.StageStatePending, api.StageStatePending, api.StageStatePending}, want: "smoke"},
+		{name: "needs passed", states: []string{api.StageStatePassed, api.StageStatePending, api.StageStatePending}, want: "ab"},
+		{name: "needs running", states: []string{api.StageStateRunning, api.StageStatePending, api.StageStatePending}, want: "conformance"},
+		{name: "needs deploying", states: []string{api.StageStateDeploying, api.StageStatePending, api.StageStatePending}, want: "conformance"},
+		{name: "needs not finished", states: []string{api.StageStateRunning, api.StageStatePending, api.StageStatePassed}, want: ""},
+		{name: "independent stage after failure", states: []string{api.StageStateFailed, api.StageStateSkipped, api.StageStatePending}, want: "conformance"},
+		{name: "all finished", states: []string{api.StageStatePassed, api.StageStatePassed, api.StageStatePassed}, want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &api.Pipeline{Stages: []api.PipelineStage{
+				{Name: "smoke"},
+				{Name: "ab", Needs: []string{"smoke"}},
+				{Name: "conformance"},
+			}}
+			for i, state := range tc.states {
+				p.Stages[i].State = state
+			}
+			got := ""
+			if st := nextPipelineStage(p); st != nil {
+				got = st.Name
+			}
+			if got != tc.want {
+				t.Errorf("got stage %q, wanted %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSettlePipeline(t *testing.T) {
+	testCases := []struct {
+		name         string
+		states       []string
+		wantStates   []string
+		wantFinished bool
+		wantVerdict  string
+	}{
+		{
+			name:        "stage deploying",
+			states:      []string{api.StageStatePassed, api.StageStateDeploying},
+			wantStates:  []string{api.StageStatePassed, api.StageStateDeploying},
+			wantVerdict: api.PipelineVerdictPending,
+		},
+		{
+			name:         "all passed",
+			states:       []string{api.StageStatePassed, api.StageStatePassed},
+			wantStates:   []string{api.StageStatePassed, api.StageStatePassed},
+			wantFinished: true,
+			wantVerdict:  api.PipelineVerdictGo,
+		},
+		{
+			name:         "need failed",
+			states:       []string{api.StageStateFailed, api.StageStatePending},
+			wantStates:   []string{api.StageStateFailed, api.StageStateSkipped},
+			wantFinished: true,
+			wantVerdict:  api.PipelineVerdictNoGo,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &api.Pipeline{
+				Verdict: api.PipelineVerdictPending,
+				Stages: []api.PipelineStage{
+					{Name: "smoke", State: tc.states[0]},
+					{Name: "ab", Needs: []string{"smoke"}, State: tc.states[1]},
+				},
+			}
+			if got := settlePipeline(p); got != tc.wantFinished {
+				t.Errorf("got finished %v, wanted %v", got, tc.wantFinished)
+			}
+			for i, st := range p.Stages {
+				if st.State != tc.wantStates[i] {
+					t.Errorf("stage %s: got state %s, wanted %s", st.Name, st.State, tc.wantStates[i])
+				}
+			}
+			if p.Verdict != tc.wantVerdict {
+				t.Errorf("got verdict %s, wanted %s", p.Verdict, tc.wantVerdict)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// targetComponentPrefix starts the component names of an experiment's targets.
+const targetComponentPrefix = "target "
+
+// mainContainers are the names of the containers whose image is recorded for each component,
+// the first found in the task is used.
+var mainContainers = []string{gatewayContainer, "dealgood"}
+
+// Limits beyond which differences in the network baseline of targets are flagged. Differences
+// in round trip time smaller than the minimum are within the noise of a single measurement.
+const (
+	maxBaselineRTTRatio        = 1.5
+	minBaselineRTTDifference   = 100 * time.Microsecond
+	maxBaselineThroughputRatio = 1.25
+)
+
+// describePlacements returns where each of the experiment's running tasks was placed and the
+// image it runs. Tasks that cannot be described are logged and left out.
+func describePlacements(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources) []api.TaskPlacement {
+	var placements []api.TaskPlacement
+	bases := make(map[string]string) // image base keyed by image digest
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		if taskArn == "" {
+			continue
+		}
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			logger.Error("failed to describe task", err, "arn", taskArn, "cluster_arn", clusterArn)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+
+		p := api.TaskPlacement{
+			Component:        res.Keys[api.ResourceKeyComponent],
+			TaskArn:          taskArn,
+			AvailabilityZone: aws.StringValue(task.AvailabilityZone),
+		}
+		if task.ContainerInstanceArn != nil {
+			inst, err := describeContainerInstanceHost(ctx, sess, clusterArn, *task.ContainerInstanceArn)
+			if err != nil {
+				logger.Error("failed to describe container instance", err, "arn", *task.ContainerInstanceArn, "cluster_arn", clusterArn)
+			} else if inst != nil {
+				p.InstanceID = aws.StringValue(inst.InstanceId)
+				p.InstanceType = aws.StringValue(inst.InstanceType)
+			}
+		}
+
+		if c := mainContainer(task); c != nil {
+			p.Image = aws.StringValue(c.Image)
+			if digest := aws.StringValue(c.ImageDigest); digest != "" {
+				p.ImageDigest = digest
+				base, ok := bases[digest]
+				if !ok {
+					base, err = ecrImageBase(ctx, sess, p.Image, digest)
+					if err != nil {
+						logger.Debug("could not read image base", "image", p.Image, "error", err)
+					}
+					bases[digest] = base
+				}
+				p.ImageBase = base
+			}
+		}
+		placements = append(placements, p)
+	}
+	return placements
+}
+
+func mainContainer(task *ecs.Task) *ecs.Container {
+	for _, name := range mainContainers {
+		for _, c := range task.Containers {
+			if aws.StringValue(c.Name) == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// describeContainerInstanceHost returns the ec2 instance behind an ecs container instance, or
+// nil if it cannot be found.
+func describeContainerInstanceHost(ctx context.Context, sess *session.Session, ecsClusterArn, containerInstanceArn string) (*ec2.Instance, error) {
+	out, err := ecs.New(sess).DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+		Cluster:            aws.String(ecsClusterArn),
+		ContainerInstances: []*string{aws.String(containerInstanceArn)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe container instances: %w", err)
+	}
+	if len(out.ContainerInstances) == 0 || out.ContainerInstances[0].Ec2InstanceId == nil {
+		return nil, nil
+	}
+
+	iout, err := ec2.New(sess).DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{out.ContainerInstances[0].Ec2InstanceId},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe instances: %w", err)
+	}
+	for _, r := range iout.Reservations {
+		for _, inst := range r.Instances {
+			return inst, nil
+		}
+	}
+	return nil, nil
+}
+
+// imageBaseLabel is the standard annotation naming the image an image was built from, which
+// thunderdome sets on the images it builds.
+const imageBaseLabel = "org.opencontainers.image.base.name"
+
+// ecrImageBase returns the base image recorded in the config of an image held in ECR, or an
+// empty string if the image is not in ECR or has no base recorded.
+func ecrImageBase(ctx context.Context, sess *session.Session, image string, digest string) (string, error) {
+	// ECR images are named <registry id>.dkr.ecr.<region>.amazonaws.com/<repository>[:tag]
+	host, repo, ok := strings.Cut(image, "/")
+	if !ok || !strings.Contains(host, ".dkr.ecr.") {
+		return "", nil
+	}
+	registryID, _, _ := strings.Cut(host, ".")
+	if i := strings.IndexAny(repo, ":@"); i >= 0 {
+		repo = repo[:i]
+	}
+
+	svc := ecr.New(sess)
+	out, err := svc.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repo),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageDigest: aws.String(digest)}},
+		AcceptedMediaTypes: aws.StringSlice([]string{
+			"application/vnd.docker.distribution.manifest.v2+json",
+			"application/vnd.oci.image.manifest.v1+json",
+		}),
+	})
+	if err != nil {
+		return "", fmt.Errorf("batch get image: %w", err)
+	}
+	if len(out.Images) == 0 || out.Images[0].ImageManifest == nil {
+		return "", fmt.Errorf("image manifest not found")
+	}
+
+	var manifest struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal([]byte(*out.Images[0].ImageManifest), &manifest); err != nil {
+		return "", fmt.Errorf("decode manifest: %w", err)
+	}
+	if manifest.Config.Digest == "" {
+		return "", fmt.Errorf("manifest has no config")
+	}
+
+	dout, err := svc.GetDownloadUrlForLayerWithContext(ctx, &ecr.GetDownloadUrlForLayerInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repo),
+		LayerDigest:    aws.String(manifest.Config.Digest),
+	})
+	if err != nil {
+		return "", fmt.Errorf("get config url: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, aws.StringValue(dout.DownloadUrl), nil)
+	if err != nil {
+		return "", fmt.Errorf("new request: %w", err)
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("get config: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get config: unexpected status %s", resp.Status)
+	}
+
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return "", fmt.Errorf("decode config: %w", err)
+	}
+	return config.Config.Labels[imageBaseLabel], nil
+}
+
+// findAsymmetries compares the placement, image bases and network baseline of an experiment's
+// targets and describes each difference that could bias a comparison of their results. Shadow
+// targets are not compared, but still count as sharing an instance with the targets that are.
+func findAsymmetries(placements []api.TaskPlacement, targets []api.TargetSummary, shadows []string) []api.Asymmetry {
+	shadow := make(map[string]bool, len(shadows))
+	for _, name := range shadows {
+		shadow[name] = true
+	}
+	byTarget := make(map[string]api.TaskPlacement)
+	all := make(map[string]api.TaskPlacement)
+	for _, p := range placements {
+		if name, ok := strings.CutPrefix(p.Component, targetComponentPrefix); ok {
+			all[name] = p
+			if !shadow[name] {
+				byTarget[name] = p
+			}
+		}
+	}
+
+	var out []api.Asymmetry
+	differs := func(kind string, description string, value func(api.TaskPlacement) string) {
+		values := make(map[string]string)
+		distinct := make(map[string]bool)
+		for name, p := range byTarget {
+			if v := value(p); v != "" {
+				values[name] = v
+				distinct[v] = true
+			}
+		}
+		if len(distinct) > 1 {
+			out = append(out, api.Asymmetry{Kind: kind, Description: description, Values: values})
+		}
+	}
+	differs(api.AsymmetryAvailabilityZone, "targets ran in different availability zones, so some were further from dealgood than others",
+		func(p api.TaskPlacement) string { return p.AvailabilityZone })
+	differs(api.AsymmetryInstanceType, "targets ran on different instance types",
+		func(p api.TaskPlacement) string { return p.InstanceType })
+	differs(api.AsymmetryImageBase, "target images were built from different base images",
+		func(p api.TaskPlacement) string { return p.ImageBase })
+
+	// targets sharing an instance compete with each other for its cpu, disk and network
+	hosts := make(map[string][]string)
+	for name, p := range all {
+		if p.InstanceID != "" {
+			hosts[p.InstanceID] = append(hosts[p.InstanceID], name)
+		}
+	}
+	shared := make(map[string]string)
+	for id, names := range hosts {
+		if len(names) > 1 {
+			for _, name := range names {
+				shared[name] = id
+			}
+		}
+	}
+	if len(shared) > 0 {
+		out = append(out, api.Asymmetry{
+			Kind:        api.AsymmetryHost,
+			Description: "some targets shared an instance with other targets",
+			Values:      shared,
+		})
+	}
+
+	rtts := make(map[string]float64)
+	throughputs := make(map[string]float64)
+	for _, ts := range targets {
+		if shadow[ts.Target] {
+			continue
+		}
+		if ts.BaselineRTT != nil {
+			rtts[ts.Target] = *ts.BaselineRTT
+		}
+		if ts.BaselineThroughput != nil {
+			throughputs[ts.Target] = *ts.BaselineThroughput
+		}
+	}
+	if lo, hi := spread(rtts); hi > lo*maxBaselineRTTRatio && hi-lo > minBaselineRTTDifference.Seconds() {
+		out = append(out, api.Asymmetry{
+			Kind:        api.AsymmetryNetworkRTT,
+			Description: fmt.Sprintf("the network round trip time to targets ranged from %s to %s", seconds(lo), seconds(hi)),
+			Values:      formatValues(rtts, func(v float64) string { return seconds(v).String() }),
+		})
+	}
+	if lo, hi := spread(throughputs); hi > lo*maxBaselineThroughputRatio {
+		out = append(out, api.Asymmetry{
+			Kind:        api.AsymmetryNetworkThroughput,
+			Description: fmt.Sprintf("the network throughput from targets ranged from %.0f to %.0f Mbit/s", lo*8/1e6, hi*8/1e6),
+			Values:      formatValues(throughputs, func(v float64) string { return fmt.Sprintf("%.0f Mbit/s", v*8/1e6) }),
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Kind < out[j].Kind })
+	return out
+}
+
+// spread returns the smallest and largest of the values, both zero unless there are at least
+// two to compare.
+func spread(values map[string]float64) (float64, float64) {
+	if len(values) < 2 {
+		return 0, 0
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	return lo, hi
+}
+
+func seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second)).Round(time.Microsecond)
+}
+
+func formatValues(values map[string]float64, format func(float64) string) map[string]string {
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		out[k] = format(v)
+	}
+	return out
+}
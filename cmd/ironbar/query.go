@@ -0,0 +1,649 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+const (
+	// queryRangePoints is the number of points a range query returns when no step is given.
+	queryRangePoints = 250
+
+	// minQueryStep is the smallest step a range query is run with, which is the interval
+	// dealgood's metrics are scraped at.
+	minQueryStep = 15 * time.Second
+)
+
+// QueryHandler runs an instant PromQL query over the metrics of an experiment.
+func (s *Server) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveQuery(w, r, false)
+}
+
+// QueryRangeHandler runs a PromQL query over the metrics of an experiment for each step of a
+// period, which defaults to the experiment's.
+func (s *Server) QueryRangeHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveQuery(w, r, true)
+}
+
+func (s *Server) serveQuery(w http.ResponseWriter, r *http.Request, isRange bool) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	s.mu.Lock()
+	m, ok := s.managed[name]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.NotFound(w, r, fmt.Errorf("experiment %s is not known", name))
+		return
+	}
+	if s.results == nil {
+		s.WriteError(w, http.StatusServiceUnavailable, api.ErrorCodeUnavailable, fmt.Errorf("ironbar is not configured with a results url"))
+		return
+	}
+
+	in, err := parseQueryInput(r.URL.Query(), isRange)
+	if err != nil {
+		s.BadRequest(w, r, err)
+		return
+	}
+	scoped, err := scopeQuery(in.Query, name)
+	if err != nil {
+		s.BadRequest(w, r, fmt.Errorf("invalid query: %w", err))
+		return
+	}
+
+	// default to the experiment's period, cut short at now if it is still running
+	now := time.Now().UTC()
+	stop := mr.stopTime()
+	if stop.After(now) {
+		stop = now
+	}
+
+	var out *api.QueryOutput
+	if isRange {
+		start, end, step := in.Start, in.End, in.Step
+		if start.IsZero() {
+			start = mr.Start
+		}
+		if end.IsZero() {
+			end = stop
+		}
+		if !end.After(start) {
+			s.BadRequest(w, r, fmt.Errorf("end of query must be after its start"))
+			return
+		}
+		if step == 0 {
+			step = end.Sub(start) / queryRangePoints
+			if step < minQueryStep {
+				step = minQueryStep
+			}
+		}
+		out, err = s.results.QueryRange(ctx, scoped, start, end, step)
+	} else {
+		t := in.Time
+		if t.IsZero() {
+			t = stop
+		}
+		out, err = s.results.Query(ctx, scoped, t)
+	}
+	if err != nil {
+		if api.ErrorCode(err) == api.ErrorCodeSpecInvalid {
+			s.BadRequest(w, r, err)
+			return
+		}
+		s.ServerError(w, r, fmt.Errorf("failed to run query: %w", err))
+		return
+	}
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+// parseQueryInput reads a query from the parameters of a request. Times may be given in RFC 3339
+// format or as unix seconds and the step as a duration or a number of seconds, as accepted by
+// the Prometheus query api.
+func parseQueryInput(q url.Values, isRange bool) (*api.QueryInput, error) {
+	in := &api.QueryInput{Query: q.Get("query"), Range: isRange}
+	if strings.TrimSpace(in.Query) == "" {
+		return nil, fmt.Errorf("query must be supplied")
+	}
+
+	var err error
+	if isRange {
+		if in.Start, err = parseQueryTime(q.Get("start")); err != nil {
+			return nil, fmt.Errorf("invalid start: %w", err)
+		}
+		if in.End, err = parseQueryTime(q.Get("end")); err != nil {
+			return nil, fmt.Errorf("invalid end: %w", err)
+		}
+		if v := q.Get("step"); v != "" {
+			in.Step, err = time.ParseDuration(v)
+			if err != nil {
+				secs, ferr := strconv.ParseFloat(v, 64)
+				if ferr != nil {
+					return nil, fmt.Errorf("invalid step: %w", err)
+				}
+				in.Step = time.Duration(secs * float64(time.Second))
+			}
+			if in.Step <= 0 {
+				return nil, fmt.Errorf("step must be positive")
+			}
+		}
+	} else {
+		if in.Time, err = parseQueryTime(q.Get("time")); err != nil {
+			return nil, fmt.Errorf("invalid time: %w", err)
+		}
+	}
+	return in, nil
+}
+
+// parseQueryTime parses a time given in RFC 3339 format or as unix seconds, returning the zero
+// time if it is empty.
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t.UTC(), nil
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or unix seconds", v)
+	}
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC(), nil
+}
+
+// scopeQuery returns a PromQL query that only selects series of an experiment, by adding an
+// experiment matcher to every vector selector in the query. Matchers of a selector must all
+// match, so a query cannot widen its scope by matching on the experiment label itself.
+//
+// The query is split into tokens, so that strings and comments are never mistaken for
+// selectors, and any construct that is not understood is rejected rather than passed on
+// unscoped. Keywords that Prometheus also accepts as metric names are scoped wherever an
+// operand is expected, as are Inf and NaN. Other syntax errors are reported by Prometheus when
+// the query is run.
+func scopeQuery(query, experiment string) (string, error) {
+	toks, err := lexQuery(query)
+	if err != nil {
+		return "", err
+	}
+	matcher := fmt.Sprintf("experiment=%q", experiment)
+
+	var b strings.Builder
+	// operand is set when the last token ended an operand, so that a word following it
+	// must be an operator or modifier rather than a metric name
+	operand := false
+	// afterGrouping is set when the last token closed an on or ignoring label list
+	afterGrouping := false
+	prev := queryToken{}
+
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		if t.kind == tokSpace {
+			b.WriteString(t.text)
+			continue
+		}
+		next := nextToken(toks, i+1)
+		closedGrouping := false
+
+		switch t.kind {
+		case tokIdent:
+			word := strings.ToLower(t.text)
+			switch {
+			case (word == "by" || word == "without" || word == "on" || word == "ignoring") && next.kind == tokLParen && (operand || prev.kind == tokOp || prev.kind == tokIdent):
+				// a label list, copied as it is once checked to hold only label names
+				b.WriteString(t.text)
+				end, err := copyLabelList(&b, toks, i+1)
+				if err != nil {
+					return "", err
+				}
+				i = end
+				closedGrouping = word == "on" || word == "ignoring"
+				operand = word == "by" || word == "without"
+			case (word == "group_left" || word == "group_right") && afterGrouping:
+				b.WriteString(t.text)
+				if next.kind == tokLParen {
+					end, err := copyLabelList(&b, toks, i+1)
+					if err != nil {
+						return "", err
+					}
+					i = end
+				}
+				operand = false
+			case operand && (word == "and" || word == "or" || word == "unless" || word == "atan2" || word == "offset"):
+				b.WriteString(t.text)
+				operand = false
+			case word == "bool" && prev.kind == tokOp && strings.ContainsAny(prev.text, "=<>"):
+				b.WriteString(t.text)
+				operand = false
+			case next.kind == tokLParen:
+				// a function or aggregation
+				b.WriteString(t.text)
+				operand = false
+			case next.kind == tokIdent && isGroupingWord(next.text) && nextToken(toks, indexAfter(toks, i+1)).kind == tokLParen:
+				// an aggregation with its grouping before its argument
+				b.WriteString(t.text)
+				operand = false
+			default:
+				if operand {
+					return "", fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+				}
+				b.WriteString(t.text)
+				if next.kind == tokLBrace {
+					// copy any space between the metric name and its matchers
+					for i+1 < len(toks) && toks[i+1].kind == tokSpace {
+						i++
+						b.WriteString(toks[i].text)
+					}
+					end, err := scopeMatchers(&b, toks, i+1, matcher)
+					if err != nil {
+						return "", err
+					}
+					i = end
+				} else {
+					b.WriteString("{" + matcher + "}")
+				}
+				operand = true
+			}
+
+		case tokLBrace:
+			end, err := scopeMatchers(&b, toks, i, matcher)
+			if err != nil {
+				return "", err
+			}
+			i = end
+			operand = true
+
+		case tokRBrace:
+			return "", fmt.Errorf("unexpected } at offset %d", t.pos)
+
+		case tokNumber, tokString, tokRange, tokRParen:
+			b.WriteString(t.text)
+			operand = true
+
+		default:
+			b.WriteString(t.text)
+			operand = false
+		}
+		afterGrouping = closedGrouping
+		prev = toks[i]
+	}
+	return b.String(), nil
+}
+
+// scopeMatchers writes the label matchers of a vector selector whose opening brace is token i,
+// with the experiment matcher added first, and returns the index of its closing brace.
+func scopeMatchers(b *strings.Builder, toks []queryToken, i int, matcher string) (int, error) {
+	var body strings.Builder
+	empty := true
+	for j := i + 1; j < len(toks); j++ {
+		t := toks[j]
+		switch t.kind {
+		case tokRBrace:
+			b.WriteString("{" + matcher)
+			if !empty {
+				b.WriteString(",")
+			}
+			b.WriteString(body.String() + "}")
+			return j, nil
+		case tokSpace:
+		case tokIdent, tokString, tokComma:
+			empty = false
+		case tokOp:
+			if strings.Trim(t.text, "=!~") != "" {
+				return 0, fmt.Errorf("unexpected %q in label matchers at offset %d", t.text, t.pos)
+			}
+			empty = false
+		default:
+			return 0, fmt.Errorf("unexpected %q in label matchers at offset %d", t.text, t.pos)
+		}
+		body.WriteString(t.text)
+	}
+	return 0, fmt.Errorf("unclosed { at offset %d", toks[i].pos)
+}
+
+// copyLabelList writes the space and parenthesised list of label names starting at token i and
+// returns the index of its closing parenthesis.
+func copyLabelList(b *strings.Builder, toks []queryToken, i int) (int, error) {
+	opened := false
+	for j := i; j < len(toks); j++ {
+		t := toks[j]
+		switch {
+		case t.kind == tokSpace:
+		case t.kind == tokLParen && !opened:
+			opened = true
+		case t.kind == tokRParen && opened:
+			b.WriteString(t.text)
+			return j, nil
+		case opened && (t.kind == tokIdent || t.kind == tokString || t.kind == tokComma):
+		default:
+			return 0, fmt.Errorf("unexpected %q in label list at offset %d", t.text, t.pos)
+		}
+		b.WriteString(t.text)
+	}
+	return 0, fmt.Errorf("unclosed label list at offset %d", toks[i].pos)
+}
+
+func isGroupingWord(w string) bool {
+	w = strings.ToLower(w)
+	return w == "by" || w == "without"
+}
+
+// nextToken returns the first token from index i that is not space, or a zero token if there
+// is none.
+func nextToken(toks []queryToken, i int) queryToken {
+	for i < len(toks) && toks[i].kind == tokSpace {
+		i++
+	}
+	if i < len(toks) {
+		return toks[i]
+	}
+	return queryToken{}
+}
+
+// indexAfter returns the index of the token following the first token from index i that is not
+// space.
+func indexAfter(toks []queryToken, i int) int {
+	for i < len(toks) && toks[i].kind == tokSpace {
+		i++
+	}
+	return i + 1
+}
+
+type queryTokenKind int
+
+const (
+	tokNone queryTokenKind = iota
+	tokSpace
+	tokIdent
+	tokNumber
+	tokString
+	tokRange
+	tokLBrace
+	tokRBrace
+	tokLParen
+	tokRParen
+	tokComma
+	tokOp
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+// lexQuery splits a PromQL query into tokens. Comments are returned as space. The contents of
+// a range or subquery are returned as a single token and may only hold durations.
+func lexQuery(query string) ([]queryToken, error) {
+	var toks []queryToken
+	i := 0
+	for i < len(query) {
+		start := i
+		c := query[i]
+		kind := tokOp
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(query) && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n' || query[i] == '\r') {
+				i++
+			}
+			kind = tokSpace
+
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			kind = tokSpace
+
+		case c == '"' || c == '\'' || c == '`':
+			end, err := skipString(query, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			kind = tokString
+
+		case c == '[':
+			end := strings.IndexByte(query[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ at offset %d", i)
+			}
+			for _, r := range query[i+1 : i+end] {
+				if !isDurationChar(r) {
+					return nil, fmt.Errorf("unexpected %q in range at offset %d", r, i)
+				}
+			}
+			i += end + 1
+			kind = tokRange
+
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			hex := strings.HasPrefix(strings.ToLower(query[i:]), "0x")
+			for i < len(query) && (isIdentChar(query[i]) || query[i] == '.') {
+				if !hex && (query[i] == 'e' || query[i] == 'E') && i+1 < len(query) && (query[i+1] == '+' || query[i+1] == '-') {
+					i++
+				}
+				i++
+			}
+			kind = tokNumber
+
+		case isIdentStart(c):
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			kind = tokIdent
+
+		case c == '{':
+			i++
+			kind = tokLBrace
+		case c == '}':
+			i++
+			kind = tokRBrace
+		case c == '(':
+			i++
+			kind = tokLParen
+		case c == ')':
+			i++
+			kind = tokRParen
+		case c == ',':
+			i++
+			kind = tokComma
+
+		case strings.IndexByte("+-*/%^=!<>~@", c) >= 0:
+			// ==, !=, >=, <=, =~ and !~ are single operators
+			i++
+			if i < len(query) && (query[i] == '=' || query[i] == '~') {
+				i++
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+		}
+		toks = append(toks, queryToken{kind: kind, text: query[start:i], pos: start})
+	}
+	return toks, nil
+}
+
+// skipString returns the offset following the quoted string starting at offset i of a query.
+func skipString(query string, i int) (int, error) {
+	quote := query[i]
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", i)
+}
+
+func isDurationChar(r rune) bool {
+	return r == ':' || r == ' ' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) }
+
+// Query runs an instant query at time t.
+func (c *ResultsClient) Query(ctx context.Context, query string, t time.Time) (*api.QueryOutput, error) {
+	return c.runQuery(ctx, "/api/v1/query", url.Values{
+		"query": {query},
+		"time":  {formatQueryTime(t)},
+	})
+}
+
+// QueryRange runs a query for each step between start and end.
+func (c *ResultsClient) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) (*api.QueryOutput, error) {
+	return c.runQuery(ctx, "/api/v1/query_range", url.Values{
+		"query": {query},
+		"start": {formatQueryTime(start)},
+		"end":   {formatQueryTime(end)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	})
+}
+
+func formatQueryTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
+
+// runQuery sends a query to the Prometheus query api and returns its result. A query that
+// Prometheus rejects returns an error with the SPEC_INVALID code.
+func (c *ResultsClient) runQuery(ctx context.Context, path string, params url.Values) (*api.QueryOutput, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if c.User != "" || c.Token != "" {
+		req.SetBasicAuth(c.User, c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity {
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&out); err != nil || out.Error == "" {
+			out.Error = resp.Status
+		}
+		return nil, &api.CodedError{Code: api.ErrorCodeSpecInvalid, Err: errors.New(out.Error)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("query: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if out.Status != "success" {
+		return nil, fmt.Errorf("query status: %s: %s", out.Status, out.Error)
+	}
+
+	qo := &api.QueryOutput{
+		Query:      params.Get("query"),
+		ResultType: out.Data.ResultType,
+		Series:     []api.QuerySeries{},
+	}
+	switch out.Data.ResultType {
+	case "vector", "matrix":
+		var result []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []any             `json:"value"`
+			Values [][]any           `json:"values"`
+		}
+		if err := json.Unmarshal(out.Data.Result, &result); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", out.Data.ResultType, err)
+		}
+		for _, r := range result {
+			qs := api.QuerySeries{Labels: r.Metric}
+			if r.Value != nil {
+				r.Values = append(r.Values, r.Value)
+			}
+			for _, v := range r.Values {
+				if sample, ok := querySample(v); ok {
+					qs.Samples = append(qs.Samples, sample)
+				}
+			}
+			qo.Series = append(qo.Series, qs)
+		}
+		sort.Slice(qo.Series, func(i, j int) bool {
+			return formatSeriesLabels(qo.Series[i].Labels) < formatSeriesLabels(qo.Series[j].Labels)
+		})
+	case "scalar", "string":
+		var v []any
+		if err := json.Unmarshal(out.Data.Result, &v); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", out.Data.ResultType, err)
+		}
+		if sample, ok := querySample(v); ok {
+			qo.Series = append(qo.Series, api.QuerySeries{Samples: []api.QuerySample{sample}})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported result type: %q", out.Data.ResultType)
+	}
+	return qo, nil
+}
+
+// querySample converts a sample given by Prometheus as a pair of unix seconds and a formatted
+// value.
+func querySample(v []any) (api.QuerySample, bool) {
+	if len(v) != 2 {
+		return api.QuerySample{}, false
+	}
+	secs, ok := v[0].(float64)
+	if !ok {
+		return api.QuerySample{}, false
+	}
+	value, ok := v[1].(string)
+	if !ok {
+		return api.QuerySample{}, false
+	}
+	whole, frac := math.Modf(secs)
+	return api.QuerySample{
+		Time:  time.Unix(int64(whole), int64(math.Round(frac*1e3))*int64(time.Millisecond)).UTC(),
+		Value: value,
+	}, true
+}
+
+// formatSeriesLabels formats the labels of a series in the order they are sorted by.
+func formatSeriesLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
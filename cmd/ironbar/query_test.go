@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopeQuery(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "bare metric",
+			query: `up`,
+			want:  `up{experiment="exp1"}`,
+		},
+		{
+			name:  "metric with matchers",
+			query: `thunderdome_dealgood_requests_total{target="kubo", code=~"5.."}`,
+			want:  `thunderdome_dealgood_requests_total{experiment="exp1",target="kubo", code=~"5.."}`,
+		},
+		{
+			name:  "empty matchers",
+			query: `up{}`,
+			want:  `up{experiment="exp1"}`,
+		},
+		{
+			name:  "space before matchers",
+			query: `up {job="a"}`,
+			want:  `up {experiment="exp1",job="a"}`,
+		},
+		{
+			name:  "selector without metric name",
+			query: `{__name__=~".+"}`,
+			want:  `{experiment="exp1",__name__=~".+"}`,
+		},
+		{
+			name:  "experiment matcher supplied by the caller",
+			query: `up{experiment=~".*"}`,
+			want:  `up{experiment="exp1",experiment=~".*"}`,
+		},
+		{
+			name:  "recording rule name",
+			query: `thunderdome:ttfb_seconds:p99`,
+			want:  `thunderdome:ttfb_seconds:p99{experiment="exp1"}`,
+		},
+		{
+			name:  "aggregation with grouping before argument",
+			query: `sum by (target) (rate(requests_total[5m]))`,
+			want:  `sum by (target) (rate(requests_total{experiment="exp1"}[5m]))`,
+		},
+		{
+			name:  "aggregation with grouping after argument",
+			query: `sum without (instance) (up) + count(up) by (job)`,
+			want:  `sum without (instance) (up{experiment="exp1"}) + count(up{experiment="exp1"}) by (job)`,
+		},
+		{
+			name:  "quoted parenthesis in grouping",
+			query: `sum by ("x)")(secret) + vector("\")")`,
+			want:  `sum by ("x)")(secret{experiment="exp1"}) + vector("\")")`,
+		},
+		{
+			name:  "on and group_left",
+			query: `a * on(target) group_left(version) b`,
+			want:  `a{experiment="exp1"} * on(target) group_left(version) b{experiment="exp1"}`,
+		},
+		{
+			name:  "ignoring and group_right without labels",
+			query: `a / ignoring (code) group_right b`,
+			want:  `a{experiment="exp1"} / ignoring (code) group_right b{experiment="exp1"}`,
+		},
+		{
+			name:  "set operators and bool",
+			query: `a and b or c unless d > bool 1`,
+			want:  `a{experiment="exp1"} and b{experiment="exp1"} or c{experiment="exp1"} unless d{experiment="exp1"} > bool 1`,
+		},
+		{
+			name:  "keywords used as metric names",
+			query: `sum(offset) + by + on{a="b"}`,
+			want:  `sum(offset{experiment="exp1"}) + by{experiment="exp1"} + on{experiment="exp1",a="b"}`,
+		},
+		{
+			name:  "subquery",
+			query: `max_over_time(rate(requests_total[1m])[1h:5m])`,
+			want:  `max_over_time(rate(requests_total{experiment="exp1"}[1m])[1h:5m])`,
+		},
+		{
+			name:  "offset and at modifiers",
+			query: `rate(x[5m] offset -1h) @ 1609746000 + y @ start() offset 5m`,
+			want:  `rate(x{experiment="exp1"}[5m] offset -1h) @ 1609746000 + y{experiment="exp1"} @ start() offset 5m`,
+		},
+		{
+			name:  "comment",
+			query: "up # {x} sum by (a) (secret)\n+ down",
+			want:  "up{experiment=\"exp1\"} # {x} sum by (a) (secret)\n+ down{experiment=\"exp1\"}",
+		},
+		{
+			name:  "string holding braces",
+			query: `label_replace(up, "dst", "{}", "src", "(.*)")`,
+			want:  `label_replace(up{experiment="exp1"}, "dst", "{}", "src", "(.*)")`,
+		},
+		{
+			name:  "matcher value holding braces and quotes",
+			query: `up{path="}{\"", b='}'}`,
+			want:  `up{experiment="exp1",path="}{\"", b='}'}`,
+		},
+		{
+			name:  "numbers",
+			query: `1e-3 * 0x1F + .5 - Inf`,
+			want:  `1e-3 * 0x1F + .5 - Inf{experiment="exp1"}`,
+		},
+		{
+			name:  "histogram quantile",
+			query: `histogram_quantile(0.99, sum by (target, le) (rate(x_bucket{le!="+Inf"}[5m])))`,
+			want:  `histogram_quantile(0.99, sum by (target, le) (rate(x_bucket{experiment="exp1",le!="+Inf"}[5m])))`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := scopeQuery(tc.query, "exp1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %s, wanted %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestScopeQueryRejects(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+	}{
+		{name: "unterminated string", query: `up{a="b}`},
+		{name: "unclosed selector", query: `up{a="b"`},
+		{name: "unexpected closing brace", query: `up}`},
+		{name: "selector in range", query: `rate(x[5m{a="b"}])`},
+		{name: "quote in range", query: `rate(x["5m"])`},
+		{name: "selector in label list", query: `sum by (a{b="c"}) (up)`},
+		{name: "nested label list", query: `sum by (a, (up)) (up)`},
+		{name: "nested selector", query: `up{a=b{}}`},
+		{name: "two metric names", query: `up down`},
+		{name: "unknown character", query: `up; down`},
+		{name: "non-ascii", query: `up{a="b"} ÷ 2`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := scopeQuery(tc.query, "exp1")
+			if err == nil {
+				t.Errorf("got %s, wanted an error", got)
+			}
+		})
+	}
+}
+
+// TestScopeQuerySelectors checks that every selector of a scoped query has the experiment matcher,
+// however the query is written.
+func TestScopeQuerySelectors(t *testing.T) {
+	queries := []string{
+		`sum by ("x)")(secret) + vector("\")")`,
+		`a and on(b) group_left c`,
+		"sum by (a # )\n) (secret)",
+		`count(up) without (a) / on() b`,
+		`{__name__="secret"} or secret{}`,
+	}
+	for _, q := range queries {
+		got, err := scopeQuery(q, "exp1")
+		if err != nil {
+			continue
+		}
+		toks, err := lexQuery(got)
+		if err != nil {
+			t.Fatalf("lex scoped query %s: %v", got, err)
+		}
+		for i, tok := range toks {
+			if tok.kind != tokLBrace {
+				continue
+			}
+			if !strings.HasPrefix(got[tok.pos:], `{experiment="exp1"`) {
+				t.Errorf("selector at offset %d of %s is not scoped", i, got)
+			}
+		}
+		if strings.Contains(got, "secret") && !strings.Contains(got, `secret{experiment="exp1"`) && !strings.Contains(got, `{experiment="exp1",__name__="secret"}`) {
+			t.Errorf("secret is not scoped in %s", got)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// A Quota limits the experiments that may run at the same time. A zero value for any limit
+// means it is not enforced.
+type Quota struct {
+	MaxExperiments int     `json:"max_experiments"` // maximum number of concurrently running experiments
+	MaxVCPUs       int     `json:"max_vcpus"`       // maximum number of vCPUs used by running experiments
+	MaxDailySpend  float64 `json:"max_daily_spend"` // maximum cost in US dollars of experiments started in the past 24 hours
+}
+
+// QuotaConfig holds the quotas enforced when experiments are submitted. The global quota
+// applies to all experiments together, team quotas to all experiments submitted by members of
+// a team and user quotas to each user's experiments. Users without their own quota are subject
+// to the default user quota.
+type QuotaConfig struct {
+	Global      Quota            `json:"global"`
+	DefaultUser Quota            `json:"default_user"`
+	Users       map[string]Quota `json:"users"`
+	Teams       map[string]Quota `json:"teams"`
+}
+
+func LoadQuotaConfig(fname string) (*QuotaConfig, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open quotas file: %w", err)
+	}
+	defer f.Close()
+
+	qc := new(QuotaConfig)
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(qc); err != nil {
+		return nil, fmt.Errorf("decode quotas file: %w", err)
+	}
+	return qc, nil
+}
+
+// QuotaExceededError reports the quota that would be exceeded by an experiment.
+type QuotaExceededError struct {
+	Scope   string // global, team or user along with the team or user name
+	Limit   string
+	Current float64
+	Adding  float64
+	Max     float64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded for %s: %g in use, experiment needs %g more, limit is %g", e.Limit, e.Scope, e.Current, e.Adding, e.Max)
+}
+
+// Check returns a QuotaExceededError if starting an experiment with the given usage would
+// exceed any quota, taking into account the experiments already managed. Experiments with the
+// same name are ignored since the new experiment replaces them.
+func (qc *QuotaConfig) Check(name string, start, end time.Time, u api.Usage, managed map[string]*ManagedResources, now time.Time) error {
+	if err := checkQuota("global", qc.Global, name, start, end, u, managed, now, func(*ManagedResources) bool { return true }); err != nil {
+		return err
+	}
+
+	if u.Team != "" {
+		if q, ok := qc.Teams[u.Team]; ok {
+			if err := checkQuota("team "+u.Team, q, name, start, end, u, managed, now, func(mr *ManagedResources) bool { return mr.Usage.Team == u.Team }); err != nil {
+				return err
+			}
+		}
+	}
+
+	q, ok := qc.Users[u.Owner]
+	if !ok {
+		q = qc.DefaultUser
+	}
+	owner := u.Owner
+	if owner == "" {
+		owner = "(unknown)"
+	}
+	return checkQuota("user "+owner, q, name, start, end, u, managed, now, func(mr *ManagedResources) bool { return mr.Usage.Owner == u.Owner })
+}
+
+// Admit is like Check but, if a quota would be exceeded, looks for running preemptible
+// experiments of lower priority than the new one that could be stopped to make room. It returns
+// the names of the experiments to preempt, lowest priority and most recently started first so
+// that as little completed work as possible is lost, or the error from Check if stopping them
+// all would still not be enough.
+func (qc *QuotaConfig) Admit(name string, start, end time.Time, u api.Usage, managed map[string]*ManagedResources, now time.Time) ([]string, error) {
+	err := qc.Check(name, start, end, u, managed, now)
+	if err == nil {
+		return nil, nil
+	}
+
+	var candidates []*ManagedResources
+	for _, mr := range managed {
+		if mr.Name == name || !mr.Deleted.IsZero() || !mr.Usage.Preemptible {
+			continue
+		}
+		if priorityRank(mr.Usage.Priority) < priorityRank(u.Priority) {
+			candidates = append(candidates, mr)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ri, rj := priorityRank(candidates[i].Usage.Priority), priorityRank(candidates[j].Usage.Priority)
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].Start.After(candidates[j].Start)
+	})
+
+	// treat preempted experiments as stopping now, so they no longer count towards running
+	// experiments but the spend they have already incurred is still counted
+	remaining := make(map[string]*ManagedResources, len(managed))
+	for k, mr := range managed {
+		remaining[k] = mr
+	}
+	var preempt []string
+	for _, mr := range candidates {
+		stopped := *mr
+		stopped.Deleted = now
+		remaining[mr.Name] = &stopped
+		preempt = append(preempt, mr.Name)
+		if qc.Check(name, start, end, u, remaining, now) == nil {
+			return preempt, nil
+		}
+	}
+	return nil, err
+}
+
+// priorityRank orders priorities from least to most urgent. An empty priority is normal.
+func priorityRank(p string) int {
+	switch p {
+	case api.PriorityLow:
+		return 0
+	case api.PriorityUrgent:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func checkQuota(scope string, q Quota, name string, start, end time.Time, u api.Usage, managed map[string]*ManagedResources, now time.Time, include func(*ManagedResources) bool) error {
+	var experiments, vcpus int
+	var spend float64
+	for _, mr := range managed {
+		if mr.Name == name || !include(mr) {
+			continue
+		}
+		spend += dailySpend(mr.Usage.CostPerHour, mr.Start, mr.stopTime(), now)
+		if !mr.Deleted.IsZero() {
+			continue
+		}
+		experiments++
+		vcpus += mr.Usage.VCPUs
+	}
+
+	if q.MaxExperiments > 0 && experiments+1 > q.MaxExperiments {
+		return &QuotaExceededError{Scope: scope, Limit: "concurrent experiments", Current: float64(experiments), Adding: 1, Max: float64(q.MaxExperiments)}
+	}
+	if q.MaxVCPUs > 0 && vcpus+u.VCPUs > q.MaxVCPUs {
+		return &QuotaExceededError{Scope: scope, Limit: "vCPU", Current: float64(vcpus), Adding: float64(u.VCPUs), Max: float64(q.MaxVCPUs)}
+	}
+	if adding := dailySpend(u.CostPerHour, start, end, now); q.MaxDailySpend > 0 && spend+adding > q.MaxDailySpend {
+		return &QuotaExceededError{Scope: scope, Limit: "daily spend", Current: roundCents(spend), Adding: roundCents(adding), Max: q.MaxDailySpend}
+	}
+	return nil
+}
+
+// dailySpend returns the cost of an experiment running from start to stop if it started within
+// the 24 hours before now, or zero if it started earlier.
+func dailySpend(costPerHour float64, start, stop, now time.Time) float64 {
+	if start.Before(now.Add(-24*time.Hour)) || !stop.After(start) {
+		return 0
+	}
+	return costPerHour * stop.Sub(start).Hours()
+}
+
+func roundCents(v float64) float64 {
+	return float64(int64(v*100+0.5)) / 100
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+const (
+	// restartPollInterval is how often a restart checks whether the target's old task has
+	// stopped and its new one is running.
+	restartPollInterval = 5 * time.Second
+
+	// restartSettle is how long after a restarted target is running that its results are still
+	// excluded, while its caches warm up again. A segment that starts with a redeploy starts once
+	// it has passed.
+	restartSettle = time.Minute
+
+	// gatewayContainer is the name of the container of a target's task that runs its image.
+	gatewayContainer = "gateway"
+)
+
+// A restartRun is the payload of a restart job.
+type restartRun struct {
+	Target     string    `json:"target"`
+	OldTaskArn string    `json:"old_task_arn"`
+	Requested  time.Time `json:"requested"`
+	Author     string    `json:"author,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Exclude    bool      `json:"exclude,omitempty"`
+	Image      string    `json:"image,omitempty"`
+}
+
+// RestartTargetHandler restarts one of a running experiment's targets in the background, or
+// redeploys it with a new image, annotating the experiment with the restart.
+func (s *Server) RestartTargetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	name, target := vars["name"], vars["target"]
+
+	in := new(api.RestartTargetInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+	in.Reason = strings.TrimSpace(in.Reason)
+	if len(in.Reason) > maxAnnotationLength {
+		s.BadRequest(w, r, fmt.Errorf("reason must be no longer than %d bytes", maxAnnotationLength))
+		return
+	}
+	in.Image = strings.TrimSpace(in.Image)
+	if strings.ContainsAny(in.Image, " \t\r\n") {
+		s.BadRequest(w, r, fmt.Errorf("image must not contain whitespace: %q", in.Image))
+		return
+	}
+
+	s.mu.Lock()
+	mr, ok := s.managed[name]
+	running := ok && mr.Deleted.IsZero() && time.Now().Before(mr.End)
+	var res api.Resource
+	found := false
+	if running {
+		_, res, found = targetTask(mr, target)
+	}
+	s.mu.Unlock()
+	if !running {
+		s.NotFound(w, r, fmt.Errorf("experiment %s is not running", name))
+		return
+	}
+	if !found {
+		s.NotFound(w, r, fmt.Errorf("experiment %s has no target named %s", name, target))
+		return
+	}
+	if res.Keys[api.ResourceKeyRunTaskInput] == "" {
+		s.BadRequest(w, r, fmt.Errorf("target %s was deployed without its run task input and cannot be restarted", target))
+		return
+	}
+	for _, j := range s.jobs.List(name) {
+		if j.Kind == api.JobKindRestart && (j.State == api.JobStatePending || j.State == api.JobStateRunning) {
+			s.WriteError(w, http.StatusConflict, api.ErrorCodeConflict, fmt.Errorf("a target of experiment %s is already being restarted by job %s", name, j.ID))
+			return
+		}
+	}
+
+	run := &restartRun{
+		Target:     target,
+		OldTaskArn: res.Keys[api.ResourceKeyArn],
+		Requested:  time.Now().UTC(),
+		Author:     in.Author,
+		Reason:     in.Reason,
+		Exclude:    in.Exclude,
+		Image:      in.Image,
+	}
+	j, err := s.jobs.Submit(ctx, api.JobKindRestart, name, run)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to submit restart: %w", err))
+		return
+	}
+
+	a := api.Annotation{
+		Time:   run.Requested,
+		Author: in.Author,
+		Text:   restartAnnotation(run),
+	}
+	if err := s.addAnnotation(ctx, name, a); err != nil {
+		// the restart has been submitted so it is not failed for want of its annotation
+		slog.Error("failed to annotate restart", err, "experiment", name, "target", target)
+	}
+
+	s.WriteAsJSON(w, http.StatusOK, &api.RestartTargetOutput{Job: j, Annotation: a})
+}
+
+func restartAnnotation(run *restartRun) string {
+	text := "restarted target " + run.Target
+	if run.Image != "" {
+		text = "redeployed target " + run.Target + " with image " + run.Image
+	}
+	if run.Reason != "" {
+		text += ": " + run.Reason
+	}
+	if run.Exclude {
+		text += " (excluded from results)"
+	}
+	return text
+}
+
+// restartJob stops a target's task, waits for it to stop and runs it again, on the same
+// instance if it ran on one so that the target keeps the address dealgood sends requests to.
+// A redeploy first registers a revision of the target's task definition that runs the new image.
+// If ironbar restarts part way through, the job carries on from the step it had reached.
+func (s *Server) restartJob(ctx context.Context, j api.Job, payload json.RawMessage) error {
+	var run restartRun
+	if err := json.Unmarshal(payload, &run); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+
+	s.mu.Lock()
+	m, ok := s.managed[j.Experiment]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok || !mr.Deleted.IsZero() {
+		return nil
+	}
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		return fmt.Errorf("new aws session: %w", err)
+	}
+	logger := slog.With("experiment", mr.Name, "job", j.ID, "target", run.Target)
+
+	_, res, ok := targetTask(mr, run.Target)
+	if !ok {
+		return fmt.Errorf("target %s not found", run.Target)
+	}
+	clusterArn := res.Keys[api.ResourceKeyEcsClusterArn]
+
+	rs := api.TargetRestart{
+		Target:     run.Target,
+		Requested:  run.Requested,
+		Author:     run.Author,
+		Reason:     run.Reason,
+		OldTaskArn: run.OldTaskArn,
+		Excluded:   run.Exclude,
+		Image:      run.Image,
+	}
+	for _, prev := range mr.Restarts {
+		if prev.Target == run.Target && prev.Requested.Equal(run.Requested) {
+			// the task definition was registered before ironbar restarted
+			rs.OldImage, rs.TaskDefinitionArn = prev.OldImage, prev.TaskDefinitionArn
+		}
+	}
+	fail := func(err error) error {
+		rs.Error = err.Error()
+		s.recordRestart(ctx, logger, mr.Name, rs)
+		return err
+	}
+
+	if taskArn := res.Keys[api.ResourceKeyArn]; taskArn != run.OldTaskArn {
+		// the new task was started before ironbar restarted
+		rs.NewTaskArn = taskArn
+	} else {
+		in := new(ecs.RunTaskInput)
+		if err := json.Unmarshal([]byte(res.Keys[api.ResourceKeyRunTaskInput]), in); err != nil {
+			return fail(fmt.Errorf("decode run task input: %w", err))
+		}
+		if run.Image != "" {
+			if rs.TaskDefinitionArn == "" {
+				rs.TaskDefinitionArn, rs.OldImage, err = registerTargetImage(ctx, sess, aws.StringValue(in.TaskDefinition), run.Image)
+				if err != nil {
+					return fail(err)
+				}
+				logger.Info("registered task definition for new image", "arn", rs.TaskDefinitionArn, "image", run.Image, "old_image", rs.OldImage)
+				// recorded straight away so that the task definition is removed at teardown
+				s.recordRestart(ctx, logger, mr.Name, rs)
+			}
+			in.TaskDefinition = aws.String(rs.TaskDefinitionArn)
+		}
+
+		instanceID, err := taskInstanceID(ctx, sess, clusterArn, run.OldTaskArn)
+		if err != nil {
+			return fail(fmt.Errorf("find instance of target's task: %w", err))
+		}
+
+		logger.Info("stopping target for restart", "arn", run.OldTaskArn)
+		if err := stopEcsTask(ctx, sess, clusterArn, run.OldTaskArn); err != nil {
+			return fail(err)
+		}
+		if err := pollRestart(ctx, func() (bool, error) {
+			return isTaskStopped(ctx, sess, clusterArn, run.OldTaskArn)
+		}); err != nil {
+			return fail(fmt.Errorf("wait for target's task to stop: %w", err))
+		}
+
+		if instanceID != "" {
+			in.PlacementConstraints = []*ecs.PlacementConstraint{{
+				Type:       aws.String(ecs.PlacementConstraintTypeMemberOf),
+				Expression: aws.String("ec2InstanceId == " + instanceID),
+			}}
+			in.PlacementStrategy = nil
+		}
+		rs.NewTaskArn, err = runEcsTask(ctx, sess, in)
+		if err != nil {
+			return fail(err)
+		}
+		logger.Info("started target's new task", "arn", rs.NewTaskArn, "instance_id", instanceID)
+		s.recordRestart(ctx, logger, mr.Name, rs)
+	}
+
+	if err := pollRestart(ctx, func() (bool, error) {
+		task, err := describeEcsTask(ctx, sess, clusterArn, rs.NewTaskArn)
+		if err != nil || task == nil {
+			return false, err
+		}
+		switch aws.StringValue(task.LastStatus) {
+		case "RUNNING":
+			return true, nil
+		case "STOPPED", "DELETED":
+			_, reason := classifyFailure(task)
+			return false, fmt.Errorf("target's new task stopped: %s", reason)
+		}
+		return false, nil
+	}); err != nil {
+		return fail(err)
+	}
+
+	rs.Running = time.Now().UTC()
+	logger.Info("restarted target", "arn", rs.NewTaskArn, "took", rs.Running.Sub(rs.Requested).Round(time.Second))
+	if !s.recordRestart(ctx, logger, mr.Name, rs) {
+		return fmt.Errorf("record restart")
+	}
+	return ctx.Err()
+}
+
+// recordRestart adds or updates a restart of an experiment's target, pointing the target's
+// task resource at its new task, and records both. The task definition of a redeploy is added to
+// the experiment's resources and the target's task is run with it from then on, including by
+// retries. It reports whether they were recorded.
+func (s *Server) recordRestart(ctx context.Context, logger *slog.Logger, name string, rs api.TargetRestart) bool {
+	s.mu.Lock()
+	cur, ok := s.managed[name]
+	if !ok {
+		s.mu.Unlock()
+		return false
+	}
+	if rs.TaskDefinitionArn != "" && !hasResource(cur, api.ResourceTypeEcsTaskDefinition, rs.TaskDefinitionArn) {
+		cur.Resources = append(cur.Resources, api.Resource{
+			Type: api.ResourceTypeEcsTaskDefinition,
+			Keys: map[string]string{api.ResourceKeyArn: rs.TaskDefinitionArn},
+		})
+	}
+	if i, res, ok := targetTask(cur, rs.Target); ok && rs.NewTaskArn != "" && res.Keys[api.ResourceKeyArn] == rs.OldTaskArn {
+		res = retriedResource(res, rs.NewTaskArn)
+		if rs.TaskDefinitionArn != "" {
+			if runIn, err := withTaskDefinition(res.Keys[api.ResourceKeyRunTaskInput], rs.TaskDefinitionArn); err != nil {
+				logger.Error("failed to update run task input for new image", err)
+			} else {
+				res.Keys[api.ResourceKeyRunTaskInput] = runIn
+			}
+		}
+		cur.Resources[i] = res
+	}
+	found := false
+	for i := range cur.Restarts {
+		if cur.Restarts[i].Target == rs.Target && cur.Restarts[i].Requested.Equal(rs.Requested) {
+			cur.Restarts[i] = rs
+			found = true
+		}
+	}
+	if !found {
+		cur.Restarts = append(cur.Restarts, rs)
+	}
+	resJSON, err := json.Marshal(cur.Resources)
+	var restartsJSON []byte
+	if err == nil {
+		restartsJSON, err = json.Marshal(cur.Restarts)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		logger.Error("failed to marshal restart", err)
+		return false
+	}
+
+	if err := s.db.RecordExperimentRestarts(ctx, name, string(resJSON), string(restartsJSON)); err != nil {
+		logger.Error("failed to record restart", err)
+		s.checkErrorsCounter.Add(1)
+		return false
+	}
+	return true
+}
+
+// pollRestart calls done every restartPollInterval until it returns true or an error, or ctx
+// is done.
+func pollRestart(ctx context.Context, done func() (bool, error)) error {
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(restartPollInterval):
+		}
+	}
+}
+
+// targetTask returns the index and resource of the task of the named target of an experiment.
+func targetTask(mr *ManagedResources, target string) (int, api.Resource, bool) {
+	for i, res := range mr.Resources {
+		if res.Type == api.ResourceTypeEcsTask && res.Keys[api.ResourceKeyComponent] == targetComponentPrefix+target {
+			return i, res, true
+		}
+	}
+	return 0, api.Resource{}, false
+}
+
+func hasResource(mr *ManagedResources, typ string, arn string) bool {
+	for _, res := range mr.Resources {
+		if res.Type == typ && res.Keys[api.ResourceKeyArn] == arn {
+			return true
+		}
+	}
+	return false
+}
+
+// withTaskDefinition returns a run task input that runs a different task definition.
+func withTaskDefinition(runTaskInput string, arn string) (string, error) {
+	in := new(ecs.RunTaskInput)
+	if err := json.Unmarshal([]byte(runTaskInput), in); err != nil {
+		return "", fmt.Errorf("decode run task input: %w", err)
+	}
+	in.TaskDefinition = aws.String(arn)
+	b, err := json.Marshal(in)
+	if err != nil {
+		return "", fmt.Errorf("encode run task input: %w", err)
+	}
+	return string(b), nil
+}
+
+// registerTargetImage registers a revision of a target's task definition whose gateway container
+// runs image, keeping the rest of the definition and its tags. It returns the arn of the revision
+// and the image the gateway container ran before.
+func registerTargetImage(ctx context.Context, sess *session.Session, arn string, image string) (string, string, error) {
+	out, err := ecs.New(sess).DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(arn),
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("describe task definition: %w", err)
+	}
+	td := out.TaskDefinition
+	if td == nil {
+		return "", "", fmt.Errorf("no task definition found")
+	}
+
+	var oldImage string
+	found := false
+	for _, c := range td.ContainerDefinitions {
+		if aws.StringValue(c.Name) == gatewayContainer {
+			oldImage = aws.StringValue(c.Image)
+			c.Image = aws.String(image)
+			found = true
+		}
+	}
+	if !found {
+		return "", "", fmt.Errorf("task definition has no %s container", gatewayContainer)
+	}
+
+	in := &ecs.RegisterTaskDefinitionInput{
+		Family:                  td.Family,
+		ContainerDefinitions:    td.ContainerDefinitions,
+		Cpu:                     td.Cpu,
+		Memory:                  td.Memory,
+		EphemeralStorage:        td.EphemeralStorage,
+		ExecutionRoleArn:        td.ExecutionRoleArn,
+		TaskRoleArn:             td.TaskRoleArn,
+		InferenceAccelerators:   td.InferenceAccelerators,
+		IpcMode:                 td.IpcMode,
+		PidMode:                 td.PidMode,
+		NetworkMode:             td.NetworkMode,
+		PlacementConstraints:    td.PlacementConstraints,
+		ProxyConfiguration:      td.ProxyConfiguration,
+		RequiresCompatibilities: td.RequiresCompatibilities,
+		RuntimePlatform:         td.RuntimePlatform,
+		Volumes:                 td.Volumes,
+	}
+	if len(out.Tags) > 0 {
+		in.Tags = out.Tags
+	}
+	newArn, err := registerEcsTaskDefinition(ctx, sess, in)
+	if err != nil {
+		return "", "", err
+	}
+	return newArn, oldImage, nil
+}
+
+// taskInstanceID returns the id of the ec2 instance a task is running on, or an empty string if
+// it runs on fargate or has already stopped.
+func taskInstanceID(ctx context.Context, sess *session.Session, ecsClusterArn, taskArn string) (string, error) {
+	task, err := describeEcsTask(ctx, sess, ecsClusterArn, taskArn)
+	if err != nil {
+		return "", err
+	}
+	if task == nil || task.ContainerInstanceArn == nil {
+		return "", nil
+	}
+	inst, err := describeContainerInstanceHost(ctx, sess, ecsClusterArn, aws.StringValue(task.ContainerInstanceArn))
+	if err != nil || inst == nil {
+		return "", err
+	}
+	return aws.StringValue(inst.InstanceId), nil
+}
+
+// excludedWindows returns the periods between start and end that are left out of an
+// experiment's results: from each restart that asked to be excluded until restartSettle after
+// the target was running again, or until the end if it never was. Overlapping periods are
+// merged.
+func excludedWindows(mr *ManagedResources, start, end time.Time) []api.ExcludedWindow {
+	var windows []api.ExcludedWindow
+	for _, rs := range mr.Restarts {
+		if !rs.Excluded {
+			continue
+		}
+		w := api.ExcludedWindow{
+			Start:  rs.Requested,
+			End:    end,
+			Reason: "restart of target " + rs.Target,
+		}
+		if !rs.Running.IsZero() {
+			w.End = rs.Running.Add(restartSettle)
+		}
+		if w.Start.Before(start) {
+			w.Start = start
+		}
+		if w.End.After(end) {
+			w.End = end
+		}
+		if w.End.After(w.Start) {
+			windows = append(windows, w)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+
+	var merged []api.ExcludedWindow
+	for _, w := range windows {
+		if n := len(merged); n > 0 && !w.Start.After(merged[n-1].End) {
+			if w.End.After(merged[n-1].End) {
+				merged[n-1].End = w.End
+			}
+			merged[n-1].Reason += ", " + w.Reason
+			continue
+		}
+		merged = append(merged, w)
+	}
+	return merged
+}
+
+// redeploySegments splits the period between start and end at each redeploy of a target with a
+// new image, so that the results of the targets before and after it are reported on their own.
+// A segment ends when a redeploy is requested and the next starts restartSettle after the target
+// is running its new image. It returns nil if no target was redeployed.
+func redeploySegments(mr *ManagedResources, start, end time.Time) []api.Segment {
+	var redeploys []api.TargetRestart
+	for _, rs := range mr.Restarts {
+		if rs.Image != "" && rs.Error == "" && !rs.Running.IsZero() {
+			redeploys = append(redeploys, rs)
+		}
+	}
+	if len(redeploys) == 0 {
+		return nil
+	}
+	sort.Slice(redeploys, func(i, j int) bool { return redeploys[i].Requested.Before(redeploys[j].Requested) })
+
+	// the targets that are redeployed start with the image they were first redeployed from
+	images := make(map[string]string)
+	for _, rs := range redeploys {
+		if _, ok := images[rs.Target]; !ok {
+			images[rs.Target] = rs.OldImage
+		}
+	}
+
+	var segments []api.Segment
+	add := func(name string, segStart, segEnd time.Time) {
+		if segEnd.After(end) {
+			segEnd = end
+		}
+		if !segEnd.After(segStart) {
+			return
+		}
+		seg := api.Segment{Name: name, Start: segStart, End: segEnd, Images: make(map[string]string, len(images))}
+		for target, image := range images {
+			seg.Images[target] = image
+		}
+		segments = append(segments, seg)
+	}
+
+	name, segStart := "initial", start
+	for _, rs := range redeploys {
+		add(name, segStart, rs.Requested)
+		images[rs.Target] = rs.Image
+		name = fmt.Sprintf("after redeploy of %s with %s", rs.Target, rs.Image)
+		segStart = rs.Running.Add(restartSettle)
+	}
+	add(name, segStart, end)
+	return segments
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// A ResultsClient reads the results of an experiment from the Prometheus query api that
+// dealgood's metrics are written to.
+type ResultsClient struct {
+	URL   string // base url of the query api, for example https://prometheus-us-central1.grafana.net/api/prom
+	User  string
+	Token string
+
+	client *http.Client
+}
+
+func NewResultsClient(baseURL, user, token string) *ResultsClient {
+	return &ResultsClient{
+		URL:    baseURL,
+		User:   user,
+		Token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// TargetSummaries returns a summary of the requests sent to each target between start and end,
+// leaving out those sent during the excluded windows. The excluded windows must not overlap.
+func (c *ResultsClient) TargetSummaries(ctx context.Context, experiment string, start, end time.Time, excluded []api.ExcludedWindow) ([]api.TargetSummary, error) {
+	sel := fmt.Sprintf("{experiment=%q}", experiment)
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+	increase := func(series string) string {
+		return increaseExcluding(series, start, end, excluded)
+	}
+
+	summaries := make(map[string]*api.TargetSummary)
+	for _, q := range []struct {
+		expr string
+		set  func(*api.TargetSummary, float64)
+	}{
+		{
+			expr: fmt.Sprintf("sum by (target) (%s)", increase("thunderdome_dealgood_requests_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.Requests = v },
+		},
+		{
+			expr: fmt.Sprintf("sum by (target) (%s) / sum by (target) (%s)", increase("thunderdome_dealgood_errors_total"+sel), increase("thunderdome_dealgood_requests_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.ErrorRatio = v },
+		},
+		{
+			expr: fmt.Sprintf("histogram_quantile(0.5, sum by (target, le) (%s))", increase("thunderdome_dealgood_ttfb_seconds_bucket"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.TTFBP50 = v },
+		},
+		{
+			expr: fmt.Sprintf("histogram_quantile(0.95, sum by (target, le) (%s))", increase("thunderdome_dealgood_ttfb_seconds_bucket"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.TTFBP95 = v },
+		},
+		{
+			expr: fmt.Sprintf("histogram_quantile(0.99, sum by (target, le) (%s))", increase("thunderdome_dealgood_ttfb_seconds_bucket"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.TTFBP99 = v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (last_over_time(thunderdome_dealgood_audit_completeness_ratio%s%s))", sel, window),
+			set:  func(ts *api.TargetSummary, v float64) { ts.Completeness = &v },
+		},
+		{
+			expr: fmt.Sprintf("sum by (target) (%s) > 0", increase("thunderdome_egress_denied_requests_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.EgressDenied = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (last_over_time(thunderdome_dealgood_network_baseline_rtt_seconds%s%s))", sel, window),
+			set:  func(ts *api.TargetSummary, v float64) { ts.BaselineRTT = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (last_over_time(thunderdome_dealgood_network_baseline_throughput_bytes_per_second%s%s))", sel, window),
+			set:  func(ts *api.TargetSummary, v float64) { ts.BaselineThroughput = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (last_over_time(thunderdome_dealgood_search_capacity_requests_per_second%s%s))", sel, window),
+			set:  func(ts *api.TargetSummary, v float64) { ts.Capacity = &v },
+		},
+		{
+			expr: fmt.Sprintf("sum by (target) (%s)", increase("thunderdome_dealgood_spikes_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.Spikes = &v },
+		},
+		{
+			expr: fmt.Sprintf("sum by (target) (%s)", increase("thunderdome_dealgood_spike_unrecovered_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.SpikesUnrecovered = &v },
+		},
+		{
+			expr: fmt.Sprintf("sum by (target) (%s) / ((sum by (target) (%s) - sum by (target) (%s)) > 0)", increase("thunderdome_dealgood_spike_recovery_seconds_total"+sel), increase("thunderdome_dealgood_spikes_total"+sel), increase("thunderdome_dealgood_spike_unrecovered_total"+sel)),
+			set:  func(ts *api.TargetSummary, v float64) { ts.SpikeRecoveryMean = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (last_over_time(thunderdome_dealgood_spike_recovery_max_seconds%s%s))", sel, window),
+			set:  func(ts *api.TargetSummary, v float64) { ts.SpikeRecoveryMax = &v },
+		},
+	} {
+		values, err := c.queryByTarget(ctx, q.expr, end)
+		if err != nil {
+			return nil, err
+		}
+		for target, v := range values {
+			ts, ok := summaries[target]
+			if !ok {
+				ts = &api.TargetSummary{Target: target}
+				summaries[target] = ts
+			}
+			q.set(ts, v)
+		}
+	}
+
+	for _, q := range []struct {
+		expr string
+		set  func(*api.TargetSummary, string, float64)
+	}{
+		{
+			expr: fmt.Sprintf("sum by (target, upstream) (%s)", increase("thunderdome_egress_upstream_requests_total"+sel)),
+			set: func(ts *api.TargetSummary, upstream string, v float64) {
+				if ts.UpstreamRequests == nil {
+					ts.UpstreamRequests = make(map[string]float64)
+				}
+				ts.UpstreamRequests[upstream] = v
+			},
+		},
+		{
+			expr: fmt.Sprintf("sum by (target, upstream) (%s)", increase(fmt.Sprintf("thunderdome_egress_upstream_bytes_total{experiment=%q,direction=\"received\"}", experiment))),
+			set: func(ts *api.TargetSummary, upstream string, v float64) {
+				if ts.UpstreamBytes == nil {
+					ts.UpstreamBytes = make(map[string]float64)
+				}
+				ts.UpstreamBytes[upstream] = v
+			},
+		},
+	} {
+		// join the labels so each series can be keyed by target and upstream
+		values, err := c.queryByLabel(ctx, fmt.Sprintf("label_join(%s, \"target_upstream\", \"/\", \"target\", \"upstream\")", q.expr), "target_upstream", end)
+		if err != nil {
+			return nil, err
+		}
+		for key, v := range values {
+			target, upstream, ok := strings.Cut(key, "/")
+			if !ok {
+				continue
+			}
+			// only add upstreams to targets that dealgood sent requests to
+			if ts, ok := summaries[target]; ok {
+				q.set(ts, upstream, v)
+			}
+		}
+	}
+
+	out := make([]api.TargetSummary, 0, len(summaries))
+	for _, ts := range summaries {
+		out = append(out, *ts)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out, nil
+}
+
+// TrafficSummary returns the rate and composition of the live request stream between start
+// and end, as recorded by skyfish before any filtering. Experiments replaying live traffic at
+// different times of day see different traffic, so this is reported alongside their results.
+func (c *ResultsClient) TrafficSummary(ctx context.Context, start, end time.Time) (*api.TrafficSummary, error) {
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	total, err := c.queryByLabel(ctx, fmt.Sprintf("sum(rate(thunderdome_skyfish_traffic_requests_total%s))", window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	ts := &api.TrafficSummary{
+		RequestRate: total[""],
+	}
+
+	ts.PathClasses, err = c.queryShares(ctx, fmt.Sprintf("sum by (path_class) (rate(thunderdome_skyfish_traffic_requests_total%s))", window), "path_class", end)
+	if err != nil {
+		return nil, err
+	}
+	ts.StatusClasses, err = c.queryShares(ctx, fmt.Sprintf("sum by (status_class) (rate(thunderdome_skyfish_traffic_requests_total%s))", window), "status_class", end)
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// MeasuredWindow returns the measured window dealgood recorded for an experiment that ran
+// between start and end, or nil if dealgood did not record one.
+func (c *ResultsClient) MeasuredWindow(ctx context.Context, experiment string, start, end time.Time) (*api.MeasuredWindow, error) {
+	sel := fmt.Sprintf("{experiment=%q}", experiment)
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	starts, err := c.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_window_start_timestamp_seconds%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	if len(starts) == 0 {
+		return nil, nil
+	}
+	ends, err := c.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_window_end_timestamp_seconds%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	mw := &api.MeasuredWindow{Start: unixSeconds(starts[""])}
+	if v, ok := ends[""]; ok {
+		mw.End = unixSeconds(v)
+	}
+	return mw, nil
+}
+
+// unixSeconds converts a unix time in fractional seconds, as exported in metrics, to a time.
+func unixSeconds(v float64) time.Time {
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// WorkloadSummary returns the composition of the requests dealgood replayed to an experiment's
+// targets between start and end, as last profiled by dealgood. It returns nil if dealgood did not
+// profile the workload.
+func (c *ResultsClient) WorkloadSummary(ctx context.Context, experiment string, start, end time.Time) (*api.WorkloadSummary, error) {
+	sel := fmt.Sprintf("{experiment=%q}", experiment)
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	requests, err := c.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_workload_requests%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	unique, err := c.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_workload_unique_paths%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	ws := &api.WorkloadSummary{
+		Requests:    requests[""],
+		UniquePaths: unique[""],
+	}
+
+	ws.TopShare, err = c.queryByLabel(ctx, fmt.Sprintf("max by (n) (last_over_time(thunderdome_dealgood_workload_top_share%s%s))", sel, window), "n", end)
+	if err != nil {
+		return nil, err
+	}
+	ws.SizeBytes, err = c.queryByLabel(ctx, fmt.Sprintf("max by (quantile) (last_over_time(thunderdome_dealgood_workload_response_size_bytes%s%s))", sel, window), "quantile", end)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// queryShares runs an instant query at time t and returns each series' share of the total,
+// keyed by the value of label.
+func (c *ResultsClient) queryShares(ctx context.Context, query string, label string, t time.Time) (map[string]float64, error) {
+	values, err := c.queryByLabel(ctx, query, label, t)
+	if err != nil {
+		return nil, err
+	}
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	for k, v := range values {
+		values[k] = v / total
+	}
+	return values, nil
+}
+
+// increaseExcluding returns an expression for the increase of each of the series between start
+// and end less its increase during each excluded window, which must not overlap.
+func increaseExcluding(series string, start, end time.Time, excluded []api.ExcludedWindow) string {
+	expr := fmt.Sprintf("increase(%s[%ds])", series, rangeSeconds(end.Sub(start)))
+	if len(excluded) == 0 {
+		return expr
+	}
+	for _, w := range excluded {
+		if w.Start.Before(start) {
+			w.Start = start
+		}
+		if w.End.After(end) {
+			w.End = end
+		}
+		if w.End.Sub(w.Start) < time.Second {
+			continue
+		}
+		offset := ""
+		if d := rangeSeconds(end.Sub(w.End)); d > 0 {
+			offset = fmt.Sprintf(" offset %ds", d)
+		}
+		// series with no samples in the window are kept by falling back to zero
+		expr += fmt.Sprintf(" - (increase(%[1]s[%[2]ds]%[3]s) or %[1]s * 0)", series, rangeSeconds(w.End.Sub(w.Start)), offset)
+	}
+	return "(" + expr + ")"
+}
+
+// rangeSeconds returns a duration as the whole number of seconds used in a range selector.
+func rangeSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// queryByTarget runs an instant query at time t and returns the value of each series keyed by
+// its target label. Series whose value is not a number are skipped.
+func (c *ResultsClient) queryByTarget(ctx context.Context, query string, t time.Time) (map[string]float64, error) {
+	return c.queryByLabel(ctx, query, "target", t)
+}
+
+// queryByLabel runs an instant query at time t and returns the value of each series keyed by
+// the value of label. Series whose value is not a number are skipped.
+func (c *ResultsClient) queryByLabel(ctx context.Context, query string, label string, t time.Time) (map[string]float64, error) {
+	params := url.Values{
+		"query": {query},
+		"time":  {strconv.FormatInt(t.Unix(), 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/api/v1/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	if c.User != "" || c.Token != "" {
+		req.SetBasicAuth(c.User, c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("query: unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var out struct {
+		Status string `json:"status"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []any             `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if out.Status != "success" {
+		return nil, fmt.Errorf("query status: %s", out.Status)
+	}
+
+	values := make(map[string]float64)
+	for _, r := range out.Data.Result {
+		if len(r.Value) != 2 {
+			continue
+		}
+		s, ok := r.Value[1].(string)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		values[r.Metric[label]] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/gorilla/mux"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// retentionInterval is how often the retention policy is applied.
+const retentionInterval = time.Hour
+
+// A RetentionPolicy removes the records ironbar keeps of completed experiments once they
+// stopped longer ago than its period: the experiment's entry in the history, its analyses and
+// annotations, and the annotations copied to Grafana. If an archive bucket is given the
+// records are written to it first. Pinned experiments are kept indefinitely.
+type RetentionPolicy struct {
+	Period        time.Duration
+	ArchiveBucket string // s3 bucket that records are archived to before removal, not archived if empty
+	KmsKey        string // key archives are encrypted with, the bucket's default if empty
+
+	lastApplied time.Time
+}
+
+func NewRetentionPolicy(period time.Duration, archiveBucket, kmsKey string) *RetentionPolicy {
+	return &RetentionPolicy{
+		Period:        period,
+		ArchiveBucket: archiveBucket,
+		KmsKey:        kmsKey,
+	}
+}
+
+// expired reports whether a completed experiment is older than the retention period.
+func (p *RetentionPolicy) expired(it api.ListExperimentsItem, now time.Time) bool {
+	stopped := it.Stopped
+	if stopped.IsZero() {
+		stopped = it.End
+	}
+	return now.Sub(stopped) > p.Period
+}
+
+// An experimentArchive holds everything ironbar recorded about a run of an experiment.
+type experimentArchive struct {
+	Experiment  api.ListExperimentsItem `json:"experiment"`
+	Analyses    []api.Analysis          `json:"analyses,omitempty"`
+	Annotations []api.Annotation        `json:"annotations,omitempty"`
+}
+
+// ApplyRetention removes, after archiving if configured, the records of completed experiments
+// that have expired, unless they are pinned. The analyses and annotations of an experiment are
+// shared by every run with its name so they are only removed once all of them have expired and
+// the name is not in use by a running experiment. It does nothing if the policy was applied
+// within the last retentionInterval.
+func (s *Server) ApplyRetention(ctx context.Context) {
+	now := time.Now().UTC()
+	if now.Sub(s.retention.lastApplied) < retentionInterval {
+		return
+	}
+	s.retention.lastApplied = now
+
+	history, err := s.db.ListHistory(ctx)
+	if err != nil {
+		slog.Error("failed to read experiment history", err)
+		s.checkErrorsCounter.Add(1)
+		return
+	}
+
+	s.mu.Lock()
+	pinned := s.pinnedExperiments()
+	active := make(map[string]bool, len(s.managed))
+	for name := range s.managed {
+		active[name] = true
+	}
+	s.mu.Unlock()
+
+	runs := map[string][]api.ListExperimentsItem{}
+	for _, it := range history {
+		runs[it.Name] = append(runs[it.Name], it)
+	}
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		slog.Error("failed to create aws session", err)
+		return
+	}
+
+	for name, items := range runs {
+		if pinned[name] {
+			continue
+		}
+		logger := slog.With("experiment", name)
+
+		allExpired := !active[name]
+		var expired []api.ListExperimentsItem
+		for _, it := range items {
+			if s.retention.expired(it, now) {
+				expired = append(expired, it)
+			} else {
+				allExpired = false
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+
+		analyses, err := s.db.GetAnalyses(ctx, name)
+		if err != nil {
+			logger.Error("failed to read analyses", err)
+			s.checkErrorsCounter.Add(1)
+			continue
+		}
+		annotations, err := s.db.GetAnnotations(ctx, name)
+		if err != nil {
+			logger.Error("failed to read annotations", err)
+			s.checkErrorsCounter.Add(1)
+			continue
+		}
+
+		removed := 0
+		for _, it := range expired {
+			if s.retention.ArchiveBucket != "" {
+				if err := s.archiveExperiment(ctx, sess, experimentArchive{Experiment: it, Analyses: analyses, Annotations: annotations}); err != nil {
+					logger.Error("failed to archive experiment", err, "start", it.Start)
+					s.checkErrorsCounter.Add(1)
+					continue
+				}
+			}
+			if err := s.db.DeleteHistory(ctx, it); err != nil {
+				logger.Error("failed to remove experiment history", err, "start", it.Start)
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			removed++
+		}
+
+		if !allExpired || removed != len(expired) {
+			continue
+		}
+		if err := s.db.DeleteExperimentData(ctx, name); err != nil {
+			logger.Error("failed to remove experiment data", err)
+			s.checkErrorsCounter.Add(1)
+		}
+		if s.grafana != nil && len(annotations) > 0 {
+			if err := s.grafana.DeleteAnnotations(ctx, name); err != nil {
+				logger.Error("failed to remove grafana annotations", err)
+				s.checkErrorsCounter.Add(1)
+			}
+		}
+		logger.Info("removed expired experiment records", "runs", removed, "archived", s.retention.ArchiveBucket != "")
+	}
+}
+
+// archiveExperiment writes the records of a run of an experiment to the archive bucket.
+func (s *Server) archiveExperiment(ctx context.Context, sess *session.Session, a experimentArchive) error {
+	content, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("marshal archive: %w", err)
+	}
+	key := path.Join(a.Experiment.Name, a.Experiment.Start.UTC().Format("20060102T150405Z")+".json")
+	if err := putS3Object(ctx, sess, s.retention.ArchiveBucket, key, s.retention.KmsKey, content); err != nil {
+		return fmt.Errorf("store archive: %w", err)
+	}
+	return nil
+}
+
+// pinnedExperiments returns the set of names of pinned experiments. Callers must hold s.mu.
+func (s *Server) pinnedExperiments() map[string]bool {
+	pinned := map[string]bool{}
+	if s.admin == nil {
+		return pinned
+	}
+	for _, p := range s.admin.Pins {
+		pinned[p.Experiment] = true
+	}
+	return pinned
+}
+
+func (s *Server) ListPinsHandler(w http.ResponseWriter, r *http.Request) {
+	out := &api.ListPinsOutput{
+		Items: []api.Pin{},
+	}
+	s.mu.Lock()
+	out.Items = append(out.Items, s.admin.Pins...)
+	s.mu.Unlock()
+	s.WriteAsJSON(w, http.StatusOK, out)
+}
+
+// PinExperimentHandler exempts an experiment from the retention policy, replacing the reason
+// if it is already pinned.
+func (s *Server) PinExperimentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	in := new(api.PinExperimentInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+
+	pin := api.Pin{
+		Experiment: name,
+		Reason:     strings.TrimSpace(in.Reason),
+		Time:       time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := *s.admin
+	st.Pins = []api.Pin{pin}
+	for _, p := range s.admin.Pins {
+		if p.Experiment != name {
+			st.Pins = append(st.Pins, p)
+		}
+	}
+	sort.Slice(st.Pins, func(i, j int) bool { return st.Pins[i].Experiment < st.Pins[j].Experiment })
+	if err := s.db.PutAdminState(ctx, &st); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to record pin: %w", err))
+		return
+	}
+	s.admin = &st
+
+	slog.Info("experiment pinned", "experiment", name, "reason", pin.Reason)
+	s.WriteAsJSON(w, http.StatusOK, &pin)
+}
+
+func (s *Server) UnpinExperimentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := *s.admin
+	st.Pins = nil
+	found := false
+	for _, p := range s.admin.Pins {
+		if p.Experiment == name {
+			found = true
+			continue
+		}
+		st.Pins = append(st.Pins, p)
+	}
+	if !found {
+		s.NotFoundHandler(w, r)
+		return
+	}
+
+	if err := s.db.PutAdminState(ctx, &st); err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to remove pin: %w", err))
+		return
+	}
+	s.admin = &st
+
+	slog.Info("experiment unpinned", "experiment", name)
+	s.WriteAsJSON(w, http.StatusOK, &api.ListPinsOutput{Items: append([]api.Pin{}, st.Pins...)})
+}
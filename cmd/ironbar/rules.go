@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// A RulesClient manages Prometheus recording rules using the ruler api provided by
+// Cortex, Mimir and Grafana Cloud. Each experiment is given its own rule group which
+// records series with stable names, labelled with the experiment name, so that
+// dashboards can overlay the results of multiple runs.
+type RulesClient struct {
+	URL       string // base url of the ruler api, for example https://prometheus-us-central1.grafana.net/api/prom
+	User      string
+	Token     string
+	Namespace string // rule namespace that experiment rule groups are created in
+	Interval  time.Duration
+
+	client *http.Client
+}
+
+func NewRulesClient(baseURL, user, token, namespace string, interval time.Duration) *RulesClient {
+	return &RulesClient{
+		URL:       baseURL,
+		User:      user,
+		Token:     token,
+		Namespace: namespace,
+		Interval:  interval,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type ruleGroup struct {
+	Name     string          `json:"name"`
+	Interval string          `json:"interval,omitempty"`
+	Rules    []recordingRule `json:"rules"`
+}
+
+type recordingRule struct {
+	Record string            `json:"record"`
+	Expr   string            `json:"expr"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ruleGroupName returns the name of the rule group holding the rules for an experiment
+func ruleGroupName(experiment string) string {
+	return "experiment-" + experiment
+}
+
+// experimentRules returns the recording rules for an experiment. The recorded series
+// drop all labels except target and are labelled with the experiment name. The series of
+// shadow targets are recorded by rules of their own and also labelled shadow="true", so
+// that dashboards comparing targets can leave them out.
+func experimentRules(experiment string, shadows []string) []recordingRule {
+	if len(shadows) == 0 {
+		return targetRules(fmt.Sprintf("{experiment=%q}", experiment), map[string]string{"experiment": experiment})
+	}
+	names := make([]string, len(shadows))
+	for i, name := range shadows {
+		names[i] = regexp.QuoteMeta(name)
+	}
+	re := strings.Join(names, "|")
+	rules := targetRules(fmt.Sprintf("{experiment=%q,target!~%q}", experiment, re), map[string]string{"experiment": experiment})
+	return append(rules, targetRules(fmt.Sprintf("{experiment=%q,target=~%q}", experiment, re), map[string]string{"experiment": experiment, "shadow": "true"})...)
+}
+
+// targetRules returns the recording rules for the targets whose series match the selector,
+// labelling the recorded series with labels.
+func targetRules(sel string, labels map[string]string) []recordingRule {
+	var rules []recordingRule
+	for _, hist := range []string{"ttfb_seconds", "request_time_seconds"} {
+		for _, q := range []struct {
+			name     string
+			quantile string
+		}{
+			{name: "p50", quantile: "0.5"},
+			{name: "p95", quantile: "0.95"},
+			{name: "p99", quantile: "0.99"},
+		} {
+			rules = append(rules, recordingRule{
+				Record: "thunderdome:" + hist + ":" + q.name,
+				Expr:   fmt.Sprintf("histogram_quantile(%s, sum by (target, le) (rate(thunderdome_dealgood_%s_bucket%s[5m])))", q.quantile, hist, sel),
+				Labels: labels,
+			})
+		}
+	}
+
+	rules = append(rules,
+		recordingRule{
+			Record: "thunderdome:requests:rate5m",
+			Expr:   fmt.Sprintf("sum by (target) (rate(thunderdome_dealgood_requests_total%s[5m]))", sel),
+			Labels: labels,
+		},
+		recordingRule{
+			Record: "thunderdome:error_ratio:rate5m",
+			Expr:   fmt.Sprintf("sum by (target) (rate(thunderdome_dealgood_errors_total%[1]s[5m])) / sum by (target) (rate(thunderdome_dealgood_requests_total%[1]s[5m]))", sel),
+			Labels: labels,
+		},
+	)
+
+	return rules
+}
+
+// InstallExperimentRules creates or replaces the recording rules for an experiment with the
+// named shadow targets.
+func (c *RulesClient) InstallExperimentRules(ctx context.Context, experiment string, shadows []string) error {
+	group := ruleGroup{
+		Name:  ruleGroupName(experiment),
+		Rules: experimentRules(experiment, shadows),
+	}
+	if c.Interval > 0 {
+		group.Interval = c.Interval.String()
+	}
+
+	// the ruler api accepts yaml, of which json is a subset
+	body, err := json.Marshal(group)
+	if err != nil {
+		return fmt.Errorf("marshal rule group: %w", err)
+	}
+
+	return c.do(ctx, http.MethodPost, "/config/v1/rules/"+url.PathEscape(c.Namespace), body)
+}
+
+// RemoveExperimentRules deletes the recording rules for an experiment.
+func (c *RulesClient) RemoveExperimentRules(ctx context.Context, experiment string) error {
+	err := c.do(ctx, http.MethodDelete, "/config/v1/rules/"+url.PathEscape(c.Namespace)+"/"+url.PathEscape(ruleGroupName(experiment)), nil)
+	if errors.Is(err, errRulesNotFound) {
+		slog.Debug("no recording rules found for experiment", "experiment", experiment)
+		return nil
+	}
+	return err
+}
+
+var errRulesNotFound = errors.New("rule group not found")
+
+func (c *RulesClient) do(ctx context.Context, method string, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/yaml")
+	}
+	if c.User != "" || c.Token != "" {
+		req.SetBasicAuth(c.User, c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s rules: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodDelete {
+		return errRulesNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s rules: unexpected status %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// segmentsDefinition holds the parts of an experiment definition needed to report on the
+// segments its measured period is divided into and to make their admin calls.
+type segmentsDefinition struct {
+	Segments []definedSegment
+}
+
+// A definedSegment is one of the segments of an experiment definition.
+type definedSegment struct {
+	Name       string
+	Duration   time.Duration // zero for a last segment that lasts until the experiment ends
+	Settle     time.Duration
+	AdminCalls []adminCall
+}
+
+// An adminCall is a request sent to the admin api of targets when a segment starts.
+type adminCall struct {
+	Method  string
+	Path    string
+	Body    string
+	Targets []string // every target with an admin port if empty
+}
+
+// definitionSegments returns the segments of an experiment definition, or nil if it has none
+// or cannot be decoded.
+func definitionSegments(definition string) []definedSegment {
+	var def segmentsDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		return nil
+	}
+	return def.Segments
+}
+
+// segmentStarts returns the time each segment starts when the first starts at start.
+func segmentStarts(segs []definedSegment, start time.Time) []time.Time {
+	starts := make([]time.Time, len(segs))
+	for i, sd := range segs {
+		starts[i] = start
+		start = start.Add(sd.Duration)
+	}
+	return starts
+}
+
+// definedSegments divides the period between start and end into the segments of the
+// experiment definition, leaving out the time each segment settles for. The first segment
+// starts at start and a segment that would start after end is omitted. It returns nil if the
+// definition has no segments.
+func definedSegments(definition string, start, end time.Time) ([]api.Segment, error) {
+	if definition == "" {
+		return nil, nil
+	}
+	var def segmentsDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		return nil, fmt.Errorf("decode experiment definition: %w", err)
+	}
+
+	var segments []api.Segment
+	starts := segmentStarts(def.Segments, start)
+	for i, sd := range def.Segments {
+		if !starts[i].Before(end) {
+			break
+		}
+		segEnd := end
+		if sd.Duration > 0 && starts[i].Add(sd.Duration).Before(end) {
+			segEnd = starts[i].Add(sd.Duration)
+		}
+		if settled := starts[i].Add(sd.Settle); settled.Before(segEnd) {
+			segments = append(segments, api.Segment{Name: sd.Name, Start: settled, End: segEnd})
+		}
+		if sd.Duration <= 0 {
+			break
+		}
+	}
+	return segments, nil
+}
@@ -7,51 +7,178 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gorilla/mux"
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 	"github.com/plprobelab/thunderdome/pkg/prom"
+	"github.com/plprobelab/thunderdome/pkg/version"
+)
+
+const (
+	checkJobTimeout       = 5 * time.Minute
+	teardownJobTimeout    = 10 * time.Minute
+	completeJobTimeout    = 4 * time.Hour // analyses may run for as long as their timeouts allow
+	retentionJobTimeout   = 30 * time.Minute
+	conformanceJobTimeout = time.Hour // conformance tests of a phase run in parallel, each within its own timeout
+	restartJobTimeout     = 15 * time.Minute
+	configJobTimeout      = 5 * time.Minute
 )
 
 type Server struct {
-	db              *DB
-	monitorInterval time.Duration
-	settle          time.Duration
-	awsRegion       string
+	db           *DB
+	awsRegion    string
+	rules        *RulesClient              // optional, nil if recording rules are not managed
+	results      *ResultsClient            // optional, nil if results are not included in webhooks
+	grafana      *GrafanaClient            // optional, nil if annotations are not copied to grafana
+	logs         *LogWatcher               // optional, nil if the logs of experiment tasks are not watched
+	dumps        *DumpCollector            // optional, nil if profiles are not captured from targets
+	slowest      *SlowestCollector         // reads the slowest requests reported by dealgood
+	anomalies    *AnomalyDetector          // optional, nil if results are not read
+	retention    *RetentionPolicy          // optional, nil if records of completed experiments are kept indefinitely
+	adminToken   string                    // optional, the admin api is disabled if empty
+	jobs         *JobEngine                // runs checks, teardowns and other background work
+	deployStage  stageDeployer             // deploys the experiments of pipeline stages
+	settings     atomic.Pointer[Settings]  // the configuration that can be reloaded, replaced rather than modified
+	loadSettings func() (*Settings, error) // reads the configuration that can be reloaded
+	reloaded     chan struct{}             // signalled when the settings have been reloaded
 
 	upGauge            prom.Gauge
 	managedGauge       prom.Gauge
 	checkErrorsCounter prom.Counter
+	deadlinesCounter   *prom.CounterVec
 
 	mu      sync.Mutex
 	managed map[string]*ManagedResources
+	admin   *AdminState // maintenance mode, freeze windows and pins, replaced rather than modified
+
+	annotationsMu sync.Mutex // serialises updates to experiment annotations
+	pipelinesMu   sync.Mutex // serialises updates to pipelines, acquired after mu
 }
 
 type ManagedResources struct {
-	Name      string
-	Start     time.Time
-	End       time.Time
-	Resources []api.Resource
-	Deleted   time.Time
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Resources  []api.Resource
+	Deleted    time.Time
+	Usage      api.Usage
+	Failures   []api.Failure
+	Analyses   []api.Analysis      // set once the analyses of a completed experiment have run
+	LogMatches []api.LogMatches    // lines of task logs that matched a log pattern
+	Anomalies  []api.Anomaly       // sudden shifts in a target's error ratio or latency
+	Restarts   []api.TargetRestart // restarts of targets asked for by operators
+	Changes    []api.ConfigChange  // calls made to the admin apis of targets as segments started
+
+	Provisioned bool                   // set once all of the experiment's tasks have been seen running
+	Conformed   []string               // conformance phases that have been run, not recorded so the post phase is run again after a restart
+	Deadlines   []api.DeadlineExceeded // deadlines the experiment has missed, each escalated once
+
+	Slowest        []api.SlowestRequests // slowest requests to each target in the latest window reported by dealgood
+	SlowestOverall []api.SlowestRequests // slowest requests to each target since the experiment started
+
+	Placements []api.TaskPlacement // where each task ran, described once all tasks are running
+	KmsKeyArn  string              // customer managed key the experiment's crash dumps are encrypted with, ironbar's own if empty
+
+	ShutdownTimeouts map[string]time.Duration // time each stage of the shutdown may take, keyed by stage
+	Shutdown         []api.ShutdownStage      // stages of the shutdown that have started, not recorded so the shutdown restarts with ironbar
+
+	Segments []definedSegment // segments of the definition, whose admin calls are made as each starts
+	Shadows  []string         // names of the shadow targets, left out of the comparison of results
 }
 
-func NewServer(ctx context.Context, db *DB, awsRegion string, monitorInterval time.Duration, settle time.Duration) (*Server, error) {
+// slowestRecord is how the slowest requests of an experiment are stored.
+type slowestRecord struct {
+	Latest  []api.SlowestRequests `json:"latest,omitempty"`
+	Overall []api.SlowestRequests `json:"overall,omitempty"`
+}
+
+// clone returns a copy of the experiment that can be modified without affecting m.
+func (m *ManagedResources) clone() *ManagedResources {
+	c := *m
+	c.Resources = append([]api.Resource(nil), m.Resources...)
+	c.Failures = append([]api.Failure(nil), m.Failures...)
+	c.Deadlines = append([]api.DeadlineExceeded(nil), m.Deadlines...)
+	c.Conformed = append([]string(nil), m.Conformed...)
+	c.Slowest = append([]api.SlowestRequests(nil), m.Slowest...)
+	c.SlowestOverall = append([]api.SlowestRequests(nil), m.SlowestOverall...)
+	c.Placements = append([]api.TaskPlacement(nil), m.Placements...)
+	c.Shutdown = append([]api.ShutdownStage(nil), m.Shutdown...)
+	c.Anomalies = append([]api.Anomaly(nil), m.Anomalies...)
+	c.Restarts = append([]api.TargetRestart(nil), m.Restarts...)
+	c.Changes = append([]api.ConfigChange(nil), m.Changes...)
+	c.LogMatches = make([]api.LogMatches, len(m.LogMatches))
+	for i, lm := range m.LogMatches {
+		lm.Excerpts = append([]string(nil), lm.Excerpts...)
+		c.LogMatches[i] = lm
+	}
+	return &c
+}
+
+// stopTime returns the time the experiment stopped or, if it is still running, when it is due to end.
+func (m *ManagedResources) stopTime() time.Time {
+	if !m.Deleted.IsZero() {
+		return m.Deleted
+	}
+	return m.End
+}
+
+func NewServer(ctx context.Context, db *DB, awsRegion string, loadSettings func() (*Settings, error), rules *RulesClient, results *ResultsClient, grafana *GrafanaClient, logs *LogWatcher, dumps *DumpCollector, retention *RetentionPolicy, adminToken string, jobWorkers int) (*Server, error) {
 	s := &Server{
-		db:              db,
-		awsRegion:       awsRegion,
-		monitorInterval: monitorInterval,
-		settle:          settle,
-		managed:         make(map[string]*ManagedResources),
+		db:           db,
+		awsRegion:    awsRegion,
+		rules:        rules,
+		results:      results,
+		grafana:      grafana,
+		logs:         logs,
+		dumps:        dumps,
+		slowest:      NewSlowestCollector(),
+		retention:    retention,
+		adminToken:   adminToken,
+		loadSettings: loadSettings,
+		reloaded:     make(chan struct{}, 1),
+		deployStage:  infraDeployer(awsRegion),
+		managed:      make(map[string]*ManagedResources),
+		admin:        new(AdminState),
 	}
 
+	settings, err := loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	s.settings.Store(settings)
+
+	s.jobs, err = NewJobEngine(db, jobWorkers)
+	if err != nil {
+		return nil, fmt.Errorf("new job engine: %w", err)
+	}
+	s.jobs.Register(api.JobKindCheck, checkJobTimeout, false, s.checkJob)
+	// teardowns are not recorded since the experiment's own record is kept until its resources
+	// have been removed, so the monitor submits them again after a restart
+	s.jobs.Register(api.JobKindTeardown, teardownJobTimeout, false, s.teardownJob)
+	s.jobs.Register(api.JobKindComplete, completeJobTimeout, true, s.completeJob)
+	// the monitor submits post phase conformance tests again after a restart, the pre phase is
+	// skipped if ironbar restarts while it runs
+	s.jobs.Register(api.JobKindConformance, conformanceJobTimeout, false, s.conformanceJob)
+	// restarts are recorded so a target that was stopped is run again if ironbar restarts
+	s.jobs.Register(api.JobKindRestart, restartJobTimeout, true, s.restartJob)
+	// config changes are not recorded since the check of the experiment submits them again
+	// after a restart if the calls of a segment had not all been made
+	s.jobs.Register(api.JobKindConfig, configJobTimeout, false, s.configJob)
+	// pipeline jobs are recorded since nothing else deploys the next stage if one is lost
+	s.jobs.Register(api.JobKindPipeline, pipelineJobTimeout, true, s.pipelineJob)
+	s.jobs.Register(api.JobKindRetention, retentionJobTimeout, false, func(ctx context.Context, _ api.Job, _ json.RawMessage) error {
+		s.ApplyRetention(ctx)
+		return ctx.Err()
+	})
+
 	commonLabels := map[string]string{}
-	var err error
 	s.upGauge, err = prom.NewPrometheusGauge(
 		appName,
 		"up",
@@ -82,6 +209,24 @@ func NewServer(ctx context.Context, db *DB, awsRegion string, monitorInterval ti
 		return nil, fmt.Errorf("new counter: %w", err)
 	}
 
+	if results != nil {
+		s.anomalies, err = NewAnomalyDetector(results)
+		if err != nil {
+			return nil, fmt.Errorf("new anomaly detector: %w", err)
+		}
+	}
+
+	s.deadlinesCounter, err = prom.NewPrometheusCounterVec(
+		appName,
+		"deadlines_exceeded_total",
+		"The total number of experiments that missed a provision or teardown deadline.",
+		commonLabels,
+		"operation",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
 	return s, nil
 }
 
@@ -89,7 +234,14 @@ func (s *Server) Run(ctx context.Context) error {
 	if err := s.LoadManagedResources(ctx); err != nil {
 		return fmt.Errorf("load managed resources: %w", err)
 	}
+	if err := s.LoadAdminState(ctx); err != nil {
+		return fmt.Errorf("load admin state: %w", err)
+	}
+	if err := s.jobs.Resume(ctx); err != nil {
+		return fmt.Errorf("resume jobs: %w", err)
+	}
 
+	go s.jobs.Run(ctx)
 	go s.MonitorResources(ctx)
 
 	mx := mux.NewRouter()
@@ -107,7 +259,7 @@ func (s *Server) Run(ctx context.Context) error {
 		}
 	}()
 
-	slog.Info("starting server", "addr", options.addr)
+	slog.Info("starting server", "addr", options.addr, "version", version.String(), "api_version", api.APIVersion)
 	listener, err := net.Listen("tcp", options.addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %q: %w", options.addr, err)
@@ -137,9 +289,63 @@ func (s *Server) LoadManagedResources(ctx context.Context) error {
 			continue
 		}
 
+		if rec.Usage != "" {
+			if err := json.Unmarshal([]byte(rec.Usage), &m.Usage); err != nil {
+				slog.Error("failed to unmarshal usage", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.Failures != "" {
+			if err := json.Unmarshal([]byte(rec.Failures), &m.Failures); err != nil {
+				slog.Error("failed to unmarshal failures", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.LogMatches != "" {
+			if err := json.Unmarshal([]byte(rec.LogMatches), &m.LogMatches); err != nil {
+				slog.Error("failed to unmarshal log matches", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.Anomalies != "" {
+			if err := json.Unmarshal([]byte(rec.Anomalies), &m.Anomalies); err != nil {
+				slog.Error("failed to unmarshal anomalies", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.Restarts != "" {
+			if err := json.Unmarshal([]byte(rec.Restarts), &m.Restarts); err != nil {
+				slog.Error("failed to unmarshal restarts", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.Changes != "" {
+			if err := json.Unmarshal([]byte(rec.Changes), &m.Changes); err != nil {
+				slog.Error("failed to unmarshal config changes", err, "experiment", rec.Name)
+			}
+		}
+
+		if rec.Slowest != "" {
+			var sr slowestRecord
+			if err := json.Unmarshal([]byte(rec.Slowest), &sr); err != nil {
+				slog.Error("failed to unmarshal slowest requests", err, "experiment", rec.Name)
+			}
+			m.Slowest, m.SlowestOverall = sr.Latest, sr.Overall
+		}
+
+		if rec.Placements != "" {
+			if err := json.Unmarshal([]byte(rec.Placements), &m.Placements); err != nil {
+				slog.Error("failed to unmarshal placements", err, "experiment", rec.Name)
+			}
+		}
+
 		m.Name = rec.Name
 		m.Start = time.Unix(0, rec.Start)
 		m.End = time.Unix(0, rec.End)
+		m.KmsKeyArn = definitionKmsKey(rec.Definition)
+		m.ShutdownTimeouts = shutdownTimeouts(rec.Definition)
+		m.Segments = definitionSegments(rec.Definition)
+		m.Shadows = shadowTargets(rec.Definition)
 		slog.Info("found managed resources", "experiment", m.Name, "end", m.End)
 		s.managed[m.Name] = m
 	}
@@ -151,14 +357,30 @@ func (s *Server) ConfigureRoutes(r *mux.Router) {
 	r.NotFoundHandler = http.HandlerFunc(s.NotFoundHandler)
 	r.Path("/experiments").Methods("POST").HandlerFunc(s.NewExperimentHandler)
 	r.Path("/experiments").Methods("GET").HandlerFunc(s.ListExperimentsHandler)
+	r.Path("/quotas/check").Methods("POST").HandlerFunc(s.CheckQuotaHandler)
+	r.Path("/noise").Methods("GET").HandlerFunc(s.ListNoiseEstimatesHandler)
 	r.Path("/experiments/{name}/status").Methods("GET").HandlerFunc(s.ExperimentStatusHandler)
+	r.Path("/experiments/{name}/adopt").Methods("POST").HandlerFunc(s.AdoptResourcesHandler)
+	r.Path("/experiments/{name}/analyses").Methods("GET").HandlerFunc(s.ListAnalysesHandler)
+	r.Path("/experiments/{name}/annotations").Methods("POST").HandlerFunc(s.AddAnnotationHandler)
+	r.Path("/experiments/{name}/annotations").Methods("GET").HandlerFunc(s.ListAnnotationsHandler)
+	r.Path("/experiments/{name}/targets/{target}/restart").Methods("POST").HandlerFunc(s.RestartTargetHandler)
+	r.Path("/experiments/{name}/query").Methods("GET").HandlerFunc(s.QueryHandler)
+	r.Path("/experiments/{name}/query_range").Methods("GET").HandlerFunc(s.QueryRangeHandler)
 	r.Path("/experiments/{name}").Methods("GET").HandlerFunc(s.GetExperimentHandler)
 	r.Path("/experiments/{name}").Methods("DELETE").HandlerFunc(s.DeleteExperimentHandler)
+	s.ConfigureAdminRoutes(r)
+	r.Path("/pipelines/{name}/stages/{stage}/fail").Methods("POST").HandlerFunc(s.FailPipelineStageHandler)
+	r.Path("/pipelines/{name}").Methods("PUT").HandlerFunc(s.PutPipelineHandler)
+	r.Path("/pipelines/{name}").Methods("GET").HandlerFunc(s.GetPipelineHandler)
+
+	r.Path("/version").Methods("GET").HandlerFunc(s.VersionHandler)
 	r.Path("/").Methods("GET").HandlerFunc(s.RootHandler)
 }
 
 func (s *Server) MonitorResources(ctx context.Context) {
-	slog.Info("starting monitoring of resources", "interval", s.monitorInterval)
+	interval := s.settings.Load().MonitorInterval
+	slog.Info("starting monitoring of resources", "interval", interval)
 	s.upGauge.Set(1)
 	defer func() {
 		s.upGauge.Set(0)
@@ -166,7 +388,7 @@ func (s *Server) MonitorResources(ctx context.Context) {
 	slog.Debug("checking resources")
 	s.CheckResources(ctx)
 
-	tick := time.NewTicker(s.monitorInterval)
+	tick := time.NewTicker(interval)
 	defer tick.Stop()
 
 	for {
@@ -174,25 +396,30 @@ func (s *Server) MonitorResources(ctx context.Context) {
 		case <-ctx.Done():
 			slog.Debug("stopping monitoring of resources")
 			return
+		case <-s.reloaded:
+			if iv := s.settings.Load().MonitorInterval; iv != interval {
+				interval = iv
+				tick.Reset(interval)
+				slog.Info("changed interval of monitoring of resources", "interval", interval)
+			}
 		case <-tick.C:
 			slog.Debug("checking resources")
 			s.CheckResources(ctx)
+			if s.retention != nil {
+				s.submitJob(ctx, slog.Default(), api.JobKindRetention, "", nil)
+			}
 		}
 	}
 }
 
+// CheckResources submits a job for each managed experiment: a check of the tasks of one that
+// is running or the teardown of one that is due to end. The jobs run on the job engine so that
+// slow AWS calls neither hold s.mu nor delay the checks of other experiments.
 func (s *Server) CheckResources(ctx context.Context) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.awsRegion),
-	})
-	if err != nil {
-		slog.Error("failed to create aws session", err)
-		return
-	}
-
+	settings := s.settings.Load()
 	activeManaged := 0
 	now := time.Now().UTC()
 	for name, mr := range s.managed {
@@ -202,136 +429,607 @@ func (s *Server) CheckResources(ctx context.Context) {
 			}
 			continue
 		}
+		activeManaged++
 		logger := slog.With("experiment", name)
 
-		if mr.Start.After(now.Add(s.settle)) {
+		if mr.Start.After(now.Add(settings.Settle)) {
 			logger.Info("waiting for experiment to settle before checking resources")
-			activeManaged++
 			continue
 		}
 
 		if mr.End.After(now) {
 			logger.Debug("experiment is not due to end yet")
-			activeManaged++
+			s.submitJob(ctx, logger, api.JobKindCheck, name, nil)
 			continue
 		}
 
 		logger.Info("experiment is due to end")
+		if settings.TeardownDeadline > 0 {
+			if deadline := mr.End.Add(settings.TeardownDeadline); now.After(deadline) {
+				s.escalateDeadline(ctx, mr, api.DeadlineOperationTeardown, deadline, "resources are still active")
+			}
+		}
+		// its tasks are about to be stopped so there is no point finishing a check of them
+		s.jobs.CancelExperiment(api.JobKindCheck, name)
+		s.jobs.CancelExperiment(api.JobKindRestart, name)
+		s.jobs.CancelExperiment(api.JobKindConfig, name)
+		if hasConformance(mr, api.ConformancePhasePost) && !conformed(mr, api.ConformancePhasePost) {
+			logger.Info("testing conformance of targets before teardown")
+			s.submitJob(ctx, logger, api.JobKindConformance, name, &conformanceRun{Phase: api.ConformancePhasePost})
+			continue
+		}
+		s.submitJob(ctx, logger, api.JobKindTeardown, name, nil)
+	}
+	s.managedGauge.Set(float64(activeManaged))
+}
 
-		anyActive := false
-		for _, res := range mr.Resources {
-			switch res.Type {
-			case api.ResourceTypeEcsTask:
-				active, err := isTaskActive(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn])
-				if err != nil {
-					logger.Error("failed to check whether task is active", err, "arn", res.Keys[api.ResourceKeyArn], "cluster_arn", res.Keys[api.ResourceKeyEcsClusterArn])
-					s.checkErrorsCounter.Add(1)
-					continue
-				}
-				if !active {
-					logger.Debug("task is not active")
-					continue
-				}
-				anyActive = true
-				logger.Info("task is active, stopping it")
-				if err := stopEcsTask(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]); err != nil {
-					logger.Error("failed to stop task", err, "arn", res.Keys[api.ResourceKeyArn], "cluster_arn", res.Keys[api.ResourceKeyEcsClusterArn])
-					s.checkErrorsCounter.Add(1)
-				}
+// checkJob checks the tasks of a running experiment for failures, captures profiles from them,
+// reads their logs, watches the targets' results for sudden shifts and submits the admin calls
+// of segments that have started. It works on a copy of the experiment so that s.mu is not held while
+// AWS is called, then merges what it found into the managed experiment and records it.
+func (s *Server) checkJob(ctx context.Context, j api.Job, _ json.RawMessage) error {
+	s.mu.Lock()
+	m, ok := s.managed[j.Experiment]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok || !mr.Deleted.IsZero() {
+		return nil
+	}
 
-			case api.ResourceTypeEcsTaskDefinition:
-				active, err := isTaskDefinitionActive(ctx, sess, res.Keys[api.ResourceKeyArn])
-				if err != nil {
-					logger.Error("failed to check whether task definition is active", err, "arn", res.Keys[api.ResourceKeyArn])
-					s.checkErrorsCounter.Add(1)
-					continue
-				}
-				if !active {
-					logger.Debug("task definition is not active")
-					continue
-				}
-				anyActive = true
-				logger.Info("task definition is active, deregistering it")
-				if err := deregisterEcsTaskDefinition(ctx, sess, res.Keys[api.ResourceKeyArn]); err != nil {
-					logger.Error("failed to deregister task definition", err, "arn", res.Keys[api.ResourceKeyArn])
-					s.checkErrorsCounter.Add(1)
-				}
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		return fmt.Errorf("new aws session: %w", err)
+	}
+	logger := slog.With("experiment", mr.Name, "job", j.ID)
 
-			case api.ResourceTypeEcsSnsSubscription:
-				active, err := isSnsSubscriptionActive(ctx, sess, res.Keys[api.ResourceKeyArn])
-				if err != nil {
-					logger.Error("failed to check whether subscription is active", err, "arn", res.Keys[api.ResourceKeyArn])
-					s.checkErrorsCounter.Add(1)
-					continue
-				}
-				if !active {
-					logger.Debug("subscription is not active")
-					s.checkErrorsCounter.Add(1)
-					continue
-				}
-				anyActive = true
-				logger.Info("subscription is active, unsubscribing")
-				if err := unsubscribeSqsQueue(ctx, sess, res.Keys[api.ResourceKeyArn]); err != nil {
-					logger.Error("failed to unsubscribe queue", err, "arn", res.Keys[api.ResourceKeyArn])
-					s.checkErrorsCounter.Add(1)
+	known := len(mr.Failures)
+	failed := s.CheckFailures(ctx, sess, logger, mr, time.Now().UTC())
+	if s.dumps != nil {
+		s.dumps.Capture(ctx, sess, logger, mr)
+	}
+	matched := s.logs != nil && s.logs.Check(ctx, sess, logger, mr)
+	slowest := s.slowest.Collect(ctx, sess, logger, mr)
+	var anomalies []api.Anomaly
+	if settings := s.settings.Load(); s.anomalies != nil && settings.AnomalySigma > 0 && mr.Provisioned {
+		anomalies = s.anomalies.Check(ctx, logger, mr, settings.AnomalySigma, settings.MonitorInterval)
+	}
+	flagged := len(anomalies) > 0
+	if mr.Provisioned {
+		if due := s.dueSegments(ctx, logger, mr, time.Now().UTC()); len(due) > 0 {
+			s.submitJob(ctx, logger, api.JobKindConfig, mr.Name, &configRun{Segments: due})
+		}
+	}
+
+	var pending []string
+	provisioned := false
+	if !mr.Provisioned {
+		pending, err = pendingTasks(ctx, sess, mr)
+		if err != nil {
+			logger.Error("failed to check whether tasks are running", err)
+			s.checkErrorsCounter.Add(1)
+		}
+		provisioned = err == nil && len(pending) == 0
+		err = nil
+	}
+	var placements []api.TaskPlacement
+	if provisioned {
+		placements = describePlacements(ctx, sess, logger, mr)
+	}
+
+	var resJSON, failuresJSON, matchesJSON, anomaliesJSON, slowestJSON, placementsJSON []byte
+	s.mu.Lock()
+	cur, ok := s.managed[mr.Name]
+	if ok && provisioned {
+		logger.Info("all tasks are running")
+		cur.Provisioned = true
+		cur.Placements = placements
+		placementsJSON, err = json.Marshal(cur.Placements)
+		if hasConformance(cur, api.ConformancePhasePre) {
+			s.submitJob(ctx, logger, api.JobKindConformance, cur.Name, &conformanceRun{Phase: api.ConformancePhasePre})
+		}
+	}
+	if provisionDeadline := s.settings.Load().ProvisionDeadline; ok && len(pending) > 0 && provisionDeadline > 0 {
+		if deadline := cur.Start.Add(provisionDeadline); time.Now().After(deadline) {
+			s.escalateDeadline(ctx, cur, api.DeadlineOperationProvision, deadline, "tasks not running: "+strings.Join(pending, ", "))
+		}
+	}
+	if ok && failed {
+		for _, f := range mr.Failures[known:] {
+			if !f.Retried {
+				continue
+			}
+			for i, res := range cur.Resources {
+				if res.Type == api.ResourceTypeEcsTask && res.Keys[api.ResourceKeyArn] == f.TaskArn {
+					cur.Resources[i] = retriedResource(res, f.RetryArn)
 				}
+			}
+		}
+		cur.Failures = append(cur.Failures, mr.Failures[known:]...)
+		resJSON, err = json.Marshal(cur.Resources)
+		if err == nil {
+			failuresJSON, err = json.Marshal(cur.Failures)
+		}
+	}
+	if ok && matched && err == nil {
+		cur.LogMatches = mr.LogMatches
+		matchesJSON, err = json.Marshal(cur.LogMatches)
+	}
+	if ok && flagged && err == nil {
+		cur.Anomalies = mr.Anomalies
+		anomaliesJSON, err = json.Marshal(cur.Anomalies)
+		if settings := s.settings.Load(); settings.Webhooks != nil && settings.AnomalyNotify {
+			summary := experimentSummary(cur.clone(), "")
+			for i := range anomalies {
+				go settings.Webhooks.Send(ctx, &api.WebhookEvent{
+					Event:      api.WebhookEventAnomalyDetected,
+					Time:       anomalies[i].Time,
+					Experiment: summary,
+					Anomaly:    &anomalies[i],
+				})
+			}
+		}
+	}
+	if ok && slowest && err == nil {
+		cur.Slowest, cur.SlowestOverall = mr.Slowest, mr.SlowestOverall
+		slowestJSON, err = json.Marshal(slowestRecord{Latest: cur.Slowest, Overall: cur.SlowestOverall})
+	}
+	s.mu.Unlock()
+	if !ok || (!failed && !matched && !flagged && !slowest && !provisioned) {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("marshal experiment: %w", err)
+	}
 
-			case api.ResourceTypeSqsQueue:
-				active, err := isSqsQueueActive(ctx, sess, res.Keys[api.ResourceKeyQueueURL])
+	if failed {
+		if err := s.db.RecordExperimentFailures(ctx, mr.Name, string(resJSON), string(failuresJSON)); err != nil {
+			s.checkErrorsCounter.Add(1)
+			return fmt.Errorf("record failures: %w", err)
+		}
+	}
+	if matched {
+		if err := s.db.RecordExperimentLogMatches(ctx, mr.Name, string(matchesJSON)); err != nil {
+			s.checkErrorsCounter.Add(1)
+			return fmt.Errorf("record log matches: %w", err)
+		}
+	}
+	if flagged {
+		if err := s.db.RecordExperimentAnomalies(ctx, mr.Name, string(anomaliesJSON)); err != nil {
+			s.checkErrorsCounter.Add(1)
+			return fmt.Errorf("record anomalies: %w", err)
+		}
+	}
+	if slowest {
+		if err := s.db.RecordExperimentSlowest(ctx, mr.Name, string(slowestJSON)); err != nil {
+			s.checkErrorsCounter.Add(1)
+			return fmt.Errorf("record slowest requests: %w", err)
+		}
+	}
+	if provisioned {
+		if err := s.db.RecordExperimentPlacements(ctx, mr.Name, string(placementsJSON)); err != nil {
+			s.checkErrorsCounter.Add(1)
+			return fmt.Errorf("record placements: %w", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// A completion is the payload of a complete job. It holds a copy of the experiment since
+// ironbar forgets it a day after it stops.
+type completion struct {
+	Experiment ManagedResources `json:"experiment"`
+	Definition string           `json:"definition,omitempty"`
+}
+
+// teardownJob removes the resources of an experiment that is due to end, one stage of its
+// shutdown at a time. Once none of them are active the experiment's record is removed and, if
+// it has analyses or anything is to be notified of its completion, a complete job is submitted.
+func (s *Server) teardownJob(ctx context.Context, j api.Job, _ json.RawMessage) error {
+	s.mu.Lock()
+	m, ok := s.managed[j.Experiment]
+	var mr *ManagedResources
+	if ok {
+		mr = m.clone()
+	}
+	s.mu.Unlock()
+	if !ok || !mr.Deleted.IsZero() {
+		return nil
+	}
+	name := mr.Name
+
+	sess, err := newAWSSession(s.awsRegion)
+	if err != nil {
+		return fmt.Errorf("new aws session: %w", err)
+	}
+	logger := slog.With("experiment", name, "job", j.ID)
+
+	if s.shutdown(ctx, sess, logger, mr) {
+		logger.Info("some resources are still active or stopping, will check again")
+		return ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		// the checks may have failed because the job was cancelled
+		return err
+	}
+
+	logger.Info("no resources are active")
+	var definition string
+	webhooks := s.settings.Load().Webhooks
+	if webhooks != nil || s.results != nil {
+		// read the definition for the webhook and noise estimate before the record is removed
+		if er, err := s.db.GetExperiment(ctx, name); err != nil {
+			logger.Error("failed to get experiment definition", err)
+		} else {
+			definition = er.Definition
+		}
+	}
+	if err := s.db.RemoveExperiment(ctx, name); err != nil {
+		s.checkErrorsCounter.Add(1)
+		return fmt.Errorf("remove experiment: %w", err)
+	}
+
+	s.mu.Lock()
+	if cur, ok := s.managed[name]; ok {
+		mr = cur
+	}
+	mr.Deleted = time.Now().UTC()
+	mr = mr.clone()
+	s.mu.Unlock()
+
+	s.recordHistory(ctx, mr)
+	if s.logs != nil {
+		s.logs.Forget(mr)
+	}
+	if s.dumps != nil {
+		s.dumps.Forget(mr)
+	}
+	s.slowest.Forget(mr)
+	if s.anomalies != nil {
+		s.anomalies.Forget(mr)
+	}
+	if s.rules != nil {
+		if err := s.rules.RemoveExperimentRules(ctx, name); err != nil {
+			logger.Error("failed to remove recording rules", err)
+			s.checkErrorsCounter.Add(1)
+		}
+	}
+	_, _, inPipeline := pipelineStageOf(mr)
+	if hasAnalyses(mr) || webhooks != nil || s.results != nil || inPipeline {
+		s.submitJob(ctx, logger, api.JobKindComplete, name, &completion{Experiment: *mr, Definition: definition})
+	}
+	return nil
+}
+
+// completeJob runs the analyses of a completed experiment, then sends the webhook announcing
+// its completion, finishes the pipeline stage it was deployed for and records a noise estimate
+// from its results. It is resumed from the start
+// if ironbar restarts, in which case the analyses are run again.
+func (s *Server) completeJob(ctx context.Context, j api.Job, payload json.RawMessage) error {
+	var c completion
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return fmt.Errorf("decode payload: %w", err)
+	}
+	mr := c.Experiment
+	if hasAnalyses(&mr) {
+		mr.Analyses = s.RunAnalyses(ctx, mr)
+	} else if hasConformance(&mr, "") {
+		analyses, err := s.db.GetAnalyses(ctx, mr.Name)
+		if err != nil {
+			slog.Error("failed to read conformance reports", err, "experiment", mr.Name)
+		}
+		mr.Analyses = analyses
+	}
+	webhooks := s.settings.Load().Webhooks
+	if _, _, ok := pipelineStageOf(&mr); webhooks != nil || ok {
+		summary := s.summarize(ctx, mr, c.Definition)
+		if webhooks != nil {
+			webhooks.Send(ctx, &api.WebhookEvent{
+				Event:      api.WebhookEventExperimentCompleted,
+				Time:       time.Now().UTC(),
+				Experiment: summary,
+			})
+		}
+		s.finishPipelineStage(ctx, &mr, &summary)
+	}
+	if s.results != nil {
+		s.RecordNoiseEstimate(ctx, mr, c.Definition)
+	}
+	return ctx.Err()
+}
+
+// stopResources stops or removes each of the experiment's resources in a stage of its shutdown
+// that are still active and reports whether any were. dealgood's task counts as active until
+// it has stopped, rather than only until it has been asked to, since it keeps reading requests
+// while it drains.
+func (s *Server) stopResources(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources, stage string) bool {
+	anyActive := false
+	for _, res := range mr.Resources {
+		if shutdownStage(res) != stage {
+			continue
+		}
+		switch res.Type {
+		case api.ResourceTypeEcsTask:
+			active, err := isTaskActive(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn])
+			if err != nil {
+				logger.Error("failed to check whether task is active", err, "arn", res.Keys[api.ResourceKeyArn], "cluster_arn", res.Keys[api.ResourceKeyEcsClusterArn])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active && stage == api.ShutdownStageDealgood {
+				stopped, err := isTaskStopped(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn])
 				if err != nil {
-					logger.Error("failed to check whether queue is active", err, "url", res.Keys[api.ResourceKeyQueueURL])
+					logger.Error("failed to check whether task has stopped", err, "arn", res.Keys[api.ResourceKeyArn], "cluster_arn", res.Keys[api.ResourceKeyEcsClusterArn])
 					s.checkErrorsCounter.Add(1)
+					anyActive = true
 					continue
 				}
-				if !active {
-					logger.Debug("queue is not active")
+				if !stopped {
+					logger.Debug("dealgood is draining")
+					anyActive = true
 					continue
 				}
-				anyActive = true
-				logger.Info("queue is active, deleting")
-				if err := deleteSqsQueue(ctx, sess, res.Keys[api.ResourceKeyQueueURL]); err != nil {
-					logger.Error("failed to delete queue", err, "url", res.Keys[api.ResourceKeyQueueURL])
-					s.checkErrorsCounter.Add(1)
-				}
+			}
+			if !active {
+				logger.Debug("task is not active")
+				continue
+			}
+			anyActive = true
+			logger.Info("task is active, stopping it")
+			if err := stopEcsTask(ctx, sess, res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]); err != nil {
+				logger.Error("failed to stop task", err, "arn", res.Keys[api.ResourceKeyArn], "cluster_arn", res.Keys[api.ResourceKeyEcsClusterArn])
+				s.checkErrorsCounter.Add(1)
+			}
 
-			case api.ResourceTypeEc2Instance:
-				_, err := isEc2InstanceActive(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID])
-				if err != nil {
-					logger.Error("failed to check whether ec2 instance is active", err, "instance_id", res.Keys[api.ResourceKeyEc2InstanceID])
-					s.checkErrorsCounter.Add(1)
-					continue
-				}
+		case api.ResourceTypeEcsTaskDefinition:
+			active, err := isTaskDefinitionActive(ctx, sess, res.Keys[api.ResourceKeyArn])
+			if err != nil {
+				logger.Error("failed to check whether task definition is active", err, "arn", res.Keys[api.ResourceKeyArn])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active {
+				logger.Debug("task definition is not active")
+				continue
+			}
+			anyActive = true
+			logger.Info("task definition is active, deregistering it")
+			if err := deregisterEcsTaskDefinition(ctx, sess, res.Keys[api.ResourceKeyArn]); err != nil {
+				logger.Error("failed to deregister task definition", err, "arn", res.Keys[api.ResourceKeyArn])
+				s.checkErrorsCounter.Add(1)
+			}
 
-			default:
-				anyActive = true
-				logger.Warn("unknown resource type, cannot remove", "type", res.Type)
+		case api.ResourceTypeEcsSnsSubscription:
+			active, err := isSnsSubscriptionActive(ctx, sess, res.Keys[api.ResourceKeyArn])
+			if err != nil {
+				logger.Error("failed to check whether subscription is active", err, "arn", res.Keys[api.ResourceKeyArn])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active {
+				logger.Debug("subscription is not active")
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			anyActive = true
+			logger.Info("subscription is active, unsubscribing")
+			if err := unsubscribeSqsQueue(ctx, sess, res.Keys[api.ResourceKeyArn]); err != nil {
+				logger.Error("failed to unsubscribe queue", err, "arn", res.Keys[api.ResourceKeyArn])
 				s.checkErrorsCounter.Add(1)
 			}
-		}
 
-		if anyActive {
-			logger.Info("some resources are still active or stopping, will check again")
-			activeManaged++
-		} else {
-			logger.Info("no resources are active")
-			if err := s.db.RemoveExperiment(ctx, name); err != nil {
-				logger.Error("failed to remove experiment", err)
+		case api.ResourceTypeSqsQueue:
+			active, err := isSqsQueueActive(ctx, sess, res.Keys[api.ResourceKeyQueueURL])
+			if err != nil {
+				logger.Error("failed to check whether queue is active", err, "url", res.Keys[api.ResourceKeyQueueURL])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active {
+				logger.Debug("queue is not active")
+				continue
+			}
+			anyActive = true
+			logger.Info("queue is active, deleting")
+			if err := deleteSqsQueue(ctx, sess, res.Keys[api.ResourceKeyQueueURL]); err != nil {
+				logger.Error("failed to delete queue", err, "url", res.Keys[api.ResourceKeyQueueURL])
+				s.checkErrorsCounter.Add(1)
+			}
+
+		case api.ResourceTypeDynamoDBTable:
+			active, err := isDynamoDBTableActive(ctx, sess, res.Keys[api.ResourceKeyTableName])
+			if err != nil {
+				logger.Error("failed to check whether table is active", err, "table_name", res.Keys[api.ResourceKeyTableName])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active {
+				logger.Debug("table is not active")
+				continue
+			}
+			anyActive = true
+			logger.Info("table is active, deleting")
+			if err := deleteDynamoDBTable(ctx, sess, res.Keys[api.ResourceKeyTableName]); err != nil {
+				logger.Error("failed to delete table", err, "table_name", res.Keys[api.ResourceKeyTableName])
+				s.checkErrorsCounter.Add(1)
+			}
+
+		case api.ResourceTypeAnalysis:
+			// run once the experiment's other resources have been removed
+
+		case api.ResourceTypeConformance:
+			// run by ironbar before teardown, each task is stopped when its tests finish
+
+		case api.ResourceTypeEc2Instance:
+			_, err := isEc2InstanceActive(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID])
+			if err != nil {
+				logger.Error("failed to check whether ec2 instance is active", err, "instance_id", res.Keys[api.ResourceKeyEc2InstanceID])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if res.Keys[api.ResourceKeyDedicated] != "true" {
+				// the instance belongs to a capacity provider's auto scaling group
+				continue
+			}
+			running, err := isEc2InstanceRunning(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID])
+			if err != nil {
+				logger.Error("failed to check whether ec2 instance is running", err, "instance_id", res.Keys[api.ResourceKeyEc2InstanceID])
 				s.checkErrorsCounter.Add(1)
 				continue
 			}
-			mr.Deleted = time.Now().UTC()
+			if !running {
+				logger.Debug("ec2 instance is not running")
+				continue
+			}
+			anyActive = true
+			logger.Info("ec2 instance is running, terminating it")
+			if err := terminateEc2Instance(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID]); err != nil {
+				logger.Error("failed to terminate ec2 instance", err, "instance_id", res.Keys[api.ResourceKeyEc2InstanceID])
+				s.checkErrorsCounter.Add(1)
+			}
+
+		case api.ResourceTypeEc2PlacementGroup:
+			active, err := isPlacementGroupActive(ctx, sess, res.Keys[api.ResourceKeyGroupName])
+			if err != nil {
+				logger.Error("failed to check whether placement group is active", err, "group_name", res.Keys[api.ResourceKeyGroupName])
+				s.checkErrorsCounter.Add(1)
+				continue
+			}
+			if !active {
+				logger.Debug("placement group is not active")
+				continue
+			}
+			anyActive = true
+			logger.Info("placement group is active, deleting it")
+			if err := deletePlacementGroup(ctx, sess, res.Keys[api.ResourceKeyGroupName]); err != nil {
+				// expected until the instances launched in the group have terminated
+				logger.Debug("could not delete placement group", "group_name", res.Keys[api.ResourceKeyGroupName], "error", err)
+			}
+
+		default:
+			anyActive = true
+			logger.Warn("unknown resource type, cannot remove", "type", res.Type)
+			s.checkErrorsCounter.Add(1)
 		}
 	}
-	s.managedGauge.Set(float64(activeManaged))
+
+	return anyActive
 }
 
-func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("Not Found\n"))
+// experimentSummary summarises an experiment without reading its results or annotations.
+func experimentSummary(mr *ManagedResources, definition string) api.ExperimentSummary {
+	return api.ExperimentSummary{
+		Name:       mr.Name,
+		Start:      mr.Start,
+		End:        mr.End,
+		Stopped:    mr.Deleted,
+		Owner:      mr.Usage.Owner,
+		Team:       mr.Usage.Team,
+		Purpose:    mr.Usage.Purpose,
+		Ticket:     mr.Usage.Ticket,
+		Definition: definition,
+		Failures:   mr.Failures,
+		Analyses:   mr.Analyses,
+		LogMatches: mr.LogMatches,
+		Anomalies:  mr.Anomalies,
+		Restarts:   mr.Restarts,
+		Changes:    mr.Changes,
+		Deadlines:  mr.Deadlines,
+		Slowest:    mr.SlowestOverall,
+		Placements: mr.Placements,
+		Shutdown:   mr.Shutdown,
+	}
+}
+
+// summarize returns a summary of a completed experiment's results.
+func (s *Server) summarize(ctx context.Context, mr ManagedResources, definition string) api.ExperimentSummary {
+	summary := experimentSummary(&mr, definition)
+
+	annotations, err := s.db.GetAnnotations(ctx, mr.Name)
+	if err != nil {
+		slog.Error("failed to read annotations", err, "experiment", mr.Name)
+	} else {
+		summary.Annotations = annotations
+	}
+
+	if s.results != nil {
+		// results are read for the measured window when dealgood recorded one, excluding the
+		// time spent starting the experiment
+		start, end := mr.Start, mr.End
+		window, err := s.results.MeasuredWindow(ctx, mr.Name, mr.Start, mr.End)
+		if err != nil {
+			slog.Error("failed to read measured window", err, "experiment", mr.Name)
+		} else if window != nil {
+			summary.Window = window
+			start = window.Start
+			if !window.End.IsZero() {
+				end = window.End
+			}
+		}
+
+		summary.Excluded = excludedWindows(&mr, start, end)
+		targets, err := s.results.TargetSummaries(ctx, mr.Name, start, end, summary.Excluded)
+		if err != nil {
+			slog.Error("failed to read experiment results", err, "experiment", mr.Name)
+		} else {
+			summary.Targets = targets
+		}
+		segments, err := definedSegments(definition, start, end)
+		if err != nil {
+			slog.Error("failed to read segments", err, "experiment", mr.Name)
+		}
+		summary.Segments = append(segments, redeploySegments(&mr, start, end)...)
+		for i := range summary.Segments {
+			seg := &summary.Segments[i]
+			targets, err := s.results.TargetSummaries(ctx, mr.Name, seg.Start, seg.End, excludedWindows(&mr, seg.Start, seg.End))
+			if err != nil {
+				slog.Error("failed to read segment results", err, "experiment", mr.Name, "segment", seg.Name)
+				continue
+			}
+			seg.Targets = targets
+		}
+		markShadows(&mr, summary.Targets)
+		for i := range summary.Segments {
+			markShadows(&mr, summary.Segments[i].Targets)
+		}
+		summary.Asymmetries = findAsymmetries(mr.Placements, summary.Targets, mr.Shadows)
+		addConformanceFailures(summary.Targets, mr.Analyses)
+
+		traffic, err := s.results.TrafficSummary(ctx, start, end)
+		if err != nil {
+			slog.Error("failed to read live traffic", err, "experiment", mr.Name)
+		} else {
+			summary.Traffic = traffic
+		}
+
+		workload, err := s.results.WorkloadSummary(ctx, mr.Name, start, end)
+		if err != nil {
+			slog.Error("failed to read workload profile", err, "experiment", mr.Name)
+		} else {
+			summary.Workload = workload
+		}
+
+		interval, err := soakInterval(definition)
+		if err != nil {
+			slog.Error("failed to read soak settings", err, "experiment", mr.Name)
+		} else if interval > 0 {
+			soak, err := s.results.SoakSummaries(ctx, mr.Name, start, end, interval)
+			if err != nil {
+				slog.Error("failed to read soak results", err, "experiment", mr.Name)
+			} else {
+				countRestarts(soak, mr.Failures)
+				summary.Soak = soak
+			}
+		}
+	}
+
+	return summary
 }
 
-type ErrorResponse struct {
-	Err string `json:"err"`
+func (s *Server) NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	s.NotFound(w, r, nil)
 }
 
 func (s *Server) WriteAsJSON(w http.ResponseWriter, status int, v any) {
@@ -343,20 +1041,46 @@ func (s *Server) WriteAsJSON(w http.ResponseWriter, status int, v any) {
 	}
 }
 
+// WriteError writes an error response with one of the api error codes.
+func (s *Server) WriteError(w http.ResponseWriter, status int, code string, err error) {
+	s.WriteAsJSON(w, status, &api.ErrorResponse{Code: code, Err: err.Error()})
+}
+
 func (s *Server) NotFound(w http.ResponseWriter, r *http.Request, err error) {
-	w.Header().Set("Content-Type", "plain/text")
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("Not found\n"))
+	if err == nil {
+		err = fmt.Errorf("not found")
+	}
+	s.WriteError(w, http.StatusNotFound, api.ErrorCodeNotFound, err)
 }
 
+// BadRequest rejects an invalid request. The error code is taken from err if it has one,
+// otherwise it is SPEC_INVALID.
 func (s *Server) BadRequest(w http.ResponseWriter, r *http.Request, err error) {
 	slog.Info("bad request", "error", err)
-	s.WriteAsJSON(w, http.StatusBadRequest, &ErrorResponse{Err: err.Error()})
+	code := api.ErrorCode(err)
+	if code == "" {
+		code = api.ErrorCodeSpecInvalid
+	}
+	s.WriteError(w, http.StatusBadRequest, code, err)
 }
 
+func (s *Server) QuotaExceeded(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Info("quota exceeded", "error", err)
+	s.WriteError(w, http.StatusForbidden, api.ErrorCodeQuotaExceeded, err)
+}
+
+// ServerError reports a failure of ironbar or of a request it made to AWS, distinguishing
+// throttling and other AWS errors from ironbar's own failures by the error code.
 func (s *Server) ServerError(w http.ResponseWriter, r *http.Request, err error) {
 	slog.Error("server error", err)
-	s.WriteAsJSON(w, http.StatusInternalServerError, &ErrorResponse{Err: err.Error()})
+	code := api.ErrorCode(err)
+	if code == "" {
+		code = awsErrorCode(err)
+	}
+	if code == "" {
+		code = api.ErrorCodeInternal
+	}
+	s.WriteError(w, http.StatusInternalServerError, code, err)
 }
 
 func (s *Server) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
@@ -368,6 +1092,11 @@ func (s *Server) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.checkMetadata(in.Usage); err != nil {
+		s.BadRequest(w, r, err)
+		return
+	}
+
 	// TODO: what if already managing this experiment
 
 	resJSON, err := json.Marshal(in.Resources)
@@ -376,12 +1105,40 @@ func (s *Server) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usageJSON, err := json.Marshal(in.Usage)
+	if err != nil {
+		s.ServerError(w, r, fmt.Errorf("failed to marshal usage: %w", err))
+		return
+	}
+
 	rec := &ExperimentRecord{
 		Name:       in.Name,
 		Start:      in.Start.UnixNano(),
 		End:        in.End.UnixNano(),
 		Definition: in.Definition,
 		Resources:  string(resJSON),
+		Usage:      string(usageJSON),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAvailable(in.Start, in.End); err != nil {
+		s.Unavailable(w, r, err)
+		return
+	}
+
+	if quotas := s.settings.Load().Quotas; quotas != nil {
+		now := time.Now().UTC()
+		preempt, err := quotas.Admit(in.Name, in.Start, in.End, in.Usage, s.managed, now)
+		if err != nil {
+			s.QuotaExceeded(w, r, err)
+			return
+		}
+		if err := s.preempt(ctx, preempt, in.Name, now); err != nil {
+			s.ServerError(w, r, fmt.Errorf("failed to preempt experiments: %w", err))
+			return
+		}
 	}
 
 	if err := s.db.RecordExperimentStart(ctx, rec); err != nil {
@@ -394,6 +1151,20 @@ func (s *Server) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
 		Start:     in.Start,
 		End:       in.End,
 		Resources: in.Resources,
+		Usage:     in.Usage,
+		KmsKeyArn: definitionKmsKey(in.Definition),
+
+		ShutdownTimeouts: shutdownTimeouts(in.Definition),
+		Segments:         definitionSegments(in.Definition),
+		Shadows:          shadowTargets(in.Definition),
+	}
+	s.startPipelineStage(ctx, s.managed[in.Name])
+
+	if s.rules != nil {
+		// recording rules are a convenience for dashboards so failing to install them does not fail the deployment
+		if err := s.rules.InstallExperimentRules(ctx, in.Name, shadowTargets(in.Definition)); err != nil {
+			slog.Error("failed to install recording rules", err, "experiment", in.Name)
+		}
 	}
 
 	s.WriteAsJSON(w, http.StatusOK, &api.NewExperimentOutput{
@@ -403,24 +1174,73 @@ func (s *Server) NewExperimentHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (s *Server) ListExperimentsHandler(w http.ResponseWriter, r *http.Request) {
-	out := &api.ListExperimentsOutput{
-		Items: []api.ListExperimentsItem{},
+// CheckQuotaHandler reports whether an experiment would be accepted without exceeding any
+// quota, so that it can be rejected before any resources are created for it.
+func (s *Server) CheckQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	in := new(api.CheckQuotaInput)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		s.BadRequest(w, r, fmt.Errorf("parse input: %w", err))
+		return
+	}
+	if err := s.checkMetadata(in.Usage); err != nil {
+		s.BadRequest(w, r, err)
+		return
 	}
 
 	s.mu.Lock()
-	for _, mr := range s.managed {
-		out.Items = append(out.Items, api.ListExperimentsItem{
-			Name:    mr.Name,
-			Start:   mr.Start,
-			End:     mr.End,
-			Stopped: mr.Deleted,
-		})
+	err := s.checkAvailable(in.Start, in.End)
+	s.mu.Unlock()
+	if err != nil {
+		s.Unavailable(w, r, err)
+		return
+	}
+
+	out := &api.CheckQuotaOutput{
+		Message: "Experiment is within quota",
+	}
+	settings := s.settings.Load()
+	if settings.Quotas != nil {
+		s.mu.Lock()
+		preempt, err := settings.Quotas.Admit(in.Name, in.Start, in.End, in.Usage, s.managed, time.Now().UTC())
+		s.mu.Unlock()
+		if err != nil {
+			s.QuotaExceeded(w, r, err)
+			return
+		}
+		if len(preempt) > 0 {
+			out.Message = "Experiment is within quota once lower priority experiments are preempted"
+			out.Preempts = preempt
+		}
 	}
+
+	s.mu.Lock()
+	out.Cluster, err = settings.Clusters.Place(in.Name, in.Clusters, in.Usage, s.managed)
 	s.mu.Unlock()
+	if err != nil {
+		s.Unavailable(w, r, err)
+		return
+	}
+
 	s.WriteAsJSON(w, http.StatusOK, out)
 }
 
+// preempt ends the named experiments now so that their resources are removed on the next check,
+// making room for the experiment admitted in their place. Callers must hold s.mu.
+func (s *Server) preempt(ctx context.Context, names []string, admitted string, now time.Time) error {
+	for _, name := range names {
+		mr, ok := s.managed[name]
+		if !ok {
+			continue
+		}
+		slog.Warn("preempting experiment", "experiment", name, "priority", mr.Usage.Priority, "admitted", admitted)
+		if err := s.db.RecordExperimentEnd(ctx, name, now.UnixNano()); err != nil {
+			return fmt.Errorf("record end of experiment %s: %w", name, err)
+		}
+		mr.End = now
+	}
+	return nil
+}
+
 func (s *Server) ExperimentStatusHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	vars := mux.Vars(r)
@@ -440,9 +1260,7 @@ func (s *Server) ExperimentStatusHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(s.awsRegion),
-	})
+	sess, err := newAWSSession(s.awsRegion)
 	if err != nil {
 		s.ServerError(w, r, fmt.Errorf("failed to create aws session: %w", err))
 		return
@@ -453,7 +1271,25 @@ func (s *Server) ExperimentStatusHandler(w http.ResponseWriter, r *http.Request)
 		End:     mr.End,
 		Stopped: mr.Deleted,
 		Status:  "Unknown",
+		Owner:   mr.Usage.Owner,
+		Team:    mr.Usage.Team,
+		Purpose: mr.Usage.Purpose,
+		Ticket:  mr.Usage.Ticket,
+		Cluster: mr.Usage.Cluster,
 	}
+	s.mu.Lock()
+	out.Failures = append([]api.Failure(nil), mr.Failures...)
+	out.LogMatches = append([]api.LogMatches(nil), mr.LogMatches...)
+	out.Anomalies = append([]api.Anomaly(nil), mr.Anomalies...)
+	out.Restarts = append([]api.TargetRestart(nil), mr.Restarts...)
+	out.Changes = append([]api.ConfigChange(nil), mr.Changes...)
+	out.Deadlines = append([]api.DeadlineExceeded(nil), mr.Deadlines...)
+	out.Slowest = append([]api.SlowestRequests(nil), mr.Slowest...)
+	out.SlowestOverall = append([]api.SlowestRequests(nil), mr.SlowestOverall...)
+	out.Placements = append([]api.TaskPlacement(nil), mr.Placements...)
+	out.Shutdown = append([]api.ShutdownStage(nil), mr.Shutdown...)
+	s.mu.Unlock()
+	out.Asymmetries = findAsymmetries(out.Placements, nil, mr.Shadows)
 
 	if !mr.Deleted.IsZero() {
 		out.Status = "Stopped"
@@ -506,6 +1342,48 @@ func (s *Server) ExperimentStatusHandler(w http.ResponseWriter, r *http.Request)
 					continue
 				}
 
+			case api.ResourceTypeDynamoDBTable:
+				active, err := isDynamoDBTableActive(ctx, sess, res.Keys[api.ResourceKeyTableName])
+				if err != nil {
+					receivedErrors = true
+					continue
+				}
+				if !active {
+					allActive = false
+					continue
+				}
+
+			case api.ResourceTypeEc2Instance:
+				active, err := isEc2InstanceActive(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID])
+				if err == nil && active && res.Keys[api.ResourceKeyDedicated] == "true" {
+					active, err = isEc2InstanceRunning(ctx, sess, res.Keys[api.ResourceKeyEc2InstanceID])
+				}
+				if err != nil {
+					receivedErrors = true
+					continue
+				}
+				if !active {
+					allActive = false
+					continue
+				}
+
+			case api.ResourceTypeEc2PlacementGroup:
+				active, err := isPlacementGroupActive(ctx, sess, res.Keys[api.ResourceKeyGroupName])
+				if err != nil {
+					receivedErrors = true
+					continue
+				}
+				if !active {
+					allActive = false
+					continue
+				}
+
+			case api.ResourceTypeAnalysis:
+				// not run until the experiment completes
+
+			case api.ResourceTypeConformance:
+				// run by ironbar rather than kept running
+
 			default:
 				receivedErrors = true
 			}
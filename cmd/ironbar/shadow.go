@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// shadowDefinition holds the parts of an experiment definition needed to tell its shadow
+// targets apart.
+type shadowDefinition struct {
+	Targets []struct {
+		Name   string
+		Shadow bool
+	}
+}
+
+// shadowTargets returns the names of the shadow targets of an experiment definition, which
+// receive requests like the others but are left out of the comparison of their results. It
+// returns nil if there are none or the definition cannot be decoded.
+func shadowTargets(definition string) []string {
+	var def shadowDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		return nil
+	}
+	var shadows []string
+	for _, t := range def.Targets {
+		if t.Shadow {
+			shadows = append(shadows, t.Name)
+		}
+	}
+	sort.Strings(shadows)
+	return shadows
+}
+
+// isShadow reports whether a target of an experiment is a shadow target.
+func (m *ManagedResources) isShadow(target string) bool {
+	for _, name := range m.Shadows {
+		if name == target {
+			return true
+		}
+	}
+	return false
+}
+
+// markShadows marks the summaries of an experiment's shadow targets.
+func markShadows(mr *ManagedResources, targets []api.TargetSummary) {
+	for i := range targets {
+		targets[i].Shadow = mr.isShadow(targets[i].Target)
+	}
+}
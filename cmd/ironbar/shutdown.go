@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// dealgoodComponent is the experiment component that sends requests to the targets.
+const dealgoodComponent = "dealgood"
+
+// shutdownStages are the stages of an experiment's shutdown in the order they run. Requests
+// stop being delivered before dealgood is stopped, and dealgood has exited before the targets
+// it sends to are stopped and the queue it reads from is deleted.
+var shutdownStages = []string{
+	api.ShutdownStageSource,
+	api.ShutdownStageDealgood,
+	api.ShutdownStageTargets,
+	api.ShutdownStageInfra,
+}
+
+// defaultShutdownTimeouts is how long ironbar waits for the resources of each stage to stop
+// before moving on to the next, unless the experiment's definition sets its own. dealgood's
+// covers its default drain and final scrape with time for ECS to report the task stopped. The
+// infra stage is the last so it has no timeout.
+var defaultShutdownTimeouts = map[string]time.Duration{
+	api.ShutdownStageSource:   2 * time.Minute,
+	api.ShutdownStageDealgood: 3 * time.Minute,
+	api.ShutdownStageTargets:  10 * time.Minute,
+}
+
+// shutdownDefinition holds the parts of an experiment definition that configure its shutdown.
+type shutdownDefinition struct {
+	Shutdown *struct {
+		StageTimeouts map[string]time.Duration
+	}
+}
+
+// shutdownTimeouts returns the time each stage of an experiment's shutdown may take, with
+// ironbar's defaults for the stages the definition does not set.
+func shutdownTimeouts(definition string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(defaultShutdownTimeouts))
+	for stage, t := range defaultShutdownTimeouts {
+		timeouts[stage] = t
+	}
+	var def shutdownDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil || def.Shutdown == nil {
+		return timeouts
+	}
+	for stage, t := range def.Shutdown.StageTimeouts {
+		if _, ok := defaultShutdownTimeouts[stage]; ok && t > 0 {
+			timeouts[stage] = t
+		}
+	}
+	return timeouts
+}
+
+// shutdownStage returns the stage of the shutdown in which a resource is stopped or removed.
+func shutdownStage(res api.Resource) string {
+	switch res.Type {
+	case api.ResourceTypeEcsSnsSubscription:
+		return api.ShutdownStageSource
+	case api.ResourceTypeEcsTask:
+		if res.Keys[api.ResourceKeyComponent] == dealgoodComponent {
+			return api.ShutdownStageDealgood
+		}
+		return api.ShutdownStageTargets
+	case api.ResourceTypeEc2Instance:
+		return api.ShutdownStageTargets
+	default:
+		return api.ShutdownStageInfra
+	}
+}
+
+// shutdown advances the shutdown of an experiment that is due to end. The resources of each
+// stage are stopped in turn, moving on to the next stage only once those of the current stage
+// have stopped or its timeout has passed. Resources of a stage that timed out are still stopped
+// on each call. It reports whether any of the experiment's resources are still active. The
+// progress of each stage is recorded in mr.Shutdown and copied to the managed experiment.
+func (s *Server) shutdown(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources) bool {
+	anyActive := false
+	for _, stage := range shutdownStages {
+		i := shutdownStageIndex(mr, stage)
+		if i < 0 {
+			st := api.ShutdownStage{Stage: stage, Started: time.Now().UTC()}
+			if t := mr.ShutdownTimeouts[stage]; t > 0 {
+				st.TimeoutSeconds = t.Seconds()
+			}
+			mr.Shutdown = append(mr.Shutdown, st)
+			i = len(mr.Shutdown) - 1
+			logger.Info("shutdown stage started", "stage", stage)
+		}
+		st := &mr.Shutdown[i]
+
+		if !s.stopResources(ctx, sess, logger, mr, stage) {
+			if st.Finished.IsZero() && ctx.Err() == nil {
+				st.Finished = time.Now().UTC()
+				logger.Info("shutdown stage finished", "stage", stage, "duration", st.Finished.Sub(st.Started).Round(time.Second), "timed_out", st.TimedOut)
+			}
+			continue
+		}
+		anyActive = true
+		if st.TimedOut {
+			continue
+		}
+		timeout := mr.ShutdownTimeouts[stage]
+		if timeout > 0 && time.Since(st.Started) >= timeout {
+			st.TimedOut = true
+			logger.Warn("shutdown stage timed out, moving on to the next stage", "stage", stage, "timeout", timeout)
+			continue
+		}
+		break
+	}
+
+	s.mu.Lock()
+	if cur, ok := s.managed[mr.Name]; ok {
+		cur.Shutdown = append([]api.ShutdownStage(nil), mr.Shutdown...)
+	}
+	s.mu.Unlock()
+	return anyActive
+}
+
+// shutdownStageIndex returns the index of a stage in the experiment's shutdown, or -1 if the
+// stage has not started.
+func shutdownStageIndex(mr *ManagedResources, stage string) int {
+	for i, st := range mr.Shutdown {
+		if st.Stage == stage {
+			return i
+		}
+	}
+	return -1
+}
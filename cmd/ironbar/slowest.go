@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// slowestComponent is the experiment component, and the name of its container, that reports
+// the slowest requests sent to targets.
+const slowestComponent = "dealgood"
+
+// slowestFilterPattern selects the log lines dealgood writes with the slowest requests.
+var slowestFilterPattern = `"` + strings.TrimSpace(api.SlowestRequestsLogPrefix) + `"`
+
+// A SlowestCollector reads the slowest requests that dealgood writes to its log at the end of
+// each window, keeping the latest window for each target and the slowest requests over the
+// whole experiment.
+type SlowestCollector struct {
+	mu      sync.Mutex       // guards cursors since experiments are checked concurrently
+	cursors map[string]int64 // time in milliseconds to read each log stream from, keyed by stream name
+}
+
+func NewSlowestCollector() *SlowestCollector {
+	return &SlowestCollector{
+		cursors: make(map[string]int64),
+	}
+}
+
+// Collect reads the windows dealgood has reported since the previous call into mr.Slowest and
+// mr.SlowestOverall, returning true if there were any. mr should be a copy of the managed
+// experiment since s.mu is not held while the logs are read.
+func (c *SlowestCollector) Collect(ctx context.Context, sess *session.Session, logger *slog.Logger, mr *ManagedResources) bool {
+	changed := false
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask || res.Keys[api.ResourceKeyComponent] != slowestComponent {
+			continue
+		}
+		clusterArn, taskArn := res.Keys[api.ResourceKeyEcsClusterArn], res.Keys[api.ResourceKeyArn]
+		if taskArn == "" {
+			continue
+		}
+
+		task, err := describeEcsTask(ctx, sess, clusterArn, taskArn)
+		if err != nil {
+			logger.Error("failed to describe task", err, "arn", taskArn, "cluster_arn", clusterArn)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+		td, err := describeEcsTaskDefinition(ctx, sess, aws.StringValue(task.TaskDefinitionArn))
+		if err != nil {
+			logger.Error("failed to describe task definition", err, "arn", aws.StringValue(task.TaskDefinitionArn))
+			continue
+		}
+
+		for _, cd := range td.ContainerDefinitions {
+			if aws.StringValue(cd.Name) != slowestComponent || cd.LogConfiguration == nil || aws.StringValue(cd.LogConfiguration.LogDriver) != "awslogs" {
+				continue
+			}
+			opts := cd.LogConfiguration.Options
+			group := aws.StringValue(opts["awslogs-group"])
+			stream := path.Join(aws.StringValue(opts["awslogs-stream-prefix"]), aws.StringValue(cd.Name), path.Base(taskArn))
+
+			c.mu.Lock()
+			start, ok := c.cursors[stream]
+			c.mu.Unlock()
+			if !ok {
+				start = mr.Start.UnixMilli()
+			}
+			err := filterLogEventsMatching(ctx, sess, group, stream, slowestFilterPattern, start, maxLogPagesPerStream, func(ev *cloudwatchlogs.FilteredLogEvent) {
+				if ts := aws.Int64Value(ev.Timestamp); ts >= start {
+					start = ts + 1
+				}
+				_, data, ok := strings.Cut(aws.StringValue(ev.Message), api.SlowestRequestsLogPrefix)
+				if !ok {
+					return
+				}
+				var w api.SlowestRequests
+				if err := json.Unmarshal([]byte(data), &w); err != nil {
+					logger.Debug("failed to parse slowest requests", "error", err)
+					return
+				}
+				mergeSlowest(mr, w)
+				changed = true
+			})
+			c.mu.Lock()
+			c.cursors[stream] = start
+			c.mu.Unlock()
+			if err != nil {
+				logger.Error("failed to read dealgood logs", err, "stream", stream)
+			}
+		}
+	}
+	return changed
+}
+
+// Forget discards the state kept for an experiment's tasks once it has completed.
+func (c *SlowestCollector) Forget(mr *ManagedResources) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, res := range mr.Resources {
+		if res.Type != api.ResourceTypeEcsTask {
+			continue
+		}
+		suffix := "/" + path.Base(res.Keys[api.ResourceKeyArn])
+		for stream := range c.cursors {
+			if strings.HasSuffix(stream, suffix) {
+				delete(c.cursors, stream)
+			}
+		}
+	}
+}
+
+// mergeSlowest records a window reported by dealgood as the latest for its target, unless a
+// later one has been seen, and merges its requests into the slowest of the experiment.
+func mergeSlowest(mr *ManagedResources, w api.SlowestRequests) {
+	found := false
+	for i := range mr.Slowest {
+		if mr.Slowest[i].Target == w.Target {
+			found = true
+			if w.WindowEnd.After(mr.Slowest[i].WindowEnd) {
+				mr.Slowest[i] = w
+			}
+		}
+	}
+	if !found {
+		mr.Slowest = append(mr.Slowest, w)
+		sort.Slice(mr.Slowest, func(i, j int) bool { return mr.Slowest[i].Target < mr.Slowest[j].Target })
+	}
+
+	for i := range mr.SlowestOverall {
+		o := &mr.SlowestOverall[i]
+		if o.Target != w.Target {
+			continue
+		}
+		k := len(w.Requests)
+		if len(o.Requests) > k {
+			k = len(o.Requests)
+		}
+		o.Requests = api.MergeSlowRequests(o.Requests, w.Requests, k)
+		if w.WindowEnd.After(o.WindowEnd) {
+			o.WindowEnd = w.WindowEnd
+		}
+		return
+	}
+	mr.SlowestOverall = append(mr.SlowestOverall, api.SlowestRequests{
+		Target:      w.Target,
+		WindowStart: mr.Start,
+		WindowEnd:   w.WindowEnd,
+		Requests:    w.Requests,
+	})
+	sort.Slice(mr.SlowestOverall, func(i, j int) bool { return mr.SlowestOverall[i].Target < mr.SlowestOverall[j].Target })
+}
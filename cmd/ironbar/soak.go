@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// soakDefinition holds the parts of an experiment definition needed to report on a soak
+// experiment.
+type soakDefinition struct {
+	Soak *struct {
+		Interval time.Duration
+	}
+}
+
+// soakInterval returns the interval latency drift is measured over if the definition is of a
+// soak experiment, or zero otherwise.
+func soakInterval(definition string) (time.Duration, error) {
+	if definition == "" {
+		return 0, nil
+	}
+	var def soakDefinition
+	if err := json.Unmarshal([]byte(definition), &def); err != nil {
+		return 0, fmt.Errorf("decode experiment definition: %w", err)
+	}
+	if def.Soak == nil {
+		return 0, nil
+	}
+	if def.Soak.Interval <= 0 {
+		return time.Hour, nil
+	}
+	return def.Soak.Interval, nil
+}
+
+// SoakSummaries returns the stability indicators of each target between start and end, with
+// latency summarised over each interval. Restarts are not known to Prometheus and are left
+// for the caller to fill in.
+func (c *ResultsClient) SoakSummaries(ctx context.Context, experiment string, start, end time.Time, interval time.Duration) ([]api.SoakSummary, error) {
+	span := end.Sub(start)
+	if interval > span/2 {
+		// at least two intervals are needed to fit a slope
+		interval = span / 2
+	}
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(span.Seconds())))
+	iv := int64(math.Ceil(interval.Seconds()))
+	// containers of the target's task other than the gateway are sidecars and dealgood's own
+	// go_goroutines has no target label
+	memory := fmt.Sprintf("ecs_memory_bytes{experiment=%q,container=\"gateway\",target!=\"\"}", experiment)
+	goroutines := fmt.Sprintf("go_goroutines{experiment=%q,job=\"thunderdome-target\"}", experiment)
+	ttfb := func(q float64, r string) string {
+		return fmt.Sprintf("histogram_quantile(%g, sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%q}%s)))", q, experiment, r)
+	}
+	ivRange := fmt.Sprintf("[%ds]", iv)
+	subquery := fmt.Sprintf("[%ds:%ds]", int64(math.Ceil(span.Seconds())), iv)
+
+	summaries := make(map[string]*api.SoakSummary)
+	for _, q := range []struct {
+		expr string
+		at   time.Time
+		set  func(*api.SoakSummary, float64)
+	}{
+		{
+			expr: fmt.Sprintf("max by (target) (max_over_time(%s%s))", memory, window),
+			set:  func(ss *api.SoakSummary, v float64) { ss.MemoryMax = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (deriv(%s%s)) * 3600", memory, window),
+			set:  func(ss *api.SoakSummary, v float64) { ss.MemoryGrowth = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (max_over_time(%s%s))", goroutines, window),
+			set:  func(ss *api.SoakSummary, v float64) { ss.GoroutinesMax = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (deriv(%s%s)) * 3600", goroutines, window),
+			set:  func(ss *api.SoakSummary, v float64) { ss.GoroutineGrowth = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (deriv(%s%s)) * 3600", ttfb(0.5, ivRange), subquery),
+			set:  func(ss *api.SoakSummary, v float64) { ss.TTFBP50Drift = &v },
+		},
+		{
+			expr: fmt.Sprintf("max by (target) (deriv(%s%s)) * 3600", ttfb(0.99, ivRange), subquery),
+			set:  func(ss *api.SoakSummary, v float64) { ss.TTFBP99Drift = &v },
+		},
+		{
+			expr: ttfb(0.99, ivRange),
+			at:   start.Add(interval),
+			set:  func(ss *api.SoakSummary, v float64) { ss.TTFBP99First = &v },
+		},
+		{
+			expr: ttfb(0.99, ivRange),
+			set:  func(ss *api.SoakSummary, v float64) { ss.TTFBP99Last = &v },
+		},
+	} {
+		at := q.at
+		if at.IsZero() {
+			at = end
+		}
+		values, err := c.queryByTarget(ctx, q.expr, at)
+		if err != nil {
+			return nil, err
+		}
+		for target, v := range values {
+			ss, ok := summaries[target]
+			if !ok {
+				ss = &api.SoakSummary{Target: target}
+				summaries[target] = ss
+			}
+			q.set(ss, v)
+		}
+	}
+
+	out := make([]api.SoakSummary, 0, len(summaries))
+	for _, ss := range summaries {
+		out = append(out, *ss)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out, nil
+}
+
+// countRestarts sets the number of times the task of each target stopped early.
+func countRestarts(summaries []api.SoakSummary, failures []api.Failure) {
+	restarts := make(map[string]int)
+	for _, f := range failures {
+		if name, ok := strings.CutPrefix(f.Component, targetComponentPrefix); ok {
+			restarts[name]++
+		}
+	}
+	for i := range summaries {
+		summaries[i].Restarts = restarts[summaries[i].Target]
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/version"
+)
+
+// features are the parts of experiment definitions this ironbar acts on. A feature is added
+// here when ironbar starts reading a new field of the definition so that clients can tell an
+// older ironbar would ignore it.
+var features = []string{
+	api.FeatureKmsKey,
+	api.FeatureNoiseBaseline,
+	api.FeatureSoak,
+	api.FeatureShutdownStages,
+}
+
+func (s *Server) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	s.WriteAsJSON(w, http.StatusOK, &api.VersionOutput{
+		Version:       version.String(),
+		APIVersion:    api.APIVersion,
+		MinAPIVersion: api.MinAPIVersion,
+		Features:      features,
+	})
+}
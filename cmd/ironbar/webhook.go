@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+const (
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the request body, computed with
+	// the webhook secret and prefixed with "sha256=".
+	WebhookSignatureHeader = "X-Thunderdome-Signature"
+
+	// WebhookEventHeader holds the type of event being delivered.
+	WebhookEventHeader = "X-Thunderdome-Event"
+
+	// WebhookDeliveryHeader holds the id of the event, which is the same for every retry.
+	WebhookDeliveryHeader = "X-Thunderdome-Delivery"
+)
+
+// A WebhookSender delivers signed webhook events to a set of urls, retrying failed deliveries
+// with exponential backoff.
+type WebhookSender struct {
+	URLs       []string
+	Secret     string // used to sign each delivery, deliveries are unsigned if empty
+	MaxRetries int
+	Backoff    time.Duration // delay before the first retry, doubled for each subsequent retry
+
+	client *http.Client
+}
+
+func NewWebhookSender(urls []string, secret string, maxRetries int) *WebhookSender {
+	return &WebhookSender{
+		URLs:       urls,
+		Secret:     secret,
+		MaxRetries: maxRetries,
+		Backoff:    5 * time.Second,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send delivers the event to every url, returning once all deliveries have succeeded or
+// exhausted their retries.
+func (w *WebhookSender) Send(ctx context.Context, ev *api.WebhookEvent) {
+	if ev.ID == "" {
+		ev.ID = newEventID()
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("failed to marshal webhook event", err, "event", ev.Event)
+		return
+	}
+
+	for _, u := range w.URLs {
+		logger := slog.With("url", u, "event", ev.Event, "delivery", ev.ID)
+		if err := w.deliver(ctx, u, ev, body); err != nil {
+			logger.Error("failed to deliver webhook", err)
+			continue
+		}
+		logger.Info("delivered webhook")
+	}
+}
+
+func (w *WebhookSender) deliver(ctx context.Context, u string, ev *api.WebhookEvent, body []byte) error {
+	backoff := w.Backoff
+	var err error
+	for attempt := 0; attempt <= w.MaxRetries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("webhook delivery failed, retrying", "url", u, "delivery", ev.ID, "attempt", attempt, "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		if err = w.post(ctx, u, ev, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *WebhookSender) post(ctx context.Context, u string, ev *api.WebhookEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, ev.Event)
+	req.Header.Set(WebhookDeliveryHeader, ev.ID)
+	if w.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+signWebhook(w.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of body using secret as the key.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -9,7 +9,8 @@ import (
 
 // Some global counts that will be periodically logged
 var (
-	totalRequestsSent atomic.Int64
+	totalRequestsSent     atomic.Int64
+	totalRequestsExcluded atomic.Int64
 )
 
 type Health struct{}
@@ -23,7 +24,7 @@ func (h *Health) Run(ctx context.Context) error {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			log.Printf("sent %d requests", totalRequestsSent.Load())
+			log.Printf("sent %d requests, excluded %d requests", totalRequestsSent.Load(), totalRequestsExcluded.Load())
 		}
 	}
 }
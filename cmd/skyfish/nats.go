@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/plprobelab/thunderdome/pkg/nats"
+)
+
+// natsHeaderAllowance is the part of a NATS message reserved for its headers when batching
+// requests, which hold the message attributes.
+const natsHeaderAllowance = 1024
+
+// A NATSPublisher publishes messages to JetStream, reconnecting to the server if the
+// connection is lost. It is shared by every topic publishing to a NATS subject.
+type NATSPublisher struct {
+	url      string
+	stream   string        // stream created to capture the subjects if it does not exist, empty to rely on an existing stream
+	maxAge   time.Duration // age at which messages are removed from a stream that is created
+	subjects []string
+
+	mu   sync.Mutex // guards following fields
+	conn *nats.Conn
+	js   *nats.JetStream
+}
+
+func NewNATSPublisher(url string, stream string, maxAge time.Duration) (*NATSPublisher, error) {
+	if url == "" {
+		return nil, fmt.Errorf("nats url must be specified to publish to a nats subject")
+	}
+	return &NATSPublisher{url: url, stream: stream, maxAge: maxAge}, nil
+}
+
+// Connect connects to the server, creating the stream for the subjects if one was named and
+// it does not exist.
+func (n *NATSPublisher) Connect(ctx context.Context, subjects []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subjects = subjects
+	return n.connect(ctx)
+}
+
+// connect must be called with the mutex held.
+func (n *NATSPublisher) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	conn, err := nats.Dial(ctx, n.url, appName)
+	if err != nil {
+		return err
+	}
+	js := nats.NewJetStream(conn, 10*time.Second)
+	if n.stream != "" {
+		if err := n.ensureStream(ctx, js); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	n.conn = conn
+	n.js = js
+	return nil
+}
+
+func (n *NATSPublisher) ensureStream(ctx context.Context, js *nats.JetStream) error {
+	_, err := js.StreamInfo(ctx, n.stream)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrNotFound) {
+		return fmt.Errorf("stream info: %w", err)
+	}
+	if _, err := js.AddStream(ctx, nats.StreamConfig{
+		Name:     n.stream,
+		Subjects: n.subjects,
+		MaxAge:   n.maxAge,
+	}); err != nil {
+		return fmt.Errorf("add stream: %w", err)
+	}
+	log.Printf("created nats stream %s for subjects %v", n.stream, n.subjects)
+	return nil
+}
+
+// MaxMessageSize returns the largest batch of requests that can be published in one message.
+func (n *NATSPublisher) MaxMessageSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nats.DefaultMaxPayload - natsHeaderAllowance
+	}
+	return n.conn.MaxPayload() - natsHeaderAllowance
+}
+
+// Publish publishes a message to subject with the attributes as headers and waits for the
+// stream to store it.
+func (n *NATSPublisher) Publish(ctx context.Context, subject string, msg string, attrs map[string]string) error {
+	n.mu.Lock()
+	if n.conn == nil || n.conn.Err() != nil {
+		if err := n.connect(ctx); err != nil {
+			n.mu.Unlock()
+			return fmt.Errorf("reconnect: %w", err)
+		}
+		log.Printf("reconnected to nats at %s", n.url)
+	}
+	js := n.js
+	n.mu.Unlock()
+
+	hdr := make(nats.Header, len(attrs))
+	for name, value := range attrs {
+		// set directly so the attribute names are not canonicalized
+		hdr[name] = []string{value}
+	}
+	_, err := js.Publish(ctx, subject, hdr, []byte(msg))
+	return err
+}
+
+func (n *NATSPublisher) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil {
+		n.conn.Close()
+	}
+}
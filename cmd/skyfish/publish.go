@@ -2,43 +2,99 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/plprobelab/thunderdome/pkg/filter"
 	"github.com/plprobelab/thunderdome/pkg/loki"
+	"github.com/plprobelab/thunderdome/pkg/nats"
 	"github.com/plprobelab/thunderdome/pkg/prom"
 	"github.com/plprobelab/thunderdome/pkg/request"
 )
 
 const MaxMessageSize = 256 * 1024 // sns has 256kb max message size
 
+// MaxRecordSize is the maximum size of the payload of a kinesis record. Kinesis allows records
+// of up to 1MiB, some of which is reserved for the attribute header.
+const MaxRecordSize = 1000 * 1024
+
+// CompressedBatchFactor is the factor by which the maximum size of a batch of requests is
+// increased when it will be compressed. Request logs typically compress by a factor of five
+// or more so a batch usually fits within the message size limit once compressed and base64
+// encoded. Batches that do not fit are split before publishing.
+const CompressedBatchFactor = 4
+
+// ContentEncodingAttribute is the sns message attribute that names the encoding applied to a
+// compressed message. Compressed messages are base64 encoded since sns messages must be text.
+const ContentEncodingAttribute = "content-encoding"
+
+// SchemaVersionAttribute is the sns message attribute that identifies the format of the message
+// payload, allowing subscribers to reject messages they cannot read.
+const SchemaVersionAttribute = "schema-version"
+
+// SchemaVersion is the version of the message format published. Version 1 messages contain a
+// batch of one or more newline separated JSON encoded requests.
+const SchemaVersion = "1"
+
 type Publisher struct {
 	logch               <-chan loki.LogLine
 	awscfg              *aws.Config
-	topicArn            string
-	snsErrorCounter     prometheus.Counter
+	nats                *NATSPublisher  // publishes to topics with a nats subject, nil if there are none
+	redis               *RedisPublisher // publishes to topics with a redis stream, nil if there are none
+	topics              []*Topic
+	filter              filter.RequestFilter
+	traffic             *TrafficStats
+	maxDelay            time.Duration // maximum time a request is buffered before being published
 	processErrorCounter prometheus.Counter
-	messagesCounter     prometheus.Counter
-	requestsCounter     prometheus.Counter
+	excludedCounter     prometheus.Counter
 	connectedGauge      prometheus.Gauge
 }
 
-func NewPublisher(awscfg *aws.Config, topicArn string, logch <-chan loki.LogLine) (*Publisher, error) {
+func NewPublisher(awscfg *aws.Config, natsPublisher *NATSPublisher, redisPublisher *RedisPublisher, topics []*Topic, logch <-chan loki.LogLine, fltr filter.RequestFilter, maxDelay time.Duration) (*Publisher, error) {
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("at least one topic must be specified")
+	}
+	if maxDelay <= 0 {
+		return nil, fmt.Errorf("maximum batch delay must be greater than zero")
+	}
+	for _, t := range topics {
+		if t.Subject != "" && natsPublisher == nil {
+			return nil, fmt.Errorf("topic %s publishes to a nats subject but no nats server was specified", t.Name)
+		}
+		if t.RedisStream != "" && redisPublisher == nil {
+			return nil, fmt.Errorf("topic %s publishes to a redis stream but no redis server was specified", t.Name)
+		}
+	}
+
 	p := &Publisher{
 		logch:    logch,
 		awscfg:   awscfg,
-		topicArn: topicArn,
+		nats:     natsPublisher,
+		redis:    redisPublisher,
+		topics:   topics,
+		filter:   fltr,
+		maxDelay: maxDelay,
 	}
 
 	commonLabels := map[string]string{}
 	var err error
+	p.traffic, err = NewTrafficStats()
+	if err != nil {
+		return nil, fmt.Errorf("new traffic stats: %w", err)
+	}
+
 	p.connectedGauge, err = prom.NewPrometheusGauge(
 		appName,
 		"publisher_connected",
@@ -49,16 +105,6 @@ func NewPublisher(awscfg *aws.Config, topicArn string, logch <-chan loki.LogLine
 		return nil, fmt.Errorf("new gauge: %w", err)
 	}
 
-	p.snsErrorCounter, err = prom.NewPrometheusCounter(
-		appName,
-		"publisher_sns_error_total",
-		"The total number of errors encountered when publishing requests to sns.",
-		commonLabels,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("new counter: %w", err)
-	}
-
 	p.processErrorCounter, err = prom.NewPrometheusCounter(
 		appName,
 		"publisher_process_error_total",
@@ -69,20 +115,10 @@ func NewPublisher(awscfg *aws.Config, topicArn string, logch <-chan loki.LogLine
 		return nil, fmt.Errorf("new counter: %w", err)
 	}
 
-	p.messagesCounter, err = prom.NewPrometheusCounter(
+	p.excludedCounter, err = prom.NewPrometheusCounter(
 		appName,
-		"publisher_sns_messages_total",
-		"The total number of sns messages published.",
-		commonLabels,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("new counter: %w", err)
-	}
-
-	p.requestsCounter, err = prom.NewPrometheusCounter(
-		appName,
-		"publisher_requests_total",
-		"The total number of requests published in messages.",
+		"publisher_requests_excluded_total",
+		"The total number of requests that were not published because they matched an exclusion rule.",
 		commonLabels,
 	)
 	if err != nil {
@@ -99,25 +135,70 @@ func (p *Publisher) Run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("new session: %w", err)
 	}
-	log.Printf("connected to sns, publishing to topic %s", p.topicArn)
+	svc := sns.New(sess)
+	ksvc := kinesis.New(sess)
+
+	if p.nats != nil {
+		var subjects []string
+		for _, t := range p.topics {
+			if t.Subject != "" {
+				subjects = append(subjects, t.Subject)
+			}
+		}
+		if err := p.nats.Connect(ctx, subjects); err != nil {
+			return fmt.Errorf("connect to nats: %w", err)
+		}
+		defer p.nats.Close()
+	}
+	if p.redis != nil {
+		if err := p.redis.Connect(ctx); err != nil {
+			return fmt.Errorf("connect to redis: %w", err)
+		}
+		defer p.redis.Close()
+	}
+
+	for _, t := range p.topics {
+		switch {
+		case t.Subject != "":
+			log.Printf("connected to nats, publishing to topic %s (subject %s)", t.Name, t.Subject)
+			t.nats = p.nats
+		case t.RedisStream != "":
+			log.Printf("connected to redis, publishing to topic %s (stream %s)", t.Name, t.RedisStream)
+			t.redis = p.redis
+		case t.Stream != "":
+			log.Printf("connected to kinesis, publishing to topic %s (stream %s)", t.Name, t.Stream)
+			t.kinesis = ksvc
+		default:
+			log.Printf("connected to sns, publishing to topic %s (%s)", t.Name, t.TopicArn)
+			t.svc = svc
+		}
+		t.buf.Reset()
+		t.requests = 0
+	}
 
 	p.connectedGauge.Set(1)
 	defer p.connectedGauge.Set(0)
 
-	svc := sns.New(sess)
-
-	buf := new(bytes.Buffer)
-	buf.Grow(MaxMessageSize)
+	// partial batches are published periodically so requests are not held indefinitely
+	// when traffic is light
+	ticker := time.NewTicker(p.maxDelay)
+	defer ticker.Stop()
 
-	requests := 0
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-ticker.C:
+			for _, t := range p.topics {
+				if t.requests > 0 && time.Since(t.started) >= p.maxDelay {
+					t.flush()
+				}
+			}
 		case ll, ok := <-p.logch:
 			if !ok {
 				return fmt.Errorf("request channel closed")
 			}
+			p.traffic.Observe(&ll)
 
 			r := request.Request{
 				Method:     ll.Method,
@@ -129,45 +210,54 @@ func (p *Publisher) Run(ctx context.Context) error {
 				UserAgent:  ll.UserAgent,
 				Referer:    ll.Referer,
 			}
-
-			data, err := json.Marshal(r)
-			if err != nil {
-				p.processErrorCounter.Add(1)
-				log.Printf("failed to marshal request: %v", err)
+			if p.filter != nil && !p.filter(&r) {
+				p.excludedCounter.Add(1)
+				totalRequestsExcluded.Add(1)
 				continue
 			}
-			data = append(data, '\n')
 
-			if len(data) > MaxMessageSize {
-				p.processErrorCounter.Add(1)
-				log.Printf("request too large to send: %d bytes", len(data))
-				continue
-			}
+			// full and scrubbed encodings are created on demand and shared between topics
+			var full, scrubbed []byte
+			for _, t := range p.topics {
+				if !t.Accept(&r) {
+					continue
+				}
 
-			if buf.Len()+len(data) > MaxMessageSize {
-				_, err := svc.Publish(&sns.PublishInput{
-					Message:  aws.String(buf.String()),
-					TopicArn: aws.String(p.topicArn),
-				})
-				if err != nil {
-					p.snsErrorCounter.Add(1)
-					log.Printf("failed to publish message: %v", err)
+				var data []byte
+				if t.Scrub {
+					if scrubbed == nil {
+						scrubbed, err = marshalRequest(Scrub(&r))
+						if err != nil {
+							p.processErrorCounter.Add(1)
+							log.Printf("failed to marshal request: %v", err)
+							continue
+						}
+					}
+					data = scrubbed
 				} else {
-					p.messagesCounter.Add(1)
-					p.requestsCounter.Add(float64(requests))
-					totalRequestsSent.Add(int64(requests))
+					if full == nil {
+						full, err = marshalRequest(&r)
+						if err != nil {
+							p.processErrorCounter.Add(1)
+							log.Printf("failed to marshal request: %v", err)
+							continue
+						}
+					}
+					data = full
 				}
 
-				buf.Reset()
-				requests = 0
-			}
-			_, err = buf.Write(data)
-			if err != nil {
-				p.processErrorCounter.Add(1)
-				log.Printf("failed to buffer request: %v", err)
-				continue
+				if len(data) > t.maxBatchSize() {
+					p.processErrorCounter.Add(1)
+					log.Printf("request too large to send: %d bytes", len(data))
+					continue
+				}
+
+				if err := t.Add(data); err != nil {
+					p.processErrorCounter.Add(1)
+					log.Printf("failed to buffer request: %v", err)
+					continue
+				}
 			}
-			requests++
 		}
 	}
 }
@@ -177,3 +267,321 @@ func (p *Publisher) Run(ctx context.Context) error {
 func (p *Publisher) Shutdown(ctx context.Context) error {
 	return nil
 }
+
+func marshalRequest(r *request.Request) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Topic is an sns topic, kinesis data stream, nats subject or redis stream that requests are
+// published to. Each topic may apply its own filtering, sampling and scrubbing to the request
+// stream.
+type Topic struct {
+	Name        string
+	TopicArn    string
+	Stream      string               // name of the kinesis data stream to publish to instead of an sns topic
+	Subject     string               // nats subject captured by a JetStream stream to publish to instead of an sns topic
+	RedisStream string               // name of the redis stream to publish to instead of an sns topic
+	SampleRate  float64              // fraction of requests to publish, 1 publishes all requests
+	Scrub       bool                 // whether identifying information should be removed from requests before publishing
+	Filter      filter.RequestFilter // optional filter applied to requests before sampling
+	Compress    bool                 // whether messages are gzip compressed before publishing
+	BatchSize   int                  // maximum number of requests published in each message, 0 for no limit other than message size
+
+	svc      *sns.SNS
+	kinesis  *kinesis.Kinesis
+	nats     *NATSPublisher
+	redis    *RedisPublisher
+	records  int // number of records published to the stream, used as the partition key
+	buf      bytes.Buffer
+	requests int
+	started  time.Time // time the first request in the buffer was added
+	sampler  *Sampler
+
+	snsErrorCounter prometheus.Counter
+	messagesCounter prometheus.Counter
+	requestsCounter prometheus.Counter
+	skippedCounter  prometheus.Counter
+}
+
+func NewTopic(name string, topicArn string, sampleRate float64, scrub bool, fltr filter.RequestFilter) (*Topic, error) {
+	if topicArn == "" {
+		return nil, fmt.Errorf("topic arn must not be empty")
+	}
+	t, err := newTopic(name, sampleRate, scrub, fltr)
+	if err != nil {
+		return nil, err
+	}
+	t.TopicArn = topicArn
+	return t, nil
+}
+
+// NewSubjectTopic returns a topic that publishes requests to a nats subject captured by a
+// JetStream stream.
+func NewSubjectTopic(name string, subject string, sampleRate float64, scrub bool, fltr filter.RequestFilter) (*Topic, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("subject must not be empty")
+	}
+	t, err := newTopic(name, sampleRate, scrub, fltr)
+	if err != nil {
+		return nil, err
+	}
+	t.Subject = subject
+	return t, nil
+}
+
+// NewRedisStreamTopic returns a topic that adds requests to a redis stream.
+func NewRedisStreamTopic(name string, stream string, sampleRate float64, scrub bool, fltr filter.RequestFilter) (*Topic, error) {
+	if stream == "" {
+		return nil, fmt.Errorf("stream must not be empty")
+	}
+	t, err := newTopic(name, sampleRate, scrub, fltr)
+	if err != nil {
+		return nil, err
+	}
+	t.RedisStream = stream
+	return t, nil
+}
+
+// NewStreamTopic returns a topic that publishes requests to a kinesis data stream.
+func NewStreamTopic(name string, stream string, sampleRate float64, scrub bool, fltr filter.RequestFilter) (*Topic, error) {
+	if stream == "" {
+		return nil, fmt.Errorf("stream name must not be empty")
+	}
+	t, err := newTopic(name, sampleRate, scrub, fltr)
+	if err != nil {
+		return nil, err
+	}
+	t.Stream = stream
+	return t, nil
+}
+
+func newTopic(name string, sampleRate float64, scrub bool, fltr filter.RequestFilter) (*Topic, error) {
+	if name == "" {
+		return nil, fmt.Errorf("topic name must not be empty")
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("sample rate must be greater than 0 and no more than 1")
+	}
+
+	t := &Topic{
+		Name:       name,
+		SampleRate: sampleRate,
+		Scrub:      scrub,
+		Filter:     fltr,
+		sampler:    NewSampler(sampleRate),
+	}
+	t.buf.Grow(MaxMessageSize)
+
+	topicLabels := map[string]string{"topic": name}
+	var err error
+
+	t.snsErrorCounter, err = prom.NewPrometheusCounter(
+		appName,
+		"publisher_sns_error_total",
+		"The total number of errors encountered when publishing requests to sns or kinesis.",
+		topicLabels,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	t.messagesCounter, err = prom.NewPrometheusCounter(
+		appName,
+		"publisher_sns_messages_total",
+		"The total number of sns messages or kinesis records published.",
+		topicLabels,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	t.requestsCounter, err = prom.NewPrometheusCounter(
+		appName,
+		"publisher_requests_total",
+		"The total number of requests published in messages.",
+		topicLabels,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	t.skippedCounter, err = prom.NewPrometheusCounter(
+		appName,
+		"publisher_requests_skipped_total",
+		"The total number of requests not published to the topic because of its filter or sample rate.",
+		topicLabels,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter: %w", err)
+	}
+
+	return t, nil
+}
+
+// Accept reports whether the request should be published to the topic
+func (t *Topic) Accept(r *request.Request) bool {
+	if t.Filter != nil && !t.Filter(r) {
+		t.skippedCounter.Add(1)
+		return false
+	}
+	if !t.sampler.Sample() {
+		t.skippedCounter.Add(1)
+		return false
+	}
+	return true
+}
+
+// Add adds the encoded request to the topic's buffer, first publishing the buffer
+// as a message if the request would not fit.
+func (t *Topic) Add(data []byte) error {
+	if t.buf.Len()+len(data) > t.maxBatchSize() {
+		t.flush()
+	}
+	if _, err := t.buf.Write(data); err != nil {
+		return err
+	}
+	if t.requests == 0 {
+		t.started = time.Now()
+	}
+	t.requests++
+	if t.BatchSize > 0 && t.requests >= t.BatchSize {
+		t.flush()
+	}
+	return nil
+}
+
+// maxMessageSize returns the maximum size of a message that can be published to the topic
+func (t *Topic) maxMessageSize() int {
+	if t.Subject != "" {
+		if t.nats == nil {
+			return nats.DefaultMaxPayload - natsHeaderAllowance
+		}
+		return t.nats.MaxMessageSize()
+	}
+	if t.Stream != "" {
+		return MaxRecordSize
+	}
+	if t.RedisStream != "" {
+		return MaxEntrySize
+	}
+	return MaxMessageSize
+}
+
+// maxBatchSize returns the maximum size of a batch of requests before it is published
+func (t *Topic) maxBatchSize() int {
+	if t.Compress {
+		return CompressedBatchFactor * t.maxMessageSize()
+	}
+	return t.maxMessageSize()
+}
+
+func (t *Topic) flush() {
+	if t.requests == 0 {
+		return
+	}
+	if t.Compress {
+		t.publishCompressed(t.buf.Bytes(), t.requests)
+	} else {
+		t.publish(t.buf.String(), nil, t.requests)
+	}
+
+	t.buf.Reset()
+	t.requests = 0
+}
+
+// publishCompressed compresses a batch of newline separated requests and publishes it,
+// splitting the batch in two if it is still too large to fit in a single message.
+func (t *Topic) publishCompressed(batch []byte, requests int) {
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write(batch)
+	zw.Close()
+
+	if base64.StdEncoding.EncodedLen(zbuf.Len()) <= t.maxMessageSize() {
+		t.publish(base64.StdEncoding.EncodeToString(zbuf.Bytes()), map[string]string{
+			ContentEncodingAttribute: "gzip",
+		}, requests)
+		return
+	}
+
+	// split at the line break nearest the middle of the batch
+	mid := bytes.IndexByte(batch[len(batch)/2:], '\n')
+	if mid < 0 || len(batch)/2+mid+1 == len(batch) {
+		mid = bytes.LastIndexByte(batch[:len(batch)/2], '\n')
+		if mid < 0 {
+			t.snsErrorCounter.Add(1)
+			log.Printf("request too large to publish to topic %s after compression: %d bytes", t.Name, len(batch))
+			return
+		}
+	} else {
+		mid += len(batch) / 2
+	}
+	first := batch[:mid+1]
+	firstRequests := bytes.Count(first, []byte{'\n'})
+	t.publishCompressed(first, firstRequests)
+	t.publishCompressed(batch[mid+1:], requests-firstRequests)
+}
+
+func (t *Topic) publish(msg string, attrs map[string]string, requests int) {
+	all := map[string]string{SchemaVersionAttribute: SchemaVersion}
+	for name, value := range attrs {
+		all[name] = value
+	}
+
+	var err error
+	switch {
+	case t.Subject != "":
+		err = t.nats.Publish(context.Background(), t.Subject, msg, all)
+	case t.RedisStream != "":
+		err = t.redis.Publish(context.Background(), t.RedisStream, msg, all)
+	case t.Stream != "":
+		err = t.putRecord(msg, all)
+	default:
+		msgAttrs := make(map[string]*sns.MessageAttributeValue, len(all))
+		for name, value := range all {
+			msgAttrs[name] = &sns.MessageAttributeValue{
+				DataType:    aws.String("String"),
+				StringValue: aws.String(value),
+			}
+		}
+		_, err = t.svc.Publish(&sns.PublishInput{
+			Message:           aws.String(msg),
+			MessageAttributes: msgAttrs,
+			TopicArn:          aws.String(t.TopicArn),
+		})
+	}
+	if err != nil {
+		t.snsErrorCounter.Add(1)
+		log.Printf("failed to publish message to topic %s: %v", t.Name, err)
+	} else {
+		t.messagesCounter.Add(1)
+		t.requestsCounter.Add(float64(requests))
+		totalRequestsSent.Add(int64(requests))
+	}
+}
+
+// putRecord publishes a message to the topic's kinesis stream. Kinesis records have no
+// attributes so the record starts with a line holding the message attributes as a JSON object.
+// Records are spread evenly across shards by partitioning on a sequence number.
+func (t *Topic) putRecord(msg string, attrs map[string]string) error {
+	header, err := json.Marshal(attrs)
+	if err != nil {
+		return fmt.Errorf("marshal attributes: %w", err)
+	}
+	data := make([]byte, 0, len(header)+1+len(msg))
+	data = append(data, header...)
+	data = append(data, '\n')
+	data = append(data, msg...)
+
+	t.records++
+	_, err = t.kinesis.PutRecord(&kinesis.PutRecordInput{
+		StreamName:   aws.String(t.Stream),
+		PartitionKey: aws.String(strconv.Itoa(t.records)),
+		Data:         data,
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MaxEntrySize is the maximum size of the payload of a redis stream entry. Redis allows much
+// larger values but large entries are slow to trim and to read in batches.
+const MaxEntrySize = 1024 * 1024
+
+// redisPayloadField is the field of a stream entry holding the batch of requests. The message
+// attributes are added as the other fields of the entry.
+const redisPayloadField = "payload"
+
+// A RedisPublisher adds messages to redis streams. It is shared by every topic publishing to a
+// redis stream. The client reconnects to the server by itself if the connection is lost.
+type RedisPublisher struct {
+	client *redis.Client
+	maxLen int64 // approximate number of entries each stream is trimmed to, 0 for no limit
+}
+
+func NewRedisPublisher(url string, maxLen int64) (*RedisPublisher, error) {
+	if url == "" {
+		return nil, fmt.Errorf("redis url must be specified to publish to a redis stream")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	opts.ClientName = appName
+	opts.ContextTimeoutEnabled = true
+	return &RedisPublisher{client: redis.NewClient(opts), maxLen: maxLen}, nil
+}
+
+// Connect checks that the server can be reached.
+func (r *RedisPublisher) Connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Publish adds a message to stream as an entry with the attributes as its other fields.
+func (r *RedisPublisher) Publish(ctx context.Context, stream string, msg string, attrs map[string]string) error {
+	fields := make(map[string]any, len(attrs)+1)
+	for name, value := range attrs {
+		fields[name] = value
+	}
+	fields[redisPayloadField] = msg
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: r.maxLen,
+		Approx: true,
+		Values: fields,
+	}).Err()
+}
+
+func (r *RedisPublisher) Close() {
+	r.client.Close()
+}
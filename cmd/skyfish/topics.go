@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/plprobelab/thunderdome/pkg/filter"
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// TopicConfig describes a topic that requests should be published to. A list of
+// topic configs may be supplied as a JSON file to publish to several topics at once,
+// for example a full fidelity internal topic and a sampled and scrubbed topic for
+// external collaborators.
+type TopicConfig struct {
+	Name                string   `json:"name"`                            // short name used in logs and metrics
+	TopicArn            string   `json:"topic_arn,omitempty"`             // ARN of the sns topic
+	KinesisStream       string   `json:"kinesis_stream,omitempty"`        // name of a kinesis data stream to publish to instead of an sns topic
+	NATSSubject         string   `json:"nats_subject,omitempty"`          // nats subject captured by a JetStream stream to publish to instead of an sns topic
+	RedisStream         string   `json:"redis_stream,omitempty"`          // name of a redis stream to publish to instead of an sns topic
+	SampleRate          float64  `json:"sample_rate,omitempty"`           // fraction of requests to publish, defaults to 1
+	Scrub               bool     `json:"scrub,omitempty"`                 // remove client identifying information from requests
+	AllowHosts          []string `json:"allow_hosts,omitempty"`           // only publish requests for these hosts
+	ExcludeHosts        []string `json:"exclude_hosts,omitempty"`         // do not publish requests for these hosts
+	ExcludePathPrefixes []string `json:"exclude_path_prefixes,omitempty"` // do not publish requests with these path prefixes
+	ExcludeUserAgents   []string `json:"exclude_user_agents,omitempty"`   // do not publish requests from these user agents
+	Compress            bool     `json:"compress,omitempty"`              // gzip compress messages, allowing larger batches of requests
+	BatchSize           int      `json:"batch_size,omitempty"`            // maximum number of requests per message, defaults to --batch-size
+}
+
+// ReadTopicsFile reads a list of topic configs from a JSON file and creates the topics
+// they describe.
+func ReadTopicsFile(fname string, batchSize int) ([]*Topic, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	var cfgs []TopicConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfgs); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	seen := map[string]bool{}
+	topics := make([]*Topic, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("duplicate topic name: %s", cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		if cfg.SampleRate == 0 {
+			cfg.SampleRate = 1
+		}
+
+		excl := &filter.Exclusions{
+			AllowHosts:   lower(cfg.AllowHosts),
+			Hosts:        lower(cfg.ExcludeHosts),
+			PathPrefixes: cfg.ExcludePathPrefixes,
+			UserAgents:   cfg.ExcludeUserAgents,
+		}
+		var fltr filter.RequestFilter
+		if !excl.Empty() {
+			fltr = excl.Filter()
+		}
+
+		var t *Topic
+		var err error
+		destinations := 0
+		for _, v := range []string{cfg.TopicArn, cfg.KinesisStream, cfg.NATSSubject, cfg.RedisStream} {
+			if v != "" {
+				destinations++
+			}
+		}
+
+		switch {
+		case destinations > 1:
+			return nil, fmt.Errorf("topic %q: only one of topic_arn, kinesis_stream, nats_subject or redis_stream may be specified", cfg.Name)
+		case cfg.NATSSubject != "":
+			t, err = NewSubjectTopic(cfg.Name, cfg.NATSSubject, cfg.SampleRate, cfg.Scrub, fltr)
+		case cfg.RedisStream != "":
+			t, err = NewRedisStreamTopic(cfg.Name, cfg.RedisStream, cfg.SampleRate, cfg.Scrub, fltr)
+		case cfg.KinesisStream != "":
+			t, err = NewStreamTopic(cfg.Name, cfg.KinesisStream, cfg.SampleRate, cfg.Scrub, fltr)
+		default:
+			t, err = NewTopic(cfg.Name, cfg.TopicArn, cfg.SampleRate, cfg.Scrub, fltr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("topic %q: %w", cfg.Name, err)
+		}
+		t.Compress = cfg.Compress
+		t.BatchSize = batchSize
+		if cfg.BatchSize != 0 {
+			if cfg.BatchSize < 0 {
+				return nil, fmt.Errorf("topic %q: batch size must not be negative", cfg.Name)
+			}
+			t.BatchSize = cfg.BatchSize
+		}
+		topics = append(topics, t)
+	}
+
+	return topics, nil
+}
+
+// Sampler selects a random fraction of requests.
+type Sampler struct {
+	rate float64
+	rng  *rand.Rand
+}
+
+func NewSampler(rate float64) *Sampler {
+	return &Sampler{
+		rate: rate,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Sample reports whether the next request should be selected. It is not safe for concurrent use.
+func (s *Sampler) Sample() bool {
+	if s.rate >= 1 {
+		return true
+	}
+	return s.rng.Float64() < s.rate
+}
+
+// scrubbedHeaders are the only headers retained when a request is scrubbed. They
+// affect how a gateway responds but do not identify the client.
+var scrubbedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Cache-Control",
+	"Host",
+	"If-None-Match",
+	"Range",
+}
+
+// Scrub returns a copy of the request with client identifying information removed.
+func Scrub(r *request.Request) *request.Request {
+	s := &request.Request{
+		Method:    r.Method,
+		URI:       r.URI,
+		Status:    r.Status,
+		Timestamp: r.Timestamp,
+		Header:    map[string]string{},
+	}
+	for k, v := range r.Header {
+		ck := http.CanonicalHeaderKey(k)
+		for _, h := range scrubbedHeaders {
+			if ck == h {
+				s.Header[ck] = v
+				break
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/plprobelab/thunderdome/pkg/loki"
+	"github.com/plprobelab/thunderdome/pkg/prom"
+)
+
+// TrafficStats records aggregate metrics describing the composition of the
+// live request stream before any filtering is applied. Only coarse
+// classifications are used as labels so no individual request can be
+// identified from the metrics.
+type TrafficStats struct {
+	requestsCounter *prometheus.CounterVec
+	sizeHistogram   *prometheus.HistogramVec
+}
+
+func NewTrafficStats() (*TrafficStats, error) {
+	commonLabels := map[string]string{}
+
+	t := &TrafficStats{}
+
+	var err error
+	t.requestsCounter, err = prom.NewPrometheusCounterVec(
+		appName,
+		"traffic_requests_total",
+		"The total number of requests seen in the live stream, by method, path class and status class.",
+		commonLabels,
+		"method", "path_class", "status_class",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new counter vec: %w", err)
+	}
+
+	t.sizeHistogram, err = prom.NewPrometheusHistogramVec(
+		appName,
+		"traffic_response_size_bytes",
+		"Size of response bodies seen in the live stream, by path class.",
+		prometheus.ExponentialBuckets(256, 4, 12), // 256B to 1GB
+		commonLabels,
+		"path_class",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new histogram vec: %w", err)
+	}
+
+	return t, nil
+}
+
+// Observe records the log line in the aggregate metrics.
+func (t *TrafficStats) Observe(ll *loki.LogLine) {
+	pc := pathClass(ll.URI)
+	t.requestsCounter.WithLabelValues(methodClass(ll.Method), pc, statusClass(ll.Status)).Inc()
+	if ll.BodyBytes > 0 {
+		t.sizeHistogram.WithLabelValues(pc).Observe(float64(ll.BodyBytes))
+	}
+}
+
+// pathClass returns a coarse classification of a request uri.
+func pathClass(uri string) string {
+	switch {
+	case strings.HasPrefix(uri, "/ipfs/"):
+		return "ipfs"
+	case strings.HasPrefix(uri, "/ipns/"):
+		return "ipns"
+	case strings.HasPrefix(uri, "/api/"):
+		return "api"
+	case uri == "/" || uri == "":
+		return "root"
+	default:
+		return "other"
+	}
+}
+
+// statusClass returns the class of a status code, such as 2xx
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// methodClass limits the method label to well known values to avoid unbounded label cardinality
+func methodClass(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS":
+		return method
+	default:
+		return "other"
+	}
+}
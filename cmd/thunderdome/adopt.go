@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var AdoptCommand = &cli.Command{
+	Name:      "adopt",
+	Usage:     "Register existing AWS resources under an experiment so ironbar manages and removes them",
+	Action:    Adopt,
+	ArgsUsage: "EXPERIMENT-NAME",
+	Description: examples(
+		"thunderdome adopt --arn arn:aws:ecs:eu-west-1:123456789012:service/thunderdome/kubo bifrost-2023-05",
+		"thunderdome adopt --tag experiment=bifrost-2023-05 --lifetime 24h bifrost-2023-05",
+	),
+	BashComplete: completeExperimentNames(""),
+	Flags: flags([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "arn",
+			Usage:       "ARN of a resource to adopt. May be repeated.",
+			Destination: &adoptOpts.arns,
+		},
+		&cli.StringSliceFlag{
+			Name:        "tag",
+			Usage:       "Adopt every resource with this tag, given as KEY=VALUE. May be repeated, in which case resources must have all the tags.",
+			Destination: &adoptOpts.tags,
+		},
+		&cli.DurationFlag{
+			Name:        "lifetime",
+			Usage:       "How long ironbar should leave the adopted resources running before removing them. Resources are removed at ironbar's next check if zero.",
+			Destination: &adoptOpts.lifetime,
+		},
+	}),
+}
+
+var adoptOpts struct {
+	arns     cli.StringSlice
+	tags     cli.StringSlice
+	lifetime time.Duration
+}
+
+func Adopt(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("experiment name must be supplied")
+	}
+
+	in := &api.AdoptResourcesInput{
+		ARNs: adoptOpts.arns.Value(),
+		Tags: make(map[string]string),
+	}
+	for _, t := range adoptOpts.tags.Value() {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("tag %q should be given as KEY=VALUE", t)
+		}
+		in.Tags[k] = v
+	}
+	if len(in.ARNs) == 0 && len(in.Tags) == 0 {
+		return fmt.Errorf("at least one --arn or --tag must be supplied")
+	}
+	if adoptOpts.lifetime > 0 {
+		in.End = time.Now().UTC().Add(adoptOpts.lifetime)
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	name := cc.Args().Get(0)
+	out, err := prov.AdoptResources(ctx, name, in)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Adopted %d resources into experiment %s\n", len(out.Adopted), name)
+	for _, res := range out.Adopted {
+		fmt.Printf("  %-20s %s\n", res.Type, resourceLabel(res))
+	}
+	if len(out.Unsupported) > 0 {
+		fmt.Printf("Skipped %d resources that ironbar cannot manage\n", len(out.Unsupported))
+		for _, a := range out.Unsupported {
+			fmt.Println("  " + a)
+		}
+	}
+
+	return nil
+}
+
+// resourceLabel returns the most descriptive key of a resource for display.
+func resourceLabel(res api.Resource) string {
+	for _, k := range []string{api.ResourceKeyArn, api.ResourceKeyTableName, api.ResourceKeyEc2InstanceID, api.ResourceKeyQueueURL} {
+		if v, ok := res.Keys[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var AnnotateCommand = &cli.Command{
+	Name:      "annotate",
+	Usage:     "Attach a note to a running experiment, such as a record of a manual intervention",
+	Action:    Annotate,
+	ArgsUsage: "EXPERIMENT-NAME TEXT",
+	Description: "Annotations are kept by ironbar, shown by the status command, included in the webhook sent when " +
+		"the experiment completes and, if ironbar is configured with a Grafana instance, rendered on dashboards.\n\n" +
+		examples(
+			"thunderdome annotate bifrost-2023-05 \"restarted kubo target after it ran out of disk\"",
+		),
+	BashComplete: completeExperimentNames(""),
+	Flags:        flags([]cli.Flag{}),
+}
+
+func Annotate(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() < 2 {
+		return fmt.Errorf("experiment name and annotation text must be supplied")
+	}
+	name := cc.Args().First()
+	text := strings.Join(cc.Args().Tail(), " ")
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	a, err := prov.Annotate(ctx, name, text)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Annotated %s at %s\n", name, a.Time.Format(time.Stamp))
+	return nil
+}
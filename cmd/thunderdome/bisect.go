@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/build"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var BisectCommand = &cli.Command{
+	Name:  "bisect",
+	Usage: "Find the commit that introduced a performance regression by running experiments against intermediate commits",
+	Description: "Bisects the first-parent history of a target built from git between a good and a bad commit. " +
+		"Each step builds a commit and runs a short experiment comparing it with the good commit, which receives the same requests, " +
+		"and marks the commit bad if the metric is worse than the good commit's by more than the threshold. " +
+		"The bad commit is tested first to confirm the regression. Commits that fail to build or deploy are skipped.\n\n" +
+		examples(
+			"thunderdome bisect --good v0.19.0 --bad master --spec experiment.json --metric ttfb_p99 --threshold 10%",
+			"thunderdome bisect --good 1a2b3c4 --bad 5d6e7f8 --spec experiment.json --target kubo --duration 20 --repeats 2 --output bisect.json",
+		),
+	BashComplete: completeExperimentFile("target"),
+	Action:       Bisect,
+	Flags: flags(append(
+		[]cli.Flag{
+			&cli.StringFlag{
+				Name:        "good",
+				Required:    true,
+				Usage:       "Commit, tag or branch known not to have the regression.",
+				Destination: &bisectOpts.good,
+			},
+			&cli.StringFlag{
+				Name:        "bad",
+				Required:    true,
+				Usage:       "Commit, tag or branch known to have the regression. Must be a descendant of the good commit.",
+				Destination: &bisectOpts.bad,
+			},
+			&cli.StringFlag{
+				Name:        "spec",
+				Required:    true,
+				Usage:       "Experiment file defining the target and the workload of each run.",
+				Destination: &bisectOpts.spec,
+			},
+			&cli.StringFlag{
+				Name:        "target",
+				Usage:       "Name of the target to bisect, which must be built from git. Defaults to the first target built from git.",
+				Destination: &bisectOpts.target,
+			},
+			&cli.StringFlag{
+				Name:        "metric",
+				Value:       "ttfb_p99",
+				Usage:       "Metric to compare, one of ttfb_p50, ttfb_p95, ttfb_p99 or error_ratio.",
+				Destination: &bisectOpts.metric,
+			},
+			&cli.StringFlag{
+				Name:        "threshold",
+				Value:       "10%",
+				Usage:       "Increase of the metric over the good commit above which a commit is bad, as a percentage such as 10% or a fraction such as 0.1.",
+				Destination: &bisectOpts.threshold,
+			},
+			&cli.IntFlag{
+				Name:        "duration",
+				Aliases:     []string{"d"},
+				Value:       15,
+				Usage:       "Duration of each run, in minutes.",
+				Destination: &bisectOpts.duration,
+			},
+			&cli.IntFlag{
+				Name:        "repeats",
+				Value:       1,
+				Usage:       "Number of runs made for each commit, the median difference is compared with the threshold.",
+				Destination: &bisectOpts.repeats,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Write the measurements of each step to this file as JSON, updated after every step.",
+				Destination: &bisectOpts.output,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Aliases:     []string{"f"},
+				Usage:       "Force docker images to be rebuilt.",
+				Destination: &bisectOpts.forceBuild,
+			},
+			&cli.BoolFlag{
+				Name:        "skip-preflight",
+				Usage:       "Skip the checks made before any resources are created.",
+				Destination: &bisectOpts.skipPreflight,
+			},
+		},
+		promFlags(&bisectOpts.prom, "used to measure each run")...,
+	)),
+}
+
+var bisectOpts struct {
+	good          string
+	bad           string
+	spec          string
+	target        string
+	metric        string
+	threshold     string
+	duration      int
+	repeats       int
+	output        string
+	forceBuild    bool
+	skipPreflight bool
+	prom          promConfig
+}
+
+// bisectMetricAliases maps alternative names of the metrics that can be bisected to the names
+// used by studies.
+var bisectMetricAliases = map[string]string{
+	"p50_ttfb": "ttfb_p50",
+	"p95_ttfb": "ttfb_p95",
+	"p99_ttfb": "ttfb_p99",
+}
+
+// Names of the targets in each run of a bisection.
+const (
+	bisectGoodTarget      = "good"
+	bisectCandidateTarget = "candidate"
+)
+
+// A bisectStep holds the measurements made of one commit.
+type bisectStep struct {
+	Commit     string     `json:"commit"`
+	Runs       []studyRun `json:"runs,omitempty"`
+	Difference float64    `json:"difference"` // median relative difference of the metric from the good commit
+	Regressed  bool       `json:"regressed"`
+	Skipped    bool       `json:"skipped,omitempty"`
+	Error      string     `json:"error,omitempty"` // why the commit was skipped
+}
+
+type bisectReport struct {
+	Experiment string       `json:"experiment"`
+	Target     string       `json:"target"`
+	Metric     string       `json:"metric"`
+	Threshold  float64      `json:"threshold"`
+	Good       string       `json:"good"`
+	Bad        string       `json:"bad"`
+	Commits    int          `json:"commits"` // number of commits after the good commit up to and including the bad one
+	Steps      []bisectStep `json:"steps"`
+
+	// FirstBad is the commit that introduced the regression. Empty if commits next to it were
+	// skipped, in which case Suspects lists the commits that may have introduced it.
+	FirstBad string   `json:"first_bad,omitempty"`
+	Suspects []string `json:"suspects,omitempty"`
+}
+
+func Bisect(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkBuildEnv(); err != nil {
+		return err
+	}
+
+	if bisectOpts.duration < 5 {
+		return fmt.Errorf("duration must be at least 5 minutes")
+	}
+	if bisectOpts.repeats < 1 {
+		return fmt.Errorf("repeats must be at least 1")
+	}
+	if bisectOpts.prom.URL == "" {
+		return fmt.Errorf("a prometheus url must be supplied to measure each run")
+	}
+	metric := bisectOpts.metric
+	if m, ok := bisectMetricAliases[metric]; ok {
+		metric = m
+	}
+	query, ok := studyMetrics[metric]
+	if !ok || metric == "requests" {
+		return fmt.Errorf("unsupported metric: %q", bisectOpts.metric)
+	}
+	threshold, err := parseThreshold(bisectOpts.threshold)
+	if err != nil {
+		return err
+	}
+
+	e, err := LoadExperiment(ctx, bisectOpts.spec)
+	if err != nil {
+		return err
+	}
+	e.Duration = time.Duration(bisectOpts.duration) * time.Minute
+
+	tmpl, err := bisectTarget(e, bisectOpts.target)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("", "thunderdome-bisect")
+	if err != nil {
+		return fmt.Errorf("create work dir: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+	commits, good, err := bisectCommits(workDir, tmpl.ImageSpec.Git.Repo, bisectOpts.good, bisectOpts.bad)
+	if err != nil {
+		return err
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	bad := commits[len(commits)-1]
+	if !bisectOpts.skipPreflight {
+		fmt.Println("Running preflight checks")
+		if err := runPreflight(ctx, prov, bisectExperiment(e, tmpl, good, bad, e.Name)); err != nil {
+			return err
+		}
+	}
+
+	report := &bisectReport{
+		Experiment: e.Name,
+		Target:     tmpl.Name,
+		Metric:     metric,
+		Threshold:  threshold,
+		Good:       good,
+		Bad:        bad,
+		Commits:    len(commits),
+	}
+
+	runs := 0
+	test := func(commit string) (bisectStep, error) {
+		step := bisectStep{Commit: commit}
+		var diffs []float64
+		for i := 0; i < bisectOpts.repeats; i++ {
+			runs++
+			run := bisectExperiment(e, tmpl, good, commit, fmt.Sprintf("%s-b%d", e.Name, runs))
+			fmt.Printf("Testing %s: deploying %s for %s\n", shortCommit(commit), run.Name, run.Duration)
+			sr, err := runStudyExperiment(ctx, prov, &bisectOpts.prom, run, query, bisectGoodTarget, bisectCandidateTarget, bisectOpts.forceBuild && runs == 1)
+			if err != nil {
+				if ctx.Err() != nil {
+					return step, ctx.Err()
+				}
+				slog.Warn("skipping commit that could not be measured", "commit", commit, "error", err)
+				step.Skipped = true
+				step.Error = err.Error()
+				break
+			}
+			step.Runs = append(step.Runs, *sr)
+			if sr.Baseline == 0 {
+				continue
+			}
+			diffs = append(diffs, (sr.Candidate-sr.Baseline)/sr.Baseline)
+		}
+		if !step.Skipped && len(diffs) == 0 {
+			step.Skipped = true
+			step.Error = "the good commit measured zero in every run"
+		}
+		if !step.Skipped {
+			step.Difference = median(diffs)
+			step.Regressed = step.Difference > threshold
+			verdict := "good"
+			if step.Regressed {
+				verdict = "bad"
+			}
+			fmt.Printf("Tested %s: %s %+.2f%% from the good commit, %s\n", shortCommit(commit), metric, step.Difference*100, verdict)
+		}
+		report.Steps = append(report.Steps, step)
+		if err := writeBisectReport(report); err != nil {
+			slog.Error("failed to write report", err)
+		}
+		return step, nil
+	}
+
+	fmt.Printf("Bisecting %d commits between %s and %s, %s of %s worse by more than %g%% is bad\n",
+		len(commits), shortCommit(good), shortCommit(bad), metric, tmpl.Name, threshold*100)
+
+	// confirm the regression before spending runs on the commits in between
+	step, err := test(bad)
+	if err != nil {
+		return err
+	}
+	if step.Skipped {
+		return fmt.Errorf("bad commit %s could not be measured: %s", shortCommit(bad), step.Error)
+	}
+	if !step.Regressed {
+		return fmt.Errorf("bad commit %s is %+.2f%% from the good commit, which is within the threshold", shortCommit(bad), step.Difference*100)
+	}
+
+	// lo is the index of the last commit known to be good, -1 being the good commit itself, and
+	// hi of the first commit known to be bad
+	lo, hi := -1, len(commits)-1
+	skipped := map[int]bool{}
+	for {
+		next := bisectNext(lo, hi, skipped)
+		if next < 0 {
+			break
+		}
+		step, err := test(commits[next])
+		if err != nil {
+			return err
+		}
+		switch {
+		case step.Skipped:
+			skipped[next] = true
+		case step.Regressed:
+			hi = next
+		default:
+			lo = next
+		}
+	}
+
+	if hi-lo == 1 {
+		report.FirstBad = commits[hi]
+	} else {
+		report.Suspects = commits[lo+1 : hi+1]
+	}
+	if err := writeBisectReport(report); err != nil {
+		return err
+	}
+	printBisectReport(report)
+	return nil
+}
+
+// parseThreshold parses a threshold given as a percentage, such as 10%, or as a fraction.
+func parseThreshold(v string) (float64, error) {
+	s := strings.TrimSpace(v)
+	scale := 1.0
+	if strings.HasSuffix(s, "%") {
+		s = strings.TrimSuffix(s, "%")
+		scale = 100
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("threshold must be a positive percentage or fraction: %q", v)
+	}
+	return f / scale, nil
+}
+
+// bisectTarget returns the target to bisect, which must be built from a git repository.
+func bisectTarget(e *exp.Experiment, name string) (*exp.TargetSpec, error) {
+	for _, t := range e.Targets {
+		fromGit := t.ImageSpec != nil && t.ImageSpec.Git != nil && t.ImageSpec.Git.Repo != ""
+		if name == "" && fromGit {
+			return t, nil
+		}
+		if t.Name != name {
+			continue
+		}
+		if !fromGit {
+			return nil, fmt.Errorf("target %s is not built from git", name)
+		}
+		return t, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("experiment has no target built from git")
+	}
+	return nil, fmt.Errorf("target %s not found in experiment", name)
+}
+
+// bisectCommits clones the repository into workDir and returns the commits after good up to
+// and including bad, oldest first, together with the full hash of good.
+func bisectCommits(workDir, repo, good, bad string) ([]string, string, error) {
+	const cloneName = "code"
+	fmt.Printf("Cloning %s\n", repo)
+	if err := build.GitClone(workDir, repo, cloneName); err != nil {
+		return nil, "", fmt.Errorf("git clone: %w", err)
+	}
+	repoDir := filepath.Join(workDir, cloneName)
+	if err := build.GitFetchTags(repoDir); err != nil {
+		return nil, "", fmt.Errorf("git fetch tags: %w", err)
+	}
+
+	goodHash, err := build.GitRevParse(repoDir, good)
+	if err != nil {
+		return nil, "", fmt.Errorf("good commit %s not found: %w", good, err)
+	}
+	badHash, err := build.GitRevParse(repoDir, bad)
+	if err != nil {
+		// branches other than the default are only present as remote branches
+		badHash, err = build.GitRevParse(repoDir, "origin/"+bad)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad commit %s not found: %w", bad, err)
+		}
+	}
+	commits, err := build.GitRevList(repoDir, goodHash, badHash)
+	if err != nil {
+		return nil, "", fmt.Errorf("git rev-list: %w", err)
+	}
+	if len(commits) == 0 || commits[len(commits)-1] != badHash {
+		return nil, "", fmt.Errorf("bad commit %s is not a descendant of good commit %s", bad, good)
+	}
+	return commits, goodHash, nil
+}
+
+// bisectNext returns the index of the next commit to test between lo and hi, as close to the
+// middle as the skipped commits allow, or -1 if there is none left to test.
+func bisectNext(lo, hi int, skipped map[int]bool) int {
+	mid := lo + (hi-lo)/2
+	for d := 0; mid-d > lo || mid+d < hi; d++ {
+		if i := mid - d; i > lo && !skipped[i] {
+			return i
+		}
+		if i := mid + d; i < hi && !skipped[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// bisectExperiment returns one run of a bisection, an experiment with only the bisected target,
+// built once from the good commit and once from the commit being tested.
+func bisectExperiment(e *exp.Experiment, tmpl *exp.TargetSpec, good, commit, name string) *exp.Experiment {
+	target := func(targetName, commit string) *exp.TargetSpec {
+		t := *tmpl
+		t.Name = targetName
+		is := *tmpl.ImageSpec
+		git := *tmpl.ImageSpec.Git
+		git.Commit, git.Tag, git.Branch = commit, "", ""
+		is.Git = &git
+		t.ImageSpec = &is
+		t.Image = ""
+		return &t
+	}
+
+	run := *e
+	run.Name = name
+	run.Targets = []*exp.TargetSpec{
+		target(bisectGoodTarget, good),
+		target(bisectCandidateTarget, commit),
+	}
+	return &run
+}
+
+func median(vs []float64) float64 {
+	s := append([]float64(nil), vs...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+func shortCommit(c string) string {
+	if len(c) > 10 {
+		return c[:10]
+	}
+	return c
+}
+
+func writeBisectReport(r *bisectReport) error {
+	if bisectOpts.output == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode report: %w", err)
+	}
+	if err := os.WriteFile(bisectOpts.output, content, 0o644); err != nil {
+		return fmt.Errorf("write report: %w", err)
+	}
+	return nil
+}
+
+func printBisectReport(r *bisectReport) {
+	fmt.Println()
+	fmt.Printf("Bisection of %s in %s: %d of %d commits tested\n", r.Target, r.Experiment, len(r.Steps), r.Commits)
+	for _, s := range r.Steps {
+		switch {
+		case s.Skipped:
+			fmt.Printf("  %s skipped: %s\n", shortCommit(s.Commit), s.Error)
+		case s.Regressed:
+			fmt.Printf("  %s bad, %+.2f%%\n", shortCommit(s.Commit), s.Difference*100)
+		default:
+			fmt.Printf("  %s good, %+.2f%%\n", shortCommit(s.Commit), s.Difference*100)
+		}
+	}
+	if r.FirstBad != "" {
+		fmt.Printf("First bad commit: %s\n", r.FirstBad)
+		return
+	}
+	fmt.Printf("The regression was introduced by one of these commits, which could not all be tested:\n")
+	for _, c := range r.Suspects {
+		fmt.Printf("  %s\n", c)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -18,11 +19,21 @@ import (
 
 const imageBaseName = "thunderdome"
 
+// DefaultPlatform is the platform images are built for unless another is given. Targets run on
+// x86 instances, so images built on arm64 machines such as Apple silicon Macs must be built for
+// this platform rather than the machine's own.
+const DefaultPlatform = "linux/amd64"
+
 func LocalImageName(tag string) string {
 	return imageBaseName + ":" + tag
 }
 
-func Build(ctx context.Context, tag string, spec *exp.ImageSpec) (string, error) {
+// Build builds the image described by spec for the platform, DefaultPlatform if empty, and
+// returns its local name.
+func Build(ctx context.Context, tag string, platform string, spec *exp.ImageSpec) (string, error) {
+	if platform == "" {
+		platform = DefaultPlatform
+	}
 	imageName := LocalImageName(tag)
 	logger := slog.With("component", imageName)
 	logger.Debug("building image")
@@ -41,25 +52,25 @@ func Build(ctx context.Context, tag string, spec *exp.ImageSpec) (string, error)
 
 		if spec.Git.Branch != "" {
 			logger.Info(fmt.Sprintf("building image from branch %s in %s", spec.Git.Branch, spec.Git.Repo))
-			baseImage, err = BuildImageFromGitBranch(workDir, spec.Git.Repo, spec.Git.Branch, imageName)
+			baseImage, err = BuildImageFromGitBranch(workDir, spec.Git.Repo, spec.Git.Branch, imageName, platform)
 			if err != nil {
 				return "", err
 			}
 		} else if spec.Git.Commit != "" {
 			logger.Info(fmt.Sprintf("building image from commit %s in %s", spec.Git.Commit, spec.Git.Repo))
-			baseImage, err = BuildImageFromGitCommit(workDir, spec.Git.Repo, spec.Git.Commit, imageName)
+			baseImage, err = BuildImageFromGitCommit(workDir, spec.Git.Repo, spec.Git.Commit, imageName, platform)
 			if err != nil {
 				return "", err
 			}
 		} else if spec.Git.Tag != "" {
 			logger.Info(fmt.Sprintf("building image from tag %s in %s", spec.Git.Tag, spec.Git.Repo))
-			baseImage, err = BuildImageFromGitTag(workDir, spec.Git.Repo, spec.Git.Tag, imageName)
+			baseImage, err = BuildImageFromGitTag(workDir, spec.Git.Repo, spec.Git.Tag, imageName, platform)
 			if err != nil {
 				return "", err
 			}
 		} else {
 			logger.Info(fmt.Sprintf("building image from %s", spec.Git.Repo))
-			baseImage, err = BuildImageFromGit(workDir, spec.Git.Repo, imageName)
+			baseImage, err = BuildImageFromGit(workDir, spec.Git.Repo, imageName, platform)
 			if err != nil {
 				return "", err
 			}
@@ -72,7 +83,8 @@ func Build(ctx context.Context, tag string, spec *exp.ImageSpec) (string, error)
 	}
 
 	labels := map[string]string{
-		"org.opencontainers.image.created": time.Now().Format(time.RFC3339),
+		"org.opencontainers.image.created":   time.Now().Format(time.RFC3339),
+		"org.opencontainers.image.base.name": baseImage,
 	}
 	if spec.Maintainer != "" {
 		labels["maintainer"] = spec.Maintainer
@@ -81,7 +93,7 @@ func Build(ctx context.Context, tag string, spec *exp.ImageSpec) (string, error)
 		labels["org.opencontainers.image.description"] = spec.Description
 	}
 
-	if err := ConfigureImage(workDir, baseImage, imageName, labels, spec.InitCommands); err != nil {
+	if err := ConfigureImage(workDir, baseImage, imageName, platform, labels, spec.InitCommands); err != nil {
 		return "", fmt.Errorf("configure image: %w", err)
 	}
 
@@ -89,8 +101,9 @@ func Build(ctx context.Context, tag string, spec *exp.ImageSpec) (string, error)
 }
 
 func CopyDockerAssets(buildDir string, system string) error {
-	systemPath := filepath.Join("dockerassets", system)
-	pathPrefix := systemPath + string(filepath.Separator)
+	// paths in an embedded file system are separated by forward slashes on every os
+	systemPath := path.Join("dockerassets", system)
+	pathPrefix := systemPath + "/"
 	err := fs.WalkDir(dockerAssets, systemPath, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("walk error: %w", err)
@@ -99,7 +112,7 @@ func CopyDockerAssets(buildDir string, system string) error {
 		if !strings.HasPrefix(path, pathPrefix) {
 			return nil
 		}
-		dst := strings.Replace(path, pathPrefix, buildDir+string(filepath.Separator), 1)
+		dst := filepath.Join(buildDir, filepath.FromSlash(strings.TrimPrefix(path, pathPrefix)))
 
 		info, err := d.Info()
 		if err != nil {
@@ -135,7 +148,7 @@ func CopyDockerAssets(buildDir string, system string) error {
 	return nil
 }
 
-func BuildImageFromGitBranch(workDir string, gitRepo string, branch string, imageName string) (string, error) {
+func BuildImageFromGitBranch(workDir string, gitRepo string, branch string, imageName string, platform string) (string, error) {
 	const cloneName = "code"
 
 	if err := GitClone(workDir, gitRepo, cloneName); err != nil {
@@ -148,14 +161,14 @@ func BuildImageFromGitBranch(workDir string, gitRepo string, branch string, imag
 	}
 
 	tmpImageName := fmt.Sprintf("thunderdome:tmp-%d", time.Now().Unix())
-	if err := DockerBuild(gitRepoDir, tmpImageName); err != nil {
+	if err := DockerBuild(gitRepoDir, tmpImageName, platform); err != nil {
 		return "", fmt.Errorf("docker build: %w", err)
 	}
 
 	return tmpImageName, nil
 }
 
-func BuildImageFromGitCommit(workDir string, gitRepo string, commit string, imageName string) (string, error) {
+func BuildImageFromGitCommit(workDir string, gitRepo string, commit string, imageName string, platform string) (string, error) {
 	const cloneName = "code"
 
 	if err := GitClone(workDir, gitRepo, cloneName); err != nil {
@@ -168,13 +181,13 @@ func BuildImageFromGitCommit(workDir string, gitRepo string, commit string, imag
 	}
 
 	tmpImageName := fmt.Sprintf("thunderdome:tmp-%d", time.Now().Unix())
-	if err := DockerBuild(gitRepoDir, tmpImageName); err != nil {
+	if err := DockerBuild(gitRepoDir, tmpImageName, platform); err != nil {
 		return "", fmt.Errorf("docker build: %w", err)
 	}
 	return tmpImageName, nil
 }
 
-func BuildImageFromGitTag(workDir string, gitRepo string, gitTag string, imageName string) (string, error) {
+func BuildImageFromGitTag(workDir string, gitRepo string, gitTag string, imageName string, platform string) (string, error) {
 	const cloneName = "code"
 
 	if err := GitClone(workDir, gitRepo, cloneName); err != nil {
@@ -194,13 +207,13 @@ func BuildImageFromGitTag(workDir string, gitRepo string, gitTag string, imageNa
 	}
 
 	tmpImageName := fmt.Sprintf("thunderdome:tmp-%d", time.Now().Unix())
-	if err := DockerBuild(gitRepoDir, tmpImageName); err != nil {
+	if err := DockerBuild(gitRepoDir, tmpImageName, platform); err != nil {
 		return "", fmt.Errorf("docker build: %w", err)
 	}
 	return tmpImageName, nil
 }
 
-func BuildImageFromGit(workDir string, gitRepo string, imageName string) (string, error) {
+func BuildImageFromGit(workDir string, gitRepo string, imageName string, platform string) (string, error) {
 	const cloneName = "code"
 
 	if err := GitClone(workDir, gitRepo, cloneName); err != nil {
@@ -209,16 +222,16 @@ func BuildImageFromGit(workDir string, gitRepo string, imageName string) (string
 
 	gitRepoDir := filepath.Join(workDir, cloneName)
 	tmpImageName := fmt.Sprintf("thunderdome:tmp-%d", time.Now().Unix())
-	if err := DockerBuild(gitRepoDir, tmpImageName); err != nil {
+	if err := DockerBuild(gitRepoDir, tmpImageName, platform); err != nil {
 		return "", fmt.Errorf("docker build: %w", err)
 	}
 	return tmpImageName, nil
 }
 
-func DockerBuildFromImage(buildDir, srcImageName, imageName string, labels map[string]string) error {
+func DockerBuildFromImage(buildDir, srcImageName, imageName, platform string, labels map[string]string) error {
 	fromImageNameArg := fmt.Sprintf("FROM_IMAGE_NAME=%s", srcImageName)
 
-	dockerArgs := []string{"build", "-t", imageName, "--build-arg", fromImageNameArg}
+	dockerArgs := []string{"build", "--platform", platform, "-t", imageName, "--build-arg", fromImageNameArg}
 	for k, v := range labels {
 		dockerArgs = append(dockerArgs, "--label")
 		dockerArgs = append(dockerArgs, fmt.Sprintf("%s=%s", k, v))
@@ -236,7 +249,7 @@ func DockerBuildFromImage(buildDir, srcImageName, imageName string, labels map[s
 	return cmd.Wait()
 }
 
-func ConfigureImage(workDir, fromImage, imageName string, labels map[string]string, initCommands []string) error {
+func ConfigureImage(workDir, fromImage, imageName, platform string, labels map[string]string, initCommands []string) error {
 	logger := slog.With("component", imageName)
 	logger.Info(fmt.Sprintf("configuring image %s for use in thunderdome", fromImage))
 	buildDir := filepath.Join(workDir, "build")
@@ -254,7 +267,7 @@ func ConfigureImage(workDir, fromImage, imageName string, labels map[string]stri
 		return fmt.Errorf("write init config script: %w", err)
 	}
 
-	if err := DockerBuildFromImage(buildDir, fromImage, imageName, labels); err != nil {
+	if err := DockerBuildFromImage(buildDir, fromImage, imageName, platform, labels); err != nil {
 		return fmt.Errorf("docker build from tag: %w", err)
 	}
 
@@ -299,15 +312,15 @@ func EcrLogin(dockerRepo string, awsRegion string) error {
 		return fmt.Errorf("get aws ecr password: %w", err)
 	}
 
-	// docker login -u AWS -p $(aws ecr get-login-password --region eu-west-1) "$ECR_REPO"
-	cmd := exec.Command("docker", "login", "-u", "AWS", "-p", awsPwd, dockerRepo)
-	slog.Debug("docker login -u AWS -p REDACTED " + dockerRepo)
+	// aws ecr get-login-password --region eu-west-1 | docker login -u AWS --password-stdin "$ECR_REPO"
+	cmd := exec.Command("docker", "login", "-u", "AWS", "--password-stdin", dockerRepo)
+	slog.Debug(cmd.String())
+	cmd.Stdin = strings.NewReader(awsPwd)
 	cmd.Stdout = io.Discard
 	cmd.Stderr = os.Stderr
-
-	cmd.Env = []string{
-		fmt.Sprintf("AWS_PROFILE=%s", os.Getenv("AWS_PROFILE")),
-	}
+	// docker's credential helpers, such as docker-credential-desktop on macOS and windows,
+	// are found on the PATH and keep their state in the user's home directory
+	cmd.Env = os.Environ()
 
 	if err := cmd.Start(); err != nil {
 		return err
@@ -320,10 +333,7 @@ func GetAwsEcrPassword(awsRegion string) (string, error) {
 	cmd := exec.Command("aws", "ecr", "get-login-password", "--region", awsRegion)
 	cmd.Stdout = buf
 	cmd.Stderr = os.Stderr
-
-	cmd.Env = []string{
-		fmt.Sprintf("AWS_PROFILE=%s", os.Getenv("AWS_PROFILE")),
-	}
+	cmd.Env = os.Environ()
 
 	slog.Debug(cmd.String())
 	if err := cmd.Start(); err != nil {
@@ -333,7 +343,7 @@ func GetAwsEcrPassword(awsRegion string) (string, error) {
 		return "", err
 	}
 
-	return buf.String(), nil
+	return strings.TrimSpace(buf.String()), nil
 }
 
 // nonEmptyCount returns the number the passed strings that are not empty
@@ -355,7 +365,9 @@ func writeInitConfigScript(buildDir string, initCommands []string) error {
 	b.WriteString("#!/bin/sh\n")
 
 	for _, cmd := range initCommands {
-		fmt.Fprintln(b, cmd)
+		// commands read from files written on windows end their lines with \r\n, which sh
+		// would take as part of each command
+		fmt.Fprintln(b, strings.ReplaceAll(cmd, "\r\n", "\n"))
 	}
 
 	initConfigFilename := filepath.Join(buildDir, "container-init.d", "02-env-config.sh")
@@ -1,10 +1,12 @@
 package build
 
 import (
+	"bytes"
 	"embed"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 
 	"golang.org/x/exp/slog"
 )
@@ -12,8 +14,8 @@ import (
 //go:embed dockerassets
 var dockerAssets embed.FS
 
-func DockerBuild(gitRepoDir string, imageName string) error {
-	cmd := exec.Command("docker", "build", "-t", imageName, ".")
+func DockerBuild(gitRepoDir string, imageName string, platform string) error {
+	cmd := exec.Command("docker", "build", "--platform", platform, "-t", imageName, ".")
 	cmd.Dir = gitRepoDir
 	cmd.Stdout = io.Discard
 	cmd.Stderr = os.Stderr
@@ -56,3 +58,19 @@ func DockerInspect(imageName string) error {
 	}
 	return cmd.Wait()
 }
+
+// DockerServerVersion returns the version of the docker daemon, failing if it is not running.
+func DockerServerVersion() (string, error) {
+	buf := new(bytes.Buffer)
+	cmd := exec.Command("docker", "version", "--format", "{{.Server.Version}}")
+	cmd.Stdout = buf
+	cmd.Stderr = io.Discard
+	slog.Debug(cmd.String())
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,22 @@
+#!/bin/sh
+## Peers the gateway with the experiment's content providers. THUNDERDOME_PROVIDER_PEERING
+## holds a comma separated list of urls, each returning an entry of Peering.Peers.
+[ -z "$THUNDERDOME_PROVIDER_PEERING" ] && exit 0
+
+peers=""
+for url in $(echo "$THUNDERDOME_PROVIDER_PEERING" | tr ',' ' '); do
+    peer=""
+    # the provider's node may still be starting
+    for i in $(seq 60); do
+        peer=$(http_proxy= HTTP_PROXY= wget -qO- "$url") && break
+        sleep 5
+    done
+    if [ -z "$peer" ]; then
+        echo "could not read peering details from $url"
+        exit 1
+    fi
+    peers="${peers:+$peers,}$peer"
+done
+
+echo "peering with content providers"
+ipfs config --json Peering.Peers "[$peers]"
@@ -0,0 +1,11 @@
+#!/bin/sh
+## Isolates the gateway from the public network in a hermetic experiment. The swarm key is
+## installed by start_ipfs from IPFS_SWARM_KEY, this removes the public bootstrap peers and
+## disables the transports that do not support private networks.
+[ -z "$THUNDERDOME_HERMETIC" ] && exit 0
+
+echo "configuring hermetic network"
+ipfs bootstrap rm --all
+ipfs config --json Swarm.Transports.Network.QUIC false
+ipfs config --json Swarm.Transports.Network.WebTransport false
+ipfs config --json Discovery.MDNS.Enabled false
@@ -0,0 +1,7 @@
+#!/bin/sh
+## Imports the gateway conformance fixtures so that the conformance tests run by ironbar find
+## their content. THUNDERDOME_CONFORMANCE_FIXTURES is the path of the merged fixtures CAR file.
+[ -z "$THUNDERDOME_CONFORMANCE_FIXTURES" ] && exit 0
+
+echo "importing conformance fixtures"
+ipfs dag import --stats "$THUNDERDOME_CONFORMANCE_FIXTURES"
@@ -3,12 +3,15 @@ package build
 import (
 	"os"
 	"os/exec"
+	"strings"
 
 	"golang.org/x/exp/slog"
 )
 
 func GitClone(workdir string, repo string, targetDir string) error {
-	cmd := exec.Command("git", "clone", repo, targetDir)
+	// keep the line endings of the repository's scripts, which are run in linux containers,
+	// when git is configured to convert them on windows
+	cmd := exec.Command("git", "clone", "--config", "core.autocrlf=false", repo, targetDir)
 	cmd.Dir = workdir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -54,3 +57,30 @@ func GitFetchTags(workdir string) error {
 	}
 	return cmd.Wait()
 }
+
+// GitRevList returns the commits that are descendants of good and ancestors of bad, following
+// only the first parent of merges, oldest first. bad is the last commit returned.
+func GitRevList(gitRepoDir string, good string, bad string) ([]string, error) {
+	cmd := exec.Command("git", "rev-list", "--first-parent", "--ancestry-path", "--reverse", good+".."+bad)
+	cmd.Dir = gitRepoDir
+	cmd.Stderr = os.Stderr
+	slog.Debug(cmd.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// GitRevParse returns the full hash of the commit named by ref.
+func GitRevParse(gitRepoDir string, ref string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", ref+"^{commit}")
+	cmd.Dir = gitRepoDir
+	cmd.Stderr = os.Stderr
+	slog.Debug(cmd.String())
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
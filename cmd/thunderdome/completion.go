@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var CompletionCommand = &cli.Command{
+	Name:      "completion",
+	Usage:     "Print a shell completion script for bash, zsh or fish",
+	ArgsUsage: "SHELL",
+	Description: "Completes commands, flags, experiment file names, the names of experiments known to ironbar and the names of " +
+		"targets in an experiment file. Experiment names are only completed when AWS_REGION is set.\n\n" +
+		examples(
+			"source <(thunderdome completion bash)",
+			"thunderdome completion zsh > \"${fpath[1]}/_thunderdome\"",
+			"thunderdome completion fish > ~/.config/fish/completions/thunderdome.fish",
+		),
+	Action: Completion,
+	BashComplete: func(cc *cli.Context) {
+		if cc.NArg() == 0 {
+			fmt.Fprintln(cc.App.Writer, "bash\nzsh\nfish")
+		}
+	},
+}
+
+// completionScripts call the cli with --generate-bash-completion to produce candidates, so
+// completions stay in step with the commands and flags of the binary that is installed.
+var completionScripts = map[string]string{
+	"bash": `_thunderdome_complete() {
+  local cur opts
+  COMPREPLY=()
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  if [[ "$cur" == "-"* ]]; then
+    opts=$( "${COMP_WORDS[@]:0:$COMP_CWORD}" "${cur}" --generate-bash-completion 2>/dev/null )
+  else
+    opts=$( "${COMP_WORDS[@]:0:$COMP_CWORD}" --generate-bash-completion 2>/dev/null )
+  fi
+  COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+  return 0
+}
+
+complete -o bashdefault -o default -F _thunderdome_complete thunderdome
+`,
+	"zsh": `#compdef thunderdome
+
+_thunderdome() {
+  local -a opts
+  local cur
+  cur=${words[-1]}
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    _describe 'values' opts
+  else
+    _files
+  fi
+}
+
+compdef _thunderdome thunderdome
+`,
+	"fish": `function __thunderdome_complete
+    set -l args (commandline -opc)
+    set -l cur (commandline -ct)
+    if string match -q -- '-*' $cur
+        $args $cur --generate-bash-completion 2>/dev/null
+    else
+        $args --generate-bash-completion 2>/dev/null
+    end
+end
+
+complete -c thunderdome -f -a '(__thunderdome_complete)'
+`,
+}
+
+func Completion(cc *cli.Context) error {
+	if cc.NArg() != 1 {
+		return fmt.Errorf("shell must be supplied, one of bash, zsh or fish")
+	}
+	script, ok := completionScripts[cc.Args().First()]
+	if !ok {
+		return fmt.Errorf("unsupported shell: %q", cc.Args().First())
+	}
+	fmt.Fprint(cc.App.Writer, script)
+	return nil
+}
+
+// completionTimeout limits how long completion waits for ironbar.
+const completionTimeout = 3 * time.Second
+
+// previousArg returns the argument before the word being completed.
+func previousArg() string {
+	// the last argument is --generate-bash-completion
+	if len(os.Args) < 3 {
+		return ""
+	}
+	return os.Args[len(os.Args)-2]
+}
+
+// completeFlags prints the command's flags if a flag is being completed and reports whether it did.
+func completeFlags(cc *cli.Context) bool {
+	if strings.HasPrefix(previousArg(), "-") {
+		cli.DefaultCompleteWithFlags(cc.Command)(cc)
+		return true
+	}
+	return false
+}
+
+// completeExperimentNames returns a completion function that prints the names of the
+// experiments known to ironbar for the command's EXPERIMENT-NAME argument or, if flag is not
+// empty, for the value of the named flag.
+func completeExperimentNames(flag string, aliases ...string) cli.BashCompleteFunc {
+	return func(cc *cli.Context) {
+		prev := strings.TrimLeft(previousArg(), "-")
+		isFlag := flag != "" && (prev == flag || contains(aliases, prev))
+		if !isFlag {
+			if completeFlags(cc) || flag != "" || cc.NArg() > 0 {
+				return
+			}
+		}
+		for _, name := range experimentNames(cc.Context) {
+			fmt.Fprintln(cc.App.Writer, name)
+		}
+	}
+}
+
+// experimentNames returns the names of the running and recently stopped experiments known to
+// ironbar, or nil if they cannot be read.
+func experimentNames(ctx context.Context) []string {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if checkEnv() != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, completionTimeout)
+	defer cancel()
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return nil
+	}
+	out, err := prov.ListExperiments(ctx, nil)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(out.Items))
+	for _, it := range out.Items {
+		names = append(names, it.Name)
+	}
+	return names
+}
+
+// completeExperimentFile returns a completion function that prints the experiment files in
+// the current directory for the command's EXPERIMENT-FILENAME argument and the names of the
+// targets in the experiment file for the value of any of targetFlags.
+func completeExperimentFile(targetFlags ...string) cli.BashCompleteFunc {
+	return func(cc *cli.Context) {
+		prev := strings.TrimLeft(previousArg(), "-")
+		if contains(targetFlags, prev) {
+			for _, name := range experimentFileTargets() {
+				fmt.Fprintln(cc.App.Writer, name)
+			}
+			return
+		}
+		if completeFlags(cc) || cc.NArg() > 0 {
+			return
+		}
+		files, _ := filepath.Glob("*.json")
+		for _, f := range files {
+			fmt.Fprintln(cc.App.Writer, f)
+		}
+	}
+}
+
+// experimentFileTargets returns the names of the targets in the first experiment file named on
+// the command line, or nil if there is none.
+func experimentFileTargets() []string {
+	for _, arg := range os.Args[1:] {
+		if !strings.HasSuffix(arg, ".json") {
+			continue
+		}
+		content, err := os.ReadFile(arg)
+		if err != nil {
+			return nil
+		}
+		ej, _, err := decodeSpec(content)
+		if err != nil {
+			return nil
+		}
+		names := make([]string, 0, len(ej.Targets))
+		for _, t := range ej.Targets {
+			names = append(names, t.Name)
+		}
+		return names
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// examples formats usage examples for a command's description.
+func examples(lines ...string) string {
+	var b strings.Builder
+	b.WriteString("EXAMPLES:\n")
+	for _, l := range lines {
+		b.WriteString("   " + l + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// profileSettings maps the settings that may be given in a profile to the environment variable
+// each one provides a value for.
+var profileSettings = map[string]string{
+	"ironbar_addr":     envPrefix + "IRONBAR_ADDR",
+	"aws_profile":      "AWS_PROFILE",
+	"aws_region":       "AWS_REGION",
+	"ecr_repo":         envPrefix + "ECR_REPO",
+	"owner":            envPrefix + "OWNER",
+	"team":             envPrefix + "TEAM",
+	"prometheus_url":   envPrefix + "PROMETHEUS_URL",
+	"prometheus_user":  envPrefix + "PROMETHEUS_USER",
+	"prometheus_token": envPrefix + "PROMETHEUS_TOKEN",
+}
+
+var configOpts struct {
+	file    string
+	profile string
+}
+
+var configFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "config",
+		Usage:       "Path of the config file. Defaults to $XDG_CONFIG_HOME/thunderdome/config.toml or ~/.config/thunderdome/config.toml.",
+		Destination: &configOpts.file,
+		EnvVars:     []string{envPrefix + "CONFIG"},
+	},
+	&cli.StringFlag{
+		Name:        "profile",
+		Aliases:     []string{"p"},
+		Usage:       "Name of the config file profile to use. Defaults to the config file's default_profile, or the profile named default.",
+		Destination: &configOpts.profile,
+		EnvVars:     []string{envPrefix + "PROFILE"},
+	},
+}
+
+// A Config holds the named profiles read from the config file.
+type Config struct {
+	DefaultProfile string
+	Profiles       map[string]map[string]string // settings of each profile, keyed by profile name
+}
+
+// defaultConfigFile returns the path of the config file used when none is given.
+func defaultConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, appName, "config.toml")
+}
+
+// applyConfig reads the selected profile from the config file and sets the environment
+// variables it provides values for. Variables that are already set are left alone so the
+// environment can override a profile, and flags can override both.
+func applyConfig(cc *cli.Context) error {
+	fname := configOpts.file
+	if fname == "" {
+		fname = defaultConfigFile()
+		if fname == "" {
+			return nil
+		}
+		if _, err := os.Stat(fname); os.IsNotExist(err) {
+			if configOpts.profile != "" {
+				return fmt.Errorf("profile %s was selected but config file %s does not exist", configOpts.profile, fname)
+			}
+			return nil
+		}
+	}
+
+	cfg, err := ReadConfig(fname)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", fname, err)
+	}
+
+	name := configOpts.profile
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := cfg.Profiles[name]
+	if !ok {
+		if configOpts.profile == "" && cfg.DefaultProfile == "" {
+			// no profile was asked for and there is no default
+			return nil
+		}
+		return fmt.Errorf("config file %s has no profile named %s", fname, name)
+	}
+
+	for key, value := range profile {
+		env := profileSettings[key]
+		if _, set := os.LookupEnv(env); set {
+			continue
+		}
+		if err := os.Setenv(env, value); err != nil {
+			return fmt.Errorf("set %s: %w", env, err)
+		}
+	}
+	return nil
+}
+
+// ReadConfig reads a config file. Config files are written in a subset of TOML: a top level
+// default_profile key followed by a [profiles.NAME] table for each profile, holding string
+// values only.
+//
+//	default_profile = "staging"
+//
+//	[profiles.staging]
+//	ironbar_addr = "http://ironbar.staging.example.com:8080"
+//	aws_profile = "thunderdome-staging"
+//	aws_region = "eu-west-1"
+func ReadConfig(fname string) (*Config, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	cfg := &Config{
+		Profiles: make(map[string]map[string]string),
+	}
+
+	var profile map[string]string // profile being read, nil at the top level
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed table header", lineno)
+			}
+			table := strings.TrimSpace(line[1 : len(line)-1])
+			name, ok := strings.CutPrefix(table, "profiles.")
+			if !ok {
+				return nil, fmt.Errorf("line %d: unsupported table %q, only [profiles.NAME] tables are allowed", lineno, table)
+			}
+			name, err := parseConfigKey(name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: profile name: %w", lineno, err)
+			}
+			if _, exists := cfg.Profiles[name]; exists {
+				return nil, fmt.Errorf("line %d: profile %s is defined more than once", lineno, name)
+			}
+			profile = make(map[string]string)
+			cfg.Profiles[name] = profile
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key, err := parseConfigKey(strings.TrimSpace(k))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		value, err := parseConfigString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineno, key, err)
+		}
+
+		if profile == nil {
+			if key != "default_profile" {
+				return nil, fmt.Errorf("line %d: unknown key %q, settings must be inside a [profiles.NAME] table", lineno, key)
+			}
+			cfg.DefaultProfile = value
+			continue
+		}
+		if _, known := profileSettings[key]; !known {
+			return nil, fmt.Errorf("line %d: unknown setting %q, expected one of %s", lineno, key, strings.Join(settingNames(), ", "))
+		}
+		profile[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// stripComment removes a trailing comment from a line, ignoring # characters within strings.
+func stripComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseConfigKey parses a bare or quoted key.
+func parseConfigKey(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'") {
+		return parseConfigString(s)
+	}
+	if s == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", fmt.Errorf("invalid character %q in key %q", c, s)
+		}
+	}
+	return s, nil
+}
+
+// parseConfigString parses a basic (double quoted) or literal (single quoted) string.
+func parseConfigString(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("value must be a quoted string")
+}
+
+func settingNames() []string {
+	names := make([]string, 0, len(profileSettings))
+	for name := range profileSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
 )
@@ -14,6 +15,12 @@ var DeployCommand = &cli.Command{
 	Usage:     "Deploy an experiment",
 	Action:    Deploy,
 	ArgsUsage: "EXPERIMENT-FILENAME",
+	Description: examples(
+		"thunderdome deploy experiment.json",
+		"thunderdome deploy --duration 30 experiment.json",
+		"thunderdome deploy --force --skip-preflight experiment.json",
+	),
+	BashComplete: completeExperimentFile(),
 	Flags: flags(
 		[]cli.Flag{
 			&cli.IntFlag{
@@ -30,15 +37,44 @@ var DeployCommand = &cli.Command{
 				Usage:       "Force docker images to be rebuilt.",
 				Destination: &deployOpts.forceBuild,
 			},
+			&cli.BoolFlag{
+				Name:        "allow-remote-targets",
+				Required:    false,
+				Usage:       "Confirm that requests may be sent to remote targets defined by a url in the experiment file.",
+				Destination: &deployOpts.allowRemoteTargets,
+			},
+			&cli.IntFlag{
+				Name:        "remote-max-request-rate",
+				Required:    false,
+				Value:       DefaultRemoteMaxRequestRate,
+				Usage:       "The maximum request rate allowed for experiments that include remote targets.",
+				Destination: &deployOpts.remoteMaxRequestRate,
+			},
+			&cli.BoolFlag{
+				Name:        "skip-preflight",
+				Required:    false,
+				Usage:       "Skip the checks made before any resources are created.",
+				Destination: &deployOpts.skipPreflight,
+			},
 		},
 	),
 }
 
 var deployOpts struct {
-	duration   int
-	forceBuild bool
+	duration             int
+	forceBuild           bool
+	allowRemoteTargets   bool
+	remoteMaxRequestRate int
+	skipPreflight        bool
 }
 
+// MinSoakDuration is the shortest duration a soak experiment may be deployed for. Slow leaks
+// and drift are lost in the noise of shorter runs.
+const MinSoakDuration = 12 * time.Hour
+
+// DefaultRemoteMaxRequestRate is the default maximum request rate for experiments that include remote targets
+const DefaultRemoteMaxRequestRate = 10
+
 func Deploy(cc *cli.Context) error {
 	ctx := cc.Context
 	setupLogging()
@@ -60,11 +96,35 @@ func Deploy(cc *cli.Context) error {
 		return err
 	}
 	e.Duration = time.Duration(deployOpts.duration) * time.Minute
+	if e.Soak != nil && e.Duration < MinSoakDuration {
+		return fmt.Errorf("duration of a soak experiment must be at least %d minutes", int(MinSoakDuration.Minutes()))
+	}
+	if err := checkSegmentsDuration(e); err != nil {
+		return err
+	}
+
+	if err := checkRemoteTargets(e, deployOpts.allowRemoteTargets, deployOpts.remoteMaxRequestRate); err != nil {
+		return err
+	}
+	for _, w := range LintExperiment(e) {
+		slog.Warn(w)
+	}
 
 	prov, err := infra.NewProvider()
 	if err != nil {
 		return err
 	}
 
-	return prov.Deploy(ctx, e, deployOpts.forceBuild)
+	if !deployOpts.skipPreflight {
+		fmt.Println("Running preflight checks")
+		if err := runPreflight(ctx, prov, e); err != nil {
+			return err
+		}
+	}
+
+	if err := prov.Deploy(ctx, e, deployOpts.forceBuild); err != nil {
+		return err
+	}
+	printName(e.Name)
+	return nil
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/build"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var DescribeCommand = &cli.Command{
+	Name:      "describe",
+	Usage:     "Compare the effective configuration of an experiment's targets side by side",
+	Action:    Describe,
+	ArgsUsage: "EXPERIMENT-NAME",
+	Description: "The configuration each target was deployed with is read from ironbar, along with the image " +
+		"digest, image base, instance type and availability zone each target ran with once all of the " +
+		"experiment's tasks are running. Settings that differ between targets are marked ~ when the " +
+		"difference was asked for in the experiment definition and ! when it was not, such as targets given " +
+		"the same image that ran different digests, which can bias a comparison of their results.\n\n" +
+		examples(
+			"thunderdome describe bifrost-2023-05",
+			"thunderdome describe --all bifrost-2023-05",
+		),
+	BashComplete: completeExperimentNames(""),
+	Flags: flags([]cli.Flag{
+		&cli.BoolFlag{
+			Name:        "all",
+			Usage:       "Show the settings that are the same for every target as well as those that differ.",
+			Destination: &describeOpts.all,
+		},
+	}),
+}
+
+var describeOpts struct {
+	all bool
+}
+
+func Describe(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("experiment name must be supplied")
+	}
+	name := cc.Args().Get(0)
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	e, err := prov.Experiment(ctx, name)
+	if err != nil {
+		return err
+	}
+	status, err := prov.ExperimentStatus(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	rows := targetConfigRows(e, status.Placements)
+
+	var intended, unintended int
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := []string{"", "SETTING"}
+	for _, t := range e.Targets {
+		header = append(header, strings.ToUpper(t.Name))
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range rows {
+		mark := r.difference(rows)
+		switch mark {
+		case "":
+			if !describeOpts.all {
+				continue
+			}
+		case diffIntended:
+			intended++
+		case diffUnintended:
+			unintended++
+		}
+		cells := []string{mark, r.setting}
+		for _, t := range e.Targets {
+			v := r.values[t.Name]
+			if v == "" {
+				v = "-"
+			}
+			cells = append(cells, v)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if len(status.Placements) == 0 {
+		fmt.Println("The experiment's tasks are not all running, so only the definitions of its targets were compared.")
+	}
+	fmt.Printf("%d intended (~) and %d unintended (!) differences between targets\n", intended, unintended)
+	return nil
+}
+
+// Marks given to the settings that differ between targets.
+const (
+	diffIntended   = "~"
+	diffUnintended = "!"
+)
+
+// A configRow is one setting of the effective configuration of each target.
+type configRow struct {
+	setting string
+	values  map[string]string // keyed by target name, empty when the setting does not apply to a target
+
+	// source is the setting of the definition that the row follows from when it describes how
+	// the target ran rather than how it was defined, such as the digest of the image named by
+	// the definition. A difference is intended when the source differs between the same targets.
+	// Empty for rows of the definition and for rows of how the target ran that no setting of the
+	// definition accounts for.
+	source  string
+	defined bool // the row is a setting of the definition, so any difference was asked for
+}
+
+// difference returns the mark of a row whose value differs between targets, or an empty string
+// if every target has the same value.
+func (r *configRow) difference(rows []*configRow) string {
+	distinct := make(map[string]bool)
+	for _, v := range r.values {
+		distinct[v] = true
+	}
+	if len(distinct) < 2 {
+		return ""
+	}
+	if r.defined {
+		return diffIntended
+	}
+
+	var source *configRow
+	for _, sr := range rows {
+		if sr.setting == r.source {
+			source = sr
+		}
+	}
+	if source == nil {
+		return diffUnintended
+	}
+
+	// unintended if any two targets differ here while their source is the same
+	names := make([]string, 0, len(r.values))
+	for name := range r.values {
+		names = append(names, name)
+	}
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if r.values[a] != r.values[b] && source.values[a] == source.values[b] {
+				return diffUnintended
+			}
+		}
+	}
+	return diffIntended
+}
+
+// targetConfigRows describes the effective configuration of each of the experiment's targets, as
+// defined and, once placements are known, as it ran.
+func targetConfigRows(e *exp.Experiment, placements []api.TaskPlacement) []*configRow {
+	var rows []*configRow
+	index := make(map[string]*configRow)
+	set := func(setting string, target string, value string) {
+		r, ok := index[setting]
+		if !ok {
+			r = &configRow{setting: setting, values: make(map[string]string), defined: true}
+			index[setting] = r
+			rows = append(rows, r)
+		}
+		r.values[target] = value
+	}
+
+	// settings that apply to some targets only are added after the settings of every target
+	var envKeys, headerKeys []string
+	seen := make(map[string]bool)
+	for _, t := range e.Targets {
+		for k := range t.Environment {
+			if !seen["env "+k] {
+				seen["env "+k] = true
+				envKeys = append(envKeys, k)
+			}
+		}
+		for k := range t.RequestHeaders {
+			if !seen["header "+k] {
+				seen["header "+k] = true
+				headerKeys = append(headerKeys, k)
+			}
+		}
+	}
+	sort.Strings(envKeys)
+	sort.Strings(headerKeys)
+
+	for _, t := range e.Targets {
+		set("remote url", t.Name, t.URL)
+
+		image, built := "", ""
+		var initCommands []string
+		switch {
+		case t.Image != "":
+			image = t.Image
+		case t.ImageSpec != nil:
+			image = build.LocalImageName(t.ImageSpec.Hash())
+			built = imageSource(t.ImageSpec)
+			initCommands = t.ImageSpec.InitCommands
+		}
+		set("image", t.Name, image)
+		set("image built from", t.Name, built)
+		set("init commands", t.Name, strconv.Itoa(len(initCommands)))
+		for i, cmd := range initCommands {
+			set(fmt.Sprintf("init command %d", i+1), t.Name, strings.Join(strings.Fields(cmd), " "))
+		}
+
+		if t.EC2 != nil {
+			set("instance type", t.Name, t.EC2.InstanceType+" (own instance)")
+			set("placement group", t.Name, t.EC2.PlacementGroup)
+			set("tenancy", t.Name, t.EC2.Tenancy)
+			set("ena express", t.Name, strconv.FormatBool(t.EC2.EnaExpress))
+			set("instance storage", t.Name, strconv.FormatBool(t.EC2.InstanceStorage))
+		} else {
+			set("instance type", t.Name, t.InstanceType)
+		}
+
+		set("max in flight", t.Name, positiveInt(t.MaxInFlight))
+		set("shadow", t.Name, strconv.FormatBool(t.Shadow))
+		set("subdomain gateway", t.Name, t.SubdomainGateway)
+		set("debug port", t.Name, positiveInt(t.DebugPort))
+		set("admin port", t.Name, positiveInt(t.AdminPort))
+	}
+
+	for _, k := range envKeys {
+		for _, t := range e.Targets {
+			v, ok := t.Environment[k]
+			if ok {
+				v = strconv.Quote(v)
+			}
+			set("env "+k, t.Name, v)
+		}
+	}
+	for _, k := range headerKeys {
+		for _, t := range e.Targets {
+			set("header "+k, t.Name, redactedValue(t.RequestHeaders[k]))
+		}
+	}
+
+	// a setting that applies to some targets only is empty for the others
+	for _, r := range rows {
+		for _, t := range e.Targets {
+			if _, ok := r.values[t.Name]; !ok {
+				r.values[t.Name] = ""
+			}
+		}
+	}
+
+	if len(placements) == 0 {
+		return rows
+	}
+
+	ran := func(setting string, source string, value func(api.TaskPlacement) string) {
+		r := &configRow{setting: setting, source: source, values: make(map[string]string)}
+		for _, p := range placements {
+			name, ok := strings.CutPrefix(p.Component, "target ")
+			if !ok {
+				continue
+			}
+			r.values[name] = value(p)
+		}
+		rows = append(rows, r)
+	}
+	ran("image that ran", "image", func(p api.TaskPlacement) string { return p.Image })
+	ran("image digest", "image", func(p api.TaskPlacement) string { return shortDigest(p.ImageDigest) })
+	ran("image base", "image", func(p api.TaskPlacement) string { return p.ImageBase })
+	ran("instance type that ran", "instance type", func(p api.TaskPlacement) string { return p.InstanceType })
+	ran("availability zone", "", func(p api.TaskPlacement) string { return p.AvailabilityZone })
+	if e.Zones != nil && e.Zones.Policy == exp.ZonePolicySpread {
+		// targets were spread across zones on purpose
+		rows[len(rows)-1].defined = true
+	}
+
+	return rows
+}
+
+// imageSource describes where an image built by thunderdome comes from.
+func imageSource(is *exp.ImageSpec) string {
+	switch {
+	case is.BaseImage != "":
+		return is.BaseImage
+	case is.Git == nil:
+		return ""
+	case is.Git.Commit != "":
+		return is.Git.Repo + "@" + is.Git.Commit
+	case is.Git.Tag != "":
+		return is.Git.Repo + "@" + is.Git.Tag
+	case is.Git.Branch != "":
+		return is.Git.Repo + "@" + is.Git.Branch
+	default:
+		return is.Git.Repo
+	}
+}
+
+// redactedValue hides the value of a request header, which may be a credential, while still
+// letting values be told apart.
+func redactedValue(v string) string {
+	if v == "" {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(v))
+	return fmt.Sprintf("<redacted %08x>", h.Sum32())
+}
+
+func shortDigest(d string) string {
+	algo, hex, ok := strings.Cut(d, ":")
+	if !ok || len(hex) <= 12 {
+		return d
+	}
+	return algo + ":" + hex[:12]
+}
+
+func positiveInt(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
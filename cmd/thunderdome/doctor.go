@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/version"
+)
+
+var DoctorCommand = &cli.Command{
+	Name:   "doctor",
+	Usage:  "Check that the environment is set up to build images and deploy experiments",
+	Action: Doctor,
+	Description: examples(
+		"thunderdome doctor",
+	),
+	Flags: commonFlags,
+}
+
+func Doctor(cc *cli.Context) error {
+	setupLogging()
+
+	fmt.Printf("thunderdome %s\n", version.String())
+	results := infra.Doctor(cc.Context, os.Getenv("AWS_REGION"))
+
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("  ok    %s\n", r.Check)
+			continue
+		case r.Warning:
+			fmt.Printf("  warn  %s: %v\n", r.Check, r.Err)
+		default:
+			fmt.Printf("  FAIL  %s: %v\n", r.Check, r.Err)
+			failed++
+		}
+		if r.Fix != "" {
+			fmt.Printf("        fix: %s\n", r.Fix)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+)
+
+// Exit codes returned by the thunderdome command, so that scripts can tell whether to fix
+// their input, wait or retry.
+const (
+	exitFailure  = 1 // the error could not be classified
+	exitUser     = 2 // the experiment definition or the command's arguments are at fault
+	exitRejected = 3 // ironbar refused the experiment because of a quota, maintenance or a freeze window
+	exitInfra    = 4 // AWS, ironbar or the environment the experiment runs in failed
+)
+
+// errorCode returns the api error code of err, classifying errors from AWS that were not
+// returned by ironbar.
+func errorCode(err error) string {
+	if code := api.ErrorCode(err); code != "" {
+		return code
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if request.IsErrorThrottle(aerr) {
+			return api.ErrorCodeAWSThrottled
+		}
+		return api.ErrorCodeAWSError
+	}
+	return ""
+}
+
+// exitCode returns the exit code for an error returned by a command.
+func exitCode(err error) int {
+	code := errorCode(err)
+	switch {
+	case code == "":
+		return exitFailure
+	case api.IsUserError(code):
+		return exitUser
+	case code == api.ErrorCodeQuotaExceeded || code == api.ErrorCodeUnavailable:
+		return exitRejected
+	default:
+		return exitInfra
+	}
+}
+
+var errorHints = map[string]string{
+	api.ErrorCodeSpecInvalid:     "Check the experiment definition with: thunderdome validate <file>",
+	api.ErrorCodeMetadataMissing: "Add the missing fields, such as owner and purpose, to the experiment definition.",
+	api.ErrorCodeImageNotFound:   "Build and push the image with: thunderdome image, then use the tag it prints.",
+	api.ErrorCodeNotFound:        "List known experiments with: thunderdome list",
+	api.ErrorCodeUnauthorized:    "This request needs the ironbar admin token.",
+	api.ErrorCodeQuotaExceeded:   "Wait for running experiments to finish, or reduce the number of targets or the duration.",
+	api.ErrorCodeUnavailable:     "ironbar is in maintenance or a freeze window; try again later.",
+	api.ErrorCodePreflightFailed: "Fix the failed checks listed above and run: thunderdome preflight <file>",
+	api.ErrorCodeAWSThrottled:    "AWS is throttling requests; wait a minute and try again.",
+	api.ErrorCodeAWSError:        "Check your AWS credentials and region, then try again.",
+	api.ErrorCodeInternal:        "ironbar failed; check its logs.",
+}
+
+// errorHint returns a suggestion for how to recover from err, or the empty string if there
+// is none.
+func errorHint(err error) string {
+	hint, ok := errorHints[errorCode(err)]
+	if !ok {
+		return ""
+	}
+	return "hint: " + hint
+}
@@ -1,26 +1,131 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
 type ExperimentJSON struct {
-	Name           string        `json:"name"`
-	Description    string        `json:"description"`
-	MaxRequestRate int           `json:"max_request_rate"` // maximum number of requests per second to send to targets
-	MaxConcurrency int           `json:"max_concurrency"`  // maximum number of concurrent requests to have in flight for each target
-	RequestFilter  string        `json:"request_filter"`   // filter to apply to incoming requests: "none", "pathonly", "validpathonly"
-	Targets        []TargetJSON  `json:"targets"`
-	Shared         *SharedJSON   `json:"shared"` // environment variables and init commands provided to all targets
-	Defaults       *DefaultsJSON `json:"defaults"`
+	SpecVersion    int               `json:"spec_version"` // version of the definition format, see CurrentSpecVersion
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	Purpose        string            `json:"purpose,omitempty"`            // why the experiment is being run
+	Ticket         string            `json:"ticket,omitempty"`             // issue or pull request the experiment is for
+	Labels         map[string]string `json:"labels,omitempty"`             // key value pairs for finding related experiments
+	MaxRequestRate int               `json:"max_request_rate"`             // maximum number of requests per second to send to targets
+	MaxConcurrency int               `json:"max_concurrency"`              // maximum number of concurrent requests to have in flight for each target
+	RequestFilter  string            `json:"request_filter"`               // filter to apply to incoming requests: "none", "pathonly", "validpathonly"
+	BodyStrategy   string            `json:"body_strategy,omitempty"`      // how response bodies are read: "full", "discard", "hash", "partial"
+	BodyReadLimit  int64             `json:"body_read_limit,omitempty"`    // maximum number of body bytes read by the partial strategy
+	AcceptEncoding map[string]int    `json:"accept_encoding,omitempty"`    // relative weights of the Accept-Encoding values sent with requests
+	Audit          bool              `json:"audit,omitempty"`              // whether dealgood records the outcome of each request for every target
+	Egress         *EgressJSON       `json:"egress,omitempty"`             // proxy sidecar accounting for and restricting the destinations targets connect to
+	Cluster        string            `json:"cluster,omitempty"`            // ecs cluster targets are placed in, "auto" to let ironbar choose
+	Transport      string            `json:"transport,omitempty"`          // how requests are delivered to dealgood: "sqs", "kinesis" or "nats"
+	Replay         *ReplayJSON       `json:"replay,omitempty"`             // requests already in the nats stream that dealgood starts from
+	Priority       string            `json:"priority,omitempty"`           // admission priority: "low", "normal" or "urgent"
+	Preemptible    bool              `json:"preemptible,omitempty"`        // whether the experiment may be stopped early for one of higher priority
+	Precision      bool              `json:"precision,omitempty"`          // latency-sensitive comparison whose targets should not share hardware with other tenants
+	Zones          *ZonesJSON        `json:"zones,omitempty"`              // availability zones targets and dealgood are placed in
+	Search         *SearchJSON       `json:"search,omitempty"`             // search for the highest request rate each target sustains within an SLO
+	Spikes         *SpikesJSON       `json:"spikes,omitempty"`             // periodic traffic spikes whose recovery is scored for each target
+	Soak           *SoakJSON         `json:"soak,omitempty"`               // long-running experiment reporting the stability of each target
+	Segments       []SegmentJSON     `json:"segments,omitempty"`           // consecutive periods of the experiment whose results are reported on their own
+	Workload       *WorkloadJSON     `json:"workload,omitempty"`           // generated workload used instead of gateway traffic
+	Providers      []ProviderJSON    `json:"providers,omitempty"`          // content provider nodes seeded with generated content that targets are peered with
+	Hermetic       bool              `json:"hermetic,omitempty"`           // isolate targets and providers from the public IPFS network
+	KmsKeyArn      string            `json:"kms_key_arn,omitempty"`        // customer managed key encrypting the experiment's queue, table and crash dumps
+	Private        bool              `json:"private_networking,omitempty"` // run tasks and instances without public IPs, reaching AWS through vpc endpoints
+	Conformance    *ConformanceJSON  `json:"conformance,omitempty"`        // gateway conformance tests run against every target
+	Analyses       []AnalysisJSON    `json:"analyses,omitempty"`           // containers run by ironbar once the experiment completes
+	Shutdown       *ShutdownJSON     `json:"shutdown,omitempty"`           // timeouts of the stages the experiment is shut down in
+	Targets        []TargetJSON      `json:"targets"`
+	Shared         *SharedJSON       `json:"shared,omitempty"` // environment variables and init commands provided to all targets
+	Defaults       *DefaultsJSON     `json:"defaults,omitempty"`
+}
+
+type EgressJSON struct {
+	Upstreams map[string][]string `json:"upstreams,omitempty"` // hosts of each shared upstream, a leading *. matches any subdomain
+	Allow     []string            `json:"allow,omitempty"`     // hosts targets may connect to, all hosts not denied if empty
+	Deny      []string            `json:"deny,omitempty"`      // hosts targets may not connect to, even if allowed
+}
+
+type ReplayJSON struct {
+	StartSequence uint64 `json:"start_sequence,omitempty"` // stream sequence number of the first request
+	StartTime     string `json:"start_time,omitempty"`     // RFC 3339 time the first request was published at or after
+}
+
+type ZonesJSON struct {
+	Policy string `json:"policy"`         // "same" to place every target in dealgood's zone or "spread" to spread them across zones
+	Zone   string `json:"zone,omitempty"` // zone used by the same policy, defaults to that of the default subnet
+}
+
+type SearchJSON struct {
+	StartRate     float64 `json:"start_rate,omitempty"`      // request rate of the first step, defaults to 10
+	StepSeconds   int     `json:"step_seconds,omitempty"`    // time spent at each rate, defaults to 120
+	MaxP99Millis  int     `json:"max_p99_millis,omitempty"`  // highest p99 time to first byte within the SLO, defaults to 1000
+	MaxErrorRatio float64 `json:"max_error_ratio,omitempty"` // highest share of failed requests within the SLO, defaults to 0.01
+	Precision     float64 `json:"precision,omitempty"`       // fraction of the sustained rate the search narrows to, defaults to 0.05
+}
+
+type SpikesJSON struct {
+	Multiplier        float64 `json:"multiplier"`                   // request rate during a spike as a multiple of max_request_rate
+	DurationSeconds   int     `json:"duration_seconds,omitempty"`   // length of each spike, defaults to 30
+	IntervalMinutes   int     `json:"interval_minutes,omitempty"`   // time between the starts of successive spikes, defaults to 10
+	RecoveryTolerance float64 `json:"recovery_tolerance,omitempty"` // fraction of the pre-spike p99 a target must return within, defaults to 0.1
+}
+
+type SoakJSON struct {
+	IntervalMinutes int `json:"interval_minutes,omitempty"` // period latency is summarised over when measuring its drift, defaults to 60
+}
+
+type SegmentJSON struct {
+	Name            string `json:"name"`
+	DurationMinutes int    `json:"duration_minutes,omitempty"` // length of the segment, may only be omitted for the last segment which then lasts until the experiment ends
+	SettleSeconds   int    `json:"settle_seconds,omitempty"`   // time at the start of the segment left out of its results
+
+	AdminCalls []AdminCallJSON `json:"admin_calls,omitempty"` // requests sent to the admin api of targets as the segment starts
+}
+
+type AdminCallJSON struct {
+	Method  string          `json:"method,omitempty"`  // http method, defaults to POST
+	Path    string          `json:"path"`              // path and query of the request, such as /api/v0/config?arg=Routing.Type&arg=autoclient
+	Body    json.RawMessage `json:"body,omitempty"`    // json sent as the body of the request
+	Targets []string        `json:"targets,omitempty"` // targets the request is sent to, every target with an admin_port if empty
+}
+
+type ShutdownJSON struct {
+	DrainSeconds        int            `json:"drain_seconds,omitempty"`         // time dealgood waits for requests in flight once stopped, defaults to 30
+	FinalScrapeSeconds  int            `json:"final_scrape_seconds,omitempty"`  // time dealgood then waits for a final scrape of its metrics, defaults to 30
+	StageTimeoutSeconds map[string]int `json:"stage_timeout_seconds,omitempty"` // time ironbar waits for each of the "source", "dealgood" and "targets" stages
+}
+
+type WorkloadJSON struct {
+	Preset         string `json:"preset"`                     // "cold" to request freshly seeded content that no target has cached, "corpus" to request the content of the providers
+	ContentSizeKiB int    `json:"content_size_kib,omitempty"` // size of each item of content, defaults to 256
+}
+
+type ProviderJSON struct {
+	Name           string `json:"name"`
+	Kind           string `json:"kind,omitempty"`             // "kubo" to announce content to the DHT or "bitswap" to serve it only to peers, defaults to kubo
+	ContentCount   int    `json:"content_count,omitempty"`    // number of items of content seeded, defaults to 1000
+	ContentSizeKiB int    `json:"content_size_kib,omitempty"` // size of each item of content, defaults to 256
 }
 
 type NVJSON struct {
@@ -30,7 +135,8 @@ type NVJSON struct {
 
 type TargetJSON struct {
 	Name         string   `json:"name"`
-	Description  string   `json:"description"`
+	Description  string   `json:"description,omitempty"`
+	URL          string   `json:"url,omitempty"`           // base URL of an already running gateway. Remote targets are not deployed and take no other configuration.
 	InstanceType string   `json:"instance_type,omitempty"` // instance type to use. If empty, DefaultInstanceType will be used instead
 	Environment  []NVJSON `json:"environment,omitempty"`   // additional environment variables
 
@@ -42,6 +148,36 @@ type TargetJSON struct {
 	InitCommandsFrom string   `json:"init_commands_from,omitempty"`
 
 	UseImage string `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
+
+	RequestHeaders   []NVJSON `json:"request_headers,omitempty"`   // headers added to every request sent to the target, such as api keys or a Host override
+	SubdomainGateway string   `json:"subdomain_gateway,omitempty"` // domain served by the target as a subdomain gateway, requests are rewritten into subdomain form
+	DebugPort        int      `json:"debug_port,omitempty"`        // port serving pprof profiles under /debug/pprof, captured by ironbar in case the target crashes
+	AdminPort        int      `json:"admin_port,omitempty"`        // port serving the target's admin api, called by ironbar as segments start
+	MaxInFlight      int      `json:"max_in_flight,omitempty"`     // maximum number of requests in flight to the target, further requests wait in a queue
+	Shadow           bool     `json:"shadow,omitempty"`            // receives the requests but is left out of the comparison of results
+	EC2              *EC2JSON `json:"ec2,omitempty"`               // ec2 instance launched for the target alone, used instead of instance_type
+}
+
+type EC2JSON struct {
+	InstanceType    string `json:"instance_type"`              // any ec2 instance type, such as c6in.8xlarge
+	PlacementGroup  string `json:"placement_group,omitempty"`  // placement strategy shared with the experiment's other instances: "cluster", "spread" or "partition"
+	Tenancy         string `json:"tenancy,omitempty"`          // "dedicated" to run on hardware dedicated to the account
+	EnaExpress      bool   `json:"ena_express,omitempty"`      // enable ENA Express on the instance's network interface
+	InstanceStorage bool   `json:"instance_storage,omitempty"` // keep the target's data on the instance's NVMe instance storage
+}
+
+type ConformanceJSON struct {
+	Phases         []string `json:"phases,omitempty"`          // "pre" to test targets once they are running and "post" before they are stopped, defaults to post
+	Image          string   `json:"image,omitempty"`           // gateway-conformance docker image, defaults to DefaultConformanceImage
+	Specs          []string `json:"specs,omitempty"`           // specs to test, such as "trustless-gateway". If empty, the suite's defaults are tested
+	TimeoutMinutes int      `json:"timeout_minutes,omitempty"` // maximum time the tests of a target may run for. If zero, ironbar's default is used
+}
+
+type AnalysisJSON struct {
+	Name           string   `json:"name"`
+	Image          string   `json:"image"`                     // docker image to run, it is given the experiment's name, start and end in its environment
+	Environment    []NVJSON `json:"environment,omitempty"`     // additional environment variables
+	TimeoutMinutes int      `json:"timeout_minutes,omitempty"` // maximum time the analysis may run for. If zero, ironbar's default is used
 }
 
 type DefaultsJSON struct {
@@ -52,6 +188,10 @@ type DefaultsJSON struct {
 	InitCommands     []string     `json:"init_commands,omitempty"`
 	InitCommandsFrom string       `json:"init_commands_from,omitempty"`
 	UseImage         string       `json:"use_image,omitempty"` // docker image to use. If empty, DefaultImage will be used instead. Must be pre-configured for thunderdome.
+	DebugPort        int          `json:"debug_port,omitempty"`
+	AdminPort        int          `json:"admin_port,omitempty"`
+	MaxInFlight      int          `json:"max_in_flight,omitempty"`
+	EC2              *EC2JSON     `json:"ec2,omitempty"`
 }
 
 type SharedJSON struct {
@@ -70,34 +210,139 @@ type GitSpecJSON struct {
 // Target name must contain only lowercase letters, numbers and hyphens and must start with a letter
 var reTargetName = regexp.MustCompile(`^[a-z][a-z0-9-]+$`)
 
+// validEgressHost reports whether h is a host name, optionally with a leading *. to match any
+// subdomain, as used by the egress proxy.
+func validEgressHost(h string) bool {
+	return h != "" && !strings.ContainsAny(h, ":/ ,") && !strings.Contains(strings.TrimPrefix(h, "*."), "*")
+}
+
 // Experiment name must contain only lowercase letters, numbers and hyphens and must start with a letter
 var reExperimentName = regexp.MustCompile(`^[a-z][a-z0-9-]+$`)
 
+var reLabelKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,62}$`)
+
+// DefaultSoakInterval is the period latency is summarised over when measuring its drift in a
+// soak experiment that does not set one.
+const DefaultSoakInterval = time.Hour
+
+// DefaultDrainTimeout and DefaultFinalScrapeTimeout are the times dealgood waits for requests in
+// flight and for a final scrape of its metrics when it is stopped.
+const (
+	DefaultDrainTimeout       = 30 * time.Second
+	DefaultFinalScrapeTimeout = 30 * time.Second
+)
+
+// MaxStopTimeout is the longest ECS waits for a container to exit after asking it to stop,
+// which bounds the time dealgood can spend draining and waiting for a final scrape.
+const MaxStopTimeout = 120 * time.Second
+
+// DefaultProviderContentCount is the number of items of content seeded by a content provider
+// that does not set one.
+const DefaultProviderContentCount = 1000
+
+// DefaultConformanceImage is the gateway-conformance image used to test targets when the
+// experiment's conformance settings do not name one.
+const DefaultConformanceImage = "ghcr.io/ipfs/gateway-conformance:v0.3.0"
+
+// reTagValue matches the values that can be used in tags on every type of AWS resource.
+var reTagValue = regexp.MustCompile(`^[\pL\pN\s_.:/=+\-@]{0,256}$`)
+
+// StdinFilename is the experiment filename that reads the definition from stdin, so that
+// commands can be given the output of another, such as thunderdome render.
+const StdinFilename = "-"
+
+// LoadExperiment reads and parses an experiment definition from a file, or from stdin if the
+// filename is StdinFilename. Files named by the definition are relative to the directory of
+// the file, or to the working directory when it is read from stdin.
 func LoadExperiment(ctx context.Context, filename string) (*exp.Experiment, error) {
-	f, err := os.Open(filename)
+	f, dir, err := openExperiment(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	dir := filepath.Dir(filename)
-
 	e, err := ParseExperiment(ctx, f, dir)
 	if err != nil {
-		return nil, fmt.Errorf("parse experiment definition: %w", err)
+		return nil, &api.CodedError{Code: api.ErrorCodeSpecInvalid, Err: fmt.Errorf("parse experiment definition: %w", err)}
 	}
 
 	return e, nil
 }
 
-func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Experiment, error) {
-	ej := new(ExperimentJSON)
+// resolveInitCommands replaces the init_commands_from of the shared, default and target
+// configuration with the init commands read from the file it names, relative to baseDir.
+func resolveInitCommands(ej *ExperimentJSON, baseDir string) error {
+	if ej.Shared != nil && ej.Shared.InitCommandsFrom != "" {
+		if len(ej.Shared.InitCommands) > 0 {
+			return fmt.Errorf("cannot specify both init_commands and init_commands_from for target shared config")
+		}
 
-	dec := json.NewDecoder(r)
-	dec.DisallowUnknownFields()
+		fromFile := filepath.Join(baseDir, ej.Shared.InitCommandsFrom)
+		content, err := os.ReadFile(fromFile)
+		if err != nil {
+			return fmt.Errorf("failed reading init_commands_from in target shared config: %w", err)
+		}
+		ej.Shared.InitCommands = []string{string(content)}
+		ej.Shared.InitCommandsFrom = ""
+	}
 
-	if err := dec.Decode(ej); err != nil {
-		return nil, fmt.Errorf("json decode: %w", err)
+	if ej.Defaults != nil && ej.Defaults.InitCommandsFrom != "" {
+		if len(ej.Defaults.InitCommands) > 0 {
+			return fmt.Errorf("cannot specify both init_commands and init_commands_from for target default config")
+		}
+		fromFile := filepath.Join(baseDir, ej.Defaults.InitCommandsFrom)
+		content, err := os.ReadFile(fromFile)
+		if err != nil {
+			return fmt.Errorf("failed reading init_commands_from in target default config: %w", err)
+		}
+		ej.Defaults.InitCommands = []string{string(content)}
+		ej.Defaults.InitCommandsFrom = ""
+	}
+
+	for i := range ej.Targets {
+		tj := &ej.Targets[i]
+		if tj.InitCommandsFrom == "" {
+			continue
+		}
+		if len(tj.InitCommands) > 0 {
+			return fmt.Errorf("cannot specify both init_commands and init_commands_from for target %d", i+1)
+		}
+		fromFile := filepath.Join(baseDir, tj.InitCommandsFrom)
+		content, err := os.ReadFile(fromFile)
+		if err != nil {
+			return fmt.Errorf("failed reading init_commands_from in target %d: %w", i+1, err)
+		}
+		tj.InitCommands = []string{string(content)}
+		tj.InitCommandsFrom = ""
+	}
+	return nil
+}
+
+// openExperiment opens an experiment definition and returns the directory files it names are
+// relative to.
+func openExperiment(filename string) (io.ReadCloser, string, error) {
+	if filename == StdinFilename {
+		return io.NopCloser(os.Stdin), ".", nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, filepath.Dir(filename), nil
+}
+
+func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Experiment, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	ej, declared, err := decodeSpec(data)
+	if err != nil {
+		return nil, err
+	}
+	if declared == 0 {
+		slog.Warn(fmt.Sprintf("experiment definition has no spec_version, assuming version %d; run thunderdome migrate-spec to add it", legacySpecVersion))
 	}
 
 	if !reExperimentName.MatchString(ej.Name) {
@@ -108,6 +353,25 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		Name: ej.Name,
 	}
 
+	if !reTagValue.MatchString(ej.Purpose) {
+		return nil, fmt.Errorf("purpose must be no longer than 256 characters and contain only letters, numbers, spaces and _.:/=+-@")
+	}
+	e.Purpose = strings.TrimSpace(ej.Purpose)
+	if !reTagValue.MatchString(ej.Ticket) {
+		return nil, fmt.Errorf("ticket must be no longer than 256 characters and contain only letters, numbers, spaces and _.:/=+-@")
+	}
+	e.Ticket = strings.TrimSpace(ej.Ticket)
+
+	for k, v := range ej.Labels {
+		if !reLabelKey.MatchString(k) {
+			return nil, fmt.Errorf("label key must start with a letter and contain only letters, numbers and _.-, and be no longer than 63 characters: %q", k)
+		}
+		if !reTagValue.MatchString(v) {
+			return nil, fmt.Errorf("label %s must be no longer than 256 characters and contain only letters, numbers, spaces and _.:/=+-@", k)
+		}
+	}
+	e.Labels = ej.Labels
+
 	if ej.MaxRequestRate > 0 {
 		e.MaxRequestRate = ej.MaxRequestRate
 	} else {
@@ -127,29 +391,153 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		return nil, fmt.Errorf("unsupported request filter")
 	}
 
-	if ej.Shared.InitCommandsFrom != "" {
-		if len(ej.Shared.InitCommands) > 0 {
-			return nil, fmt.Errorf("cannot specify both init_commands and init_commands_from for target shared config")
+	switch ej.BodyStrategy {
+	case "", "full", "discard", "hash":
+		if ej.BodyReadLimit != 0 {
+			return nil, fmt.Errorf("body read limit can only be used with the partial body strategy")
+		}
+	case "partial":
+		if ej.BodyReadLimit <= 0 {
+			return nil, fmt.Errorf("body read limit must be a positive number when using the partial body strategy")
 		}
+	default:
+		return nil, fmt.Errorf("unsupported body strategy: %q", ej.BodyStrategy)
+	}
+	e.BodyStrategy = ej.BodyStrategy
+	e.BodyReadLimit = ej.BodyReadLimit
 
-		fromFile := filepath.Join(baseDir, ej.Shared.InitCommandsFrom)
-		content, err := os.ReadFile(fromFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed reading init_commands_from in target shared config: %w", err)
+	for v, w := range ej.AcceptEncoding {
+		if strings.TrimSpace(v) == "" {
+			return nil, fmt.Errorf("accept encoding values must not be empty, use identity to request uncompressed responses")
+		}
+		if w <= 0 {
+			return nil, fmt.Errorf("accept encoding weight of %q must be a positive number", v)
 		}
-		ej.Shared.InitCommands = []string{string(content)}
 	}
+	if ej.AcceptEncoding != nil && ej.BodyStrategy == "discard" {
+		return nil, fmt.Errorf("accept encoding cannot be used with the discard body strategy since response sizes are not measured")
+	}
+	e.AcceptEncoding = ej.AcceptEncoding
+	e.Audit = ej.Audit
 
-	if ej.Defaults.InitCommandsFrom != "" {
-		if len(ej.Defaults.InitCommands) > 0 {
-			return nil, fmt.Errorf("cannot specify both init_commands and init_commands_from for target default config")
+	if ej.Egress != nil {
+		if len(ej.Egress.Upstreams) == 0 && len(ej.Egress.Allow) == 0 && len(ej.Egress.Deny) == 0 {
+			return nil, fmt.Errorf("egress must name at least one upstream, allowed host or denied host")
 		}
-		fromFile := filepath.Join(baseDir, ej.Defaults.InitCommandsFrom)
-		content, err := os.ReadFile(fromFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed reading init_commands_from in target default config: %w", err)
+		e.Egress = &exp.EgressSpec{Upstreams: map[string][]string{}}
+		for name, hosts := range ej.Egress.Upstreams {
+			if !reTargetName.MatchString(name) || name == "other" {
+				return nil, fmt.Errorf("egress upstream name must start with a letter, contain only lowercase letters, numbers and hyphens and not be other: %q", name)
+			}
+			if len(hosts) == 0 {
+				return nil, fmt.Errorf("egress upstream %s must list at least one host", name)
+			}
+			for _, h := range hosts {
+				if !validEgressHost(h) {
+					return nil, fmt.Errorf("egress upstream %s has an invalid host %q, expected a host name with an optional leading *.", name, h)
+				}
+			}
+			e.Egress.Upstreams[name] = hosts
 		}
-		ej.Defaults.InitCommands = []string{string(content)}
+		for _, h := range ej.Egress.Allow {
+			if !validEgressHost(h) {
+				return nil, fmt.Errorf("egress allows an invalid host %q, expected a host name with an optional leading *.", h)
+			}
+		}
+		for _, h := range ej.Egress.Deny {
+			if !validEgressHost(h) {
+				return nil, fmt.Errorf("egress denies an invalid host %q, expected a host name with an optional leading *.", h)
+			}
+		}
+		e.Egress.Allow = ej.Egress.Allow
+		e.Egress.Deny = ej.Egress.Deny
+	}
+
+	if ej.Cluster != "" && ej.Cluster != exp.ClusterAuto && !reTargetName.MatchString(ej.Cluster) {
+		return nil, fmt.Errorf("cluster must be auto or a cluster name starting with a letter and containing only lowercase letters, numbers and hyphens: %q", ej.Cluster)
+	}
+	e.Cluster = ej.Cluster
+
+	switch ej.Transport {
+	case "", "sqs", "kinesis", "nats":
+		e.Transport = ej.Transport
+	default:
+		return nil, fmt.Errorf("unsupported transport: %q", ej.Transport)
+	}
+
+	if rj := ej.Replay; rj != nil {
+		if e.Transport != "nats" {
+			return nil, fmt.Errorf("replay: requires the nats transport")
+		}
+		e.Replay = &exp.ReplaySpec{StartSequence: rj.StartSequence}
+		if rj.StartTime != "" {
+			t, err := time.Parse(time.RFC3339, rj.StartTime)
+			if err != nil {
+				return nil, fmt.Errorf("replay: start_time must be in RFC 3339 format: %w", err)
+			}
+			e.Replay.StartTime = t
+		}
+		if (e.Replay.StartSequence == 0) == e.Replay.StartTime.IsZero() {
+			return nil, fmt.Errorf("replay: exactly one of start_sequence or start_time must be given")
+		}
+	}
+
+	switch ej.Priority {
+	case "":
+		e.Priority = api.PriorityNormal
+	case api.PriorityLow, api.PriorityNormal, api.PriorityUrgent:
+		e.Priority = ej.Priority
+	default:
+		return nil, fmt.Errorf("unsupported priority: %q", ej.Priority)
+	}
+	e.Preemptible = ej.Preemptible
+	e.Precision = ej.Precision
+
+	if ej.Zones != nil {
+		switch ej.Zones.Policy {
+		case exp.ZonePolicySame:
+		case exp.ZonePolicySpread:
+			if ej.Zones.Zone != "" {
+				return nil, fmt.Errorf("zones: zone may only be given with the %q policy", exp.ZonePolicySame)
+			}
+		default:
+			return nil, fmt.Errorf("zones: unsupported policy: %q", ej.Zones.Policy)
+		}
+		e.Zones = &exp.ZoneSpec{
+			Policy: ej.Zones.Policy,
+			Zone:   ej.Zones.Zone,
+		}
+	}
+
+	analysisNames := map[string]bool{}
+	for i, aj := range ej.Analyses {
+		if !reTargetName.MatchString(aj.Name) {
+			return nil, fmt.Errorf("analysis %d name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", i+1, aj.Name)
+		}
+		if analysisNames[aj.Name] {
+			return nil, fmt.Errorf("analysis name must be unique, %q has already been used", aj.Name)
+		}
+		analysisNames[aj.Name] = true
+		if aj.Image == "" {
+			return nil, fmt.Errorf("image must be supplied for analysis %s", aj.Name)
+		}
+		if aj.TimeoutMinutes < 0 {
+			return nil, fmt.Errorf("timeout must not be negative for analysis %s", aj.Name)
+		}
+		a := &exp.AnalysisSpec{
+			Name:        aj.Name,
+			Image:       aj.Image,
+			Environment: map[string]string{},
+			Timeout:     time.Duration(aj.TimeoutMinutes) * time.Minute,
+		}
+		for _, nv := range aj.Environment {
+			a.Environment[nv.Name] = nv.Value
+		}
+		e.Analyses = append(e.Analyses, a)
+	}
+
+	if err := resolveInitCommands(ej, baseDir); err != nil {
+		return nil, err
 	}
 
 	uniqueNames := map[string]bool{}
@@ -163,18 +551,6 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 			return nil, fmt.Errorf("name must be supplied for target %d", i+1)
 		}
 
-		if tj.InitCommandsFrom != "" {
-			if len(tj.InitCommands) > 0 {
-				return nil, fmt.Errorf("cannot specify both init_commands and init_commands_from for target %d", i+1)
-			}
-			fromFile := filepath.Join(baseDir, tj.InitCommandsFrom)
-			content, err := os.ReadFile(fromFile)
-			if err != nil {
-				return nil, fmt.Errorf("failed reading init_commands_from in target %d: %w", i+1, err)
-			}
-			tj.InitCommands = []string{string(content)}
-		}
-
 		if uniqueNames[t.Name] {
 			return nil, fmt.Errorf("target name must be unique, %q has already been used", t.Name)
 		}
@@ -184,14 +560,94 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 			return nil, fmt.Errorf("target name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", t.Name)
 		}
 
-		if tj.InstanceType != "" {
+		if len(tj.RequestHeaders) > 0 {
+			t.RequestHeaders = map[string]string{}
+			for _, nv := range tj.RequestHeaders {
+				if nv.Name == "" {
+					return nil, fmt.Errorf("request header name must not be empty for target %s", tj.Name)
+				}
+				if strings.ContainsAny(nv.Name, " :\r\n") || strings.ContainsAny(nv.Value, "\r\n") {
+					return nil, fmt.Errorf("invalid request header %q for target %s", nv.Name, tj.Name)
+				}
+				t.RequestHeaders[http.CanonicalHeaderKey(nv.Name)] = nv.Value
+			}
+		}
+
+		if tj.SubdomainGateway != "" {
+			if strings.ContainsAny(tj.SubdomainGateway, "/:* ") {
+				return nil, fmt.Errorf("subdomain_gateway must be a domain name for target %s", tj.Name)
+			}
+			t.SubdomainGateway = strings.ToLower(tj.SubdomainGateway)
+		}
+
+		t.MaxInFlight = tj.MaxInFlight
+		if t.MaxInFlight == 0 && ej.Defaults != nil {
+			t.MaxInFlight = ej.Defaults.MaxInFlight
+		}
+		if t.MaxInFlight < 0 {
+			return nil, fmt.Errorf("max_in_flight must be a positive number for target %s", tj.Name)
+		}
+		if t.MaxInFlight >= e.MaxConcurrency {
+			// the experiment's concurrency already limits the target
+			t.MaxInFlight = 0
+		}
+		t.Shadow = tj.Shadow
+
+		if tj.URL != "" {
+			if tj.InstanceType != "" || tj.EC2 != nil || len(tj.Environment) > 0 || tj.BaseImage != "" || tj.BuildFromGit != nil || len(tj.InitCommands) > 0 || tj.UseImage != "" || tj.DebugPort != 0 || tj.AdminPort != 0 {
+				return nil, fmt.Errorf("remote target %s must not specify instance_type, ec2, environment, use_image, base_image, build_from_git, init commands, debug_port or admin_port", tj.Name)
+			}
+			u, err := parseRemoteURL(tj.URL)
+			if err != nil {
+				return nil, fmt.Errorf("remote target %s: %w", tj.Name, err)
+			}
+			t.URL = u
+			e.Targets = append(e.Targets, t)
+			continue
+		}
+
+		if tj.EC2 != nil {
+			if tj.InstanceType != "" {
+				return nil, fmt.Errorf("must not specify both instance_type and ec2 for target %s", tj.Name)
+			}
+			t.EC2, err = parseEC2(tj.EC2)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: %w", tj.Name, err)
+			}
+		} else if tj.InstanceType != "" {
 			t.InstanceType = tj.InstanceType
+		} else if ej.Defaults != nil && ej.Defaults.EC2 != nil {
+			if ej.Defaults.InstanceType != "" {
+				return nil, fmt.Errorf("must not specify both instance_type and ec2 in target defaults")
+			}
+			t.EC2, err = parseEC2(ej.Defaults.EC2)
+			if err != nil {
+				return nil, fmt.Errorf("target defaults: %w", err)
+			}
 		} else if ej.Defaults != nil && ej.Defaults.InstanceType != "" {
 			t.InstanceType = ej.Defaults.InstanceType
 		} else {
 			return nil, fmt.Errorf("instance type must be supplied for target %d or a default specified", i+1)
 		}
 
+		if tj.DebugPort != 0 {
+			t.DebugPort = tj.DebugPort
+		} else if ej.Defaults != nil {
+			t.DebugPort = ej.Defaults.DebugPort
+		}
+		if t.DebugPort < 0 || t.DebugPort > 65535 || t.DebugPort == 8080 {
+			return nil, fmt.Errorf("debug_port must be a valid port other than the gateway port 8080 for target %s", tj.Name)
+		}
+
+		if tj.AdminPort != 0 {
+			t.AdminPort = tj.AdminPort
+		} else if ej.Defaults != nil {
+			t.AdminPort = ej.Defaults.AdminPort
+		}
+		if t.AdminPort < 0 || t.AdminPort > 65535 || t.AdminPort == 8080 {
+			return nil, fmt.Errorf("admin_port must be a valid port other than the gateway port 8080 for target %s", tj.Name)
+		}
+
 		// combine environment variables
 		if ej.Shared != nil {
 			for _, nv := range ej.Shared.Environment {
@@ -283,9 +739,430 @@ func ParseExperiment(ctx context.Context, r io.Reader, baseDir string) (*exp.Exp
 		e.Targets = append(e.Targets, t)
 	}
 
+	if ej.Search != nil {
+		sj := ej.Search
+		if sj.StartRate < 0 || sj.StepSeconds < 0 || sj.MaxP99Millis < 0 || sj.Precision < 0 {
+			return nil, fmt.Errorf("search: values must not be negative")
+		}
+		if sj.MaxErrorRatio < 0 || sj.MaxErrorRatio > 1 {
+			return nil, fmt.Errorf("search: max_error_ratio must be between 0 and 1")
+		}
+		if sj.StartRate > float64(e.MaxRequestRate) {
+			return nil, fmt.Errorf("search: start_rate must not exceed max_request_rate, the highest rate tried")
+		}
+		e.Search = &exp.SearchSpec{
+			StartRate:     sj.StartRate,
+			Step:          time.Duration(sj.StepSeconds) * time.Second,
+			MaxP99:        time.Duration(sj.MaxP99Millis) * time.Millisecond,
+			MaxErrorRatio: sj.MaxErrorRatio,
+			Precision:     sj.Precision,
+		}
+	}
+
+	if ej.Spikes != nil {
+		sj := ej.Spikes
+		if e.Search != nil {
+			return nil, fmt.Errorf("spikes: cannot be combined with search, which varies the request rate")
+		}
+		if sj.Multiplier <= 1 {
+			return nil, fmt.Errorf("spikes: multiplier must be greater than 1")
+		}
+		if sj.DurationSeconds < 0 || sj.IntervalMinutes < 0 || sj.RecoveryTolerance < 0 {
+			return nil, fmt.Errorf("spikes: values must not be negative")
+		}
+		e.Spikes = &exp.SpikeSpec{
+			Multiplier: sj.Multiplier,
+			Duration:   time.Duration(sj.DurationSeconds) * time.Second,
+			Interval:   time.Duration(sj.IntervalMinutes) * time.Minute,
+			Tolerance:  sj.RecoveryTolerance,
+		}
+	}
+
+	if ej.Soak != nil {
+		if e.Search != nil {
+			return nil, fmt.Errorf("soak: cannot be combined with search, which varies the request rate")
+		}
+		if ej.Soak.IntervalMinutes < 0 {
+			return nil, fmt.Errorf("soak: interval_minutes must not be negative")
+		}
+		e.Soak = &exp.SoakSpec{Interval: DefaultSoakInterval}
+		if ej.Soak.IntervalMinutes > 0 {
+			e.Soak.Interval = time.Duration(ej.Soak.IntervalMinutes) * time.Minute
+		}
+	}
+
+	compared := 0
+	for _, t := range e.Targets {
+		if !t.Shadow {
+			compared++
+		}
+	}
+	if compared == 0 && len(e.Targets) > 0 {
+		return nil, fmt.Errorf("every target is a shadow, at least one must be compared")
+	}
+
+	segmentNames := map[string]bool{}
+	for i, sj := range ej.Segments {
+		if !reTargetName.MatchString(sj.Name) {
+			return nil, fmt.Errorf("segment name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", sj.Name)
+		}
+		if segmentNames[sj.Name] {
+			return nil, fmt.Errorf("segment %s: name is not unique", sj.Name)
+		}
+		segmentNames[sj.Name] = true
+		if sj.DurationMinutes < 0 || sj.SettleSeconds < 0 {
+			return nil, fmt.Errorf("segment %s: values must not be negative", sj.Name)
+		}
+		if sj.DurationMinutes == 0 && i != len(ej.Segments)-1 {
+			return nil, fmt.Errorf("segment %s: duration_minutes may only be omitted for the last segment", sj.Name)
+		}
+		seg := &exp.SegmentSpec{
+			Name:     sj.Name,
+			Duration: time.Duration(sj.DurationMinutes) * time.Minute,
+			Settle:   time.Duration(sj.SettleSeconds) * time.Second,
+		}
+		if seg.Duration > 0 && seg.Settle >= seg.Duration {
+			return nil, fmt.Errorf("segment %s: settle_seconds must be shorter than the segment", sj.Name)
+		}
+		for _, cj := range sj.AdminCalls {
+			call, err := parseAdminCall(cj, e.Targets)
+			if err != nil {
+				return nil, fmt.Errorf("segment %s: admin call: %w", sj.Name, err)
+			}
+			seg.AdminCalls = append(seg.AdminCalls, call)
+		}
+		e.Segments = append(e.Segments, seg)
+	}
+	if len(e.Segments) == 1 {
+		return nil, fmt.Errorf("segments: at least two segments are needed to compare")
+	}
+	if len(e.Segments) > 0 && e.Search != nil {
+		return nil, fmt.Errorf("segments: cannot be combined with search, which varies the request rate")
+	}
+
+	if sj := ej.Shutdown; sj != nil {
+		if sj.DrainSeconds < 0 || sj.FinalScrapeSeconds < 0 {
+			return nil, fmt.Errorf("shutdown: values must not be negative")
+		}
+		e.Shutdown = &exp.ShutdownSpec{
+			DrainTimeout:       DefaultDrainTimeout,
+			FinalScrapeTimeout: DefaultFinalScrapeTimeout,
+		}
+		if sj.DrainSeconds > 0 {
+			e.Shutdown.DrainTimeout = time.Duration(sj.DrainSeconds) * time.Second
+		}
+		if sj.FinalScrapeSeconds > 0 {
+			e.Shutdown.FinalScrapeTimeout = time.Duration(sj.FinalScrapeSeconds) * time.Second
+		}
+		// dealgood is killed if it has not exited within the container's stop timeout
+		if e.Shutdown.DrainTimeout+e.Shutdown.FinalScrapeTimeout > MaxStopTimeout-10*time.Second {
+			return nil, fmt.Errorf("shutdown: drain_seconds and final_scrape_seconds must add up to at most %d", int((MaxStopTimeout - 10*time.Second).Seconds()))
+		}
+		for stage, secs := range sj.StageTimeoutSeconds {
+			switch stage {
+			case exp.ShutdownStageSource, exp.ShutdownStageDealgood, exp.ShutdownStageTargets:
+			default:
+				return nil, fmt.Errorf("shutdown: unsupported stage %q, expected source, dealgood or targets", stage)
+			}
+			if secs <= 0 {
+				return nil, fmt.Errorf("shutdown: timeout of stage %s must be positive", stage)
+			}
+			if e.Shutdown.StageTimeouts == nil {
+				e.Shutdown.StageTimeouts = map[string]time.Duration{}
+			}
+			e.Shutdown.StageTimeouts[stage] = time.Duration(secs) * time.Second
+		}
+		if t, ok := e.Shutdown.StageTimeouts[exp.ShutdownStageDealgood]; ok && t < e.Shutdown.DrainTimeout+e.Shutdown.FinalScrapeTimeout {
+			return nil, fmt.Errorf("shutdown: timeout of the dealgood stage must be at least drain_seconds plus final_scrape_seconds")
+		}
+	}
+
+	names := map[string]bool{}
+	for _, t := range e.Targets {
+		names[t.Name] = true
+	}
+	for _, pj := range ej.Providers {
+		if !reTargetName.MatchString(pj.Name) {
+			return nil, fmt.Errorf("provider name must start with a letter and contain only lowercase letters, numbers and hyphens: %q", pj.Name)
+		}
+		// providers' tasks are named like targets' with a provider- prefix
+		if names["provider-"+pj.Name] || names[pj.Name] {
+			return nil, fmt.Errorf("provider %s: name clashes with a target or another provider", pj.Name)
+		}
+		names[pj.Name] = true
+		p := &exp.ProviderSpec{
+			Name:         pj.Name,
+			Kind:         pj.Kind,
+			ContentCount: pj.ContentCount,
+			ContentSize:  pj.ContentSizeKiB * 1024,
+		}
+		switch p.Kind {
+		case "":
+			p.Kind = exp.ProviderKindKubo
+		case exp.ProviderKindKubo, exp.ProviderKindBitswap:
+		default:
+			return nil, fmt.Errorf("provider %s: unsupported kind: %q", pj.Name, pj.Kind)
+		}
+		if pj.ContentCount < 0 || pj.ContentSizeKiB < 0 {
+			return nil, fmt.Errorf("provider %s: values must not be negative", pj.Name)
+		}
+		if p.ContentCount == 0 {
+			p.ContentCount = DefaultProviderContentCount
+		}
+		e.Providers = append(e.Providers, p)
+	}
+	// experiments with providers request their content unless given another workload
+	wj := ej.Workload
+	if len(e.Providers) > 0 && wj == nil {
+		wj = &WorkloadJSON{Preset: exp.WorkloadPresetCorpus}
+	}
+
+	if wj != nil {
+		switch wj.Preset {
+		case exp.WorkloadPresetCold:
+			if len(e.Providers) > 0 {
+				return nil, fmt.Errorf("workload: the cold preset cannot be combined with providers")
+			}
+		case exp.WorkloadPresetCorpus:
+			if len(e.Providers) == 0 {
+				return nil, fmt.Errorf("workload: the corpus preset requires at least one provider")
+			}
+			if wj.ContentSizeKiB != 0 {
+				return nil, fmt.Errorf("workload: content_size_kib is set for each provider with the corpus preset")
+			}
+		default:
+			return nil, fmt.Errorf("workload: unsupported preset: %q", wj.Preset)
+		}
+		if e.Transport != "" {
+			return nil, fmt.Errorf("workload: cannot be combined with a transport, requests are generated rather than delivered")
+		}
+		if wj.ContentSizeKiB < 0 {
+			return nil, fmt.Errorf("workload: content_size_kib must not be negative")
+		}
+		e.Workload = &exp.WorkloadSpec{
+			Preset:      wj.Preset,
+			ContentSize: wj.ContentSizeKiB * 1024,
+		}
+	}
+
+	if ej.Hermetic {
+		if len(e.Providers) == 0 {
+			return nil, fmt.Errorf("hermetic: requires at least one provider for targets to retrieve content from")
+		}
+		for _, t := range e.Targets {
+			if t.IsRemote() {
+				return nil, fmt.Errorf("hermetic: remote target %s cannot be isolated from the public network", t.Name)
+			}
+		}
+		if e.Egress != nil && len(e.Egress.Allow) > 0 {
+			return nil, fmt.Errorf("hermetic: egress allow cannot be used, targets may only connect to the providers")
+		}
+		e.Hermetic = true
+	}
+
+	if ej.Private {
+		for _, t := range e.Targets {
+			if t.IsRemote() {
+				return nil, fmt.Errorf("private_networking: remote target %s cannot be reached without a public network", t.Name)
+			}
+			if t.EC2 == nil {
+				return nil, fmt.Errorf("private_networking: target %s must run on an instance of its own with ec2, the capacity providers' instances have public IP addresses", t.Name)
+			}
+		}
+		e.PrivateNetworking = true
+	}
+
+	if ej.KmsKeyArn != "" {
+		if err := validateKmsKeyArn(ej.KmsKeyArn); err != nil {
+			return nil, fmt.Errorf("kms_key_arn: %w", err)
+		}
+		e.KmsKeyArn = ej.KmsKeyArn
+	}
+
+	if ej.Conformance != nil {
+		cj := ej.Conformance
+		c := &exp.ConformanceSpec{
+			Phases:  cj.Phases,
+			Image:   cj.Image,
+			Specs:   cj.Specs,
+			Timeout: time.Duration(cj.TimeoutMinutes) * time.Minute,
+		}
+		if len(c.Phases) == 0 {
+			c.Phases = []string{exp.ConformancePhasePost}
+		}
+		phases := map[string]bool{}
+		for _, ph := range c.Phases {
+			if ph != exp.ConformancePhasePre && ph != exp.ConformancePhasePost {
+				return nil, fmt.Errorf("conformance: unsupported phase: %q", ph)
+			}
+			if phases[ph] {
+				return nil, fmt.Errorf("conformance: phase %q is listed more than once", ph)
+			}
+			phases[ph] = true
+		}
+		if c.Image == "" {
+			c.Image = DefaultConformanceImage
+		}
+		for _, sp := range c.Specs {
+			if sp == "" || strings.ContainsAny(sp, ", ") {
+				return nil, fmt.Errorf("conformance: invalid spec name: %q", sp)
+			}
+		}
+		if cj.TimeoutMinutes < 0 || cj.TimeoutMinutes > 60 {
+			return nil, fmt.Errorf("conformance: timeout_minutes must be between 0 and 60")
+		}
+		e.Conformance = c
+	}
+
+	if e.Zones != nil && e.Zones.Policy == exp.ZonePolicySpread {
+		for _, t := range e.Targets {
+			// a cluster placement group is confined to a single availability zone
+			if t.EC2 != nil && t.EC2.PlacementGroup == exp.PlacementCluster {
+				return nil, fmt.Errorf("target %s: a cluster placement group cannot be used when targets are spread across availability zones", t.Name)
+			}
+		}
+	}
+
 	return e, nil
 }
 
+// parseRemoteURL checks that the url is suitable as the base url of a remote target and
+// returns it in canonical form.
+func parseRemoteURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("url scheme must be http or https")
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("url must include a host")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return "", fmt.Errorf("url must not include a path")
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("url must not include a query, fragment or user info")
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// reEC2InstanceType matches the form of ec2 instance type names, such as c6in.8xlarge
+var reEC2InstanceType = regexp.MustCompile(`^[a-z][a-z0-9-]*\.[a-z0-9]+$`)
+
+// parseEC2 checks the settings of an ec2 instance launched for a target. Whether the instance
+// type exists and supports the settings is checked against the ec2 api before deploying.
+func parseEC2(ej *EC2JSON) (*exp.EC2Spec, error) {
+	if !reEC2InstanceType.MatchString(ej.InstanceType) {
+		return nil, fmt.Errorf("ec2 instance_type must be an ec2 instance type such as c6in.8xlarge")
+	}
+	switch ej.PlacementGroup {
+	case "", exp.PlacementCluster, exp.PlacementSpread, exp.PlacementPartition:
+	default:
+		return nil, fmt.Errorf("ec2 placement_group must be one of %q, %q or %q", exp.PlacementCluster, exp.PlacementSpread, exp.PlacementPartition)
+	}
+	if ej.Tenancy != "" && ej.Tenancy != exp.TenancyDedicated {
+		return nil, fmt.Errorf("ec2 tenancy must be %q or left out for shared tenancy", exp.TenancyDedicated)
+	}
+	return &exp.EC2Spec{
+		InstanceType:    ej.InstanceType,
+		PlacementGroup:  ej.PlacementGroup,
+		Tenancy:         ej.Tenancy,
+		EnaExpress:      ej.EnaExpress,
+		InstanceStorage: ej.InstanceStorage,
+	}, nil
+}
+
+// parseAdminCall checks a request sent to the admin api of targets. Every target it is sent to
+// must have been given an admin port.
+func parseAdminCall(cj AdminCallJSON, targets []*exp.TargetSpec) (*exp.AdminCallSpec, error) {
+	call := &exp.AdminCallSpec{
+		Method:  strings.ToUpper(cj.Method),
+		Path:    cj.Path,
+		Targets: cj.Targets,
+	}
+	if call.Method == "" {
+		call.Method = http.MethodPost
+	}
+	switch call.Method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return nil, fmt.Errorf("unsupported method %q", cj.Method)
+	}
+	if !strings.HasPrefix(call.Path, "/") {
+		return nil, fmt.Errorf("path must start with /: %q", cj.Path)
+	}
+	if _, err := url.ParseRequestURI(call.Path); err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", cj.Path, err)
+	}
+	if len(cj.Body) > 0 {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, cj.Body); err != nil {
+			return nil, fmt.Errorf("body must be json: %w", err)
+		}
+		call.Body = compact.String()
+	}
+
+	ports := make(map[string]int, len(targets))
+	for _, t := range targets {
+		ports[t.Name] = t.AdminPort
+	}
+	for _, name := range call.Targets {
+		port, ok := ports[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown target %q", name)
+		}
+		if port == 0 {
+			return nil, fmt.Errorf("target %s has no admin_port", name)
+		}
+	}
+	if len(call.Targets) == 0 {
+		called := false
+		for _, port := range ports {
+			called = called || port != 0
+		}
+		if !called {
+			return nil, fmt.Errorf("no target has an admin_port")
+		}
+	}
+	return call, nil
+}
+
+// RemoteTargets returns the targets of the experiment that are not deployed by thunderdome.
+func RemoteTargets(e *exp.Experiment) []*exp.TargetSpec {
+	var remote []*exp.TargetSpec
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			remote = append(remote, t)
+		}
+	}
+	return remote
+}
+
+// checkRemoteTargets verifies that the experiment may be sent to any remote targets it defines.
+// Remote targets are usually outside of our infrastructure so the operator must confirm that
+// they want to send traffic to them and the request rate must not exceed a safe limit.
+func checkRemoteTargets(e *exp.Experiment, allow bool, maxRate int) error {
+	remote := RemoteTargets(e)
+	if len(remote) == 0 {
+		return nil
+	}
+
+	urls := make([]string, len(remote))
+	for i, t := range remote {
+		urls[i] = t.URL
+	}
+
+	if !allow {
+		return fmt.Errorf("experiment sends requests to remote targets (%s), use --allow-remote-targets to confirm", strings.Join(urls, ", "))
+	}
+	if e.MaxRequestRate > maxRate {
+		return fmt.Errorf("max request rate %d exceeds the limit of %d for experiments with remote targets, use --remote-max-request-rate to raise the limit", e.MaxRequestRate, maxRate)
+	}
+	return nil
+}
+
 // nonEmptyCount returns the number the passed strings that are not empty
 func nonEmptyCount(strs ...string) int {
 	nonEmpty := 0
@@ -296,3 +1173,30 @@ func nonEmptyCount(strs ...string) int {
 	}
 	return nonEmpty
 }
+
+// validateKmsKeyArn checks that v is the arn of a kms key or alias. Bare key ids are not
+// accepted since the key is passed to ironbar, which may run with a different region.
+func validateKmsKeyArn(v string) error {
+	a, err := arn.Parse(v)
+	if err != nil {
+		return fmt.Errorf("must be the arn of a kms key or alias: %w", err)
+	}
+	if a.Service != "kms" || !(strings.HasPrefix(a.Resource, "key/") || strings.HasPrefix(a.Resource, "alias/")) {
+		return fmt.Errorf("must be the arn of a kms key or alias: %q", v)
+	}
+	return nil
+}
+
+// checkSegmentsDuration fails if the segments of an experiment do not fit within the duration
+// it is deployed for. Segments start with the measured period, once every target is running,
+// so the last segment may still be cut short by the time taken to start the experiment.
+func checkSegmentsDuration(e *exp.Experiment) error {
+	var total time.Duration
+	for _, seg := range e.Segments {
+		total += seg.Duration
+	}
+	if total > e.Duration {
+		return fmt.Errorf("segments last %d minutes, longer than the experiment's duration of %d minutes", int(total.Minutes()), int(e.Duration.Minutes()))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var IamPolicyCommand = &cli.Command{
+	Name:  "iam-policy",
+	Usage: "Print or apply least privilege IAM policies for the roles of thunderdome's components",
+	Description: "Generates a policy for each component allowing exactly the AWS API calls its code makes, scoped to the account, " +
+		"clusters, topic, table and log group of the base infrastructure, which are read from infra.json and may be overridden. " +
+		"Resources created for experiments are matched by the suffix thunderdome names them with or by their experiment tag. " +
+		"With a single component the policy document is printed on its own, so it can be passed to aws iam put-role-policy; " +
+		"otherwise the policies are printed keyed by component.\n\n" +
+		"Components are ironbar, dealgood, skyfish and deployer, the users or roles running thunderdome. " +
+		"--apply puts each policy inline on the role named after its component, or the deployers group, as " + infra.PolicyName + ".\n\n" +
+		examples(
+			"thunderdome iam-policy",
+			"thunderdome iam-policy --component ironbar --archive-bucket thunderdome-archive > ironbar-policy.json",
+			"thunderdome iam-policy --component dealgood --component skyfish --apply",
+		),
+	Action: IamPolicy,
+	Flags: flags([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "component",
+			Aliases:     []string{"c"},
+			Usage:       "Component to generate a policy for, may be repeated. Defaults to all of: " + strings.Join(infra.PolicyComponents, ", ") + ".",
+			Destination: &iamPolicyOpts.components,
+		},
+		&cli.StringFlag{
+			Name:        "account",
+			Usage:       "AWS account id the resources belong to. Defaults to that of the caller.",
+			Destination: &iamPolicyOpts.account,
+		},
+		&cli.StringSliceFlag{
+			Name:        "cluster-arn",
+			Usage:       "ARN of an ecs cluster experiments are deployed to, may be repeated. Defaults to the clusters in infra.json.",
+			Destination: &iamPolicyOpts.clusterArns,
+		},
+		&cli.StringFlag{
+			Name:        "topic-arn",
+			Usage:       "ARN of the sns topic skyfish publishes requests to. Defaults to the topic in infra.json.",
+			Destination: &iamPolicyOpts.topicArn,
+		},
+		&cli.StringFlag{
+			Name:        "stream-name",
+			Usage:       "Name of the kinesis stream carrying requests, if any. Defaults to the stream in infra.json.",
+			Destination: &iamPolicyOpts.streamName,
+		},
+		&cli.StringFlag{
+			Name:        "experiments-table",
+			Usage:       "Name of ironbar's dynamodb table. Defaults to the table in infra.json.",
+			Destination: &iamPolicyOpts.experimentsTable,
+		},
+		&cli.StringFlag{
+			Name:        "log-group",
+			Usage:       "Name of the log group experiments log to. Defaults to the log group in infra.json.",
+			Destination: &iamPolicyOpts.logGroup,
+		},
+		&cli.StringFlag{
+			Name:        "archive-bucket",
+			Usage:       "Bucket ironbar archives records to, as given by its --archive-bucket.",
+			Destination: &iamPolicyOpts.archiveBucket,
+		},
+		&cli.StringFlag{
+			Name:        "dumps-bucket",
+			Usage:       "Bucket ironbar writes crash dumps to, as given by its --dumps-bucket.",
+			Destination: &iamPolicyOpts.dumpsBucket,
+		},
+		&cli.StringSliceFlag{
+			Name:        "kms-key-arn",
+			Usage:       "ARN of a customer managed key experiments' resources are encrypted with, may be repeated to include keys set by experiments. Defaults to the key in infra.json.",
+			Destination: &iamPolicyOpts.kmsKeyArns,
+		},
+		&cli.BoolFlag{
+			Name:        "apply",
+			Usage:       "Put each policy on its component's role instead of printing it.",
+			Destination: &iamPolicyOpts.apply,
+		},
+		&cli.StringFlag{
+			Name:        "deployers-group",
+			Value:       "deployers",
+			Usage:       "IAM group of the deploying users that --apply puts the deployer policy on.",
+			Destination: &iamPolicyOpts.deployersGroup,
+		},
+	}),
+}
+
+var iamPolicyOpts struct {
+	components       cli.StringSlice
+	account          string
+	clusterArns      cli.StringSlice
+	topicArn         string
+	streamName       string
+	experimentsTable string
+	logGroup         string
+	archiveBucket    string
+	dumpsBucket      string
+	kmsKeyArns       cli.StringSlice
+	apply            bool
+	deployersGroup   string
+}
+
+func IamPolicy(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	components := iamPolicyOpts.components.Value()
+	if len(components) == 0 {
+		components = infra.PolicyComponents
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+	params, err := prov.PolicyParams(ctx)
+	if err != nil {
+		return err
+	}
+	override := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	override(&params.Account, iamPolicyOpts.account)
+	override(&params.TopicArn, iamPolicyOpts.topicArn)
+	override(&params.StreamName, iamPolicyOpts.streamName)
+	override(&params.ExperimentsTable, iamPolicyOpts.experimentsTable)
+	override(&params.LogGroup, iamPolicyOpts.logGroup)
+	override(&params.ArchiveBucket, iamPolicyOpts.archiveBucket)
+	override(&params.DumpsBucket, iamPolicyOpts.dumpsBucket)
+	if arns := iamPolicyOpts.clusterArns.Value(); len(arns) > 0 {
+		params.ClusterArns = arns
+	}
+	if arns := iamPolicyOpts.kmsKeyArns.Value(); len(arns) > 0 {
+		params.KmsKeyArns = arns
+	}
+
+	policies := make(map[string]*infra.PolicyDocument, len(components))
+	for _, c := range components {
+		doc, err := params.Policy(c)
+		if err != nil {
+			return err
+		}
+		policies[c] = doc
+	}
+
+	if iamPolicyOpts.apply {
+		for _, c := range components {
+			name := c
+			if c == infra.PolicyComponentDeployer {
+				name = iamPolicyOpts.deployersGroup
+			}
+			if err := prov.ApplyPolicy(ctx, c, name, policies[c]); err != nil {
+				return fmt.Errorf("apply %s policy: %w", c, err)
+			}
+			fmt.Printf("Put policy %s on %s\n", infra.PolicyName, name)
+		}
+		return nil
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if len(components) == 1 {
+		return enc.Encode(policies[components[0]])
+	}
+	return enc.Encode(policies)
+}
@@ -16,6 +16,10 @@ var ImageCommand = &cli.Command{
 	Name:   "image",
 	Usage:  "Build a docker image for an experiment",
 	Action: Image,
+	Description: examples(
+		"thunderdome image --from-repo https://github.com/ipfs/kubo --git-tag v0.20.0 --tag kubo-v0.20.0",
+		"thunderdome image --from-image ipfs/kubo:v0.20.0 --tag kubo-v0.20.0 --env-config Routing.Type=dht",
+	),
 	Flags: flags([]cli.Flag{
 		&cli.StringFlag{
 			Name:        "from-repo",
@@ -53,6 +57,7 @@ var ImageCommand = &cli.Command{
 			Name:        "push-to",
 			Usage:       "Push built image to this docker repo.",
 			Destination: &imageOpts.dockerRepo,
+			EnvVars:     []string{envPrefix + "ECR_REPO"},
 		},
 		&cli.StringFlag{
 			Name:        "base-config",
@@ -81,6 +86,12 @@ var ImageCommand = &cli.Command{
 			Destination: &imageOpts.maintainer,
 			Value:       "ian.davis@protocol.ai",
 		},
+		&cli.StringFlag{
+			Name:        "platform",
+			Usage:       "Platform to build the image for. Targets run on x86 instances, so this only needs changing for images run elsewhere.",
+			Destination: &imageOpts.platform,
+			Value:       build.DefaultPlatform,
+		},
 		// TODO: support  ARG IPFS_PLUGINS
 	}),
 }
@@ -98,6 +109,7 @@ var imageOpts struct {
 	description     string
 	maintainer      string
 	baseConfig      string
+	platform        string
 }
 
 func Image(cc *cli.Context) error {
@@ -153,7 +165,7 @@ func Image(cc *cli.Context) error {
 	spec.InitCommands = append(spec.InitCommands, envConfigMappings...)
 	spec.InitCommands = append(spec.InitCommands, envConfigMappingsQuoted...)
 
-	finalImage, err := build.Build(ctx, imageOpts.tag, spec)
+	finalImage, err := build.Build(ctx, imageOpts.tag, imageOpts.platform, spec)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,111 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// analysisContainerName is the name of the container in an analysis task.
+const analysisContainerName = "analysis"
+
+// AnalysisResources returns the ironbar resources describing how to run each of an experiment's
+// analyses, run in the given subnet. Nothing is created in AWS until ironbar runs the analyses
+// once the experiment has completed.
+func AnalysisResources(experiment string, base *BaseInfra, subnet string, specs []*exp.AnalysisSpec, metadata map[string]string) ([]api.Resource, error) {
+	var res []api.Resource
+	for _, spec := range specs {
+		tags := withMetadata(map[string]*string{
+			"experiment": aws.String(experiment),
+			"component":  aws.String("analysis " + spec.Name),
+		}, metadata)
+
+		env := map[string]string{
+			"THUNDERDOME_EXPERIMENT": experiment,
+			"THUNDERDOME_ANALYSIS":   spec.Name,
+		}
+
+		tdIn := &ecs.RegisterTaskDefinitionInput{
+			Family:                  aws.String(experiment + "-analysis-" + spec.Name),
+			RequiresCompatibilities: []*string{aws.String("FARGATE")},
+			NetworkMode:             aws.String("awsvpc"),
+			ExecutionRoleArn:        aws.String(base.EcsExecutionRoleArn),
+			TaskRoleArn:             aws.String(base.DealgoodTaskRoleArn),
+			Cpu:                     aws.String("1024"),
+			Memory:                  aws.String("4096"),
+			Tags:                    ecsTags(tags),
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{
+					Name:        aws.String(analysisContainerName),
+					Image:       aws.String(spec.Image),
+					Essential:   aws.Bool(true),
+					Environment: mapsToKeyValuePair(spec.Environment, env),
+					LogConfiguration: &ecs.LogConfiguration{
+						LogDriver: aws.String("awslogs"),
+						Options: map[string]*string{
+							"awslogs-group":         aws.String(base.LogGroupName),
+							"awslogs-region":        aws.String(base.AwsRegion),
+							"awslogs-stream-prefix": aws.String(experiment + "-analysis"),
+						},
+					},
+					Secrets: []*ecs.Secret{
+						{
+							Name:      aws.String("PROMETHEUS_USER"),
+							ValueFrom: aws.String(base.PrometheusSecretArn + ":username::"),
+						},
+						{
+							Name:      aws.String("PROMETHEUS_PASS"),
+							ValueFrom: aws.String(base.PrometheusSecretArn + ":password::"),
+						},
+					},
+				},
+			},
+		}
+
+		runIn := &ecs.RunTaskInput{
+			LaunchType: aws.String("FARGATE"),
+			NetworkConfiguration: &ecs.NetworkConfiguration{
+				AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+					AssignPublicIp: base.assignPublicIp(subnet),
+					SecurityGroups: []*string{
+						aws.String(base.DealgoodSecurityGroup),
+					},
+					Subnets: []*string{
+						aws.String(subnet),
+					},
+				},
+			},
+			Cluster: aws.String(base.EcsClusterArn),
+			Count:   aws.Int64(1),
+			Tags:    ecsTags(tags),
+		}
+
+		tdJSON, err := json.Marshal(tdIn)
+		if err != nil {
+			return nil, fmt.Errorf("encode task definition input for analysis %s: %w", spec.Name, err)
+		}
+		runJSON, err := json.Marshal(runIn)
+		if err != nil {
+			return nil, fmt.Errorf("encode run task input for analysis %s: %w", spec.Name, err)
+		}
+
+		r := api.Resource{
+			Type: api.ResourceTypeAnalysis,
+			Keys: map[string]string{
+				api.ResourceKeyComponent:           spec.Name,
+				api.ResourceKeyTaskDefinitionInput: string(tdJSON),
+				api.ResourceKeyRunTaskInput:        string(runJSON),
+			},
+		}
+		if spec.Timeout > 0 {
+			r.Keys[api.ResourceKeyTimeout] = spec.Timeout.String()
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
@@ -2,14 +2,20 @@ package infra
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 )
 
 func mapsToKeyValuePair(ms ...map[string]string) []*ecs.KeyValuePair {
@@ -27,6 +33,14 @@ func mapsToKeyValuePair(ms ...map[string]string) []*ecs.KeyValuePair {
 	return pairs
 }
 
+// withMetadata adds an experiment's metadata to a set of resource tags.
+func withMetadata(tags map[string]*string, metadata map[string]string) map[string]*string {
+	for k, v := range metadata {
+		tags[k] = aws.String(v)
+	}
+	return tags
+}
+
 func ecsTags(m map[string]*string) []*ecs.Tag {
 	tags := make([]*ecs.Tag, 0, len(m))
 	for k, v := range m {
@@ -38,6 +52,36 @@ func ecsTags(m map[string]*string) []*ecs.Tag {
 	return tags
 }
 
+func ec2Tags(m map[string]*string) []*ec2.Tag {
+	tags := make([]*ec2.Tag, 0, len(m))
+	for k, v := range m {
+		tags = append(tags, &ec2.Tag{
+			Key:   aws.String(k),
+			Value: v,
+		})
+	}
+	return tags
+}
+
+// ecsTaskResource returns the ironbar resource for a running task, including the input used
+// to run it so that ironbar can retry the task if it fails.
+func ecsTaskResource(clusterArn, taskArn, component string, in *ecs.RunTaskInput) api.Resource {
+	res := api.Resource{
+		Type: api.ResourceTypeEcsTask,
+		Keys: map[string]string{
+			api.ResourceKeyEcsClusterArn: clusterArn,
+			api.ResourceKeyArn:           taskArn,
+			api.ResourceKeyComponent:     component,
+		},
+	}
+	if content, err := json.Marshal(in); err != nil {
+		slog.Warn("failed to encode run task input, ironbar will not be able to retry the task", "component", component, "error", err)
+	} else {
+		res.Keys[api.ResourceKeyRunTaskInput] = string(content)
+	}
+	return res
+}
+
 func sqsIsQueueDoesNotExist(err error) bool {
 	if aerr, ok := err.(awserr.Error); ok {
 		return aerr.Code() == sqs.ErrCodeQueueDoesNotExist
@@ -108,6 +152,23 @@ func deleteSqsQueue(ctx context.Context, sess *session.Session, requestQueueURL
 	return nil
 }
 
+func deleteDynamoDBTable(ctx context.Context, sess *session.Session, tableName string) error {
+	svc := dynamodb.New(sess)
+
+	in := &dynamodb.DeleteTableInput{
+		TableName: aws.String(tableName),
+	}
+
+	_, err := svc.DeleteTable(in)
+	if err != nil {
+		if _, ok := err.(*dynamodb.ResourceNotFoundException); ok {
+			return nil
+		}
+		return fmt.Errorf("delete table: %w", err)
+	}
+	return nil
+}
+
 func dstr(v *string) string {
 	if v == nil {
 		return "<nil>"
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"sort"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,18 +21,47 @@ type BaseInfra struct {
 	DealgoodSecurityGroup         string
 	DealgoodTaskRoleArn           string
 	EcrBaseURL                    string
+	EgressImage                   string // image of the egress proxy sidecar that counts requests to shared upstreams
 	EcsClusterArn                 string
 	EcsExecutionRoleArn           string
 	EfsFileSystemID               string
 	ExperimentsTableName          string
 	PrometheusSecretArn           string
 	IronbarAddr                   string
+	KmsKeyArn                     string // customer managed key encrypting experiments' queues and tables, aws managed keys are used if empty
 	LogGroupName                  string
 	RequestSNSTopicArn            string
+	RequestKinesisStreamName      string // optional stream carrying the same requests as the sns topic
+	RequestNatsURL                string // optional url of a NATS server, which may include credentials, with a JetStream stream of requests
+	RequestNatsStream             string // JetStream stream skyfish publishes requests to on the NATS server
+	SeederSecurityGroup           string // security group of the content seeder task run for the cold workload
 	TargetGrafanaAgentConfigURL   string
+	TargetInstanceProfileArn      string   // instance profile of ec2 instances launched for a single target
+	TargetSecurityGroups          []string // security groups of ec2 instances launched for a single target
 	TargetTaskRoleArn             string
+	VpcId                         string
 	VpcPublicSubnet               string
-	CapacityProviders             map[string]CapacityProvider // currently staticly setup
+	VpcPublicSubnets              []string                    // public subnets of every availability zone, including VpcPublicSubnet
+	VpcPrivateSubnets             []string                    // subnets without a route to an internet gateway, used by experiments with private networking
+	VpcEndpointSecurityGroup      string                      // security group of the interface endpoints created for private networking
+	CapacityProviders             map[string]CapacityProvider // defined statically, infra.json may add providers for additional clusters
+	Clusters                      map[string]Cluster          // additional ecs clusters targets may be placed in, keyed by name
+
+	defaultProviders map[string]string // capacity providers of the default cluster
+}
+
+// DefaultCluster is the name of the cluster given by EcsClusterArn, which offers the statically
+// defined capacity providers and runs dealgood.
+const DefaultCluster = "default"
+
+// A Cluster is an ecs cluster that targets can be placed in. A capacity provider can only be
+// attached to one cluster, so each cluster maps the instance types used in experiment
+// definitions to the names of its own capacity providers.
+type Cluster struct {
+	Name              string
+	Arn               string
+	Description       string            // what distinguishes the cluster, such as its instance family or dedicated hosts
+	CapacityProviders map[string]string // name of the cluster's capacity provider for each instance type it offers
 }
 
 type CapacityProvider struct {
@@ -70,8 +101,13 @@ func NewBaseInfra(awsRegion string) (*BaseInfra, error) {
 		return nil, fmt.Errorf("decode json: %w", err)
 	}
 
-	// TODO: read from json
+	// allow a different ironbar, such as one run locally, to be used with the same base infra
+	if addr := os.Getenv("THUNDERDOME_IRONBAR_ADDR"); addr != "" {
+		base.IronbarAddr = addr
+	}
+
 	base.setupCapacityProviders()
+	base.setupClusters()
 
 	return base, nil
 }
@@ -148,7 +184,7 @@ type InstanceType struct {
 
 func (b *BaseInfra) setupCapacityProviders() {
 	// These are defined in terraform
-	b.CapacityProviders = map[string]CapacityProvider{
+	static := map[string]CapacityProvider{
 		"compute_large": {
 			Name: "compute_large",
 			InstanceType: InstanceType{
@@ -195,4 +231,71 @@ func (b *BaseInfra) setupCapacityProviders() {
 			},
 		},
 	}
+
+	// capacity providers read from infra.json are kept, they serve additional clusters
+	if b.CapacityProviders == nil {
+		b.CapacityProviders = make(map[string]CapacityProvider, len(static))
+	}
+	for name, cp := range static {
+		if _, ok := b.CapacityProviders[name]; !ok {
+			b.CapacityProviders[name] = cp
+		}
+	}
+	b.defaultProviders = make(map[string]string, len(static))
+	for name := range static {
+		b.defaultProviders[name] = name
+	}
+}
+
+// setupClusters adds the default cluster to the clusters read from infra.json.
+func (b *BaseInfra) setupClusters() {
+	if b.Clusters == nil {
+		b.Clusters = make(map[string]Cluster)
+	}
+	for name, c := range b.Clusters {
+		c.Name = name
+		b.Clusters[name] = c
+	}
+	b.Clusters[DefaultCluster] = Cluster{
+		Name:              DefaultCluster,
+		Arn:               b.EcsClusterArn,
+		CapacityProviders: b.defaultProviders,
+	}
+}
+
+// Cluster returns the cluster with the given name, the default cluster if name is empty.
+func (b *BaseInfra) Cluster(name string) (Cluster, error) {
+	if name == "" {
+		name = DefaultCluster
+	}
+	c, ok := b.Clusters[name]
+	if !ok {
+		return Cluster{}, fmt.Errorf("unknown cluster %q", name)
+	}
+	return c, nil
+}
+
+// ClustersOffering returns the names of the clusters that offer every one of the instance
+// types, default cluster first and the rest sorted.
+func (b *BaseInfra) ClustersOffering(instanceTypes []string) []string {
+	var names []string
+	for name, c := range b.Clusters {
+		offers := true
+		for _, it := range instanceTypes {
+			if _, ok := c.CapacityProviders[it]; !ok {
+				offers = false
+				break
+			}
+		}
+		if offers {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == DefaultCluster) != (names[j] == DefaultCluster) {
+			return names[i] == DefaultCluster
+		}
+		return names[i] < names[j]
+	})
+	return names
 }
@@ -0,0 +1,167 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// conformanceContainerName is the name of the container in a conformance task.
+const conformanceContainerName = "conformance"
+
+// conformanceFixturesPath is where the conformance fixtures are extracted to in a target's task.
+// The gateway's init scripts import the merged CAR file before the node starts.
+const conformanceFixturesPath = "/conformance-fixtures"
+
+// conformanceScript runs the conformance tests against the target and writes a summary of the
+// report as the last line of its output, which ironbar records. It exits successfully when
+// tests fail so that their failures are recorded rather than the task's.
+const conformanceScript = `gateway-conformance test --gateway-url "$THUNDERDOME_GATEWAY_URL" --json /tmp/report.json $THUNDERDOME_CONFORMANCE_ARGS >&2
+[ -s /tmp/report.json ] || { echo "no conformance report was written" >&2; exit 1; }
+count() { grep "\"Action\":\"$1\"" /tmp/report.json | grep -c '"Test":'; }
+failed=$(grep '"Action":"fail"' /tmp/report.json | sed -n 's/.*"Test":"\([^"\\]*\)".*/"\1"/p' | sort -u | head -n 100 | paste -sd, -)
+printf '{"passed":%d,"failed":%d,"skipped":%d,"failed_tests":[%s]}\n' "$(count pass)" "$(count fail)" "$(count skip)" "$failed"
+`
+
+// ConformanceResources returns the ironbar resources describing how to run the gateway
+// conformance tests against each target in each of the experiment's conformance phases.
+// gatewayURLs maps the name of each target to the url of its gateway and the tests run in
+// dealgood's subnet. Nothing is created in AWS until ironbar runs the tests.
+func ConformanceResources(e *exp.Experiment, base *BaseInfra, subnet string, gatewayURLs map[string]string, metadata map[string]string) ([]api.Resource, error) {
+	if e.Conformance == nil {
+		return nil, nil
+	}
+
+	var args []string
+	if len(e.Conformance.Specs) > 0 {
+		args = append(args, "--specs", strings.Join(e.Conformance.Specs, ","))
+	}
+
+	var res []api.Resource
+	for _, t := range e.Targets {
+		targetArgs := args
+		if t.SubdomainGateway != "" {
+			targetArgs = append(append([]string(nil), args...), "--subdomain-url", "http://"+t.SubdomainGateway)
+		}
+		env := map[string]string{
+			"THUNDERDOME_EXPERIMENT":       e.Name,
+			"THUNDERDOME_TARGET":           t.Name,
+			"THUNDERDOME_GATEWAY_URL":      gatewayURLs[t.Name],
+			"THUNDERDOME_CONFORMANCE_ARGS": strings.Join(targetArgs, " "),
+		}
+
+		for _, phase := range e.Conformance.Phases {
+			component := "conformance " + t.Name + " " + phase
+			tags := withMetadata(map[string]*string{
+				"experiment": aws.String(e.Name),
+				"component":  aws.String(component),
+			}, metadata)
+
+			tdIn := &ecs.RegisterTaskDefinitionInput{
+				Family:                  aws.String(e.Name + "-conformance-" + t.Name + "-" + phase),
+				RequiresCompatibilities: []*string{aws.String("FARGATE")},
+				NetworkMode:             aws.String("awsvpc"),
+				ExecutionRoleArn:        aws.String(base.EcsExecutionRoleArn),
+				TaskRoleArn:             aws.String(base.DealgoodTaskRoleArn),
+				Cpu:                     aws.String("1024"),
+				Memory:                  aws.String("2048"),
+				Tags:                    ecsTags(tags),
+				ContainerDefinitions: []*ecs.ContainerDefinition{
+					{
+						Name:        aws.String(conformanceContainerName),
+						Image:       aws.String(e.Conformance.Image),
+						Essential:   aws.Bool(true),
+						EntryPoint:  []*string{aws.String("/bin/sh"), aws.String("-c")},
+						Command:     []*string{aws.String(conformanceScript)},
+						Environment: mapsToKeyValuePair(env),
+						LogConfiguration: &ecs.LogConfiguration{
+							LogDriver: aws.String("awslogs"),
+							Options: map[string]*string{
+								"awslogs-group":         aws.String(base.LogGroupName),
+								"awslogs-region":        aws.String(base.AwsRegion),
+								"awslogs-stream-prefix": aws.String(e.Name + "-conformance"),
+							},
+						},
+					},
+				},
+			}
+
+			// run alongside dealgood, whose security group may reach the targets' gateways
+			runIn := &ecs.RunTaskInput{
+				LaunchType: aws.String("FARGATE"),
+				NetworkConfiguration: &ecs.NetworkConfiguration{
+					AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+						AssignPublicIp: base.assignPublicIp(subnet),
+						SecurityGroups: []*string{
+							aws.String(base.DealgoodSecurityGroup),
+						},
+						Subnets: []*string{
+							aws.String(subnet),
+						},
+					},
+				},
+				Cluster: aws.String(base.EcsClusterArn),
+				Count:   aws.Int64(1),
+				Tags:    ecsTags(tags),
+			}
+
+			tdJSON, err := json.Marshal(tdIn)
+			if err != nil {
+				return nil, fmt.Errorf("encode task definition input for %s: %w", component, err)
+			}
+			runJSON, err := json.Marshal(runIn)
+			if err != nil {
+				return nil, fmt.Errorf("encode run task input for %s: %w", component, err)
+			}
+
+			r := api.Resource{
+				Type: api.ResourceTypeConformance,
+				Keys: map[string]string{
+					api.ResourceKeyComponent:           component,
+					api.ResourceKeyPhase:               phase,
+					api.ResourceKeyTaskDefinitionInput: string(tdJSON),
+					api.ResourceKeyRunTaskInput:        string(runJSON),
+				},
+			}
+			if e.Conformance.Timeout > 0 {
+				r.Keys[api.ResourceKeyTimeout] = e.Conformance.Timeout.String()
+			}
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+// conformanceFixturesContainer defines the container that extracts the conformance fixtures
+// into a volume shared with the gateway, which waits for it to finish before starting.
+func (t *Target) conformanceFixturesContainer(logStreamPrefix string) *ecs.ContainerDefinition {
+	return &ecs.ContainerDefinition{
+		Name:       aws.String("conformance-fixtures"),
+		Image:      aws.String(t.conformanceImage),
+		Essential:  aws.Bool(false),
+		EntryPoint: []*string{aws.String("/bin/sh"), aws.String("-c")},
+		Command: []*string{
+			aws.String("gateway-conformance extract-fixtures --directory " + conformanceFixturesPath + " --merged=true"),
+		},
+		LogConfiguration: &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(t.base.LogGroupName),
+				"awslogs-region":        aws.String(t.base.AwsRegion),
+				"awslogs-stream-prefix": aws.String(logStreamPrefix),
+			},
+		},
+		MountPoints: []*ecs.MountPoint{
+			{
+				SourceVolume:  aws.String("conformance-fixtures"),
+				ContainerPath: aws.String(conformanceFixturesPath),
+			},
+		},
+	}
+}
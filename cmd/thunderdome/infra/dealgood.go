@@ -2,6 +2,7 @@ package infra
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -10,23 +11,41 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
+// dealgoodTaskCPU is the number of cpu units, 1024 to a vCPU, reserved for the dealgood task
+const dealgoodTaskCPU = 4096
+
+// dealgoodStopTimeout is how long ECS waits for dealgood to exit after sending it SIGTERM, which
+// covers its default drain and final scrape timeouts of 30 seconds each.
+const dealgoodStopTimeout = 70 * time.Second
+
+// maxStopTimeout is the longest stop timeout ECS allows for a container.
+const maxStopTimeout = 120 * time.Second
+
 type Dealgood struct {
 	experiment  string
 	base        *BaseInfra
 	image       string
 	environment map[string]string
+	metadata    map[string]string // owner and purpose of the experiment, added to the tags of every resource
 
 	taskDefinitionFamily string
 	taskName             string
 	requestQueueName     string
+	transport            string // how requests are delivered to dealgood, "sqs", "kinesis", "nats" or "seeder" for a generated workload
+	checkpointTableName  string
+	subnet               string        // subnet dealgood's task runs in, which determines its availability zone
+	kmsKeyArn            string        // customer managed key the request queue and checkpoint table are encrypted with
+	stopTimeout          time.Duration // time dealgood is given to drain requests and be scraped once stopped
 
 	// mu guards access to fields in block directly below
 	mu                     sync.Mutex
@@ -43,21 +62,22 @@ func NewDealgood(experiment string, base *BaseInfra) *Dealgood {
 	requestQueueName := experiment + "-dealgood-requests"
 
 	env := map[string]string{
-		"DEALGOOD_EXPERIMENT":         experiment,
-		"OTEL_TRACES_EXPORTER":        "otlp",
-		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4317",
-		"DEALGOOD_DURATION":           "-1",
-		"DEALGOOD_PROMETHEUS_ADDR":    ":9090",
-		"DEALGOOD_RATE":               "10",
-		"DEALGOOD_FILTER":             "pathonly",
-		"DEALGOOD_CONCURRENCY":        "100",
-		"DEALGOOD_LOKI_URI":           "https://logs-prod-us-central1.grafana.net",
-		"DEALGOOD_LOKI_QUERY":         "{job=\"nginx\",app=\"gateway\",team=\"bifrost\"}",
-		"DEALGOOD_SQS_REGION":         base.AwsRegion,
-		"DEALGOOD_SOURCE":             "sqs",
-		"DEALGOOD_SQS_QUEUE":          requestQueueName,
-		"DEALGOOD_PRE_PROBE_WAIT":     "0",
-		"DEALGOOD_READY_TIMEOUT":      "1200", // seconds
+		"DEALGOOD_EXPERIMENT":            experiment,
+		"OTEL_TRACES_EXPORTER":           "otlp",
+		"OTEL_EXPORTER_OTLP_ENDPOINT":    "http://localhost:4317",
+		"DEALGOOD_DURATION":              "-1",
+		"DEALGOOD_PROMETHEUS_ADDR":       ":9090",
+		"DEALGOOD_RATE":                  "10",
+		"DEALGOOD_FILTER":                "pathonly",
+		"DEALGOOD_CONCURRENCY":           "100",
+		"DEALGOOD_LOKI_URI":              "https://logs-prod-us-central1.grafana.net",
+		"DEALGOOD_LOKI_QUERY":            "{job=\"nginx\",app=\"gateway\",team=\"bifrost\"}",
+		"DEALGOOD_SQS_REGION":            base.AwsRegion,
+		"DEALGOOD_SOURCE":                "sqs",
+		"DEALGOOD_SQS_QUEUE":             requestQueueName,
+		"DEALGOOD_PRE_PROBE_WAIT":        "0",
+		"DEALGOOD_READY_TIMEOUT":         "1200", // seconds
+		"DEALGOOD_NETWORK_BASELINE_PORT": strconv.Itoa(networkBaselinePort),
 	}
 
 	return &Dealgood{
@@ -65,9 +85,13 @@ func NewDealgood(experiment string, base *BaseInfra) *Dealgood {
 		base:                 base,
 		image:                base.DealgoodImage,
 		environment:          env,
+		subnet:               base.VpcPublicSubnet,
 		taskDefinitionFamily: experiment + "-dealgood",
 		taskName:             experiment + "-dealgood",
 		requestQueueName:     requestQueueName,
+		transport:            "sqs",
+		checkpointTableName:  experiment + "-dealgood-checkpoints",
+		stopTimeout:          dealgoodStopTimeout,
 	}
 }
 
@@ -76,6 +100,50 @@ func (d *Dealgood) WithMaxRequestRate(v int) *Dealgood {
 	return d
 }
 
+// WithSearch has dealgood search for the highest request rate each target can sustain within
+// an SLO. Settings left at zero use dealgood's defaults.
+func (d *Dealgood) WithSearch(s *exp.SearchSpec) *Dealgood {
+	if s == nil {
+		return d
+	}
+	d.environment["DEALGOOD_SEARCH"] = "true"
+	if s.StartRate > 0 {
+		d.environment["DEALGOOD_SEARCH_START_RATE"] = strconv.FormatFloat(s.StartRate, 'f', -1, 64)
+	}
+	if s.Step > 0 {
+		d.environment["DEALGOOD_SEARCH_STEP"] = s.Step.String()
+	}
+	if s.MaxP99 > 0 {
+		d.environment["DEALGOOD_SEARCH_MAX_P99"] = s.MaxP99.String()
+	}
+	if s.MaxErrorRatio > 0 {
+		d.environment["DEALGOOD_SEARCH_MAX_ERROR_RATIO"] = strconv.FormatFloat(s.MaxErrorRatio, 'f', -1, 64)
+	}
+	if s.Precision > 0 {
+		d.environment["DEALGOOD_SEARCH_PRECISION"] = strconv.FormatFloat(s.Precision, 'f', -1, 64)
+	}
+	return d
+}
+
+// WithSpikes has dealgood send periodic traffic spikes and score each target's recovery from
+// them. Settings left at zero use dealgood's defaults.
+func (d *Dealgood) WithSpikes(s *exp.SpikeSpec) *Dealgood {
+	if s == nil {
+		return d
+	}
+	d.environment["DEALGOOD_SPIKE_MULTIPLIER"] = strconv.FormatFloat(s.Multiplier, 'f', -1, 64)
+	if s.Duration > 0 {
+		d.environment["DEALGOOD_SPIKE_DURATION"] = s.Duration.String()
+	}
+	if s.Interval > 0 {
+		d.environment["DEALGOOD_SPIKE_INTERVAL"] = s.Interval.String()
+	}
+	if s.Tolerance > 0 {
+		d.environment["DEALGOOD_SPIKE_TOLERANCE"] = strconv.FormatFloat(s.Tolerance, 'f', -1, 64)
+	}
+	return d
+}
+
 func (d *Dealgood) WithMaxConcurrency(v int) *Dealgood {
 	d.environment["DEALGOOD_CONCURRENCY"] = strconv.Itoa(v)
 	return d
@@ -86,6 +154,138 @@ func (d *Dealgood) WithRequestFilter(v string) *Dealgood {
 	return d
 }
 
+// WithBodyStrategy configures how dealgood reads response bodies. An empty strategy leaves
+// dealgood's default of reading bodies in full.
+func (d *Dealgood) WithBodyStrategy(strategy string, readLimit int64) *Dealgood {
+	if strategy == "" {
+		return d
+	}
+	d.environment["DEALGOOD_BODY_STRATEGY"] = strategy
+	if readLimit > 0 {
+		d.environment["DEALGOOD_BODY_READ_LIMIT"] = strconv.FormatInt(readLimit, 10)
+	}
+	return d
+}
+
+// WithAcceptEncoding configures the relative weights of the Accept-Encoding values dealgood
+// sends with requests. Requests are sent with the original client's header if empty.
+func (d *Dealgood) WithAcceptEncoding(weights map[string]int) *Dealgood {
+	if len(weights) == 0 {
+		return d
+	}
+	// cannot fail, maps of ints are always encodable
+	data, _ := json.Marshal(weights)
+	d.environment["DEALGOOD_ACCEPT_ENCODING"] = string(data)
+	return d
+}
+
+// WithAudit configures whether dealgood records the outcome of each request for every target.
+func (d *Dealgood) WithAudit(v bool) *Dealgood {
+	if v {
+		d.environment["DEALGOOD_AUDIT"] = "true"
+	}
+	return d
+}
+
+// WithSubnet places dealgood's task in the given subnet rather than the default subnet, so that
+// it runs in the availability zone chosen for the experiment's targets.
+func (d *Dealgood) WithSubnet(subnet string) *Dealgood {
+	if subnet != "" {
+		d.subnet = subnet
+	}
+	return d
+}
+
+// WithKmsKey encrypts the request queue and checkpoint table with a customer managed key
+// instead of one managed by AWS. The key's policy must allow sns to use it for the request
+// topic to deliver to the queue.
+func (d *Dealgood) WithKmsKey(arn string) *Dealgood {
+	d.kmsKeyArn = arn
+	return d
+}
+
+// WithTransport configures how requests are delivered to dealgood. The default "sqs" transport
+// subscribes a queue for the experiment to the request topic. The "kinesis" transport reads
+// directly from the shared request stream, checkpointing its position in a table created for
+// the experiment, which avoids provisioning a queue and subscription. The "nats" transport
+// reads the JetStream stream of the base infra through a durable consumer named after the
+// experiment, which the NATS server creates and keeps the position of, so no AWS resources
+// are needed for it.
+func (d *Dealgood) WithTransport(transport string) *Dealgood {
+	switch transport {
+	case "", "sqs":
+		return d
+	case "nats":
+		d.environment["DEALGOOD_SOURCE"] = "nats"
+		d.environment["DEALGOOD_NATS_URL"] = d.base.RequestNatsURL
+		d.environment["DEALGOOD_NATS_STREAM"] = d.base.RequestNatsStream
+		d.environment["DEALGOOD_NATS_CONSUMER"] = d.taskName
+	default:
+		d.environment["DEALGOOD_SOURCE"] = "kinesis"
+		d.environment["DEALGOOD_KINESIS_STREAM"] = d.base.RequestKinesisStreamName
+		d.environment["DEALGOOD_KINESIS_CHECKPOINT_TABLE"] = d.checkpointTableName
+	}
+	d.transport = transport
+	delete(d.environment, "DEALGOOD_SQS_QUEUE")
+	return d
+}
+
+// WithReplay has a new nats consumer start from requests already in the stream, from a
+// sequence number or time, instead of those published once dealgood starts.
+func (d *Dealgood) WithReplay(r *exp.ReplaySpec) *Dealgood {
+	if r == nil {
+		return d
+	}
+	if r.StartSequence > 0 {
+		d.environment["DEALGOOD_NATS_START_SEQUENCE"] = strconv.FormatUint(r.StartSequence, 10)
+	}
+	if !r.StartTime.IsZero() {
+		d.environment["DEALGOOD_NATS_START_TIME"] = r.StartTime.UTC().Format(time.RFC3339)
+	}
+	return d
+}
+
+// WithShutdown configures how long dealgood drains requests in flight and waits for a final
+// scrape of its metrics once it is stopped, and gives its container long enough to do both.
+func (d *Dealgood) WithShutdown(s *exp.ShutdownSpec) *Dealgood {
+	if s == nil {
+		return d
+	}
+	d.environment["DEALGOOD_DRAIN_TIMEOUT"] = s.DrainTimeout.String()
+	d.environment["DEALGOOD_FINAL_SCRAPE_TIMEOUT"] = s.FinalScrapeTimeout.String()
+	d.stopTimeout = s.DrainTimeout + s.FinalScrapeTimeout + 10*time.Second
+	if d.stopTimeout > maxStopTimeout {
+		d.stopTimeout = maxStopTimeout
+	}
+	return d
+}
+
+// WithWorkload has dealgood send a generated workload instead of requests from the shared
+// request stream, so no request queue is subscribed. The cold preset requests the content
+// handed out by the content seeder and the corpus preset the content of the content providers
+// at seederURLs, which may be empty when the workload is only needed to find dealgood's
+// resources.
+func (d *Dealgood) WithWorkload(w *exp.WorkloadSpec, seederURLs []string) *Dealgood {
+	if w == nil {
+		return d
+	}
+	d.transport = "seeder"
+	d.environment["DEALGOOD_SOURCE"] = "seeder"
+	if w.Preset == exp.WorkloadPresetCorpus {
+		d.environment["DEALGOOD_SOURCE"] = "corpus"
+	}
+	d.environment["DEALGOOD_SOURCE_PARAM"] = strings.Join(seederURLs, ",")
+	delete(d.environment, "DEALGOOD_SQS_QUEUE")
+	return d
+}
+
+// WithMetadata adds the experiment's owner and purpose to the tags of every resource created
+// for dealgood.
+func (d *Dealgood) WithMetadata(metadata map[string]string) *Dealgood {
+	d.metadata = metadata
+	return d
+}
+
 func (d *Dealgood) WithTargets(targets []*Target) *Dealgood {
 	targetURLs := make([]string, len(targets))
 	for i := range targets {
@@ -96,10 +296,94 @@ func (d *Dealgood) WithTargets(targets []*Target) *Dealgood {
 	return d
 }
 
+// WithRemoteTargets adds targets that are not deployed by thunderdome to the list of targets
+// that dealgood sends requests to. It must be called after WithTargets.
+func (d *Dealgood) WithRemoteTargets(specs []*exp.TargetSpec) *Dealgood {
+	if len(specs) == 0 {
+		return d
+	}
+	targetURLs := make([]string, 0, len(specs)+1)
+	if existing := d.environment["DEALGOOD_TARGETS"]; existing != "" {
+		targetURLs = append(targetURLs, existing)
+	}
+	for _, t := range specs {
+		targetURLs = append(targetURLs, t.Name+"::"+t.URL)
+	}
+
+	d.environment["DEALGOOD_TARGETS"] = strings.Join(targetURLs, ",")
+	return d
+}
+
+// WithTargetHeaders configures the headers that dealgood adds to every request sent to each target.
+func (d *Dealgood) WithTargetHeaders(specs []*exp.TargetSpec) *Dealgood {
+	headers := map[string]map[string]string{}
+	for _, t := range specs {
+		if len(t.RequestHeaders) > 0 {
+			headers[t.Name] = t.RequestHeaders
+		}
+	}
+	if len(headers) == 0 {
+		return d
+	}
+
+	// cannot fail, maps of strings are always encodable
+	data, _ := json.Marshal(headers)
+	d.environment["DEALGOOD_TARGET_HEADERS"] = string(data)
+	return d
+}
+
+// WithSubdomainGateways configures dealgood to send requests in subdomain form to targets that
+// are configured as subdomain gateways.
+func (d *Dealgood) WithSubdomainGateways(specs []*exp.TargetSpec) *Dealgood {
+	domains := map[string]string{}
+	for _, t := range specs {
+		if t.SubdomainGateway != "" {
+			domains[t.Name] = t.SubdomainGateway
+		}
+	}
+	if len(domains) == 0 {
+		return d
+	}
+
+	// cannot fail, maps of strings are always encodable
+	data, _ := json.Marshal(domains)
+	d.environment["DEALGOOD_SUBDOMAIN_GATEWAY"] = string(data)
+	return d
+}
+
+// WithTargetMaxInFlight configures the number of requests dealgood may have in flight to targets
+// that are limited below the experiment's concurrency.
+func (d *Dealgood) WithTargetMaxInFlight(specs []*exp.TargetSpec) *Dealgood {
+	limits := map[string]int{}
+	for _, t := range specs {
+		if t.MaxInFlight > 0 {
+			limits[t.Name] = t.MaxInFlight
+		}
+	}
+	if len(limits) == 0 {
+		return d
+	}
+
+	// cannot fail, maps of ints are always encodable
+	data, _ := json.Marshal(limits)
+	d.environment["DEALGOOD_TARGET_MAX_IN_FLIGHT"] = string(data)
+	return d
+}
+
 func (d *Dealgood) Name() string {
 	return "dealgood"
 }
 
+// Environment returns a copy of the environment variables configuring dealgood, so that the
+// same configuration can be used to run dealgood elsewhere.
+func (d *Dealgood) Environment() map[string]string {
+	env := make(map[string]string, len(d.environment))
+	for k, v := range d.environment {
+		env[k] = v
+	}
+	return env
+}
+
 func (d *Dealgood) ComponentName() string {
 	return "dealgood"
 }
@@ -127,19 +411,25 @@ func (d *Dealgood) Resources() []api.Resource {
 	defer d.mu.Unlock()
 
 	var res []api.Resource
-	res = append(res, api.Resource{
-		Type: api.ResourceTypeEcsTask,
-		Keys: map[string]string{
-			api.ResourceKeyEcsClusterArn: d.base.EcsClusterArn,
-			api.ResourceKeyArn:           d.taskArn,
-		},
-	})
+	res = append(res, ecsTaskResource(d.base.EcsClusterArn, d.taskArn, d.Name(), d.runTaskInput()))
 	res = append(res, api.Resource{
 		Type: api.ResourceTypeEcsTaskDefinition,
 		Keys: map[string]string{
 			api.ResourceKeyArn: d.taskDefinitionArn,
 		},
 	})
+	if d.transport == "seeder" || d.transport == "nats" {
+		return res
+	}
+	if d.transport == "kinesis" {
+		res = append(res, api.Resource{
+			Type: api.ResourceTypeDynamoDBTable,
+			Keys: map[string]string{
+				api.ResourceKeyTableName: d.checkpointTableName,
+			},
+		})
+		return res
+	}
 	res = append(res, api.Resource{
 		Type: api.ResourceTypeEcsSnsSubscription,
 		Keys: map[string]string{
@@ -156,6 +446,49 @@ func (d *Dealgood) Resources() []api.Resource {
 	return res
 }
 
+// TeardownChecks returns checks that confirm dealgood's resources have been deleted.
+func (d *Dealgood) TeardownChecks() []TeardownCheck {
+	checks := []TeardownCheck{
+		{
+			Component: d.Name(),
+			Resource:  "task " + d.taskDefinitionFamily,
+			Deleted: func(ctx context.Context, sess *session.Session) (bool, error) {
+				return isTaskStopped(ctx, sess, d.base.EcsClusterArn, d.taskDefinitionFamily)
+			},
+		},
+		{
+			Component: d.Name(),
+			Resource:  "task definition " + d.taskDefinitionFamily,
+			Deleted:   d.taskDefinitionIsInactive().Func,
+		},
+	}
+	if d.transport == "seeder" || d.transport == "nats" {
+		return checks
+	}
+	if d.transport == "kinesis" {
+		return append(checks, TeardownCheck{
+			Component: d.Name(),
+			Resource:  "checkpoint table " + d.checkpointTableName,
+			Deleted:   d.checkpointTableDoesNotExist().Func,
+		})
+	}
+	return append(checks,
+		TeardownCheck{
+			Component: d.Name(),
+			Resource:  "request queue subscription for " + d.requestQueueName,
+			Deleted: func(ctx context.Context, sess *session.Session) (bool, error) {
+				arn, err := findQueueSubscription(ctx, sess, d.base.RequestSNSTopicArn, d.requestQueueName)
+				return arn == "", err
+			},
+		},
+		TeardownCheck{
+			Component: d.Name(),
+			Resource:  "request queue " + d.requestQueueName,
+			Deleted:   d.requestQueueDoesNotExist().Func,
+		},
+	)
+}
+
 func (d *Dealgood) Setup(ctx context.Context) error {
 	slog.Info("starting setup", "component", d.Name())
 	sess, err := session.NewSession(&aws.Config{
@@ -165,6 +498,21 @@ func (d *Dealgood) Setup(ctx context.Context) error {
 		return fmt.Errorf("new session: %w", err)
 	}
 
+	if d.transport == "seeder" || d.transport == "nats" {
+		return TaskSequence(ctx, sess, d.Name(),
+			d.createTaskDefinition(),
+			d.runTask(),
+		)
+	}
+
+	if d.transport == "kinesis" {
+		return TaskSequence(ctx, sess, d.Name(),
+			d.createCheckpointTable(),
+			d.createTaskDefinition(),
+			d.runTask(),
+		)
+	}
+
 	return TaskSequence(ctx, sess, d.Name(),
 		d.createRequestQueue(),
 		d.createRequestQueueSubscription(),
@@ -182,14 +530,71 @@ func (d *Dealgood) Teardown(ctx context.Context) error {
 		return fmt.Errorf("new session: %w", err)
 	}
 
+	// dealgood keeps consuming requests while it drains, so the resources it reads from are only
+	// deleted once its task has stopped
+	if d.transport == "seeder" || d.transport == "nats" {
+		return TaskSequence(ctx, sess, d.Name(),
+			d.stopTask(),
+			d.waitForTaskStopped(),
+			d.deregisterTaskDefinition(),
+		)
+	}
+
+	if d.transport == "kinesis" {
+		return TaskSequence(ctx, sess, d.Name(),
+			d.stopTask(),
+			d.waitForTaskStopped(),
+			d.deregisterTaskDefinition(),
+			d.deleteCheckpointTable(),
+		)
+	}
+
+	// the queue is unsubscribed first so that no new requests arrive while dealgood drains
 	return TaskSequence(ctx, sess, d.Name(),
+		d.deleteRequestQueueSubscription(),
 		d.stopTask(),
+		d.waitForTaskStopped(),
 		d.deregisterTaskDefinition(),
-		d.deleteRequestQueueSubscription(),
 		d.deleteRequestQueue(),
 	)
 }
 
+// ForceTeardown removes dealgood's resources in dependency order, continuing past failures.
+// The request queue is unsubscribed before the task is stopped so no new requests arrive,
+// and purged before it is deleted.
+func (d *Dealgood) ForceTeardown(ctx context.Context) error {
+	slog.Info("starting forced teardown", "component", d.Name())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(d.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	if d.transport == "seeder" || d.transport == "nats" {
+		return ForceTaskSequence(ctx, sess, d.Name(),
+			stopFamilyTasks(d.base.EcsClusterArn, d.taskDefinitionFamily),
+			deregisterFamilyTaskDefinitions(d.taskDefinitionFamily),
+		)
+	}
+
+	if d.transport == "kinesis" {
+		return ForceTaskSequence(ctx, sess, d.Name(),
+			stopFamilyTasks(d.base.EcsClusterArn, d.taskDefinitionFamily),
+			deregisterFamilyTaskDefinitions(d.taskDefinitionFamily),
+			d.deleteCheckpointTable(),
+		)
+	}
+
+	return ForceTaskSequence(ctx, sess, d.Name(),
+		unsubscribeQueue(d.base.RequestSNSTopicArn, d.requestQueueName),
+		stopFamilyTasks(d.base.EcsClusterArn, d.taskDefinitionFamily),
+		purgeQueue(d.requestQueueName),
+		d.deleteRequestQueue(),
+		deregisterFamilyTaskDefinitions(d.taskDefinitionFamily),
+	)
+}
+
 func (d *Dealgood) Ready(ctx context.Context) (bool, error) {
 	d.mu.Lock()
 	d.ready = false
@@ -202,12 +607,19 @@ func (d *Dealgood) Ready(ctx context.Context) (bool, error) {
 		return false, fmt.Errorf("new session: %w", err)
 	}
 
-	ready, err := CheckSequence(ctx, sess, d.Name(),
+	checks := []Check{
 		d.requestQueueExists(),
 		d.requestQueueSubscriptionExists(),
-		d.taskDefinitionIsActive(),
-		d.taskIsRunning(),
-	)
+	}
+	switch d.transport {
+	case "kinesis":
+		checks = []Check{d.checkpointTableExists()}
+	case "seeder", "nats":
+		checks = nil
+	}
+	checks = append(checks, d.taskDefinitionIsActive(), d.taskIsRunning())
+
+	ready, err := CheckSequence(ctx, sess, d.Name(), checks...)
 
 	if !ready || err != nil {
 		return ready, err
@@ -220,10 +632,10 @@ func (d *Dealgood) Ready(ctx context.Context) (bool, error) {
 }
 
 func (d *Dealgood) tags() map[string]*string {
-	return map[string]*string{
+	return withMetadata(map[string]*string{
 		"experiment": aws.String(d.experiment),
 		"component":  aws.String(d.Name()),
-	}
+	}, d.metadata)
 }
 
 func (d *Dealgood) createTaskDefinition() Task {
@@ -239,7 +651,7 @@ func (d *Dealgood) createTaskDefinition() Task {
 				NetworkMode:             aws.String("awsvpc"),
 				ExecutionRoleArn:        aws.String(d.base.EcsExecutionRoleArn),
 				TaskRoleArn:             aws.String(d.base.DealgoodTaskRoleArn),
-				Cpu:                     aws.String("4096"),
+				Cpu:                     aws.String(strconv.Itoa(dealgoodTaskCPU)),
 				Memory:                  aws.String("10240"),
 				Tags:                    ecsTags(d.tags()),
 				Volumes: []*ecs.Volume{
@@ -266,6 +678,7 @@ func (d *Dealgood) createTaskDefinition() Task {
 						Cpu:         aws.Int64(0),
 						Essential:   aws.Bool(true),
 						Environment: mapsToKeyValuePair(d.environment),
+						StopTimeout: aws.Int64(int64(d.stopTimeout.Seconds())),
 
 						Secrets: []*ecs.Secret{},
 						MountPoints: []*ecs.MountPoint{
@@ -384,24 +797,7 @@ func (d *Dealgood) runTask() Task {
 		Func: func(ctx context.Context, sess *session.Session) error {
 			svc := ecs.New(sess)
 
-			in := &ecs.RunTaskInput{
-				LaunchType: aws.String("FARGATE"),
-				NetworkConfiguration: &ecs.NetworkConfiguration{
-					AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
-						AssignPublicIp: aws.String("ENABLED"),
-						SecurityGroups: []*string{
-							aws.String(d.base.DealgoodSecurityGroup),
-						},
-						Subnets: []*string{
-							aws.String(d.base.VpcPublicSubnet),
-						},
-					},
-				},
-				Cluster:        aws.String(d.base.EcsClusterArn),
-				Count:          aws.Int64(1),
-				TaskDefinition: aws.String(d.taskDefinitionFamily),
-				Tags:           ecsTags(d.tags()),
-			}
+			in := d.runTaskInput()
 
 			out, err := svc.RunTask(in)
 			if err != nil {
@@ -427,6 +823,29 @@ func (d *Dealgood) runTask() Task {
 	}
 }
 
+// runTaskInput returns the input used to run dealgood's task. It is also given to ironbar so
+// that it can run the task again if it fails for a transient reason.
+func (d *Dealgood) runTaskInput() *ecs.RunTaskInput {
+	return &ecs.RunTaskInput{
+		LaunchType: aws.String("FARGATE"),
+		NetworkConfiguration: &ecs.NetworkConfiguration{
+			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+				AssignPublicIp: d.base.assignPublicIp(d.subnet),
+				SecurityGroups: []*string{
+					aws.String(d.base.DealgoodSecurityGroup),
+				},
+				Subnets: []*string{
+					aws.String(d.subnet),
+				},
+			},
+		},
+		Cluster:        aws.String(d.base.EcsClusterArn),
+		Count:          aws.Int64(1),
+		TaskDefinition: aws.String(d.taskDefinitionFamily),
+		Tags:           ecsTags(d.tags()),
+	}
+}
+
 func (d *Dealgood) stopTask() Task {
 	return Task{
 		Name:  "stop task",
@@ -439,6 +858,38 @@ func (d *Dealgood) stopTask() Task {
 	}
 }
 
+// waitForTaskStopped waits for dealgood to exit after it has been asked to stop, for up to
+// its stop timeout and a margin for ECS to report it. Teardown carries on with a warning if it
+// has not stopped by then.
+func (d *Dealgood) waitForTaskStopped() Task {
+	return Task{
+		Name: "wait for task to stop",
+		Func: func(ctx context.Context, sess *session.Session) error {
+			timeout := d.stopTimeout + 30*time.Second
+			logger := slog.With("component", d.Name(), "step", "wait for task to stop")
+			start := time.Now()
+
+			wctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := WaitUntilCheck(wctx, sess, logger, Check{
+				Name: "task is stopped",
+				Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+					return isTaskStopped(ctx, sess, d.base.EcsClusterArn, d.taskDefinitionFamily)
+				},
+			}, 0, 5*time.Second)
+			if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+				logger.Warn("task did not stop within timeout, continuing teardown", "timeout", timeout)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			logger.Info("task stopped", "duration", time.Since(start).Round(time.Second))
+			return nil
+		},
+	}
+}
+
 func (d *Dealgood) createRequestQueue() Task {
 	return Task{
 		Name:  "create request queue",
@@ -450,6 +901,11 @@ func (d *Dealgood) createRequestQueue() Task {
 				QueueName: aws.String(d.requestQueueName),
 				Tags:      d.tags(),
 			}
+			if d.kmsKeyArn != "" {
+				in.Attributes = map[string]*string{
+					sqs.QueueAttributeNameKmsMasterKeyId: aws.String(d.kmsKeyArn),
+				}
+			}
 
 			var err error
 			out, err := svc.CreateQueue(in)
@@ -555,6 +1011,11 @@ func (d *Dealgood) createRequestQueueSubscription() Task {
 				TopicArn: aws.String(d.base.RequestSNSTopicArn),
 				Protocol: aws.String("sqs"),
 				Endpoint: aws.String(d.requestQueueArn),
+				// deliver messages without the sns envelope so message attributes such as
+				// content-encoding are passed to dealgood as sqs message attributes
+				Attributes: map[string]*string{
+					"RawMessageDelivery": aws.String("true"),
+				},
 			}
 
 			outsub, err := snssvc.Subscribe(insub)
@@ -689,6 +1150,93 @@ func (d *Dealgood) taskIsStoppedOrStopping() Check {
 	}
 }
 
+func (d *Dealgood) createCheckpointTable() Task {
+	return Task{
+		Name:  "create checkpoint table",
+		Check: d.checkpointTableExists(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			svc := dynamodb.New(sess)
+
+			tags := make([]*dynamodb.Tag, 0)
+			for k, v := range d.tags() {
+				tags = append(tags, &dynamodb.Tag{Key: aws.String(k), Value: v})
+			}
+
+			in := &dynamodb.CreateTableInput{
+				TableName:   aws.String(d.checkpointTableName),
+				BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+				AttributeDefinitions: []*dynamodb.AttributeDefinition{
+					{
+						AttributeName: aws.String("shard_id"),
+						AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+					},
+				},
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("shard_id"),
+						KeyType:       aws.String(dynamodb.KeyTypeHash),
+					},
+				},
+				Tags: tags,
+			}
+			if d.kmsKeyArn != "" {
+				in.SSESpecification = &dynamodb.SSESpecification{
+					Enabled:        aws.Bool(true),
+					SSEType:        aws.String(dynamodb.SSETypeKms),
+					KMSMasterKeyId: aws.String(d.kmsKeyArn),
+				}
+			}
+
+			if _, err := svc.CreateTable(in); err != nil {
+				if _, ok := err.(*dynamodb.ResourceInUseException); ok {
+					// table is still being created by an earlier attempt
+					return nil
+				}
+				return fmt.Errorf("create table: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+func (d *Dealgood) deleteCheckpointTable() Task {
+	return Task{
+		Name:  "delete checkpoint table",
+		Check: d.checkpointTableDoesNotExist(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			return deleteDynamoDBTable(ctx, sess, d.checkpointTableName)
+		},
+	}
+}
+
+func (d *Dealgood) checkpointTableExists() Check {
+	return Check{
+		Name:        "checkpoint table exists",
+		FailureText: "checkpoint table does not exist",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			status, err := findTable(d.checkpointTableName, sess)
+			if err != nil {
+				return false, err
+			}
+			return status == dynamodb.TableStatusActive, nil
+		},
+	}
+}
+
+func (d *Dealgood) checkpointTableDoesNotExist() Check {
+	return Check{
+		Name:        "checkpoint table does not exist",
+		FailureText: "checkpoint table exists",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			status, err := findTable(d.checkpointTableName, sess)
+			if err != nil {
+				return false, err
+			}
+			return status == "", nil
+		},
+	}
+}
+
 func (d *Dealgood) requestQueueExists() Check {
 	return Check{
 		Name:        "request queue exists",
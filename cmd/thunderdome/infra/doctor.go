@@ -0,0 +1,161 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/client"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/build"
+)
+
+// DoctorResult is the outcome of a check of the environment thunderdome is run in.
+type DoctorResult struct {
+	PreflightResult
+	Fix string // what to do about a failed check, empty if it passed
+}
+
+// Doctor checks that the environment is set up to build images and deploy experiments: the
+// tools that are run, the AWS credentials and permissions, ironbar, the ECR repository and
+// the account's quotas. Checks that depend on one that failed are not run.
+func Doctor(ctx context.Context, region string) []DoctorResult {
+	var results []DoctorResult
+	add := func(r PreflightResult, fix string) {
+		res := DoctorResult{PreflightResult: r}
+		if r.Err != nil {
+			res.Fix = fix
+		}
+		results = append(results, res)
+	}
+
+	var regionErr error
+	if region == "" {
+		regionErr = fmt.Errorf("not set")
+	}
+	add(PreflightResult{Check: "AWS_REGION is set", Err: regionErr},
+		"Set AWS_REGION, or aws_region in the config file profile, to the region Thunderdome runs in.")
+
+	var profileErr error
+	if os.Getenv("AWS_PROFILE") == "" {
+		profileErr = fmt.Errorf("not set, images cannot be pushed to ECR")
+	}
+	add(PreflightResult{Check: "AWS_PROFILE is set", Err: profileErr, Warning: true},
+		"Set AWS_PROFILE, or aws_profile in the config file profile, to the AWS profile used to push images.")
+
+	_, err := exec.LookPath("docker")
+	add(PreflightResult{Check: "docker is installed", Err: err},
+		"Install Docker Desktop or Docker Engine and make sure docker is on the PATH.")
+	dockerOK := err == nil
+	if dockerOK {
+		var version string
+		version, err = build.DockerServerVersion()
+		if err == nil && version == "" {
+			err = fmt.Errorf("docker did not report a server version")
+		}
+		add(PreflightResult{Check: "docker daemon is running", Err: err},
+			"Start Docker Desktop, or the docker service with: sudo systemctl start docker")
+		dockerOK = err == nil
+	}
+
+	_, err = exec.LookPath("aws")
+	add(PreflightResult{Check: "aws cli is installed", Err: err},
+		"Install version 2 of the AWS CLI and make sure aws is on the PATH.")
+	awsOK := err == nil
+
+	if region == "" {
+		return results
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err == nil {
+		_, err = sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	}
+	add(PreflightResult{Check: "aws credentials are valid", Err: err},
+		"Log in with: aws sso login, or configure the profile's credentials with: aws configure")
+	if err != nil {
+		return results
+	}
+
+	base, err := NewBaseInfra(region)
+	add(PreflightResult{Check: "base infra can be read", Err: err},
+		"Check that AWS_REGION is the region Thunderdome runs in and that your role may read infra.json from the pl-thunderdome-private bucket.")
+	if err != nil {
+		return results
+	}
+
+	add(preflightPermissions(sess),
+		"Ask an administrator to allow your role the actions listed.")
+
+	add(doctorIronbar(ctx, base.IronbarAddr))
+
+	if dockerOK && awsOK {
+		registry, _, _ := strings.Cut(base.EcrBaseURL, "/")
+		add(PreflightResult{Check: "docker can log in to ecr", Err: build.EcrLogin(base.EcrBaseURL, region)},
+			fmt.Sprintf("Check that your role may call ecr:GetAuthorizationToken, then try: aws ecr get-login-password --region %s | docker login -u AWS --password-stdin %s", region, registry))
+	}
+
+	// the smallest experiment has dealgood and a single target on the smallest instance type
+	targetVCPUs := 0
+	for _, cp := range base.CapacityProviders {
+		if targetVCPUs == 0 || cp.InstanceType.MaxCPU < targetVCPUs {
+			targetVCPUs = cp.InstanceType.MaxCPU
+		}
+	}
+	for _, q := range []struct {
+		quota  serviceQuota
+		needed float64
+	}{
+		{quota: ec2StandardVCPUQuota, needed: float64(targetVCPUs)},
+		{quota: fargateVCPUQuota, needed: float64(dealgoodTaskCPU) / 1024},
+	} {
+		if q.needed == 0 {
+			continue
+		}
+		add(checkQuota(sess, base, q.quota, q.needed),
+			fmt.Sprintf("Wait for running experiments to finish, or request an increase with: aws service-quotas request-service-quota-increase --service-code %s --quota-code %s --desired-value <vCPUs>", q.quota.ServiceCode, q.quota.QuotaCode))
+	}
+
+	add(preflightPrometheus(sess, base.PrometheusSecretArn),
+		fmt.Sprintf("Check the url and credentials of the Prometheus remote write endpoint in secret %s.", base.PrometheusSecretArn))
+
+	return results
+}
+
+// doctorIronbar checks that ironbar can be reached and that it and this version of
+// thunderdome can work together, returning the result and what to do if it failed.
+func doctorIronbar(ctx context.Context, addr string) (PreflightResult, string) {
+	check := fmt.Sprintf("ironbar at %s is reachable and compatible", addr)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := client.New(addr, nil).Version(ctx)
+	if err == nil {
+		if err := checkIronbarVersion(out, nil); err != nil {
+			return PreflightResult{Check: check, Err: err},
+				fmt.Sprintf("Use the release of thunderdome matching ironbar %s, or upgrade ironbar.", out.Version)
+		}
+		return PreflightResult{Check: check}, ""
+	}
+
+	if errors.Is(err, client.ErrNotFound) {
+		return PreflightResult{Check: check, Err: fmt.Errorf("ironbar does not report its version and may ignore newer parts of experiment definitions"), Warning: true},
+			"Upgrade ironbar."
+	}
+	var cerr *client.Error
+	if errors.As(err, &cerr) {
+		return PreflightResult{Check: check, Err: err},
+			"ironbar is reachable but failed the request; check its logs."
+	}
+	return PreflightResult{Check: check, Err: err},
+		"Check that you are connected to the network ironbar is served on, or set THUNDERDOME_IRONBAR_ADDR to the address of a reachable ironbar."
+}
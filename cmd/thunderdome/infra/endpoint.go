@@ -0,0 +1,230 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// vpcEndpointTagValue is the value of the thunderdome tag of the vpc endpoints created for
+// private networking. They are shared by every experiment with private networking, so they are
+// kept when an experiment is torn down.
+const vpcEndpointTagValue = "vpc-endpoint"
+
+// A vpcEndpointService is an AWS service that tasks and instances without a public IP address
+// reach through an endpoint in the vpc.
+type vpcEndpointService struct {
+	Name    string // service name following com.amazonaws.<region>.
+	Gateway bool   // reached through a gateway endpoint in the route tables rather than an interface endpoint
+}
+
+func (s vpcEndpointService) serviceName(region string) string {
+	return "com.amazonaws." + region + "." + s.Name
+}
+
+// vpcEndpointServices returns the AWS services called by an experiment's tasks and instances.
+func vpcEndpointServices(e *exp.Experiment) []vpcEndpointService {
+	services := []vpcEndpointService{
+		{Name: "ecr.api"},
+		{Name: "ecr.dkr"},
+		{Name: "s3", Gateway: true}, // ecr serves image layers from s3
+		{Name: "logs"},
+		{Name: "secretsmanager"}, // secrets given to tasks by their task definitions
+		{Name: "sqs"},
+	}
+	for _, t := range e.Targets {
+		if t.EC2 != nil {
+			// the ecs agent of an instance launched for a target registers it with the cluster
+			services = append(services,
+				vpcEndpointService{Name: "ecs"},
+				vpcEndpointService{Name: "ecs-agent"},
+				vpcEndpointService{Name: "ecs-telemetry"},
+			)
+			break
+		}
+	}
+	if e.Transport == "kinesis" {
+		services = append(services,
+			vpcEndpointService{Name: "kinesis-streams"},
+			vpcEndpointService{Name: "dynamodb", Gateway: true}, // checkpoint table
+		)
+	}
+	return services
+}
+
+// vpcEndpoints returns the state of the vpc's endpoints, keyed by service name. Endpoints that
+// are being deleted or have failed are left out.
+func vpcEndpoints(ctx context.Context, sess *session.Session, base *BaseInfra) (map[string]string, error) {
+	states := make(map[string]string)
+	in := &ec2.DescribeVpcEndpointsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{aws.String(base.VpcId)}},
+		},
+	}
+	err := ec2.New(sess).DescribeVpcEndpointsPagesWithContext(ctx, in, func(out *ec2.DescribeVpcEndpointsOutput, last bool) bool {
+		for _, ep := range out.VpcEndpoints {
+			switch state := aws.StringValue(ep.State); state {
+			case ec2.StateAvailable, ec2.StatePending, ec2.StatePendingAcceptance:
+				states[aws.StringValue(ep.ServiceName)] = state
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe vpc endpoints: %w", err)
+	}
+	return states, nil
+}
+
+// missingVpcEndpoints returns the services called by the experiment that the vpc has no
+// endpoint for.
+func missingVpcEndpoints(ctx context.Context, sess *session.Session, base *BaseInfra, e *exp.Experiment) ([]vpcEndpointService, error) {
+	if base.VpcId == "" {
+		return nil, fmt.Errorf("vpc id is not listed in infra.json")
+	}
+	states, err := vpcEndpoints(ctx, sess, base)
+	if err != nil {
+		return nil, err
+	}
+	var missing []vpcEndpointService
+	for _, svc := range vpcEndpointServices(e) {
+		if _, ok := states[svc.serviceName(base.AwsRegion)]; !ok {
+			missing = append(missing, svc)
+		}
+	}
+	return missing, nil
+}
+
+// EnsureVpcEndpoints creates the vpc endpoints that an experiment with private networking needs
+// and the vpc does not already have, and waits until every one is available. Interface
+// endpoints are placed in the private subnets with private DNS, so that the services' usual
+// hostnames resolve to them, and gateway endpoints are added to the private subnets' route
+// tables.
+func EnsureVpcEndpoints(ctx context.Context, sess *session.Session, base *BaseInfra, e *exp.Experiment) error {
+	logger := slog.With("component", base.Name())
+	missing, err := missingVpcEndpoints(ctx, sess, base, e)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		subnets, _, err := zoneSubnets(sess, base, true)
+		if err != nil {
+			return err
+		}
+		// an interface endpoint may have only one subnet in each availability zone
+		subnetIDs := make([]string, 0, len(subnets))
+		for _, id := range subnets {
+			subnetIDs = append(subnetIDs, id)
+		}
+		sort.Strings(subnetIDs)
+
+		var routeTables []string
+		for _, svc := range missing {
+			if svc.Gateway {
+				routeTables, err = subnetRouteTables(ctx, sess, base.VpcPrivateSubnets)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+
+		svc := ec2.New(sess)
+		for _, s := range missing {
+			in := &ec2.CreateVpcEndpointInput{
+				VpcId:       aws.String(base.VpcId),
+				ServiceName: aws.String(s.serviceName(base.AwsRegion)),
+				TagSpecifications: []*ec2.TagSpecification{
+					{
+						ResourceType: aws.String(ec2.ResourceTypeVpcEndpoint),
+						Tags: ec2Tags(map[string]*string{
+							"Name":        aws.String("thunderdome-" + s.Name),
+							"thunderdome": aws.String(vpcEndpointTagValue),
+						}),
+					},
+				},
+			}
+			if s.Gateway {
+				in.VpcEndpointType = aws.String(ec2.VpcEndpointTypeGateway)
+				in.RouteTableIds = aws.StringSlice(routeTables)
+			} else {
+				if base.VpcEndpointSecurityGroup == "" {
+					return fmt.Errorf("vpc endpoint security group is not listed in infra.json")
+				}
+				in.VpcEndpointType = aws.String(ec2.VpcEndpointTypeInterface)
+				in.SubnetIds = aws.StringSlice(subnetIDs)
+				in.SecurityGroupIds = []*string{aws.String(base.VpcEndpointSecurityGroup)}
+				in.PrivateDnsEnabled = aws.Bool(true)
+			}
+			out, err := svc.CreateVpcEndpointWithContext(ctx, in)
+			if err != nil {
+				return fmt.Errorf("create vpc endpoint for %s: %w", s.Name, err)
+			}
+			logger.Info("created vpc endpoint", "service", s.Name, "id", aws.StringValue(out.VpcEndpoint.VpcEndpointId))
+		}
+	}
+
+	return WaitUntil(ctx, logger, "vpc endpoints are available", func(ctx context.Context) (bool, error) {
+		states, err := vpcEndpoints(ctx, sess, base)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range vpcEndpointServices(e) {
+			if states[s.serviceName(base.AwsRegion)] != ec2.StateAvailable {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, 0, 10*time.Second)
+}
+
+// subnetRouteTables returns the route tables explicitly associated with the subnets.
+func subnetRouteTables(ctx context.Context, sess *session.Session, subnets []string) ([]string, error) {
+	out, err := ec2.New(sess).DescribeRouteTablesWithContext(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("association.subnet-id"), Values: aws.StringSlice(subnets)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe route tables: %w", err)
+	}
+	var ids []string
+	for _, rt := range out.RouteTables {
+		ids = append(ids, aws.StringValue(rt.RouteTableId))
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no route tables associated with subnets %s", strings.Join(subnets, ", "))
+	}
+	return ids, nil
+}
+
+// preflightVpcEndpoints checks that the private subnets are known and reports the endpoints
+// that deploying the experiment will create.
+func preflightVpcEndpoints(ctx context.Context, sess *session.Session, base *BaseInfra, e *exp.Experiment) PreflightResult {
+	const check = "vpc endpoints for private networking exist"
+	if len(base.VpcPrivateSubnets) == 0 {
+		return PreflightResult{Check: check, Err: fmt.Errorf("no private subnets are listed in infra.json")}
+	}
+	missing, err := missingVpcEndpoints(ctx, sess, base, e)
+	if err != nil {
+		return PreflightResult{Check: check, Err: err}
+	}
+	if len(missing) > 0 {
+		names := make([]string, len(missing))
+		for i, s := range missing {
+			names[i] = s.Name
+		}
+		return PreflightResult{Check: check, Err: fmt.Errorf("endpoints for %s will be created when the experiment is deployed", strings.Join(names, ", ")), Warning: true}
+	}
+	return PreflightResult{Check: check}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -115,6 +116,24 @@ func findQueue(queueName string, sess *session.Session) (string, string, error)
 	return *queueArn, *out.QueueUrl, nil
 }
 
+// findTable returns the status of the named dynamodb table, or an empty string if it does not exist.
+func findTable(tableName string, sess *session.Session) (string, error) {
+	svc := dynamodb.New(sess)
+	out, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		if _, ok := err.(*dynamodb.ResourceNotFoundException); ok {
+			return "", nil
+		}
+		return "", fmt.Errorf("describe table: %w", err)
+	}
+	if out.Table == nil || out.Table.TableStatus == nil {
+		return "", nil
+	}
+	return *out.Table.TableStatus, nil
+}
+
 func findSubscription(topicArn string, queueArn string, sess *session.Session) (string, error) {
 	logger := slog.With("topic_arn", topicArn, "queue_arn", queueArn)
 	logger.Debug("finding subscription")
@@ -0,0 +1,265 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// forceStepTimeout is the maximum time a single step of a forced teardown may take before
+// it is abandoned and the next step is attempted.
+const forceStepTimeout = 5 * time.Minute
+
+// ForceTeardown removes an experiment's resources, resolving the dependencies that can
+// leave resources stuck after a normal teardown. Deletions are ordered so that nothing is
+// removed while something else still depends on it: dealgood is stopped before the
+// targets it sends requests to, queues are unsubscribed before their consumer is stopped
+// and purged before deletion, and task definitions are deregistered only once their tasks
+// have fully stopped. Every step is attempted even if earlier ones fail.
+func (p *Provider) ForceTeardown(ctx context.Context, e *exp.Experiment) error {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return fmt.Errorf("failed to read base infra: %w", err)
+	}
+	if err := base.Verify(ctx); err != nil {
+		return fmt.Errorf("failed to verify base infra: %w", err)
+	}
+
+	var errs []error
+	d := NewDealgood(e.Name, base).WithTransport(e.Transport).WithWorkload(e.Workload, nil)
+	if err := d.ForceTeardown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to force teardown of dealgood: %w", err))
+	}
+
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		if err := NewSeeder(e.Name, base).ForceTeardown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to force teardown of seeder: %w", err))
+		}
+	}
+	for _, p := range ContentProviders(e, base) {
+		if err := p.ForceTeardown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to force teardown of %s: %w", p.ComponentName(), err))
+		}
+	}
+
+	cluster := p.experimentCluster(ctx, e, base)
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		target := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
+		target.ec2 = t.EC2
+		target.cluster = cluster
+		if err := target.ForceTeardown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to force teardown of %s: %w", target.ComponentName(), err))
+		}
+	}
+
+	// placement groups can only be deleted once the instances launched in them have terminated
+	for _, g := range PlacementGroups(e.Name, base, e.Targets) {
+		if err := g.ForceTeardown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to force teardown of %s: %w", g.ComponentName(), err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ForceTaskSequence executes each task in turn, limiting each to forceStepTimeout. Unlike
+// TaskSequence it continues after a task fails and returns all the errors encountered.
+func ForceTaskSequence(ctx context.Context, sess *session.Session, component string, tasks ...Task) error {
+	var errs []error
+	for _, task := range tasks {
+		tctx, cancel := context.WithTimeout(ctx, forceStepTimeout)
+		err := ExecuteTask(tctx, sess, component, task)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			slog.Warn("step failed, continuing with teardown", "component", component, "step", task.Name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stopFamilyTasks stops every task in the task definition family and waits until they have
+// fully stopped, not just been asked to stop.
+func stopFamilyTasks(clusterArn, family string) Task {
+	return Task{
+		Name: "stop all tasks",
+		Check: Check{
+			Name:        "all tasks are stopped",
+			FailureText: "some tasks are not stopped",
+			Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+				return isTaskStopped(ctx, sess, clusterArn, family)
+			},
+		},
+		Func: func(ctx context.Context, sess *session.Session) error {
+			svc := ecs.New(sess)
+			var arns []*string
+			err := svc.ListTasksPagesWithContext(ctx, &ecs.ListTasksInput{
+				Cluster: aws.String(clusterArn),
+				Family:  aws.String(family),
+			}, func(out *ecs.ListTasksOutput, last bool) bool {
+				arns = append(arns, out.TaskArns...)
+				return true
+			})
+			if err != nil {
+				return fmt.Errorf("list tasks: %w", err)
+			}
+			for _, arn := range arns {
+				if err := stopEcsTask(ctx, sess, clusterArn, aws.StringValue(arn)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// deregisterFamilyTaskDefinitions deregisters every active revision of the task definition
+// family, not only the latest.
+func deregisterFamilyTaskDefinitions(family string) Task {
+	return Task{
+		Name: "deregister all task definitions",
+		Check: Check{
+			Name:        "all task definitions are inactive",
+			FailureText: "some task definitions are active",
+			Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+				arns, err := findActiveTaskDefinitions(ctx, sess, family)
+				if err != nil {
+					return false, err
+				}
+				return len(arns) == 0, nil
+			},
+		},
+		Func: func(ctx context.Context, sess *session.Session) error {
+			arns, err := findActiveTaskDefinitions(ctx, sess, family)
+			if err != nil {
+				return err
+			}
+			for _, arn := range arns {
+				if err := deregisterEcsTaskDefinition(ctx, sess, arn); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// findActiveTaskDefinitions returns the arns of all active revisions of the task definition
+// family. Families that merely share the prefix are excluded.
+func findActiveTaskDefinitions(ctx context.Context, sess *session.Session, family string) ([]string, error) {
+	var arns []string
+	err := ecs.New(sess).ListTaskDefinitionsPagesWithContext(ctx, &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Status:       aws.String(ecs.TaskDefinitionStatusActive),
+	}, func(out *ecs.ListTaskDefinitionsOutput, last bool) bool {
+		for _, arn := range out.TaskDefinitionArns {
+			if strings.HasSuffix(strings.TrimRightFunc(aws.StringValue(arn), isDigit), "/"+family+":") {
+				arns = append(arns, aws.StringValue(arn))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list task definitions: %w", err)
+	}
+	return arns, nil
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+// unsubscribeQueue removes the topic's subscription for the named queue, matching it by name
+// so that it can be removed even if the queue has already been deleted.
+func unsubscribeQueue(topicArn, queueName string) Task {
+	return Task{
+		Name: "unsubscribe request queue",
+		Check: Check{
+			Name:        "request queue subscription does not exist",
+			FailureText: "request queue subscription exists",
+			Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+				arn, err := findQueueSubscription(ctx, sess, topicArn, queueName)
+				return arn == "", err
+			},
+		},
+		Func: func(ctx context.Context, sess *session.Session) error {
+			arn, err := findQueueSubscription(ctx, sess, topicArn, queueName)
+			if err != nil || arn == "" {
+				return err
+			}
+			return unsubscribeSqsQueue(ctx, sess, arn)
+		},
+	}
+}
+
+// purgeQueue deletes all messages in the named queue, including those in flight. It is only
+// safe once the queue has been unsubscribed and its consumer stopped.
+func purgeQueue(queueName string) Task {
+	return Task{
+		Name: "purge request queue",
+		Check: Check{
+			Name:        "request queue is empty",
+			FailureText: "request queue has messages",
+			Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+				n, err := queueMessageCount(ctx, sess, queueName)
+				return n == 0, err
+			},
+		},
+		Func: func(ctx context.Context, sess *session.Session) error {
+			_, queueURL, err := findQueue(queueName, sess)
+			if err != nil || queueURL == "" {
+				return err
+			}
+			if _, err := sqs.New(sess).PurgeQueueWithContext(ctx, &sqs.PurgeQueueInput{QueueUrl: aws.String(queueURL)}); err != nil {
+				return fmt.Errorf("purge queue: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+// queueMessageCount returns the approximate number of visible and in flight messages in the
+// named queue, or zero if the queue does not exist.
+func queueMessageCount(ctx context.Context, sess *session.Session, queueName string) (int, error) {
+	_, queueURL, err := findQueue(queueName, sess)
+	if err != nil || queueURL == "" {
+		return 0, err
+	}
+	out, err := sqs.New(sess).GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(queueURL),
+		AttributeNames: aws.StringSlice([]string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages,
+			sqs.QueueAttributeNameApproximateNumberOfMessagesNotVisible,
+		}),
+	})
+	if err != nil {
+		if sqsIsQueueDoesNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("get queue attributes: %w", err)
+	}
+	total := 0
+	for _, v := range out.Attributes {
+		n, err := strconv.Atoi(aws.StringValue(v))
+		if err != nil {
+			return 0, fmt.Errorf("parse queue attribute: %w", err)
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,40 @@
+package infra
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// newSwarmKey returns a new key for a private libp2p network in the format of kubo's swarm.key.
+// Nodes only connect to peers holding the same key, so a key generated for an experiment
+// isolates its targets and content providers from the public network.
+func newSwarmKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("generate swarm key: %w", err)
+	}
+	return "/key/swarm/psk/1.0.0/\n/base16/\n" + hex.EncodeToString(key), nil
+}
+
+// hermeticEgress returns the egress rules of a target in a hermetic experiment, which only
+// allow the target's HTTP traffic to reach the content providers at the given urls. Upstreams
+// and denied hosts are kept from the experiment's own rules.
+func hermeticEgress(e *exp.EgressSpec, providerURLs []string) (*exp.EgressSpec, error) {
+	h := &exp.EgressSpec{}
+	if e != nil {
+		h.Upstreams = e.Upstreams
+		h.Deny = e.Deny
+	}
+	for _, pu := range providerURLs {
+		u, err := url.Parse(pu)
+		if err != nil {
+			return nil, fmt.Errorf("provider url: %w", err)
+		}
+		h.Allow = append(h.Allow, u.Hostname())
+	}
+	return h, nil
+}
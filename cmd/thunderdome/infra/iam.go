@@ -0,0 +1,491 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Components that policies can be generated for. The deployer is the user or role running
+// thunderdome.
+const (
+	PolicyComponentIronbar  = "ironbar"
+	PolicyComponentDealgood = "dealgood"
+	PolicyComponentSkyfish  = "skyfish"
+	PolicyComponentDeployer = "deployer"
+)
+
+// PolicyComponents lists the components that policies can be generated for.
+var PolicyComponents = []string{PolicyComponentIronbar, PolicyComponentDealgood, PolicyComponentSkyfish, PolicyComponentDeployer}
+
+// PolicyName is the name of the inline policy that ApplyPolicy puts on a component's role.
+const PolicyName = "thunderdome-least-privilege"
+
+// configBucket is the bucket holding the infra.json written by terraform, see NewBaseInfra.
+const configBucket = "pl-thunderdome-private"
+
+// PolicyParams holds the account and resources that generated policies are scoped to.
+type PolicyParams struct {
+	Partition        string
+	Region           string
+	Account          string
+	ClusterArns      []string // clusters experiments are deployed to
+	TopicArn         string   // sns topic skyfish publishes requests to
+	StreamName       string   // optional kinesis stream carrying the same requests
+	ExperimentsTable string
+	LogGroup         string
+	ArchiveBucket    string   // optional bucket ironbar archives records to
+	DumpsBucket      string   // optional bucket ironbar writes crash dumps to
+	PassRoleArns     []string // roles given to the tasks and instances of experiments
+	KmsKeyArns       []string // customer managed keys encrypting experiments' resources, if any
+}
+
+// A PolicyDocument is an IAM policy in the form accepted by the IAM API.
+type PolicyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []PolicyStatement `json:"Statement"`
+}
+
+type PolicyStatement struct {
+	Sid       string                         `json:"Sid,omitempty"`
+	Effect    string                         `json:"Effect"`
+	Action    []string                       `json:"Action"`
+	Resource  []string                       `json:"Resource"`
+	Condition map[string]map[string][]string `json:"Condition,omitempty"`
+}
+
+// PolicyParams returns the parameters of the policies for the base infrastructure, using the
+// account of the caller.
+func (p *Provider) PolicyParams(ctx context.Context) (*PolicyParams, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(p.region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+	ident, err := sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("get caller identity: %w", err)
+	}
+	caller, err := arn.Parse(aws.StringValue(ident.Arn))
+	if err != nil {
+		return nil, fmt.Errorf("parse caller arn: %w", err)
+	}
+
+	params := &PolicyParams{
+		Partition:        caller.Partition,
+		Region:           base.AwsRegion,
+		Account:          aws.StringValue(ident.Account),
+		ClusterArns:      []string{base.EcsClusterArn},
+		TopicArn:         base.RequestSNSTopicArn,
+		StreamName:       base.RequestKinesisStreamName,
+		ExperimentsTable: base.ExperimentsTableName,
+		LogGroup:         base.LogGroupName,
+	}
+	if base.KmsKeyArn != "" {
+		params.KmsKeyArns = []string{base.KmsKeyArn}
+	}
+	for _, c := range base.Clusters {
+		if c.Arn != "" && c.Arn != base.EcsClusterArn {
+			params.ClusterArns = append(params.ClusterArns, c.Arn)
+		}
+	}
+	sort.Strings(params.ClusterArns[1:])
+
+	roles := []string{base.EcsExecutionRoleArn, base.DealgoodTaskRoleArn, base.TargetTaskRoleArn}
+	if base.TargetInstanceProfileArn != "" {
+		// instance profiles are passed by the role they contain, which terraform names the same
+		roles = append(roles, strings.Replace(base.TargetInstanceProfileArn, ":instance-profile/", ":role/", 1))
+	}
+	for _, r := range roles {
+		if r != "" {
+			params.PassRoleArns = append(params.PassRoleArns, r)
+		}
+	}
+	return params, nil
+}
+
+// Validate checks that the parameters needed by every policy are present.
+func (pp *PolicyParams) Validate() error {
+	switch {
+	case pp.Partition == "":
+		return fmt.Errorf("partition must be supplied")
+	case pp.Region == "":
+		return fmt.Errorf("region must be supplied")
+	case pp.Account == "":
+		return fmt.Errorf("account must be supplied")
+	case len(pp.ClusterArns) == 0:
+		return fmt.Errorf("at least one cluster arn must be supplied")
+	case pp.TopicArn == "":
+		return fmt.Errorf("topic arn must be supplied")
+	case pp.ExperimentsTable == "":
+		return fmt.Errorf("experiments table must be supplied")
+	case pp.LogGroup == "":
+		return fmt.Errorf("log group must be supplied")
+	}
+	for _, c := range pp.ClusterArns {
+		if _, err := clusterName(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Policy returns the least privileged policy allowing a component to make the AWS API calls
+// its code makes. Resources created for experiments are matched by the suffixes thunderdome
+// names them with, or by their experiment tag where the action supports conditions on tags.
+func (pp *PolicyParams) Policy(component string) (*PolicyDocument, error) {
+	if err := pp.Validate(); err != nil {
+		return nil, err
+	}
+	var stmts []PolicyStatement
+	switch component {
+	case PolicyComponentIronbar:
+		stmts = pp.ironbarStatements()
+	case PolicyComponentDealgood:
+		stmts = pp.dealgoodStatements()
+	case PolicyComponentSkyfish:
+		stmts = pp.skyfishStatements()
+	case PolicyComponentDeployer:
+		stmts = pp.deployerStatements()
+	default:
+		return nil, fmt.Errorf("unknown component %q, must be one of %s", component, strings.Join(PolicyComponents, ", "))
+	}
+	return &PolicyDocument{Version: "2012-10-17", Statement: stmts}, nil
+}
+
+func (pp *PolicyParams) ironbarStatements() []PolicyStatement {
+	stmts := []PolicyStatement{
+		allow("ExperimentsTable", []string{
+			"dynamodb:DeleteItem",
+			"dynamodb:GetItem",
+			"dynamodb:PutItem",
+			"dynamodb:Scan",
+			"dynamodb:UpdateItem",
+		}, pp.arn("dynamodb", "table/"+pp.ExperimentsTable)),
+		allow("CheckpointTables", []string{
+			"dynamodb:DeleteTable",
+			"dynamodb:DescribeTable",
+		}, pp.checkpointTables()),
+		allow("TaskDefinitions", []string{
+			"ecs:DeregisterTaskDefinition",
+			"ecs:DescribeTaskDefinition",
+			"ecs:RegisterTaskDefinition",
+		}, "*"),
+		pp.runTask(),
+		allow("Tasks", []string{
+			"ecs:DescribeContainerInstances",
+			"ecs:DescribeTasks",
+			"ecs:StopTask",
+		}, pp.clusterResources()...),
+		pp.passRole(),
+		allow("DescribeInstances", []string{
+			"ec2:DescribeInstances",
+			"ec2:DescribePlacementGroups",
+		}, "*"),
+		withExperimentTag(allow("ExperimentInstances", []string{
+			"ec2:DeletePlacementGroup",
+			"ec2:TerminateInstances",
+		}, pp.arn("ec2", "instance/*"), pp.arn("ec2", "placement-group/*"))),
+		allow("Images", []string{
+			"ecr:BatchGetImage",
+			"ecr:GetDownloadUrlForLayer",
+		}, pp.arn("ecr", "repository/*")),
+		allow("Logs", []string{
+			"logs:FilterLogEvents",
+			"logs:GetLogEvents",
+		}, pp.logGroup()),
+		allow("Subscriptions", []string{
+			"sns:GetSubscriptionAttributes",
+			"sns:Unsubscribe",
+		}, pp.TopicArn, pp.TopicArn+":*"),
+		allow("RequestQueues", []string{
+			"sqs:DeleteQueue",
+			"sqs:GetQueueAttributes",
+			"sqs:GetQueueUrl",
+		}, pp.requestQueues()),
+		// adopting resources searches every tagged resource, which cannot be scoped
+		allow("AdoptResources", []string{"tag:GetResources"}, "*"),
+	}
+
+	var buckets []string
+	for _, b := range []string{pp.ArchiveBucket, pp.DumpsBucket} {
+		if b != "" {
+			buckets = append(buckets, "arn:"+pp.Partition+":s3:::"+b+"/*")
+		}
+	}
+	if len(buckets) > 0 {
+		stmts = append(stmts, allow("Buckets", []string{"s3:PutObject"}, buckets...))
+		if len(pp.KmsKeyArns) > 0 {
+			stmts = append(stmts, allow("EncryptObjects", []string{"kms:GenerateDataKey"}, pp.KmsKeyArns...))
+		}
+	}
+	return stmts
+}
+
+func (pp *PolicyParams) dealgoodStatements() []PolicyStatement {
+	stmts := []PolicyStatement{
+		allow("RequestQueue", []string{
+			"sqs:DeleteMessage",
+			"sqs:GetQueueUrl",
+			"sqs:ReceiveMessage",
+		}, pp.requestQueues()),
+	}
+	if len(pp.KmsKeyArns) > 0 {
+		stmts = append(stmts, allow("DecryptRequests", []string{"kms:Decrypt"}, pp.KmsKeyArns...))
+	}
+	if pp.StreamName != "" {
+		stmts = append(stmts,
+			allow("RequestStream", []string{
+				"kinesis:GetRecords",
+				"kinesis:GetShardIterator",
+				"kinesis:ListShards",
+			}, pp.stream()),
+			allow("CheckpointTable", []string{
+				"dynamodb:GetItem",
+				"dynamodb:PutItem",
+			}, pp.checkpointTables()),
+		)
+	}
+	return stmts
+}
+
+func (pp *PolicyParams) skyfishStatements() []PolicyStatement {
+	stmts := []PolicyStatement{
+		allow("RequestTopic", []string{"sns:Publish"}, pp.TopicArn),
+	}
+	if pp.StreamName != "" {
+		stmts = append(stmts, allow("RequestStream", []string{"kinesis:PutRecord"}, pp.stream()))
+	}
+	if len(pp.KmsKeyArns) > 0 {
+		// publishing to a topic encrypted with the key
+		stmts = append(stmts, allow("EncryptRequests", []string{"kms:Decrypt", "kms:GenerateDataKey"}, pp.KmsKeyArns...))
+	}
+	return stmts
+}
+
+func (pp *PolicyParams) deployerStatements() []PolicyStatement {
+	stmts := []PolicyStatement{
+		allow("Config", []string{"s3:GetObject"}, "arn:"+pp.Partition+":s3:::"+configBucket+"/*"),
+		allow("Describe", []string{
+			"autoscaling:DescribeAutoScalingGroups",
+			"ec2:DescribeInstanceTypes",
+			"ec2:DescribeInstances",
+			"ec2:DescribeNetworkInterfaces",
+			"ec2:DescribePlacementGroups",
+			"ec2:DescribeRouteTables",
+			"ec2:DescribeSubnets",
+			"ec2:DescribeVpcEndpoints",
+			"ecs:DescribeCapacityProviders",
+			"ecs:ListTaskDefinitions",
+			"servicequotas:GetAWSDefaultServiceQuota",
+			"servicequotas:GetServiceQuota",
+		}, "*"),
+		allow("TaskDefinitions", []string{
+			"ecs:DeregisterTaskDefinition",
+			"ecs:DescribeTaskDefinition",
+			"ecs:RegisterTaskDefinition",
+		}, "*"),
+		pp.runTask(),
+		allow("Clusters", []string{
+			"ecs:DescribeClusters",
+			"ecs:DescribeContainerInstances",
+			"ecs:DescribeTasks",
+			"ecs:ListContainerInstances",
+			"ecs:ListTasks",
+			"ecs:StopTask",
+		}, pp.clusterResources()...),
+		pp.passRole(),
+		// instances and placement groups are tagged as they are created
+		allow("CreateInstances", []string{
+			"ec2:CreatePlacementGroup",
+			"ec2:CreateTags",
+			"ec2:RunInstances",
+		}, "*"),
+		withExperimentTag(allow("ExperimentInstances", []string{
+			"ec2:DeletePlacementGroup",
+			"ec2:TerminateInstances",
+		}, pp.arn("ec2", "instance/*"), pp.arn("ec2", "placement-group/*"))),
+		// endpoints for private networking are created on first use, private dns needs the hosted zone association
+		allow("VpcEndpoints", []string{
+			"ec2:CreateVpcEndpoint",
+			"route53:AssociateVPCWithHostedZone",
+		}, "*"),
+		// the target's network interface is only known once its task has started
+		allow("NetworkInterfaces", []string{"ec2:ModifyNetworkInterfaceAttribute"}, pp.arn("ec2", "network-interface/*")),
+		allow("PushImages", []string{
+			"ecr:BatchCheckLayerAvailability",
+			"ecr:CompleteLayerUpload",
+			"ecr:DescribeImages",
+			"ecr:InitiateLayerUpload",
+			"ecr:PutImage",
+			"ecr:UploadLayerPart",
+		}, pp.arn("ecr", "repository/*")),
+		allow("EcrLogin", []string{"ecr:GetAuthorizationToken"}, "*"),
+		allow("RequestTopic", []string{
+			"sns:GetTopicAttributes",
+			"sns:ListSubscriptionsByTopic",
+			"sns:Subscribe",
+			"sns:Unsubscribe",
+		}, pp.TopicArn, pp.TopicArn+":*"),
+		allow("RequestQueues", []string{
+			"sqs:CreateQueue",
+			"sqs:DeleteQueue",
+			"sqs:GetQueueAttributes",
+			"sqs:GetQueueUrl",
+			"sqs:PurgeQueue",
+			"sqs:SetQueueAttributes",
+		}, pp.requestQueues()),
+		allow("CheckpointTables", []string{
+			"dynamodb:CreateTable",
+			"dynamodb:DeleteTable",
+			"dynamodb:DescribeTable",
+		}, pp.checkpointTables()),
+		allow("Secrets", []string{"secretsmanager:GetSecretValue"}, pp.arn("secretsmanager", "secret:*")),
+		allow("Parameters", []string{"ssm:GetParameter"}, pp.arn("ssm", "parameter/*")),
+		// preflight checks simulate deployActions against the caller's own policies
+		allow("Preflight", []string{"iam:SimulatePrincipalPolicy"}, "arn:"+pp.Partition+":iam::"+pp.Account+":*"),
+	}
+	if pp.StreamName != "" {
+		stmts = append(stmts, allow("RequestStream", []string{"kinesis:DescribeStreamSummary"}, pp.stream()))
+	}
+	if len(pp.KmsKeyArns) > 0 {
+		// checkpoint tables encrypted with a customer managed key need a grant for dynamodb
+		stmts = append(stmts, allow("Keys", []string{
+			"kms:CreateGrant",
+			"kms:DescribeKey",
+			"kms:GetKeyPolicy",
+		}, pp.KmsKeyArns...))
+	}
+	return stmts
+}
+
+// runTask allows tasks to be run from any task definition, but only in the given clusters.
+func (pp *PolicyParams) runTask() PolicyStatement {
+	s := allow("RunTask", []string{"ecs:RunTask"}, pp.arn("ecs", "task-definition/*"))
+	s.Condition = map[string]map[string][]string{
+		"ArnEquals": {"ecs:cluster": pp.ClusterArns},
+	}
+	return s
+}
+
+func (pp *PolicyParams) passRole() PolicyStatement {
+	s := allow("PassRole", []string{"iam:PassRole"}, pp.PassRoleArns...)
+	if len(pp.PassRoleArns) == 0 {
+		s.Resource = []string{"arn:" + pp.Partition + ":iam::" + pp.Account + ":role/*"}
+	}
+	s.Condition = map[string]map[string][]string{
+		"StringEquals": {"iam:PassedToService": {"ecs-tasks.amazonaws.com", "ec2.amazonaws.com"}},
+	}
+	return s
+}
+
+// clusterResources returns the clusters and the tasks and container instances in them.
+func (pp *PolicyParams) clusterResources() []string {
+	var res []string
+	for _, c := range pp.ClusterArns {
+		name, _ := clusterName(c)
+		res = append(res, c, pp.arn("ecs", "task/"+name+"/*"), pp.arn("ecs", "container-instance/"+name+"/*"))
+	}
+	return res
+}
+
+// requestQueues matches the queues dealgood reads requests from, named after their experiment.
+func (pp *PolicyParams) requestQueues() string {
+	return "arn:" + pp.Partition + ":sqs:" + pp.Region + ":" + pp.Account + ":*-dealgood-requests"
+}
+
+// checkpointTables matches the tables dealgood records its position in the stream in.
+func (pp *PolicyParams) checkpointTables() string {
+	return pp.arn("dynamodb", "table/*-dealgood-checkpoints")
+}
+
+func (pp *PolicyParams) stream() string {
+	return pp.arn("kinesis", "stream/"+pp.StreamName)
+}
+
+func (pp *PolicyParams) logGroup() string {
+	return pp.arn("logs", "log-group:"+pp.LogGroup+":*")
+}
+
+func (pp *PolicyParams) arn(service, resource string) string {
+	return arn.ARN{
+		Partition: pp.Partition,
+		Service:   service,
+		Region:    pp.Region,
+		AccountID: pp.Account,
+		Resource:  resource,
+	}.String()
+}
+
+func clusterName(clusterArn string) (string, error) {
+	a, err := arn.Parse(clusterArn)
+	if err != nil || !strings.HasPrefix(a.Resource, "cluster/") {
+		return "", fmt.Errorf("invalid cluster arn: %q", clusterArn)
+	}
+	return strings.TrimPrefix(a.Resource, "cluster/"), nil
+}
+
+func allow(sid string, actions []string, resources ...string) PolicyStatement {
+	return PolicyStatement{Sid: sid, Effect: "Allow", Action: actions, Resource: resources}
+}
+
+// withExperimentTag restricts a statement to resources tagged with the experiment they belong to.
+func withExperimentTag(s PolicyStatement) PolicyStatement {
+	s.Condition = map[string]map[string][]string{
+		"Null": {"aws:ResourceTag/experiment": {"false"}},
+	}
+	return s
+}
+
+// ApplyPolicy puts a policy inline on the role of a component, replacing any earlier version.
+// The deployer's policy is put on the group of deploying users.
+func (p *Provider) ApplyPolicy(ctx context.Context, component, roleOrGroup string, doc *PolicyDocument) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("encode policy: %w", err)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(p.region),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	svc := iam.New(sess)
+
+	if component == PolicyComponentDeployer {
+		_, err = svc.PutGroupPolicyWithContext(ctx, &iam.PutGroupPolicyInput{
+			GroupName:      aws.String(roleOrGroup),
+			PolicyName:     aws.String(PolicyName),
+			PolicyDocument: aws.String(string(data)),
+		})
+		if err != nil {
+			return fmt.Errorf("put group policy: %w", err)
+		}
+		return nil
+	}
+
+	_, err = svc.PutRolePolicyWithContext(ctx, &iam.PutRolePolicyInput{
+		RoleName:       aws.String(roleOrGroup),
+		PolicyName:     aws.String(PolicyName),
+		PolicyDocument: aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("put role policy: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,625 @@
+package infra
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// targetAttribute is the ecs container instance attribute naming the target an ec2 instance
+// was launched for. The target's task is constrained to run on the instance carrying it.
+const targetAttribute = "thunderdome.target"
+
+// ecsOptimizedAmiParameter is the ssm parameter holding the id of the current ecs optimized
+// image, the same image used by the auto scaling groups of the capacity providers.
+const ecsOptimizedAmiParameter = "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended/image_id"
+
+// targetUserData configures the ecs agent of an instance launched for a single target. It is
+// formatted with the cluster name, the attribute name and the target's task name.
+const targetUserData = `#!/bin/bash
+cat <<'EOF' >> /etc/ecs/ecs.config
+ECS_CLUSTER=%s
+ECS_INSTANCE_ATTRIBUTES={"%s":"%s"}
+EOF
+`
+
+// instanceStorageUserData keeps docker volumes, which hold the gateway's data, on the first
+// NVMe instance store device, as the capacity providers' instances do.
+const instanceStorageUserData = `dev=$(lsblk -dpno NAME,MODEL | awk '/Instance Storage/ {print $1; exit}')
+mkfs.xfs -f "$dev"
+mkdir -p /var/lib/docker/volumes
+mount "$dev" /var/lib/docker/volumes
+systemctl enable fstrim.timer
+systemctl start fstrim.timer
+`
+
+// describeInstanceType returns the details of an ec2 instance type.
+func describeInstanceType(sess *session.Session, name string) (*ec2.InstanceTypeInfo, error) {
+	out, err := ec2.New(sess).DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe instance types: %w", err)
+	}
+	if len(out.InstanceTypes) != 1 || out.InstanceTypes[0] == nil {
+		return nil, fmt.Errorf("unknown instance type %q", name)
+	}
+	return out.InstanceTypes[0], nil
+}
+
+// checkInstanceType checks that an instance type can run a target and supports the settings
+// asked for by the target's ec2 spec.
+func checkInstanceType(info *ec2.InstanceTypeInfo, spec *exp.EC2Spec) error {
+	if info.ProcessorInfo == nil || !contains(info.ProcessorInfo.SupportedArchitectures, ec2.ArchitectureTypeX8664) {
+		return fmt.Errorf("instance type %s does not support x86_64, which target images are built for", spec.InstanceType)
+	}
+	if spec.EnaExpress && (info.NetworkInfo == nil || !aws.BoolValue(info.NetworkInfo.EnaSrdSupported)) {
+		return fmt.Errorf("instance type %s does not support ENA Express", spec.InstanceType)
+	}
+	if spec.InstanceStorage && !aws.BoolValue(info.InstanceStorageSupported) {
+		return fmt.Errorf("instance type %s has no instance storage", spec.InstanceType)
+	}
+	if spec.PlacementGroup != "" && (info.PlacementGroupInfo == nil || !contains(info.PlacementGroupInfo.SupportedStrategies, spec.PlacementGroup)) {
+		return fmt.Errorf("instance type %s does not support %s placement groups", spec.InstanceType, spec.PlacementGroup)
+	}
+	return nil
+}
+
+func contains(values []*string, v string) bool {
+	for _, s := range values {
+		if aws.StringValue(s) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ecsClusterName returns the name of the ecs cluster with the given arn.
+func ecsClusterName(arn string) string {
+	if i := strings.LastIndex(arn, "/"); i >= 0 {
+		return arn[i+1:]
+	}
+	return arn
+}
+
+// placementExpression returns the ecs placement constraint expression matching the instance
+// launched for the target.
+func (t *Target) placementExpression() string {
+	return fmt.Sprintf("attribute:%s == %s", targetAttribute, t.taskName)
+}
+
+// instanceSubnet returns the subnet the instance launched for the target is placed in, that of
+// the target's availability zone if it was assigned one.
+func (t *Target) instanceSubnet() string {
+	if t.subnet != "" {
+		return t.subnet
+	}
+	return t.base.VpcPublicSubnet
+}
+
+func (t *Target) userData() string {
+	data := fmt.Sprintf(targetUserData, ecsClusterName(t.cluster.Arn), targetAttribute, t.taskName)
+	if t.ec2.InstanceStorage {
+		data += instanceStorageUserData
+	}
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+// findInstance returns the instance launched for the target that is in one of the given
+// states, or nil if there is none.
+func (t *Target) findInstance(sess *session.Session, states ...string) (*ec2.Instance, error) {
+	out, err := ec2.New(sess).DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:experiment"),
+				Values: []*string{aws.String(t.experiment)},
+			},
+			{
+				Name:   aws.String("tag:component"),
+				Values: []*string{aws.String(t.ComponentName())},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice(states),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describe ec2 instances: %w", err)
+	}
+	for _, r := range out.Reservations {
+		for _, in := range r.Instances {
+			if in != nil && in.InstanceId != nil {
+				return in, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (t *Target) launchInstance() Task {
+	return Task{
+		Name:  "launch ec2 instance",
+		Check: t.instanceIsRunning(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			// an instance still starting from an earlier attempt is waited for rather than replaced
+			pending, err := t.findInstance(sess, ec2.InstanceStateNamePending)
+			if err != nil {
+				return err
+			}
+			if pending != nil {
+				return nil
+			}
+
+			info, err := describeInstanceType(sess, t.ec2.InstanceType)
+			if err != nil {
+				return err
+			}
+			if err := checkInstanceType(info, t.ec2); err != nil {
+				return err
+			}
+
+			param, err := ssm.New(sess).GetParameter(&ssm.GetParameterInput{
+				Name: aws.String(ecsOptimizedAmiParameter),
+			})
+			if err != nil {
+				return fmt.Errorf("get ecs optimized image id: %w", err)
+			}
+			if param.Parameter == nil || param.Parameter.Value == nil {
+				return fmt.Errorf("no ecs optimized image id found")
+			}
+
+			tags := t.tags()
+			tags["Name"] = aws.String(t.taskName)
+
+			in := &ec2.RunInstancesInput{
+				ImageId:      param.Parameter.Value,
+				InstanceType: aws.String(t.ec2.InstanceType),
+				MinCount:     aws.Int64(1),
+				MaxCount:     aws.Int64(1),
+				KeyName:      aws.String("thunderdome"),
+				IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
+					Arn: aws.String(t.base.TargetInstanceProfileArn),
+				},
+				UserData:                          aws.String(t.userData()),
+				InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+				NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{
+					{
+						DeviceIndex:              aws.Int64(0),
+						SubnetId:                 aws.String(t.instanceSubnet()),
+						Groups:                   aws.StringSlice(t.base.TargetSecurityGroups),
+						AssociatePublicIpAddress: aws.Bool(!t.base.isPrivateSubnet(t.instanceSubnet())),
+						DeleteOnTermination:      aws.Bool(true),
+					},
+				},
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+					{
+						// Root volume, matching the capacity providers' instances
+						DeviceName: aws.String("/dev/xvda"),
+						Ebs: &ec2.EbsBlockDevice{
+							DeleteOnTermination: aws.Bool(true),
+							VolumeSize:          aws.Int64(200),
+							VolumeType:          aws.String(ec2.VolumeTypeGp3),
+							Iops:                aws.Int64(200 * 50),
+							Throughput:          aws.Int64(1000),
+						},
+					},
+				},
+				TagSpecifications: []*ec2.TagSpecification{
+					{
+						ResourceType: aws.String(ec2.ResourceTypeInstance),
+						Tags:         ec2Tags(tags),
+					},
+					{
+						ResourceType: aws.String(ec2.ResourceTypeVolume),
+						Tags:         ec2Tags(tags),
+					},
+				},
+			}
+			if t.ec2.PlacementGroup != "" || t.ec2.Tenancy != "" {
+				in.Placement = &ec2.Placement{}
+				if t.ec2.PlacementGroup != "" {
+					in.Placement.GroupName = aws.String(placementGroupName(t.experiment, t.ec2.PlacementGroup))
+				}
+				if t.ec2.Tenancy != "" {
+					in.Placement.Tenancy = aws.String(t.ec2.Tenancy)
+				}
+			}
+
+			out, err := ec2.New(sess).RunInstances(in)
+			if err != nil {
+				return fmt.Errorf("run instances: %w", err)
+			}
+			if len(out.Instances) != 1 || out.Instances[0] == nil {
+				return fmt.Errorf("unexpected number of instances: %d", len(out.Instances))
+			}
+			slog.Debug("launched ec2 instance", "component", t.ComponentName(), "ec2_instance_id", dstr(out.Instances[0].InstanceId))
+			return nil
+		},
+	}
+}
+
+func (t *Target) instanceIsRunning() Check {
+	return Check{
+		Name:        "ec2 instance is running",
+		FailureText: "ec2 instance is not running",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			in, err := t.findInstance(sess, ec2.InstanceStateNameRunning)
+			if err != nil {
+				return false, err
+			}
+			return in != nil, nil
+		},
+	}
+}
+
+// enableEnaExpress turns on ENA Express, for both tcp and udp, on the primary network
+// interface of the instance launched for the target.
+func (t *Target) enableEnaExpress() Task {
+	return Task{
+		Name:  "enable ena express",
+		Check: t.enaExpressIsEnabled(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			eni, err := t.primaryNetworkInterface(sess)
+			if err != nil {
+				return err
+			}
+			_, err = ec2.New(sess).ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+				NetworkInterfaceId: aws.String(eni),
+				EnaSrdSpecification: &ec2.EnaSrdSpecification{
+					EnaSrdEnabled: aws.Bool(true),
+					EnaSrdUdpSpecification: &ec2.EnaSrdUdpSpecification{
+						EnaSrdUdpEnabled: aws.Bool(true),
+					},
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("modify network interface attribute: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+func (t *Target) enaExpressIsEnabled() Check {
+	return Check{
+		Name:        "ena express is enabled",
+		FailureText: "ena express is not enabled",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			eni, err := t.primaryNetworkInterface(sess)
+			if err != nil {
+				return false, err
+			}
+			out, err := ec2.New(sess).DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+				NetworkInterfaceIds: []*string{aws.String(eni)},
+			})
+			if err != nil {
+				return false, fmt.Errorf("describe network interfaces: %w", err)
+			}
+			for _, ni := range out.NetworkInterfaces {
+				if ni.Attachment != nil && ni.Attachment.EnaSrdSpecification != nil && aws.BoolValue(ni.Attachment.EnaSrdSpecification.EnaSrdEnabled) {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+	}
+}
+
+func (t *Target) primaryNetworkInterface(sess *session.Session) (string, error) {
+	in, err := t.findInstance(sess, ec2.InstanceStateNameRunning)
+	if err != nil {
+		return "", err
+	}
+	if in == nil {
+		return "", fmt.Errorf("no running ec2 instance found")
+	}
+	for _, ni := range in.NetworkInterfaces {
+		if ni.Attachment != nil && aws.Int64Value(ni.Attachment.DeviceIndex) == 0 && ni.NetworkInterfaceId != nil {
+			return *ni.NetworkInterfaceId, nil
+		}
+	}
+	return "", fmt.Errorf("no primary network interface found for instance %s", dstr(in.InstanceId))
+}
+
+// registerContainerInstance waits for the ecs agent of the instance launched for the target
+// to register it with the cluster.
+func (t *Target) registerContainerInstance() Task {
+	return Task{
+		Name:  "register container instance",
+		Check: t.containerInstanceIsRegistered(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			// nothing to do, the ecs agent registers the instance once it has started
+			return nil
+		},
+	}
+}
+
+func (t *Target) containerInstanceIsRegistered() Check {
+	return Check{
+		Name:        "container instance is registered",
+		FailureText: "container instance is not registered",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			out, err := ecs.New(sess).ListContainerInstances(&ecs.ListContainerInstancesInput{
+				Cluster: aws.String(t.cluster.Arn),
+				Filter:  aws.String(t.placementExpression()),
+				Status:  aws.String(ecs.ContainerInstanceStatusActive),
+			})
+			if err != nil {
+				return false, fmt.Errorf("list container instances: %w", err)
+			}
+			return len(out.ContainerInstanceArns) > 0, nil
+		},
+	}
+}
+
+func (t *Target) terminateInstance() Task {
+	return Task{
+		Name:  "terminate ec2 instance",
+		Check: t.instanceIsTerminated(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			in, err := t.findInstance(sess, ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped)
+			if err != nil {
+				return err
+			}
+			if in == nil {
+				return nil
+			}
+			return terminateEc2Instance(ctx, sess, *in.InstanceId)
+		},
+	}
+}
+
+func (t *Target) instanceIsTerminated() Check {
+	return Check{
+		Name:        "ec2 instance is terminated",
+		FailureText: "ec2 instance is not terminated",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			in, err := t.findInstance(sess, ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning, ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped)
+			if err != nil {
+				return false, err
+			}
+			return in == nil, nil
+		},
+	}
+}
+
+func terminateEc2Instance(ctx context.Context, sess *session.Session, instanceID string) error {
+	in := &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	}
+	if _, err := ec2.New(sess).TerminateInstancesWithContext(ctx, in); err != nil {
+		return fmt.Errorf("terminate instances: %w", err)
+	}
+	return nil
+}
+
+// placementGroupName returns the name of the placement group shared by an experiment's
+// instances that use the given strategy.
+func placementGroupName(experiment, strategy string) string {
+	return experiment + "-" + strategy
+}
+
+// A PlacementGroup is an ec2 placement group shared by the instances launched for the targets
+// of an experiment that ask for the same placement strategy.
+type PlacementGroup struct {
+	name       string
+	experiment string
+	strategy   string
+	base       *BaseInfra
+	metadata   map[string]string // owner and purpose of the experiment, added to the group's tags
+}
+
+// PlacementGroups returns the placement groups needed by an experiment's targets, ordered
+// by strategy.
+func PlacementGroups(experiment string, base *BaseInfra, targets []*exp.TargetSpec) []*PlacementGroup {
+	seen := make(map[string]bool)
+	var strategies []string
+	for _, t := range targets {
+		if t.EC2 == nil || t.EC2.PlacementGroup == "" || seen[t.EC2.PlacementGroup] {
+			continue
+		}
+		seen[t.EC2.PlacementGroup] = true
+		strategies = append(strategies, t.EC2.PlacementGroup)
+	}
+	sort.Strings(strategies)
+
+	groups := make([]*PlacementGroup, 0, len(strategies))
+	for _, s := range strategies {
+		groups = append(groups, &PlacementGroup{
+			name:       placementGroupName(experiment, s),
+			experiment: experiment,
+			strategy:   s,
+			base:       base,
+		})
+	}
+	return groups
+}
+
+func (g *PlacementGroup) ComponentName() string { return "placement group " + g.strategy }
+
+func (g *PlacementGroup) Resources() []api.Resource {
+	return []api.Resource{
+		{
+			Type: api.ResourceTypeEc2PlacementGroup,
+			Keys: map[string]string{
+				api.ResourceKeyGroupName: g.name,
+			},
+		},
+	}
+}
+
+// TeardownChecks returns a check that confirms the placement group has been deleted.
+func (g *PlacementGroup) TeardownChecks() []TeardownCheck {
+	return []TeardownCheck{
+		{
+			Component: g.ComponentName(),
+			Resource:  "placement group " + g.name,
+			Deleted:   g.groupIsDeleted().Func,
+		},
+	}
+}
+
+func (g *PlacementGroup) Setup(ctx context.Context) error {
+	slog.Info("starting setup", "component", g.ComponentName())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(g.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return TaskSequence(ctx, sess, g.ComponentName(),
+		g.createGroup(),
+	)
+}
+
+func (g *PlacementGroup) Ready(ctx context.Context) (bool, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(g.base.AwsRegion),
+	})
+	if err != nil {
+		return false, fmt.Errorf("new session: %w", err)
+	}
+
+	return CheckSequence(ctx, sess, g.ComponentName(),
+		g.groupIsAvailable(),
+	)
+}
+
+// Teardown deletes the placement group. It must be called once the instances launched in
+// the group have terminated.
+func (g *PlacementGroup) Teardown(ctx context.Context) error {
+	slog.Info("starting teardown", "component", g.ComponentName())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(g.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return TaskSequence(ctx, sess, g.ComponentName(),
+		g.deleteGroup(),
+	)
+}
+
+func (g *PlacementGroup) ForceTeardown(ctx context.Context) error {
+	slog.Info("starting forced teardown", "component", g.ComponentName())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(g.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return ForceTaskSequence(ctx, sess, g.ComponentName(),
+		g.deleteGroup(),
+	)
+}
+
+func (g *PlacementGroup) createGroup() Task {
+	return Task{
+		Name:  "create placement group",
+		Check: g.groupIsAvailable(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			_, err := ec2.New(sess).CreatePlacementGroup(&ec2.CreatePlacementGroupInput{
+				GroupName: aws.String(g.name),
+				Strategy:  aws.String(g.strategy),
+				TagSpecifications: []*ec2.TagSpecification{
+					{
+						ResourceType: aws.String(ec2.ResourceTypePlacementGroup),
+						Tags: ec2Tags(withMetadata(map[string]*string{
+							"experiment": aws.String(g.experiment),
+							"component":  aws.String(g.ComponentName()),
+						}, g.metadata)),
+					},
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("create placement group: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+func (g *PlacementGroup) deleteGroup() Task {
+	return Task{
+		Name:  "delete placement group",
+		Check: g.groupIsDeleted(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			return deletePlacementGroup(ctx, sess, g.name)
+		},
+	}
+}
+
+func (g *PlacementGroup) groupIsAvailable() Check {
+	return Check{
+		Name:        "placement group is available",
+		FailureText: "placement group is not available",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			state, err := placementGroupState(sess, g.name)
+			if err != nil {
+				return false, err
+			}
+			return state == ec2.PlacementGroupStateAvailable, nil
+		},
+	}
+}
+
+func (g *PlacementGroup) groupIsDeleted() Check {
+	return Check{
+		Name:        "placement group is deleted",
+		FailureText: "placement group is not deleted",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			state, err := placementGroupState(sess, g.name)
+			if err != nil {
+				return false, err
+			}
+			return state == "" || state == ec2.PlacementGroupStateDeleted, nil
+		},
+	}
+}
+
+// placementGroupState returns the state of the named placement group, empty if it does not exist.
+func placementGroupState(sess *session.Session, name string) (string, error) {
+	out, err := ec2.New(sess).DescribePlacementGroups(&ec2.DescribePlacementGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describe placement groups: %w", err)
+	}
+	for _, pg := range out.PlacementGroups {
+		if aws.StringValue(pg.GroupName) == name {
+			return aws.StringValue(pg.State), nil
+		}
+	}
+	return "", nil
+}
+
+func deletePlacementGroup(ctx context.Context, sess *session.Session, name string) error {
+	in := &ec2.DeletePlacementGroupInput{
+		GroupName: aws.String(name),
+	}
+	if _, err := ec2.New(sess).DeletePlacementGroupWithContext(ctx, in); err != nil {
+		return fmt.Errorf("delete placement group: %w", err)
+	}
+	return nil
+}
@@ -1,9 +1,9 @@
 package infra
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -11,10 +11,11 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/ironbar/client"
 	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
-func RegisterExperiment(addr string, e *exp.Experiment, res []api.Resource) func(ctx context.Context) (bool, error) {
+func RegisterExperiment(addr string, e *exp.Experiment, res []api.Resource, usage api.Usage) func(ctx context.Context) (bool, error) {
 	return func(ctx context.Context) (bool, error) {
 		def, err := json.Marshal(e)
 		if err != nil {
@@ -24,98 +25,204 @@ func RegisterExperiment(addr string, e *exp.Experiment, res []api.Resource) func
 		start := time.Now().UTC()
 		end := start.Add(e.Duration)
 
-		man := api.NewExperimentInput{
+		man := &api.NewExperimentInput{
 			Name:       e.Name,
 			Start:      start,
 			End:        end,
 			Definition: string(def),
 			Resources:  res,
+			Usage:      usage,
 		}
 
-		content, err := json.Marshal(man)
-		if err != nil {
-			return false, fmt.Errorf("failed to encode ironbar manifest: %w", err)
-		}
-
-		resp, err := http.Post(fmt.Sprintf("http://%s/experiments", addr), "application/json", bytes.NewReader(content))
-		if err != nil {
+		if _, err := client.New(addr, nil).NewExperiment(ctx, man); err != nil {
+			var apiErr *client.Error
+			if errors.As(err, &apiErr) {
+				return false, apiErr
+			}
 			slog.Error("failed to post to ironbar service", err)
 			return false, nil
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			errorResp := new(ErrorResponse)
-			if err := json.NewDecoder(resp.Body).Decode(errorResp); err != nil {
-				return false, fmt.Errorf("failed to send experiment manifest, and failed to decode response: %w", err)
-			}
-
-			return false, errorResp
-		}
-
 		return true, nil
 	}
 }
 
-type ErrorResponse struct {
-	Err string `json:"err"`
+// isRejected reports whether ironbar refused to accept an experiment, either because it would
+// exceed a quota, because ironbar is in maintenance mode or a freeze window, or because it is
+// missing required metadata.
+func isRejected(err error) bool {
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == http.StatusForbidden || apiErr.StatusCode == http.StatusServiceUnavailable || apiErr.StatusCode == http.StatusBadRequest
 }
 
-func (e *ErrorResponse) Error() string {
-	return e.Err
+// CheckQuota asks ironbar whether an experiment can be started without exceeding the
+// submitter's quotas and outside of any maintenance or freeze window, returning an error
+// giving the reason if not. It also asks ironbar to choose which of the clusters, given in
+// order of preference, to place the experiment in and returns its choice. The first cluster
+// is returned if ironbar does not make one.
+func CheckQuota(ctx context.Context, addr string, e *exp.Experiment, usage api.Usage, clusters []string) (string, error) {
+	var fallback string
+	if len(clusters) > 0 {
+		fallback = clusters[0]
+	}
+
+	start := time.Now().UTC()
+	out, err := client.New(addr, nil).CheckQuota(ctx, &api.CheckQuotaInput{
+		Name:     e.Name,
+		Start:    start,
+		End:      start.Add(e.Duration),
+		Usage:    usage,
+		Clusters: clusters,
+	})
+	if err != nil {
+		if isRejected(err) {
+			return "", fmt.Errorf("experiment cannot be started: %w", err)
+		}
+		if errors.Is(err, client.ErrNotFound) {
+			slog.Debug("ironbar does not support quota checks")
+			return fallback, nil
+		}
+		return "", fmt.Errorf("check quota: %w", err)
+	}
+	if len(out.Preempts) > 0 {
+		slog.Warn("lower priority experiments will be preempted to make room for this one", "experiments", out.Preempts)
+	}
+	if out.Cluster == "" {
+		return fallback, nil
+	}
+	return out.Cluster, nil
+}
+
+// GetExperiment returns an experiment known to ironbar, including the definition it was
+// deployed with.
+func GetExperiment(ctx context.Context, addr string, name string) (*api.GetExperimentOutput, error) {
+	out, err := client.New(addr, nil).GetExperiment(ctx, name)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, &api.CodedError{Code: api.ErrorCodeNotFound, Err: fmt.Errorf("experiment not found")}
+		}
+		return nil, fmt.Errorf("get experiment: %w", err)
+	}
+	return out, nil
 }
 
 func GetExperimentStatus(ctx context.Context, addr string, name string) (*api.ExperimentStatusOutput, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/experiments/%s/status", addr, name))
+	out, err := client.New(addr, nil).ExperimentStatus(ctx, name)
 	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, &api.CodedError{Code: api.ErrorCodeNotFound, Err: fmt.Errorf("experiment not found")}
+		}
 		return nil, fmt.Errorf("get status: %w", err)
 	}
+	return out, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, fmt.Errorf("experiment not found")
-		} else {
+func ListNoiseEstimates(ctx context.Context, addr string) (*api.ListNoiseEstimatesOutput, error) {
+	out, err := client.New(addr, nil).ListNoiseEstimates(ctx)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, fmt.Errorf("ironbar does not support noise estimates")
+		}
+		return nil, fmt.Errorf("list noise estimates: %w", err)
+	}
+	return out, nil
+}
 
-			errorResp := new(ErrorResponse)
-			if err := json.NewDecoder(resp.Body).Decode(errorResp); err != nil {
-				return nil, fmt.Errorf("status check failed, and failed to decode response: %w", err)
-			}
+// ListAnalyses returns the analyses recorded for an experiment, or nil if there are none.
+func ListAnalyses(ctx context.Context, addr string, name string) ([]api.Analysis, error) {
+	out, err := client.New(addr, nil).ListAnalyses(ctx, name)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list analyses: %w", err)
+	}
+	return out.Items, nil
+}
 
-			return nil, errorResp
+func AddAnnotation(ctx context.Context, addr string, name string, in *api.AddAnnotationInput) (*api.Annotation, error) {
+	out, err := client.New(addr, nil).AddAnnotation(ctx, name, in)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, fmt.Errorf("experiment not found")
 		}
+		return nil, fmt.Errorf("add annotation: %w", err)
 	}
+	return out, nil
+}
 
-	out := new(api.ExperimentStatusOutput)
-	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+func RestartTarget(ctx context.Context, addr string, name string, target string, in *api.RestartTargetInput) (*api.RestartTargetOutput, error) {
+	out, err := client.New(addr, nil).RestartTarget(ctx, name, target, in)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, fmt.Errorf("experiment or target not found: %w", err)
+		}
+		return nil, fmt.Errorf("restart target: %w", err)
 	}
+	return out, nil
+}
 
+// Query runs a PromQL query over an experiment's metrics through ironbar.
+func Query(ctx context.Context, addr string, name string, in *api.QueryInput) (*api.QueryOutput, error) {
+	out, err := client.New(addr, nil).Query(ctx, name, in)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, fmt.Errorf("experiment not found, or ironbar does not support queries: %w", err)
+		}
+		return nil, fmt.Errorf("query: %w", err)
+	}
 	return out, nil
 }
 
-func ListExperiments(ctx context.Context, addr string) (*api.ListExperimentsOutput, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/experiments", addr))
+// ListAnnotations returns the annotations attached to an experiment, or nil if there are none.
+func ListAnnotations(ctx context.Context, addr string, name string) ([]api.Annotation, error) {
+	out, err := client.New(addr, nil).ListAnnotations(ctx, name)
 	if err != nil {
-		return nil, fmt.Errorf("get experiments: %w", err)
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list annotations: %w", err)
 	}
+	return out.Items, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusNotFound {
+func ListExperiments(ctx context.Context, addr string, in *api.ListExperimentsInput) (*api.ListExperimentsOutput, error) {
+	out, err := client.New(addr, nil).ListExperiments(ctx, in)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
 			return nil, fmt.Errorf("experiments not found")
-		} else {
-
-			errorResp := new(ErrorResponse)
-			if err := json.NewDecoder(resp.Body).Decode(errorResp); err != nil {
-				return nil, fmt.Errorf("status check failed, and failed to decode response: %w", err)
-			}
-
-			return nil, errorResp
 		}
+		return nil, fmt.Errorf("get experiments: %w", err)
 	}
+	return out, nil
+}
 
-	out := new(api.ListExperimentsOutput)
-	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+func AdoptResources(ctx context.Context, addr string, name string, in *api.AdoptResourcesInput) (*api.AdoptResourcesOutput, error) {
+	out, err := client.New(addr, nil).AdoptResources(ctx, name, in)
+	if err != nil {
+		return nil, fmt.Errorf("adopt resources: %w", err)
 	}
+	return out, nil
+}
 
+func PutPipeline(ctx context.Context, addr string, name string, in *api.NewPipelineInput) (*api.Pipeline, error) {
+	out, err := client.New(addr, nil).PutPipeline(ctx, name, in)
+	if err != nil {
+		return nil, fmt.Errorf("put pipeline: %w", err)
+	}
+	return out, nil
+}
+
+func GetPipeline(ctx context.Context, addr string, name string) (*api.Pipeline, error) {
+	out, err := client.New(addr, nil).GetPipeline(ctx, name)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			return nil, fmt.Errorf("pipeline not found")
+		}
+		return nil, fmt.Errorf("get pipeline: %w", err)
+	}
 	return out, nil
 }
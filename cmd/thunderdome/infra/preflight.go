@@ -0,0 +1,401 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// PreflightResult is the outcome of a single preflight check.
+type PreflightResult struct {
+	Check   string
+	Err     error // nil if the check passed
+	Warning bool  // the check could not be completed but the deploy may still succeed
+}
+
+// Failed reports whether the check found a problem that will prevent the experiment from deploying.
+func (r PreflightResult) Failed() bool {
+	return r.Err != nil && !r.Warning
+}
+
+// deployActions are the actions the deploying user must be allowed to perform
+var deployActions = []string{
+	"ecs:RegisterTaskDefinition",
+	"ecs:DeregisterTaskDefinition",
+	"ecs:RunTask",
+	"ecs:StopTask",
+	"ecs:DescribeTasks",
+	"iam:PassRole",
+	"sqs:CreateQueue",
+	"sqs:DeleteQueue",
+	"sqs:SetQueueAttributes",
+	"sns:Subscribe",
+	"sns:Unsubscribe",
+	"ecr:DescribeImages",
+}
+
+// Preflight checks that an experiment can be deployed without creating any resources. Every
+// check is run and all results are returned so that problems can be reported together.
+func (p *Provider) Preflight(ctx context.Context, e *exp.Experiment) ([]PreflightResult, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(p.region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	var results []PreflightResult
+	add := func(check string, err error) {
+		results = append(results, PreflightResult{Check: check, Err: err})
+	}
+	warn := func(check string, err error) {
+		results = append(results, PreflightResult{Check: check, Err: err, Warning: err != nil})
+	}
+
+	add("experiment requirements", p.validateRequirmentsWithBase(ctx, e, base))
+
+	ready, err := CheckSequence(ctx, sess, base.Name(), base.ecsClusterExists())
+	if err == nil && !ready {
+		err = fmt.Errorf("ecs cluster %s does not exist", base.EcsClusterArn)
+	}
+	add("ecs cluster exists", err)
+
+	add("dealgood image exists", preflightImage(sess, base, base.DealgoodImage))
+	for _, t := range e.Targets {
+		if t.IsRemote() || t.Image == "" {
+			// remote targets have no image and other images are built during deploy
+			continue
+		}
+		check := fmt.Sprintf("image for target %s exists", t.Name)
+		if !strings.HasPrefix(t.Image, base.EcrBaseURL+":") {
+			warn(check, fmt.Errorf("image %s is not in the thunderdome ecr repository and cannot be checked", t.Image))
+			continue
+		}
+		add(check, preflightImage(sess, base, t.Image))
+	}
+
+	capacity := preflightCapacity(sess, base, e)
+	names := make([]string, 0, len(capacity))
+	for name := range capacity {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(fmt.Sprintf("capacity provider %s has headroom", name), capacity[name])
+	}
+
+	results = append(results, preflightQuotas(sess, base, e)...)
+
+	switch e.Transport {
+	case "kinesis":
+		add("request stream exists", preflightStream(sess, base.RequestKinesisStreamName))
+	case "nats":
+		// the nats server is usually only reachable from the vpc, dealgood reports if it cannot read the stream
+	default:
+		add("request topic exists", preflightTopic(sess, base.RequestSNSTopicArn))
+	}
+
+	if key := experimentKmsKey(e, base); key != "" {
+		// only the request queue is delivered to by sns
+		subscribed := (e.Transport == "" || e.Transport == "sqs") && e.Workload == nil
+		results = append(results, preflightKmsKey(sess, key, subscribed))
+	}
+
+	if e.PrivateNetworking {
+		results = append(results, preflightVpcEndpoints(ctx, sess, base, e))
+	}
+
+	results = append(results, preflightIronbar(ctx, base.IronbarAddr, e))
+
+	results = append(results, preflightPermissions(sess), preflightPrometheus(sess, base.PrometheusSecretArn))
+
+	return results, nil
+}
+
+// preflightImage checks that an image exists in the thunderdome ecr repository.
+func preflightImage(sess *session.Session, base *BaseInfra, image string) error {
+	repoURL, tag, ok := strings.Cut(image, ":")
+	if !ok || repoURL != base.EcrBaseURL {
+		return fmt.Errorf("image %s is not in the thunderdome ecr repository", image)
+	}
+	_, repo, ok := strings.Cut(repoURL, "/")
+	if !ok {
+		return fmt.Errorf("invalid ecr repository url: %s", repoURL)
+	}
+
+	svc := ecr.New(sess)
+	_, err := svc.DescribeImages(&ecr.DescribeImagesInput{
+		RepositoryName: aws.String(repo),
+		ImageIds: []*ecr.ImageIdentifier{
+			{ImageTag: aws.String(tag)},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageNotFoundException {
+			return &api.CodedError{Code: api.ErrorCodeImageNotFound, Err: fmt.Errorf("image %s not found", image)}
+		}
+		return fmt.Errorf("describe images: %w", err)
+	}
+	return nil
+}
+
+// preflightCapacity checks that the auto scaling group behind each capacity provider used by
+// the experiment can start an instance for each target that uses it. Targets with an instance
+// of their own do not use a capacity provider. When ironbar chooses the cluster, the capacity providers of the first cluster it could choose are checked.
+func preflightCapacity(sess *session.Session, base *BaseInfra, e *exp.Experiment) map[string]error {
+	var cluster Cluster
+	if names := candidateClusters(e, base); len(names) > 0 {
+		cluster = base.Clusters[names[0]]
+	}
+	needed := make(map[string]int)
+	for _, t := range e.Targets {
+		if t.IsRemote() || t.EC2 != nil {
+			continue
+		}
+		name, ok := cluster.CapacityProviders[t.InstanceType]
+		if !ok {
+			name = t.InstanceType
+		}
+		needed[name]++
+	}
+	if len(needed) == 0 {
+		return nil
+	}
+
+	names := make([]*string, 0, len(needed))
+	for name := range needed {
+		names = append(names, aws.String(name))
+	}
+
+	results := make(map[string]error, len(needed))
+	out, err := ecs.New(sess).DescribeCapacityProviders(&ecs.DescribeCapacityProvidersInput{
+		CapacityProviders: names,
+	})
+	if err != nil {
+		for name := range needed {
+			results[name] = fmt.Errorf("describe capacity providers: %w", err)
+		}
+		return results
+	}
+
+	asgsvc := autoscaling.New(sess)
+	for _, cp := range out.CapacityProviders {
+		name := aws.StringValue(cp.Name)
+		if cp.AutoScalingGroupProvider == nil {
+			results[name] = fmt.Errorf("capacity provider has no auto scaling group")
+			continue
+		}
+		asgArn := aws.StringValue(cp.AutoScalingGroupProvider.AutoScalingGroupArn)
+		_, asgName, ok := strings.Cut(asgArn, "autoScalingGroupName/")
+		if !ok {
+			results[name] = fmt.Errorf("unexpected auto scaling group arn: %s", asgArn)
+			continue
+		}
+
+		asgout, err := asgsvc.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: []*string{aws.String(asgName)},
+		})
+		if err != nil {
+			results[name] = fmt.Errorf("describe auto scaling groups: %w", err)
+			continue
+		}
+		if len(asgout.AutoScalingGroups) == 0 {
+			results[name] = fmt.Errorf("auto scaling group %s not found", asgName)
+			continue
+		}
+		asg := asgout.AutoScalingGroups[0]
+		available := int(aws.Int64Value(asg.MaxSize)) - int(aws.Int64Value(asg.DesiredCapacity))
+		if available < needed[name] {
+			results[name] = fmt.Errorf("experiment needs %d instances but only %d of a maximum of %d are available", needed[name], available, aws.Int64Value(asg.MaxSize))
+			continue
+		}
+		results[name] = nil
+	}
+
+	for name := range needed {
+		if _, ok := results[name]; !ok {
+			results[name] = fmt.Errorf("capacity provider not found")
+		}
+	}
+	return results
+}
+
+func preflightTopic(sess *session.Session, topicArn string) error {
+	_, err := sns.New(sess).GetTopicAttributes(&sns.GetTopicAttributesInput{
+		TopicArn: aws.String(topicArn),
+	})
+	if err != nil {
+		return fmt.Errorf("get topic attributes: %w", err)
+	}
+	return nil
+}
+
+// preflightKmsKey checks that the key an experiment's resources are encrypted with is enabled
+// and, when sns delivers requests to the experiment's queue, that the key's policy mentions sns.
+// A policy that cannot be read is only a warning since the deployer may not be allowed to.
+func preflightKmsKey(sess *session.Session, key string, subscribed bool) PreflightResult {
+	const check = "kms key is usable"
+	svc := kms.New(sess)
+	out, err := svc.DescribeKey(&kms.DescribeKeyInput{KeyId: aws.String(key)})
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("describe key: %w", err)}
+	}
+	if state := aws.StringValue(out.KeyMetadata.KeyState); state != kms.KeyStateEnabled {
+		return PreflightResult{Check: check, Err: fmt.Errorf("key %s is %s", key, state)}
+	}
+	if !subscribed {
+		return PreflightResult{Check: check}
+	}
+
+	policy, err := svc.GetKeyPolicy(&kms.GetKeyPolicyInput{
+		KeyId:      out.KeyMetadata.Arn,
+		PolicyName: aws.String("default"),
+	})
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("get key policy: %w", err), Warning: true}
+	}
+	if !strings.Contains(aws.StringValue(policy.Policy), "sns.amazonaws.com") {
+		return PreflightResult{Check: check, Err: fmt.Errorf("policy of key %s does not allow sns.amazonaws.com to use it, requests will not be delivered to the encrypted queue", key)}
+	}
+	return PreflightResult{Check: check}
+}
+
+func preflightStream(sess *session.Session, stream string) error {
+	if stream == "" {
+		return fmt.Errorf("no request stream is configured in the base infra")
+	}
+	out, err := kinesis.New(sess).DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		return fmt.Errorf("describe stream: %w", err)
+	}
+	if status := aws.StringValue(out.StreamDescriptionSummary.StreamStatus); status != kinesis.StreamStatusActive && status != kinesis.StreamStatusUpdating {
+		return fmt.Errorf("stream status is %s", status)
+	}
+	return nil
+}
+
+// preflightPermissions simulates the actions needed to deploy an experiment against the
+// policies of the calling user or role. Failure to run the simulation is only a warning since
+// the user may not be allowed to simulate policies.
+func preflightPermissions(sess *session.Session) PreflightResult {
+	const check = "iam permissions"
+	ident, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("get caller identity: %w", err), Warning: true}
+	}
+
+	principal, err := principalArn(aws.StringValue(ident.Arn))
+	if err != nil {
+		return PreflightResult{Check: check, Err: err, Warning: true}
+	}
+
+	var denied []string
+	err = iam.New(sess).SimulatePrincipalPolicyPages(&iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principal),
+		ActionNames:     aws.StringSlice(deployActions),
+	}, func(out *iam.SimulatePolicyResponse, last bool) bool {
+		for _, r := range out.EvaluationResults {
+			if aws.StringValue(r.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+				denied = append(denied, aws.StringValue(r.EvalActionName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("simulate principal policy: %w", err), Warning: true}
+	}
+	if len(denied) > 0 {
+		return PreflightResult{Check: check, Err: fmt.Errorf("%s is not allowed to perform: %s", principal, strings.Join(denied, ", "))}
+	}
+	return PreflightResult{Check: check, Err: nil}
+}
+
+// principalArn converts the arn of an assumed role session into the arn of the role so its
+// policies can be simulated.
+func principalArn(s string) (string, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("parse caller arn: %w", err)
+	}
+	if a.Service == "sts" && strings.HasPrefix(a.Resource, "assumed-role/") {
+		parts := strings.Split(a.Resource, "/")
+		a.Service = "iam"
+		a.Resource = "role/" + parts[1]
+	}
+	return a.String(), nil
+}
+
+// preflightPrometheus checks that the remote write endpoint used by the grafana agents in
+// each task can be reached with the configured credentials. Failure to read the credentials is
+// only a warning since the user may not be allowed to read the secret.
+func preflightPrometheus(sess *session.Session, secretArn string) PreflightResult {
+	const check = "prometheus is reachable"
+	out, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return PreflightResult{Check: check, Err: fmt.Errorf("prometheus secret %s not found", secretArn)}
+		}
+		return PreflightResult{Check: check, Err: fmt.Errorf("get prometheus secret: %w", err), Warning: true}
+	}
+
+	var secret struct {
+		URL      string `json:"url"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(out.SecretString)), &secret); err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("decode prometheus secret: %w", err)}
+	}
+	if secret.URL == "" {
+		return PreflightResult{Check: check, Err: fmt.Errorf("prometheus secret has no url")}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, secret.URL, nil)
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("invalid prometheus url: %w", err)}
+	}
+	req.SetBasicAuth(secret.Username, secret.Password)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("prometheus unreachable: %w", err)}
+	}
+	resp.Body.Close()
+
+	// the remote write endpoint only accepts posts so any response other than an
+	// authentication failure shows that it is reachable
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return PreflightResult{Check: check, Err: fmt.Errorf("prometheus rejected credentials: %s", resp.Status)}
+	}
+	return PreflightResult{Check: check, Err: nil}
+}
@@ -2,10 +2,15 @@ package infra
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/user"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
@@ -15,7 +20,13 @@ import (
 
 type Provider struct {
 	region     string
+	owner      string // user submitting experiments, counted against their quotas
+	team       string // optional team of the user submitting experiments
 	imageCache map[string]string
+
+	// instanceTypes holds the details of the ec2 instance types of targets that run on an
+	// instance of their own, read when the experiment's requirements are validated
+	instanceTypes map[string]*ec2.InstanceTypeInfo
 }
 
 func NewProvider() (*Provider, error) {
@@ -23,9 +34,25 @@ func NewProvider() (*Provider, error) {
 	if region == "" {
 		return nil, fmt.Errorf("environment variable AWS_REGION should be set to the region Thunderdome is running in")
 	}
+
+	owner := os.Getenv("THUNDERDOME_OWNER")
+	if owner == "" {
+		if u, err := user.Current(); err == nil {
+			owner = u.Username
+		}
+	}
+
+	return NewProviderFor(region, owner, os.Getenv("THUNDERDOME_TEAM")), nil
+}
+
+// NewProviderFor returns a provider that submits experiments on behalf of an owner and team,
+// such as ironbar deploying the stages of a pipeline for whoever defined it.
+func NewProviderFor(region string, owner string, team string) *Provider {
 	return &Provider{
 		region: region,
-	}, nil
+		owner:  owner,
+		team:   team,
+	}
 }
 
 func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild bool) error {
@@ -41,34 +68,121 @@ func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild boo
 		return err
 	}
 
-	// Build all the images
-	// TODO: optimise this by checking if image already exists and by reusing checked out sources
+	usage := p.experimentUsage(e, base)
+	clusterName, err := CheckQuota(ctx, base.IronbarAddr, e, usage, candidateClusters(e, base))
+	if err != nil {
+		return err
+	}
+	cluster, err := base.Cluster(clusterName)
+	if err != nil {
+		return err
+	}
+	if cluster.Name != DefaultCluster {
+		usage.Cluster = cluster.Name
+	}
+	if e.Cluster == exp.ClusterAuto {
+		slog.Info("ironbar placed experiment", "cluster", cluster.Name)
+	}
+
+	metadata := p.experimentMetadata(e)
+	analyses, err := AnalysisResources(e.Name, base, base.DefaultSubnet(e.PrivateNetworking), e.Analyses, metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := p.buildImages(ctx, e, base, forceBuild); err != nil {
+		return err
+	}
+
+	components := make([]Component, 0, len(e.Targets))
+	targets := make([]*Target, 0, len(e.Targets))
+	var remoteTargets []*exp.TargetSpec
 	for _, t := range e.Targets {
-		if t.Image != "" {
+		if t.IsRemote() {
+			remoteTargets = append(remoteTargets, t)
 			continue
 		}
+		target := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
+		target.debugPort = t.DebugPort
+		target.adminPort = t.AdminPort
+		target.metadata = metadata
+		target.egress = e.Egress
+		target.ec2 = t.EC2
+		target.cluster = cluster
+		if e.Conformance != nil {
+			target.conformanceImage = e.Conformance.Image
+		}
+		targets = append(targets, target)
+		components = append(components, target)
+	}
 
-		if t.ImageSpec == nil {
-			return fmt.Errorf("no image found for target %s", t.Name)
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	if e.PrivateNetworking {
+		if err := EnsureVpcEndpoints(ctx, sess, base, e); err != nil {
+			return fmt.Errorf("failed to ensure vpc endpoints: %w", err)
 		}
+	}
+	dealgoodSubnet, err := AssignZones(sess, base, e.Zones, targets, e.PrivateNetworking)
+	if err != nil {
+		return fmt.Errorf("failed to assign availability zones: %w", err)
+	}
 
-		var err error
-		slog.Info("building docker image", "component", "target "+t.Name)
-		t.Image, err = p.BuildImage(ctx, t.ImageSpec, base.EcrBaseURL, forceBuild)
-		slog.Debug("using docker image", "component", "target "+t.Name, "image", t.Image)
+	groups := PlacementGroups(e.Name, base, e.Targets)
+	if len(groups) > 0 {
+		groupComponents := make([]Component, 0, len(groups))
+		for _, g := range groups {
+			g.metadata = metadata
+			groupComponents = append(groupComponents, g)
+		}
+		if err := DeployInParallel(ctx, groupComponents); err != nil {
+			return fmt.Errorf("placement groups failed to deploy: %w", err)
+		}
+	}
+
+	var swarmKey string
+	if e.Hermetic {
+		swarmKey, err = newSwarmKey()
 		if err != nil {
-			slog.Error("build image", err)
-			return fmt.Errorf("failed to build image for target %s", t.Name)
+			return err
 		}
 	}
 
-	components := make([]Component, 0, len(e.Targets))
-	targets := make([]*Target, 0, len(e.Targets))
-	for _, t := range e.Targets {
-		t := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
-		targets = append(targets, t)
-		components = append(components, t)
+	// providers are deployed first so that targets can be peered with them
+	providers := ContentProviders(e, base)
+	var providerURLs, providerPeering []string
+	if len(providers) > 0 {
+		providerComponents := make([]Component, 0, len(providers))
+		for _, p := range providers {
+			p.WithMetadata(metadata).WithSubnet(dealgoodSubnet).WithSwarmKey(swarmKey)
+			providerComponents = append(providerComponents, p)
+		}
+		if err := DeployInParallel(ctx, providerComponents); err != nil {
+			return fmt.Errorf("content providers failed to deploy: %w", err)
+		}
+		for _, p := range providers {
+			providerURLs = append(providerURLs, p.URL())
+			providerPeering = append(providerPeering, p.URL()+"/peering")
+		}
+		for _, t := range targets {
+			t.providerPeering = providerPeering
+		}
+	}
+	if e.Hermetic {
+		egress, err := hermeticEgress(e.Egress, providerURLs)
+		if err != nil {
+			return err
+		}
+		for _, t := range targets {
+			t.swarmKey = swarmKey
+			t.egress = egress
+		}
 	}
+
 	if err := DeployInParallel(ctx, components); err != nil {
 		return fmt.Errorf("targets failed to deploy: %w", err)
 	}
@@ -78,11 +192,57 @@ func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild boo
 		targetURLs[i] = targets[i].GatewayURL()
 	}
 
+	gatewayURLs := map[string]string{}
+	for _, t := range remoteTargets {
+		gatewayURLs[t.Name] = t.URL
+	}
+	for _, t := range targets {
+		gatewayURLs[t.Name()] = t.GatewayURL()
+	}
+	conformance, err := ConformanceResources(e, base, dealgoodSubnet, gatewayURLs, metadata)
+	if err != nil {
+		return err
+	}
+
+	var seeder *Seeder
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		seeder = NewSeeder(e.Name, base).
+			WithMetadata(metadata).
+			WithContentSize(e.Workload.ContentSize).
+			WithSubnet(dealgoodSubnet)
+		if err := seeder.Setup(ctx); err != nil {
+			return fmt.Errorf("failed to setup seeder: %w", err)
+		}
+		if err := WaitUntil(ctx, slog.With("component", seeder.Name()), "is ready", seeder.Ready, 2*time.Second, 30*time.Second); err != nil {
+			return fmt.Errorf("seeder failed to become ready: %w", err)
+		}
+	}
+	seederURLs := providerURLs
+	if seeder != nil {
+		seederURLs = []string{seeder.URL()}
+	}
+
 	d := NewDealgood(e.Name, base).
+		WithMetadata(metadata).
 		WithTargets(targets).
+		WithRemoteTargets(remoteTargets).
+		WithTargetHeaders(e.Targets).
+		WithSubdomainGateways(e.Targets).
+		WithTargetMaxInFlight(e.Targets).
 		WithMaxRequestRate(e.MaxRequestRate).
+		WithSearch(e.Search).
+		WithSpikes(e.Spikes).
 		WithMaxConcurrency(e.MaxConcurrency).
-		WithRequestFilter(e.RequestFilter)
+		WithRequestFilter(e.RequestFilter).
+		WithBodyStrategy(e.BodyStrategy, e.BodyReadLimit).
+		WithAcceptEncoding(e.AcceptEncoding).
+		WithAudit(e.Audit).
+		WithTransport(e.Transport).
+		WithReplay(e.Replay).
+		WithShutdown(e.Shutdown).
+		WithWorkload(e.Workload, seederURLs).
+		WithSubnet(dealgoodSubnet).
+		WithKmsKey(experimentKmsKey(e, base))
 
 	if err := d.Setup(ctx); err != nil {
 		return fmt.Errorf("failed to setup dealgood: %w", err)
@@ -94,17 +254,40 @@ func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild boo
 
 	var res []api.Resource
 	res = append(res, d.Resources()...)
+	if seeder != nil {
+		res = append(res, seeder.Resources()...)
+	}
+	for _, p := range providers {
+		res = append(res, p.Resources()...)
+	}
 	for i := range targets {
 		res = append(res, targets[i].Resources()...)
 	}
-
-	if err := WaitUntil(ctx, slog.With(), "experiment registered", RegisterExperiment(base.IronbarAddr, e, res), 2*time.Second, 30*time.Second); err != nil {
+	// placement groups follow the targets' instances, they cannot be deleted while in use
+	for _, g := range groups {
+		res = append(res, g.Resources()...)
+	}
+	res = append(res, conformance...)
+	res = append(res, analyses...)
+
+	if err := WaitUntil(ctx, slog.With(), "experiment registered", RegisterExperiment(base.IronbarAddr, e, res, usage), 2*time.Second, 30*time.Second); err != nil {
+		if isRejected(err) {
+			// another experiment used up the quota or ironbar entered maintenance mode since
+			// the check, nothing will remove the unregistered resources so tear them down now
+			slog.Warn("experiment rejected by ironbar, tearing down", "error", err)
+			if terr := p.Teardown(ctx, e); terr != nil {
+				slog.Error("failed to tear down rejected experiment", terr)
+			}
+		}
 		return fmt.Errorf("failed to register experiment: %w", err)
 	}
 
 	dashboard := fmt.Sprintf("https://protocollabs.grafana.net/d/GE2JD7ZVz/experiment-timeline?orgId=1&from=now-1h&to=now&var-experiment=%s", e.Name)
 	slog.Info("Grafana dashboard: " + dashboard)
 
+	for _, t := range remoteTargets {
+		slog.Info("sending requests to remote target", "component", "target "+t.Name, "url", t.URL)
+	}
 	for _, t := range targets {
 		slog.Info("target running on ec2", "component", t.ComponentName(), "instance_id", t.EC2InstanceID(), "private_ip", t.PrivateIPAddress())
 	}
@@ -121,20 +304,48 @@ func (p *Provider) Teardown(ctx context.Context, e *exp.Experiment) error {
 		return fmt.Errorf("failed to verify base infra: %w", err)
 	}
 
-	d := NewDealgood(e.Name, base)
+	d := NewDealgood(e.Name, base).WithTransport(e.Transport).WithShutdown(e.Shutdown).WithWorkload(e.Workload, nil)
 	if err := d.Teardown(ctx); err != nil {
 		return fmt.Errorf("failed to teardown dealgood: %w", err)
 	}
 
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		if err := NewSeeder(e.Name, base).Teardown(ctx); err != nil {
+			return fmt.Errorf("failed to teardown seeder: %w", err)
+		}
+	}
+	var providers []Component
+	for _, p := range ContentProviders(e, base) {
+		providers = append(providers, p)
+	}
+	if err := TeardownInParallel(ctx, providers); err != nil {
+		return err
+	}
+
+	cluster := p.experimentCluster(ctx, e, base)
 	components := make([]Component, 0)
 	for _, t := range e.Targets {
-		t := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
-		components = append(components, t)
+		if t.IsRemote() {
+			continue
+		}
+		target := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
+		target.ec2 = t.EC2
+		target.cluster = cluster
+		components = append(components, target)
 	}
 	if err := TeardownInParallel(ctx, components); err != nil {
 		return err
 	}
 
+	// the targets' instances have terminated so their placement groups are no longer in use
+	var groups []Component
+	for _, g := range PlacementGroups(e.Name, base, e.Targets) {
+		groups = append(groups, g)
+	}
+	if err := TeardownInParallel(ctx, groups); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -148,8 +359,15 @@ func (p *Provider) Status(ctx context.Context, e *exp.Experiment) error {
 	if err := base.Verify(ctx); err != nil {
 		return fmt.Errorf("failed to verify base infra: %w", err)
 	}
+	cluster := p.experimentCluster(ctx, e, base)
 	for _, t := range e.Targets {
+		if t.IsRemote() {
+			slog.Info("remote target, not managed by thunderdome", "component", "target "+t.Name, "url", t.URL)
+			continue
+		}
 		target := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
+		target.ec2 = t.EC2
+		target.cluster = cluster
 		ready, err := target.Ready(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to check %s ready state: %w", target.ComponentName(), err)
@@ -161,7 +379,31 @@ func (p *Provider) Status(ctx context.Context, e *exp.Experiment) error {
 		}
 	}
 
-	d := NewDealgood(e.Name, base)
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		s := NewSeeder(e.Name, base)
+		ready, err := s.Ready(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check %s ready state: %w", s.Name(), err)
+		}
+		if ready {
+			slog.Info("ready", "component", s.Name(), "url", s.URL())
+		} else {
+			allready = false
+		}
+	}
+	for _, p := range ContentProviders(e, base) {
+		ready, err := p.Ready(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check %s ready state: %w", p.Name(), err)
+		}
+		if ready {
+			slog.Info("ready", "component", p.Name(), "url", p.URL())
+		} else {
+			allready = false
+		}
+	}
+
+	d := NewDealgood(e.Name, base).WithTransport(e.Transport).WithWorkload(e.Workload, nil)
 	ready, err := d.Ready(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to check %s ready state: %w", d.Name(), err)
@@ -178,6 +420,40 @@ func (p *Provider) Status(ctx context.Context, e *exp.Experiment) error {
 	return nil
 }
 
+// BuildImages builds the image of each target of an experiment that is defined by an image
+// spec, setting the target's image to the one pushed, so that the experiment can be deployed
+// where docker is not available.
+func (p *Provider) BuildImages(ctx context.Context, e *exp.Experiment, forceBuild bool) error {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return fmt.Errorf("failed to read base infra: %w", err)
+	}
+	return p.buildImages(ctx, e, base, forceBuild)
+}
+
+func (p *Provider) buildImages(ctx context.Context, e *exp.Experiment, base *BaseInfra, forceBuild bool) error {
+	// TODO: optimise this by reusing checked out sources
+	for _, t := range e.Targets {
+		if t.IsRemote() || t.Image != "" {
+			continue
+		}
+
+		if t.ImageSpec == nil {
+			return fmt.Errorf("no image found for target %s", t.Name)
+		}
+
+		var err error
+		slog.Info("building docker image", "component", "target "+t.Name)
+		t.Image, err = p.BuildImage(ctx, t.ImageSpec, base.EcrBaseURL, forceBuild)
+		slog.Debug("using docker image", "component", "target "+t.Name, "image", t.Image)
+		if err != nil {
+			slog.Error("build image", err)
+			return fmt.Errorf("failed to build image for target %s", t.Name)
+		}
+	}
+	return nil
+}
+
 func (p *Provider) BuildImage(ctx context.Context, is *exp.ImageSpec, ecrBaseURL string, forceBuild bool) (string, error) {
 	tag := is.Hash()
 	image, ok := p.imageCache[tag]
@@ -197,7 +473,7 @@ func (p *Provider) BuildImage(ctx context.Context, is *exp.ImageSpec, ecrBaseURL
 		}
 	}
 
-	if _, err := build.Build(ctx, tag, is); err != nil {
+	if _, err := build.Build(ctx, tag, "", is); err != nil {
 		return "", fmt.Errorf("build image: %w", err)
 	}
 
@@ -223,16 +499,184 @@ func (p *Provider) ValidateRequirements(ctx context.Context, e *exp.Experiment)
 }
 
 func (p *Provider) validateRequirmentsWithBase(ctx context.Context, e *exp.Experiment, base *BaseInfra) error {
+	if e.Transport == "kinesis" && base.RequestKinesisStreamName == "" {
+		return fmt.Errorf("kinesis transport is not available, no request stream is configured in the base infra")
+	}
+	if e.Transport == "nats" && (base.RequestNatsURL == "" || base.RequestNatsStream == "") {
+		return fmt.Errorf("nats transport is not available, no nats server and stream are configured in the base infra")
+	}
+
 	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		if t.EC2 != nil {
+			if base.TargetInstanceProfileArn == "" {
+				return fmt.Errorf("target %s cannot run on an ec2 instance of its own, no instance profile is configured in the base infra", t.Name)
+			}
+			info, err := p.ec2InstanceType(base, t.EC2.InstanceType)
+			if err != nil {
+				return fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			if err := checkInstanceType(info, t.EC2); err != nil {
+				return fmt.Errorf("target %s: %w", t.Name, err)
+			}
+			continue
+		}
 		_, ok := base.CapacityProviders[t.InstanceType]
 		if !ok {
 			return fmt.Errorf("target %s has unsupported instance type %q", t.Name, t.InstanceType)
 		}
 	}
 
+	switch e.Cluster {
+	case exp.ClusterAuto:
+		if len(candidateClusters(e, base)) == 0 {
+			return fmt.Errorf("no cluster offers all of the instance types used by the experiment's targets")
+		}
+	default:
+		cluster, err := base.Cluster(e.Cluster)
+		if err != nil {
+			return err
+		}
+		for _, t := range e.Targets {
+			if t.IsRemote() || t.EC2 != nil {
+				continue
+			}
+			if _, ok := cluster.CapacityProviders[t.InstanceType]; !ok {
+				return fmt.Errorf("target %s uses instance type %q which is not offered by cluster %s", t.Name, t.InstanceType, cluster.Name)
+			}
+		}
+	}
+
 	return nil
 }
 
+// candidateClusters returns the names of the clusters an experiment may be placed in, in order
+// of preference: the cluster it names or, if it lets ironbar choose, every cluster offering all
+// of its targets' instance types. Targets with an instance of their own can join any cluster.
+func candidateClusters(e *exp.Experiment, base *BaseInfra) []string {
+	if e.Cluster != exp.ClusterAuto {
+		if e.Cluster == "" {
+			return []string{DefaultCluster}
+		}
+		return []string{e.Cluster}
+	}
+	seen := make(map[string]bool)
+	var instanceTypes []string
+	for _, t := range e.Targets {
+		if !t.IsRemote() && t.EC2 == nil && !seen[t.InstanceType] {
+			seen[t.InstanceType] = true
+			instanceTypes = append(instanceTypes, t.InstanceType)
+		}
+	}
+	return base.ClustersOffering(instanceTypes)
+}
+
+// experimentCluster returns the cluster an experiment's targets were placed in. When ironbar
+// chose the cluster it is asked which, falling back to the default cluster if it cannot say.
+func (p *Provider) experimentCluster(ctx context.Context, e *exp.Experiment, base *BaseInfra) Cluster {
+	name := e.Cluster
+	if name == exp.ClusterAuto {
+		name = ""
+		out, err := GetExperimentStatus(ctx, base.IronbarAddr, e.Name)
+		if err != nil {
+			slog.Warn("could not find the cluster ironbar placed the experiment in, using the default cluster", "error", err)
+		} else {
+			name = out.Cluster
+		}
+	}
+	cluster, err := base.Cluster(name)
+	if err != nil {
+		slog.Warn("using the default cluster", "error", err)
+		return base.Clusters[DefaultCluster]
+	}
+	return cluster
+}
+
+// NoiseEstimates returns the noise estimates recorded by ironbar, most recent first.
+func (p *Provider) NoiseEstimates(ctx context.Context) (*api.ListNoiseEstimatesOutput, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return ListNoiseEstimates(ctx, base.IronbarAddr)
+}
+
+// Analyses returns the analyses ironbar ran once the experiment completed, or nil if there are none.
+func (p *Provider) Analyses(ctx context.Context, name string) ([]api.Analysis, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return ListAnalyses(ctx, base.IronbarAddr, name)
+}
+
+// Annotate attaches an annotation, credited to the user submitting experiments, to an experiment.
+func (p *Provider) Annotate(ctx context.Context, name string, text string) (*api.Annotation, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return AddAnnotation(ctx, base.IronbarAddr, name, &api.AddAnnotationInput{
+		Text:   text,
+		Author: p.owner,
+	})
+}
+
+// RestartTarget asks ironbar to restart one of an experiment's targets, or redeploy it with a
+// new image, credited to the user submitting experiments.
+func (p *Provider) RestartTarget(ctx context.Context, name string, target string, in *api.RestartTargetInput) (*api.RestartTargetOutput, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	in.Author = p.owner
+	return RestartTarget(ctx, base.IronbarAddr, name, target, in)
+}
+
+// Query runs a PromQL query over an experiment's metrics, scoped to the experiment by ironbar.
+func (p *Provider) Query(ctx context.Context, name string, in *api.QueryInput) (*api.QueryOutput, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return Query(ctx, base.IronbarAddr, name, in)
+}
+
+func (p *Provider) Annotations(ctx context.Context, name string) ([]api.Annotation, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return ListAnnotations(ctx, base.IronbarAddr, name)
+}
+
+// Experiment returns the definition an experiment known to ironbar was deployed with.
+func (p *Provider) Experiment(ctx context.Context, name string) (*exp.Experiment, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	out, err := GetExperiment(ctx, base.IronbarAddr, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e := new(exp.Experiment)
+	if err := json.Unmarshal([]byte(out.Definition), e); err != nil {
+		return nil, fmt.Errorf("failed to decode experiment definition: %w", err)
+	}
+	return e, nil
+}
+
 func (p *Provider) ExperimentStatus(ctx context.Context, name string) (*api.ExperimentStatusOutput, error) {
 	base, err := NewBaseInfra(p.region)
 	if err != nil {
@@ -247,16 +691,178 @@ func (p *Provider) ExperimentStatus(ctx context.Context, name string) (*api.Expe
 	return out, nil
 }
 
-func (p *Provider) ListExperiments(ctx context.Context) (*api.ListExperimentsOutput, error) {
+// Owner returns the name of the user submitting experiments.
+func (p *Provider) Owner() string { return p.owner }
+
+// Team returns the team experiments are submitted for, which may be empty.
+func (p *Provider) Team() string { return p.team }
+
+// ListExperiments lists the experiments known to ironbar, filtered, sorted and paged by in,
+// which may be nil to list the running and recently stopped experiments.
+func (p *Provider) ListExperiments(ctx context.Context, in *api.ListExperimentsInput) (*api.ListExperimentsOutput, error) {
 	base, err := NewBaseInfra(p.region)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read base infra: %w", err)
 	}
 
-	out, err := ListExperiments(ctx, base.IronbarAddr)
+	out, err := ListExperiments(ctx, base.IronbarAddr, in)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list experiments: %w", err)
 	}
 
 	return out, nil
 }
+
+// ec2InstanceType returns the details of an ec2 instance type, reading them once.
+func (p *Provider) ec2InstanceType(base *BaseInfra, name string) (*ec2.InstanceTypeInfo, error) {
+	if info, ok := p.instanceTypes[name]; ok {
+		return info, nil
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(base.AwsRegion),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+	info, err := describeInstanceType(sess, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.instanceTypes == nil {
+		p.instanceTypes = make(map[string]*ec2.InstanceTypeInfo)
+	}
+	p.instanceTypes[name] = info
+	return info, nil
+}
+
+// experimentUsage returns the resources used by an experiment that count against quotas. The
+// cost covers the ec2 instances used by targets only. The cost of an instance launched for a
+// single target is only known when a capacity provider uses the same instance type.
+func (p *Provider) experimentUsage(e *exp.Experiment, base *BaseInfra) api.Usage {
+	u := api.Usage{
+		Owner:       p.owner,
+		Team:        p.team,
+		Purpose:     e.Purpose,
+		Ticket:      e.Ticket,
+		Labels:      e.Labels,
+		VCPUs:       dealgoodTaskCPU / 1024,
+		Priority:    e.Priority,
+		Preemptible: e.Preemptible,
+	}
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		u.VCPUs += seederTaskCPU / 1024
+	}
+	u.VCPUs += len(e.Providers) * seederTaskCPU / 1024
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		if t.EC2 != nil {
+			if info, ok := p.instanceTypes[t.EC2.InstanceType]; ok && info.VCpuInfo != nil {
+				u.VCPUs += int(aws.Int64Value(info.VCpuInfo.DefaultVCpus))
+			}
+			known := false
+			for _, cp := range base.CapacityProviders {
+				if cp.InstanceType.Name == t.EC2.InstanceType {
+					u.CostPerHour += float64(cp.InstanceType.CostPerHour) / 100
+					known = true
+					break
+				}
+			}
+			if !known {
+				slog.Warn("hourly cost of instance type is not known, it is not counted against cost quotas", "component", "target "+t.Name, "instance_type", t.EC2.InstanceType)
+			}
+			continue
+		}
+		if cp, ok := base.CapacityProviders[t.InstanceType]; ok {
+			u.VCPUs += cp.InstanceType.MaxCPU
+			u.CostPerHour += float64(cp.InstanceType.CostPerHour) / 100
+		}
+	}
+	return u
+}
+
+// experimentMetadata returns the tags recording who an experiment belongs to and why it is
+// being run, which are added to every resource created for it so costs can be attributed.
+func (p *Provider) experimentMetadata(e *exp.Experiment) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range map[string]string{
+		"owner":   p.owner,
+		"team":    p.team,
+		"purpose": e.Purpose,
+		"ticket":  e.Ticket,
+	} {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// AdoptResources registers existing resources under an experiment with ironbar so they are
+// removed when the experiment ends.
+func (p *Provider) AdoptResources(ctx context.Context, name string, in *api.AdoptResourcesInput) (*api.AdoptResourcesOutput, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	out, err := AdoptResources(ctx, base.IronbarAddr, name, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adopt resources: %w", err)
+	}
+
+	return out, nil
+}
+
+// CheapestInstanceType returns the name of the capacity provider with the lowest hourly cost.
+func (p *Provider) CheapestInstanceType(ctx context.Context) (string, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return "", fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	var cheapest CapacityProvider
+	for _, cp := range base.CapacityProviders {
+		if cheapest.Name == "" || cp.InstanceType.CostPerHour < cheapest.InstanceType.CostPerHour ||
+			(cp.InstanceType.CostPerHour == cheapest.InstanceType.CostPerHour && cp.Name < cheapest.Name) {
+			cheapest = cp
+		}
+	}
+	if cheapest.Name == "" {
+		return "", fmt.Errorf("no capacity providers available")
+	}
+	return cheapest.Name, nil
+}
+
+// PutPipeline defines a pipeline with ironbar, returning the existing one if it was already
+// defined with the same stages.
+func (p *Provider) PutPipeline(ctx context.Context, name string, in *api.NewPipelineInput) (*api.Pipeline, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return PutPipeline(ctx, base.IronbarAddr, name, in)
+}
+
+// Pipeline returns a pipeline with the state of each of its stages.
+func (p *Provider) Pipeline(ctx context.Context, name string) (*api.Pipeline, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	return GetPipeline(ctx, base.IronbarAddr, name)
+}
+
+// experimentKmsKey returns the customer managed key an experiment's resources are encrypted
+// with, or the empty string if they use keys managed by AWS.
+func experimentKmsKey(e *exp.Experiment, base *BaseInfra) string {
+	if e.KmsKeyArn != "" {
+		return e.KmsKeyArn
+	}
+	return base.KmsKeyArn
+}
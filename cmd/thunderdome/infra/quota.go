@@ -0,0 +1,197 @@
+package infra
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// A serviceQuota is an AWS service quota that limits the resources an experiment can use.
+type serviceQuota struct {
+	ServiceCode string
+	QuotaCode   string
+	Name        string
+	Unit        string
+	Usage       func(sess *session.Session, base *BaseInfra) (float64, error) // current usage counted against the quota
+}
+
+var (
+	ec2StandardVCPUQuota = serviceQuota{
+		ServiceCode: "ec2",
+		QuotaCode:   "L-1216C47A",
+		Name:        "Running On-Demand Standard instances",
+		Unit:        "vCPUs",
+		Usage:       ec2StandardVCPUUsage,
+	}
+
+	fargateVCPUQuota = serviceQuota{
+		ServiceCode: "fargate",
+		QuotaCode:   "L-3032A538",
+		Name:        "Fargate On-Demand vCPU resource count",
+		Unit:        "vCPUs",
+		Usage:       fargateVCPUUsage,
+	}
+)
+
+// preflightQuotas checks that the resources needed by an experiment fit within the account's
+// service quotas, given the resources already in use. Quotas that cannot be read are reported
+// as warnings.
+func preflightQuotas(sess *session.Session, base *BaseInfra, e *exp.Experiment) []PreflightResult {
+	// targets run on ec2 instances started by their capacity provider or launched for them alone
+	var targetVCPUs float64
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		if t.EC2 != nil {
+			if info, err := describeInstanceType(sess, t.EC2.InstanceType); err == nil && info.VCpuInfo != nil {
+				targetVCPUs += float64(aws.Int64Value(info.VCpuInfo.DefaultVCpus))
+			}
+			continue
+		}
+		if cp, ok := base.CapacityProviders[t.InstanceType]; ok {
+			targetVCPUs += float64(cp.InstanceType.MaxCPU)
+		}
+	}
+
+	var results []PreflightResult
+	if targetVCPUs > 0 {
+		results = append(results, checkQuota(sess, base, ec2StandardVCPUQuota, targetVCPUs))
+	}
+	results = append(results, checkQuota(sess, base, fargateVCPUQuota, float64(dealgoodTaskCPU)/1024))
+	return results
+}
+
+func checkQuota(sess *session.Session, base *BaseInfra, q serviceQuota, needed float64) PreflightResult {
+	check := fmt.Sprintf("quota %s (%s) has room for %s %s", q.QuotaCode, q.Name, formatQuantity(needed), q.Unit)
+
+	limit, err := quotaValue(sess, q.ServiceCode, q.QuotaCode)
+	if err != nil {
+		return PreflightResult{Check: check, Err: err, Warning: true}
+	}
+
+	used, err := q.Usage(sess, base)
+	if err != nil {
+		return PreflightResult{Check: check, Err: fmt.Errorf("measure usage: %w", err), Warning: true}
+	}
+
+	if used+needed > limit {
+		return PreflightResult{
+			Check: check,
+			Err:   fmt.Errorf("experiment won't fit: needs %s %s but %s of the quota of %s are in use", formatQuantity(needed), q.Unit, formatQuantity(used), formatQuantity(limit)),
+		}
+	}
+	return PreflightResult{Check: check}
+}
+
+// quotaValue returns the value of a quota applied to the account, falling back to the
+// default value if the quota has not been changed.
+func quotaValue(sess *session.Session, serviceCode, quotaCode string) (float64, error) {
+	svc := servicequotas.New(sess)
+	out, err := svc.GetServiceQuota(&servicequotas.GetServiceQuotaInput{
+		ServiceCode: aws.String(serviceCode),
+		QuotaCode:   aws.String(quotaCode),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != servicequotas.ErrCodeNoSuchResourceException {
+			return 0, fmt.Errorf("get service quota: %w", err)
+		}
+		dout, err := svc.GetAWSDefaultServiceQuota(&servicequotas.GetAWSDefaultServiceQuotaInput{
+			ServiceCode: aws.String(serviceCode),
+			QuotaCode:   aws.String(quotaCode),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("get default service quota: %w", err)
+		}
+		return aws.Float64Value(dout.Quota.Value), nil
+	}
+	return aws.Float64Value(out.Quota.Value), nil
+}
+
+// ec2StandardVCPUUsage returns the number of vCPUs used by running instances in the
+// standard instance families (A, C, D, H, I, M, R, T and Z).
+func ec2StandardVCPUUsage(sess *session.Session, base *BaseInfra) (float64, error) {
+	var vcpus float64
+	err := ec2.New(sess).DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{"pending", "running"}),
+			},
+		},
+	}, func(out *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, r := range out.Reservations {
+			for _, in := range r.Instances {
+				if in.CpuOptions == nil || !isStandardInstanceType(aws.StringValue(in.InstanceType)) {
+					continue
+				}
+				vcpus += float64(aws.Int64Value(in.CpuOptions.CoreCount) * aws.Int64Value(in.CpuOptions.ThreadsPerCore))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("describe instances: %w", err)
+	}
+	return vcpus, nil
+}
+
+// fargateVCPUUsage returns the number of vCPUs reserved by fargate tasks running in the
+// thunderdome cluster. Fargate tasks in other clusters are not counted.
+func fargateVCPUUsage(sess *session.Session, base *BaseInfra) (float64, error) {
+	svc := ecs.New(sess)
+
+	var arns []*string
+	err := svc.ListTasksPages(&ecs.ListTasksInput{
+		Cluster:    aws.String(base.EcsClusterArn),
+		LaunchType: aws.String(ecs.LaunchTypeFargate),
+	}, func(out *ecs.ListTasksOutput, last bool) bool {
+		arns = append(arns, out.TaskArns...)
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("list tasks: %w", err)
+	}
+
+	var units float64
+	for len(arns) > 0 {
+		n := len(arns)
+		if n > 100 {
+			n = 100
+		}
+		out, err := svc.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: aws.String(base.EcsClusterArn),
+			Tasks:   arns[:n],
+		})
+		if err != nil {
+			return 0, fmt.Errorf("describe tasks: %w", err)
+		}
+		for _, t := range out.Tasks {
+			cpu, err := strconv.ParseFloat(aws.StringValue(t.Cpu), 64)
+			if err == nil {
+				units += cpu
+			}
+		}
+		arns = arns[n:]
+	}
+	return units / 1024, nil
+}
+
+// isStandardInstanceType reports whether an instance type belongs to one of the families
+// counted by the standard on-demand vCPU quota.
+func isStandardInstanceType(name string) bool {
+	return name != "" && strings.ContainsRune("acdhimrtz", rune(name[0]))
+}
+
+func formatQuantity(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,577 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// seederKuboImage is the image of the ipfs node the content seeder adds content to.
+const seederKuboImage = "ipfs/kubo:v0.20.0"
+
+// seederTaskCPU is the number of cpu units, 1024 to a vCPU, reserved for the seeder task
+const seederTaskCPU = 2048
+
+// seederHermeticEntryPoint starts the kubo image with an init script that removes the public
+// bootstrap peers and disables the transports that do not support private networks. The
+// image's start script installs the swarm key from IPFS_SWARM_KEY.
+var seederHermeticEntryPoint = []string{"/bin/sh", "-c", `printf '%s\n' '#!/bin/sh' \
+	'ipfs bootstrap rm --all' \
+	'ipfs config --json Swarm.Transports.Network.QUIC false' \
+	'ipfs config --json Swarm.Transports.Network.WebTransport false' \
+	'ipfs config --json Discovery.MDNS.Enabled false' > /container-init.d/01-hermetic.sh \
+	&& exec /sbin/tini -- /usr/local/bin/start_ipfs "$@"`, "sh"}
+
+// seederPort is the port the content seeder serves the CIDs of seeded content on.
+const seederPort = 8090
+
+// A Seeder is a companion task that adds freshly generated content to its own ipfs node and
+// hands out the CID of each item once, so that dealgood can request content no target has
+// cached or stored locally. The node is reachable from the internet so that targets must find
+// and fetch the content over the network. A Seeder also runs each of an experiment's content
+// providers, seeding a fixed corpus instead.
+type Seeder struct {
+	name         string
+	experiment   string
+	base         *BaseInfra
+	kind         string // kind of ipfs node, one of the exp.ProviderKind constants
+	contentSize  int
+	contentCount int               // items of content in the corpus, zero to seed continuously
+	metadata     map[string]string // owner and purpose of the experiment, added to the tags of every resource
+	subnet       string
+	swarmKey     string // key of the private network of a hermetic experiment, empty to join the public network
+
+	taskDefinitionFamily string
+
+	// mu guards access to fields in block directly below
+	mu                     sync.Mutex
+	ready                  bool
+	taskDefinitionArn      string
+	taskDefinitionRevision int64
+	taskArn                string
+	privateIPAddress       string
+}
+
+func NewSeeder(experiment string, base *BaseInfra) *Seeder {
+	return &Seeder{
+		name:                 "seeder",
+		experiment:           experiment,
+		base:                 base,
+		kind:                 exp.ProviderKindKubo,
+		subnet:               base.VpcPublicSubnet,
+		taskDefinitionFamily: experiment + "-seeder",
+	}
+}
+
+// NewContentProvider returns a Seeder that runs one of an experiment's content providers.
+func NewContentProvider(experiment string, spec *exp.ProviderSpec, base *BaseInfra) *Seeder {
+	return &Seeder{
+		name:                 "provider " + spec.Name,
+		experiment:           experiment,
+		base:                 base,
+		kind:                 spec.Kind,
+		contentSize:          spec.ContentSize,
+		contentCount:         spec.ContentCount,
+		subnet:               base.VpcPublicSubnet,
+		taskDefinitionFamily: experiment + "-provider-" + spec.Name,
+	}
+}
+
+// ContentProviders returns a Seeder for each of the experiment's content providers.
+func ContentProviders(e *exp.Experiment, base *BaseInfra) []*Seeder {
+	var providers []*Seeder
+	for _, p := range e.Providers {
+		providers = append(providers, NewContentProvider(e.Name, p, base))
+	}
+	return providers
+}
+
+// WithContentSize sets the size in bytes of each item of content. Zero uses the content
+// seeder's default.
+func (s *Seeder) WithContentSize(v int) *Seeder {
+	s.contentSize = v
+	return s
+}
+
+// WithMetadata adds the experiment's owner and purpose to the tags of every resource created
+// for the seeder.
+func (s *Seeder) WithMetadata(metadata map[string]string) *Seeder {
+	s.metadata = metadata
+	return s
+}
+
+// WithSwarmKey has the seeder's node join the private network of a hermetic experiment
+// instead of the public network.
+func (s *Seeder) WithSwarmKey(key string) *Seeder {
+	s.swarmKey = key
+	return s
+}
+
+// WithSubnet places the seeder's task in the given subnet rather than the default subnet.
+func (s *Seeder) WithSubnet(subnet string) *Seeder {
+	if subnet != "" {
+		s.subnet = subnet
+	}
+	return s
+}
+
+func (s *Seeder) Name() string {
+	return s.name
+}
+
+func (s *Seeder) ComponentName() string {
+	return s.name
+}
+
+// URL returns the url the CIDs of seeded content and the node's peering details are fetched
+// from, or an empty string if the seeder is not ready.
+func (s *Seeder) URL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ready || s.privateIPAddress == "" {
+		return ""
+	}
+	return fmt.Sprintf("http://%s:%d", s.privateIPAddress, seederPort)
+}
+
+func (s *Seeder) Resources() []api.Resource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return []api.Resource{
+		ecsTaskResource(s.base.EcsClusterArn, s.taskArn, s.Name(), s.runTaskInput()),
+		{
+			Type: api.ResourceTypeEcsTaskDefinition,
+			Keys: map[string]string{
+				api.ResourceKeyArn: s.taskDefinitionArn,
+			},
+		},
+	}
+}
+
+// TeardownChecks returns checks that confirm the seeder's resources have been deleted.
+func (s *Seeder) TeardownChecks() []TeardownCheck {
+	return []TeardownCheck{
+		{
+			Component: s.Name(),
+			Resource:  "task " + s.taskDefinitionFamily,
+			Deleted: func(ctx context.Context, sess *session.Session) (bool, error) {
+				return isTaskStopped(ctx, sess, s.base.EcsClusterArn, s.taskDefinitionFamily)
+			},
+		},
+		{
+			Component: s.Name(),
+			Resource:  "task definition " + s.taskDefinitionFamily,
+			Deleted:   s.taskDefinitionIsInactive().Func,
+		},
+	}
+}
+
+func (s *Seeder) Setup(ctx context.Context) error {
+	slog.Info("starting setup", "component", s.Name())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(s.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return TaskSequence(ctx, sess, s.Name(),
+		s.createTaskDefinition(),
+		s.runTask(),
+	)
+}
+
+func (s *Seeder) Teardown(ctx context.Context) error {
+	slog.Info("starting teardown", "component", s.Name())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(s.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return TaskSequence(ctx, sess, s.Name(),
+		s.stopTask(),
+		s.deregisterTaskDefinition(),
+	)
+}
+
+// ForceTeardown removes the seeder's resources, continuing past failures.
+func (s *Seeder) ForceTeardown(ctx context.Context) error {
+	slog.Info("starting forced teardown", "component", s.Name())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(s.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	return ForceTaskSequence(ctx, sess, s.Name(),
+		stopFamilyTasks(s.base.EcsClusterArn, s.taskDefinitionFamily),
+		deregisterFamilyTaskDefinitions(s.taskDefinitionFamily),
+	)
+}
+
+func (s *Seeder) Ready(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	s.ready = false
+	s.mu.Unlock()
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(s.base.AwsRegion),
+	})
+	if err != nil {
+		return false, fmt.Errorf("new session: %w", err)
+	}
+
+	ready, err := CheckSequence(ctx, sess, s.Name(),
+		s.taskDefinitionIsActive(),
+		s.taskIsRunning(),
+	)
+	if !ready || err != nil {
+		return ready, err
+	}
+
+	s.mu.Lock()
+	s.ready = true
+	s.mu.Unlock()
+	return true, nil
+}
+
+func (s *Seeder) tags() map[string]*string {
+	return withMetadata(map[string]*string{
+		"experiment": aws.String(s.experiment),
+		"component":  aws.String(s.Name()),
+	}, s.metadata)
+}
+
+func (s *Seeder) createTaskDefinition() Task {
+	return Task{
+		Name:  "create task definition",
+		Check: s.taskDefinitionIsActive(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			logConfiguration := &ecs.LogConfiguration{
+				LogDriver: aws.String("awslogs"),
+				Options: map[string]*string{
+					"awslogs-group":         aws.String(s.base.LogGroupName),
+					"awslogs-region":        aws.String(s.base.AwsRegion),
+					"awslogs-stream-prefix": aws.String(s.taskDefinitionFamily),
+				},
+			}
+
+			env := map[string]string{
+				"DEALGOOD_SEEDER_LISTEN_ADDR": ":" + strconv.Itoa(seederPort),
+			}
+			if s.contentSize > 0 {
+				env["DEALGOOD_SEEDER_CONTENT_SIZE"] = strconv.Itoa(s.contentSize)
+			}
+			if s.contentCount > 0 {
+				env["DEALGOOD_SEEDER_COUNT"] = strconv.Itoa(s.contentCount)
+			}
+
+			// the kubo image's default command
+			command := []string{"daemon", "--migrate=true", "--agent-version-suffix=docker"}
+			if s.kind == exp.ProviderKindBitswap {
+				// without routing the node neither joins nor announces to the DHT and can only
+				// be reached by peers connected to it
+				command = append(command, "--routing=none")
+				env["DEALGOOD_SEEDER_PROVIDE"] = "false"
+			}
+
+			kuboEnv := map[string]string{
+				"IPFS_PROFILE": "server",
+			}
+			var entryPoint []string
+			if s.swarmKey != "" {
+				kuboEnv["IPFS_SWARM_KEY"] = s.swarmKey
+				kuboEnv["LIBP2P_FORCE_PNET"] = "1"
+				entryPoint = seederHermeticEntryPoint
+			}
+
+			in := &ecs.RegisterTaskDefinitionInput{
+				Family:                  aws.String(s.taskDefinitionFamily),
+				RequiresCompatibilities: []*string{aws.String("FARGATE")},
+				NetworkMode:             aws.String("awsvpc"),
+				ExecutionRoleArn:        aws.String(s.base.EcsExecutionRoleArn),
+				Cpu:                     aws.String(strconv.Itoa(seederTaskCPU)),
+				Memory:                  aws.String("8192"),
+				Tags:                    ecsTags(s.tags()),
+				Volumes: []*ecs.Volume{
+					{
+						Name: aws.String("ipfs-data"),
+					},
+				},
+				ContainerDefinitions: []*ecs.ContainerDefinition{
+					{
+						Name:        aws.String("kubo"),
+						Image:       aws.String(seederKuboImage),
+						EntryPoint:  aws.StringSlice(entryPoint),
+						Command:     aws.StringSlice(command),
+						Essential:   aws.Bool(true),
+						Environment: mapsToKeyValuePair(kuboEnv),
+						MountPoints: []*ecs.MountPoint{
+							{
+								SourceVolume:  aws.String("ipfs-data"),
+								ContainerPath: aws.String("/data/ipfs"),
+							},
+						},
+						PortMappings: []*ecs.PortMapping{
+							{
+								ContainerPort: aws.Int64(4001),
+								HostPort:      aws.Int64(4001),
+								Protocol:      aws.String("tcp"),
+							},
+							{
+								ContainerPort: aws.Int64(4001),
+								HostPort:      aws.Int64(4001),
+								Protocol:      aws.String("udp"),
+							},
+						},
+						LogConfiguration: logConfiguration,
+					},
+					{
+						Name:        aws.String("seeder"),
+						Image:       aws.String(s.base.DealgoodImage),
+						Command:     []*string{aws.String("/app/dealgood"), aws.String("content-seeder")},
+						Essential:   aws.Bool(true),
+						Environment: mapsToKeyValuePair(env),
+						DependsOn: []*ecs.ContainerDependency{
+							{
+								ContainerName: aws.String("kubo"),
+								Condition:     aws.String(ecs.ContainerConditionStart),
+							},
+						},
+						PortMappings: []*ecs.PortMapping{
+							{
+								ContainerPort: aws.Int64(seederPort),
+								HostPort:      aws.Int64(seederPort),
+								Protocol:      aws.String("tcp"),
+							},
+						},
+						LogConfiguration: logConfiguration,
+					},
+				},
+			}
+
+			svc := ecs.New(sess)
+			out, err := svc.RegisterTaskDefinition(in)
+			if err != nil {
+				return fmt.Errorf("create task definition: %w", err)
+			}
+
+			if out == nil || out.TaskDefinition == nil || out.TaskDefinition.TaskDefinitionArn == nil {
+				return fmt.Errorf("no task definition arn found")
+			}
+
+			return nil
+		},
+	}
+}
+
+func (s *Seeder) deregisterTaskDefinition() Task {
+	return Task{
+		Name:  "deregister task definition",
+		Check: s.taskDefinitionIsInactive(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return deregisterEcsTaskDefinition(ctx, sess, s.taskDefinitionArn)
+		},
+	}
+}
+
+func (s *Seeder) runTask() Task {
+	return Task{
+		Name:  "run task",
+		Check: s.taskIsRunning(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			svc := ecs.New(sess)
+			out, err := svc.RunTask(s.runTaskInput())
+			if err != nil {
+				return fmt.Errorf("run task: %w", err)
+			}
+
+			if out == nil {
+				return fmt.Errorf("no run task output found")
+			}
+
+			for _, f := range out.Failures {
+				slog.Warn("run task failure", "component", s.Name(), "arn", dstr(f.Arn), "detail", dstr(f.Detail), "reason", dstr(f.Reason))
+			}
+
+			if len(out.Tasks) != 1 {
+				return fmt.Errorf("run task returned unexpected number of tasks: %d", len(out.Tasks))
+			}
+
+			return nil
+		},
+	}
+}
+
+// runTaskInput returns the input used to run the seeder's task. The task is given a public ip
+// so that its node can be dialled by the targets.
+func (s *Seeder) runTaskInput() *ecs.RunTaskInput {
+	return &ecs.RunTaskInput{
+		LaunchType: aws.String("FARGATE"),
+		NetworkConfiguration: &ecs.NetworkConfiguration{
+			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+				AssignPublicIp: s.base.assignPublicIp(s.subnet),
+				SecurityGroups: []*string{
+					aws.String(s.base.SeederSecurityGroup),
+				},
+				Subnets: []*string{
+					aws.String(s.subnet),
+				},
+			},
+		},
+		Cluster:        aws.String(s.base.EcsClusterArn),
+		Count:          aws.Int64(1),
+		TaskDefinition: aws.String(s.taskDefinitionFamily),
+		Tags:           ecsTags(s.tags()),
+	}
+}
+
+func (s *Seeder) stopTask() Task {
+	return Task{
+		Name:  "stop task",
+		Check: s.taskIsStoppedOrStopping(),
+		Func: func(ctx context.Context, sess *session.Session) error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return stopEcsTask(ctx, sess, s.base.EcsClusterArn, s.taskArn)
+		},
+	}
+}
+
+func (s *Seeder) taskDefinitionIsActive() Check {
+	return Check{
+		Name:        "task definition is active",
+		FailureText: "task definition is not active",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			var err error
+			s.taskDefinitionArn, s.taskDefinitionRevision, err = findTaskDefinition(s.taskDefinitionFamily, sess)
+			if err != nil {
+				return false, err
+			}
+			return s.taskDefinitionArn != "", nil
+		},
+	}
+}
+
+func (s *Seeder) taskDefinitionIsInactive() Check {
+	return Check{
+		Name:        "task definition is inactive",
+		FailureText: "task definition is active",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			var err error
+			s.taskDefinitionArn, s.taskDefinitionRevision, err = findTaskDefinition(s.taskDefinitionFamily, sess)
+			if err != nil {
+				return false, err
+			}
+			return s.taskDefinitionArn == "", nil
+		},
+	}
+}
+
+// taskIsRunning also captures the private ip address of the running task, which dealgood
+// uses to reach the content seeder.
+func (s *Seeder) taskIsRunning() Check {
+	return Check{
+		Name:        "task is running",
+		FailureText: "task is not running",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			taskArn, err := findTask(s.base.EcsClusterArn, s.taskDefinitionFamily, sess)
+			if err != nil {
+				return false, err
+			}
+
+			s.mu.Lock()
+			s.taskArn = taskArn
+			s.mu.Unlock()
+			if taskArn == "" {
+				return false, nil
+			}
+
+			running, err := isTaskRunning(ctx, sess, s.base.EcsClusterArn, taskArn)
+			if err != nil || !running {
+				return false, err
+			}
+
+			ip, err := taskPrivateIPAddress(ctx, sess, s.base.EcsClusterArn, taskArn)
+			if err != nil {
+				return false, err
+			}
+			s.mu.Lock()
+			s.privateIPAddress = ip
+			s.mu.Unlock()
+			slog.Debug("captured task details", "component", s.Name(), "task_arn", taskArn, "private_ip_address", ip)
+			return ip != "", nil
+		},
+	}
+}
+
+func (s *Seeder) taskIsStoppedOrStopping() Check {
+	return Check{
+		Name:        "task is stopped or stopping",
+		FailureText: "task is not stopped or stopping",
+		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
+			taskArn, err := findTask(s.base.EcsClusterArn, s.taskDefinitionFamily, sess)
+			if err != nil {
+				return false, err
+			}
+			s.mu.Lock()
+			s.taskArn = taskArn
+			s.mu.Unlock()
+
+			if taskArn == "" {
+				return true, nil
+			}
+
+			running, err := isTaskRunning(ctx, sess, s.base.EcsClusterArn, taskArn)
+			if err != nil {
+				return false, err
+			}
+			return !running, nil
+		},
+	}
+}
+
+// taskPrivateIPAddress returns the private ip address of the network interface attached to
+// an awsvpc task, or an empty string if it has not been attached yet.
+func taskPrivateIPAddress(ctx context.Context, sess *session.Session, clusterArn, taskArn string) (string, error) {
+	svc := ecs.New(sess)
+	out, err := svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(clusterArn),
+		Tasks:   []*string{aws.String(taskArn)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describe tasks: %w", err)
+	}
+	for _, task := range out.Tasks {
+		for _, att := range task.Attachments {
+			if dstr(att.Type) != "ElasticNetworkInterface" {
+				continue
+			}
+			for _, kv := range att.Details {
+				if dstr(kv.Name) == "privateIPv4Address" {
+					return dstr(kv.Value), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
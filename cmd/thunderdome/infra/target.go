@@ -3,7 +3,9 @@ package infra
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
 type Target struct {
@@ -23,8 +26,19 @@ type Target struct {
 	experiment       string
 	base             *BaseInfra
 	image            string
-	capacityProvider string
+	capacityProvider string  // instance type the target runs on, the name of a capacity provider in the default cluster
+	cluster          Cluster // cluster the target is placed in
 	environment      map[string]string
+	debugPort        int               // port serving pprof profiles, zero if none
+	adminPort        int               // port serving the target's admin api, zero if none
+	metadata         map[string]string // owner and purpose of the experiment, added to the tags of every resource
+	egress           *exp.EgressSpec   // upstreams and rules applied by an egress proxy sidecar, nil to connect directly
+	ec2              *exp.EC2Spec      // instance launched for the target alone, nil to use the capacity provider
+	zone             string            // availability zone the target is constrained to, empty to let ecs choose
+	subnet           string            // subnet in zone, in which an instance launched for the target is placed
+	providerPeering  []string          // urls of the peering details of the experiment's content providers
+	swarmKey         string            // key of the private network of a hermetic experiment, empty to join the public network
+	conformanceImage string            // gateway-conformance image whose fixtures are imported by the gateway, empty if it is not tested
 
 	taskDefinitionFamily string
 	taskName             string
@@ -46,6 +60,7 @@ func NewTarget(name, experiment string, base *BaseInfra, image string, capacityP
 		name:                 name,
 		image:                image,
 		capacityProvider:     capacityProvider,
+		cluster:              base.Clusters[DefaultCluster],
 		environment:          environment,
 		taskDefinitionFamily: experiment + "-" + name,
 		taskName:             experiment + "-" + name,
@@ -106,33 +121,66 @@ func (t *Target) Resources() []api.Resource {
 	defer t.mu.Unlock()
 
 	var res []api.Resource
-	res = append(res, api.Resource{
-		Type: api.ResourceTypeEcsTask,
-		Keys: map[string]string{
-			api.ResourceKeyEcsClusterArn: t.base.EcsClusterArn,
-			api.ResourceKeyArn:           t.taskArn,
-		},
-	})
+	task := ecsTaskResource(t.cluster.Arn, t.taskArn, t.ComponentName(), t.runTaskInput())
+	if t.debugPort != 0 {
+		task.Keys[api.ResourceKeyDebugPort] = strconv.Itoa(t.debugPort)
+	}
+	if t.adminPort != 0 {
+		task.Keys[api.ResourceKeyAdminPort] = strconv.Itoa(t.adminPort)
+	}
+	res = append(res, task)
 	res = append(res, api.Resource{
 		Type: api.ResourceTypeEcsTaskDefinition,
 		Keys: map[string]string{
 			api.ResourceKeyArn: t.taskDefinitionArn,
 		},
 	})
-	res = append(res, api.Resource{
+	instance := api.Resource{
 		Type: api.ResourceTypeEc2Instance,
 		Keys: map[string]string{
 			api.ResourceKeyEc2InstanceID: t.taskEC2InstanceID,
 		},
-	})
+	}
+	if t.ec2 != nil {
+		instance.Keys[api.ResourceKeyDedicated] = "true"
+	}
+	res = append(res, instance)
 	return res
 }
 
+// TeardownChecks returns checks that confirm the target's resources have been deleted. The
+// target's ec2 instance is only included when it was launched for the target, otherwise it
+// belongs to the capacity provider's auto scaling group.
+func (t *Target) TeardownChecks() []TeardownCheck {
+	checks := []TeardownCheck{
+		{
+			Component: t.ComponentName(),
+			Resource:  "task " + t.taskDefinitionFamily,
+			Deleted: func(ctx context.Context, sess *session.Session) (bool, error) {
+				return isTaskStopped(ctx, sess, t.cluster.Arn, t.taskDefinitionFamily)
+			},
+		},
+		{
+			Component: t.ComponentName(),
+			Resource:  "task definition " + t.taskDefinitionFamily,
+			Deleted:   t.taskDefinitionIsInactive().Func,
+		},
+	}
+	if t.ec2 != nil {
+		checks = append(checks, TeardownCheck{
+			Component: t.ComponentName(),
+			Resource:  "ec2 instance " + t.taskName,
+			Deleted:   t.instanceIsTerminated().Func,
+		})
+	}
+	return checks
+}
+
 func (t *Target) tags() map[string]*string {
-	return map[string]*string{
+	return withMetadata(map[string]*string{
 		"experiment": aws.String(t.experiment),
 		"component":  aws.String(t.ComponentName()),
-	}
+	}, t.metadata)
 }
 
 func (t *Target) Setup(ctx context.Context) error {
@@ -145,10 +193,17 @@ func (t *Target) Setup(ctx context.Context) error {
 		return fmt.Errorf("new session: %w", err)
 	}
 
-	return TaskSequence(ctx, sess, t.ComponentName(),
-		t.createTaskDefinition(),
-		t.runTask(),
-	)
+	var tasks []Task
+	if t.ec2 != nil {
+		tasks = append(tasks, t.launchInstance())
+		if t.ec2.EnaExpress {
+			tasks = append(tasks, t.enableEnaExpress())
+		}
+		tasks = append(tasks, t.registerContainerInstance())
+	}
+	tasks = append(tasks, t.createTaskDefinition(), t.runTask())
+
+	return TaskSequence(ctx, sess, t.ComponentName(), tasks...)
 }
 
 func (t *Target) Teardown(ctx context.Context) error {
@@ -160,10 +215,37 @@ func (t *Target) Teardown(ctx context.Context) error {
 		return fmt.Errorf("new session: %w", err)
 	}
 
-	return TaskSequence(ctx, sess, t.ComponentName(),
+	tasks := []Task{
 		t.stopTask(),
 		t.deregisterTaskDefinition(),
-	)
+	}
+	if t.ec2 != nil {
+		tasks = append(tasks, t.terminateInstance())
+	}
+
+	return TaskSequence(ctx, sess, t.ComponentName(), tasks...)
+}
+
+// ForceTeardown stops every task for the target and waits for them to stop before
+// deregistering all revisions of its task definition, continuing past failures.
+func (t *Target) ForceTeardown(ctx context.Context) error {
+	slog.Info("starting forced teardown", "component", t.ComponentName())
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(t.base.AwsRegion),
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+
+	tasks := []Task{
+		stopFamilyTasks(t.cluster.Arn, t.taskDefinitionFamily),
+		deregisterFamilyTaskDefinitions(t.taskDefinitionFamily),
+	}
+	if t.ec2 != nil {
+		tasks = append(tasks, t.terminateInstance())
+	}
+
+	return ForceTaskSequence(ctx, sess, t.ComponentName(), tasks...)
 }
 
 func (t *Target) Ready(ctx context.Context) (bool, error) {
@@ -196,13 +278,33 @@ func (t *Target) createTaskDefinition() Task {
 		Name:  "create task definition",
 		Check: t.taskDefinitionIsActive(),
 		Func: func(ctx context.Context, sess *session.Session) error {
-			cp, ok := t.base.CapacityProviders[t.capacityProvider]
-			if !ok {
-				return fmt.Errorf("unsupported capacity provider %q for %s", t.capacityProvider, t.ComponentName())
+			memory, err := t.taskMemory(sess)
+			if err != nil {
+				return err
 			}
 
-			additionalEnv := map[string]string{
-				// TODO: any additional env?
+			additionalEnv := map[string]string{}
+			if t.egress != nil {
+				// route the gateway's HTTP traffic through the egress proxy, except for the
+				// task metadata and credentials endpoints
+				proxy := fmt.Sprintf("http://localhost:%d", egressProxyPort)
+				additionalEnv["HTTP_PROXY"] = proxy
+				additionalEnv["HTTPS_PROXY"] = proxy
+				additionalEnv["NO_PROXY"] = "localhost,127.0.0.1,169.254.169.254,169.254.170.2"
+			}
+			if len(t.providerPeering) > 0 {
+				// read by an init script that peers the gateway with the content providers
+				additionalEnv["THUNDERDOME_PROVIDER_PEERING"] = strings.Join(t.providerPeering, ",")
+			}
+			if t.swarmKey != "" {
+				// installed by the image's start script, the node refuses to start without it
+				additionalEnv["IPFS_SWARM_KEY"] = t.swarmKey
+				additionalEnv["LIBP2P_FORCE_PNET"] = "1"
+				additionalEnv["THUNDERDOME_HERMETIC"] = "1"
+			}
+			if t.conformanceImage != "" {
+				// imported by an init script so that the conformance tests find their content
+				additionalEnv["THUNDERDOME_CONFORMANCE_FIXTURES"] = conformanceFixturesPath + "/fixtures.car"
 			}
 
 			logStreamPrefix := fmt.Sprintf("%s-%s", t.experiment, t.name)
@@ -211,7 +313,7 @@ func (t *Target) createTaskDefinition() Task {
 				Family:                  aws.String(t.taskDefinitionFamily),
 				RequiresCompatibilities: []*string{aws.String("EC2")},
 				NetworkMode:             aws.String("host"),
-				Memory:                  aws.String(strconv.Itoa(1024 * (cp.InstanceType.MaxMemory - 2))),
+				Memory:                  aws.String(strconv.FormatInt(memory, 10)),
 				ExecutionRoleArn:        aws.String(t.base.EcsExecutionRoleArn),
 				TaskRoleArn:             aws.String(t.base.TargetTaskRoleArn),
 				Tags:                    ecsTags(t.tags()),
@@ -359,6 +461,27 @@ func (t *Target) createTaskDefinition() Task {
 				},
 			}
 
+			if t.egress != nil {
+				in.ContainerDefinitions = append(in.ContainerDefinitions, t.egressContainer(logStreamPrefix))
+			}
+			if t.conformanceImage != "" {
+				in.Volumes = append(in.Volumes, &ecs.Volume{Name: aws.String("conformance-fixtures")})
+				gateway := in.ContainerDefinitions[0]
+				gateway.MountPoints = append(gateway.MountPoints, &ecs.MountPoint{
+					SourceVolume:  aws.String("conformance-fixtures"),
+					ContainerPath: aws.String(conformanceFixturesPath),
+					ReadOnly:      aws.Bool(true),
+				})
+				gateway.DependsOn = []*ecs.ContainerDependency{
+					{
+						ContainerName: aws.String("conformance-fixtures"),
+						Condition:     aws.String(ecs.ContainerConditionSuccess),
+					},
+				}
+				in.ContainerDefinitions = append(in.ContainerDefinitions, t.conformanceFixturesContainer(logStreamPrefix))
+			}
+			in.ContainerDefinitions = append(in.ContainerDefinitions, t.networkBaselineContainer(logStreamPrefix))
+
 			svc := ecs.New(sess)
 			out, err := svc.RegisterTaskDefinition(in)
 			if err != nil {
@@ -374,6 +497,128 @@ func (t *Target) createTaskDefinition() Task {
 	}
 }
 
+// taskMemory returns the memory in MiB given to the target's task, all of the instance's memory
+// less 2GiB left for the operating system and the ecs agent.
+func (t *Target) taskMemory(sess *session.Session) (int64, error) {
+	if t.ec2 != nil {
+		info, err := describeInstanceType(sess, t.ec2.InstanceType)
+		if err != nil {
+			return 0, err
+		}
+		if info.MemoryInfo == nil || info.MemoryInfo.SizeInMiB == nil {
+			return 0, fmt.Errorf("no memory size found for instance type %s", t.ec2.InstanceType)
+		}
+		return *info.MemoryInfo.SizeInMiB - 2048, nil
+	}
+
+	cp, ok := t.base.CapacityProviders[t.capacityProvider]
+	if !ok {
+		return 0, fmt.Errorf("unsupported capacity provider %q for %s", t.capacityProvider, t.ComponentName())
+	}
+	return int64(1024 * (cp.InstanceType.MaxMemory - 2)), nil
+}
+
+// Ports used by the egress proxy sidecar. The metrics port is scraped by the target's grafana agent.
+const (
+	egressProxyPort   = 3128
+	egressMetricsPort = 9092
+)
+
+// egressContainer defines the proxy sidecar that counts the requests the gateway sends to
+// each shared upstream and destination and refuses destinations the rules do not permit.
+func (t *Target) egressContainer(logStreamPrefix string) *ecs.ContainerDefinition {
+	names := make([]string, 0, len(t.egress.Upstreams))
+	for name := range t.egress.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var upstreams []string
+	for _, name := range names {
+		for _, host := range t.egress.Upstreams[name] {
+			upstreams = append(upstreams, name+":"+host)
+		}
+	}
+
+	return &ecs.ContainerDefinition{
+		Name:      aws.String("egress"),
+		Image:     aws.String(t.base.EgressImage),
+		Essential: aws.Bool(true),
+		Environment: []*ecs.KeyValuePair{
+			{
+				Name:  aws.String("EGRESS_LISTEN_ADDR"),
+				Value: aws.String(fmt.Sprintf("localhost:%d", egressProxyPort)),
+			},
+			{
+				Name:  aws.String("EGRESS_PROMETHEUS_ADDR"),
+				Value: aws.String(fmt.Sprintf(":%d", egressMetricsPort)),
+			},
+			{
+				Name:  aws.String("EGRESS_UPSTREAMS"),
+				Value: aws.String(strings.Join(upstreams, ",")),
+			},
+			{
+				Name:  aws.String("EGRESS_ALLOW"),
+				Value: aws.String(strings.Join(t.egress.Allow, ",")),
+			},
+			{
+				Name:  aws.String("EGRESS_DENY"),
+				Value: aws.String(strings.Join(t.egress.Deny, ",")),
+			},
+		},
+		LogConfiguration: &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(t.base.LogGroupName),
+				"awslogs-region":        aws.String(t.base.AwsRegion),
+				"awslogs-stream-prefix": aws.String(logStreamPrefix),
+			},
+		},
+		PortMappings: []*ecs.PortMapping{
+			{
+				ContainerPort: aws.Int64(egressMetricsPort),
+				HostPort:      aws.Int64(egressMetricsPort),
+				Protocol:      aws.String("tcp"),
+			},
+		},
+	}
+}
+
+// networkBaselinePort is the port of the baseline server run alongside each target, which
+// dealgood uses to measure the round trip time and throughput to the target's host before the
+// measured window starts.
+const networkBaselinePort = 5201
+
+// networkBaselineContainer defines the sidecar serving dealgood's network baseline. It is not
+// essential so a failure cannot stop the gateway.
+func (t *Target) networkBaselineContainer(logStreamPrefix string) *ecs.ContainerDefinition {
+	return &ecs.ContainerDefinition{
+		Name:      aws.String("netbaseline"),
+		Image:     aws.String(t.base.DealgoodImage),
+		Essential: aws.Bool(false),
+		Command: []*string{
+			aws.String("/app/dealgood"),
+			aws.String("baseline-server"),
+			aws.String("--listen-addr"),
+			aws.String(fmt.Sprintf(":%d", networkBaselinePort)),
+		},
+		LogConfiguration: &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(t.base.LogGroupName),
+				"awslogs-region":        aws.String(t.base.AwsRegion),
+				"awslogs-stream-prefix": aws.String(logStreamPrefix),
+			},
+		},
+		PortMappings: []*ecs.PortMapping{
+			{
+				ContainerPort: aws.Int64(networkBaselinePort),
+				HostPort:      aws.Int64(networkBaselinePort),
+				Protocol:      aws.String("tcp"),
+			},
+		},
+	}
+}
+
 func (t *Target) deregisterTaskDefinition() Task {
 	return Task{
 		Name:  "deregister task definition",
@@ -392,26 +637,7 @@ func (t *Target) runTask() Task {
 		Check: t.taskIsRunning(),
 		Func: func(ctx context.Context, sess *session.Session) error {
 			svc := ecs.New(sess)
-			in := &ecs.RunTaskInput{
-				CapacityProviderStrategy: []*ecs.CapacityProviderStrategyItem{
-					{
-						Base:             aws.Int64(0),
-						CapacityProvider: aws.String(t.capacityProvider),
-						Weight:           aws.Int64(1),
-					},
-				},
-				Cluster:        aws.String(t.base.EcsClusterArn),
-				Count:          aws.Int64(1),
-				TaskDefinition: aws.String(t.taskDefinitionFamily),
-				Group:          aws.String(t.experiment),
-				PlacementStrategy: []*ecs.PlacementStrategy{
-					{
-						Field: aws.String("instanceId"),
-						Type:  aws.String("spread"),
-					},
-				},
-				Tags: ecsTags(t.tags()),
-			}
+			in := t.runTaskInput()
 
 			attempts := 3
 			for attempts > 0 {
@@ -450,6 +676,71 @@ func (t *Target) runTask() Task {
 	}
 }
 
+// ecsCapacityProvider returns the name of the capacity provider offering the target's instance
+// type in the cluster it is placed in.
+func (t *Target) ecsCapacityProvider() string {
+	if name, ok := t.cluster.CapacityProviders[t.capacityProvider]; ok {
+		return name
+	}
+	return t.capacityProvider
+}
+
+// runTaskInput returns the input used to run the target's task. It is also given to ironbar
+// so that it can run the task again if it fails for a transient reason. A target with an
+// instance of its own is constrained to run on that instance.
+func (t *Target) runTaskInput() *ecs.RunTaskInput {
+	if t.ec2 != nil {
+		return &ecs.RunTaskInput{
+			LaunchType:     aws.String(ecs.LaunchTypeEc2),
+			Cluster:        aws.String(t.cluster.Arn),
+			Count:          aws.Int64(1),
+			TaskDefinition: aws.String(t.taskDefinitionFamily),
+			Group:          aws.String(t.experiment),
+			PlacementConstraints: []*ecs.PlacementConstraint{
+				{
+					Type:       aws.String(ecs.PlacementConstraintTypeMemberOf),
+					Expression: aws.String(t.placementExpression()),
+				},
+			},
+			Tags: ecsTags(t.tags()),
+		}
+	}
+	return &ecs.RunTaskInput{
+		CapacityProviderStrategy: []*ecs.CapacityProviderStrategyItem{
+			{
+				Base:             aws.Int64(0),
+				CapacityProvider: aws.String(t.ecsCapacityProvider()),
+				Weight:           aws.Int64(1),
+			},
+		},
+		Cluster:              aws.String(t.cluster.Arn),
+		Count:                aws.Int64(1),
+		TaskDefinition:       aws.String(t.taskDefinitionFamily),
+		Group:                aws.String(t.experiment),
+		PlacementConstraints: t.zoneConstraints(),
+		PlacementStrategy: []*ecs.PlacementStrategy{
+			{
+				Field: aws.String("instanceId"),
+				Type:  aws.String("spread"),
+			},
+		},
+		Tags: ecsTags(t.tags()),
+	}
+}
+
+// zoneConstraints constrains the target's task to the availability zone assigned to it, if any.
+func (t *Target) zoneConstraints() []*ecs.PlacementConstraint {
+	if t.zone == "" {
+		return nil
+	}
+	return []*ecs.PlacementConstraint{
+		{
+			Type:       aws.String(ecs.PlacementConstraintTypeMemberOf),
+			Expression: aws.String(fmt.Sprintf("%s == %s", zoneAttribute, t.zone)),
+		},
+	}
+}
+
 func (t *Target) stopTask() Task {
 	return Task{
 		Name:  "stop task",
@@ -457,7 +748,7 @@ func (t *Target) stopTask() Task {
 		Func: func(ctx context.Context, sess *session.Session) error {
 			t.mu.Lock()
 			defer t.mu.Unlock()
-			return stopEcsTask(ctx, sess, t.base.EcsClusterArn, t.taskArn)
+			return stopEcsTask(ctx, sess, t.cluster.Arn, t.taskArn)
 		},
 	}
 }
@@ -511,7 +802,7 @@ func (t *Target) taskIsRunning() Check {
 		Name:        "task is running",
 		FailureText: "task is not running",
 		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
-			taskArn, err := findTask(t.base.EcsClusterArn, t.taskDefinitionFamily, sess)
+			taskArn, err := findTask(t.cluster.Arn, t.taskDefinitionFamily, sess)
 			if err != nil {
 				return false, err
 			}
@@ -526,7 +817,7 @@ func (t *Target) taskIsRunning() Check {
 
 			slog.Debug("captured task details", "component", t.ComponentName(), "task_arn", taskArn)
 
-			running, err := isTaskRunning(ctx, sess, t.base.EcsClusterArn, taskArn)
+			running, err := isTaskRunning(ctx, sess, t.cluster.Arn, taskArn)
 			if err != nil {
 				return false, err
 			}
@@ -537,7 +828,7 @@ func (t *Target) taskIsRunning() Check {
 
 			svc := ecs.New(sess)
 			in := &ecs.DescribeTasksInput{
-				Cluster: aws.String(t.base.EcsClusterArn),
+				Cluster: aws.String(t.cluster.Arn),
 				Tasks: []*string{
 					aws.String(taskArn),
 				},
@@ -568,7 +859,7 @@ func (t *Target) taskIsRunning() Check {
 			}
 
 			inci := &ecs.DescribeContainerInstancesInput{
-				Cluster: aws.String(t.base.EcsClusterArn),
+				Cluster: aws.String(t.cluster.Arn),
 				ContainerInstances: []*string{
 					task.ContainerInstanceArn,
 				},
@@ -633,7 +924,7 @@ func (t *Target) taskIsStoppedOrStopping() Check {
 		Name:        "task is stopped or stopping",
 		FailureText: "task is not stopped or stopping",
 		Func: func(ctx context.Context, sess *session.Session) (bool, error) {
-			taskArn, err := findTask(t.base.EcsClusterArn, t.taskDefinitionFamily, sess)
+			taskArn, err := findTask(t.cluster.Arn, t.taskDefinitionFamily, sess)
 			if err != nil {
 				return false, err
 			}
@@ -648,7 +939,7 @@ func (t *Target) taskIsStoppedOrStopping() Check {
 			}
 			slog.Debug("captured task details", "component", t.ComponentName(), "task_arn", taskArn)
 
-			running, err := isTaskRunning(ctx, sess, t.base.EcsClusterArn, taskArn)
+			running, err := isTaskRunning(ctx, sess, t.cluster.Arn, taskArn)
 			if err != nil {
 				return false, err
 			}
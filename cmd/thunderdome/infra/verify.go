@@ -0,0 +1,169 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// A TeardownCheck confirms that a resource created for an experiment has been deleted.
+type TeardownCheck struct {
+	Component string
+	Resource  string
+	Deleted   func(context.Context, *session.Session) (bool, error)
+}
+
+// TeardownResult is the outcome of verifying that a single resource was deleted.
+type TeardownResult struct {
+	Component string
+	Resource  string
+	Deleted   bool
+	Err       error // the last error seen while checking the resource, if it could not be confirmed as deleted
+}
+
+func (r TeardownResult) String() string {
+	return r.Component + ": " + r.Resource
+}
+
+// teardownVerifyInterval is the time to wait between attempts to confirm that resources
+// have been deleted, to allow for eventual consistency in the AWS apis.
+const teardownVerifyInterval = 10 * time.Second
+
+// VerifyTeardown checks that every resource created for an experiment has been deleted,
+// retrying until timeout elapses. A result is returned for every resource; resources that
+// survive have Deleted set to false.
+func (p *Provider) VerifyTeardown(ctx context.Context, e *exp.Experiment, timeout time.Duration) ([]TeardownResult, error) {
+	base, err := NewBaseInfra(p.region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base infra: %w", err)
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(p.region),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+
+	cluster := p.experimentCluster(ctx, e, base)
+	var checks []TeardownCheck
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		target := NewTarget(t.Name, e.Name, base, t.Image, t.InstanceType, t.Environment)
+		target.ec2 = t.EC2
+		target.cluster = cluster
+		checks = append(checks, target.TeardownChecks()...)
+	}
+	for _, g := range PlacementGroups(e.Name, base, e.Targets) {
+		checks = append(checks, g.TeardownChecks()...)
+	}
+	checks = append(checks, NewDealgood(e.Name, base).WithTransport(e.Transport).WithWorkload(e.Workload, nil).TeardownChecks()...)
+	if e.Workload != nil && e.Workload.Preset == exp.WorkloadPresetCold {
+		checks = append(checks, NewSeeder(e.Name, base).TeardownChecks()...)
+	}
+	for _, p := range ContentProviders(e, base) {
+		checks = append(checks, p.TeardownChecks()...)
+	}
+
+	results := make([]TeardownResult, len(checks))
+	for i, c := range checks {
+		results[i] = TeardownResult{Component: c.Component, Resource: c.Resource}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		remaining := 0
+		for i, c := range checks {
+			if results[i].Deleted {
+				continue
+			}
+			deleted, err := c.Deleted(ctx, sess)
+			results[i].Deleted = deleted && err == nil
+			results[i].Err = err
+			if !results[i].Deleted {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			return results, nil
+		}
+
+		slog.Info("waiting for resources to be deleted", "remaining", remaining)
+		select {
+		case <-ctx.Done():
+			return results, nil
+		case <-time.After(teardownVerifyInterval):
+		}
+	}
+}
+
+// isTaskStopped reports whether every task in the task definition family has stopped. Tasks
+// that have been asked to stop but are still shutting down are not counted as stopped.
+func isTaskStopped(ctx context.Context, sess *session.Session, clusterArn, family string) (bool, error) {
+	svc := ecs.New(sess)
+	for _, desired := range []string{ecs.DesiredStatusRunning, ecs.DesiredStatusStopped} {
+		out, err := svc.ListTasksWithContext(ctx, &ecs.ListTasksInput{
+			Cluster:       aws.String(clusterArn),
+			Family:        aws.String(family),
+			DesiredStatus: aws.String(desired),
+		})
+		if err != nil {
+			return false, fmt.Errorf("list tasks: %w", err)
+		}
+		if len(out.TaskArns) == 0 {
+			continue
+		}
+		if desired == ecs.DesiredStatusRunning {
+			return false, nil
+		}
+
+		dout, err := svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(clusterArn),
+			Tasks:   out.TaskArns,
+		})
+		if err != nil {
+			return false, fmt.Errorf("describe tasks: %w", err)
+		}
+		for _, t := range dout.Tasks {
+			if aws.StringValue(t.LastStatus) != ecs.DesiredStatusStopped {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// findQueueSubscription returns the arn of the topic's subscription for the named queue, or an
+// empty string if there is none. The queue is matched by name since its arn can no longer be
+// looked up once it has been deleted.
+func findQueueSubscription(ctx context.Context, sess *session.Session, topicArn, queueName string) (string, error) {
+	var subscriptionArn string
+	err := sns.New(sess).ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	}, func(out *sns.ListSubscriptionsByTopicOutput, last bool) bool {
+		for _, s := range out.Subscriptions {
+			if aws.StringValue(s.Protocol) == "sqs" && strings.HasSuffix(aws.StringValue(s.Endpoint), ":"+queueName) {
+				subscriptionArn = aws.StringValue(s.SubscriptionArn)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", fmt.Errorf("list subscriptions by topic: %w", err)
+	}
+	return subscriptionArn, nil
+}
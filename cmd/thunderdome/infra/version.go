@@ -0,0 +1,96 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/ironbar/client"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+	"github.com/plprobelab/thunderdome/pkg/version"
+)
+
+// ironbarFeatures returns the features of ironbar that an experiment's definition relies on,
+// each mapped to the field of the definition that needs it. An ironbar without one of them
+// would silently ignore the field.
+func ironbarFeatures(e *exp.Experiment) map[string]string {
+	needed := make(map[string]string)
+	if e == nil {
+		return needed
+	}
+	if e.KmsKeyArn != "" {
+		needed[api.FeatureKmsKey] = "kms_key_arn"
+	}
+	if e.NoiseBaseline {
+		needed[api.FeatureNoiseBaseline] = "noise baseline"
+	}
+	if e.Soak != nil {
+		needed[api.FeatureSoak] = "soak"
+	}
+	if e.Shutdown != nil && len(e.Shutdown.StageTimeouts) > 0 {
+		needed[api.FeatureShutdownStages] = "shutdown.stage_timeout_seconds"
+	}
+	return needed
+}
+
+// preflightIronbar checks that ironbar and this version of thunderdome can work together and
+// that ironbar supports every part of the experiment's definition that it acts on. An ironbar
+// that predates version reporting is only a warning since it may still be compatible.
+func preflightIronbar(ctx context.Context, addr string, e *exp.Experiment) PreflightResult {
+	const check = "ironbar version is compatible"
+	needed := ironbarFeatures(e)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := client.New(addr, nil).Version(ctx)
+	if err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			if len(needed) > 0 {
+				return PreflightResult{Check: check, Err: fmt.Errorf("ironbar does not report its version and may ignore %s in the experiment definition", strings.Join(neededFields(needed), ", ")), Warning: true}
+			}
+			return PreflightResult{Check: check, Err: fmt.Errorf("ironbar does not report its version"), Warning: true}
+		}
+		return PreflightResult{Check: check, Err: fmt.Errorf("get ironbar version: %w", err), Warning: true}
+	}
+	return PreflightResult{Check: check, Err: checkIronbarVersion(out, needed)}
+}
+
+// checkIronbarVersion returns an error if ironbar and this version of thunderdome cannot work
+// together or ironbar lacks any of the needed features.
+func checkIronbarVersion(out *api.VersionOutput, needed map[string]string) error {
+	if out.APIVersion < api.MinAPIVersion {
+		return fmt.Errorf("ironbar %s serves api version %d but thunderdome %s needs at least version %d, upgrade ironbar", out.Version, out.APIVersion, version.String(), api.MinAPIVersion)
+	}
+	if api.APIVersion < out.MinAPIVersion {
+		return fmt.Errorf("ironbar %s needs clients of api version %d or later but thunderdome %s uses version %d, upgrade thunderdome", out.Version, out.MinAPIVersion, version.String(), api.APIVersion)
+	}
+
+	supported := make(map[string]bool, len(out.Features))
+	for _, f := range out.Features {
+		supported[f] = true
+	}
+	missing := make(map[string]string)
+	for feature, field := range needed {
+		if !supported[feature] {
+			missing[feature] = field
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("ironbar %s does not support %s in the experiment definition and would ignore it, upgrade ironbar or remove it", out.Version, strings.Join(neededFields(missing), ", "))
+	}
+	return nil
+}
+
+// neededFields returns the fields of the definition that need features, sorted.
+func neededFields(needed map[string]string) []string {
+	fields := make([]string, 0, len(needed))
+	for _, field := range needed {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
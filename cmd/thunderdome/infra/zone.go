@@ -0,0 +1,145 @@
+package infra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// zoneAttribute is the attribute ecs gives every container instance naming its availability zone.
+const zoneAttribute = "attribute:ecs.availability-zone"
+
+// DefaultSubnet returns the subnet tasks run in when they are not assigned an availability
+// zone, the first private subnet for an experiment with private networking.
+func (b *BaseInfra) DefaultSubnet(private bool) string {
+	if private && len(b.VpcPrivateSubnets) > 0 {
+		return b.VpcPrivateSubnets[0]
+	}
+	return b.VpcPublicSubnet
+}
+
+// isPrivateSubnet reports whether the subnet is one of the vpc's private subnets, whose tasks
+// and instances are not given public IP addresses.
+func (b *BaseInfra) isPrivateSubnet(id string) bool {
+	for _, sn := range b.VpcPrivateSubnets {
+		if sn == id {
+			return true
+		}
+	}
+	return false
+}
+
+// assignPublicIp returns the awsvpc public IP setting of a task running in the subnet.
+func (b *BaseInfra) assignPublicIp(subnet string) *string {
+	if b.isPrivateSubnet(subnet) {
+		return aws.String(ecs.AssignPublicIpDisabled)
+	}
+	return aws.String(ecs.AssignPublicIpEnabled)
+}
+
+// zoneSubnets returns the public or private subnet of each availability zone of the vpc, keyed
+// by zone, and the zone of the default subnet.
+func zoneSubnets(sess *session.Session, base *BaseInfra, private bool) (map[string]string, string, error) {
+	defaultSubnet := base.DefaultSubnet(private)
+	ids := base.VpcPublicSubnets
+	if private {
+		ids = base.VpcPrivateSubnets
+	}
+	if len(ids) == 0 {
+		ids = []string{defaultSubnet}
+	}
+	out, err := ec2.New(sess).DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(ids),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("describe subnets: %w", err)
+	}
+
+	subnets := make(map[string]string)
+	defaultZone := ""
+	for _, sn := range out.Subnets {
+		zone, id := aws.StringValue(sn.AvailabilityZone), aws.StringValue(sn.SubnetId)
+		if id == defaultSubnet {
+			defaultZone = zone
+		}
+		// keep the first subnet listed for a zone, which is the default subnet in its zone
+		if _, ok := subnets[zone]; !ok || id == defaultSubnet {
+			subnets[zone] = id
+		}
+	}
+	if defaultZone == "" {
+		return nil, "", fmt.Errorf("default subnet %s not found", defaultSubnet)
+	}
+	return subnets, defaultZone, nil
+}
+
+// AssignZones applies the experiment's availability zone policy, setting the zone each
+// deployed target is constrained to and returning the subnet dealgood should run in. Targets
+// are left unconstrained and dealgood runs in the default subnet when the policy is nil.
+// With private networking only the private subnets are used, and instances launched for
+// targets are placed in the default private subnet when the policy is nil.
+func AssignZones(sess *session.Session, base *BaseInfra, spec *exp.ZoneSpec, targets []*Target, private bool) (string, error) {
+	kind := "public"
+	if private {
+		if len(base.VpcPrivateSubnets) == 0 {
+			return "", fmt.Errorf("private networking needs the vpc's private subnets, none are listed in infra.json")
+		}
+		kind = "private"
+	}
+	if spec == nil {
+		if private {
+			for _, t := range targets {
+				t.subnet = base.DefaultSubnet(private)
+			}
+		}
+		return base.DefaultSubnet(private), nil
+	}
+
+	subnets, defaultZone, err := zoneSubnets(sess, base, private)
+	if err != nil {
+		return "", err
+	}
+	zones := make([]string, 0, len(subnets))
+	for zone := range subnets {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	switch spec.Policy {
+	case exp.ZonePolicySame:
+		zone := spec.Zone
+		if zone == "" {
+			zone = defaultZone
+		}
+		subnet, ok := subnets[zone]
+		if !ok {
+			return "", fmt.Errorf("no %s subnet in availability zone %s, expected one of %s", kind, zone, strings.Join(zones, ", "))
+		}
+		for _, t := range targets {
+			t.zone, t.subnet = zone, subnet
+		}
+		return subnet, nil
+
+	case exp.ZonePolicySpread:
+		if len(zones) < 2 {
+			return "", fmt.Errorf("targets cannot be spread across availability zones, the vpc has %s subnets in %s only", kind, defaultZone)
+		}
+		// start with dealgood's zone so the first target always shares it
+		start := sort.SearchStrings(zones, defaultZone)
+		for i, t := range targets {
+			zone := zones[(start+i)%len(zones)]
+			t.zone, t.subnet = zone, subnets[zone]
+		}
+		return base.DefaultSubnet(private), nil
+
+	default:
+		return "", fmt.Errorf("unsupported availability zone policy: %q", spec.Policy)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// LintExperiment returns warnings about an experiment definition that is valid but may not
+// measure what it is meant to.
+func LintExperiment(e *exp.Experiment) []string {
+	var warnings []string
+	if e.Precision {
+		for _, t := range e.Targets {
+			if t.IsRemote() {
+				continue
+			}
+			if t.EC2 == nil || t.EC2.Tenancy != exp.TenancyDedicated {
+				warnings = append(warnings, fmt.Sprintf("target %s of a precision experiment runs on shared tenancy, its latency may vary with the load of other tenants of its host; set ec2 tenancy to %q", t.Name, exp.TenancyDedicated))
+			}
+		}
+	}
+	if e.Soak != nil {
+		for _, t := range e.Targets {
+			if !t.IsRemote() && t.DebugPort == 0 {
+				warnings = append(warnings, fmt.Sprintf("target %s of a soak experiment has no debug_port, so no profiles will be captured if it runs out of memory", t.Name))
+			}
+		}
+	}
+	if e.Hermetic {
+		for _, t := range e.Targets {
+			if t.ImageSpec == nil {
+				warnings = append(warnings, fmt.Sprintf("target %s of a hermetic experiment uses a prebuilt image, which must include thunderdome's current init scripts to join the private network", t.Name))
+			}
+		}
+	}
+	if e.PrivateNetworking && !e.Hermetic {
+		warnings = append(warnings, "targets of an experiment with private networking retrieve content from the public IPFS network, which needs a NAT gateway in the private subnets; make the experiment hermetic to run without one")
+	}
+	if e.Conformance != nil {
+		for _, t := range e.Targets {
+			switch {
+			case t.IsRemote():
+				warnings = append(warnings, fmt.Sprintf("remote target %s is not given the conformance fixtures, its tests will fail unless it can retrieve them", t.Name))
+			case t.ImageSpec == nil:
+				warnings = append(warnings, fmt.Sprintf("target %s uses a prebuilt image, which must include thunderdome's current init scripts to import the conformance fixtures", t.Name))
+			}
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var ListCommand = &cli.Command{
+	Name:   "list",
+	Usage:  "List experiments, filtered by status, owner, age or label",
+	Action: List,
+	Description: "Lists the running and recently stopped experiments known to ironbar, most recently started first. " +
+		"With --all, completed experiments are read from ironbar's history too. Results are paged; the command to fetch " +
+		"the next page is printed after each one.\n\n" +
+		examples(
+			"thunderdome list",
+			"thunderdome list --mine --status running",
+			"thunderdome list --all --label release=v0.20 --sort name",
+			"thunderdome list --all --min-age 168h --owner iand --json",
+		),
+	Flags: flags([]cli.Flag{
+		&cli.StringFlag{
+			Name:        "status",
+			Usage:       "Only list experiments with this status, one of running, stopping or stopped.",
+			Destination: &listOpts.status,
+		},
+		&cli.StringFlag{
+			Name:        "owner",
+			Usage:       "Only list experiments submitted by this owner.",
+			Destination: &listOpts.owner,
+		},
+		&cli.BoolFlag{
+			Name:        "mine",
+			Usage:       "Only list experiments submitted by the current owner, as set by THUNDERDOME_OWNER or the local user name.",
+			Destination: &listOpts.mine,
+		},
+		&cli.StringFlag{
+			Name:        "team",
+			Usage:       "Only list experiments submitted by this team.",
+			Destination: &listOpts.team,
+		},
+		&cli.StringSliceFlag{
+			Name:        "label",
+			Aliases:     []string{"l"},
+			Usage:       "Only list experiments with this label, given as KEY=VALUE. May be repeated, in which case experiments must have all the labels.",
+			Destination: &listOpts.labels,
+		},
+		&cli.DurationFlag{
+			Name:        "min-age",
+			Usage:       "Only list experiments started at least this long ago.",
+			Destination: &listOpts.minAge,
+		},
+		&cli.DurationFlag{
+			Name:        "max-age",
+			Usage:       "Only list experiments started at most this long ago.",
+			Destination: &listOpts.maxAge,
+		},
+		&cli.StringFlag{
+			Name:        "sort",
+			Usage:       "Order to list experiments in, one of name, start or end. Prefix with - for descending order.",
+			Value:       "-start",
+			Destination: &listOpts.sort,
+		},
+		&cli.IntFlag{
+			Name:        "limit",
+			Usage:       "Maximum number of experiments to list in each page.",
+			Value:       50,
+			Destination: &listOpts.limit,
+		},
+		&cli.StringFlag{
+			Name:        "page-token",
+			Usage:       "Token of the page to list, as printed after the previous page.",
+			Destination: &listOpts.pageToken,
+		},
+		&cli.BoolFlag{
+			Name:        "all",
+			Aliases:     []string{"a"},
+			Usage:       "Include completed experiments from ironbar's history.",
+			Destination: &listOpts.all,
+		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Write the page of experiments as JSON.",
+			Destination: &listOpts.json,
+		},
+	}),
+}
+
+var listOpts struct {
+	status    string
+	owner     string
+	mine      bool
+	team      string
+	labels    cli.StringSlice
+	minAge    time.Duration
+	maxAge    time.Duration
+	sort      string
+	limit     int
+	pageToken string
+	all       bool
+	json      bool
+}
+
+func List(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	in := &api.ListExperimentsInput{
+		Status:    listOpts.status,
+		Owner:     listOpts.owner,
+		Team:      listOpts.team,
+		MinAge:    listOpts.minAge,
+		MaxAge:    listOpts.maxAge,
+		Sort:      listOpts.sort,
+		Limit:     listOpts.limit,
+		PageToken: listOpts.pageToken,
+		All:       listOpts.all,
+	}
+	if listOpts.mine {
+		if listOpts.owner != "" {
+			return fmt.Errorf("only one of --owner and --mine may be supplied")
+		}
+		in.Owner = prov.Owner()
+	}
+	for _, l := range listOpts.labels.Value() {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("label must be given as KEY=VALUE: %q", l)
+		}
+		if in.Labels == nil {
+			in.Labels = map[string]string{}
+		}
+		in.Labels[k] = v
+	}
+
+	out, err := prov.ListExperiments(ctx, in)
+	if err != nil {
+		return err
+	}
+
+	if commonOpts.quiet {
+		for _, it := range out.Items {
+			printName(it.Name)
+		}
+		return nil
+	}
+
+	if listOpts.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	if len(out.Items) == 0 {
+		fmt.Println("No matching experiments")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tSTARTED\tDURATION\tOWNER\tPURPOSE\tLABELS")
+	for _, it := range out.Items {
+		stop := it.End
+		if !it.Stopped.IsZero() {
+			stop = it.Stopped
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			it.Name,
+			it.Status,
+			it.Start.Local().Format("2006-01-02 15:04"),
+			stop.Sub(it.Start).Round(time.Minute),
+			it.Owner,
+			it.Purpose,
+			formatLabels(it.Labels),
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if out.NextPageToken != "" {
+		fmt.Printf("\nMore experiments match, list the next page with --page-token %s\n", out.NextPageToken)
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
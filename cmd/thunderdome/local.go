@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/local"
+)
+
+var LocalCommand = &cli.Command{
+	Name:  "local",
+	Usage: "Run experiments on this machine with docker or podman, without AWS",
+	Description: "Runs an experiment's targets and dealgood as containers in a network of their own, for labs that cannot reach AWS. " +
+		"Experiment records are kept in a state directory instead of by ironbar, images are kept by the container runtime or pushed " +
+		"to a local registry instead of ECR, and dealgood generates requests or reads them from a file instead of the request topic. " +
+		"Experiments using ec2 instances, clusters, zones, a transport, private networking, kms keys, workloads, providers, " +
+		"conformance or analyses cannot be run locally.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "deploy",
+			Usage: "Build images and start an experiment's containers",
+			Description: examples(
+				"thunderdome local deploy experiment.json",
+				"thunderdome local deploy --runtime podman --source nginx --source-param access.log experiment.json",
+				"thunderdome local deploy --registry localhost:5000 --metrics-port 9090 experiment.json",
+			),
+			ArgsUsage:    "EXPERIMENT-FILENAME",
+			BashComplete: completeExperimentFile(),
+			Action:       LocalDeploy,
+			Flags: localFlags([]cli.Flag{
+				&cli.StringFlag{
+					Name:        "registry",
+					Usage:       "Registry to push built images to, such as localhost:5000. By default images are only kept by the container runtime.",
+					Destination: &localOpts.registry,
+					EnvVars:     []string{envPrefix + "LOCAL_REGISTRY"},
+				},
+				&cli.StringFlag{
+					Name:        "dealgood-image",
+					Value:       "dealgood:latest",
+					Usage:       "Image to run dealgood from.",
+					Destination: &localOpts.dealgoodImage,
+					EnvVars:     []string{envPrefix + "DEALGOOD_IMAGE"},
+				},
+				&cli.StringFlag{
+					Name:        "source",
+					Value:       "random",
+					Usage:       "Source of dealgood's requests, such as random, har, nginx or redis.",
+					Destination: &localOpts.source,
+				},
+				&cli.StringFlag{
+					Name:        "source-param",
+					Usage:       "Parameter of the request source. For har and nginx this is a file on this machine, which is mounted into dealgood's container. For redis it is the url of the server skyfish adds requests to, which must be reachable from dealgood's container.",
+					Destination: &localOpts.sourceParam,
+				},
+				&cli.IntFlag{
+					Name:        "metrics-port",
+					Usage:       "Port on this machine to publish dealgood's prometheus metrics on. By default they are not published.",
+					Destination: &localOpts.metricsPort,
+				},
+				&cli.BoolFlag{
+					Name:        "force",
+					Aliases:     []string{"f"},
+					Usage:       "Force docker images to be rebuilt.",
+					Destination: &localOpts.forceBuild,
+				},
+			}),
+		},
+		{
+			Name:        "teardown",
+			Usage:       "Remove an experiment's containers and network",
+			Description: examples("thunderdome local teardown my-experiment"),
+			ArgsUsage:   "EXPERIMENT-NAME",
+			Action:      LocalTeardown,
+			Flags: localFlags([]cli.Flag{
+				&cli.BoolFlag{
+					Name:        "forget",
+					Usage:       "Remove the experiment's record once it has been torn down.",
+					Destination: &localOpts.forget,
+				},
+			}),
+		},
+		{
+			Name:        "status",
+			Usage:       "Report the state of an experiment's containers",
+			Description: examples("thunderdome local status my-experiment"),
+			ArgsUsage:   "EXPERIMENT-NAME",
+			Action:      LocalStatus,
+			Flags:       localFlags(nil),
+		},
+		{
+			Name:        "list",
+			Usage:       "List the experiments recorded in the state directory",
+			Description: examples("thunderdome local list"),
+			Action:      LocalList,
+			Flags:       localFlags(nil),
+		},
+	},
+}
+
+var localOpts struct {
+	runtime       string
+	stateDir      string
+	registry      string
+	dealgoodImage string
+	source        string
+	sourceParam   string
+	metricsPort   int
+	forceBuild    bool
+	forget        bool
+}
+
+// localFlags adds the flags every local subcommand takes to fs.
+func localFlags(fs []cli.Flag) []cli.Flag {
+	fs = append(fs,
+		&cli.StringFlag{
+			Name:        "runtime",
+			Value:       local.RuntimeDocker,
+			Usage:       "Container runtime to run experiments with, " + local.RuntimeDocker + " or " + local.RuntimePodman + ".",
+			Destination: &localOpts.runtime,
+			EnvVars:     []string{envPrefix + "CONTAINER_RUNTIME"},
+		},
+		&cli.StringFlag{
+			Name:        "state-dir",
+			Value:       local.DefaultStateDir(),
+			Usage:       "Directory local experiments are recorded in.",
+			Destination: &localOpts.stateDir,
+			EnvVars:     []string{envPrefix + "LOCAL_STATE_DIR"},
+		},
+	)
+	return flags(fs)
+}
+
+func newLocalProvider() (*local.Provider, error) {
+	return local.NewProvider(local.Config{
+		Runtime:       localOpts.runtime,
+		StateDir:      localOpts.stateDir,
+		Registry:      localOpts.registry,
+		DealgoodImage: localOpts.dealgoodImage,
+		Source:        localOpts.source,
+		SourceParam:   localOpts.sourceParam,
+		MetricsPort:   localOpts.metricsPort,
+	})
+}
+
+func LocalDeploy(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+	e, err := LoadExperiment(ctx, cc.Args().First())
+	if err != nil {
+		return fmt.Errorf("failed to read experiment file: %w", err)
+	}
+	if err := local.Validate(e); err != nil {
+		return err
+	}
+
+	prov, err := newLocalProvider()
+	if err != nil {
+		return err
+	}
+	if err := prov.Deploy(ctx, e, localOpts.forceBuild); err != nil {
+		return fmt.Errorf("deploy: %w", err)
+	}
+	fmt.Printf("Experiment %s is running for %s, tear it down with: thunderdome local teardown %s\n", e.Name, e.Duration, e.Name)
+	return nil
+}
+
+func LocalTeardown(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("experiment name must be supplied")
+	}
+	name := cc.Args().First()
+	prov, err := newLocalProvider()
+	if err != nil {
+		return err
+	}
+	if err := prov.Teardown(ctx, name); err != nil {
+		if errors.Is(err, local.ErrNotFound) {
+			return fmt.Errorf("no local experiment named %s", name)
+		}
+		return err
+	}
+	if localOpts.forget {
+		return prov.Forget(name)
+	}
+	return nil
+}
+
+func LocalStatus(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("experiment name must be supplied")
+	}
+	name := cc.Args().First()
+	prov, err := newLocalProvider()
+	if err != nil {
+		return err
+	}
+	rec, err := prov.Experiment(name)
+	if err != nil {
+		if errors.Is(err, local.ErrNotFound) {
+			return fmt.Errorf("no local experiment named %s", name)
+		}
+		return err
+	}
+	states, err := prov.ContainerStates(ctx, rec)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Experiment %s (%s)\n", rec.Name, rec.Runtime)
+	fmt.Printf("  started  %s\n", rec.Start.Local().Format(time.RFC3339))
+	if rec.End.IsZero() {
+		fmt.Printf("  ends     %s\n", rec.Start.Add(rec.Duration).Local().Format(time.RFC3339))
+	} else {
+		fmt.Printf("  ended    %s\n", rec.End.Local().Format(time.RFC3339))
+	}
+	targets := make([]string, 0, len(rec.Images))
+	for t := range rec.Images {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	for _, t := range targets {
+		fmt.Printf("  target %s runs %s\n", t, rec.Images[t])
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER\tSTATE")
+	for _, c := range rec.Containers {
+		fmt.Fprintf(tw, "%s\t%s\n", c, states[c])
+	}
+	return tw.Flush()
+}
+
+func LocalList(cc *cli.Context) error {
+	setupLogging()
+
+	prov, err := newLocalProvider()
+	if err != nil {
+		return err
+	}
+	recs, err := prov.Experiments()
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		fmt.Println("No local experiments")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTARTED\tDURATION\tSTATE")
+	for _, rec := range recs {
+		state := "deployed"
+		if !rec.End.IsZero() {
+			state = "torn down"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", rec.Name, rec.Start.Local().Format(time.RFC3339), rec.Duration, state)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,333 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/build"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// experimentLabel is the container and network label naming the experiment they belong to.
+const experimentLabel = "thunderdome.experiment"
+
+// gatewayPort is the port the gateway of a target built by thunderdome listens on.
+const gatewayPort = 8080
+
+// dealgoodMetricsPort is the port dealgood serves its prometheus metrics on.
+const dealgoodMetricsPort = 9090
+
+// requestsDir is where a request file given as the source parameter is mounted in dealgood's container.
+const requestsDir = "/requests"
+
+// Config configures where a Provider runs experiments and how dealgood is given requests.
+type Config struct {
+	Runtime       string // container runtime, docker or podman
+	StateDir      string // directory experiment records are kept in
+	Registry      string // registry images are pushed to, such as localhost:5000, empty to keep them in the runtime's image store
+	DealgoodImage string // image dealgood is run from
+	Source        string // dealgood request source, such as random, har or nginx
+	SourceParam   string // parameter of the request source, a file on the host for har and nginx or the server url for redis
+	MetricsPort   int    // host port dealgood's metrics are published on, 0 to leave them unpublished
+}
+
+// A Provider deploys experiments as containers on the local machine, without AWS. Experiment
+// records are kept in a state directory in place of ironbar, images are kept by the container
+// runtime or pushed to a local registry in place of ECR, and dealgood reads requests from a
+// file or generates them in place of reading the SNS request topic.
+type Provider struct {
+	cfg     Config
+	runtime *Runtime
+	store   *Store
+}
+
+func NewProvider(cfg Config) (*Provider, error) {
+	rt, err := NewRuntime(cfg.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewStore(cfg.StateDir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Source == "" {
+		cfg.Source = "random"
+	}
+	return &Provider{cfg: cfg, runtime: rt, store: store}, nil
+}
+
+// Validate returns an error listing the features of the experiment that depend on AWS and so
+// cannot be run locally.
+func Validate(e *exp.Experiment) error {
+	var unsupported []string
+	add := func(cond bool, feature string) {
+		if cond {
+			unsupported = append(unsupported, feature)
+		}
+	}
+	add(e.Transport != "", "transport")
+	add(e.Cluster != "", "cluster")
+	add(e.Zones != nil, "zones")
+	add(e.PrivateNetworking, "private_networking")
+	add(e.KmsKeyArn != "", "kms_key_arn")
+	add(e.Workload != nil, "workload")
+	add(len(e.Providers) > 0, "providers")
+	add(e.Hermetic, "hermetic")
+	add(e.Conformance != nil, "conformance")
+	add(len(e.Analyses) > 0, "analyses")
+	for _, t := range e.Targets {
+		add(t.EC2 != nil, "ec2 of target "+t.Name)
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("local experiments do not support %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+func (p *Provider) network(e string) string {
+	return "thunderdome-" + e
+}
+
+func (p *Provider) containerName(e, component string) string {
+	return e + "-" + component
+}
+
+// Deploy builds the images of the experiment's targets, then starts the targets and dealgood
+// in a network of their own. The experiment is recorded before anything is started, so that
+// Teardown can remove what a failed deploy left behind.
+func (p *Provider) Deploy(ctx context.Context, e *exp.Experiment, forceBuild bool) error {
+	if err := Validate(e); err != nil {
+		return err
+	}
+	if rec, err := p.store.Get(e.Name); err == nil && rec.End.IsZero() {
+		return fmt.Errorf("experiment %s is already deployed, tear it down first", e.Name)
+	} else if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	images := make(map[string]string)
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			continue
+		}
+		image, err := p.image(ctx, t, forceBuild)
+		if err != nil {
+			return fmt.Errorf("image for target %s: %w", t.Name, err)
+		}
+		images[t.Name] = image
+	}
+
+	rec := &Record{
+		Name:       e.Name,
+		Start:      time.Now().UTC(),
+		Duration:   e.Duration,
+		Runtime:    p.runtime.Name(),
+		Network:    p.network(e.Name),
+		Images:     images,
+		Experiment: e,
+	}
+	labels := map[string]string{experimentLabel: e.Name}
+	if err := p.store.Put(rec); err != nil {
+		return err
+	}
+	if err := p.runtime.CreateNetwork(ctx, rec.Network, labels); err != nil {
+		return fmt.Errorf("create network: %w", err)
+	}
+
+	var targetURLs []string
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			targetURLs = append(targetURLs, t.Name+"::"+t.URL)
+			continue
+		}
+		c := &Container{
+			Name:        p.containerName(e.Name, t.Name),
+			Image:       images[t.Name],
+			Network:     rec.Network,
+			Environment: t.Environment,
+			Labels:      labels,
+		}
+		if err := p.start(ctx, rec, c); err != nil {
+			return fmt.Errorf("start target %s: %w", t.Name, err)
+		}
+		slog.Info("started target", "component", "target "+t.Name, "container", c.Name)
+		targetURLs = append(targetURLs, fmt.Sprintf("%s::http://%s:%d", t.Name, c.Name, gatewayPort))
+	}
+
+	d, err := p.dealgood(e, rec.Network, labels, targetURLs)
+	if err != nil {
+		return err
+	}
+	if err := p.start(ctx, rec, d); err != nil {
+		return fmt.Errorf("start dealgood: %w", err)
+	}
+	slog.Info("started dealgood", "component", "dealgood", "container", d.Name, "source", p.cfg.Source)
+	if p.cfg.MetricsPort > 0 {
+		slog.Info(fmt.Sprintf("dealgood metrics: http://localhost:%d/metrics", p.cfg.MetricsPort))
+	}
+	return nil
+}
+
+// start records the container as part of the experiment and runs it.
+func (p *Provider) start(ctx context.Context, rec *Record, c *Container) error {
+	rec.Containers = append(rec.Containers, c.Name)
+	if err := p.store.Put(rec); err != nil {
+		return err
+	}
+	return p.runtime.Run(ctx, c)
+}
+
+// image returns the image a target runs, building it for the local machine's architecture if
+// the target has an image spec. Built images are pushed to the registry if one is configured.
+func (p *Provider) image(ctx context.Context, t *exp.TargetSpec, forceBuild bool) (string, error) {
+	if t.Image != "" {
+		return t.Image, nil
+	}
+	tag := t.ImageSpec.Hash()
+	image := build.LocalImageName(tag)
+	exists, err := p.runtime.ImageExists(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	if !exists || forceBuild {
+		if _, err := build.Build(ctx, tag, "linux/"+runtime.GOARCH, t.ImageSpec); err != nil {
+			return "", fmt.Errorf("build image: %w", err)
+		}
+	}
+	if p.cfg.Registry == "" {
+		return image, nil
+	}
+	remote := p.cfg.Registry + "/" + image
+	if err := p.runtime.Tag(ctx, image, remote); err != nil {
+		return "", err
+	}
+	if err := p.runtime.Push(ctx, remote); err != nil {
+		return "", err
+	}
+	return remote, nil
+}
+
+// dealgood returns the container running dealgood, configured as it is for an experiment in
+// AWS apart from the request source and the services only available there.
+func (p *Provider) dealgood(e *exp.Experiment, network string, labels map[string]string, targetURLs []string) (*Container, error) {
+	env := infra.NewDealgood(e.Name, &infra.BaseInfra{}).
+		WithMaxRequestRate(e.MaxRequestRate).
+		WithSearch(e.Search).
+		WithSpikes(e.Spikes).
+		WithMaxConcurrency(e.MaxConcurrency).
+		WithRequestFilter(e.RequestFilter).
+		WithBodyStrategy(e.BodyStrategy, e.BodyReadLimit).
+		WithAcceptEncoding(e.AcceptEncoding).
+		WithAudit(e.Audit).
+		WithTargetHeaders(e.Targets).
+		WithSubdomainGateways(e.Targets).
+		WithTargetMaxInFlight(e.Targets).
+		Environment()
+
+	for _, k := range []string{"DEALGOOD_SQS_QUEUE", "DEALGOOD_SQS_REGION", "DEALGOOD_LOKI_URI", "DEALGOOD_LOKI_QUERY", "OTEL_EXPORTER_OTLP_ENDPOINT"} {
+		delete(env, k)
+	}
+	env["OTEL_TRACES_EXPORTER"] = "none"
+	env["DEALGOOD_TARGETS"] = strings.Join(targetURLs, ",")
+	// there is no ironbar to stop dealgood, so it stops itself once the experiment's time is up
+	env["DEALGOOD_DURATION"] = strconv.Itoa(int(e.Duration.Seconds()))
+	env["DEALGOOD_SOURCE"] = p.cfg.Source
+
+	c := &Container{
+		Name:        p.containerName(e.Name, "dealgood"),
+		Image:       p.cfg.DealgoodImage,
+		Network:     network,
+		Environment: env,
+		Labels:      labels,
+	}
+	if p.cfg.SourceParam != "" {
+		switch p.cfg.Source {
+		case "har", "nginx":
+			path, err := filepath.Abs(p.cfg.SourceParam)
+			if err != nil {
+				return nil, fmt.Errorf("request file: %w", err)
+			}
+			dst := requestsDir + "/" + filepath.Base(path)
+			c.Mounts = map[string]string{dst: path}
+			env["DEALGOOD_SOURCE_PARAM"] = dst
+		case "redis":
+			// each experiment reads the stream through its own consumer group
+			env["DEALGOOD_REDIS_URL"] = p.cfg.SourceParam
+			env["DEALGOOD_REDIS_GROUP"] = e.Name
+		default:
+			env["DEALGOOD_SOURCE_PARAM"] = p.cfg.SourceParam
+		}
+	}
+	if p.cfg.MetricsPort > 0 {
+		c.Ports = map[int]int{dealgoodMetricsPort: p.cfg.MetricsPort}
+	}
+	return c, nil
+}
+
+// Teardown removes the experiment's containers and network and records when it ended.
+func (p *Provider) Teardown(ctx context.Context, name string) error {
+	rec, err := p.store.Get(name)
+	if err != nil {
+		return err
+	}
+	// dealgood is removed first so that it does not record the targets disappearing
+	for i := len(rec.Containers) - 1; i >= 0; i-- {
+		if err := p.runtime.Remove(ctx, rec.Containers[i]); err != nil {
+			return fmt.Errorf("remove container %s: %w", rec.Containers[i], err)
+		}
+		slog.Info("removed container", "container", rec.Containers[i])
+	}
+	if err := p.runtime.RemoveNetwork(ctx, rec.Network); err != nil {
+		return fmt.Errorf("remove network: %w", err)
+	}
+	if rec.End.IsZero() {
+		rec.End = time.Now().UTC()
+	}
+	return p.store.Put(rec)
+}
+
+// ContainerStates returns the state of each of the experiment's containers, such as running
+// or exited, keyed by container name. Containers that have been removed are reported as removed.
+func (p *Provider) ContainerStates(ctx context.Context, rec *Record) (map[string]string, error) {
+	states := make(map[string]string, len(rec.Containers))
+	for _, c := range rec.Containers {
+		st, err := p.runtime.State(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if st == "" {
+			st = "removed"
+		}
+		states[c] = st
+	}
+	return states, nil
+}
+
+func (p *Provider) Experiment(name string) (*Record, error) {
+	return p.store.Get(name)
+}
+
+func (p *Provider) Experiments() ([]*Record, error) {
+	return p.store.List()
+}
+
+// Forget removes the record of an experiment that has been torn down.
+func (p *Provider) Forget(name string) error {
+	rec, err := p.store.Get(name)
+	if err != nil {
+		return err
+	}
+	if rec.End.IsZero() {
+		return fmt.Errorf("experiment %s has not been torn down", name)
+	}
+	return p.store.Delete(name)
+}
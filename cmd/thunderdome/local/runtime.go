@@ -0,0 +1,163 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// Container runtimes that can run local experiments. Both accept the same commands.
+const (
+	RuntimeDocker = "docker"
+	RuntimePodman = "podman"
+)
+
+// A Runtime runs containers with the docker or podman command line tool.
+type Runtime struct {
+	command string
+}
+
+func NewRuntime(name string) (*Runtime, error) {
+	if name != RuntimeDocker && name != RuntimePodman {
+		return nil, fmt.Errorf("unsupported container runtime %q, expected %s or %s", name, RuntimeDocker, RuntimePodman)
+	}
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, fmt.Errorf("%s must be installed and on the PATH: %w", name, err)
+	}
+	return &Runtime{command: name}, nil
+}
+
+func (r *Runtime) Name() string {
+	return r.command
+}
+
+// exec runs the tool and returns its trimmed output, or an error including what it wrote to stderr.
+func (r *Runtime) exec(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, r.command, args...)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	slog.Debug(cmd.String())
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s %s: %w: %s", r.command, args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s %s: %w", r.command, args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// A Container describes a container run for a local experiment.
+type Container struct {
+	Name        string
+	Image       string
+	Network     string            // network the container is attached to, under its name
+	Environment map[string]string // environment variables
+	Ports       map[int]int       // host ports published for container ports, keyed by container port
+	Mounts      map[string]string // host paths mounted read only, keyed by path in the container
+	Labels      map[string]string
+}
+
+// Run starts the container in the background.
+func (r *Runtime) Run(ctx context.Context, c *Container) error {
+	args := []string{"run", "--detach", "--name", c.Name, "--network", c.Network, "--network-alias", c.Name}
+	for _, k := range sortedKeys(c.Labels) {
+		args = append(args, "--label", k+"="+c.Labels[k])
+	}
+	for _, k := range sortedKeys(c.Environment) {
+		args = append(args, "--env", k+"="+c.Environment[k])
+	}
+	for cport, hport := range c.Ports {
+		args = append(args, "--publish", fmt.Sprintf("%d:%d", hport, cport))
+	}
+	for _, dst := range sortedKeys(c.Mounts) {
+		args = append(args, "--volume", c.Mounts[dst]+":"+dst+":ro")
+	}
+	args = append(args, c.Image)
+	_, err := r.exec(ctx, args...)
+	return err
+}
+
+// Remove stops and removes the container. It is not an error if the container does not exist.
+func (r *Runtime) Remove(ctx context.Context, name string) error {
+	if _, err := r.exec(ctx, "rm", "--force", "--volumes", name); err != nil && !isNoSuchObject(err) {
+		return err
+	}
+	return nil
+}
+
+// State returns the status of the container, such as running or exited, or an empty string if
+// it does not exist.
+func (r *Runtime) State(ctx context.Context, name string) (string, error) {
+	out, err := r.exec(ctx, "container", "inspect", "--format", "{{.State.Status}}", name)
+	if err != nil {
+		if isNoSuchObject(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return out, nil
+}
+
+// CreateNetwork creates a bridge network that the containers of an experiment resolve each
+// other's names on.
+func (r *Runtime) CreateNetwork(ctx context.Context, name string, labels map[string]string) error {
+	args := []string{"network", "create"}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", k+"="+labels[k])
+	}
+	_, err := r.exec(ctx, append(args, name)...)
+	return err
+}
+
+// RemoveNetwork removes the network. It is not an error if the network does not exist.
+func (r *Runtime) RemoveNetwork(ctx context.Context, name string) error {
+	if _, err := r.exec(ctx, "network", "rm", name); err != nil && !isNoSuchObject(err) {
+		return err
+	}
+	return nil
+}
+
+// Tag gives an image another name.
+func (r *Runtime) Tag(ctx context.Context, src, dst string) error {
+	_, err := r.exec(ctx, "tag", src, dst)
+	return err
+}
+
+// Push pushes an image to the registry named by its name.
+func (r *Runtime) Push(ctx context.Context, image string) error {
+	_, err := r.exec(ctx, "push", image)
+	return err
+}
+
+// ImageExists reports whether the image is present in the runtime's local image store.
+func (r *Runtime) ImageExists(ctx context.Context, image string) (bool, error) {
+	if _, err := r.exec(ctx, "image", "inspect", image); err != nil {
+		if isNoSuchObject(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// isNoSuchObject reports whether the tool failed because the container, network or image it
+// was given does not exist. docker and podman word this differently.
+func isNoSuchObject(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such") || strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
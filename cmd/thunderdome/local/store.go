@@ -0,0 +1,135 @@
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+// A Record is the state of a local experiment, kept by the Store in place of the records
+// ironbar keeps in dynamodb.
+type Record struct {
+	Name       string
+	Start      time.Time
+	End        time.Time // zero while the experiment has not been torn down
+	Duration   time.Duration
+	Runtime    string            // container runtime the experiment was deployed with
+	Network    string            // network the experiment's containers are attached to
+	Containers []string          // names of the experiment's containers, dealgood last
+	Images     map[string]string // image each target runs, keyed by target name
+	Experiment *exp.Experiment
+}
+
+// A Store keeps the records of local experiments as JSON files in a directory, one for each
+// experiment.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("state directory must be supplied")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "experiments"), 0o755); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// DefaultStateDir returns the directory local experiments are recorded in when none is given.
+func DefaultStateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "thunderdome")
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, "experiments", name+".json")
+}
+
+// ErrNotFound is returned when there is no record of a local experiment.
+var ErrNotFound = errors.New("experiment not found")
+
+// Put writes the record, replacing an earlier one for the same experiment. The file is written
+// in full before it replaces the earlier one so that a crash cannot leave it truncated.
+func (s *Store) Put(rec *Record) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode record: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "experiments"), rec.Name+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create record: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write record: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(rec.Name)); err != nil {
+		return fmt.Errorf("replace record: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) Get(name string) (*Record, error) {
+	data, err := os.ReadFile(s.path(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("read record: %w", err)
+	}
+	rec := new(Record)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("decode record %s: %w", name, err)
+	}
+	return rec, nil
+}
+
+// List returns the records of every local experiment, most recently started first.
+func (s *Store) List() ([]*Record, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "experiments"))
+	if err != nil {
+		return nil, fmt.Errorf("read state directory: %w", err)
+	}
+	var recs []*Record
+	for _, ent := range entries {
+		name, ok := strings.CutSuffix(ent.Name(), ".json")
+		if !ok || ent.IsDir() {
+			continue
+		}
+		rec, err := s.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Start.After(recs[j].Start)
+	})
+	return recs, nil
+}
+
+func (s *Store) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove record: %w", err)
+	}
+	return nil
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 
 	"github.com/urfave/cli/v2"
 	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/pkg/version"
 )
 
 const (
@@ -18,25 +22,56 @@ var app = &cli.App{
 	Name:        appName,
 	Usage:       "a tool for managing experiments",
 	Description: "thunderdome is a tool for managing experiments",
+	Version:     version.String(),
 	Commands: []*cli.Command{
 		DeployCommand,
 		TeardownCommand,
 		StatusCommand,
+		DescribeCommand,
+		ListCommand,
 		ImageCommand,
 		ValidateCommand,
+		SmokeCommand,
+		PreflightCommand,
+		DoctorCommand,
+		AdoptCommand,
+		AnnotateCommand,
+		RestartTargetCommand,
+		NoiseCommand,
+		StudyCommand,
+		BisectCommand,
+		PipelineCommand,
+		IamPolicyCommand,
+		LocalCommand,
+		ResultsCommand,
+		CompletionCommand,
+		MigrateSpecCommand,
+		RenderCommand,
 	},
-	Flags: commonFlags,
+	EnableBashCompletion: true,
+	Before:               applyConfig,
+	Flags:                flags(configFlags),
 }
 
 func main() {
+	// -v is the alias of --verbose, so --version has none
+	cli.VersionFlag = &cli.BoolFlag{Name: "version", Usage: "print the version"}
+
 	ctx := context.Background()
 	if err := app.RunContext(ctx, os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		if hint := errorHint(err); hint != "" {
+			fmt.Fprintln(os.Stderr, hint)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
 func setupLogging() {
+	if commonOpts.quiet {
+		os.Stdout = os.Stderr
+	}
+
 	logLevel := new(slog.LevelVar)
 	logLevel.Set(slog.LevelWarn)
 	if commonOpts.verbose {
@@ -57,7 +92,13 @@ func setupLogging() {
 
 func checkBuildEnv() error {
 	if os.Getenv("AWS_PROFILE") == "" {
-		return fmt.Errorf("environment variable AWS_PROFILE should be set to a valid AWS profile name to allow pushing of images to ECR")
+		return fmt.Errorf("environment variable AWS_PROFILE, or aws_profile in the config file profile, should be set to a valid AWS profile name to allow pushing of images to ECR")
+	}
+	// images are built and pushed by running these, report a missing one before any work is done
+	for _, tool := range []string{"docker", "aws"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s must be installed and on the PATH to build and push images: %w", tool, err)
+		}
 	}
 
 	return checkEnv()
@@ -65,7 +106,7 @@ func checkBuildEnv() error {
 
 func checkEnv() error {
 	if os.Getenv("AWS_REGION") == "" {
-		return fmt.Errorf("environment variable AWS_REGION should be set to the region Thunderdome is running in")
+		return fmt.Errorf("environment variable AWS_REGION, or aws_region in the config file profile, should be set to the region Thunderdome is running in")
 	}
 
 	return nil
@@ -75,6 +116,7 @@ var commonOpts struct {
 	verbose     bool
 	veryverbose bool
 	nocolor     bool
+	quiet       bool
 }
 
 var commonFlags = []cli.Flag{
@@ -101,6 +143,25 @@ var commonFlags = []cli.Flag{
 		Destination: &commonOpts.nocolor,
 		EnvVars:     []string{envPrefix + "NOCOLOR"},
 	},
+	&cli.BoolFlag{
+		Name:        "quiet",
+		Aliases:     []string{"q"},
+		Usage:       "Write only the names of the experiments acted on to stdout, one per line, and logs and other output to stderr, so commands can be piped together",
+		Value:       false,
+		Destination: &commonOpts.quiet,
+	},
+}
+
+// output is the original stdout, which receives the names of experiments acted on and other
+// machine readable output when --quiet sends the rest of the output to stderr.
+var output io.Writer = os.Stdout
+
+// printName writes the name of an experiment a command acted on when --quiet is given, for
+// the next command in a pipeline.
+func printName(name string) {
+	if commonOpts.quiet {
+		fmt.Fprintln(output, name)
+	}
 }
 
 func flags(fs []cli.Flag) []cli.Flag {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
+
+var MigrateSpecCommand = &cli.Command{
+	Name:      "migrate-spec",
+	Usage:     "Upgrade experiment definitions to the current spec version",
+	Action:    MigrateSpec,
+	ArgsUsage: "EXPERIMENT-FILENAME...",
+	Description: examples(
+		"thunderdome migrate-spec experiment.json",
+		"thunderdome migrate-spec --check experiments/*.json",
+		"thunderdome migrate-spec --stdout experiment.json > upgraded.json",
+		"cat experiment.json | thunderdome migrate-spec -",
+	),
+	BashComplete: completeExperimentFile(),
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:        "check",
+			Usage:       "Report the files that need upgrading without changing them, failing if there are any.",
+			Destination: &migrateSpecOpts.check,
+		},
+		&cli.BoolFlag{
+			Name:        "stdout",
+			Usage:       "Print the upgraded definition instead of rewriting the file. Only one file may be given. Implied when the definition is read from stdin with -.",
+			Destination: &migrateSpecOpts.stdout,
+		},
+	}, commonFlags...),
+}
+
+var migrateSpecOpts struct {
+	check  bool
+	stdout bool
+}
+
+func MigrateSpec(cc *cli.Context) error {
+	setupLogging()
+
+	if cc.NArg() == 0 {
+		return fmt.Errorf("at least one experiment filename must be supplied")
+	}
+	if migrateSpecOpts.stdout && cc.NArg() != 1 {
+		return fmt.Errorf("only one experiment filename may be supplied with --stdout")
+	}
+	stdin := cc.Args().First() == StdinFilename
+	if stdin && cc.NArg() != 1 {
+		return fmt.Errorf("no other experiment filename may be supplied when reading from stdin")
+	}
+
+	outdated := 0
+	for _, filename := range cc.Args().Slice() {
+		f, _, err := openExperiment(filename)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		ej, declared, err := decodeSpec(content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		var upgraded []byte
+		if declared == 0 && legacySpecVersion == CurrentSpecVersion {
+			// Only the version is missing, so keep the file's layout and add it.
+			upgraded = addSpecVersion(content)
+		} else if upgraded, err = encodeSpec(ej); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		if migrateSpecOpts.stdout || stdin {
+			_, err := output.Write(upgraded)
+			return err
+		}
+
+		if declared == CurrentSpecVersion {
+			fmt.Printf("%s: already at spec version %d\n", filename, CurrentSpecVersion)
+			continue
+		}
+		outdated++
+
+		from := "no spec version"
+		if declared != 0 {
+			from = fmt.Sprintf("spec version %d", declared)
+		}
+		if migrateSpecOpts.check {
+			fmt.Printf("%s: needs upgrading from %s to %d\n", filename, from, CurrentSpecVersion)
+			continue
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filename, upgraded, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("write %s: %w", filename, err)
+		}
+		fmt.Printf("%s: upgraded from %s to %d\n", filename, from, CurrentSpecVersion)
+	}
+
+	if migrateSpecOpts.check && outdated > 0 {
+		return fmt.Errorf("%d experiment definitions need upgrading, run thunderdome migrate-spec to upgrade them", outdated)
+	}
+	return nil
+}
+
+// addSpecVersion inserts the current spec version as the first field of an experiment
+// definition, on its own line with the indentation of the field that follows it if the
+// definition is spread over several lines.
+func addSpecVersion(content []byte) []byte {
+	open := bytes.IndexByte(content, '{') + 1
+	field := fmt.Sprintf("\"spec_version\": %d,", CurrentSpecVersion)
+
+	rest := content[open:]
+	body := bytes.TrimLeft(rest, "\r\n")
+	if len(body) < len(rest) {
+		indent := body[:len(body)-len(bytes.TrimLeft(body, " \t"))]
+		field = "\n" + string(indent) + field
+	}
+
+	var buf bytes.Buffer
+	buf.Write(content[:open])
+	buf.WriteString(field)
+	buf.Write(rest)
+	return buf.Bytes()
+}
+
+// encodeSpec formats an experiment definition the way they are written in the experiments
+// directory.
+func encodeSpec(ej *ExperimentJSON) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(ej); err != nil {
+		return nil, fmt.Errorf("encode definition: %w", err)
+	}
+	return buf.Bytes(), nil
+}
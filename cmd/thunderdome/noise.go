@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var NoiseCommand = &cli.Command{
+	Name:  "noise",
+	Usage: "Deploy an A/A experiment to estimate run-to-run noise, or list the estimates",
+	Description: "Deploys two targets running the same image, taken from one target of the experiment file, " +
+		"so that ironbar can measure the differences between them once the experiment completes. The " +
+		"differences are an estimate of the noise in the environment: smaller differences between targets " +
+		"in other experiments cannot be told apart from noise.\n\n" +
+		examples(
+			"thunderdome noise experiment.json",
+			"thunderdome noise --target kubo --duration 60 experiment.json",
+			"thunderdome noise --list",
+		),
+	BashComplete: completeExperimentFile("target", "t"),
+	Action:       Noise,
+	ArgsUsage:    "[EXPERIMENT-FILENAME]",
+	Flags: flags(
+		[]cli.Flag{
+			&cli.IntFlag{
+				Name:        "duration",
+				Aliases:     []string{"d"},
+				Usage:       "Duration to run the A/A experiment for, in minutes.",
+				Destination: &noiseOpts.duration,
+			},
+			&cli.StringFlag{
+				Name:        "target",
+				Aliases:     []string{"t"},
+				Usage:       "Name of the target in the experiment file to duplicate. Defaults to the first target that is not remote.",
+				Destination: &noiseOpts.target,
+			},
+			&cli.BoolFlag{
+				Name:        "list",
+				Aliases:     []string{"l"},
+				Usage:       "List the noise estimates recorded by ironbar instead of deploying an experiment.",
+				Destination: &noiseOpts.list,
+			},
+			&cli.BoolFlag{
+				Name:        "skip-preflight",
+				Usage:       "Skip the checks made before any resources are created.",
+				Destination: &noiseOpts.skipPreflight,
+			},
+		},
+	),
+}
+
+var noiseOpts struct {
+	duration      int
+	target        string
+	list          bool
+	skipPreflight bool
+}
+
+func Noise(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if noiseOpts.list {
+		if err := checkEnv(); err != nil {
+			return err
+		}
+		prov, err := infra.NewProvider()
+		if err != nil {
+			return err
+		}
+		return listNoiseEstimates(cc, prov)
+	}
+
+	if err := checkBuildEnv(); err != nil {
+		return err
+	}
+	if noiseOpts.duration < 5 {
+		return fmt.Errorf("duration must be at least 5 minutes")
+	}
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+
+	e, err := LoadExperiment(ctx, cc.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	aa, err := noiseExperiment(e, noiseOpts.target)
+	if err != nil {
+		return err
+	}
+	aa.Duration = time.Duration(noiseOpts.duration) * time.Minute
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	if !noiseOpts.skipPreflight {
+		fmt.Println("Running preflight checks")
+		if err := runPreflight(ctx, prov, aa); err != nil {
+			return err
+		}
+	}
+
+	if err := prov.Deploy(ctx, aa, false); err != nil {
+		return err
+	}
+	fmt.Printf("A/A experiment %s deployed, ironbar records the noise estimate once it completes. Use thunderdome noise --list to see it.\n", aa.Name)
+	printName(aa.Name)
+	return nil
+}
+
+// noiseExperiment returns an A/A experiment that runs two copies of the named target, or the
+// first target that is not remote if name is empty, with the same request stream as e.
+func noiseExperiment(e *exp.Experiment, name string) (*exp.Experiment, error) {
+	var src *exp.TargetSpec
+	for _, t := range e.Targets {
+		if t.IsRemote() {
+			if t.Name == name {
+				return nil, fmt.Errorf("target %s is remote and cannot be duplicated", name)
+			}
+			continue
+		}
+		if name == "" || t.Name == name {
+			src = t
+			break
+		}
+	}
+	if src == nil {
+		if name != "" {
+			return nil, fmt.Errorf("target %s not found in experiment", name)
+		}
+		return nil, fmt.Errorf("experiment has no targets that can be duplicated")
+	}
+
+	aa := *e
+	aa.Name = e.Name + "-aa"
+	aa.Description = fmt.Sprintf("A/A noise baseline using target %s of %s", src.Name, e.Name)
+	aa.NoiseBaseline = true
+	aa.Targets = nil
+	for _, suffix := range []string{"a", "b"} {
+		t := *src
+		t.Name = src.Name + "-" + suffix
+		aa.Targets = append(aa.Targets, &t)
+	}
+	return &aa, nil
+}
+
+func listNoiseEstimates(cc *cli.Context, prov *infra.Provider) error {
+	out, err := prov.NoiseEstimates(cc.Context)
+	if err != nil {
+		return err
+	}
+	if len(out.Items) == 0 {
+		fmt.Println("No noise estimates have been recorded")
+		return nil
+	}
+
+	fmt.Printf("%-40s %-16s %-14s %8s %8s %8s %8s %8s\n", "EXPERIMENT", "RECORDED", "INSTANCE TYPE", "REQS", "ERRORS", "P50", "P95", "P99")
+	for _, ne := range out.Items {
+		fmt.Printf("%-40s %-16s %-14s %7.2f%% %7.2f%% %7.2f%% %7.2f%% %7.2f%%\n",
+			ne.Experiment,
+			ne.Time.Format("2006-01-02 15:04"),
+			ne.InstanceType,
+			ne.RequestsDiff*100,
+			ne.ErrorRatioDiff*100,
+			ne.TTFBP50Diff*100,
+			ne.TTFBP95Diff*100,
+			ne.TTFBP99Diff*100,
+		)
+	}
+	return nil
+}
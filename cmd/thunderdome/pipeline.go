@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var PipelineCommand = &cli.Command{
+	Name:  "pipeline",
+	Usage: "Run the experiments of a release candidate pipeline and report whether it is a go",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "run",
+			Usage: "Submit a pipeline to ironbar and wait for its verdict",
+			Description: "Builds the images of every stage's experiment and submits the pipeline to ironbar, which deploys the experiment " +
+				"of each stage once the stages it needs have passed and checks the stage's gates against its results. A stage whose needs " +
+				"did not pass is skipped. The command then reports each stage as it finishes; stopping it leaves the pipeline running. " +
+				"Running a pipeline that ironbar already knows resumes watching it.\n\n" +
+				examples(
+					"thunderdome pipeline run rc-v0.20.0.json",
+					"thunderdome pipeline run --name rc-v0-20-0-retry rc-v0.20.0.json",
+					"thunderdome pipeline run --detach rc-v0.20.0.json",
+				),
+			ArgsUsage:    "PIPELINE-FILE",
+			BashComplete: completeExperimentFile(),
+			Action:       PipelineRun,
+			Flags: flags([]cli.Flag{
+				&cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of the pipeline, overriding the name in the pipeline file.",
+					Destination: &pipelineOpts.name,
+				},
+				&cli.DurationFlag{
+					Name:        "poll",
+					Value:       time.Minute,
+					Usage:       "Interval between checks of the pipeline's stages.",
+					Destination: &pipelineOpts.poll,
+				},
+				&cli.BoolFlag{
+					Name:        "detach",
+					Usage:       "Return once the pipeline has been submitted instead of waiting for its verdict.",
+					Destination: &pipelineOpts.detach,
+				},
+				&cli.BoolFlag{
+					Name:        "force",
+					Aliases:     []string{"f"},
+					Usage:       "Force docker images to be rebuilt.",
+					Destination: &pipelineOpts.forceBuild,
+				},
+				&cli.BoolFlag{
+					Name:        "skip-preflight",
+					Usage:       "Skip the checks made on the experiment of each stage before the pipeline is submitted.",
+					Destination: &pipelineOpts.skipPreflight,
+				},
+			}),
+		},
+		{
+			Name:        "status",
+			Usage:       "Report the state of each stage of a pipeline and its verdict",
+			Description: examples("thunderdome pipeline status rc-v0-20-0"),
+			ArgsUsage:   "PIPELINE-NAME",
+			Action:      PipelineStatus,
+			Flags:       flags(nil),
+		},
+	},
+}
+
+var pipelineOpts struct {
+	name          string
+	poll          time.Duration
+	detach        bool
+	forceBuild    bool
+	skipPreflight bool
+}
+
+// A pipelineFile defines the stages of a pipeline. The spec of each stage is an experiment
+// file, relative to the pipeline file.
+type pipelineFile struct {
+	Name   string          `json:"name"`
+	Stages []pipelineStage `json:"stages"`
+}
+
+type pipelineStage struct {
+	Name            string            `json:"name"`
+	Spec            string            `json:"spec"`
+	Needs           []string          `json:"needs,omitempty"`
+	DurationMinutes int               `json:"duration_minutes,omitempty"` // defaults to 60
+	Gates           api.PipelineGates `json:"gates"`
+}
+
+func PipelineRun(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkBuildEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("pipeline file must be supplied")
+	}
+	if pipelineOpts.poll < 10*time.Second {
+		return fmt.Errorf("poll interval must be at least 10 seconds")
+	}
+	filename := cc.Args().First()
+	pf, err := loadPipelineFile(filename)
+	if err != nil {
+		return err
+	}
+	name := pf.Name
+	if pipelineOpts.name != "" {
+		name = pipelineOpts.name
+	}
+	if name == "" {
+		return fmt.Errorf("pipeline name must be supplied in the pipeline file or with --name")
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	// every stage's experiment is checked and its images built before the pipeline is submitted,
+	// so that a mistake in the last stage is found before the first has run for hours, and so
+	// that ironbar, which cannot build images, can deploy each stage
+	in := &api.NewPipelineInput{
+		Owner: prov.Owner(),
+		Team:  prov.Team(),
+	}
+	for _, st := range pf.Stages {
+		e, err := pipelineExperiment(ctx, filepath.Join(filepath.Dir(filename), st.Spec), name, st)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", st.Name, err)
+		}
+		if !pipelineOpts.skipPreflight {
+			fmt.Printf("Running preflight checks for stage %s\n", st.Name)
+			if err := runPreflight(ctx, prov, e); err != nil {
+				return fmt.Errorf("stage %s: %w", st.Name, err)
+			}
+		}
+		// images shared between stages are only built once, even when forced
+		if err := prov.BuildImages(ctx, e, pipelineOpts.forceBuild); err != nil {
+			return fmt.Errorf("stage %s: %w", st.Name, err)
+		}
+		def, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("stage %s: encode experiment: %w", st.Name, err)
+		}
+		in.Stages = append(in.Stages, api.PipelineStage{
+			Name:       st.Name,
+			Experiment: e.Name,
+			Needs:      st.Needs,
+			Gates:      st.Gates,
+			Definition: string(def),
+		})
+	}
+
+	p, err := prov.PutPipeline(ctx, name, in)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Submitted pipeline %s with %d stages\n", p.Name, len(p.Stages))
+	if pipelineOpts.detach {
+		fmt.Printf("Use thunderdome pipeline status %s to check its progress\n", p.Name)
+		return nil
+	}
+
+	p, err = watchPipeline(ctx, prov, p)
+	if err != nil {
+		return err
+	}
+	printPipelineReport(p)
+	if p.Verdict != api.PipelineVerdictGo {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+// watchPipeline polls ironbar until a pipeline has a verdict, printing the state of each stage
+// as it changes, and returns the finished pipeline.
+func watchPipeline(ctx context.Context, prov *infra.Provider, p *api.Pipeline) (*api.Pipeline, error) {
+	states := map[string]string{}
+	for {
+		for _, st := range p.Stages {
+			if states[st.Name] != st.State {
+				fmt.Printf("Stage %s %s\n", st.Name, st.State)
+				states[st.Name] = st.State
+			}
+		}
+		if p.Verdict != api.PipelineVerdictPending {
+			return p, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pipelineOpts.poll):
+		}
+		next, err := prov.Pipeline(ctx, p.Name)
+		if err != nil {
+			slog.Warn("failed to read pipeline", "pipeline", p.Name, "error", err)
+			continue
+		}
+		p = next
+	}
+}
+
+// pipelineExperiment loads the experiment of a stage, named and labelled for the pipeline.
+func pipelineExperiment(ctx context.Context, filename, pipeline string, st pipelineStage) (*exp.Experiment, error) {
+	e, err := LoadExperiment(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	e.Name = pipeline + "-" + st.Name
+	if !reExperimentName.MatchString(e.Name) {
+		return nil, fmt.Errorf("experiment name %q must start with a letter and contain only lowercase letters, numbers and hyphens", e.Name)
+	}
+	e.Duration = time.Duration(st.DurationMinutes) * time.Minute
+	if e.Duration == 0 {
+		e.Duration = time.Hour
+	}
+	if e.Duration < 5*time.Minute {
+		return nil, fmt.Errorf("duration must be at least 5 minutes")
+	}
+	if e.Soak != nil && e.Duration < MinSoakDuration {
+		return nil, fmt.Errorf("duration of a soak experiment must be at least %d minutes", int(MinSoakDuration.Minutes()))
+	}
+	if err := checkSegmentsDuration(e); err != nil {
+		return nil, err
+	}
+	if e.Labels == nil {
+		e.Labels = map[string]string{}
+	}
+	e.Labels[api.LabelPipeline] = pipeline
+	e.Labels[api.LabelPipelineStage] = st.Name
+	return e, nil
+}
+
+func loadPipelineFile(filename string) (*pipelineFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pf := new(pipelineFile)
+	if err := json.Unmarshal(data, pf); err != nil {
+		return nil, fmt.Errorf("parse pipeline file: %w", err)
+	}
+	if len(pf.Stages) == 0 {
+		return nil, fmt.Errorf("pipeline must have at least one stage")
+	}
+	for _, st := range pf.Stages {
+		if st.Spec == "" {
+			return nil, fmt.Errorf("stage %s must have a spec", st.Name)
+		}
+	}
+	return pf, nil
+}
+
+func PipelineStatus(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("pipeline name must be supplied")
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+	p, err := prov.Pipeline(ctx, cc.Args().First())
+	if err != nil {
+		return err
+	}
+	printPipelineReport(p)
+	return nil
+}
+
+func printPipelineReport(p *api.Pipeline) {
+	fmt.Println()
+	fmt.Printf("Pipeline %s: %s\n", p.Name, strings.ToUpper(strings.ReplaceAll(p.Verdict, "_", "-")))
+	for _, st := range p.Stages {
+		line := fmt.Sprintf("  %-20s %-8s %s", st.Name, st.State, st.Experiment)
+		if !st.Started.IsZero() && !st.Finished.IsZero() {
+			line += fmt.Sprintf(" (%s)", st.Finished.Sub(st.Started).Round(time.Minute))
+		}
+		fmt.Println(line)
+		for _, r := range st.Reasons {
+			fmt.Printf("    - %s\n", r)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var PreflightCommand = &cli.Command{
+	Name:      "preflight",
+	Usage:     "Check that an experiment can be deployed without creating any resources",
+	Action:    Preflight,
+	ArgsUsage: "EXPERIMENT-FILENAME",
+	Description: examples(
+		"thunderdome preflight experiment.json",
+	),
+	BashComplete: completeExperimentFile(),
+	Flags:        commonFlags,
+}
+
+func Preflight(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+
+	args := cc.Args()
+	e, err := LoadExperiment(ctx, args.Get(0))
+	if err != nil {
+		return err
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	return runPreflight(ctx, prov, e)
+}
+
+// runPreflight runs the preflight checks for an experiment, printing the result of each, and
+// returns an error if any check failed.
+func runPreflight(ctx context.Context, prov *infra.Provider, e *exp.Experiment) error {
+	results, err := prov.Preflight(ctx, e)
+	if err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+
+	failed := 0
+	code := api.ErrorCodePreflightFailed
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("  ok    %s\n", r.Check)
+		case r.Warning:
+			fmt.Printf("  warn  %s: %v\n", r.Check, r.Err)
+		default:
+			fmt.Printf("  FAIL  %s: %v\n", r.Check, r.Err)
+			failed++
+			if api.ErrorCode(r.Err) == api.ErrorCodeImageNotFound {
+				code = api.ErrorCodeImageNotFound
+			}
+		}
+	}
+
+	if failed > 0 {
+		return &api.CodedError{Code: code, Err: fmt.Errorf("%d preflight checks failed", failed)}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/pkg/results"
+)
+
+// promConfig holds the location of the Prometheus query API that experiment metrics are
+// written to.
+type promConfig struct {
+	URL   string
+	User  string
+	Token string
+}
+
+// promFlags returns the flags that configure access to the Prometheus query API. The purpose
+// is appended to the description of the url flag.
+func promFlags(pc *promConfig, purpose string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "prometheus-url",
+			Usage:       "Base URL of the Prometheus query API that experiment metrics are written to, " + purpose + ".",
+			Destination: &pc.URL,
+			EnvVars:     []string{envPrefix + "PROMETHEUS_URL"},
+		},
+		&cli.StringFlag{
+			Name:        "prometheus-user",
+			Usage:       "Username for the Prometheus query API.",
+			Destination: &pc.User,
+			EnvVars:     []string{envPrefix + "PROMETHEUS_USER"},
+		},
+		&cli.StringFlag{
+			Name:        "prometheus-token",
+			Usage:       "Password or API token for the Prometheus query API.",
+			Destination: &pc.Token,
+			EnvVars:     []string{envPrefix + "PROMETHEUS_TOKEN"},
+		},
+	}
+}
+
+// trafficSummary returns the rate and composition of the live request stream between start and
+// end, as recorded by skyfish.
+func (pc *promConfig) trafficSummary(ctx context.Context, start, end time.Time) (*api.TrafficSummary, error) {
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	total, err := pc.queryByLabel(ctx, fmt.Sprintf("sum(rate(thunderdome_skyfish_traffic_requests_total%s))", window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	ts := &api.TrafficSummary{
+		RequestRate: total[""],
+	}
+
+	ts.PathClasses, err = pc.queryShares(ctx, fmt.Sprintf("sum by (path_class) (rate(thunderdome_skyfish_traffic_requests_total%s))", window), "path_class", end)
+	if err != nil {
+		return nil, err
+	}
+	ts.StatusClasses, err = pc.queryShares(ctx, fmt.Sprintf("sum by (status_class) (rate(thunderdome_skyfish_traffic_requests_total%s))", window), "status_class", end)
+	if err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// measuredWindow returns the measured window dealgood recorded for an experiment that ran
+// between start and end, or nil if dealgood did not record one.
+func (pc *promConfig) measuredWindow(ctx context.Context, experiment string, start, end time.Time) (*api.MeasuredWindow, error) {
+	sel := fmt.Sprintf("{experiment=%q}", experiment)
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	starts, err := pc.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_window_start_timestamp_seconds%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	if len(starts) == 0 {
+		return nil, nil
+	}
+	ends, err := pc.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_window_end_timestamp_seconds%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	mw := &api.MeasuredWindow{Start: unixSeconds(starts[""])}
+	if v, ok := ends[""]; ok {
+		mw.End = unixSeconds(v)
+	}
+	return mw, nil
+}
+
+// unixSeconds converts a unix time in fractional seconds, as exported in metrics, to a time.
+func unixSeconds(v float64) time.Time {
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// workloadSummary returns the composition of the requests dealgood replayed to an experiment's
+// targets between start and end, or nil if dealgood did not profile the workload.
+func (pc *promConfig) workloadSummary(ctx context.Context, experiment string, start, end time.Time) (*api.WorkloadSummary, error) {
+	sel := fmt.Sprintf("{experiment=%q}", experiment)
+	window := fmt.Sprintf("[%ds]", int64(math.Ceil(end.Sub(start).Seconds())))
+
+	requests, err := pc.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_workload_requests%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	unique, err := pc.queryByLabel(ctx, fmt.Sprintf("max(last_over_time(thunderdome_dealgood_workload_unique_paths%s%s))", sel, window), "", end)
+	if err != nil {
+		return nil, err
+	}
+	ws := &api.WorkloadSummary{
+		Requests:    requests[""],
+		UniquePaths: unique[""],
+	}
+
+	ws.TopShare, err = pc.queryByLabel(ctx, fmt.Sprintf("max by (n) (last_over_time(thunderdome_dealgood_workload_top_share%s%s))", sel, window), "n", end)
+	if err != nil {
+		return nil, err
+	}
+	ws.SizeBytes, err = pc.queryByLabel(ctx, fmt.Sprintf("max by (quantile) (last_over_time(thunderdome_dealgood_workload_response_size_bytes%s%s))", sel, window), "quantile", end)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// queryShares runs an instant Prometheus query and returns each series' share of the total,
+// keyed by the value of label.
+func (pc *promConfig) queryShares(ctx context.Context, query string, label string, at time.Time) (map[string]float64, error) {
+	values, err := pc.queryByLabel(ctx, query, label, at)
+	if err != nil {
+		return nil, err
+	}
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	for k, v := range values {
+		values[k] = v / total
+	}
+	return values, nil
+}
+
+// queryByTarget runs an instant Prometheus query and returns the value of each series keyed
+// by its target label. The query is evaluated at time at, or now if at is zero.
+func (pc *promConfig) queryByTarget(ctx context.Context, query string, at time.Time) (map[string]float64, error) {
+	return pc.queryByLabel(ctx, query, "target", at)
+}
+
+// queryByLabel runs an instant Prometheus query and returns the value of each series keyed
+// by the value of label. The query is evaluated at time at, or now if at is zero.
+func (pc *promConfig) queryByLabel(ctx context.Context, query string, label string, at time.Time) (map[string]float64, error) {
+	series, err := pc.client().Query(ctx, query, at)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64, len(series))
+	for _, s := range series {
+		if len(s.Samples) == 0 {
+			continue
+		}
+		values[s.Labels[label]] = s.Samples[0].Value
+	}
+	return values, nil
+}
+
+// client returns a client for the Prometheus query API.
+func (pc *promConfig) client() *results.Client {
+	return &results.Client{URL: pc.URL, User: pc.User, Token: pc.Token}
+}
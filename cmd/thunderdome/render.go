@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+var RenderCommand = &cli.Command{
+	Name:      "render",
+	Usage:     "Print an experiment definition with variables substituted, ready to deploy",
+	Action:    Render,
+	ArgsUsage: "EXPERIMENT-FILENAME",
+	Description: "The definition is read from the file, or from stdin if the filename is -, and each ${NAME} given a value " +
+		"with --var is replaced by it. The result is upgraded to the current spec version, with the init commands " +
+		"named by init_commands_from included so that it does not depend on the directory of the file, and " +
+		"validated before it is printed. Commands that take an experiment filename read the definition from stdin " +
+		"when it is -, so the output can be piped to them.\n\n" +
+		examples(
+			"thunderdome render --var VERSION=v0.21.0 template.json | thunderdome deploy -d 60 -",
+			"thunderdome render --name kubo-rc1 --label release=rc1 template.json > kubo-rc1.json",
+			"thunderdome render --var VERSION=v0.21.0 template.json | thunderdome deploy -q -d 60 - | xargs thunderdome describe",
+		),
+	BashComplete: completeExperimentFile(),
+	Flags: flags([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name:        "var",
+			Usage:       "Value substituted for ${NAME} in the definition, given as NAME=VALUE. May be repeated.",
+			Destination: &renderOpts.vars,
+		},
+		&cli.StringFlag{
+			Name:        "name",
+			Usage:       "Name of the experiment, replacing the name in the definition.",
+			Destination: &renderOpts.name,
+		},
+		&cli.StringSliceFlag{
+			Name:        "label",
+			Aliases:     []string{"l"},
+			Usage:       "Label added to the experiment, given as KEY=VALUE. May be repeated.",
+			Destination: &renderOpts.labels,
+		},
+	}),
+}
+
+var renderOpts struct {
+	vars   cli.StringSlice
+	name   string
+	labels cli.StringSlice
+}
+
+func Render(cc *cli.Context) error {
+	ctx := cc.Context
+	// the definition is the output, so logs go to stderr as with --quiet
+	commonOpts.quiet = true
+	setupLogging()
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+
+	vars := make(map[string]string)
+	for _, nv := range renderOpts.vars.Value() {
+		k, v, ok := strings.Cut(nv, "=")
+		if !ok || !reVarName.MatchString(k) {
+			return fmt.Errorf("variable must be given as NAME=VALUE, where NAME starts with a letter or underscore: %q", nv)
+		}
+		vars[k] = v
+	}
+
+	f, dir, err := openExperiment(cc.Args().First())
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	data, err = substituteVars(data, vars)
+	if err != nil {
+		return err
+	}
+
+	ej, _, err := decodeSpec(data)
+	if err != nil {
+		return fmt.Errorf("parse experiment definition: %w", err)
+	}
+	if err := resolveInitCommands(ej, dir); err != nil {
+		return err
+	}
+	if renderOpts.name != "" {
+		ej.Name = renderOpts.name
+	}
+	for _, l := range renderOpts.labels.Value() {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("label must be given as KEY=VALUE: %q", l)
+		}
+		if ej.Labels == nil {
+			ej.Labels = map[string]string{}
+		}
+		ej.Labels[k] = v
+	}
+
+	rendered, err := encodeSpec(ej)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseExperiment(ctx, bytes.NewReader(rendered), dir); err != nil {
+		return fmt.Errorf("rendered experiment definition is not valid: %w", err)
+	}
+
+	_, err = output.Write(rendered)
+	return err
+}
+
+var (
+	reVarName     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	rePlaceholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// substituteVars replaces each ${NAME} in an experiment definition with the value of the
+// variable, escaped to be placed in a JSON string. Placeholders without a variable are left
+// alone since init commands may use the same syntax for shell variables. It fails if a variable
+// is not used, which is most likely a typing mistake.
+func substituteVars(data []byte, vars map[string]string) ([]byte, error) {
+	used := make(map[string]bool)
+	out := rePlaceholder.ReplaceAllFunc(data, func(m []byte) []byte {
+		name := string(m[2 : len(m)-1])
+		v, ok := vars[name]
+		if !ok {
+			return m
+		}
+		used[name] = true
+		quoted, _ := json.Marshal(v)
+		return quoted[1 : len(quoted)-1]
+	})
+	for name := range vars {
+		if !used[name] {
+			return nil, fmt.Errorf("variable %s is not used in the experiment definition", name)
+		}
+	}
+	return out, nil
+}
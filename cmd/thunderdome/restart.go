@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+)
+
+var RestartTargetCommand = &cli.Command{
+	Name:      "restart-target",
+	Usage:     "Restart one of a running experiment's targets, or redeploy it with a new image",
+	Action:    RestartTarget,
+	ArgsUsage: "EXPERIMENT-NAME TARGET-NAME",
+	Description: "ironbar stops the target's task and runs it again on the same instance, so dealgood keeps sending " +
+		"requests to it, and annotates the experiment with the restart. With --exclude the time from the restart until " +
+		"a minute after the target is running again is left out of every target's results in the experiment summary.\n\n" +
+		"With --image the target is redeployed with the image instead, leaving the other targets running. The experiment " +
+		"summary then reports the results of each period between redeploys on its own, as well as over the whole " +
+		"experiment. The image must be one the cluster can pull, such as one pushed by thunderdome image --push-to.\n\n" +
+		examples(
+			"thunderdome restart-target bifrost-2023-05 kubo190 --reason \"ran out of disk\"",
+			"thunderdome restart-target --exclude bifrost-2023-05 kubo190",
+			"thunderdome restart-target --image 123456789012.dkr.ecr.eu-west-1.amazonaws.com/thunderdome:kubo-fix2 bifrost-2023-05 kubo190",
+		),
+	BashComplete: completeExperimentNames(""),
+	Flags: flags([]cli.Flag{
+		&cli.StringFlag{
+			Name:        "reason",
+			Usage:       "Why the target is being restarted, recorded in the annotation.",
+			Destination: &restartOpts.reason,
+		},
+		&cli.StringFlag{
+			Name:        "image",
+			Usage:       "Redeploy the target with this image rather than restarting it with the image it is running.",
+			Destination: &restartOpts.image,
+		},
+		&cli.BoolFlag{
+			Name:        "exclude",
+			Usage:       "Leave the time the target was restarting out of the experiment's results.",
+			Destination: &restartOpts.exclude,
+		},
+		&cli.BoolFlag{
+			Name:        "wait",
+			Value:       true,
+			Usage:       "Wait until the target is running again.",
+			Destination: &restartOpts.wait,
+		},
+		&cli.DurationFlag{
+			Name:        "wait-timeout",
+			Value:       15 * time.Minute,
+			Usage:       "Maximum time to wait for the target to be running again.",
+			Destination: &restartOpts.waitTimeout,
+		},
+	}),
+}
+
+var restartOpts struct {
+	reason      string
+	image       string
+	exclude     bool
+	wait        bool
+	waitTimeout time.Duration
+}
+
+func RestartTarget(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 2 {
+		return fmt.Errorf("experiment name and target name must be supplied")
+	}
+	name, target := cc.Args().Get(0), cc.Args().Get(1)
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	out, err := prov.RestartTarget(ctx, name, target, &api.RestartTargetInput{
+		Reason:  restartOpts.reason,
+		Exclude: restartOpts.exclude,
+		Image:   restartOpts.image,
+	})
+	if err != nil {
+		return err
+	}
+	verb := "Restarting"
+	if restartOpts.image != "" {
+		verb = "Redeploying"
+	}
+	fmt.Printf("%s %s of %s (job %s), annotated at %s\n", verb, target, name, out.Job.ID, out.Annotation.Time.Format(time.Stamp))
+	if !restartOpts.wait {
+		return nil
+	}
+
+	deadline := time.Now().Add(restartOpts.waitTimeout)
+	for {
+		status, err := prov.ExperimentStatus(ctx, name)
+		if err != nil {
+			return err
+		}
+		if rs := findRestart(status.Restarts, target, out.Annotation.Time); rs != nil {
+			if rs.Error != "" {
+				return fmt.Errorf("restart failed: %s", rs.Error)
+			}
+			if !rs.Running.IsZero() {
+				fmt.Printf("Target %s is running again as %s after %s\n", target, rs.NewTaskArn, rs.Running.Sub(rs.Requested).Round(time.Second))
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("target was not running again within %s, check thunderdome status %s", restartOpts.waitTimeout, name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// findRestart returns the restart of a target requested at a time, or nil if it has not been
+// recorded yet.
+func findRestart(restarts []api.TargetRestart, target string, requested time.Time) *api.TargetRestart {
+	for i := range restarts {
+		if restarts[i].Target == target && restarts[i].Requested.Equal(requested) {
+			return &restarts[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/results"
+)
+
+var ResultsCommand = &cli.Command{
+	Name:  "results",
+	Usage: "Export the metrics recorded for experiments",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "query",
+			Usage: "Export an experiment's metrics as CSV or JSON lines for analysis in a notebook",
+			Description: "Reads the metrics recorded by dealgood for an experiment from the Prometheus query API and writes " +
+				"one row per sample. Histogram buckets are exported as the number of requests added to each bucket in each step, " +
+				"so they can be summed over any period and quantiles computed from them.\n\n" +
+				examples(
+					"thunderdome results query --experiment bifrost-2023-05 --format csv --output results.csv",
+					"thunderdome results query -e bifrost-2023-05 -m ttfb_p99_seconds --from 2023-05-01T10:00:00Z --to 2023-05-01T12:00:00Z",
+				),
+			BashComplete: completeExperimentNames("experiment", "e"),
+			Action:       ResultsQuery,
+			Flags: flags(append(
+				[]cli.Flag{
+					&cli.StringFlag{
+						Name:        "experiment",
+						Aliases:     []string{"e"},
+						Required:    true,
+						Usage:       "Name of the experiment.",
+						Destination: &resultsOpts.experiment,
+					},
+					&cli.TimestampFlag{
+						Name:        "from",
+						Layout:      time.RFC3339,
+						Usage:       "Start of the period to export, in RFC 3339 format. Defaults to the start of the experiment as recorded by ironbar.",
+						Destination: &resultsOpts.from,
+					},
+					&cli.TimestampFlag{
+						Name:        "to",
+						Layout:      time.RFC3339,
+						Usage:       "End of the period to export, in RFC 3339 format. Defaults to when the experiment stopped, or now if it is still running.",
+						Destination: &resultsOpts.to,
+					},
+					&cli.DurationFlag{
+						Name:        "step",
+						Value:       time.Minute,
+						Usage:       "Interval between samples.",
+						Destination: &resultsOpts.step,
+					},
+					&cli.StringSliceFlag{
+						Name:        "metric",
+						Aliases:     []string{"m"},
+						Usage:       "Metric to export, may be repeated. Defaults to all of: " + strings.Join(results.MetricNames(), ", ") + ".",
+						Destination: &resultsOpts.metrics,
+					},
+					&cli.StringFlag{
+						Name:        "format",
+						Value:       "csv",
+						Usage:       "Output format, either csv or jsonl.",
+						Destination: &resultsOpts.format,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "File to write the results to. Defaults to stdout.",
+						Destination: &resultsOpts.output,
+					},
+				},
+				promFlags(&resultsOpts.prom, "used to read the results")...,
+			)),
+		},
+		{
+			Name:      "promql",
+			Usage:     "Run a PromQL query over an experiment's metrics through ironbar",
+			ArgsUsage: "EXPERIMENT-NAME QUERY",
+			Description: "ironbar adds a matcher for the experiment to every selector in the query and runs it against the " +
+				"Prometheus query API it reads results from, so no Prometheus credentials are needed and the query should not " +
+				"name the experiment. An instant query is run at the time the experiment stopped, or now if it is still running, " +
+				"unless --time is given. With --range the query is run for each step of the experiment's period, or of the " +
+				"period given by --from and --to.\n\n" +
+				examples(
+					"thunderdome results promql bifrost-2023-05 'sum by (target) (rate(thunderdome_dealgood_requests_total[5m]))'",
+					"thunderdome results promql --range --step 5m bifrost-2023-05 'histogram_quantile(0.99, sum by (target, le) (rate(thunderdome_dealgood_request_time_seconds_bucket[5m])))'",
+					"thunderdome results promql --json bifrost-2023-05 'count(up)'",
+				),
+			BashComplete: completeExperimentNames(""),
+			Action:       ResultsPromQL,
+			Flags: flags([]cli.Flag{
+				&cli.TimestampFlag{
+					Name:        "time",
+					Layout:      time.RFC3339,
+					Usage:       "Time to run an instant query at, in RFC 3339 format.",
+					Destination: &promqlOpts.time,
+				},
+				&cli.BoolFlag{
+					Name:        "range",
+					Usage:       "Run a range query, returning a sample for each step.",
+					Destination: &promqlOpts.isRange,
+				},
+				&cli.TimestampFlag{
+					Name:        "from",
+					Layout:      time.RFC3339,
+					Usage:       "Start of a range query, in RFC 3339 format. Defaults to the start of the experiment.",
+					Destination: &promqlOpts.from,
+				},
+				&cli.TimestampFlag{
+					Name:        "to",
+					Layout:      time.RFC3339,
+					Usage:       "End of a range query, in RFC 3339 format. Defaults to when the experiment stopped, or now if it is still running.",
+					Destination: &promqlOpts.to,
+				},
+				&cli.DurationFlag{
+					Name:        "step",
+					Usage:       "Interval between the samples of a range query. Defaults to one giving about 250 samples.",
+					Destination: &promqlOpts.step,
+				},
+				&cli.BoolFlag{
+					Name:        "json",
+					Usage:       "Write the result as JSON.",
+					Destination: &promqlOpts.json,
+				},
+			}),
+		},
+	},
+}
+
+var resultsOpts struct {
+	experiment string
+	from       cli.Timestamp
+	to         cli.Timestamp
+	step       time.Duration
+	metrics    cli.StringSlice
+	format     string
+	output     string
+	prom       promConfig
+}
+
+var promqlOpts struct {
+	time    cli.Timestamp
+	isRange bool
+	from    cli.Timestamp
+	to      cli.Timestamp
+	step    time.Duration
+	json    bool
+}
+
+func ResultsQuery(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+
+	if resultsOpts.prom.URL == "" {
+		return fmt.Errorf("a prometheus url must be supplied to read results")
+	}
+	if resultsOpts.step <= 0 {
+		return fmt.Errorf("step must be positive")
+	}
+
+	var write func(io.Writer, []results.Series) error
+	switch resultsOpts.format {
+	case "csv":
+		write = results.WriteCSV
+	case "jsonl":
+		write = results.WriteJSONLines
+	default:
+		return fmt.Errorf("unsupported format: %q", resultsOpts.format)
+	}
+
+	var from, to time.Time
+	if v := resultsOpts.from.Value(); v != nil {
+		from = *v
+	}
+	if v := resultsOpts.to.Value(); v != nil {
+		to = *v
+	}
+	if from.IsZero() || to.IsZero() {
+		if err := checkEnv(); err != nil {
+			return err
+		}
+		prov, err := infra.NewProvider()
+		if err != nil {
+			return err
+		}
+		status, err := prov.ExperimentStatus(ctx, resultsOpts.experiment)
+		if err != nil {
+			return fmt.Errorf("find experiment period, supply --from and --to if ironbar no longer knows of the experiment: %w", err)
+		}
+		start, end := status.Start, status.Stopped
+		if end.IsZero() {
+			end = time.Now()
+		}
+		// prefer the window dealgood measured over once its start barrier was passed
+		mw, err := resultsOpts.prom.measuredWindow(ctx, resultsOpts.experiment, start, end)
+		if err != nil {
+			slog.Warn("failed to read measured window, using the experiment's period", "error", err)
+		} else if mw != nil {
+			start = mw.Start
+			if !mw.End.IsZero() {
+				end = mw.End
+			}
+		}
+		if from.IsZero() {
+			from = start
+		}
+		if to.IsZero() {
+			to = end
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("end of period must be after its start")
+	}
+
+	series, err := resultsOpts.prom.client().Export(ctx, resultsOpts.experiment, resultsOpts.metrics.Value(), from, to, resultsOpts.step)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if resultsOpts.output != "" {
+		f, err := os.Create(resultsOpts.output)
+		if err != nil {
+			return fmt.Errorf("create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := write(w, series); err != nil {
+		return fmt.Errorf("write results: %w", err)
+	}
+	return nil
+}
+
+func ResultsPromQL(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 2 {
+		return fmt.Errorf("experiment name and query must be supplied")
+	}
+	name := cc.Args().Get(0)
+
+	in := &api.QueryInput{
+		Query: cc.Args().Get(1),
+		Range: promqlOpts.isRange,
+		Step:  promqlOpts.step,
+	}
+	if v := promqlOpts.time.Value(); v != nil {
+		if in.Range {
+			return fmt.Errorf("--time cannot be used with --range, use --from and --to")
+		}
+		in.Time = *v
+	}
+	if v := promqlOpts.from.Value(); v != nil {
+		in.Start = *v
+	}
+	if v := promqlOpts.to.Value(); v != nil {
+		in.End = *v
+	}
+	if !in.Range && (!in.Start.IsZero() || !in.End.IsZero() || in.Step != 0) {
+		return fmt.Errorf("--from, --to and --step can only be used with --range")
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+	out, err := prov.Query(ctx, name, in)
+	if err != nil {
+		return err
+	}
+
+	if promqlOpts.json {
+		enc := json.NewEncoder(output)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+
+	if len(out.Series) == 0 {
+		fmt.Fprintln(output, "No series matched")
+		return nil
+	}
+	tw := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tVALUE\tLABELS")
+	for _, qs := range out.Series {
+		for _, sample := range qs.Samples {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", sample.Time.Local().Format(time.RFC3339), sample.Value, formatLabels(qs.Labels))
+		}
+	}
+	return tw.Flush()
+}
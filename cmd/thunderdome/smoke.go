@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var SmokeCommand = &cli.Command{
+	Name:      "smoke",
+	Usage:     "Deploy a scaled-down version of an experiment to check that it works end to end",
+	Action:    Smoke,
+	ArgsUsage: "EXPERIMENT-FILENAME",
+	Description: examples(
+		"thunderdome smoke experiment.json",
+		"thunderdome smoke --rate 5 --timeout 15m --keep experiment.json",
+	),
+	BashComplete: completeExperimentFile(),
+	Flags: flags(append(
+		[]cli.Flag{
+			&cli.IntFlag{
+				Name:        "rate",
+				Value:       2,
+				Usage:       "Request rate to use for the smoke test.",
+				Destination: &smokeOpts.rate,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Value:       15 * time.Minute,
+				Usage:       "Maximum time to wait for every target to report metrics after the experiment is deployed.",
+				Destination: &smokeOpts.timeout,
+			},
+			&cli.BoolFlag{
+				Name:        "keep",
+				Usage:       "Leave the smoke test experiment running instead of tearing it down. Ironbar will still stop it once the timeout plus one minute has passed, 16 minutes by default.",
+				Destination: &smokeOpts.keep,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Aliases:     []string{"f"},
+				Usage:       "Force docker images to be rebuilt.",
+				Destination: &smokeOpts.forceBuild,
+			},
+			&cli.BoolFlag{
+				Name:        "allow-remote-targets",
+				Usage:       "Confirm that requests may be sent to remote targets defined by a url in the experiment file.",
+				Destination: &smokeOpts.allowRemoteTargets,
+			},
+		},
+		promFlags(&smokeOpts.prom, "used to verify that targets are receiving requests")...,
+	)),
+}
+
+var smokeOpts struct {
+	rate               int
+	timeout            time.Duration
+	keep               bool
+	forceBuild         bool
+	allowRemoteTargets bool
+	prom               promConfig
+}
+
+const (
+	// smokeMaxConcurrency is the maximum concurrency used for a smoke test
+	smokeMaxConcurrency = 10
+
+	// smokeRunTime is the minimum time requests are sent before the smoke test passes
+	smokeRunTime = time.Minute
+
+	// smokeTeardownVerifyTimeout is the maximum time to wait for the smoke test's resources to be deleted
+	smokeTeardownVerifyTimeout = 5 * time.Minute
+)
+
+func Smoke(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkBuildEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+
+	if smokeOpts.rate <= 0 {
+		return fmt.Errorf("rate must be a positive number")
+	}
+
+	args := cc.Args()
+	e, err := LoadExperiment(ctx, args.Get(0))
+	if err != nil {
+		return err
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	if err := scaleDownExperiment(ctx, prov, e, smokeOpts.rate, smokeOpts.timeout+smokeRunTime); err != nil {
+		return err
+	}
+
+	if err := checkRemoteTargets(e, smokeOpts.allowRemoteTargets, DefaultRemoteMaxRequestRate); err != nil {
+		return err
+	}
+
+	fmt.Println("Running preflight checks")
+	if err := runPreflight(ctx, prov, e); err != nil {
+		return err
+	}
+
+	fmt.Printf("Running smoke test experiment %s at %d requests per second\n", e.Name, e.MaxRequestRate)
+
+	failures := runSmokeTest(ctx, prov, e)
+
+	if smokeOpts.keep {
+		fmt.Printf("Leaving experiment %s running\n", e.Name)
+		printName(e.Name)
+	} else {
+		fmt.Printf("Tearing down experiment %s\n", e.Name)
+		if err := prov.Teardown(ctx, e); err != nil {
+			failures = append(failures, fmt.Sprintf("teardown failed: %v", err))
+		} else if err := verifyTeardown(ctx, prov, e, smokeTeardownVerifyTimeout); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	fmt.Println()
+	if len(failures) > 0 {
+		fmt.Println("Smoke test FAILED:")
+		for _, f := range failures {
+			fmt.Println("  - " + f)
+		}
+		return fmt.Errorf("smoke test failed")
+	}
+
+	fmt.Println("Smoke test PASSED")
+	return nil
+}
+
+// scaleDownExperiment modifies an experiment so it runs briefly at a low request rate using
+// the cheapest instances available. The duration is registered with ironbar, which stops the
+// experiment once it has passed even if the smoke command is interrupted before tearing it down,
+// so it must cover the longest time the smoke test can take.
+func scaleDownExperiment(ctx context.Context, prov *infra.Provider, e *exp.Experiment, rate int, duration time.Duration) error {
+	instanceType, err := prov.CheapestInstanceType(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.Name += "-smoke"
+	e.Duration = duration
+	e.MaxRequestRate = rate
+	if e.MaxConcurrency > smokeMaxConcurrency {
+		e.MaxConcurrency = smokeMaxConcurrency
+	}
+	for _, t := range e.Targets {
+		if !t.IsRemote() {
+			t.InstanceType = instanceType
+		}
+	}
+	return nil
+}
+
+// runSmokeTest deploys the experiment and checks that it produces metrics, returning a
+// description of each problem found.
+func runSmokeTest(ctx context.Context, prov *infra.Provider, e *exp.Experiment) []string {
+	if err := prov.Deploy(ctx, e, smokeOpts.forceBuild); err != nil {
+		return []string{fmt.Sprintf("deploy failed: %v", err)}
+	}
+	started := time.Now()
+
+	var failures []string
+	if smokeOpts.prom.URL == "" {
+		slog.Warn("no prometheus url supplied, metrics will not be verified")
+		select {
+		case <-ctx.Done():
+			return []string{ctx.Err().Error()}
+		case <-time.After(smokeRunTime):
+		}
+	} else {
+		if err := waitForTargetMetrics(ctx, e, smokeOpts.timeout); err != nil {
+			failures = append(failures, err.Error())
+		}
+		if wait := smokeRunTime - time.Since(started); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return append(failures, ctx.Err().Error())
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	// after requests have been sent for a while every component should still be running
+	status, err := prov.ExperimentStatus(ctx, e.Name)
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("failed to get experiment status: %v", err))
+	} else if status.Status != "Running" {
+		failures = append(failures, fmt.Sprintf("experiment status is %s, expected Running", status.Status))
+	}
+
+	return failures
+}
+
+// waitForTargetMetrics polls Prometheus until dealgood has reported successful requests to
+// every target in the experiment.
+func waitForTargetMetrics(ctx context.Context, e *exp.Experiment, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`sum by (target) (thunderdome_dealgood_responses_total{experiment=%q,code=~"2.."})`, e.Name)
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	var missing []string
+	for {
+		counts, err := smokeOpts.prom.queryByTarget(ctx, query, time.Time{})
+		if err != nil {
+			slog.Warn("failed to query prometheus", "error", err)
+		} else {
+			missing = missing[:0]
+			for _, t := range e.Targets {
+				if counts[t.Name] <= 0 {
+					missing = append(missing, t.Name)
+				}
+			}
+			if len(missing) == 0 {
+				slog.Info("all targets are reporting successful requests")
+				return nil
+			}
+			slog.Info("waiting for targets to report successful requests", "missing", missing)
+		}
+
+		select {
+		case <-ctx.Done():
+			if len(missing) == 0 {
+				return fmt.Errorf("no metrics could be read from prometheus")
+			}
+			sort.Strings(missing)
+			return fmt.Errorf("no successful requests reported for targets: %v", missing)
+		case <-ticker.C:
+		}
+	}
+}
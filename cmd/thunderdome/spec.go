@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// A specMigration upgrades the fields of an experiment definition by one spec version, for
+// example by renaming a block or filling in a field that became required.
+type specMigration func(spec map[string]json.RawMessage) error
+
+// specMigrations upgrade experiment definitions to the current spec version. specMigrations[i]
+// upgrades a definition from version i+1 to version i+2, so a new version is introduced by
+// appending the migration from the previous one.
+var specMigrations = []specMigration{}
+
+// CurrentSpecVersion is the version of the experiment definition format written by this
+// version of thunderdome.
+var CurrentSpecVersion = len(specMigrations) + 1
+
+// legacySpecVersion is assumed for definitions written before spec_version was introduced.
+const legacySpecVersion = 1
+
+// specVersion returns the spec version declared by an experiment definition, or zero if it
+// does not declare one.
+func specVersion(spec map[string]json.RawMessage) (int, error) {
+	raw, ok := spec["spec_version"]
+	if !ok {
+		return 0, nil
+	}
+	var v int
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return 0, fmt.Errorf("spec_version must be an integer: %w", err)
+	}
+	if v < 1 {
+		return 0, fmt.Errorf("spec_version must be a positive integer")
+	}
+	if v > CurrentSpecVersion {
+		return 0, fmt.Errorf("spec_version %d is newer than the latest supported by this version of thunderdome (%d), upgrade thunderdome to use this definition", v, CurrentSpecVersion)
+	}
+	return v, nil
+}
+
+// decodeSpec decodes an experiment definition of any supported spec version, migrating it to
+// the current version. It returns the version declared by the definition, which is zero if it
+// has no spec_version.
+func decodeSpec(data []byte) (*ExperimentJSON, int, error) {
+	var spec map[string]json.RawMessage
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, 0, fmt.Errorf("json decode: %w", err)
+	}
+
+	declared, err := specVersion(spec)
+	if err != nil {
+		return nil, 0, err
+	}
+	version := declared
+	if version == 0 {
+		version = legacySpecVersion
+	}
+
+	if version < CurrentSpecVersion {
+		for v := version; v < CurrentSpecVersion; v++ {
+			if err := specMigrations[v-1](spec); err != nil {
+				return nil, 0, fmt.Errorf("migrate from spec version %d to %d: %w", v, v+1, err)
+			}
+		}
+		spec["spec_version"] = json.RawMessage(fmt.Sprint(CurrentSpecVersion))
+		if data, err = json.Marshal(spec); err != nil {
+			return nil, 0, fmt.Errorf("encode migrated definition: %w", err)
+		}
+	}
+
+	ej := new(ExperimentJSON)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(ej); err != nil {
+		return nil, 0, fmt.Errorf("json decode: %w", err)
+	}
+	ej.SpecVersion = CurrentSpecVersion
+
+	return ej, declared, nil
+}
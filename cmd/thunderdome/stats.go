@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+)
+
+// A comparison summarises paired measurements of a baseline and candidate taken in repeated
+// runs, as the relative difference of the candidate from the baseline in each run.
+type comparison struct {
+	N        int     // number of runs
+	MeanDiff float64 // mean relative difference of the candidate from the baseline
+	StdDev   float64 // sample standard deviation of the relative differences
+	CILow    float64 // lower bound of the confidence interval of the mean difference
+	CIHigh   float64 // upper bound of the confidence interval of the mean difference
+	PValue   float64 // two sided p-value of a paired t-test that the mean difference is zero
+	Power    float64 // power of the test to detect the effect size at the significance level
+}
+
+// compare runs a paired t-test on the relative differences between candidate and baseline.
+// The power is calculated for the given effect size, a relative difference, or for the
+// observed mean difference if effect is zero.
+func compare(baseline, candidate []float64, alpha, effect float64) comparison {
+	diffs := make([]float64, 0, len(baseline))
+	for i := range baseline {
+		if baseline[i] == 0 {
+			continue
+		}
+		diffs = append(diffs, (candidate[i]-baseline[i])/baseline[i])
+	}
+
+	c := comparison{N: len(diffs)}
+	if c.N == 0 {
+		return c
+	}
+	for _, d := range diffs {
+		c.MeanDiff += d
+	}
+	c.MeanDiff /= float64(c.N)
+	if c.N < 2 {
+		return c
+	}
+
+	for _, d := range diffs {
+		c.StdDev += (d - c.MeanDiff) * (d - c.MeanDiff)
+	}
+	c.StdDev = math.Sqrt(c.StdDev / float64(c.N-1))
+
+	df := float64(c.N - 1)
+	se := c.StdDev / math.Sqrt(float64(c.N))
+	tcrit := studentTQuantile(1-alpha/2, df)
+	c.CILow = c.MeanDiff - tcrit*se
+	c.CIHigh = c.MeanDiff + tcrit*se
+
+	if se == 0 {
+		// every run measured exactly the same difference
+		if c.MeanDiff != 0 {
+			c.PValue, c.Power = 0, 1
+		} else {
+			c.PValue, c.Power = 1, 0
+		}
+		return c
+	}
+
+	t := c.MeanDiff / se
+	c.PValue = 2 * (1 - studentTCDF(math.Abs(t), df))
+
+	if effect == 0 {
+		effect = c.MeanDiff
+	}
+	// approximate the noncentral t distribution by shifting the central one
+	ncp := math.Abs(effect) / se
+	c.Power = 1 - studentTCDF(tcrit-ncp, df) + studentTCDF(-tcrit-ncp, df)
+	return c
+}
+
+// studentTCDF returns the cumulative distribution function of Student's t distribution with
+// df degrees of freedom.
+func studentTCDF(t, df float64) float64 {
+	x := df / (df + t*t)
+	tail := 0.5 * regIncBeta(df/2, 0.5, x)
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// studentTQuantile returns the value below which a fraction p of Student's t distribution
+// with df degrees of freedom lies.
+func studentTQuantile(p, df float64) float64 {
+	lo, hi := -1000.0, 1000.0
+	for i := 0; i < 200; i++ {
+		mid := (lo + hi) / 2
+		if studentTCDF(mid, df) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// regIncBeta returns the regularized incomplete beta function I_x(a, b).
+func regIncBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	// the continued fraction converges quickly only for x < (a+1)/(a+b+2)
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(a, b, x) / a
+	}
+	return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+}
+
+// betaContinuedFraction evaluates the continued fraction for the incomplete beta function
+// using the modified Lentz method.
+func betaContinuedFraction(a, b, x float64) float64 {
+	const (
+		maxIterations = 300
+		epsilon       = 1e-14
+		tiny          = 1e-300
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
 	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
 )
 
@@ -13,6 +15,11 @@ var StatusCommand = &cli.Command{
 	Name:   "status",
 	Usage:  "Report on the operational status of experiments",
 	Action: Status,
+	Description: examples(
+		"thunderdome status",
+		"thunderdome status --experiment bifrost-2023-05",
+	),
+	BashComplete: completeExperimentNames("experiment", "e"),
 	Flags: flags([]cli.Flag{
 		&cli.StringFlag{
 			Name:        "experiment",
@@ -53,6 +60,141 @@ func Status(cc *cli.Context) error {
 			fmt.Printf("Ran for      : %s\n", out.Stopped.Sub(out.Start).Round(time.Second))
 			fmt.Printf("Stopped at   : %s\n", out.Stopped.Format(time.Stamp))
 		}
+		if out.Owner != "" {
+			fmt.Printf("Owner        : %s\n", out.Owner)
+		}
+		if out.Team != "" {
+			fmt.Printf("Team         : %s\n", out.Team)
+		}
+		if out.Purpose != "" {
+			fmt.Printf("Purpose      : %s\n", out.Purpose)
+		}
+		if out.Ticket != "" {
+			fmt.Printf("Ticket       : %s\n", out.Ticket)
+		}
+
+		for _, f := range out.Failures {
+			retried := "not retried"
+			if f.Retried {
+				retried = "retried"
+			}
+			fmt.Printf("Failure      : %s %s at %s, %s (%s)\n", f.Component, f.Cause, f.Time.Format(time.Stamp), retried, f.Reason)
+			for _, d := range f.Dumps {
+				fmt.Printf("               %s\n", d)
+			}
+		}
+
+		for _, d := range out.Deadlines {
+			fmt.Printf("Overdue      : %s was due by %s (%s)\n", d.Operation, d.Deadline.Format(time.Stamp), d.Detail)
+		}
+
+		for _, st := range out.Shutdown {
+			switch {
+			case st.Finished.IsZero() && st.TimedOut:
+				fmt.Printf("Shutdown     : %s timed out after %s, still stopping\n", st.Stage, time.Duration(st.TimeoutSeconds*float64(time.Second)))
+			case st.Finished.IsZero():
+				fmt.Printf("Shutdown     : %s started at %s\n", st.Stage, st.Started.Format(time.Stamp))
+			case st.TimedOut:
+				fmt.Printf("Shutdown     : %s took %s, timed out after %s\n", st.Stage, st.Finished.Sub(st.Started).Round(time.Second), time.Duration(st.TimeoutSeconds*float64(time.Second)))
+			default:
+				fmt.Printf("Shutdown     : %s took %s\n", st.Stage, st.Finished.Sub(st.Started).Round(time.Second))
+			}
+		}
+
+		for _, lm := range out.LogMatches {
+			fmt.Printf("Log matches  : %s %s x%d\n", lm.Component, lm.Pattern, lm.Count)
+			for _, ex := range lm.Excerpts {
+				fmt.Printf("               %s\n", ex)
+			}
+		}
+
+		for _, a := range out.Anomalies {
+			fmt.Printf("Anomaly      : %s %s was %.4g at %s, %.1f sigma from its mean of %.4g\n", a.Target, a.Metric, a.Value, a.Time.Format(time.Stamp), a.Sigma, a.Mean)
+		}
+
+		for _, rs := range out.Restarts {
+			state := "restarting"
+			switch {
+			case rs.Error != "":
+				state = "failed: " + rs.Error
+			case !rs.Running.IsZero():
+				state = fmt.Sprintf("running again after %s", rs.Running.Sub(rs.Requested).Round(time.Second))
+			}
+			if rs.Excluded {
+				state += ", excluded from results"
+			}
+			if rs.Image != "" {
+				fmt.Printf("Redeploy     : %s at %s with %s, %s\n", rs.Target, rs.Requested.Format(time.Stamp), rs.Image, state)
+				continue
+			}
+			fmt.Printf("Restart      : %s at %s, %s\n", rs.Target, rs.Requested.Format(time.Stamp), state)
+		}
+
+		for _, c := range out.Changes {
+			state := fmt.Sprintf("status %d", c.Status)
+			if c.Error != "" {
+				state = "failed: " + c.Error
+			}
+			fmt.Printf("Config change: %s %s %s %s at %s, %s\n", c.Segment, c.Target, c.Method, c.Path, c.Time.Format(time.Stamp), state)
+		}
+
+		for _, p := range out.Placements {
+			where := p.AvailabilityZone
+			if p.InstanceID != "" {
+				where += fmt.Sprintf(" on %s (%s)", p.InstanceID, p.InstanceType)
+			}
+			fmt.Printf("Placement    : %s in %s\n", p.Component, where)
+		}
+
+		for _, a := range out.Asymmetries {
+			fmt.Printf("Asymmetry    : %s\n", a.Description)
+		}
+
+		slowest := out.SlowestOverall
+		if len(slowest) == 0 {
+			slowest = out.Slowest
+		}
+		for _, sr := range slowest {
+			fmt.Printf("Slowest      : %s since %s\n", sr.Target, sr.WindowStart.Format(time.Stamp))
+			for i, r := range sr.Requests {
+				if i == 3 {
+					fmt.Printf("               ... %d more\n", len(sr.Requests)-i)
+					break
+				}
+				outcome := fmt.Sprint(r.StatusCode)
+				if r.ErrorClass != "" {
+					outcome += " " + r.ErrorClass
+				}
+				fmt.Printf("               %.3fs %s %s %s\n", r.TotalSeconds, outcome, r.Method, r.URI)
+			}
+		}
+
+		annotations, err := prov.Annotations(ctx, statusOpts.experiment)
+		if err != nil {
+			return err
+		}
+		for _, a := range annotations {
+			if a.Author != "" {
+				fmt.Printf("Annotation   : %s %s (%s)\n", a.Time.Format(time.Stamp), a.Text, a.Author)
+				continue
+			}
+			fmt.Printf("Annotation   : %s %s\n", a.Time.Format(time.Stamp), a.Text)
+		}
+
+		if !out.Stopped.IsZero() {
+			analyses, err := prov.Analyses(ctx, statusOpts.experiment)
+			if err != nil {
+				return err
+			}
+			for _, an := range analyses {
+				if an.Status != api.AnalysisStatusSucceeded {
+					fmt.Printf("Analysis     : %s %s (%s)\n", an.Name, an.Status, an.Reason)
+					continue
+				}
+				fmt.Printf("Analysis     : %s %s\n", an.Name, an.Status)
+				fmt.Printf("%s\n", an.Output)
+			}
+		}
 
 		dashboard := fmt.Sprintf("https://protocollabs.grafana.net/d/GE2JD7ZVz/experiment-timeline?orgId=1&from=now-1h&to=now&var-experiment=%s", statusOpts.experiment)
 		fmt.Println("Grafana dashboard: " + dashboard)
@@ -60,10 +202,16 @@ func Status(cc *cli.Context) error {
 		return nil
 	}
 
-	out, err := prov.ListExperiments(ctx)
+	out, err := prov.ListExperiments(ctx, nil)
 	if err != nil {
 		return err
 	}
+	if commonOpts.quiet {
+		for _, it := range out.Items {
+			printName(it.Name)
+		}
+		return nil
+	}
 
 	if len(out.Items) == 0 {
 		fmt.Println("No experiments running or recently stopped")
@@ -78,7 +226,29 @@ func Status(cc *cli.Context) error {
 		} else {
 			fmt.Printf("%-40s [stopped]\n", it.Name)
 		}
+		if md := listMetadata(it); md != "" {
+			fmt.Printf("    %s\n", md)
+		}
 	}
 
 	return nil
 }
+
+// listMetadata formats who an experiment belongs to and why it is being run for the list of
+// experiments.
+func listMetadata(it api.ListExperimentsItem) string {
+	var parts []string
+	if it.Owner != "" {
+		parts = append(parts, "owner: "+it.Owner)
+	}
+	if it.Team != "" {
+		parts = append(parts, "team: "+it.Team)
+	}
+	if it.Purpose != "" {
+		parts = append(parts, "purpose: "+it.Purpose)
+	}
+	if it.Ticket != "" {
+		parts = append(parts, "ticket: "+it.Ticket)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/exp/slog"
+
+	"github.com/plprobelab/thunderdome/cmd/ironbar/api"
+	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
+)
+
+var StudyCommand = &cli.Command{
+	Name:  "study",
+	Usage: "Repeat an experiment until the difference between two targets is measured with enough statistical power",
+	Description: "Runs the experiment repeatedly, measuring a metric for a baseline and a candidate target in each run. " +
+		"After each run a paired t-test is made on the relative differences between the targets across all runs so far. " +
+		"Runs stop once the test reaches the target power, or the maximum number of repeats has been run.\n\n" +
+		examples(
+			"thunderdome study --baseline kubo-v0.19 --candidate kubo-v0.20 experiment.json",
+			"thunderdome study --baseline kubo-v0.19 --candidate kubo-v0.20 --metric ttfb_p99 --max-repeats 10 --output study.json experiment.json",
+		),
+	BashComplete: completeExperimentFile("baseline", "candidate"),
+	Action:       Study,
+	ArgsUsage:    "EXPERIMENT-FILENAME",
+	Flags: flags(append(
+		[]cli.Flag{
+			&cli.IntFlag{
+				Name:        "duration",
+				Required:    true,
+				Aliases:     []string{"d"},
+				Usage:       "Duration of each run, in minutes.",
+				Destination: &studyOpts.duration,
+			},
+			&cli.StringFlag{
+				Name:        "baseline",
+				Usage:       "Name of the baseline target. Defaults to the first target in the experiment.",
+				Destination: &studyOpts.baseline,
+			},
+			&cli.StringFlag{
+				Name:        "candidate",
+				Usage:       "Name of the candidate target. Defaults to the second target in the experiment.",
+				Destination: &studyOpts.candidate,
+			},
+			&cli.StringFlag{
+				Name:        "metric",
+				Value:       "ttfb_p50",
+				Usage:       "Metric to compare, one of ttfb_p50, ttfb_p95, ttfb_p99, error_ratio or requests.",
+				Destination: &studyOpts.metric,
+			},
+			&cli.Float64Flag{
+				Name:        "power",
+				Value:       0.8,
+				Usage:       "Statistical power at which to stop repeating.",
+				Destination: &studyOpts.power,
+			},
+			&cli.Float64Flag{
+				Name:        "alpha",
+				Value:       0.05,
+				Usage:       "Significance level of the test.",
+				Destination: &studyOpts.alpha,
+			},
+			&cli.Float64Flag{
+				Name:        "min-effect",
+				Usage:       "Smallest relative difference between the targets worth detecting, for example 0.03 for 3%. Defaults to the observed difference.",
+				Destination: &studyOpts.minEffect,
+			},
+			&cli.IntFlag{
+				Name:        "min-repeats",
+				Value:       3,
+				Usage:       "Minimum number of runs.",
+				Destination: &studyOpts.minRepeats,
+			},
+			&cli.IntFlag{
+				Name:        "max-repeats",
+				Value:       10,
+				Usage:       "Maximum number of runs.",
+				Destination: &studyOpts.maxRepeats,
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Aliases:     []string{"o"},
+				Usage:       "Write the measurements of each run and the comparison to this file as JSON.",
+				Destination: &studyOpts.output,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Aliases:     []string{"f"},
+				Usage:       "Force docker images to be rebuilt.",
+				Destination: &studyOpts.forceBuild,
+			},
+			&cli.BoolFlag{
+				Name:        "skip-preflight",
+				Usage:       "Skip the checks made before any resources are created.",
+				Destination: &studyOpts.skipPreflight,
+			},
+		},
+		promFlags(&studyOpts.prom, "used to measure each run")...,
+	)),
+}
+
+var studyOpts struct {
+	duration      int
+	baseline      string
+	candidate     string
+	metric        string
+	power         float64
+	alpha         float64
+	minEffect     float64
+	minRepeats    int
+	maxRepeats    int
+	output        string
+	forceBuild    bool
+	skipPreflight bool
+	prom          promConfig
+}
+
+// studyMetrics maps the metrics that can be compared to a query giving their value for each
+// target of an experiment over a window. The query is formatted with the experiment name and
+// the window.
+var studyMetrics = map[string]string{
+	"ttfb_p50":    `histogram_quantile(0.5, sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+	"ttfb_p95":    `histogram_quantile(0.95, sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+	"ttfb_p99":    `histogram_quantile(0.99, sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+	"error_ratio": `sum by (target) (increase(thunderdome_dealgood_errors_total{experiment=%[1]q}[%[2]s])) / sum by (target) (increase(thunderdome_dealgood_requests_total{experiment=%[1]q}[%[2]s]))`,
+	"requests":    `sum by (target) (increase(thunderdome_dealgood_requests_total{experiment=%[1]q}[%[2]s]))`,
+}
+
+// A studyRun holds the measurements made in one run of a study.
+type studyRun struct {
+	Experiment string    `json:"experiment"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Baseline   float64   `json:"baseline"`
+	Candidate  float64   `json:"candidate"`
+
+	// Traffic is the live traffic replayed during the run, nil if it could not be read.
+	Traffic *api.TrafficSummary `json:"traffic,omitempty"`
+
+	// Workload is the composition of the requests replayed during the run, nil if dealgood did
+	// not profile it.
+	Workload *api.WorkloadSummary `json:"workload,omitempty"`
+}
+
+// trafficVariationWarning is the relative spread in live request rate between runs above which
+// the study report warns that runs saw different traffic.
+const trafficVariationWarning = 0.2
+
+// workloadShareWarning is the difference in the share of requests made for the ten most
+// popular paths between runs above which the study report warns that runs replayed different
+// content.
+const workloadShareWarning = 0.1
+
+// workloadSizeWarning is the relative spread in median response size between runs above which
+// the study report warns that runs replayed different content.
+const workloadSizeWarning = 0.5
+
+type studyReport struct {
+	Experiment string     `json:"experiment"`
+	Metric     string     `json:"metric"`
+	Baseline   string     `json:"baseline"`
+	Candidate  string     `json:"candidate"`
+	Runs       []studyRun `json:"runs"`
+	Comparison comparison `json:"comparison"`
+	Conclusive bool       `json:"conclusive"` // whether the target power was reached
+}
+
+func Study(cc *cli.Context) error {
+	ctx := cc.Context
+	setupLogging()
+	if err := checkBuildEnv(); err != nil {
+		return err
+	}
+
+	if cc.NArg() != 1 {
+		return fmt.Errorf("filename experiment must be supplied")
+	}
+	if studyOpts.duration < 5 {
+		return fmt.Errorf("duration must be at least 5 minutes")
+	}
+	if studyOpts.prom.URL == "" {
+		return fmt.Errorf("a prometheus url must be supplied to measure each run")
+	}
+	query, ok := studyMetrics[studyOpts.metric]
+	if !ok {
+		return fmt.Errorf("unsupported metric: %q", studyOpts.metric)
+	}
+	if studyOpts.power <= 0 || studyOpts.power >= 1 {
+		return fmt.Errorf("power must be between 0 and 1")
+	}
+	if studyOpts.alpha <= 0 || studyOpts.alpha >= 1 {
+		return fmt.Errorf("alpha must be between 0 and 1")
+	}
+	if studyOpts.minRepeats < 2 {
+		return fmt.Errorf("min repeats must be at least 2")
+	}
+	if studyOpts.maxRepeats < studyOpts.minRepeats {
+		return fmt.Errorf("max repeats must not be less than min repeats")
+	}
+
+	e, err := LoadExperiment(ctx, cc.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	e.Duration = time.Duration(studyOpts.duration) * time.Minute
+
+	baseline, candidate, err := studyTargets(e, studyOpts.baseline, studyOpts.candidate)
+	if err != nil {
+		return err
+	}
+	if err := checkRemoteTargets(e, false, DefaultRemoteMaxRequestRate); err != nil {
+		return err
+	}
+
+	prov, err := infra.NewProvider()
+	if err != nil {
+		return err
+	}
+
+	if !studyOpts.skipPreflight {
+		fmt.Println("Running preflight checks")
+		if err := runPreflight(ctx, prov, e); err != nil {
+			return err
+		}
+	}
+
+	report := &studyReport{
+		Experiment: e.Name,
+		Metric:     studyOpts.metric,
+		Baseline:   baseline,
+		Candidate:  candidate,
+	}
+
+	fmt.Printf("Comparing %s of %s against %s, repeating until power reaches %g\n", studyOpts.metric, candidate, baseline, studyOpts.power)
+	for i := 1; i <= studyOpts.maxRepeats; i++ {
+		run := *e
+		run.Name = fmt.Sprintf("%s-r%d", e.Name, i)
+
+		fmt.Printf("Run %d: deploying %s for %s\n", i, run.Name, run.Duration)
+		sr, err := runStudyExperiment(ctx, prov, &studyOpts.prom, &run, query, baseline, candidate, studyOpts.forceBuild && i == 1)
+		if err != nil {
+			return fmt.Errorf("run %d: %w", i, err)
+		}
+		report.Runs = append(report.Runs, *sr)
+
+		var bs, cs []float64
+		for _, r := range report.Runs {
+			bs = append(bs, r.Baseline)
+			cs = append(cs, r.Candidate)
+		}
+		report.Comparison = compare(bs, cs, studyOpts.alpha, studyOpts.minEffect)
+		report.Conclusive = i >= studyOpts.minRepeats && report.Comparison.Power >= studyOpts.power
+
+		fmt.Printf("Run %d: baseline %g, candidate %g, mean difference %+.2f%%, p=%.3g, power %.2f\n",
+			i, sr.Baseline, sr.Candidate, report.Comparison.MeanDiff*100, report.Comparison.PValue, report.Comparison.Power)
+
+		if report.Conclusive {
+			break
+		}
+	}
+
+	printStudyReport(report)
+
+	if studyOpts.output != "" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encode report: %w", err)
+		}
+		if err := os.WriteFile(studyOpts.output, content, 0o644); err != nil {
+			return fmt.Errorf("write report: %w", err)
+		}
+	}
+	return nil
+}
+
+// studyTargets returns the names of the baseline and candidate targets, defaulting to the first
+// two targets of the experiment.
+func studyTargets(e *exp.Experiment, baseline, candidate string) (string, string, error) {
+	if len(e.Targets) < 2 {
+		return "", "", fmt.Errorf("experiment must have at least two targets to compare")
+	}
+	if baseline == "" {
+		baseline = e.Targets[0].Name
+	}
+	if candidate == "" {
+		candidate = e.Targets[1].Name
+	}
+	if baseline == candidate {
+		return "", "", fmt.Errorf("baseline and candidate must be different targets")
+	}
+	for _, name := range []string{baseline, candidate} {
+		found := false
+		for _, t := range e.Targets {
+			if t.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", "", fmt.Errorf("target %s not found in experiment", name)
+		}
+	}
+	return baseline, candidate, nil
+}
+
+// runStudyExperiment deploys one run of a study, waits for it to complete, measures the
+// baseline and candidate with the prometheus server pc and tears it down.
+func runStudyExperiment(ctx context.Context, prov *infra.Provider, pc *promConfig, e *exp.Experiment, query, baseline, candidate string, forceBuild bool) (sr *studyRun, err error) {
+	if err := prov.Deploy(ctx, e, forceBuild); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if terr := prov.Teardown(ctx, e); terr != nil {
+			slog.Error("failed to tear down run, ironbar will remove it", terr, "experiment", e.Name)
+		}
+	}()
+
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(e.Duration):
+	}
+	end := time.Now()
+
+	// measure over the window dealgood recorded once its start barrier was passed, excluding
+	// the time the run spent starting
+	mw, err := pc.measuredWindow(ctx, e.Name, start, end)
+	if err != nil {
+		slog.Warn("failed to read measured window for run", "experiment", e.Name, "error", err)
+	} else if mw != nil && mw.Start.After(start) && mw.Start.Before(end) {
+		start = mw.Start
+		if !mw.End.IsZero() && mw.End.Before(end) {
+			end = mw.End
+		}
+	}
+
+	window := fmt.Sprintf("%ds", int64(math.Ceil(end.Sub(start).Seconds())))
+	values, err := pc.queryByTarget(ctx, fmt.Sprintf(query, e.Name, window), end)
+	if err != nil {
+		return nil, fmt.Errorf("measure run: %w", err)
+	}
+
+	sr = &studyRun{Experiment: e.Name, Start: start, End: end}
+	var ok bool
+	if sr.Baseline, ok = values[baseline]; !ok {
+		return nil, fmt.Errorf("no measurement found for target %s", baseline)
+	}
+	if sr.Candidate, ok = values[candidate]; !ok {
+		return nil, fmt.Errorf("no measurement found for target %s", candidate)
+	}
+
+	sr.Traffic, err = pc.trafficSummary(ctx, start, end)
+	if err != nil {
+		slog.Warn("failed to read live traffic for run", "experiment", e.Name, "error", err)
+	}
+	sr.Workload, err = pc.workloadSummary(ctx, e.Name, start, end)
+	if err != nil {
+		slog.Warn("failed to read workload profile for run", "experiment", e.Name, "error", err)
+	}
+	return sr, nil
+}
+
+func printStudyReport(r *studyReport) {
+	c := r.Comparison
+	fmt.Println()
+	fmt.Printf("Study of %s: %s vs %s over %d runs\n", r.Experiment, r.Candidate, r.Baseline, len(r.Runs))
+	fmt.Printf("Mean difference : %+.2f%% (%.0f%% CI %+.2f%% to %+.2f%%)\n", c.MeanDiff*100, (1-studyOpts.alpha)*100, c.CILow*100, c.CIHigh*100)
+	fmt.Printf("p-value         : %.3g\n", c.PValue)
+	fmt.Printf("Power           : %.2f\n", c.Power)
+	switch {
+	case !r.Conclusive:
+		fmt.Printf("Target power of %g was not reached after %d runs, the result is inconclusive\n", studyOpts.power, len(r.Runs))
+	case c.PValue < studyOpts.alpha:
+		fmt.Println("The difference is statistically significant")
+	default:
+		fmt.Println("No significant difference was found")
+	}
+	printTrafficVariation(r.Runs)
+	printWorkloadVariation(r.Runs)
+}
+
+// printTrafficVariation lists the live traffic seen by each run and warns if it varied enough
+// between runs, for example with the time of day, to affect the comparison.
+func printTrafficVariation(runs []studyRun) {
+	var lo, hi float64
+	n := 0
+	for _, r := range runs {
+		if r.Traffic == nil || r.Traffic.RequestRate == 0 {
+			continue
+		}
+		if n == 0 || r.Traffic.RequestRate < lo {
+			lo = r.Traffic.RequestRate
+		}
+		if n == 0 || r.Traffic.RequestRate > hi {
+			hi = r.Traffic.RequestRate
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Live traffic during each run:")
+	for i, r := range runs {
+		if r.Traffic == nil {
+			fmt.Printf("  run %d: %s UTC, unknown\n", i+1, r.Start.UTC().Format("2006-01-02 15:04"))
+			continue
+		}
+		fmt.Printf("  run %d: %s UTC, %.1f req/s\n", i+1, r.Start.UTC().Format("2006-01-02 15:04"), r.Traffic.RequestRate)
+	}
+	if n > 1 && (hi-lo)/lo > trafficVariationWarning {
+		fmt.Printf("Warning: live request rate varied by %.0f%% between runs. Targets in the same run see the same traffic, "+
+			"but absolute values differ between runs made at different times of day.\n", (hi-lo)/lo*100)
+	}
+}
+
+// printWorkloadVariation lists the composition of the requests replayed in each run and warns
+// if the popularity or size of the content varied enough between runs to affect the comparison.
+func printWorkloadVariation(runs []studyRun) {
+	var shareLo, shareHi, sizeLo, sizeHi float64
+	n, sized := 0, 0
+	for _, r := range runs {
+		if r.Workload == nil {
+			continue
+		}
+		share := r.Workload.TopShare["10"]
+		if n == 0 || share < shareLo {
+			shareLo = share
+		}
+		if n == 0 || share > shareHi {
+			shareHi = share
+		}
+		n++
+		if size, ok := r.Workload.SizeBytes["0.5"]; ok && size > 0 {
+			if sized == 0 || size < sizeLo {
+				sizeLo = size
+			}
+			if sized == 0 || size > sizeHi {
+				sizeHi = size
+			}
+			sized++
+		}
+	}
+	if n == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Workload replayed in each run:")
+	for i, r := range runs {
+		if r.Workload == nil {
+			fmt.Printf("  run %d: unknown\n", i+1)
+			continue
+		}
+		fmt.Printf("  run %d: %.0f requests, %.0f distinct paths, top 10 paths %.1f%% of requests, median response %.0f bytes\n",
+			i+1, r.Workload.Requests, r.Workload.UniquePaths, r.Workload.TopShare["10"]*100, r.Workload.SizeBytes["0.5"])
+	}
+	if n > 1 && shareHi-shareLo > workloadShareWarning {
+		fmt.Printf("Warning: the share of requests for the 10 most popular paths varied by %.0f points between runs, "+
+			"differences between runs may be due to the content requested rather than the targets.\n", (shareHi-shareLo)*100)
+	}
+	if sized > 1 && (sizeHi-sizeLo)/sizeLo > workloadSizeWarning {
+		fmt.Printf("Warning: median response size varied by %.0f%% between runs, "+
+			"differences between runs may be due to the content requested rather than the targets.\n", (sizeHi-sizeLo)/sizeLo*100)
+	}
+}
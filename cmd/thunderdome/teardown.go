@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"golang.org/x/exp/slog"
 
 	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
 var TeardownCommand = &cli.Command{
@@ -14,7 +18,38 @@ var TeardownCommand = &cli.Command{
 	Usage:     "Teardown an experiment",
 	Action:    Teardown,
 	ArgsUsage: "EXPERIMENT-FILENAME",
-	Flags:     commonFlags,
+	Description: examples(
+		"thunderdome teardown experiment.json",
+		"thunderdome teardown --verify-timeout 10m experiment.json",
+	),
+	BashComplete: completeExperimentFile(),
+	Flags: flags(
+		[]cli.Flag{
+			&cli.DurationFlag{
+				Name:        "verify-timeout",
+				Value:       5 * time.Minute,
+				Usage:       "Maximum time to wait for every resource created by the experiment to be confirmed as deleted.",
+				Destination: &teardownOpts.verifyTimeout,
+			},
+			&cli.BoolFlag{
+				Name:        "force",
+				Aliases:     []string{"f"},
+				Usage:       "Force removal of resources left stuck by dependencies, stopping tasks before their task definitions are deregistered and purging queues before deletion. Every step is attempted even if some fail.",
+				Destination: &teardownOpts.force,
+			},
+			&cli.BoolFlag{
+				Name:        "skip-verify",
+				Usage:       "Skip verifying that every resource created by the experiment has been deleted.",
+				Destination: &teardownOpts.skipVerify,
+			},
+		},
+	),
+}
+
+var teardownOpts struct {
+	verifyTimeout time.Duration
+	force         bool
+	skipVerify    bool
 }
 
 func Teardown(cc *cli.Context) error {
@@ -38,6 +73,57 @@ func Teardown(cc *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	slog.Info("tearing down experiment " + e.Name)
-	return prov.Teardown(ctx, e)
+	var forceErr error
+	if teardownOpts.force {
+		slog.Info("force tearing down experiment " + e.Name)
+		if forceErr = prov.ForceTeardown(ctx, e); forceErr != nil {
+			// the verification report shows what survived the failed steps
+			slog.Error("forced teardown did not complete", forceErr)
+		}
+	} else {
+		slog.Info("tearing down experiment " + e.Name)
+		if err := prov.Teardown(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	if teardownOpts.skipVerify {
+		if forceErr != nil {
+			return forceErr
+		}
+	} else if err := verifyTeardown(ctx, prov, e, teardownOpts.verifyTimeout); err != nil {
+		return err
+	}
+	printName(e.Name)
+	return nil
+}
+
+// verifyTeardown prints a report of every resource created for the experiment and whether
+// it was deleted, returning an error that lists any resources that survived.
+func verifyTeardown(ctx context.Context, prov *infra.Provider, e *exp.Experiment, timeout time.Duration) error {
+	slog.Info("verifying teardown of experiment " + e.Name)
+	results, err := prov.VerifyTeardown(ctx, e, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to verify teardown: %w", err)
+	}
+
+	var survivors []string
+	fmt.Println("Teardown verification:")
+	for _, r := range results {
+		if r.Deleted {
+			fmt.Printf("  deleted   %s\n", r)
+			continue
+		}
+		survivors = append(survivors, r.String())
+		if r.Err != nil {
+			fmt.Printf("  SURVIVED  %s (%v)\n", r, r.Err)
+		} else {
+			fmt.Printf("  SURVIVED  %s\n", r)
+		}
+	}
+
+	if len(survivors) > 0 {
+		return fmt.Errorf("teardown left %d resources that were not deleted: %s", len(survivors), strings.Join(survivors, ", "))
+	}
+	return nil
 }
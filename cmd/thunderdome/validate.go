@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 
 	"github.com/plprobelab/thunderdome/cmd/thunderdome/build"
 	"github.com/plprobelab/thunderdome/cmd/thunderdome/infra"
+	"github.com/plprobelab/thunderdome/pkg/exp"
 )
 
 var ValidateCommand = &cli.Command{
@@ -16,7 +18,11 @@ var ValidateCommand = &cli.Command{
 	Usage:     "Validate an experiment definition",
 	Action:    Validate,
 	ArgsUsage: "EXPERIMENT-FILENAME",
-	Flags:     commonFlags,
+	Description: examples(
+		"thunderdome validate experiment.json",
+	),
+	BashComplete: completeExperimentFile(),
+	Flags:        commonFlags,
 }
 
 func Validate(cc *cli.Context) error {
@@ -47,11 +53,171 @@ func Validate(cc *cli.Context) error {
 	fmt.Printf("Maximum request rate:        %d\n", e.MaxRequestRate)
 	fmt.Printf("Maximum concurrent requests: %d\n", e.MaxConcurrency)
 	fmt.Printf("Request filter:              %s\n", e.RequestFilter)
+	switch e.BodyStrategy {
+	case "":
+		fmt.Printf("Body strategy:               full\n")
+	case "partial":
+		fmt.Printf("Body strategy:               partial, first %d bytes\n", e.BodyReadLimit)
+	default:
+		fmt.Printf("Body strategy:               %s\n", e.BodyStrategy)
+	}
+	if len(e.AcceptEncoding) > 0 {
+		values := make([]string, 0, len(e.AcceptEncoding))
+		total := 0
+		for v, w := range e.AcceptEncoding {
+			values = append(values, v)
+			total += w
+		}
+		sort.Strings(values)
+		fmt.Printf("Accept-Encoding:\n")
+		for _, v := range values {
+			fmt.Printf("  %-26s %.0f%%\n", v, 100*float64(e.AcceptEncoding[v])/float64(total))
+		}
+	}
+	if e.Audit {
+		fmt.Printf("Replay audit:                enabled\n")
+	}
+	if e.Egress != nil {
+		names := make([]string, 0, len(e.Egress.Upstreams))
+		for name := range e.Egress.Upstreams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			fmt.Printf("Egress upstreams:\n")
+			for _, name := range names {
+				fmt.Printf("  %-26s %s\n", name, strings.Join(e.Egress.Upstreams[name], ", "))
+			}
+		}
+		if len(e.Egress.Allow) > 0 {
+			fmt.Printf("Egress allowed:              %s\n", strings.Join(e.Egress.Allow, ", "))
+		}
+		if len(e.Egress.Deny) > 0 {
+			fmt.Printf("Egress denied:               %s\n", strings.Join(e.Egress.Deny, ", "))
+		}
+	}
+	switch e.Cluster {
+	case "":
+		fmt.Printf("Cluster:                     default\n")
+	case exp.ClusterAuto:
+		fmt.Printf("Cluster:                     chosen by ironbar\n")
+	default:
+		fmt.Printf("Cluster:                     %s\n", e.Cluster)
+	}
+	if e.Precision {
+		fmt.Printf("Precision:                   targets should not share hardware\n")
+	}
+	if e.Zones != nil {
+		switch {
+		case e.Zones.Policy == exp.ZonePolicySpread:
+			fmt.Printf("Availability zones:          targets spread across zones\n")
+		case e.Zones.Zone != "":
+			fmt.Printf("Availability zones:          all in %s\n", e.Zones.Zone)
+		default:
+			fmt.Printf("Availability zones:          all in dealgood's zone\n")
+		}
+	}
+	if e.Search != nil {
+		fmt.Printf("Capacity search:             up to %d rps\n", e.MaxRequestRate)
+	}
+	if e.Spikes != nil {
+		fmt.Printf("Spikes:                      %g times the request rate\n", e.Spikes.Multiplier)
+	}
+	if e.Workload != nil {
+		fmt.Printf("Workload:                    %s\n", e.Workload.Preset)
+	}
+	if e.Hermetic {
+		fmt.Printf("Hermetic:                    targets isolated with the providers in a private network\n")
+	}
+	if e.PrivateNetworking {
+		fmt.Printf("Private networking:          no public IP addresses, AWS reached through vpc endpoints\n")
+	}
+	for _, p := range e.Providers {
+		fmt.Printf("Content provider:            %s (%s, %d items)\n", p.Name, p.Kind, p.ContentCount)
+	}
+	if e.Conformance != nil {
+		fmt.Printf("Conformance:                 %s, %s\n", strings.Join(e.Conformance.Phases, " and "), e.Conformance.Image)
+	}
+	if e.Soak != nil {
+		fmt.Printf("Soak:                        latency drift measured over %s intervals\n", durationDesc(e.Soak.Interval))
+	}
+	for _, seg := range e.Segments {
+		length := "until the end"
+		if seg.Duration > 0 {
+			length = durationDesc(seg.Duration)
+		}
+		if seg.Settle > 0 {
+			length += ", first " + durationDesc(seg.Settle) + " left out"
+		}
+		fmt.Printf("Segment %-20s %s\n", seg.Name+":", length)
+		for _, call := range seg.AdminCalls {
+			to := "all targets with an admin port"
+			if len(call.Targets) > 0 {
+				to = strings.Join(call.Targets, ", ")
+			}
+			fmt.Printf("                             %s %s to %s\n", call.Method, call.Path, to)
+		}
+	}
+	if sd := e.Shutdown; sd != nil {
+		fmt.Printf("Shutdown:                    drain %s, final scrape %s\n", durationDesc(sd.DrainTimeout), durationDesc(sd.FinalScrapeTimeout))
+		for _, stage := range []string{exp.ShutdownStageSource, exp.ShutdownStageDealgood, exp.ShutdownStageTargets} {
+			if t, ok := sd.StageTimeouts[stage]; ok {
+				fmt.Printf("Shutdown %-20s %s\n", stage+" timeout:", durationDesc(t))
+			}
+		}
+	}
+	if e.Transport == "" {
+		fmt.Printf("Transport:                   sqs\n")
+	} else {
+		fmt.Printf("Transport:                   %s\n", e.Transport)
+	}
+	if r := e.Replay; r != nil {
+		if r.StartSequence > 0 {
+			fmt.Printf("Replay:                      from stream sequence %d\n", r.StartSequence)
+		} else {
+			fmt.Printf("Replay:                      from %s\n", r.StartTime.UTC().Format(time.RFC3339))
+		}
+	}
 
 	for _, t := range e.Targets {
 		fmt.Println()
 		fmt.Printf("Target %q\n", t.Name)
-		fmt.Printf("  Instance type: %s\n", t.InstanceType)
+		if t.Shadow {
+			fmt.Println("  Shadow: receives requests but is left out of comparisons")
+		}
+		if t.SubdomainGateway != "" {
+			fmt.Printf("  Subdomain gateway: %s\n", t.SubdomainGateway)
+		}
+		if t.MaxInFlight > 0 {
+			fmt.Printf("  Max in flight: %d, further requests are queued\n", t.MaxInFlight)
+		}
+		if len(t.RequestHeaders) > 0 {
+			fmt.Println("  Request headers:")
+			for k := range t.RequestHeaders {
+				fmt.Printf("    %s: <redacted>\n", k)
+			}
+		}
+		if t.IsRemote() {
+			fmt.Printf("  Remote URL:    %s\n", t.URL)
+			continue
+		}
+		if t.EC2 != nil {
+			fmt.Printf("  Instance type: %s, on an ec2 instance of its own\n", t.EC2.InstanceType)
+			if t.EC2.PlacementGroup != "" {
+				fmt.Printf("  Placement:     %s placement group\n", t.EC2.PlacementGroup)
+			}
+			if t.EC2.Tenancy != "" {
+				fmt.Printf("  Tenancy:       %s\n", t.EC2.Tenancy)
+			}
+			if t.EC2.EnaExpress {
+				fmt.Println("  ENA Express:   enabled")
+			}
+			if t.EC2.InstanceStorage {
+				fmt.Println("  Data volumes:  NVMe instance storage")
+			}
+		} else {
+			fmt.Printf("  Instance type: %s\n", t.InstanceType)
+		}
 
 		if t.Image != "" {
 			fmt.Printf("  Image:         %s\n", t.Image)
@@ -95,6 +261,14 @@ func Validate(cc *cli.Context) error {
 		}
 	}
 
+	if warnings := LintExperiment(e); len(warnings) > 0 {
+		fmt.Println()
+		fmt.Println("Warnings:")
+		for _, w := range warnings {
+			fmt.Printf("  %s\n", w)
+		}
+	}
+
 	return nil
 }
 
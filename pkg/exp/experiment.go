@@ -7,24 +7,379 @@ import (
 	"time"
 )
 
+// ClusterAuto is the cluster name that asks ironbar to choose the cluster targets are placed in.
+const ClusterAuto = "auto"
+
 type Experiment struct {
 	Name        string
 	Description string
 
+	// Purpose and Ticket record why the experiment is being run and the issue or pull request
+	// it is for. They are added to the tags of every resource created for the experiment.
+	Purpose string
+	Ticket  string
+
+	// Labels are arbitrary key value pairs used to find related experiments in listings.
+	Labels map[string]string
+
 	Duration       time.Duration
 	MaxRequestRate int
 	MaxConcurrency int
 	RequestFilter  string
 
+	// BodyStrategy controls how much of each response body dealgood reads, one of
+	// "full", "discard", "hash" or "partial". BodyReadLimit is the maximum number
+	// of bytes read by the partial strategy.
+	BodyStrategy  string
+	BodyReadLimit int64
+
+	// AcceptEncoding maps Accept-Encoding values to relative weights. When set, dealgood sends
+	// each request to every target with a value chosen by weight instead of the original
+	// client's, and records response sizes by content encoding.
+	AcceptEncoding map[string]int
+
+	// Audit records what happened to each request for every target, so that the share of the
+	// workload each target answered can be compared rather than assumed to be equal.
+	Audit bool
+
+	// Egress routes the HTTP traffic of deployed targets through a proxy sidecar that counts
+	// requests to shared upstreams, such as bootstrap nodes or other gateways, so that results
+	// can be weighed against how hard each target leaned on infrastructure it does not own. It
+	// also keeps candidate builds from talking to services they should not. Nil when targets
+	// connect directly.
+	Egress *EgressSpec
+
+	// Cluster is the name of the ecs cluster targets are placed in. Empty uses the default
+	// cluster and "auto" lets ironbar place the experiment in whichever cluster offering all
+	// of its instance types has the most room.
+	Cluster string
+
+	// Transport is how requests are delivered to dealgood, one of "sqs", "kinesis" or "nats".
+	// An empty value uses sqs.
+	Transport string
+
+	// Replay starts the experiment from requests already in the nats stream rather than those
+	// published once it is deployed. Only used with the nats transport.
+	Replay *ReplaySpec
+
+	// Priority is how urgently the experiment should be admitted by ironbar, one of "low",
+	// "normal" or "urgent". Preemptible experiments may be stopped early to make room for
+	// experiments of higher priority.
+	Priority    string
+	Preemptible bool
+
+	// NoiseBaseline marks an A/A experiment whose targets run the same image on the same
+	// instance type. ironbar uses the differences measured between them as an estimate of
+	// the run-to-run noise of the environment.
+	NoiseBaseline bool
+
+	// Precision marks a latency-sensitive comparison whose targets should not share hardware
+	// with other tenants, so that differences between them are not lost in noisy-neighbor
+	// variance. Definitions are linted for targets that would run on shared tenancy.
+	Precision bool
+
+	// Zones places deployed targets and dealgood by availability zone. Nil leaves placement to
+	// ecs, which may put targets in different zones from each other and from dealgood.
+	Zones *ZoneSpec
+
+	// Search turns the experiment into a search for the highest request rate each target can
+	// sustain within an SLO, with MaxRequestRate the highest rate tried. Nil for an experiment
+	// that sends every target the same requests.
+	Search *SearchSpec
+
+	// Spikes multiplies the request rate for short periods at regular intervals so that the
+	// time each target takes to recover from a spike can be scored. Nil for an experiment that
+	// runs at a steady rate.
+	Spikes *SpikeSpec
+
+	// Soak marks a long-running experiment at a moderate rate whose targets are compared by
+	// their stability rather than their latency. ironbar reports each target's memory and
+	// goroutine growth, restarts and latency drift when it completes. Nil for other experiments.
+	Soak *SoakSpec
+
+	// Segments divide the measured period of the experiment into consecutive segments whose
+	// results ironbar reports on their own as well as over the whole experiment, so that
+	// configurations applied at runtime can be compared without redeploying the targets. Empty
+	// for an experiment measured as a whole.
+	Segments []*SegmentSpec
+
+	// Workload replaces the requests taken from the shared request stream with a generated
+	// workload. Nil for an experiment that replays gateway traffic.
+	Workload *WorkloadSpec
+
+	// Providers are content provider nodes run alongside the experiment, each seeded with a
+	// corpus of generated content, so that targets have a controlled source to retrieve from.
+	// Deployed targets are peered with every provider.
+	Providers []*ProviderSpec
+
+	// Hermetic isolates deployed targets and content providers from the public IPFS network
+	// in a private network of their own, so that retrieval depends only on the providers and
+	// experiments can be reproduced.
+	Hermetic bool
+
+	// PrivateNetworking runs the experiment's tasks and instances in the vpc's private subnets
+	// without public IP addresses. AWS services are reached through vpc endpoints, which are
+	// created if the vpc does not have them, rather than through a NAT gateway.
+	PrivateNetworking bool
+
+	// KmsKeyArn is the customer managed KMS key that the experiment's request queue,
+	// checkpoint table and crash dumps are encrypted with. The key configured for the base
+	// infrastructure, if any, is used when empty.
+	KmsKeyArn string
+
+	// Conformance runs the gateway conformance test suite against every target so that
+	// performance gains that break the gateway specifications are reported with the results.
+	// Nil for an experiment whose targets are not tested.
+	Conformance *ConformanceSpec
+
+	// Analyses are run by ironbar once the experiment completes.
+	Analyses []*AnalysisSpec
+
+	// Shutdown configures how long each stage of the experiment's shutdown may take. Nil uses
+	// the defaults of dealgood and ironbar.
+	Shutdown *ShutdownSpec
+
 	Targets []*TargetSpec
 }
 
+// An EgressSpec configures the egress proxy sidecar run alongside each deployed target.
+type EgressSpec struct {
+	// Upstreams maps the name of each shared upstream to the hosts that belong to it. A
+	// leading *. in a host matches any subdomain. Requests to other hosts are counted as other.
+	Upstreams map[string][]string
+
+	// Allow lists the hosts targets may connect to. When empty every host not denied is
+	// permitted. Deny lists hosts that are refused even if allowed. Hosts may have a leading *.
+	Allow []string
+	Deny  []string
+}
+
+// Availability zone policies a ZoneSpec may ask for.
+const (
+	ZonePolicySame   = "same"   // every deployed target in dealgood's zone
+	ZonePolicySpread = "spread" // targets spread evenly across the zones of the vpc
+)
+
+// A ZoneSpec controls the availability zones deployed targets and dealgood run in, since
+// latency between zones is enough to distort a comparison of targets placed unevenly.
+type ZoneSpec struct {
+	Policy string // one of the ZonePolicy constants
+
+	// Zone is the availability zone used by the same policy. Empty uses the zone of the
+	// default subnet. Dealgood always runs in this zone.
+	Zone string
+}
+
+// A SearchSpec configures dealgood's capacity search. Zero values use dealgood's defaults.
+type SearchSpec struct {
+	StartRate     float64       // request rate of the first step
+	Step          time.Duration // time spent at each rate
+	MaxP99        time.Duration // highest 99th percentile time to first byte within the SLO
+	MaxErrorRatio float64       // highest share of failed requests within the SLO
+	Precision     float64       // the search ends when the failing rate is within this fraction of the sustained rate
+}
+
+// A SpikeSpec configures the traffic spikes sent by dealgood. Zero values other than the
+// multiplier use dealgood's defaults.
+type SpikeSpec struct {
+	Multiplier float64       // request rate during a spike as a multiple of MaxRequestRate
+	Duration   time.Duration // length of each spike
+	Interval   time.Duration // time between the starts of successive spikes
+	Tolerance  float64       // a target has recovered once its p99 is within this fraction of its p99 before the spike
+}
+
+// A SoakSpec configures the stability report of a soak experiment.
+type SoakSpec struct {
+	// Interval is the period over which latency is summarised when measuring its drift, so
+	// that short bursts of slow requests are not mistaken for a trend.
+	Interval time.Duration
+}
+
+// A SegmentSpec is one of the consecutive segments an experiment's measured period is divided
+// into.
+type SegmentSpec struct {
+	Name string
+
+	// Duration is how long the segment lasts. Zero for a last segment that lasts until the
+	// experiment ends.
+	Duration time.Duration
+
+	// Settle is the time at the start of the segment left out of its results while targets
+	// adjust to the change of segment.
+	Settle time.Duration
+
+	// AdminCalls are sent by ironbar to the admin api of targets as the segment starts, to
+	// change their configuration while they run.
+	AdminCalls []*AdminCallSpec
+}
+
+// An AdminCallSpec is a request ironbar sends to the admin api of targets, such as a call to
+// kubo's rpc api that changes a setting of the running node.
+type AdminCallSpec struct {
+	Method string // http method, POST if empty
+	Path   string // path and query of the request
+	Body   string // sent as json if not empty
+
+	// Targets are the names of the targets the call is sent to. Every target with an admin
+	// port is called if empty.
+	Targets []string
+}
+
+// Stages of an experiment's shutdown, in the order they run. Each stage starts once the
+// resources of the previous one have stopped or its timeout has passed.
+const (
+	ShutdownStageSource   = "source"   // stop delivering requests to dealgood
+	ShutdownStageDealgood = "dealgood" // stop dealgood, which drains requests in flight and waits for a final scrape
+	ShutdownStageTargets  = "targets"  // stop the targets and other tasks of the experiment
+	ShutdownStageInfra    = "infra"    // delete the queues, tables and task definitions left behind
+)
+
+// A ShutdownSpec configures the timeouts of an experiment's shutdown.
+type ShutdownSpec struct {
+	// DrainTimeout is how long dealgood waits for requests already sent to targets to finish
+	// once it is stopped, after which they are abandoned.
+	DrainTimeout time.Duration
+
+	// FinalScrapeTimeout is how long dealgood then waits for Prometheus to scrape its final
+	// metrics before exiting.
+	FinalScrapeTimeout time.Duration
+
+	// StageTimeouts is how long ironbar waits for the resources of each stage, keyed by the
+	// ShutdownStage constants, to stop before moving on to the next stage. Stages that are not
+	// listed use ironbar's defaults. The infra stage has no timeout since it is the last.
+	StageTimeouts map[string]time.Duration
+}
+
+// Workload presets a WorkloadSpec may ask for.
+const (
+	// WorkloadPresetCold requests content freshly added to a companion seeder node, each CID
+	// once, so that targets retrieve it from the network rather than serving it from a cache.
+	WorkloadPresetCold = "cold"
+
+	// WorkloadPresetCorpus requests content chosen at random from the corpora of the
+	// experiment's content providers.
+	WorkloadPresetCorpus = "corpus"
+)
+
+// ReplaySpec is where in the request stream dealgood starts reading. Exactly one field is set.
+type ReplaySpec struct {
+	StartSequence uint64    // stream sequence number of the first request
+	StartTime     time.Time // time the first request was published at or after
+}
+
+// A WorkloadSpec configures a generated workload.
+type WorkloadSpec struct {
+	Preset      string // one of the WorkloadPreset constants
+	ContentSize int    // size in bytes of each item of generated content, zero for the default
+}
+
+// Kinds of content provider a ProviderSpec may ask for.
+const (
+	ProviderKindKubo    = "kubo"    // a kubo node that announces its content to the DHT
+	ProviderKindBitswap = "bitswap" // a node that only serves its content over bitswap to peers connected to it
+)
+
+// A ProviderSpec describes a content provider node run alongside the experiment.
+type ProviderSpec struct {
+	Name         string
+	Kind         string // one of the ProviderKind constants
+	ContentCount int    // number of items of content in the provider's corpus
+	ContentSize  int    // size in bytes of each item of content, zero for the default
+}
+
+// An AnalysisSpec describes a container that ironbar runs once an experiment completes. The
+// last line it writes that is a JSON object or array is recorded as the analysis output.
+// Phases of an experiment in which ironbar runs the gateway conformance tests.
+const (
+	ConformancePhasePre  = "pre"  // once all of the experiment's tasks are running
+	ConformancePhasePost = "post" // once the experiment is due to end, before its targets are stopped
+)
+
+// A ConformanceSpec describes the gateway conformance tests ironbar runs against each target.
+type ConformanceSpec struct {
+	Phases  []string      // one or both of the ConformancePhase constants
+	Image   string        // gateway-conformance docker image, which also provides the test fixtures
+	Specs   []string      // specs to test, empty for those the suite tests by default
+	Timeout time.Duration // zero uses ironbar's default
+}
+
+type AnalysisSpec struct {
+	Name        string
+	Image       string
+	Environment map[string]string
+	Timeout     time.Duration // zero uses ironbar's default
+}
+
 type TargetSpec struct {
 	Name         string
+	URL          string // base URL of a remote target that is already running and is not deployed by thunderdome
 	Image        string
 	ImageSpec    *ImageSpec
 	InstanceType string
 	Environment  map[string]string
+
+	// RequestHeaders are added to every request sent to the target, replacing any
+	// header with the same name in the original request.
+	RequestHeaders map[string]string
+
+	// SubdomainGateway is the domain the target serves as a subdomain gateway. When set,
+	// path requests are rewritten into subdomain form before being sent to the target.
+	SubdomainGateway string
+
+	// DebugPort is the port the target serves pprof profiles on under /debug/pprof. When set,
+	// ironbar captures profiles periodically and keeps the last ones taken before a crash.
+	DebugPort int
+
+	// AdminPort is the port the target serves its admin api on, such as 5001 for kubo's rpc
+	// api. ironbar sends the admin calls of segments to it. Zero if the target has none.
+	AdminPort int
+
+	// Shadow marks a target that receives the experiment's requests like the others but is left
+	// out of the comparison of their results, such as an unstable build tried alongside an A/B
+	// comparison. Its recorded metrics are labelled shadow="true".
+	Shadow bool
+
+	// MaxInFlight limits the number of requests dealgood has in flight to the target, emulating
+	// the connection cap of a load balancer. Requests wait in a queue while the target is at
+	// its limit. Zero means the experiment's MaxConcurrency applies.
+	MaxInFlight int
+
+	// EC2 runs the target on an ec2 instance launched for it alone instead of one started by
+	// the capacity provider named by InstanceType, for targets that need control over the
+	// instance. InstanceType is empty when it is set.
+	EC2 *EC2Spec
+}
+
+// Placement group strategies an EC2Spec may ask for.
+const (
+	PlacementCluster   = "cluster"
+	PlacementSpread    = "spread"
+	PlacementPartition = "partition"
+)
+
+// An EC2Spec describes the ec2 instance launched for a target that runs on an instance of its own.
+type EC2Spec struct {
+	InstanceType string // any ec2 instance type, such as c6in.8xlarge
+
+	// PlacementGroup is the strategy of the placement group the instance is launched in, one
+	// of "cluster", "spread" or "partition". The experiment's instances that ask for the same
+	// strategy share a group. Empty launches the instance outside any placement group.
+	PlacementGroup string
+
+	// Tenancy is "dedicated" to launch the instance on hardware dedicated to the account, or
+	// empty to share hardware with other accounts.
+	Tenancy string
+
+	EnaExpress      bool // enable ENA Express on the instance's network interface
+	InstanceStorage bool // keep the target's data volumes on the instance's NVMe instance storage
+}
+
+// TenancyDedicated is the tenancy of an instance running on hardware dedicated to the account.
+const TenancyDedicated = "dedicated"
+
+// IsRemote reports whether the target is an already running gateway that is not deployed by thunderdome.
+func (t *TargetSpec) IsRemote() bool {
+	return t.URL != ""
 }
 
 type ImageSpec struct {
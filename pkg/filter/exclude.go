@@ -0,0 +1,156 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/plprobelab/thunderdome/pkg/request"
+)
+
+// Exclusions describes requests that must never be replayed, such as abusive
+// traffic or internal health checks.
+type Exclusions struct {
+	AllowHosts   []string // when not empty only requests for these hostnames are allowed, a leading "*." also matches any subdomain
+	Hosts        []string // hostnames to exclude, a leading "*." also matches any subdomain
+	PathPrefixes []string // request paths starting with any of these are excluded
+	UserAgents   []string // user agents containing any of these (case insensitive) are excluded
+}
+
+// Empty reports whether there are no exclusions defined.
+func (e *Exclusions) Empty() bool {
+	return len(e.AllowHosts) == 0 && len(e.Hosts) == 0 && len(e.PathPrefixes) == 0 && len(e.UserAgents) == 0
+}
+
+// Excluded reports whether the request matches any exclusion rule.
+func (e *Exclusions) Excluded(req *request.Request) bool {
+	if len(e.AllowHosts) > 0 || len(e.Hosts) > 0 {
+		host := hostOf(req)
+		if len(e.AllowHosts) > 0 {
+			allowed := false
+			for _, h := range e.AllowHosts {
+				if matchHost(h, host) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return true
+			}
+		}
+		for _, h := range e.Hosts {
+			if matchHost(h, host) {
+				return true
+			}
+		}
+	}
+
+	for _, p := range e.PathPrefixes {
+		if strings.HasPrefix(req.URI, p) {
+			return true
+		}
+	}
+
+	if len(e.UserAgents) > 0 && req.UserAgent != "" {
+		ua := strings.ToLower(req.UserAgent)
+		for _, a := range e.UserAgents {
+			if strings.Contains(ua, strings.ToLower(a)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Filter returns a RequestFilter that only allows requests that are not excluded to pass.
+func (e *Exclusions) Filter() RequestFilter {
+	return func(req *request.Request) bool {
+		return !e.Excluded(req)
+	}
+}
+
+// ReadExclusionsFile reads exclusion rules from the named file. See ParseExclusions for the format.
+func ReadExclusionsFile(fname string) (*Exclusions, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	return ParseExclusions(f)
+}
+
+// ParseExclusions parses exclusion rules in a robots.txt style format. Each line
+// consists of a rule type and a value separated by a colon. Blank lines and lines
+// starting with # are ignored. For example:
+//
+//	# internal health checks
+//	user-agent: kube-probe
+//	allow-host: *.ipfs.io
+//	host: *.internal.example.com
+//	disallow: /ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi
+func ParseExclusions(r io.Reader) (*Exclusions, error) {
+	e := new(Exclusions)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected rule in the form 'type: value'", lineno)
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil, fmt.Errorf("line %d: missing value", lineno)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "allow-host":
+			e.AllowHosts = append(e.AllowHosts, strings.ToLower(value))
+		case "host":
+			e.Hosts = append(e.Hosts, strings.ToLower(value))
+		case "disallow", "path":
+			e.PathPrefixes = append(e.PathPrefixes, value)
+		case "user-agent":
+			e.UserAgents = append(e.UserAgents, value)
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule type %q", lineno, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	return e, nil
+}
+
+// hostOf returns the lowercased hostname the request was originally sent to, without any port.
+func hostOf(req *request.Request) string {
+	for k, v := range req.Header {
+		if strings.EqualFold(k, "Host") {
+			host := strings.ToLower(v)
+			if p := strings.LastIndex(host, ":"); p != -1 && !strings.HasSuffix(host, "]") {
+				host = host[:p]
+			}
+			return host
+		}
+	}
+	return ""
+}
+
+func matchHost(pattern, host string) bool {
+	if host == "" {
+		return false
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return host == pattern[2:] || strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
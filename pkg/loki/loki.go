@@ -57,6 +57,7 @@ type LogLine struct {
 	Method     string            `json:"method"`
 	URI        string            `json:"uri"`
 	Status     int               `json:"status"`
+	BodyBytes  int64             `json:"bytes"` // size of the response body, if logged
 	Headers    map[string]string `json:"headers"`
 	RemoteAddr string            `json:"addr"`
 	UserAgent  string            `json:"agent"`
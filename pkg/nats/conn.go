@@ -0,0 +1,563 @@
+// Package nats is a minimal client for the NATS protocol and the JetStream API, sufficient for
+// publishing requests to a stream and reading them back with a durable pull consumer.
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPort is the port of a NATS server when the url does not include one.
+	DefaultPort = "4222"
+
+	// DefaultMaxPayload is the largest message a server accepts when it does not say otherwise.
+	DefaultMaxPayload = 1024 * 1024
+
+	headerLine = "NATS/1.0"
+)
+
+var (
+	// ErrClosed is returned by operations on a connection that has been closed, by Close or
+	// because the server went away.
+	ErrClosed = errors.New("nats: connection closed")
+
+	// ErrNoResponders is returned by Request when nothing is subscribed to the subject, which
+	// for a JetStream publish means that no stream captures it.
+	ErrNoResponders = errors.New("nats: no responders")
+)
+
+// Header holds the headers of a message.
+type Header = textproto.MIMEHeader
+
+// A Msg is a message received on a subscription. Status is set for the control messages the
+// server sends in place of a reply, such as 503 when there are no responders or 408 when a
+// pull request expires.
+type Msg struct {
+	Subject     string
+	Reply       string
+	Header      Header
+	Data        []byte
+	Status      int
+	Description string
+
+	conn *Conn
+}
+
+// Respond publishes data to the message's reply subject.
+func (m *Msg) Respond(data []byte) error {
+	if m.Reply == "" {
+		return fmt.Errorf("nats: message has no reply subject")
+	}
+	return m.conn.Publish(m.Reply, nil, data)
+}
+
+type serverInfo struct {
+	ServerID     string `json:"server_id"`
+	Version      string `json:"version"`
+	MaxPayload   int    `json:"max_payload"`
+	Headers      bool   `json:"headers"`
+	TLSRequired  bool   `json:"tls_required"`
+	AuthRequired bool   `json:"auth_required"`
+}
+
+type connectInfo struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name,omitempty"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+	User         string `json:"user,omitempty"`
+	Pass         string `json:"pass,omitempty"`
+	AuthToken    string `json:"auth_token,omitempty"`
+}
+
+// A Conn is a connection to a NATS server. It is safe for concurrent use.
+type Conn struct {
+	nc   net.Conn
+	info serverInfo
+
+	wmu sync.Mutex // guards writes to bw
+	bw  *bufio.Writer
+
+	mu      sync.Mutex // guards following fields
+	subs    map[int64]*Subscription
+	nextSid int64
+	pongs   []chan struct{}
+	err     error
+	closed  bool
+	done    chan struct{}
+}
+
+// Dial connects to the server at rawurl, such as nats://localhost:4222. Credentials are taken
+// from the url's user info, a user without a password being used as a token. A tls:// url, or
+// a server that requires it, is connected to with TLS. name identifies the client to the server.
+func Dial(ctx context.Context, rawurl string, name string) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("nats: parse url: %w", err)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return nil, fmt.Errorf("nats: unsupported url scheme %q, expected nats or tls", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("nats: dial: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+
+	br := bufio.NewReader(nc)
+	line, err := readLine(br)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: read server info: %w", err)
+	}
+	op, args, _ := strings.Cut(line, " ")
+	if !strings.EqualFold(op, "INFO") {
+		nc.Close()
+		return nil, fmt.Errorf("nats: expected INFO from server, got %q", line)
+	}
+	var info serverInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: decode server info: %w", err)
+	}
+	if !info.Headers {
+		nc.Close()
+		return nil, fmt.Errorf("nats: server %s does not support headers", info.Version)
+	}
+	if info.MaxPayload == 0 {
+		info.MaxPayload = DefaultMaxPayload
+	}
+
+	useTLS := u.Scheme == "tls" || info.TLSRequired
+	if useTLS {
+		tc := tls.Client(nc, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats: tls handshake: %w", err)
+		}
+		nc = tc
+		br = bufio.NewReader(nc)
+	}
+
+	ci := connectInfo{
+		TLSRequired:  useTLS,
+		Name:         name,
+		Lang:         "go",
+		Version:      "thunderdome",
+		Protocol:     1,
+		Headers:      true,
+		NoResponders: true,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			ci.User = u.User.Username()
+			ci.Pass = pass
+		} else {
+			ci.AuthToken = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(ci)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: encode connect: %w", err)
+	}
+
+	// the server answers the ping with an error rather than a pong if it rejects the connect
+	if _, err := fmt.Fprintf(nc, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: connect: %w", err)
+	}
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats: connect: %w", err)
+		}
+		if strings.EqualFold(line, "PONG") {
+			break
+		}
+		if strings.HasPrefix(strings.ToUpper(line), "-ERR") {
+			nc.Close()
+			return nil, fmt.Errorf("nats: connect: %s", serverError(line))
+		}
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := &Conn{
+		nc:   nc,
+		info: info,
+		bw:   bufio.NewWriterSize(nc, 32*1024),
+		subs: make(map[int64]*Subscription),
+		done: make(chan struct{}),
+	}
+	go c.readLoop(br)
+	return c, nil
+}
+
+// MaxPayload returns the size of the largest message the server accepts, including headers.
+func (c *Conn) MaxPayload() int {
+	return c.info.MaxPayload
+}
+
+// ServerVersion returns the version of the server the connection is to.
+func (c *Conn) ServerVersion() string {
+	return c.info.Version
+}
+
+// Err returns the error that closed the connection, or nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Done returns a channel that is closed when the connection closes.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes the connection and every subscription.
+func (c *Conn) Close() error {
+	c.closeWithErr(ErrClosed)
+	return nil
+}
+
+func (c *Conn) closeWithErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	c.nc.Close()
+	for _, p := range c.pongs {
+		close(p)
+	}
+	c.pongs = nil
+	close(c.done)
+}
+
+// write sends a protocol line, followed by a payload if one is given, and flushes it.
+func (c *Conn) write(line string, payload ...[]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.bw.WriteString(line)
+	c.bw.WriteString("\r\n")
+	if len(payload) > 0 {
+		for _, p := range payload {
+			c.bw.Write(p)
+		}
+		c.bw.WriteString("\r\n")
+	}
+	if err := c.bw.Flush(); err != nil {
+		c.closeWithErr(fmt.Errorf("nats: write: %w", err))
+		return c.Err()
+	}
+	return nil
+}
+
+// Publish sends a message to subject, with headers if hdr is not empty.
+func (c *Conn) Publish(subject string, hdr Header, data []byte) error {
+	return c.publish(subject, "", hdr, data)
+}
+
+func (c *Conn) publish(subject, reply string, hdr Header, data []byte) error {
+	var hdrData []byte
+	if len(hdr) > 0 {
+		hdrData = encodeHeader(hdr)
+	}
+	if len(hdrData)+len(data) > c.info.MaxPayload {
+		return fmt.Errorf("nats: message of %d bytes exceeds the server's maximum payload of %d bytes", len(hdrData)+len(data), c.info.MaxPayload)
+	}
+	subj := subject
+	if reply != "" {
+		subj += " " + reply
+	}
+	if hdrData == nil {
+		return c.write(fmt.Sprintf("PUB %s %d", subj, len(data)), data)
+	}
+	return c.write(fmt.Sprintf("HPUB %s %d %d", subj, len(hdrData), len(hdrData)+len(data)), hdrData, data)
+}
+
+// A Subscription receives the messages published to a subject on its channel. Nothing more is
+// sent on the channel once the subscription or its connection is done.
+type Subscription struct {
+	C <-chan *Msg
+
+	ch   chan *Msg
+	done chan struct{}
+	conn *Conn
+	sid  int64
+}
+
+// Subscribe subscribes to subject, buffering up to size messages. The connection stops reading
+// from the server while the buffer is full, so messages must be received promptly.
+func (c *Conn) Subscribe(subject string, size int) (*Subscription, error) {
+	ch := make(chan *Msg, size)
+	s := &Subscription{C: ch, ch: ch, done: make(chan struct{}), conn: c}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.nextSid++
+	s.sid = c.nextSid
+	c.subs[s.sid] = s
+	c.mu.Unlock()
+
+	if err := c.write(fmt.Sprintf("SUB %s %d", subject, s.sid)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Unsubscribe stops the subscription.
+func (s *Subscription) Unsubscribe() error {
+	s.conn.mu.Lock()
+	_, ok := s.conn.subs[s.sid]
+	if ok {
+		delete(s.conn.subs, s.sid)
+		close(s.done)
+	}
+	s.conn.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.conn.write(fmt.Sprintf("UNSUB %d", s.sid))
+}
+
+// NewInbox returns a unique subject for receiving replies.
+func NewInbox() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "_INBOX." + hex.EncodeToString(b[:])
+}
+
+// Request publishes data to subject and waits for the first reply.
+func (c *Conn) Request(ctx context.Context, subject string, hdr Header, data []byte) (*Msg, error) {
+	inbox := NewInbox()
+	sub, err := c.Subscribe(inbox, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	if err := c.publish(subject, inbox, hdr, data); err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, c.Err()
+	case msg := <-sub.C:
+		if msg.Status == 503 {
+			return nil, ErrNoResponders
+		}
+		return msg, nil
+	}
+}
+
+// Flush waits until the server has processed everything sent on the connection.
+func (c *Conn) Flush(ctx context.Context) error {
+	pong := make(chan struct{})
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.pongs = append(c.pongs, pong)
+	c.mu.Unlock()
+
+	if err := c.write("PING"); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pong:
+		return c.Err()
+	}
+}
+
+func (c *Conn) readLoop(br *bufio.Reader) {
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			c.closeWithErr(fmt.Errorf("nats: read: %w", err))
+			return
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "MSG", "HMSG":
+			msg, sid, err := c.readMsg(br, strings.EqualFold(op, "HMSG"), strings.Fields(args))
+			if err != nil {
+				c.closeWithErr(err)
+				return
+			}
+			c.deliver(sid, msg)
+		case "PING":
+			c.write("PONG")
+		case "PONG":
+			c.mu.Lock()
+			if len(c.pongs) > 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.mu.Unlock()
+		case "-ERR":
+			// errors about a single operation, such as a permissions violation, leave the
+			// connection open but every other error is followed by the server closing it
+			if strings.Contains(strings.ToLower(args), "permissions violation") {
+				continue
+			}
+			c.closeWithErr(fmt.Errorf("nats: %s", serverError(line)))
+			return
+		case "INFO", "+OK":
+		}
+	}
+}
+
+// readMsg reads the payload of a MSG or HMSG whose arguments are args.
+func (c *Conn) readMsg(br *bufio.Reader, hasHeader bool, args []string) (*Msg, int64, error) {
+	want := 3
+	if hasHeader {
+		want = 4
+	}
+	if len(args) != want && len(args) != want+1 {
+		return nil, 0, fmt.Errorf("nats: malformed message arguments %q", strings.Join(args, " "))
+	}
+	msg := &Msg{Subject: args[0], conn: c}
+	sid, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("nats: malformed subscription id: %w", err)
+	}
+	sizes := args[2:]
+	if len(args) == want+1 {
+		msg.Reply = args[2]
+		sizes = args[3:]
+	}
+	total, err := strconv.Atoi(sizes[len(sizes)-1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("nats: malformed message size: %w", err)
+	}
+	hdrSize := 0
+	if hasHeader {
+		if hdrSize, err = strconv.Atoi(sizes[0]); err != nil || hdrSize > total {
+			return nil, 0, fmt.Errorf("nats: malformed header size %q", sizes[0])
+		}
+	}
+
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, 0, fmt.Errorf("nats: read message: %w", err)
+	}
+	if hasHeader {
+		if err := msg.decodeHeader(buf[:hdrSize]); err != nil {
+			return nil, 0, err
+		}
+	}
+	msg.Data = buf[hdrSize:total]
+	return msg, sid, nil
+}
+
+func (c *Conn) deliver(sid int64, msg *Msg) {
+	c.mu.Lock()
+	s, ok := c.subs[sid]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case s.ch <- msg:
+	case <-s.done:
+	case <-c.done:
+	}
+}
+
+func encodeHeader(hdr Header) []byte {
+	var b bytes.Buffer
+	b.WriteString(headerLine + "\r\n")
+	for k, vs := range hdr {
+		for _, v := range vs {
+			b.WriteString(k)
+			b.WriteString(": ")
+			b.WriteString(v)
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// decodeHeader parses a header block, which starts with a version line optionally followed by
+// a status code and description.
+func (m *Msg) decodeHeader(data []byte) error {
+	first, rest, _ := bytes.Cut(data, []byte("\r\n"))
+	if !bytes.HasPrefix(first, []byte(headerLine)) {
+		return fmt.Errorf("nats: malformed header version %q", first)
+	}
+	if status := strings.TrimSpace(string(first[len(headerLine):])); status != "" {
+		code, desc, _ := strings.Cut(status, " ")
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("nats: malformed status %q", status)
+		}
+		m.Status = n
+		m.Description = desc
+	}
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(rest))).ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("nats: malformed header: %w", err)
+	}
+	m.Header = hdr
+	return nil
+}
+
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// serverError returns the text of a -ERR line without the quotes the server puts around it.
+func serverError(line string) string {
+	return strings.Trim(strings.TrimSpace(line[len("-ERR"):]), "'")
+}
@@ -0,0 +1,530 @@
+package nats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a NATS server that speaks enough of the protocol to exercise the client.
+// Messages published to a subject with a handler are passed to the handler, others are
+// delivered to the connection's own subscriptions to the subject, and requests that no
+// subscription answers get a no responders status.
+type testServer struct {
+	t        *testing.T
+	ln       net.Listener
+	info     serverInfo
+	reject   string // error sent in answer to CONNECT, empty to accept the connection
+	handlers map[string]func(c *testConn, msg *Msg)
+	connects chan connectInfo
+	accepts  sync.Once // starts accepting connections once the server is configured
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &testServer{
+		t:        t,
+		ln:       ln,
+		info:     serverInfo{ServerID: "test", Version: "2.10.0", MaxPayload: 1024, Headers: true},
+		handlers: make(map[string]func(c *testConn, msg *Msg)),
+		connects: make(chan connectInfo, 1),
+	}
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// url returns the url of the server with the given user info, which may be empty. The server
+// accepts connections from the first call, so it must be configured before.
+func (s *testServer) url(userinfo string) string {
+	s.accepts.Do(func() { go s.accept() })
+	if userinfo != "" {
+		userinfo += "@"
+	}
+	return "nats://" + userinfo + s.ln.Addr().String()
+}
+
+func (s *testServer) dial(t *testing.T) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, s.url(""), "test")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func (s *testServer) accept() {
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(nc)
+	}
+}
+
+// testConn is the server side of a client connection. It is only used by the goroutine
+// serving the connection, so handlers may write to it without locking.
+type testConn struct {
+	bw   *bufio.Writer
+	subs map[string]string // subscription ids by subject
+}
+
+func (c *testConn) writeLine(line string) {
+	c.bw.WriteString(line + "\r\n")
+	c.bw.Flush()
+}
+
+// send delivers a message to the subscription to subject, if there is one. hdr is a complete
+// header block, allowing status messages to be sent.
+func (c *testConn) send(subject, reply string, hdr, data []byte) {
+	sid, ok := c.subs[subject]
+	if !ok {
+		return
+	}
+	if reply != "" {
+		sid += " " + reply
+	}
+	if hdr == nil {
+		fmt.Fprintf(c.bw, "MSG %s %s %d\r\n", subject, sid, len(data))
+	} else {
+		fmt.Fprintf(c.bw, "HMSG %s %s %d %d\r\n", subject, sid, len(hdr), len(hdr)+len(data))
+		c.bw.Write(hdr)
+	}
+	c.bw.Write(data)
+	c.writeLine("")
+}
+
+// sendStatus delivers a status message, such as 408 Request Timeout, to the subscription to subject.
+func (c *testConn) sendStatus(subject string, status int, desc string) {
+	c.send(subject, "", []byte(fmt.Sprintf("%s %d %s\r\n\r\n", headerLine, status, desc)), nil)
+}
+
+func (s *testServer) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &testConn{bw: bufio.NewWriter(nc), subs: make(map[string]string)}
+	info, _ := json.Marshal(s.info)
+	c.writeLine("INFO " + string(info))
+
+	br := bufio.NewReader(nc)
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(line, " ")
+		fields := strings.Fields(args)
+		switch op {
+		case "CONNECT":
+			var ci connectInfo
+			if err := json.Unmarshal([]byte(args), &ci); err != nil {
+				s.t.Errorf("decode connect: %v", err)
+			}
+			select {
+			case s.connects <- ci:
+			default:
+			}
+			if s.reject != "" {
+				c.writeLine("-ERR '" + s.reject + "'")
+				return
+			}
+		case "PING":
+			c.writeLine("PONG")
+		case "SUB":
+			c.subs[fields[0]] = fields[1]
+		case "UNSUB":
+			for subject, sid := range c.subs {
+				if sid == fields[0] {
+					delete(c.subs, subject)
+				}
+			}
+		case "PUB", "HPUB":
+			msg, err := readPublished(br, op == "HPUB", fields)
+			if err != nil {
+				s.t.Errorf("read %s: %v", op, err)
+				return
+			}
+			if h, ok := s.handlers[msg.Subject]; ok {
+				h(c, msg)
+				continue
+			}
+			if _, ok := c.subs[msg.Subject]; !ok && msg.Reply != "" {
+				// the client asked to be told when a request has no responders
+				c.sendStatus(msg.Reply, 503, "")
+				continue
+			}
+			var hdr []byte
+			if len(msg.Header) > 0 {
+				hdr = encodeHeader(msg.Header)
+			}
+			c.send(msg.Subject, msg.Reply, hdr, msg.Data)
+		default:
+			s.t.Errorf("unexpected protocol line %q", line)
+			return
+		}
+	}
+}
+
+// readPublished reads the payload of a PUB or HPUB whose arguments are args.
+func readPublished(br *bufio.Reader, hasHeader bool, args []string) (*Msg, error) {
+	want := 2
+	if hasHeader {
+		want = 3
+	}
+	if len(args) != want && len(args) != want+1 {
+		return nil, fmt.Errorf("malformed arguments %q", strings.Join(args, " "))
+	}
+	msg := &Msg{Subject: args[0]}
+	if len(args) == want+1 {
+		msg.Reply = args[1]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	hdrSize := 0
+	if hasHeader {
+		if hdrSize, err = strconv.Atoi(args[len(args)-2]); err != nil {
+			return nil, err
+		}
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[total:]) != "\r\n" {
+		return nil, fmt.Errorf("payload of %d bytes is not followed by a line ending", total)
+	}
+	if hasHeader {
+		if err := msg.decodeHeader(buf[:hdrSize]); err != nil {
+			return nil, err
+		}
+	}
+	msg.Data = buf[hdrSize:total]
+	return msg, nil
+}
+
+func TestDialCredentials(t *testing.T) {
+	testCases := []struct {
+		name      string
+		userinfo  string
+		wantUser  string
+		wantPass  string
+		wantToken string
+	}{
+		{name: "none"},
+		{name: "user and password", userinfo: "alice:secret", wantUser: "alice", wantPass: "secret"},
+		{name: "token", userinfo: "s3cr3t", wantToken: "s3cr3t"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := Dial(ctx, s.url(tc.userinfo), "test-client")
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer c.Close()
+
+			ci := <-s.connects
+			if ci.User != tc.wantUser || ci.Pass != tc.wantPass || ci.AuthToken != tc.wantToken {
+				t.Errorf("got user %q, pass %q, token %q, wanted %q, %q, %q", ci.User, ci.Pass, ci.AuthToken, tc.wantUser, tc.wantPass, tc.wantToken)
+			}
+			if ci.Name != "test-client" {
+				t.Errorf("got name %q, wanted test-client", ci.Name)
+			}
+			if !ci.Headers || !ci.NoResponders {
+				t.Errorf("got headers %v and no responders %v, wanted both", ci.Headers, ci.NoResponders)
+			}
+			if got := c.MaxPayload(); got != 1024 {
+				t.Errorf("got max payload %d, wanted 1024", got)
+			}
+			if got := c.ServerVersion(); got != "2.10.0" {
+				t.Errorf("got server version %s, wanted 2.10.0", got)
+			}
+		})
+	}
+}
+
+func TestDialFails(t *testing.T) {
+	testCases := []struct {
+		name    string
+		setup   func(s *testServer)
+		rawurl  string
+		wantErr string
+	}{
+		{
+			name:    "connect rejected",
+			setup:   func(s *testServer) { s.reject = "Authorization Violation" },
+			wantErr: "Authorization Violation",
+		},
+		{
+			name:    "headers not supported",
+			setup:   func(s *testServer) { s.info.Headers = false },
+			wantErr: "does not support headers",
+		},
+		{
+			name:    "unsupported scheme",
+			rawurl:  "http://localhost:4222",
+			wantErr: "unsupported url scheme",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			if tc.setup != nil {
+				tc.setup(s)
+			}
+			rawurl := tc.rawurl
+			if rawurl == "" {
+				rawurl = s.url("")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := Dial(ctx, rawurl, "test")
+			if err == nil {
+				c.Close()
+				t.Fatalf("got no error, wanted one containing %q", tc.wantErr)
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %q, wanted one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	s := newTestServer(t)
+	c := s.dial(t)
+
+	sub, err := c.Subscribe("requests", 2)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		hdr  Header
+		data string
+	}{
+		{name: "without headers", data: "hello"},
+		{name: "with headers", hdr: Header{"encoding": {"gzip"}, "X-Count": {"1", "2"}}, data: "hello"},
+		{name: "empty payload", hdr: Header{"encoding": {"gzip"}}},
+		{name: "payload with line endings", data: "a\r\nb\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := c.Publish("requests", tc.hdr, []byte(tc.data)); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+			select {
+			case msg := <-sub.C:
+				if msg.Subject != "requests" {
+					t.Errorf("got subject %s, wanted requests", msg.Subject)
+				}
+				if string(msg.Data) != tc.data {
+					t.Errorf("got data %q, wanted %q", msg.Data, tc.data)
+				}
+				for k, want := range tc.hdr {
+					if got := msg.Header.Values(k); strings.Join(got, ",") != strings.Join(want, ",") {
+						t.Errorf("got header %s %v, wanted %v", k, got, want)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for message")
+			}
+		})
+	}
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("unsubscribe: %v", err)
+	}
+	if err := c.Publish("requests", nil, []byte("dropped")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	select {
+	case msg := <-sub.C:
+		t.Errorf("got message %q after unsubscribing, wanted none", msg.Data)
+	default:
+	}
+}
+
+func TestPublishTooLarge(t *testing.T) {
+	s := newTestServer(t)
+	s.info.MaxPayload = 16
+	c := s.dial(t)
+
+	if err := c.Publish("requests", nil, make([]byte, 16)); err != nil {
+		t.Errorf("got error %v publishing the maximum payload, wanted none", err)
+	}
+	if err := c.Publish("requests", nil, make([]byte, 17)); err == nil {
+		t.Errorf("got no error publishing more than the maximum payload, wanted one")
+	}
+	if err := c.Publish("requests", Header{"a": {"b"}}, make([]byte, 16)); err == nil {
+		t.Errorf("got no error publishing headers and the maximum payload, wanted one")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	s := newTestServer(t)
+	s.handlers["echo"] = func(c *testConn, msg *Msg) {
+		c.send(msg.Reply, "", nil, append([]byte("re: "), msg.Data...))
+	}
+	s.handlers["nobody"] = func(c *testConn, msg *Msg) {
+		c.sendStatus(msg.Reply, 503, "")
+	}
+	s.handlers["silent"] = func(c *testConn, msg *Msg) {}
+	c := s.dial(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, err := c.Request(ctx, "echo", nil, []byte("ping"))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if string(msg.Data) != "re: ping" {
+		t.Errorf("got reply %q, wanted %q", msg.Data, "re: ping")
+	}
+
+	if _, err := c.Request(ctx, "nobody", nil, nil); !errors.Is(err, ErrNoResponders) {
+		t.Errorf("got error %v, wanted %v", err, ErrNoResponders)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Request(short, "silent", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	s := newTestServer(t)
+	s.handlers["denied"] = func(c *testConn, msg *Msg) {
+		c.writeLine("-ERR 'Permissions Violation for Publish to \"denied\"'")
+	}
+	s.handlers["stale"] = func(c *testConn, msg *Msg) {
+		c.writeLine("-ERR 'Stale Connection'")
+	}
+	c := s.dial(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a permissions violation leaves the connection open
+	if err := c.Publish("denied", nil, nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("got error %v after a permissions violation, wanted none", err)
+	}
+
+	if err := c.Publish("stale", nil, nil); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for the connection to close")
+	}
+	if err := c.Err(); err == nil || !strings.Contains(err.Error(), "Stale Connection") {
+		t.Errorf("got error %v, wanted one containing %q", err, "Stale Connection")
+	}
+	if err := c.Publish("requests", nil, nil); err == nil {
+		t.Errorf("got no error publishing on a closed connection, wanted one")
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       string
+		wantStatus int
+		wantDesc   string
+		wantHeader Header
+		wantErr    bool
+	}{
+		{
+			name:       "headers",
+			data:       "NATS/1.0\r\nencoding: gzip\r\nNats-Msg-Id: 1\r\n\r\n",
+			wantHeader: Header{"Encoding": {"gzip"}, "Nats-Msg-Id": {"1"}},
+		},
+		{
+			name:       "status",
+			data:       "NATS/1.0 408 Request Timeout\r\n\r\n",
+			wantStatus: 408,
+			wantDesc:   "Request Timeout",
+		},
+		{
+			name:       "status without description",
+			data:       "NATS/1.0 503\r\n\r\n",
+			wantStatus: 503,
+		},
+		{
+			name:       "status with headers",
+			data:       "NATS/1.0 409 Consumer Deleted\r\nNats-Pending-Messages: 3\r\n\r\n",
+			wantStatus: 409,
+			wantDesc:   "Consumer Deleted",
+			wantHeader: Header{"Nats-Pending-Messages": {"3"}},
+		},
+		{
+			name:    "wrong version",
+			data:    "HTTP/1.1 200 OK\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "malformed status",
+			data:    "NATS/1.0 abc\r\n\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var m Msg
+			err := m.decodeHeader([]byte(tc.data))
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if m.Status != tc.wantStatus || m.Description != tc.wantDesc {
+				t.Errorf("got status %d %q, wanted %d %q", m.Status, m.Description, tc.wantStatus, tc.wantDesc)
+			}
+			if len(m.Header) != len(tc.wantHeader) {
+				t.Errorf("got header %v, wanted %v", m.Header, tc.wantHeader)
+			}
+			for k, want := range tc.wantHeader {
+				if got := m.Header.Get(k); got != want[0] {
+					t.Errorf("got header %s %q, wanted %q", k, got, want[0])
+				}
+			}
+		})
+	}
+}
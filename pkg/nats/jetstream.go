@@ -0,0 +1,325 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "$JS.API."
+
+// Deliver policies of a consumer, deciding where in the stream it starts.
+const (
+	DeliverAll         = "all"               // from the first message in the stream
+	DeliverNew         = "new"               // from messages published after the consumer is created
+	DeliverByStartSeq  = "by_start_sequence" // from the message with OptStartSeq
+	DeliverByStartTime = "by_start_time"     // from the first message published at or after OptStartTime
+)
+
+// Ack policies of a consumer.
+const (
+	AckPolicyAll      = "all"      // acknowledging a message acknowledges every earlier one
+	AckPolicyExplicit = "explicit" // every message is acknowledged individually
+)
+
+// An APIError is an error returned by the JetStream API.
+type APIError struct {
+	Code        int    `json:"code"`
+	ErrCode     int    `json:"err_code"`
+	Description string `json:"description"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("nats: jetstream: %s (%d)", e.Description, e.ErrCode)
+}
+
+// ErrNotFound is returned when a stream or consumer does not exist.
+var ErrNotFound = errors.New("nats: jetstream: not found")
+
+// JetStream calls the JetStream API over a connection.
+type JetStream struct {
+	conn    *Conn
+	timeout time.Duration
+}
+
+// NewJetStream returns a JetStream using conn, waiting up to timeout for each API call.
+func NewJetStream(conn *Conn, timeout time.Duration) *JetStream {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &JetStream{conn: conn, timeout: timeout}
+}
+
+// api makes an API request, decoding the response into resp.
+func (js *JetStream) api(ctx context.Context, subject string, req, resp any) error {
+	var data []byte
+	if req != nil {
+		var err error
+		if data, err = json.Marshal(req); err != nil {
+			return fmt.Errorf("nats: jetstream: encode request: %w", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, js.timeout)
+	defer cancel()
+	msg, err := js.conn.Request(ctx, subject, nil, data)
+	if err != nil {
+		if errors.Is(err, ErrNoResponders) {
+			return fmt.Errorf("nats: jetstream is not enabled on the server: %w", err)
+		}
+		return err
+	}
+	return decodeResponse(msg.Data, resp)
+}
+
+func decodeResponse(data []byte, resp any) error {
+	var apiErr struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &apiErr); err != nil {
+		return fmt.Errorf("nats: jetstream: decode response: %w", err)
+	}
+	if apiErr.Error != nil {
+		if apiErr.Error.Code == 404 {
+			return fmt.Errorf("%w: %s", ErrNotFound, apiErr.Error.Description)
+		}
+		return apiErr.Error
+	}
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("nats: jetstream: decode response: %w", err)
+	}
+	return nil
+}
+
+// StreamConfig configures a stream. Limits left zero are unlimited.
+type StreamConfig struct {
+	Name     string        `json:"name"`
+	Subjects []string      `json:"subjects"`
+	Storage  string        `json:"storage"`             // file or memory
+	MaxAge   time.Duration `json:"max_age,omitempty"`   // messages older than this are removed
+	MaxBytes int64         `json:"max_bytes,omitempty"` // oldest messages are removed to stay within this size
+	Replicas int           `json:"num_replicas,omitempty"`
+}
+
+// StreamState describes the messages held by a stream.
+type StreamState struct {
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeq  uint64    `json:"first_seq"`
+	FirstTime time.Time `json:"first_ts"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_ts"`
+}
+
+type StreamInfo struct {
+	Config StreamConfig `json:"config"`
+	State  StreamState  `json:"state"`
+}
+
+// StreamInfo returns the configuration and state of a stream, or ErrNotFound.
+func (js *JetStream) StreamInfo(ctx context.Context, name string) (*StreamInfo, error) {
+	info := new(StreamInfo)
+	if err := js.api(ctx, apiPrefix+"STREAM.INFO."+name, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// AddStream creates a stream. It is not an error if an identical stream already exists.
+func (js *JetStream) AddStream(ctx context.Context, cfg StreamConfig) (*StreamInfo, error) {
+	if cfg.Storage == "" {
+		cfg.Storage = "file"
+	}
+	info := new(StreamInfo)
+	if err := js.api(ctx, apiPrefix+"STREAM.CREATE."+cfg.Name, cfg, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// A PubAck confirms that a message was stored by a stream.
+type PubAck struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// Publish publishes a message and waits until a stream has stored it. ErrNoResponders is
+// returned if no stream captures the subject.
+func (js *JetStream) Publish(ctx context.Context, subject string, hdr Header, data []byte) (*PubAck, error) {
+	ctx, cancel := context.WithTimeout(ctx, js.timeout)
+	defer cancel()
+	msg, err := js.conn.Request(ctx, subject, hdr, data)
+	if err != nil {
+		return nil, err
+	}
+	ack := new(PubAck)
+	if err := decodeResponse(msg.Data, ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// ConsumerConfig configures a durable pull consumer.
+type ConsumerConfig struct {
+	Durable           string        `json:"durable_name"`
+	DeliverPolicy     string        `json:"deliver_policy"`
+	OptStartSeq       uint64        `json:"opt_start_seq,omitempty"`
+	OptStartTime      *time.Time    `json:"opt_start_time,omitempty"`
+	AckPolicy         string        `json:"ack_policy"`
+	AckWait           time.Duration `json:"ack_wait,omitempty"`
+	MaxAckPending     int           `json:"max_ack_pending,omitempty"`
+	FilterSubject     string        `json:"filter_subject,omitempty"`
+	ReplayPolicy      string        `json:"replay_policy"`
+	InactiveThreshold time.Duration `json:"inactive_threshold,omitempty"` // the server deletes the consumer once it has not been used for this long
+}
+
+type ConsumerInfo struct {
+	Stream    string         `json:"stream_name"`
+	Name      string         `json:"name"`
+	Config    ConsumerConfig `json:"config"`
+	Pending   uint64         `json:"num_pending"` // messages in the stream not yet delivered to the consumer
+	Delivered struct {
+		StreamSeq uint64 `json:"stream_seq"`
+	} `json:"delivered"`
+}
+
+// ConsumerInfo returns the state of a consumer, or ErrNotFound.
+func (js *JetStream) ConsumerInfo(ctx context.Context, stream, name string) (*ConsumerInfo, error) {
+	info := new(ConsumerInfo)
+	if err := js.api(ctx, apiPrefix+"CONSUMER.INFO."+stream+"."+name, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// AddConsumer creates a durable consumer of a stream.
+func (js *JetStream) AddConsumer(ctx context.Context, stream string, cfg ConsumerConfig) (*ConsumerInfo, error) {
+	if cfg.Durable == "" {
+		return nil, fmt.Errorf("nats: jetstream: consumer must be durable")
+	}
+	if cfg.ReplayPolicy == "" {
+		cfg.ReplayPolicy = "instant"
+	}
+	req := struct {
+		Stream string         `json:"stream_name"`
+		Config ConsumerConfig `json:"config"`
+	}{Stream: stream, Config: cfg}
+	info := new(ConsumerInfo)
+	if err := js.api(ctx, apiPrefix+"CONSUMER.DURABLE.CREATE."+stream+"."+cfg.Durable, req, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DeleteConsumer deletes a consumer. It is not an error if it does not exist.
+func (js *JetStream) DeleteConsumer(ctx context.Context, stream, name string) error {
+	err := js.api(ctx, apiPrefix+"CONSUMER.DELETE."+stream+"."+name, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Metadata is the position of a message delivered by a consumer, taken from its reply subject.
+type Metadata struct {
+	Stream    string
+	Consumer  string
+	Delivered uint64 // number of times the message has been delivered
+	StreamSeq uint64
+	Timestamp time.Time // when the message was stored by the stream
+	Pending   uint64    // messages in the stream not yet delivered to the consumer
+}
+
+// Metadata parses the message's reply subject, which is $JS.ACK.<stream>.<consumer>.<delivered>.
+// <stream seq>.<consumer seq>.<timestamp>.<pending>, with a domain and account hash after ACK on
+// servers since 2.9.
+func (m *Msg) Metadata() (*Metadata, error) {
+	tokens := strings.Split(m.Reply, ".")
+	if len(tokens) < 9 || tokens[0] != "$JS" || tokens[1] != "ACK" {
+		return nil, fmt.Errorf("nats: message was not delivered by a consumer")
+	}
+	if len(tokens) >= 12 {
+		tokens = tokens[2:]
+	}
+	num := func(i int) uint64 {
+		n, _ := strconv.ParseUint(tokens[i], 10, 64)
+		return n
+	}
+	return &Metadata{
+		Stream:    tokens[2],
+		Consumer:  tokens[3],
+		Delivered: num(4),
+		StreamSeq: num(5),
+		Timestamp: time.Unix(0, int64(num(7))),
+		Pending:   num(8),
+	}, nil
+}
+
+// Ack acknowledges a message delivered by a consumer.
+func (m *Msg) Ack() error {
+	return m.Respond([]byte("+ACK"))
+}
+
+// Fetch requests up to batch messages from a pull consumer, waiting up to expires for them to
+// arrive, and returns those that did. ErrNotFound is returned if the consumer has been deleted.
+func (js *JetStream) Fetch(ctx context.Context, stream, consumer string, batch int, expires time.Duration) ([]*Msg, error) {
+	inbox := NewInbox()
+	sub, err := js.conn.Subscribe(inbox, batch+1)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	req, err := json.Marshal(struct {
+		Batch   int           `json:"batch"`
+		Expires time.Duration `json:"expires"`
+	}{Batch: batch, Expires: expires})
+	if err != nil {
+		return nil, err
+	}
+	if err := js.conn.publish(apiPrefix+"CONSUMER.MSG.NEXT."+stream+"."+consumer, inbox, nil, req); err != nil {
+		return nil, err
+	}
+
+	// the server ends the request with a status message when it expires, allow for it arriving late
+	timer := time.NewTimer(expires + js.timeout)
+	defer timer.Stop()
+	var msgs []*Msg
+	for len(msgs) < batch {
+		select {
+		case <-ctx.Done():
+			return msgs, ctx.Err()
+		case <-js.conn.done:
+			return msgs, js.conn.Err()
+		case <-timer.C:
+			return msgs, nil
+		case msg := <-sub.C:
+			switch msg.Status {
+			case 0:
+				msgs = append(msgs, msg)
+			case 100:
+				// heartbeat
+			case 404, 408:
+				// no messages or the request expired
+				return msgs, nil
+			case 409:
+				if strings.Contains(strings.ToLower(msg.Description), "deleted") {
+					return msgs, fmt.Errorf("%w: %s", ErrNotFound, msg.Description)
+				}
+				return msgs, nil
+			case 503:
+				return msgs, fmt.Errorf("nats: jetstream is not enabled on the server: %w", ErrNoResponders)
+			default:
+				return msgs, fmt.Errorf("nats: jetstream: fetch: %d %s", msg.Status, msg.Description)
+			}
+		}
+	}
+	return msgs, nil
+}
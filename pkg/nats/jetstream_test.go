@@ -0,0 +1,289 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// respond answers every request to subject with resp.
+func (s *testServer) respond(subject, resp string) {
+	s.handlers[subject] = func(c *testConn, msg *Msg) {
+		c.send(msg.Reply, "", nil, []byte(resp))
+	}
+}
+
+func TestJetStreamAPIErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.respond(apiPrefix+"STREAM.INFO.missing", `{"error":{"code":404,"err_code":10059,"description":"stream not found"}}`)
+	s.respond(apiPrefix+"STREAM.INFO.broken", `{"error":{"code":500,"err_code":10001,"description":"insufficient resources"}}`)
+	s.respond(apiPrefix+"STREAM.INFO.garbled", `not json`)
+	s.respond(apiPrefix+"STREAM.INFO.requests", `{"config":{"name":"requests","subjects":["requests.>"],"max_age":3600000000000},"state":{"messages":7,"first_seq":3,"last_seq":9}}`)
+	js := NewJetStream(s.dial(t), 5*time.Second)
+	ctx := context.Background()
+
+	if _, err := js.StreamInfo(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v, wanted %v", err, ErrNotFound)
+	}
+
+	_, err := js.StreamInfo(ctx, "broken")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got error %v, wanted an api error", err)
+	}
+	if apiErr.Code != 500 || apiErr.ErrCode != 10001 {
+		t.Errorf("got code %d and error code %d, wanted 500 and 10001", apiErr.Code, apiErr.ErrCode)
+	}
+
+	if _, err := js.StreamInfo(ctx, "garbled"); err == nil {
+		t.Errorf("got no error decoding a malformed response, wanted one")
+	}
+
+	info, err := js.StreamInfo(ctx, "requests")
+	if err != nil {
+		t.Fatalf("stream info: %v", err)
+	}
+	if info.Config.MaxAge != time.Hour {
+		t.Errorf("got max age %s, wanted %s", info.Config.MaxAge, time.Hour)
+	}
+	if info.State.Messages != 7 || info.State.FirstSeq != 3 || info.State.LastSeq != 9 {
+		t.Errorf("got state %+v, wanted 7 messages from 3 to 9", info.State)
+	}
+
+	// a server without jetstream has nothing subscribed to the api
+	if _, err := js.StreamInfo(ctx, "unanswered"); !errors.Is(err, ErrNoResponders) {
+		t.Errorf("got error %v, wanted %v", err, ErrNoResponders)
+	}
+}
+
+func TestAddConsumer(t *testing.T) {
+	start := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name string
+		cfg  ConsumerConfig
+		want string
+	}{
+		{
+			name: "new",
+			cfg:  ConsumerConfig{Durable: "dealgood", DeliverPolicy: DeliverNew, AckPolicy: AckPolicyAll, AckWait: 30 * time.Second},
+			want: `{"durable_name":"dealgood","deliver_policy":"new","ack_policy":"all","ack_wait":30000000000,"replay_policy":"instant"}`,
+		},
+		{
+			name: "by start sequence",
+			cfg:  ConsumerConfig{Durable: "dealgood", DeliverPolicy: DeliverByStartSeq, OptStartSeq: 42, AckPolicy: AckPolicyAll},
+			want: `{"durable_name":"dealgood","deliver_policy":"by_start_sequence","opt_start_seq":42,"ack_policy":"all","replay_policy":"instant"}`,
+		},
+		{
+			name: "by start time",
+			cfg:  ConsumerConfig{Durable: "dealgood", DeliverPolicy: DeliverByStartTime, OptStartTime: &start, AckPolicy: AckPolicyAll, InactiveThreshold: time.Hour},
+			want: `{"durable_name":"dealgood","deliver_policy":"by_start_time","opt_start_time":"2023-03-01T12:00:00Z","ack_policy":"all","replay_policy":"instant","inactive_threshold":3600000000000}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			var got struct {
+				Stream string          `json:"stream_name"`
+				Config json.RawMessage `json:"config"`
+			}
+			s.handlers[apiPrefix+"CONSUMER.DURABLE.CREATE.requests.dealgood"] = func(c *testConn, msg *Msg) {
+				if err := json.Unmarshal(msg.Data, &got); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				c.send(msg.Reply, "", nil, []byte(`{"stream_name":"requests","name":"dealgood"}`))
+			}
+			js := NewJetStream(s.dial(t), 5*time.Second)
+
+			info, err := js.AddConsumer(context.Background(), "requests", tc.cfg)
+			if err != nil {
+				t.Fatalf("add consumer: %v", err)
+			}
+			if info.Name != "dealgood" {
+				t.Errorf("got consumer %s, wanted dealgood", info.Name)
+			}
+			if got.Stream != "requests" {
+				t.Errorf("got stream %s, wanted requests", got.Stream)
+			}
+			if string(got.Config) != tc.want {
+				t.Errorf("got config %s, wanted %s", got.Config, tc.want)
+			}
+		})
+	}
+}
+
+func TestJetStreamPublish(t *testing.T) {
+	s := newTestServer(t)
+	var gotHeader Header
+	s.handlers["requests.kubo"] = func(c *testConn, msg *Msg) {
+		gotHeader = msg.Header
+		c.send(msg.Reply, "", nil, []byte(`{"stream":"requests","seq":12}`))
+	}
+	s.handlers["requests.full"] = func(c *testConn, msg *Msg) {
+		c.send(msg.Reply, "", nil, []byte(`{"error":{"code":503,"err_code":10077,"description":"maximum messages exceeded"}}`))
+	}
+	js := NewJetStream(s.dial(t), 5*time.Second)
+	ctx := context.Background()
+
+	ack, err := js.Publish(ctx, "requests.kubo", Header{"encoding": {"gzip"}}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if ack.Stream != "requests" || ack.Sequence != 12 {
+		t.Errorf("got ack %+v, wanted stream requests and sequence 12", ack)
+	}
+	if got := gotHeader.Get("encoding"); got != "gzip" {
+		t.Errorf("got encoding header %q, wanted gzip", got)
+	}
+
+	var apiErr *APIError
+	if _, err := js.Publish(ctx, "requests.full", nil, []byte("payload")); !errors.As(err, &apiErr) {
+		t.Errorf("got error %v, wanted an api error", err)
+	}
+
+	// no stream captures the subject
+	if _, err := js.Publish(ctx, "elsewhere", nil, []byte("payload")); !errors.Is(err, ErrNoResponders) {
+		t.Errorf("got error %v, wanted %v", err, ErrNoResponders)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	const (
+		next    = apiPrefix + "CONSUMER.MSG.NEXT.requests.dealgood"
+		ackSubj = "$JS.ACK.requests.dealgood.1.11.5.1677672000000000000.3"
+	)
+	testCases := []struct {
+		name     string
+		stored   int    // messages sent before the request ends
+		status   int    // status ending the request, 0 for none
+		desc     string // description of the status
+		batch    int
+		wantMsgs int
+		wantErr  error
+	}{
+		{name: "expired", stored: 2, status: 408, desc: "Request Timeout", batch: 5, wantMsgs: 2},
+		{name: "no messages", status: 404, desc: "No Messages", batch: 5, wantMsgs: 0},
+		{name: "full batch", stored: 3, batch: 3, wantMsgs: 3},
+		{name: "heartbeat", stored: 1, status: 100, desc: "Idle Heartbeat", batch: 1, wantMsgs: 1},
+		{name: "consumer deleted", stored: 1, status: 409, desc: "Consumer Deleted", batch: 5, wantMsgs: 1, wantErr: ErrNotFound},
+		{name: "leadership change", status: 409, desc: "Leadership Change", batch: 5, wantMsgs: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			var req struct {
+				Batch   int           `json:"batch"`
+				Expires time.Duration `json:"expires"`
+			}
+			s.handlers[next] = func(c *testConn, msg *Msg) {
+				if err := json.Unmarshal(msg.Data, &req); err != nil {
+					t.Errorf("decode request: %v", err)
+				}
+				if tc.status == 100 {
+					c.sendStatus(msg.Reply, 100, tc.desc)
+				}
+				for i := 0; i < tc.stored; i++ {
+					c.send(msg.Reply, ackSubj, []byte("NATS/1.0\r\nencoding: gzip\r\n\r\n"), []byte(fmt.Sprintf("request %d", i)))
+				}
+				if tc.status != 0 && tc.status != 100 {
+					c.sendStatus(msg.Reply, tc.status, tc.desc)
+				}
+			}
+			acks := make(chan string, 1)
+			s.handlers[ackSubj] = func(c *testConn, msg *Msg) {
+				acks <- string(msg.Data)
+			}
+			js := NewJetStream(s.dial(t), 5*time.Second)
+
+			msgs, err := js.Fetch(context.Background(), "requests", "dealgood", tc.batch, time.Second)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("got error %v, wanted %v", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("fetch: %v", err)
+			}
+			if req.Batch != tc.batch || req.Expires != time.Second {
+				t.Errorf("got request for %d messages expiring in %s, wanted %d in %s", req.Batch, req.Expires, tc.batch, time.Second)
+			}
+			if len(msgs) != tc.wantMsgs {
+				t.Fatalf("got %d messages, wanted %d", len(msgs), tc.wantMsgs)
+			}
+			for i, msg := range msgs {
+				if want := fmt.Sprintf("request %d", i); string(msg.Data) != want {
+					t.Errorf("got data %q, wanted %q", msg.Data, want)
+				}
+				if got := msg.Header.Get("encoding"); got != "gzip" {
+					t.Errorf("got encoding header %q, wanted gzip", got)
+				}
+			}
+			if len(msgs) == 0 {
+				return
+			}
+
+			if err := msgs[len(msgs)-1].Ack(); err != nil {
+				t.Fatalf("ack: %v", err)
+			}
+			select {
+			case got := <-acks:
+				if got != "+ACK" {
+					t.Errorf("got ack %q, wanted +ACK", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for ack")
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	testCases := []struct {
+		name    string
+		reply   string
+		want    Metadata
+		wantErr bool
+	}{
+		{
+			name:  "without domain",
+			reply: "$JS.ACK.requests.dealgood.2.11.5.1677672000000000000.3",
+			want:  Metadata{Stream: "requests", Consumer: "dealgood", Delivered: 2, StreamSeq: 11, Timestamp: time.Unix(0, 1677672000000000000), Pending: 3},
+		},
+		{
+			name:  "with domain and account hash",
+			reply: "$JS.ACK._.AHASH.requests.dealgood.1.12.6.1677672000000000000.0.rand",
+			want:  Metadata{Stream: "requests", Consumer: "dealgood", Delivered: 1, StreamSeq: 12, Timestamp: time.Unix(0, 1677672000000000000), Pending: 0},
+		},
+		{
+			name:    "inbox",
+			reply:   "_INBOX.abc",
+			wantErr: true,
+		},
+		{
+			name:    "too short",
+			reply:   "$JS.ACK.requests.dealgood.1",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := (&Msg{Reply: tc.reply}).Metadata()
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got no error, wanted one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != tc.want {
+				t.Errorf("got %+v, wanted %+v", *got, tc.want)
+			}
+		})
+	}
+}
@@ -14,8 +14,10 @@ import (
 )
 
 type (
-	Counter = prometheus.Counter
-	Gauge   = prometheus.Gauge
+	Counter      = prometheus.Counter
+	CounterVec   = prometheus.CounterVec
+	Gauge        = prometheus.Gauge
+	HistogramVec = prometheus.HistogramVec
 )
 
 type PrometheusServer struct {
@@ -101,3 +103,46 @@ func NewPrometheusGauge(appName string, name string, help string, labels map[str
 	}
 	return m, nil
 }
+
+func NewPrometheusCounterVec(appName string, name string, help string, labels map[string]string, labelNames ...string) (*CounterVec, error) {
+	m := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   "thunderdome",
+			Subsystem:   appName,
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		},
+		labelNames,
+	)
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			m = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			return nil, fmt.Errorf("register %s counter vec: %w", name, err)
+		}
+	}
+	return m, nil
+}
+
+func NewPrometheusHistogramVec(appName string, name string, help string, buckets []float64, labels map[string]string, labelNames ...string) (*HistogramVec, error) {
+	m := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   "thunderdome",
+			Subsystem:   appName,
+			Name:        name,
+			Help:        help,
+			Buckets:     buckets,
+			ConstLabels: labels,
+		},
+		labelNames,
+	)
+	if err := prometheus.Register(m); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			m = are.ExistingCollector.(*prometheus.HistogramVec)
+		} else {
+			return nil, fmt.Errorf("register %s histogram vec: %w", name, err)
+		}
+	}
+	return m, nil
+}
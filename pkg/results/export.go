@@ -0,0 +1,165 @@
+package results
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A Metric is a query that exports one metric of an experiment. The query is a format string
+// taking the experiment name and the range over which rates are calculated.
+type Metric struct {
+	Query string
+	Help  string
+}
+
+// Metrics are the metrics exported for an experiment by default, keyed by name. Rates and
+// quantiles are calculated over each step of the export, histogram buckets are the number of
+// requests added to each bucket during the step so that they can be summed over any period.
+var Metrics = map[string]Metric{
+	"requests_per_second": {
+		Query: `sum by (target) (rate(thunderdome_dealgood_requests_total{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests sent to each target per second.",
+	},
+	"errors_per_second": {
+		Query: `sum by (target) (rate(thunderdome_dealgood_errors_total{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests to each target that failed per second.",
+	},
+	"dropped_per_second": {
+		Query: `sum by (target) (rate(thunderdome_dealgood_dropped_total{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests dropped per second because the target's concurrency limit was reached.",
+	},
+	"responses_per_second": {
+		Query: `sum by (target, code) (rate(thunderdome_dealgood_responses_total{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Responses received from each target per second, by status code.",
+	},
+	"ttfb_p50_seconds": {
+		Query: `histogram_quantile(0.5, sum by (target, le) (rate(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+		Help:  "Median time to first byte.",
+	},
+	"ttfb_p95_seconds": {
+		Query: `histogram_quantile(0.95, sum by (target, le) (rate(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+		Help:  "95th percentile time to first byte.",
+	},
+	"ttfb_p99_seconds": {
+		Query: `histogram_quantile(0.99, sum by (target, le) (rate(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s])))`,
+		Help:  "99th percentile time to first byte.",
+	},
+	"ttfb_seconds_bucket": {
+		Query: `sum by (target, le) (increase(thunderdome_dealgood_ttfb_seconds_bucket{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests added to each cumulative time to first byte bucket.",
+	},
+	"request_time_seconds_bucket": {
+		Query: `sum by (target, le) (increase(thunderdome_dealgood_request_time_seconds_bucket{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests added to each cumulative total request time bucket.",
+	},
+	"connect_time_seconds_bucket": {
+		Query: `sum by (target, le) (increase(thunderdome_dealgood_connect_time_seconds_bucket{experiment=%[1]q}[%[2]s]))`,
+		Help:  "Requests added to each cumulative connection time bucket.",
+	},
+}
+
+// MetricNames returns the names of the default metrics, sorted.
+func MetricNames() []string {
+	names := make([]string, 0, len(Metrics))
+	for name := range Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Export reads the named metrics for an experiment between start and end, one sample each
+// step. All the default metrics are read if names is empty.
+func (c *Client) Export(ctx context.Context, experiment string, names []string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if len(names) == 0 {
+		names = MetricNames()
+	}
+	window := fmt.Sprintf("%ds", int64(math.Ceil(step.Seconds())))
+
+	var all []Series
+	for _, name := range names {
+		m, ok := Metrics[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric: %q", name)
+		}
+		series, err := c.QueryRange(ctx, fmt.Sprintf(m.Query, experiment, window), start, end, step)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %w", name, err)
+		}
+		for i := range series {
+			series[i].Name = name
+			if series[i].Labels["experiment"] == "" {
+				series[i].Labels["experiment"] = experiment
+			}
+		}
+		all = append(all, series...)
+	}
+	return all, nil
+}
+
+// WriteCSV writes the series in long form, one row per sample, with a column for the time, the
+// metric name, each label and the value. Labels a series does not have are left empty.
+func WriteCSV(w io.Writer, series []Series) error {
+	labels := LabelNames(series)
+	cw := csv.NewWriter(w)
+
+	header := append([]string{"time", "metric"}, labels...)
+	header = append(header, "value")
+	if err := cw.Write(header); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
+	row := make([]string, len(header))
+	for _, s := range series {
+		for _, sm := range s.Samples {
+			row[0] = sm.Time.Format(time.RFC3339)
+			row[1] = s.Name
+			for i, l := range labels {
+				row[2+i] = s.Labels[l]
+			}
+			row[len(row)-1] = strconv.FormatFloat(sm.Value, 'g', -1, 64)
+			if err := cw.Write(row); err != nil {
+				return fmt.Errorf("write row: %w", err)
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSONLines writes the series as newline delimited JSON, one object per sample holding the
+// time, metric name, labels and value.
+func WriteJSONLines(w io.Writer, series []Series) error {
+	enc := json.NewEncoder(w)
+	for _, s := range series {
+		for _, sm := range s.Samples {
+			rec := make(map[string]any, len(s.Labels)+3)
+			for k, v := range s.Labels {
+				rec[k] = v
+			}
+			rec["time"] = sm.Time.Format(time.RFC3339)
+			rec["metric"] = s.Name
+			rec["value"] = jsonFloat(sm.Value)
+			if err := enc.Encode(rec); err != nil {
+				return fmt.Errorf("encode sample: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFloat returns v, or nil if v cannot be represented in JSON, such as the NaN returned for
+// a quantile of a histogram with no observations.
+func jsonFloat(v float64) any {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,168 @@
+// Package results reads the metrics recorded for thunderdome experiments from the Prometheus
+// query API that dealgood's metrics are written to, and exports them in forms suited to
+// notebooks and other analysis tools.
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Client queries the Prometheus HTTP API.
+type Client struct {
+	URL   string // base url of the query api, for example https://prometheus-us-central1.grafana.net/api/prom
+	User  string
+	Token string
+
+	HTTPClient *http.Client // optional, a client with a 30 second timeout is used if nil
+}
+
+// A Sample is the value of a series at a point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// A Series is a set of samples sharing the same labels.
+type Series struct {
+	Name    string // name of the exported metric, such as ttfb_p50_seconds
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// Query runs an instant query at time at, or now if at is zero, and returns one series with a
+// single sample for each result.
+func (c *Client) Query(ctx context.Context, query string, at time.Time) ([]Series, error) {
+	params := url.Values{"query": {query}}
+	if !at.IsZero() {
+		params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	}
+	return c.do(ctx, "/api/v1/query", params)
+}
+
+// QueryRange runs a range query from start to end, evaluated every step.
+func (c *Client) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	params := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(start.Unix(), 10)},
+		"end":   {strconv.FormatInt(end.Unix(), 10)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	}
+	return c.do(ctx, "/api/v1/query_range", params)
+}
+
+func (c *Client) do(ctx context.Context, path string, params url.Values) ([]Series, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.URL.RawQuery = params.Encode()
+	if c.User != "" || c.Token != "" {
+		req.SetBasicAuth(c.User, c.Token)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("query: unexpected status %s: %s", resp.Status, msg)
+	}
+
+	var out struct {
+		Status string `json:"status"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []any             `json:"value"`  // set by instant queries
+				Values [][]any           `json:"values"` // set by range queries
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if out.Status != "success" {
+		return nil, fmt.Errorf("query status: %s", out.Status)
+	}
+
+	series := make([]Series, 0, len(out.Data.Result))
+	for _, r := range out.Data.Result {
+		s := Series{
+			Name:   r.Metric["__name__"],
+			Labels: make(map[string]string, len(r.Metric)),
+		}
+		for k, v := range r.Metric {
+			if k != "__name__" {
+				s.Labels[k] = v
+			}
+		}
+		values := r.Values
+		if len(r.Value) == 2 {
+			values = append(values, r.Value)
+		}
+		for _, v := range values {
+			if sm, ok := parseSample(v); ok {
+				s.Samples = append(s.Samples, sm)
+			}
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// parseSample parses a [timestamp, "value"] pair, skipping values that are not numbers.
+func parseSample(v []any) (Sample, bool) {
+	if len(v) != 2 {
+		return Sample{}, false
+	}
+	ts, ok := v[0].(float64)
+	if !ok {
+		return Sample{}, false
+	}
+	s, ok := v[1].(string)
+	if !ok {
+		return Sample{}, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Sample{}, false
+	}
+	sec := int64(ts)
+	return Sample{
+		Time:  time.Unix(sec, int64((ts-float64(sec))*1e9)).UTC(),
+		Value: f,
+	}, true
+}
+
+// LabelNames returns the names of all the labels used by the series, sorted.
+func LabelNames(series []Series) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, s := range series {
+		for k := range s.Labels {
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
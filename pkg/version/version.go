@@ -0,0 +1,40 @@
+// Package version reports the version thunderdome's binaries were built from.
+package version
+
+import "runtime/debug"
+
+// Version is the release a binary was built from. It is set when building with
+// -ldflags "-X github.com/plprobelab/thunderdome/pkg/version.Version=v1.2.3".
+var Version = ""
+
+// String returns the version of the running binary: Version if it was set when building,
+// otherwise the vcs revision recorded by the go toolchain, or "devel" if neither is known.
+func String() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	var revision string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
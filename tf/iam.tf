@@ -171,9 +171,22 @@ resource "aws_iam_role" "ironbar" {
                   "dynamodb:Query",
                   "dynamodb:UpdateItem",
                   "dynamodb:UpdateTable",
+                  "ec2:DeletePlacementGroup",
+                  "ec2:DescribeInstances",
+                  "ec2:DescribePlacementGroups",
+                  "ec2:TerminateInstances",
+                  "ecr:BatchGetImage",
+                  "ecr:GetDownloadUrlForLayer",
+                  "ecs:DescribeContainerInstances",
                   "ecs:DescribeTasks",
                   "ecs:DescribeTaskDefinition",
                   "ecs:DeregisterTaskDefinition",
+                  "ecs:RegisterTaskDefinition",
+                  "ecs:RunTask",
+                  "iam:PassRole",
+                  "logs:FilterLogEvents",
+                  "logs:GetLogEvents",
+                  "s3:PutObject",
                   "sns:GetSubscriptionAttributes",
                   "ecs:StopTask",
                   "sns:Unsubscribe",
@@ -208,6 +221,38 @@ resource "aws_iam_role" "ironbar" {
   })
 }
 
+# Role of the ec2 instances launched for targets that run on an instance of their own
+resource "aws_iam_role" "target_instance" {
+  name = "target-instance"
+  assume_role_policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Action = "sts:AssumeRole"
+        Effect = "Allow"
+        Sid    = ""
+        Principal = {
+          Service = "ec2.amazonaws.com"
+        }
+      },
+    ]
+  })
+}
+
+resource "aws_iam_role_policy_attachment" "target_instance" {
+  for_each = {
+    AmazonEC2ContainerServiceforEC2Role = "arn:aws:iam::aws:policy/service-role/AmazonEC2ContainerServiceforEC2Role"
+    AmazonSSMManagedInstanceCore        = "arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"
+  }
+  role       = aws_iam_role.target_instance.name
+  policy_arn = each.value
+}
+
+resource "aws_iam_instance_profile" "target_instance" {
+  name = "target-instance"
+  role = aws_iam_role.target_instance.name
+}
+
 resource "aws_iam_user" "deployer" {
   for_each = toset(local.deployers)
   name     = each.key
@@ -237,7 +282,17 @@ resource "aws_iam_group_policy" "deployers" {
             "Sid": "ironbar",
             "Effect": "Allow",
             "Action": [
+                "ec2:CreatePlacementGroup",
+                "ec2:CreateTags",
+                "ec2:DeletePlacementGroup",
                 "ec2:DescribeInstances",
+                "ec2:DescribeInstanceTypes",
+                "ec2:DescribeNetworkInterfaces",
+                "ec2:DescribePlacementGroups",
+                "ec2:DescribeSubnets",
+                "ec2:ModifyNetworkInterfaceAttribute",
+                "ec2:RunInstances",
+                "ec2:TerminateInstances",
                 "ecr:BatchCheckLayerAvailability",
                 "ecr:CompleteLayerUpload",
                 "ecr:DescribeImages",
@@ -250,9 +305,11 @@ resource "aws_iam_group_policy" "deployers" {
                 "ecs:DescribeTasks",
                 "ecs:DescribeTaskDefinition",
                 "ecs:DescribeContainerInstances",
+                "ecs:ListContainerInstances",
                 "ecs:RegisterTaskDefinition",
                 "ecs:RunTask",
                 "ecs:StopTask",
+                "iam:PassRole",
                 "s3:GetObject",
                 "sns:GetSubscriptionAttributes",
                 "sns:Subscribe",
@@ -260,7 +317,8 @@ resource "aws_iam_group_policy" "deployers" {
                 "sqs:CreateQueue",
                 "sqs:DeleteQueue",
                 "sqs:GetQueueAttributes",
-                "sqs:SetQueueAttributes"
+                "sqs:SetQueueAttributes",
+                "ssm:GetParameter"
             ],
             "Resource": "*"
         }
@@ -91,6 +91,12 @@ resource "aws_ecs_task_definition" "ironbar" {
         { name = "IRONBAR_EXPERIMENTS_TABLE_NAME", value = "${aws_dynamodb_table.experiments.name}" },
         { name = "IRONBAR_MONITOR_INTERVAL", value = "1" },
         { name = "IRONBAR_SETTLE", value = "5" },
+        { name = "IRONBAR_WATCH_LOGS", value = "true" },
+        { name = "IRONBAR_DUMPS_BUCKET", value = "${aws_s3_bucket.dumps.id}" },
+        { name = "IRONBAR_REQUIRED_METADATA", value = "owner,purpose,ticket" },
+        { name = "IRONBAR_RETENTION", value = "2160h" },
+        { name = "IRONBAR_ARCHIVE_BUCKET", value = "${aws_s3_bucket.archive.id}" },
+        { name = "IRONBAR_KMS_KEY_ARN", value = local.kms_key_arn },
       ]
 
       logConfiguration = {
@@ -153,3 +159,59 @@ resource "aws_ecs_task_definition" "ironbar" {
   ])
 }
 
+
+resource "aws_s3_bucket" "dumps" {
+  bucket        = "pl-thunderdome-dumps"
+  force_destroy = true
+}
+
+resource "aws_s3_bucket_acl" "dumps" {
+  bucket = aws_s3_bucket.dumps.id
+  acl    = "private"
+}
+
+resource "aws_s3_bucket_lifecycle_configuration" "dumps" {
+  bucket = aws_s3_bucket.dumps.id
+
+  rule {
+    id     = "expire"
+    status = "Enabled"
+
+    filter {}
+
+    expiration {
+      days = 30
+    }
+  }
+}
+
+# Records of completed experiments removed by ironbar's retention policy. They are moved to
+# Glacier as soon as they are written since they are only read when investigating old runs.
+resource "aws_s3_bucket" "archive" {
+  bucket = "pl-thunderdome-archive"
+}
+
+resource "aws_s3_bucket_acl" "archive" {
+  bucket = aws_s3_bucket.archive.id
+  acl    = "private"
+}
+
+resource "aws_s3_bucket_lifecycle_configuration" "archive" {
+  bucket = aws_s3_bucket.archive.id
+
+  rule {
+    id     = "glacier"
+    status = "Enabled"
+
+    filter {}
+
+    transition {
+      days          = 1
+      storage_class = "GLACIER"
+    }
+
+    expiration {
+      days = 730
+    }
+  }
+}
@@ -3,26 +3,51 @@ locals {
 
   skyfish_image_tag = "2023-12-13-60b3d1f"
 
+  egress_image_tag = "2026-10-16-egress"
+
   ironbar_image_tag = "2023-02-27-c7b617d"
   ironbar_port_number = 8321
 
+  # Additional ecs clusters that experiments may select, keyed by name. Each maps the instance
+  # types it offers to the names of its capacity providers, for example:
+  #   gpu = { Arn = "...", Description = "g5 instances", CapacityProviders = { gpu_large = "gpu_large" } }
+  # Instance types not defined statically by the thunderdome client are added to
+  # CapacityProviders in infra.json.
+  additional_clusters = {}
+
+  # ARN of a customer managed KMS key that the request topic, the experiments log group, ironbar's
+  # buckets and the queues and tables created for experiments are encrypted with. Empty leaves
+  # them with AWS managed encryption. Experiments may name their own key with kms_key_arn. The
+  # key policy must allow sns.amazonaws.com and logs.amazonaws.com to use the key.
+  kms_key_arn = ""
+
   infra_json = jsonencode({
     AwsRegion                       = data.aws_region.current.name
+    Clusters                        = local.additional_clusters
     DealgoodGrafanaAgentConfigURL   = "http://${module.s3_bucket_public.s3_bucket_bucket_domain_name}/${module.grafana_agent_config["dealgood"].s3_object_id}"
     DealgoodImage                   = "${aws_ecr_repository.dealgood.repository_url}:${local.dealgood_image_tag}"
     DealgoodSecurityGroup           = aws_security_group.dealgood.id
     DealgoodTaskRoleArn             = aws_iam_role.dealgood.arn
+    EgressImage                     = "${aws_ecr_repository.egress.repository_url}:${local.egress_image_tag}"
     EcrBaseURL                      = aws_ecr_repository.thunderdome.repository_url
     EcsClusterArn                   = module.ecs-asg.cluster_id
     EcsExecutionRoleArn             = aws_iam_role.ecsTaskExecutionRole.arn
     EfsFileSystemID                 = aws_efs_file_system.thunderdome.id
     ExperimentsTableName            = aws_dynamodb_table.experiments.name
     PrometheusSecretArn             = data.aws_secretsmanager_secret.prometheus-secret.arn
+    KmsKeyArn                       = local.kms_key_arn
     IronbarAddr                     = "${aws_eip.ecs[0].public_ip}:${local.ironbar_port_number}"
     LogGroupName                    = aws_cloudwatch_log_group.logs.name
     RequestSNSTopicArn              = aws_sns_topic.gateway_requests.arn
+    SeederSecurityGroup             = aws_security_group.seeder.id
     TargetGrafanaAgentConfigURL     = "http://${module.s3_bucket_public.s3_bucket_bucket_domain_name}/${module.grafana_agent_config["target"].s3_object_id}"
+    TargetInstanceProfileArn        = aws_iam_instance_profile.target_instance.arn
+    TargetSecurityGroups            = [aws_security_group.target.id, aws_security_group.allow_ssh.id]
     TargetTaskRoleArn               = aws_iam_role.target.arn
+    VpcEndpointSecurityGroup        = aws_security_group.vpc_endpoints.id
+    VpcId                           = module.vpc.vpc_id
+    VpcPrivateSubnets               = module.vpc.private_subnets
     VpcPublicSubnet                 = module.vpc.public_subnets[0]
+    VpcPublicSubnets                = module.vpc.public_subnets
   })
 }
@@ -38,9 +38,9 @@ module "vpc" {
   name = "thunderdome"
   cidr = "10.0.0.0/16"
 
-  azs             = ["eu-west-1a"]
-  private_subnets = ["10.0.1.0/24"]
-  public_subnets  = ["10.0.100.0/24"]
+  azs             = ["eu-west-1a", "eu-west-1b", "eu-west-1c"]
+  private_subnets = ["10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"]
+  public_subnets  = ["10.0.100.0/24", "10.0.101.0/24", "10.0.102.0/24"]
 
   enable_ipv6 = true # This is mostly historic coincidence as we started out with it enabled
 
@@ -108,12 +108,18 @@ resource "aws_ecr_repository" "skyfish" {
   image_tag_mutability = "MUTABLE"
 }
 
+resource "aws_ecr_repository" "egress" {
+  name                 = "egress"
+  image_tag_mutability = "MUTABLE"
+}
+
 resource "aws_ecr_repository" "ironbar" {
   name                 = "ironbar"
   image_tag_mutability = "MUTABLE"
 }
 
 resource "aws_cloudwatch_log_group" "logs" {
-  name = "thunderdome"
+  name       = "thunderdome"
+  kms_key_id = local.kms_key_arn == "" ? null : local.kms_key_arn
 }
 
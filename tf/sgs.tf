@@ -42,6 +42,25 @@ resource "aws_security_group_rule" "target_allow_gateway" {
   source_security_group_id = aws_security_group.dealgood.id
 }
 
+resource "aws_security_group_rule" "target_allow_network_baseline" {
+  security_group_id        = aws_security_group.target.id
+  type                     = "ingress"
+  from_port                = 5201
+  to_port                  = 5201
+  protocol                 = "tcp"
+  source_security_group_id = aws_security_group.dealgood.id
+}
+
+resource "aws_security_group_rule" "target_allow_ironbar_debug" {
+  security_group_id        = aws_security_group.target.id
+  type                     = "ingress"
+  from_port                = 0
+  to_port                  = 65535
+  protocol                 = "tcp"
+  source_security_group_id = aws_security_group.ironbar.id
+  description              = "ironbar captures pprof profiles from the debug port of targets"
+}
+
 resource "aws_security_group" "dealgood" {
   name   = "dealgood"
   vpc_id = module.vpc.vpc_id
@@ -54,6 +73,58 @@ resource "aws_security_group" "dealgood" {
   }
 }
 
+resource "aws_security_group" "seeder" {
+  name   = "seeder"
+  vpc_id = module.vpc.vpc_id
+  egress {
+    from_port        = 0
+    to_port          = 0
+    protocol         = "-1"
+    cidr_blocks      = ["0.0.0.0/0"]
+    ipv6_cidr_blocks = ["::/0"]
+  }
+}
+
+resource "aws_security_group_rule" "seeder_allow_ipfs" {
+  security_group_id = aws_security_group.seeder.id
+  type              = "ingress"
+  from_port         = 4001
+  to_port           = 4001
+  protocol          = "tcp"
+  cidr_blocks       = ["0.0.0.0/0"]
+  ipv6_cidr_blocks  = ["::/0"]
+}
+
+resource "aws_security_group_rule" "seeder_allow_ipfs_udp" {
+  security_group_id = aws_security_group.seeder.id
+  type              = "ingress"
+  from_port         = 4001
+  to_port           = 4001
+  protocol          = "udp"
+  cidr_blocks       = ["0.0.0.0/0"]
+  ipv6_cidr_blocks  = ["::/0"]
+}
+
+resource "aws_security_group_rule" "seeder_allow_dealgood" {
+  security_group_id        = aws_security_group.seeder.id
+  type                     = "ingress"
+  from_port                = 8090
+  to_port                  = 8090
+  protocol                 = "tcp"
+  source_security_group_id = aws_security_group.dealgood.id
+  description              = "dealgood fetches the cids of seeded content"
+}
+
+resource "aws_security_group_rule" "seeder_allow_target" {
+  security_group_id        = aws_security_group.seeder.id
+  type                     = "ingress"
+  from_port                = 8090
+  to_port                  = 8090
+  protocol                 = "tcp"
+  source_security_group_id = aws_security_group.target.id
+  description              = "targets fetch the peering details of content providers"
+}
+
 resource "aws_security_group" "skyfish" {
   name   = "skyfish"
   vpc_id = module.vpc.vpc_id
@@ -183,3 +254,18 @@ resource "aws_security_group" "alb" {
     ipv6_cidr_blocks  = ["::/0"]
   }
 }
+
+# interface endpoints created by thunderdome for experiments with private networking
+resource "aws_security_group" "vpc_endpoints" {
+  name   = "vpc-endpoints"
+  vpc_id = module.vpc.vpc_id
+}
+
+resource "aws_security_group_rule" "vpc_endpoints_allow_https" {
+  security_group_id = aws_security_group.vpc_endpoints.id
+  type              = "ingress"
+  from_port         = 443
+  to_port           = 443
+  protocol          = "tcp"
+  cidr_blocks       = [module.vpc.vpc_cidr_block]
+}
@@ -1,6 +1,7 @@
 resource "aws_sns_topic" "gateway_requests" {
-  name            = "gateway-requests"
-  delivery_policy = <<EOF
+  name              = "gateway-requests"
+  kms_master_key_id = local.kms_key_arn == "" ? null : local.kms_key_arn
+  delivery_policy   = <<EOF
 {
   "http": {
     "defaultHealthyRetryPolicy": {